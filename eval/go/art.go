@@ -0,0 +1,705 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* keys are ints, compared as 8 big-endian bytes with the sign bit flipped */
+const ART_KEY_LEN int = 8
+
+/* kinds of art_node_t */
+const (
+	ART_LEAF int = iota
+	ART_NODE4
+	ART_NODE16
+	ART_NODE48
+	ART_NODE256
+)
+
+type art_node4_t struct {
+	keys     [4]byte /* sorted */
+	children [4]*art_node_t
+}
+
+type art_node16_t struct {
+	keys     [16]byte /* sorted */
+	children [16]*art_node_t
+}
+
+type art_node48_t struct {
+	index    [256]byte /* 1 + position in children of each byte, 0 if none */
+	children [48]*art_node_t
+}
+
+type art_node256_t struct {
+	children [256]*art_node_t
+}
+
+/*
+ * art_node_t -- a leaf or an inner node; an inner node keeps its header when
+ * it grows or shrinks and only its body, the one of n4..n256 matching kind,
+ * is replaced, so the pointer of its parent stays valid
+ */
+type art_node_t struct {
+	kind int
+
+	/* leaves */
+	key   int
+	value int
+
+	/* inner nodes */
+	n          int /* number of children */
+	prefix     [ART_KEY_LEN]byte /* key bytes shared by all the children */
+	prefix_len int
+	n4         *art_node4_t
+	n16        *art_node16_t
+	n48        *art_node48_t
+	n256       *art_node256_t
+}
+
+type data struct {
+	root  *art_node_t
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x4A27C1E85D3B96F0
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.root = nil
+		ptr.magic = magic
+	}
+}
+
+/*
+ * art_key -- (internal) returns the bytes of key in the order of the ints
+ */
+func art_key(key int) [ART_KEY_LEN]byte {
+	var k [ART_KEY_LEN]byte
+	binary.BigEndian.PutUint64(k[:], uint64(key) ^ (1 << 63))
+	return k
+}
+
+/*
+ * art_new_leaf -- (internal) allocates a leaf
+ */
+func art_new_leaf(key int, value int) *art_node_t {
+	l := pnew(art_node_t)
+	l.kind = ART_LEAF
+	l.key = key
+	l.value = value
+	return l
+}
+
+/*
+ * art_new_body -- (internal) allocates the body of an inner node_t of kind
+ * into the fields of body, which is not linked anywhere yet
+ */
+func art_new_body(body *art_node_t, kind int) {
+	switch kind {
+	case ART_NODE4:
+		body.n4 = pnew(art_node4_t)
+	case ART_NODE16:
+		body.n16 = pnew(art_node16_t)
+	case ART_NODE48:
+		body.n48 = pnew(art_node48_t)
+	default:
+		body.n256 = pnew(art_node256_t)
+	}
+}
+
+/*
+ * art_new_node4 -- (internal) allocates an empty Node4 with the prefix
+ */
+func art_new_node4(prefix []byte) *art_node_t {
+	n := pnew(art_node_t)
+	art_new_body(n, ART_NODE4)
+	n.kind = ART_NODE4
+	n.prefix_len = copy(n.prefix[:], prefix)
+	return n
+}
+
+/*
+ * art_find_child -- (internal) returns the slot of the child of n for the key
+ * byte b, or nil
+ */
+func art_find_child(n *art_node_t, b byte) **art_node_t {
+	switch n.kind {
+	case ART_NODE4:
+		for i := 0; i < n.n; i++ {
+			if n.n4.keys[i] == b {
+				return &n.n4.children[i]
+			}
+		}
+	case ART_NODE16:
+		for i := 0; i < n.n; i++ {
+			if n.n16.keys[i] == b {
+				return &n.n16.children[i]
+			}
+		}
+	case ART_NODE48:
+		if i := n.n48.index[b]; i != 0 {
+			return &n.n48.children[i - 1]
+		}
+	case ART_NODE256:
+		if n.n256.children[b] != nil {
+			return &n.n256.children[b]
+		}
+	}
+	return nil
+}
+
+/*
+ * art_children -- (internal) returns the key bytes and the children of n in
+ * key order
+ */
+func art_children(n *art_node_t) ([]byte, []*art_node_t) {
+	switch n.kind {
+	case ART_NODE4:
+		return n.n4.keys[:n.n], n.n4.children[:n.n]
+	case ART_NODE16:
+		return n.n16.keys[:n.n], n.n16.children[:n.n]
+	}
+	keys := make([]byte, 0, n.n)
+	children := make([]*art_node_t, 0, n.n)
+	for b := 0; b < 256; b++ {
+		var child *art_node_t = nil
+		if n.kind == ART_NODE48 {
+			if i := n.n48.index[b]; i != 0 {
+				child = n.n48.children[i - 1]
+			}
+		} else {
+			child = n.n256.children[b]
+		}
+		if child != nil {
+			keys = append(keys, byte(b))
+			children = append(children, child)
+		}
+	}
+	return keys, children
+}
+
+/*
+ * art_sorted_insert -- (internal) inserts the pair at its place among the
+ * first n sorted keys of a Node4 or Node16
+ */
+func art_sorted_insert(keys []byte, children []*art_node_t, n int, b byte,
+	child *art_node_t) {
+	i := 0
+	for i < n && keys[i] < b {
+		i++
+	}
+	copy(keys[i + 1:n + 1], keys[i:n])
+	copy(children[i + 1:n + 1], children[i:n])
+	keys[i] = b
+	children[i] = child
+}
+
+/*
+ * art_set_body -- (internal) replaces the body of n with the one of kind
+ * holding the given children, which must fit; n is left unchanged if the
+ * allocation of the new body panics
+ */
+func art_set_body(n *art_node_t, kind int, keys []byte, children []*art_node_t) {
+	var body art_node_t
+	art_new_body(&body, kind)
+	for i, b := range keys {
+		switch kind {
+		case ART_NODE4:
+			body.n4.keys[i] = b
+			body.n4.children[i] = children[i]
+		case ART_NODE16:
+			body.n16.keys[i] = b
+			body.n16.children[i] = children[i]
+		case ART_NODE48:
+			body.n48.index[b] = byte(i + 1)
+			body.n48.children[i] = children[i]
+		case ART_NODE256:
+			body.n256.children[b] = children[i]
+		}
+	}
+	n.kind = kind
+	n.n = len(keys)
+	n.n4, n.n16, n.n48, n.n256 = body.n4, body.n16, body.n48, body.n256
+}
+
+/*
+ * art_add_child -- (internal) adds the child for the key byte b to n, growing
+ * n into the next kind if it is full
+ */
+func art_add_child(n *art_node_t, b byte, child *art_node_t) {
+	switch {
+	case n.kind == ART_NODE4 && n.n < 4:
+		art_sorted_insert(n.n4.keys[:], n.n4.children[:], n.n, b, child)
+	case n.kind == ART_NODE16 && n.n < 16:
+		art_sorted_insert(n.n16.keys[:], n.n16.children[:], n.n, b, child)
+	case n.kind == ART_NODE48 && n.n < 48:
+		i := 0
+		for n.n48.children[i] != nil {
+			i++
+		}
+		n.n48.children[i] = child
+		n.n48.index[b] = byte(i + 1)
+	case n.kind == ART_NODE256:
+		n.n256.children[b] = child
+	default:
+		keys, children := art_children(n)
+		keys = append(append([]byte{}, keys...), b)
+		children = append(append([]*art_node_t{}, children...), child)
+		if n.kind != ART_NODE48 {
+			/* the new pair goes at its place in the sorted keys */
+			for i := len(keys) - 1; i > 0 && keys[i - 1] > b; i-- {
+				keys[i], keys[i - 1] = keys[i - 1], keys[i]
+				children[i], children[i - 1] = children[i - 1], children[i]
+			}
+		}
+		art_set_body(n, n.kind + 1, keys, children)
+		return
+	}
+	n.n++
+}
+
+/*
+ * art_remove_child -- (internal) removes the child for the key byte b from n
+ * and shrinks n into the previous kind once it is sparse enough; a Node4 left
+ * with a single child is replaced in ref by that child
+ */
+func art_remove_child(ref **art_node_t, b byte) {
+	n := *ref
+	switch n.kind {
+	case ART_NODE4, ART_NODE16:
+		var keys []byte
+		var children []*art_node_t
+		if n.kind == ART_NODE4 {
+			keys, children = n.n4.keys[:], n.n4.children[:]
+		} else {
+			keys, children = n.n16.keys[:], n.n16.children[:]
+		}
+		i := 0
+		for keys[i] != b {
+			i++
+		}
+		copy(keys[i:n.n - 1], keys[i + 1:n.n])
+		copy(children[i:n.n - 1], children[i + 1:n.n])
+		children[n.n - 1] = nil
+	case ART_NODE48:
+		n.n48.children[n.n48.index[b] - 1] = nil
+		n.n48.index[b] = 0
+	case ART_NODE256:
+		n.n256.children[b] = nil
+	}
+	n.n--
+
+	/* shrinking is only an optimization, it is skipped if the pool is full */
+	switch {
+	case n.kind == ART_NODE256 && n.n <= 36,
+		n.kind == ART_NODE48 && n.n <= 12,
+		n.kind == ART_NODE16 && n.n <= 3:
+		keys, children := art_children(n)
+		func() {
+			var full error
+			defer pool_full(&full)
+			art_set_body(n, n.kind - 1, append([]byte{}, keys...),
+				append([]*art_node_t{}, children...))
+		}()
+	case n.kind == ART_NODE4 && n.n == 1:
+		child := n.n4.children[0]
+		if child.kind != ART_LEAF {
+			/* the child takes over the prefix of n and its own key byte */
+			var prefix [ART_KEY_LEN]byte
+			l := copy(prefix[:], n.prefix[:n.prefix_len])
+			prefix[l] = n.n4.keys[0]
+			copy(prefix[l + 1:], child.prefix[:child.prefix_len])
+			child.prefix = prefix
+			child.prefix_len += l + 1
+		}
+		*ref = child
+	}
+}
+
+/*
+ * art_prefix_mismatch -- (internal) returns the length of the part of the
+ * prefix of n which matches the key from depth on
+ */
+func art_prefix_mismatch(n *art_node_t, k *[ART_KEY_LEN]byte, depth int) int {
+	i := 0
+	for i < n.prefix_len && n.prefix[i] == k[depth + i] {
+		i++
+	}
+	return i
+}
+
+/*
+ * art_insert_at -- (internal) inserts the pair into the subtree in ref, whose
+ * key bytes before depth match; all allocations happen before the first
+ * update, so a full pool leaves the tree unchanged
+ */
+func art_insert_at(ref **art_node_t, k *[ART_KEY_LEN]byte, key int, value int,
+	depth int) {
+	n := *ref
+	if n == nil {
+		*ref = art_new_leaf(key, value)
+		return
+	}
+
+	if n.kind == ART_LEAF {
+		if n.key == key {
+			n.value = value
+			return
+		}
+		/* the two leaves part at the first byte where their keys differ */
+		other := art_key(n.key)
+		l := depth
+		for other[l] == k[l] {
+			l++
+		}
+		leaf := art_new_leaf(key, value)
+		inner := art_new_node4(k[depth:l])
+		art_add_child(inner, other[l], n)
+		art_add_child(inner, k[l], leaf)
+		*ref = inner
+		return
+	}
+
+	if p := art_prefix_mismatch(n, k, depth); p < n.prefix_len {
+		/* the key leaves the prefix of n, which is split at p */
+		leaf := art_new_leaf(key, value)
+		inner := art_new_node4(n.prefix[:p])
+		b := n.prefix[p]
+		copy(n.prefix[:], n.prefix[p + 1:n.prefix_len])
+		n.prefix_len -= p + 1
+		art_add_child(inner, b, n)
+		art_add_child(inner, k[depth + p], leaf)
+		*ref = inner
+		return
+	}
+	depth += n.prefix_len
+
+	if child := art_find_child(n, k[depth]); child != nil {
+		art_insert_at(child, k, key, value, depth + 1)
+	} else {
+		leaf := art_new_leaf(key, value)
+		art_add_child(n, k[depth], leaf)
+	}
+}
+
+/*
+ * art_insert -- inserts a key-value pair, replacing the value of the key if
+ * it is present; returns ErrPoolFull, leaving the tree unchanged, if the pool
+ * has no room for the new nodes
+ */
+func art_insert(ptr *data, key int, value int) (err error) {
+	defer pool_full(&err)
+	k := art_key(key)
+	txn("undo") {
+		art_insert_at(&ptr.root, &k, key, value, 0)
+	}
+	return nil
+}
+
+/*
+ * art_remove_at -- (internal) removes the key from the subtree in ref, whose
+ * key bytes before depth match
+ */
+func art_remove_at(ref **art_node_t, k *[ART_KEY_LEN]byte, key int,
+	depth int) (int, bool) {
+	n := *ref
+	if n.kind == ART_LEAF {
+		if n.key != key {
+			return 0, false
+		}
+		*ref = nil
+		return n.value, true
+	}
+
+	if art_prefix_mismatch(n, k, depth) < n.prefix_len {
+		return 0, false
+	}
+	depth += n.prefix_len
+
+	child := art_find_child(n, k[depth])
+	if child == nil {
+		return 0, false
+	}
+	if (*child).kind != ART_LEAF {
+		return art_remove_at(child, k, key, depth + 1)
+	}
+	if (*child).key != key {
+		return 0, false
+	}
+	value := (*child).value
+	art_remove_child(ref, k[depth])
+	return value, true
+}
+
+/*
+ * art_remove -- removes the key from the tree, returning its value and
+ * whether it was found
+ */
+func art_remove(ptr *data, key int) (int, bool) {
+	if ptr.root == nil {
+		return 0, false
+	}
+	k := art_key(key)
+	value, found := 0, false
+	txn("undo") {
+		value, found = art_remove_at(&ptr.root, &k, key, 0)
+	}
+	return value, found
+}
+
+/*
+ * art_get -- searches for the value of the key
+ */
+func art_get(ptr *data, key int) (int, bool) {
+	k := art_key(key)
+	n := ptr.root
+	depth := 0
+	for n != nil && n.kind != ART_LEAF {
+		if art_prefix_mismatch(n, &k, depth) < n.prefix_len {
+			return 0, false
+		}
+		depth += n.prefix_len
+		child := art_find_child(n, k[depth])
+		if child == nil {
+			return 0, false
+		}
+		n = *child
+		depth++
+	}
+	if n != nil && n.key == key {
+		return n.value, true
+	}
+	return 0, false
+}
+
+/*
+ * art_lookup -- checks if the key exists in the tree
+ */
+func art_lookup(ptr *data, key int) bool {
+	_, ok := art_get(ptr, key)
+	return ok
+}
+
+/*
+ * art_foreach_node -- (internal) recursively traverses a subtree in order
+ */
+func art_foreach_node(n *art_node_t, cb func(int, int) bool) bool {
+	if n == nil {
+		return false
+	}
+	if n.kind == ART_LEAF {
+		return cb(n.key, n.value)
+	}
+	_, children := art_children(n)
+	for _, child := range children {
+		if art_foreach_node(child, cb) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * art_foreach -- calls cb for every pair in key order, stopping early when cb
+ * returns true
+ */
+func art_foreach(ptr *data, cb func(int, int) bool) bool {
+	return art_foreach_node(ptr.root, cb)
+}
+
+/*
+ * art_clear -- removes all pairs from the tree
+ */
+func art_clear(ptr *data) {
+	txn("undo") {
+		ptr.root = nil
+	}
+}
+
+/*
+ * art_check_node -- (internal) verifies a subtree whose key bytes before
+ * depth are those of prefix, counting its nodes of every kind in kinds
+ */
+func art_check_node(n *art_node_t, prefix []byte, depth int, kinds *[5]int) error {
+	kinds[n.kind]++
+	if n.kind == ART_LEAF {
+		k := art_key(n.key)
+		if string(k[:depth]) != string(prefix) {
+			return fmt.Errorf("key %d is under the prefix %x", n.key, prefix)
+		}
+		return nil
+	}
+
+	limits := [...]int{ART_NODE4: 4, ART_NODE16: 16, ART_NODE48: 48, ART_NODE256: 256}
+	keys, children := art_children(n)
+	if len(keys) != n.n || n.n < 2 || n.n > limits[n.kind] {
+		return fmt.Errorf("node of kind %d at depth %d counts %d children, holds %d",
+			n.kind, depth, n.n, len(keys))
+	}
+	prefix = append(prefix, n.prefix[:n.prefix_len]...)
+	depth += n.prefix_len
+	for i, child := range children {
+		if i > 0 && keys[i - 1] >= keys[i] {
+			return fmt.Errorf("key bytes %x out of order at depth %d", keys, depth)
+		}
+		if err := art_check_node(child, append(prefix, keys[i]), depth + 1, kinds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * art_check -- verifies the whole tree and returns the number of its nodes of
+ * every kind, indexed by kind
+ */
+func art_check(ptr *data) ([5]int, error) {
+	var kinds [5]int
+	if ptr.root == nil {
+		return kinds, nil
+	}
+	return kinds, art_check_node(ptr.root, nil, 0, &kinds)
+}
+
+/*
+ * str_insert -- art_insert wrapper which works on strings
+ */
+func str_insert(ptr *data, str string) {
+	var key int
+	if scan_args("insert", str, "%d", &key) {
+		if err := art_insert(ptr, key, 0); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- art_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key int
+	if scan_args("remove", str, "%d", &key) {
+		if _, ok := art_remove(ptr, key); !ok {
+			fmt.Println("no such value")
+		}
+	}
+}
+
+/*
+ * str_check -- art_lookup wrapper which works on strings
+ */
+func str_check(ptr *data, str string) {
+	var key int
+	if scan_args("check", str, "%d", &key) {
+		fmt.Println(art_lookup(ptr, key))
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := art_insert(ptr, rand.Int(), 0); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"i $value - insert $value",
+		"r $value - remove $value",
+		"c $value - check $value, returns 0/1",
+		"n $value - insert $value random values",
+		"p - print all values",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	art_foreach(ptr, func(key int, value int) bool {
+		fmt.Print(key, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	kinds, err := art_check(ptr)
+	if err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+	}
+	fmt.Println("leaves:", kinds[ART_LEAF])
+	fmt.Println("Node4:", kinds[ART_NODE4], "Node16:", kinds[ART_NODE16],
+		"Node48:", kinds[ART_NODE48], "Node256:", kinds[ART_NODE256])
+}
+
+/*
+ * Run -- opens the tree named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("art", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'c': str_check(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': art_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
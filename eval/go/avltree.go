@@ -0,0 +1,401 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"strconv"
+
+	"github.com/vmware/go-pmem-transaction/pmem"
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+// node is a node of an AVL tree: the heights of the subtrees of a node differ
+// by at most one, which keeps lookups logarithmic even for sorted inserts.
+type node struct {
+	key    int
+	value  [32]byte
+	height int // of the subtree, 1 for a leaf
+	slots  [2]*node
+}
+
+type data struct {
+	root  *node
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x3E6D1A9C5B27F840
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.root = nil
+		ptr.magic = magic
+	}
+}
+
+func height(n *node) int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+func fix_height(n *node) {
+	h := height(n.slots[0])
+	if r := height(n.slots[1]); r > h {
+		h = r
+	}
+	n.height = h + 1
+}
+
+// rotate moves n down to its slot d, lifting its other child into its
+// place, and returns that child.
+func rotate(n *node, d int) *node {
+	child := n.slots[1-d]
+	n.slots[1-d] = child.slots[d]
+	child.slots[d] = n
+	fix_height(n)
+	fix_height(child)
+	return child
+}
+
+// balance restores the height difference of at most one at n, whose
+// subtrees are balanced and differ by at most two, and returns the root of
+// the subtree.
+func balance(n *node) *node {
+	for d := 0; d < 2; d++ {
+		if height(n.slots[d])-height(n.slots[1-d]) > 1 {
+			child := n.slots[d]
+			if height(child.slots[1-d]) > height(child.slots[d]) {
+				n.slots[d] = rotate(child, d)
+			}
+			return rotate(n, 1-d)
+		}
+	}
+	fix_height(n)
+	return n
+}
+
+func insert_node(n *node, key int, value string) *node {
+	if n == nil {
+		n = pnew(node)
+		n.key = key
+		copy(n.value[:], value)
+		n.height = 1
+		return n
+	}
+	if key == n.key {
+		n.value = [32]byte{}
+		copy(n.value[:], value)
+		return n
+	}
+	i := 0
+	if key > n.key {
+		i = 1
+	}
+	n.slots[i] = insert_node(n.slots[i], key, value)
+	return balance(n)
+}
+
+// insert adds key with value, or replaces the value of key, rebalancing the
+// path to it in the same transaction. Nothing is changed if the pool is full.
+func insert(ptr **node, key int, value string) (err error) {
+	// a full pool panics in pnew, and the transaction is rolled back
+	defer pool_full(&err)
+	txn("undo") {
+		*ptr = insert_node(*ptr, key, value)
+	}
+	return nil
+}
+
+// remove_min unlinks the node with the smallest key from the subtree of n
+// and returns the new root of the subtree.
+func remove_min(n *node) *node {
+	if n.slots[0] == nil {
+		return n.slots[1]
+	}
+	n.slots[0] = remove_min(n.slots[0])
+	return balance(n)
+}
+
+func remove_node(n *node, key int) (*node, bool) {
+	if n == nil {
+		return nil, false
+	}
+	if key != n.key {
+		i := 0
+		if key > n.key {
+			i = 1
+		}
+		child, found := remove_node(n.slots[i], key)
+		if !found {
+			return n, false
+		}
+		n.slots[i] = child
+		return balance(n), true
+	}
+	if n.slots[0] == nil {
+		return n.slots[1], true
+	}
+	if n.slots[1] == nil {
+		return n.slots[0], true
+	}
+	// the successor of n takes its place
+	m := n.slots[1]
+	for m.slots[0] != nil {
+		m = m.slots[0]
+	}
+	m.slots[1] = remove_min(n.slots[1])
+	m.slots[0] = n.slots[0]
+	return balance(m), true
+}
+
+// remove deletes key from the tree, rebalancing the path to it in the same
+// transaction, and returns whether it was found.
+func remove(ptr **node, key int) bool {
+	found := false
+	txn("undo") {
+		var n *node
+		if n, found = remove_node(*ptr, key); found {
+			*ptr = n
+		}
+	}
+	return found
+}
+
+func find(ptr *node, key int) *node {
+	for ptr != nil && ptr.key != key {
+		i := 0
+		if key > ptr.key {
+			i = 1
+		}
+		ptr = ptr.slots[i]
+	}
+	return ptr
+}
+
+// foreach calls cb for the nodes of the subtree of n in key order, stopping
+// early when cb returns true.
+func foreach(n *node, cb func(*node) bool) bool {
+	if n == nil {
+		return false
+	}
+	return foreach(n.slots[0], cb) || cb(n) || foreach(n.slots[1], cb)
+}
+
+func print_node(ptr *node) {
+	foreach(ptr, func(n *node) bool {
+		print(string(n.value[:]), " ")
+		return false
+	})
+}
+
+// validate_node checks that the keys of the subtree of n are strictly
+// between lo and hi, where nil is no bound, that its stored heights are
+// right and that it is balanced, and that no node is reached twice. It
+// returns the height of the subtree.
+func validate_node(n *node, lo *int, hi *int, seen map[*node]bool) (int, error) {
+	if n == nil {
+		return 0, nil
+	}
+	if seen[n] {
+		return 0, errors.New("node of key " + strconv.Itoa(n.key) + " is reachable twice")
+	}
+	seen[n] = true
+	if (lo != nil && n.key <= *lo) || (hi != nil && n.key >= *hi) {
+		return 0, errors.New("key " + strconv.Itoa(n.key) + " is out of order")
+	}
+	l, err := validate_node(n.slots[0], lo, &n.key, seen)
+	if err != nil {
+		return 0, err
+	}
+	r, err := validate_node(n.slots[1], &n.key, hi, seen)
+	if err != nil {
+		return 0, err
+	}
+	if l-r > 1 || r-l > 1 {
+		return 0, errors.New("key " + strconv.Itoa(n.key) + " is unbalanced")
+	}
+	h := l + 1
+	if r >= l {
+		h = r + 1
+	}
+	if n.height != h {
+		return 0, errors.New("key " + strconv.Itoa(n.key) + " has height " +
+			strconv.Itoa(n.height) + " instead of " + strconv.Itoa(h))
+	}
+	return h, nil
+}
+
+// validate opens the existing pool at path without initializing or changing
+// it and reports the result of every check, returning an error if one
+// fails. go-pmem has no read-only mapping, and opening the pool still rolls
+// back a transaction left unfinished by a crash.
+func validate(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return pool_error(err.Error())
+	}
+	pmem.Init(path)
+	var ptr *data
+	ptr = (*data)(pmem.Get("root", ptr))
+	if ptr == nil {
+		return pool_error("no root object in " + path)
+	}
+
+	failed := false
+	report := func(check string, err error) {
+		if err != nil {
+			println(check+": FAILED,", err.Error())
+			failed = true
+		} else {
+			println(check + ": ok")
+		}
+	}
+
+	if ptr.magic != magic {
+		report("magic", errors.New("the root object was never initialized"))
+	} else {
+		report("magic", nil)
+		h, err := validate_node(ptr.root, nil, nil, make(map[*node]bool))
+		report("balance", err)
+		if err == nil {
+			println("height:", h)
+		}
+	}
+
+	if failed {
+		return pool_error(path + " failed validation")
+	}
+	return nil
+}
+
+// Run opens the pool named in args (the command line without the program
+// name) and performs the requested operation on it.
+func Run(args []string) error {
+	flags := flag.NewFlagSet("avltree", flag.ContinueOnError)
+	flags.Usage = func() {}
+	cpuprofile := flags.String("cpuprofile", "", "write a CPU profile of the operation to `file`")
+	memprofile := flags.String("memprofile", "", "write a heap profile to `file` on exit")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+
+	if len(args) < 2 || len(args[1]) == 0 {
+		return ErrUsage
+	}
+
+	if args[1] == "v" {
+		if len(args) != 2 {
+			return ErrUsage
+		}
+		return validate(args[0])
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	stop, err := start_profiling(*cpuprofile, *memprofile)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	op := args[1][0]
+	switch op {
+	case 'p':
+		print_node(ptr.root)
+		println()
+	case 'i':
+		if len(args) != 4 {
+			return ErrUsage
+		}
+		key, err := strconv.Atoi(args[2])
+		if err != nil {
+			return err
+		}
+		return insert(&ptr.root, key, args[3])
+	case 'd':
+		if len(args) != 3 {
+			return ErrUsage
+		}
+		key, err := strconv.Atoi(args[2])
+		if err != nil {
+			return err
+		}
+		if !remove(&ptr.root, key) {
+			println("not found")
+		}
+	case 'f':
+		if len(args) != 3 {
+			return ErrUsage
+		}
+		key, err := strconv.Atoi(args[2])
+		if err != nil {
+			return err
+		}
+		p := find(ptr.root, key)
+		if p != nil {
+			println(string(p.value[:]))
+		} else {
+			println("not found")
+		}
+	case 's':
+		if len(args) != 3 {
+			return ErrUsage
+		}
+		len, err := strconv.Atoi(args[2])
+		if err != nil {
+			return err
+		}
+		for k := 0; k < len; k++ {
+			if is_interrupted() {
+				return ErrInterrupted
+			}
+			if err := insert(&ptr.root, k, "test"); err != nil {
+				return err
+			}
+		}
+	case 'r':
+		if len(args) != 3 {
+			return ErrUsage
+		}
+		len, err := strconv.Atoi(args[2])
+		if err != nil {
+			return err
+		}
+		var p *node = nil
+		for k := 0; k < len; k++ {
+			p = find(ptr.root, k)
+		}
+		if p != nil {
+			println("value = ", string(p.value[:]))
+		}
+	default:
+		return usage_error("invalid operation " + args[1])
+	}
+	return nil
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		println("usage:", os.Args[0], "[-cpuprofile file] [-memprofile file] filename [p|i|f|d|s|r|v] [key] [value]")
+		println("v checks the pool without writing to it, but opening it still rolls back a transaction left unfinished by a crash")
+	} else if err != nil {
+		println(err.Error())
+	}
+	shutdown(exit_status(err))
+}
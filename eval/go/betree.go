@@ -0,0 +1,700 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* most children of an internal node */
+const BE_FANOUT int = 4
+
+/* most pairs of a leaf */
+const BE_LEAF int = 8
+
+/* most messages buffered in an internal node once an update is done */
+const BE_BUFFER int = 8
+
+/*
+ * msg_t -- a pending update of key, newer than anything below the node
+ * buffering it
+ */
+type msg_t struct {
+	key    int
+	value  int
+	remove bool
+}
+
+/*
+ * node_t -- a leaf holds sorted pairs in keys and values; an internal node
+ * holds len(pivots) + 1 children, child i holding the keys from pivots[i-1]
+ * up to but not including pivots[i], and a buffer of messages sorted by
+ * key, at most one per key; the slices are never grown in place, a new one
+ * replaces the old in the transaction of the update
+ */
+type node_t struct {
+	leaf     bool
+	keys     []int
+	values   []int
+	pivots   []int
+	children []*node_t
+	msgs     []msg_t
+}
+
+type data struct {
+	root  *node_t
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x0B6E3F91D27A8C54
+)
+
+/* messages moved and nodes split since the tree was opened */
+var be_moved, be_flushes, be_splits int
+
+/*
+ * be_new_node -- (internal) allocates an empty node; must be called in a
+ * transaction
+ */
+func be_new_node(leaf bool) *node_t {
+	n := pnew(node_t)
+	n.leaf = leaf
+	return n
+}
+
+/*
+ * be_ints -- (internal) allocates a persistent copy of s; must be called in a
+ * transaction
+ */
+func be_ints(s []int) []int {
+	if len(s) == 0 {
+		return nil
+	}
+	p := pmake([]int, len(s))
+	copy(p, s)
+	return p
+}
+
+/*
+ * be_nodes -- (internal) be_ints for children
+ */
+func be_nodes(s []*node_t) []*node_t {
+	p := pmake([]*node_t, len(s))
+	copy(p, s)
+	return p
+}
+
+/*
+ * be_msgs -- (internal) be_ints for messages
+ */
+func be_msgs(s []msg_t) []msg_t {
+	if len(s) == 0 {
+		return nil
+	}
+	p := pmake([]msg_t, len(s))
+	copy(p, s)
+	return p
+}
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.root = pnew(node_t)
+		ptr.root.leaf = true
+		ptr.magic = magic
+	}
+}
+
+/*
+ * be_route -- (internal) returns the child of internal node n which holds
+ * key
+ */
+func be_route(n *node_t, key int) int {
+	return sort.Search(len(n.pivots), func(i int) bool { return n.pivots[i] > key })
+}
+
+/*
+ * be_leaf_apply -- (internal) applies the message m to leaf n; must be
+ * called in a transaction
+ */
+func be_leaf_apply(n *node_t, m msg_t) {
+	i := sort.SearchInts(n.keys, m.key)
+	found := i < len(n.keys) && n.keys[i] == m.key
+	switch {
+	case found && m.remove:
+		keys := make([]int, 0, len(n.keys) - 1)
+		values := make([]int, 0, len(n.keys) - 1)
+		keys = append(append(keys, n.keys[:i]...), n.keys[i + 1:]...)
+		values = append(append(values, n.values[:i]...), n.values[i + 1:]...)
+		n.keys, n.values = be_ints(keys), be_ints(values)
+	case found:
+		n.values[i] = m.value
+	case !m.remove:
+		keys := make([]int, 0, len(n.keys) + 1)
+		values := make([]int, 0, len(n.keys) + 1)
+		keys = append(append(append(keys, n.keys[:i]...), m.key), n.keys[i:]...)
+		values = append(append(append(values, n.values[:i]...), m.value), n.values[i:]...)
+		n.keys, n.values = be_ints(keys), be_ints(values)
+	}
+}
+
+/*
+ * be_merge_msgs -- (internal) returns the messages of old and new sorted by
+ * key, those of new replacing those of old for the same key
+ */
+func be_merge_msgs(old []msg_t, new []msg_t) []msg_t {
+	merged := make([]msg_t, 0, len(old) + len(new))
+	i, j := 0, 0
+	for i < len(old) || j < len(new) {
+		switch {
+		case j == len(new) || (i < len(old) && old[i].key < new[j].key):
+			merged = append(merged, old[i])
+			i++
+		case i == len(old) || new[j].key < old[i].key:
+			merged = append(merged, new[j])
+			j++
+		default:
+			merged = append(merged, new[j])
+			i++
+			j++
+		}
+	}
+	return merged
+}
+
+/*
+ * be_split -- (internal) splits n, if it holds more than a node may, into
+ * as few nodes as can hold its contents, and returns them with the pivots
+ * separating them; n is reused as the first; must be called in a
+ * transaction
+ */
+func be_split(n *node_t) ([]*node_t, []int) {
+	size, max := len(n.keys), BE_LEAF
+	if !n.leaf {
+		size, max = len(n.children), BE_FANOUT
+	}
+	if size <= max {
+		return []*node_t{n}, nil
+	}
+	parts := (size + max - 1) / max
+	nodes := make([]*node_t, parts)
+	var pivots []int
+	if n.leaf {
+		keys, values := n.keys, n.values
+		for p := 0; p < parts; p++ {
+			lo, hi := p * size / parts, (p + 1) * size / parts
+			nodes[p] = n
+			if p > 0 {
+				nodes[p] = be_new_node(true)
+				pivots = append(pivots, keys[lo])
+			}
+			nodes[p].keys = be_ints(keys[lo:hi])
+			nodes[p].values = be_ints(values[lo:hi])
+		}
+	} else {
+		children, seps, msgs := n.children, n.pivots, n.msgs
+		for p := 0; p < parts; p++ {
+			lo, hi := p * size / parts, (p + 1) * size / parts
+			nodes[p] = n
+			if p > 0 {
+				nodes[p] = be_new_node(false)
+				pivots = append(pivots, seps[lo - 1])
+			}
+			nodes[p].children = be_nodes(children[lo:hi])
+			nodes[p].pivots = be_ints(seps[lo:hi - 1])
+			end := len(msgs)
+			if hi < size {
+				end = sort.Search(len(msgs), func(i int) bool { return msgs[i].key >= seps[hi - 1] })
+			}
+			nodes[p].msgs = be_msgs(msgs[:end])
+			msgs = msgs[end:]
+		}
+	}
+	be_splits += parts - 1
+	return nodes, pivots
+}
+
+/*
+ * be_flush -- (internal) moves messages from the buffer of internal node n
+ * to its children until at most limit are left, each time the whole batch
+ * for the child with the most pending; a child receiving a batch applies it
+ * if it is a leaf and flushes in turn if its buffer is over BE_BUFFER, and
+ * is split if it grows too large, which may leave n with too many children
+ * for its parent to split; must be called in a transaction
+ */
+func be_flush(n *node_t, limit int) {
+	for len(n.msgs) > limit {
+		best, lo, hi := 0, 0, 0
+		for i, start := 0, 0; i <= len(n.pivots); i++ {
+			end := len(n.msgs)
+			if i < len(n.pivots) {
+				p := n.pivots[i]
+				end = start + sort.Search(len(n.msgs) - start, func(j int) bool {
+					return n.msgs[start + j].key >= p
+				})
+			}
+			if end - start > hi - lo {
+				best, lo, hi = i, start, end
+			}
+			start = end
+		}
+
+		batch := n.msgs[lo:hi]
+		c := n.children[best]
+		if c.leaf {
+			for _, m := range batch {
+				be_leaf_apply(c, m)
+			}
+		} else {
+			c.msgs = be_msgs(be_merge_msgs(c.msgs, batch))
+			be_flush(c, min_limit(limit, BE_BUFFER))
+		}
+		be_moved += len(batch)
+		be_flushes++
+
+		msgs := make([]msg_t, 0, len(n.msgs) - len(batch))
+		msgs = append(append(msgs, n.msgs[:lo]...), n.msgs[hi:]...)
+		n.msgs = be_msgs(msgs)
+
+		be_split_child(n, best)
+	}
+}
+
+/*
+ * be_split_child -- (internal) splits child i of internal node n if it is
+ * too large, putting the new nodes and their pivots in its place, and
+ * returns how many nodes took its place; must be called in a transaction
+ */
+func be_split_child(n *node_t, i int) int {
+	nodes, pivots := be_split(n.children[i])
+	if len(nodes) > 1 {
+		children := make([]*node_t, 0, len(n.children) + len(nodes) - 1)
+		children = append(append(append(children, n.children[:i]...), nodes...),
+			n.children[i + 1:]...)
+		seps := make([]int, 0, len(n.pivots) + len(pivots))
+		seps = append(append(append(seps, n.pivots[:i]...), pivots...),
+			n.pivots[i:]...)
+		n.children = be_nodes(children)
+		n.pivots = be_ints(seps)
+	}
+	return len(nodes)
+}
+
+/*
+ * min_limit -- (internal) the smaller of two buffer limits
+ */
+func min_limit(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+/*
+ * be_grow -- (internal) gives the tree a new root above the nodes the old
+ * one is split into, as often as it needs to; must be called in a
+ * transaction
+ */
+func be_grow(ptr *data) {
+	for {
+		nodes, pivots := be_split(ptr.root)
+		if len(nodes) == 1 {
+			return
+		}
+		root := be_new_node(false)
+		root.children = be_nodes(nodes)
+		root.pivots = be_ints(pivots)
+		ptr.root = root
+	}
+}
+
+/*
+ * be_put -- (internal) adds the message m to the root, flushing the root if
+ * its buffer overflows, all in one transaction; returns ErrPoolFull, leaving
+ * the tree unchanged, if the pool fills up on the way
+ */
+func be_put(ptr *data, m msg_t) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		root := ptr.root
+		if root.leaf {
+			be_leaf_apply(root, m)
+		} else {
+			root.msgs = be_msgs(be_merge_msgs(root.msgs, []msg_t{m}))
+			be_flush(root, BE_BUFFER)
+		}
+		be_grow(ptr)
+	}
+	return nil
+}
+
+/*
+ * be_insert -- inserts key with value, or replaces the value of key; the
+ * update is buffered at the root and only reaches the leaf of key with a
+ * later batch
+ */
+func be_insert(ptr *data, key int, value int) error {
+	return be_put(ptr, msg_t{key: key, value: value})
+}
+
+/*
+ * be_remove -- removes key, if it is in the tree; like an insert, the
+ * removal is a buffered message, so it cannot tell whether the key was
+ * there, and leaves are never merged as they empty
+ */
+func be_remove(ptr *data, key int) error {
+	return be_put(ptr, msg_t{key: key, remove: true})
+}
+
+/*
+ * be_get -- returns the value of key; the newest message for the key on the
+ * path to its leaf decides, the leaf only if there is none
+ */
+func be_get(ptr *data, key int) (int, bool) {
+	n := ptr.root
+	for !n.leaf {
+		i := sort.Search(len(n.msgs), func(j int) bool { return n.msgs[j].key >= key })
+		if i < len(n.msgs) && n.msgs[i].key == key {
+			return n.msgs[i].value, !n.msgs[i].remove
+		}
+		n = n.children[be_route(n, key)]
+	}
+	i := sort.SearchInts(n.keys, key)
+	if i < len(n.keys) && n.keys[i] == key {
+		return n.values[i], true
+	}
+	return 0, false
+}
+
+/*
+ * be_lookup -- checks whether key is in the tree
+ */
+func be_lookup(ptr *data, key int) bool {
+	_, ok := be_get(ptr, key)
+	return ok
+}
+
+/*
+ * be_drain -- (internal) moves every message buffered in the subtree of n
+ * down to its leaves, top down; must be called in a transaction
+ */
+func be_drain(n *node_t) {
+	if n.leaf {
+		return
+	}
+	be_flush(n, 0)
+	for i := 0; i < len(n.children); i++ {
+		be_drain(n.children[i])
+		i += be_split_child(n, i) - 1
+	}
+}
+
+/*
+ * be_flush_all -- moves every buffered message down to the leaves, in one
+ * transaction; returns ErrPoolFull, leaving the tree unchanged, if the pool
+ * fills up on the way
+ */
+func be_flush_all(ptr *data) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		be_drain(ptr.root)
+		be_grow(ptr)
+	}
+	return nil
+}
+
+/*
+ * be_collect -- (internal) returns the pairs of the subtree of n in key
+ * order, with the messages buffered in it applied
+ */
+func be_collect(n *node_t) ([]int, []int) {
+	if n.leaf {
+		return n.keys, n.values
+	}
+	var keys, values []int
+	for _, c := range n.children {
+		k, v := be_collect(c)
+		keys = append(keys, k...)
+		values = append(values, v...)
+	}
+	out_keys := make([]int, 0, len(keys) + len(n.msgs))
+	out_values := make([]int, 0, len(keys) + len(n.msgs))
+	i := 0
+	for _, m := range n.msgs {
+		for i < len(keys) && keys[i] < m.key {
+			out_keys = append(out_keys, keys[i])
+			out_values = append(out_values, values[i])
+			i++
+		}
+		if i < len(keys) && keys[i] == m.key {
+			i++
+		}
+		if !m.remove {
+			out_keys = append(out_keys, m.key)
+			out_values = append(out_values, m.value)
+		}
+	}
+	out_keys = append(out_keys, keys[i:]...)
+	out_values = append(out_values, values[i:]...)
+	return out_keys, out_values
+}
+
+/*
+ * be_foreach -- calls cb for every pair in key order, stopping early when cb
+ * returns true; the pairs are first gathered in volatile memory
+ */
+func be_foreach(ptr *data, cb func(int, int) bool) bool {
+	keys, values := be_collect(ptr.root)
+	for i := range keys {
+		if cb(keys[i], values[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * be_clear -- removes all pairs
+ */
+func be_clear(ptr *data) {
+	txn("undo") {
+		ptr.root = pnew(node_t)
+		ptr.root.leaf = true
+	}
+}
+
+/*
+ * be_check_node -- (internal) verifies the subtree of n, whose keys must be
+ * at least lo and below hi where bounded, and returns the depth of its
+ * leaves, and the number of nodes and of buffered messages in it
+ */
+func be_check_node(n *node_t, lo int, hi int, bounded [2]bool) (int, int, int, error) {
+	in := func(key int) bool {
+		return (!bounded[0] || key >= lo) && (!bounded[1] || key < hi)
+	}
+	if n.leaf {
+		if len(n.keys) > BE_LEAF || len(n.values) != len(n.keys) {
+			return 0, 0, 0, fmt.Errorf("leaf has %d keys and %d values",
+				len(n.keys), len(n.values))
+		}
+		for i, k := range n.keys {
+			if !in(k) || (i > 0 && k <= n.keys[i - 1]) {
+				return 0, 0, 0, fmt.Errorf("key %d of a leaf is out of order", k)
+			}
+		}
+		return 1, 1, 0, nil
+	}
+	if len(n.children) > BE_FANOUT || len(n.children) != len(n.pivots) + 1 {
+		return 0, 0, 0, fmt.Errorf("node has %d children and %d pivots",
+			len(n.children), len(n.pivots))
+	}
+	if len(n.msgs) > BE_BUFFER {
+		return 0, 0, 0, fmt.Errorf("node buffers %d messages", len(n.msgs))
+	}
+	for i, m := range n.msgs {
+		if !in(m.key) || (i > 0 && m.key <= n.msgs[i - 1].key) {
+			return 0, 0, 0, fmt.Errorf("message for key %d is out of order", m.key)
+		}
+	}
+	for i, p := range n.pivots {
+		if !in(p) || (i > 0 && p <= n.pivots[i - 1]) {
+			return 0, 0, 0, fmt.Errorf("pivot %d is out of order", p)
+		}
+	}
+	depth, nodes, msgs := 0, 1, len(n.msgs)
+	for i, c := range n.children {
+		b := bounded
+		clo, chi := lo, hi
+		if i > 0 {
+			clo, b[0] = n.pivots[i - 1], true
+		}
+		if i < len(n.pivots) {
+			chi, b[1] = n.pivots[i], true
+		}
+		d, cn, cm, err := be_check_node(c, clo, chi, b)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		if i > 0 && d != depth {
+			return 0, 0, 0, fmt.Errorf("leaves at depths %d and %d", depth, d)
+		}
+		depth = d
+		nodes += cn
+		msgs += cm
+	}
+	return depth + 1, nodes, msgs, nil
+}
+
+/*
+ * be_check -- verifies that the keys, pivots and messages are in order and
+ * within the range of their node, that the nodes are within their sizes and
+ * that all leaves are at the same depth; returns the depth, and the number
+ * of nodes and of buffered messages
+ */
+func be_check(ptr *data) (int, int, int, error) {
+	return be_check_node(ptr.root, 0, 0, [2]bool{})
+}
+
+/*
+ * str_insert -- be_insert wrapper which works on strings
+ */
+func str_insert(ptr *data, str string) {
+	var key, value int
+	if scan_args("insert", str, "%d %d", &key, &value) {
+		if err := be_insert(ptr, key, value); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- be_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key int
+	if scan_args("remove", str, "%d", &key) {
+		if err := be_remove(ptr, key); err != nil {
+			fmt.Println("remove:", err)
+		}
+	}
+}
+
+/*
+ * str_get -- be_get wrapper which works on strings
+ */
+func str_get(ptr *data, str string) {
+	var key int
+	if scan_args("get", str, "%d", &key) {
+		if value, ok := be_get(ptr, key); ok {
+			fmt.Println(value)
+		} else {
+			fmt.Println("no such key")
+		}
+	}
+}
+
+/*
+ * str_check -- be_lookup wrapper which works on strings
+ */
+func str_check(ptr *data, str string) {
+	var key int
+	if scan_args("check", str, "%d", &key) {
+		fmt.Println(be_lookup(ptr, key))
+	}
+}
+
+/*
+ * str_flush -- be_flush_all wrapper
+ */
+func str_flush(ptr *data) {
+	if err := be_flush_all(ptr); err != nil {
+		fmt.Println("flush:", err)
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := be_insert(ptr, rand.Int(), 0); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"i $key $value - insert $key with $value",
+		"r $key - remove $key",
+		"g $key - print the value of $key",
+		"c $key - check $key, returns 0/1",
+		"f - flush every buffered message down to the leaves",
+		"n $value - insert $value random keys",
+		"p - print all keys",
+		"d - print debug info",
+		"x - remove all keys",
+	)
+}
+
+func print_all(ptr *data) {
+	be_foreach(ptr, func(key int, value int) bool {
+		fmt.Print(key, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	depth, nodes, msgs, err := be_check(ptr)
+	if err != nil {
+		fmt.Println("invariants:", err)
+		return
+	}
+	fmt.Println("invariants: ok")
+	fmt.Println("depth:", depth, "nodes:", nodes, "buffered messages:", msgs)
+	fmt.Println("flushes:", be_flushes, "messages moved:", be_moved, "splits:", be_splits)
+}
+
+/*
+ * Run -- opens the tree named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("betree", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'g': str_get(ptr, buf[1:])
+			case 'c': str_check(ptr, buf[1:])
+			case 'f': str_flush(ptr)
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': be_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
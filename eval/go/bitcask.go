@@ -0,0 +1,541 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* number of buckets of the index */
+const BC_BUCKETS int = 64
+
+/* capacity in bytes of a new log */
+const BC_INIT_LOG int = 4096
+
+/* a record is a header of key length, value length and flags, key, value */
+const BC_HEADER int = 9
+
+/* flag of a record which deletes its key */
+const BC_TOMBSTONE byte = 1
+
+/*
+ * the log is compacted once it is past BC_COMPACT_MIN bytes and holds more
+ * dead bytes, superseded records and tombstones, than live ones
+ */
+const BC_COMPACT_MIN int = 4096
+
+/*
+ * entry_t -- the index entry of a key, pointing to the offset of its latest
+ * record in the log
+ */
+type entry_t struct {
+	key    []byte
+	offset int
+	next   *entry_t
+}
+
+/*
+ * data -- records are appended to log past size, and only become part of
+ * the log once size moves over them, in the transaction which points the
+ * index to them
+ */
+type data struct {
+	index []*entry_t
+	nkeys int
+	log   []byte
+	size  int
+	dead  int
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x5BE1F8062D9C3A74
+)
+
+var ErrNotFound = errors.New("no such key")
+
+/* number of compactions since the store was opened */
+var compactions int
+
+/*
+ * persist -- (internal) flushes size bytes at addr to persistent memory
+ */
+func persist(addr unsafe.Pointer, size uintptr) {
+	runtime.PersistRange(addr, size)
+}
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.index = pmake([]*entry_t, BC_BUCKETS)
+		ptr.nkeys = 0
+		ptr.log = pmake([]byte, BC_INIT_LOG)
+		ptr.size = 0
+		ptr.dead = 0
+		ptr.magic = magic
+	}
+}
+
+/*
+ * hash -- 64-bit FNV-1a of key, reduced to the buckets of the index
+ */
+func hash(ptr *data, key string) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int(h.Sum64() % uint64(len(ptr.index)))
+}
+
+/*
+ * bc_record -- returns the key, value and flags of the record at offset of
+ * log, and the offset of the next one
+ */
+func bc_record(log []byte, offset int) ([]byte, []byte, byte, int) {
+	klen := int(binary.LittleEndian.Uint32(log[offset:]))
+	vlen := int(binary.LittleEndian.Uint32(log[offset + 4:]))
+	flags := log[offset + 8]
+	k := offset + BC_HEADER
+	return log[k:k + klen], log[k + klen:k + klen + vlen], flags, k + klen + vlen
+}
+
+/*
+ * bc_find -- (internal) returns the index entry of key, or nil
+ */
+func bc_find(ptr *data, key string) *entry_t {
+	for e := ptr.index[hash(ptr, key)]; e != nil; e = e.next {
+		if string(e.key) == key {
+			return e
+		}
+	}
+	return nil
+}
+
+/*
+ * bc_reserve -- (internal) makes room for n more bytes in the log, moving it
+ * to one twice as large as needed; must be called in a transaction
+ */
+func bc_reserve(ptr *data, n int) {
+	if ptr.size + n <= len(ptr.log) {
+		return
+	}
+	capacity := len(ptr.log)
+	for capacity < ptr.size + n {
+		capacity *= 2
+	}
+	log := pmake([]byte, capacity)
+	copy(log, ptr.log[:ptr.size])
+	ptr.log = log
+}
+
+/*
+ * bc_append -- (internal) writes a record past the end of the log and
+ * persists it, returning its offset; the record is not part of the log
+ * until the caller moves size over it
+ */
+func bc_append(ptr *data, key string, value string, flags byte) int {
+	offset := ptr.size
+	rec := ptr.log[offset:offset + BC_HEADER + len(key) + len(value)]
+	binary.LittleEndian.PutUint32(rec, uint32(len(key)))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(len(value)))
+	rec[8] = flags
+	copy(rec[BC_HEADER:], key)
+	copy(rec[BC_HEADER + len(key):], value)
+	persist(unsafe.Pointer(&rec[0]), uintptr(len(rec)))
+	return offset
+}
+
+/*
+ * bc_record_size -- (internal) returns the size of the record at offset
+ */
+func bc_record_size(log []byte, offset int) int {
+	_, _, _, next := bc_record(log, offset)
+	return next - offset
+}
+
+/*
+ * bc_put -- appends a record of key and value to the log and points the
+ * index to it, in one transaction; the record it supersedes becomes dead
+ *
+ * A full pool rolls the transaction back and returns ErrPoolFull.
+ */
+func bc_put(ptr *data, key string, value string) (err error) {
+	n := BC_HEADER + len(key) + len(value)
+	e := bc_find(ptr, key)
+	defer pool_full(&err)
+	txn("undo") {
+		bc_reserve(ptr, n)
+		offset := bc_append(ptr, key, value, 0)
+		if e != nil {
+			ptr.dead += bc_record_size(ptr.log, e.offset)
+			e.offset = offset
+		} else {
+			fresh := pnew(entry_t)
+			fresh.key = pmake([]byte, len(key))
+			copy(fresh.key, key)
+			fresh.offset = offset
+			h := hash(ptr, key)
+			fresh.next = ptr.index[h]
+			ptr.index[h] = fresh
+			ptr.nkeys++
+		}
+		ptr.size += n
+	}
+	return bc_maybe_compact(ptr)
+}
+
+/*
+ * bc_get -- returns the value of key
+ */
+func bc_get(ptr *data, key string) (string, error) {
+	e := bc_find(ptr, key)
+	if e == nil {
+		return "", ErrNotFound
+	}
+	_, value, _, _ := bc_record(ptr.log, e.offset)
+	return string(value), nil
+}
+
+/*
+ * bc_delete -- appends a tombstone of key to the log and unlinks its index
+ * entry, in one transaction; the tombstone is dead from the start, and only
+ * matters to a replay of the log
+ */
+func bc_delete(ptr *data, key string) (err error) {
+	h := hash(ptr, key)
+	link := &ptr.index[h]
+	for *link != nil && string((*link).key) != key {
+		link = &(*link).next
+	}
+	e := *link
+	if e == nil {
+		return ErrNotFound
+	}
+	n := BC_HEADER + len(key)
+	defer pool_full(&err)
+	txn("undo") {
+		bc_reserve(ptr, n)
+		bc_append(ptr, key, "", BC_TOMBSTONE)
+		ptr.dead += bc_record_size(ptr.log, e.offset) + n
+		*link = e.next
+		ptr.nkeys--
+		ptr.size += n
+	}
+	return bc_maybe_compact(ptr)
+}
+
+/*
+ * bc_foreach_record -- calls cb for every record of the log from the oldest
+ * with its offset, stopping early when cb returns true
+ */
+func bc_foreach_record(ptr *data, cb func(int, []byte, []byte, byte) bool) bool {
+	for offset := 0; offset < ptr.size; {
+		key, value, flags, next := bc_record(ptr.log, offset)
+		if cb(offset, key, value, flags) {
+			return true
+		}
+		offset = next
+	}
+	return false
+}
+
+/*
+ * bc_is_live -- (internal) returns whether the record at offset is the one
+ * the index points its key to
+ */
+func bc_is_live(ptr *data, offset int, key []byte) bool {
+	e := bc_find(ptr, string(key))
+	return e != nil && e.offset == offset
+}
+
+/*
+ * bc_foreach -- calls cb for every key and its value, in the order they were
+ * last written, stopping early when cb returns true
+ */
+func bc_foreach(ptr *data, cb func(string, string) bool) bool {
+	return bc_foreach_record(ptr, func(offset int, key []byte, value []byte, flags byte) bool {
+		if flags & BC_TOMBSTONE != 0 || !bc_is_live(ptr, offset, key) {
+			return false
+		}
+		return cb(string(key), string(value))
+	})
+}
+
+/*
+ * bc_compact -- copies the live records, in order, to a new log and points
+ * the index to the copies, in one transaction; the dead records and the
+ * tombstones are dropped
+ */
+func bc_compact(ptr *data) (err error) {
+	live := ptr.size - ptr.dead
+	capacity := BC_INIT_LOG
+	for capacity < 2 * live {
+		capacity *= 2
+	}
+	defer pool_full(&err)
+	txn("undo") {
+		log := pmake([]byte, capacity)
+		size := 0
+		bc_foreach_record(ptr, func(offset int, key []byte, value []byte, flags byte) bool {
+			if flags & BC_TOMBSTONE != 0 || !bc_is_live(ptr, offset, key) {
+				return false
+			}
+			_, _, _, next := bc_record(ptr.log, offset)
+			copy(log[size:], ptr.log[offset:next])
+			bc_find(ptr, string(key)).offset = size
+			size += next - offset
+			return false
+		})
+		ptr.log = log
+		ptr.size = size
+		ptr.dead = 0
+	}
+	compactions++
+	return nil
+}
+
+/*
+ * bc_maybe_compact -- (internal) compacts the log once the dead bytes
+ * outweigh the live ones
+ */
+func bc_maybe_compact(ptr *data) error {
+	if ptr.size < BC_COMPACT_MIN || 2 * ptr.dead <= ptr.size {
+		return nil
+	}
+	return bc_compact(ptr)
+}
+
+/*
+ * bc_clear -- removes all keys and empties the log
+ */
+func bc_clear(ptr *data) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		ptr.index = pmake([]*entry_t, BC_BUCKETS)
+		ptr.nkeys = 0
+		ptr.log = pmake([]byte, BC_INIT_LOG)
+		ptr.size = 0
+		ptr.dead = 0
+	}
+	return nil
+}
+
+/*
+ * bc_check -- replays the log, the last record of every key winning, and
+ * verifies that the index points every key to its winning record and holds
+ * no other, and that the dead bytes are counted right
+ */
+func bc_check(ptr *data) error {
+	if ptr.size > len(ptr.log) {
+		return fmt.Errorf("log of %d bytes in %d", ptr.size, len(ptr.log))
+	}
+	latest := make(map[string]int)
+	offset := 0
+	for offset < ptr.size {
+		if offset + BC_HEADER > ptr.size {
+			return fmt.Errorf("record at %d is cut short", offset)
+		}
+		key, _, flags, next := bc_record(ptr.log, offset)
+		if next > ptr.size {
+			return fmt.Errorf("record at %d is cut short", offset)
+		}
+		if flags & BC_TOMBSTONE != 0 {
+			delete(latest, string(key))
+		} else {
+			latest[string(key)] = offset
+		}
+		offset = next
+	}
+	live, nkeys := 0, 0
+	for i, e := range ptr.index {
+		for ; e != nil; e = e.next {
+			k := string(e.key)
+			if hash(ptr, k) != i {
+				return fmt.Errorf("key %q is in bucket %d", k, i)
+			}
+			if off, ok := latest[k]; !ok || off != e.offset {
+				return fmt.Errorf("key %q points to %d, the log to %d", k, e.offset, off)
+			}
+			live += bc_record_size(ptr.log, e.offset)
+			nkeys++
+		}
+	}
+	if nkeys != len(latest) || nkeys != ptr.nkeys {
+		return fmt.Errorf("%d keys indexed, %d in the log, total is %d", nkeys,
+			len(latest), ptr.nkeys)
+	}
+	if ptr.size - live != ptr.dead {
+		return fmt.Errorf("%d dead bytes, counted %d", ptr.size - live, ptr.dead)
+	}
+	return nil
+}
+
+/*
+ * str_put -- bc_put wrapper which works on strings: a key, then the rest of
+ * the line as its value
+ */
+func str_put(ptr *data, str string) {
+	fields := strings.SplitN(strings.TrimSpace(str), " ", 2)
+	if len(fields[0]) == 0 {
+		fmt.Println("put: invalid syntax")
+		return
+	}
+	value := ""
+	if len(fields) == 2 {
+		value = fields[1]
+	}
+	if err := bc_put(ptr, fields[0], value); err != nil {
+		fmt.Println("put:", err)
+	}
+}
+
+/*
+ * str_get -- bc_get wrapper which works on strings
+ */
+func str_get(ptr *data, str string) {
+	var key string
+	if scan_args("get", str, "%s", &key) {
+		if value, err := bc_get(ptr, key); err == nil {
+			fmt.Println(value)
+		} else {
+			fmt.Println(err)
+		}
+	}
+}
+
+/*
+ * str_delete -- bc_delete wrapper which works on strings
+ */
+func str_delete(ptr *data, str string) {
+	var key string
+	if scan_args("delete", str, "%s", &key) {
+		if err := bc_delete(ptr, key); err != nil {
+			fmt.Println("delete:", err)
+		}
+	}
+}
+
+/*
+ * str_compact -- bc_compact wrapper which reports its error
+ */
+func str_compact(ptr *data) {
+	if err := bc_compact(ptr); err != nil {
+		fmt.Println("compact:", err)
+	}
+}
+
+/*
+ * str_insert_random -- puts specified (as string) number of random values
+ * under keys drawn from a small set, so that most supersede others
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			key := fmt.Sprintf("key%d", rand.Intn(100))
+			if err := bc_put(ptr, key, fmt.Sprint(rand.Intn(1000000))); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+/*
+ * str_clear -- bc_clear wrapper which reports its error
+ */
+func str_clear(ptr *data) {
+	if err := bc_clear(ptr); err != nil {
+		fmt.Println("clear:", err)
+	}
+}
+
+func help() {
+	print_help(
+		"s $key $value - set $key to $value, the rest of the line",
+		"g $key - print the value of $key",
+		"r $key - delete $key",
+		"c - compact the log",
+		"n $value - put $value random values under random keys",
+		"p - print all keys with their value",
+		"d - print debug info",
+		"x - delete all keys",
+	)
+}
+
+func print_all(ptr *data) {
+	bc_foreach(ptr, func(key string, value string) bool {
+		fmt.Println(key, value)
+		return false
+	})
+}
+
+func print_debug(ptr *data) {
+	if err := bc_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("keys:", ptr.nkeys, "log:", ptr.size, "of", len(ptr.log),
+			"dead:", ptr.dead, "compactions:", compactions)
+	}
+}
+
+/*
+ * Run -- opens the store named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("bitcask", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 's': str_put(ptr, buf[1:])
+			case 'g': str_get(ptr, buf[1:])
+			case 'r': str_delete(ptr, buf[1:])
+			case 'c': str_compact(ptr)
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* size of a new filter in bits, and number of bits set per key */
+const BLOOM_DEFAULT_BITS int = 1 << 16
+const BLOOM_DEFAULT_HASHES int = 4
+
+/*
+ * data -- the filter is nbits bits packed into words; added counts the
+ * calls to bloom_add, duplicates included
+ */
+type data struct {
+	words  []uint64
+	nbits  int
+	hashes int
+	added  int
+	magic  int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x25D8A0F3C7E1694B
+)
+
+/*
+ * initialize -- creates an empty filter of nbits bits, rounded up to a whole
+ * word, which sets hashes bits per key
+ */
+func initialize(ptr *data, nbits int, hashes int) {
+	txn("undo") {
+		ptr.words = pmake([]uint64, (nbits + 63) / 64)
+		ptr.nbits = len(ptr.words) * 64
+		ptr.hashes = hashes
+		ptr.added = 0
+		ptr.magic = magic
+	}
+}
+
+/*
+ * bloom_bits -- (internal) calls cb with the position of every bit of key;
+ * the positions are derived from two halves of a 64-bit hash
+ */
+func bloom_bits(ptr *data, key string, cb func(int)) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum & 0xFFFFFFFF, sum >> 32 | 1
+	for i := 0; i < ptr.hashes; i++ {
+		cb(int((h1 + uint64(i) * h2) % uint64(ptr.nbits)))
+	}
+}
+
+/*
+ * bloom_add -- sets the bits of key; returns whether any of them was clear,
+ * that is whether the key was certainly not in the filter before
+ */
+func bloom_add(ptr *data, key string) bool {
+	fresh := false
+	txn("undo") {
+		bloom_bits(ptr, key, func(bit int) {
+			w, mask := &ptr.words[bit / 64], uint64(1) << uint(bit % 64)
+			if *w & mask == 0 {
+				*w |= mask
+				fresh = true
+			}
+		})
+		ptr.added++
+	}
+	return fresh
+}
+
+/*
+ * bloom_contains -- checks if the key may have been added; a false answer
+ * is always right, a true one is wrong with the rate bloom_fp_rate gives
+ */
+func bloom_contains(ptr *data, key string) bool {
+	all := true
+	bloom_bits(ptr, key, func(bit int) {
+		if ptr.words[bit / 64] & (uint64(1) << uint(bit % 64)) == 0 {
+			all = false
+		}
+	})
+	return all
+}
+
+/*
+ * bloom_popcount -- returns the number of bits set
+ */
+func bloom_popcount(ptr *data) int {
+	n := 0
+	for _, w := range ptr.words {
+		for ; w != 0; w &= w - 1 {
+			n++
+		}
+	}
+	return n
+}
+
+/*
+ * bloom_fp_rate -- returns the chance that bloom_contains answers true for a
+ * key never added, given the bits set now
+ */
+func bloom_fp_rate(ptr *data) float64 {
+	return math.Pow(float64(bloom_popcount(ptr)) / float64(ptr.nbits),
+		float64(ptr.hashes))
+}
+
+/*
+ * bloom_clear -- clears all bits
+ */
+func bloom_clear(ptr *data) {
+	txn("undo") {
+		for i := range ptr.words {
+			ptr.words[i] = 0
+		}
+		ptr.added = 0
+	}
+}
+
+/*
+ * bloom_check -- verifies that the parameters fit the bit array
+ */
+func bloom_check(ptr *data) error {
+	if ptr.nbits != len(ptr.words) * 64 || ptr.nbits == 0 {
+		return fmt.Errorf("%d bits in %d words", ptr.nbits, len(ptr.words))
+	}
+	if ptr.hashes <= 0 {
+		return fmt.Errorf("%d bits per key", ptr.hashes)
+	}
+	return nil
+}
+
+/*
+ * str_add -- adds the key given as a string
+ */
+func str_add(ptr *data, str string) {
+	var key string
+	if scan_args("add", str, "%s", &key) {
+		bloom_add(ptr, key)
+	}
+}
+
+/*
+ * str_contains -- bloom_contains wrapper which works on strings
+ */
+func str_contains(ptr *data, str string) {
+	var key string
+	if scan_args("contains", str, "%s", &key) {
+		fmt.Println(bloom_contains(ptr, key))
+	}
+}
+
+/*
+ * str_insert_random -- adds specified (as string) number of random keys
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			bloom_add(ptr, fmt.Sprintf("%x", rand.Int63()))
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"a $key - add $key",
+		"c $key - check $key, returns false if it was never added",
+		"n $value - add $value random keys",
+		"d - print debug info",
+		"x - clear the filter",
+	)
+}
+
+func print_debug(ptr *data) {
+	if err := bloom_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+		return
+	}
+	fmt.Println("invariants: ok")
+	fmt.Println("bits:", ptr.nbits, "set:", bloom_popcount(ptr), "hashes:", ptr.hashes,
+		"added:", ptr.added)
+	fmt.Printf("false positive rate: %.6f\n", bloom_fp_rate(ptr))
+}
+
+/*
+ * Run -- opens the filter named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("bloom", flag.ContinueOnError)
+	flags.Usage = func() {}
+	nbits := flags.Int("bits", BLOOM_DEFAULT_BITS, "size of the filter in bits when it is created")
+	hashes := flags.Int("hashes", BLOOM_DEFAULT_HASHES, "bits set per key when the filter is created")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	if *nbits <= 0 || *hashes <= 0 {
+		return usage_error("the filter needs a positive number of bits and hashes")
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr, *nbits, *hashes)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'a': str_add(ptr, buf[1:])
+			case 'c': str_contains(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'd': print_debug(ptr)
+			case 'x': bloom_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "[-bits n] [-hashes k] filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
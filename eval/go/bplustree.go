@@ -0,0 +1,661 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+const BPTREE_ORDER int = 8
+
+/* BPTREE_ORDER must be at least 3 */
+const _ = uint(BPTREE_ORDER - 3)
+
+/* minimum number of keys in a node_t other than the root */
+const BPTREE_MIN int = (BPTREE_ORDER - 1) / 2
+
+/*
+ * node_t -- an inner node routes key k to slots[i] for the i such that
+ * keys[i-1] <= k < keys[i]; a leaf holds the values of its keys and is
+ * linked to the next leaf in key order
+ */
+type node_t struct {
+	leaf   bool
+	n      int /* number of keys */
+	keys   [BPTREE_ORDER-1]int
+	values [BPTREE_ORDER-1]int   /* leaves only */
+	slots  [BPTREE_ORDER]*node_t /* inner nodes only */
+	next   *node_t               /* leaves only */
+}
+
+type data struct {
+	root  *node_t
+	first *node_t /* leftmost leaf */
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x61D8E2B47A93C50F
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.root = nil
+		ptr.first = nil
+		ptr.magic = magic
+	}
+}
+
+/*
+ * bptree_map_child_pos -- (internal) returns the slot of the inner node_t n
+ * where key belongs
+ */
+func bptree_map_child_pos(n *node_t, key int) int {
+	i := 0
+	for i < n.n && key >= n.keys[i] {
+		i++
+	}
+	return i
+}
+
+/*
+ * bptree_map_key_pos -- (internal) returns the position of the first key of
+ * the leaf which is not less than key
+ */
+func bptree_map_key_pos(n *node_t, key int) int {
+	i := 0
+	for i < n.n && n.keys[i] < key {
+		i++
+	}
+	return i
+}
+
+/*
+ * bptree_map_find_leaf -- (internal) returns the leaf where key belongs, or
+ * nil if the tree is empty
+ */
+func bptree_map_find_leaf(ptr *data, key int) *node_t {
+	n := ptr.root
+	for n != nil && !n.leaf {
+		n = n.slots[bptree_map_child_pos(n, key)]
+	}
+	return n
+}
+
+/*
+ * bptree_map_count_splits -- (internal) returns how many nodes inserting key
+ * splits, counting the new root if the root splits, or 0 if the key is
+ * already present
+ */
+func bptree_map_count_splits(ptr *data, key int) int {
+	var path []*node_t
+	n := ptr.root
+	for !n.leaf {
+		path = append(path, n)
+		n = n.slots[bptree_map_child_pos(n, key)]
+	}
+	if p := bptree_map_key_pos(n, key); p < n.n && n.keys[p] == key {
+		return 0
+	}
+	path = append(path, n)
+
+	splits := 0
+	for i := len(path) - 1; i >= 0 && path[i].n == BPTREE_ORDER - 1; i-- {
+		splits++
+	}
+	if splits == len(path) {
+		splits++
+	}
+	return splits
+}
+
+/*
+ * bptree_map_insert_in -- (internal) inserts the pair into the subtree of n,
+ * taking the nodes it splits off from spare; if n splits, returns the node_t
+ * holding its upper half and the key separating it from n
+ */
+func bptree_map_insert_in(n *node_t, key int, value int,
+	spare *[]*node_t) (int, *node_t) {
+	if n.leaf {
+		p := bptree_map_key_pos(n, key)
+		if p < n.n && n.keys[p] == key {
+			n.values[p] = value
+			return 0, nil
+		}
+
+		/* lay out the n+1 pairs, then keep what fits */
+		var keys [BPTREE_ORDER]int
+		var values [BPTREE_ORDER]int
+		copy(keys[:], n.keys[:p])
+		copy(values[:], n.values[:p])
+		keys[p], values[p] = key, value
+		copy(keys[p + 1:], n.keys[p:n.n])
+		copy(values[p + 1:], n.values[p:n.n])
+		total := n.n + 1
+
+		if total < BPTREE_ORDER {
+			copy(n.keys[:], keys[:total])
+			copy(n.values[:], values[:total])
+			n.n = total
+			return 0, nil
+		}
+
+		right := (*spare)[0]
+		*spare = (*spare)[1:]
+		half := total / 2
+		right.leaf = true
+		right.n = copy(right.keys[:], keys[half:total])
+		copy(right.values[:], values[half:total])
+		right.next = n.next
+		copy(n.keys[:], keys[:half])
+		copy(n.values[:], values[:half])
+		n.n = half
+		n.next = right
+		return right.keys[0], right
+	}
+
+	p := bptree_map_child_pos(n, key)
+	sep, child := bptree_map_insert_in(n.slots[p], key, value, spare)
+	if child == nil {
+		return 0, nil
+	}
+
+	var keys [BPTREE_ORDER]int
+	var slots [BPTREE_ORDER + 1]*node_t
+	copy(keys[:], n.keys[:p])
+	copy(slots[:], n.slots[:p + 1])
+	keys[p], slots[p + 1] = sep, child
+	copy(keys[p + 1:], n.keys[p:n.n])
+	copy(slots[p + 2:], n.slots[p + 1:n.n + 1])
+	total := n.n + 1
+
+	if total < BPTREE_ORDER {
+		copy(n.keys[:], keys[:total])
+		copy(n.slots[:], slots[:total + 1])
+		n.n = total
+		return 0, nil
+	}
+
+	/* the middle key moves up */
+	right := (*spare)[0]
+	*spare = (*spare)[1:]
+	half := total / 2
+	right.leaf = false
+	right.n = copy(right.keys[:], keys[half + 1:total])
+	copy(right.slots[:], slots[half + 1:total + 1])
+	copy(n.keys[:], keys[:half])
+	copy(n.slots[:], slots[:half + 1])
+	for i := half + 1; i < BPTREE_ORDER; i++ {
+		n.slots[i] = nil
+	}
+	n.n = half
+	return keys[half], right
+}
+
+/*
+ * bptree_map_insert -- inserts a key-value pair, replacing the value of the
+ * key if it is present; the nodes the insert splits off are allocated before
+ * the tree is modified, so a full pool returns ErrPoolFull and leaves it
+ * unchanged
+ */
+func bptree_map_insert(ptr *data, key int, value int) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		if ptr.root == nil {
+			leaf := pnew(node_t)
+			leaf.leaf = true
+			leaf.n = 1
+			leaf.keys[0] = key
+			leaf.values[0] = value
+			ptr.root = leaf
+			ptr.first = leaf
+			return nil
+		}
+
+		spare := make([]*node_t, bptree_map_count_splits(ptr, key))
+		for i := range spare {
+			spare[i] = pnew(node_t)
+		}
+		up := spare
+		if sep, right := bptree_map_insert_in(ptr.root, key, value, &spare); right != nil {
+			/* the root was split, the tree grows in height */
+			root := up[len(up) - 1]
+			root.leaf = false
+			root.n = 1
+			root.keys[0] = sep
+			root.slots[0] = ptr.root
+			root.slots[1] = right
+			ptr.root = root
+		}
+	}
+	return nil
+}
+
+/*
+ * bptree_map_shift -- (internal) moves the keys (and values or slots) of n
+ * from position from on by delta positions
+ */
+func bptree_map_shift(n *node_t, from int, delta int) {
+	if n.leaf {
+		copy(n.keys[from + delta:], n.keys[from:n.n])
+		copy(n.values[from + delta:], n.values[from:n.n])
+	} else {
+		copy(n.keys[from + delta:], n.keys[from:n.n])
+		copy(n.slots[from + delta:], n.slots[from:n.n + 1])
+	}
+	n.n += delta
+}
+
+/*
+ * bptree_map_rebalance -- (internal) refills the child p of the inner node_t
+ * parent, which is one key short, from a sibling or by merging it with one
+ */
+func bptree_map_rebalance(ptr *data, parent *node_t, p int) {
+	child := parent.slots[p]
+
+	if p > 0 && parent.slots[p - 1].n > BPTREE_MIN {
+		/* take the last entry of the left sibling */
+		left := parent.slots[p - 1]
+		if child.leaf {
+			bptree_map_shift(child, 0, 1)
+			child.keys[0] = left.keys[left.n - 1]
+			child.values[0] = left.values[left.n - 1]
+			parent.keys[p - 1] = child.keys[0]
+		} else {
+			copy(child.slots[1:], child.slots[:child.n + 1])
+			copy(child.keys[1:], child.keys[:child.n])
+			child.n++
+			child.keys[0] = parent.keys[p - 1]
+			child.slots[0] = left.slots[left.n]
+			left.slots[left.n] = nil
+			parent.keys[p - 1] = left.keys[left.n - 1]
+		}
+		left.n--
+		return
+	}
+
+	if p < parent.n && parent.slots[p + 1].n > BPTREE_MIN {
+		/* take the first entry of the right sibling */
+		right := parent.slots[p + 1]
+		if child.leaf {
+			child.keys[child.n] = right.keys[0]
+			child.values[child.n] = right.values[0]
+			child.n++
+			bptree_map_shift(right, 1, -1)
+			parent.keys[p] = right.keys[0]
+		} else {
+			child.keys[child.n] = parent.keys[p]
+			child.slots[child.n + 1] = right.slots[0]
+			child.n++
+			parent.keys[p] = right.keys[0]
+			copy(right.slots[:], right.slots[1:right.n + 1])
+			right.slots[right.n] = nil
+			copy(right.keys[:], right.keys[1:right.n])
+			right.n--
+		}
+		return
+	}
+
+	/* merge the child with a sibling, into the left one of the two */
+	if p == parent.n {
+		p--
+	}
+	left, right := parent.slots[p], parent.slots[p + 1]
+	if left.leaf {
+		copy(left.keys[left.n:], right.keys[:right.n])
+		copy(left.values[left.n:], right.values[:right.n])
+		left.n += right.n
+		left.next = right.next
+	} else {
+		left.keys[left.n] = parent.keys[p]
+		copy(left.keys[left.n + 1:], right.keys[:right.n])
+		copy(left.slots[left.n + 1:], right.slots[:right.n + 1])
+		left.n += right.n + 1
+	}
+	copy(parent.keys[p:], parent.keys[p + 1:parent.n])
+	copy(parent.slots[p + 1:], parent.slots[p + 2:parent.n + 1])
+	parent.slots[parent.n] = nil
+	parent.n--
+}
+
+/*
+ * bptree_map_remove_in -- (internal) removes key from the subtree of n,
+ * rebalancing the nodes left short on the way up
+ */
+func bptree_map_remove_in(ptr *data, n *node_t, key int) (int, bool) {
+	if n.leaf {
+		p := bptree_map_key_pos(n, key)
+		if p == n.n || n.keys[p] != key {
+			return 0, false
+		}
+		value := n.values[p]
+		bptree_map_shift(n, p + 1, -1)
+		return value, true
+	}
+
+	p := bptree_map_child_pos(n, key)
+	value, found := bptree_map_remove_in(ptr, n.slots[p], key)
+	if found && n.slots[p].n < BPTREE_MIN {
+		bptree_map_rebalance(ptr, n, p)
+	}
+	return value, found
+}
+
+/*
+ * bptree_map_remove -- removes the key from the tree, returning its value and
+ * whether it was found
+ */
+func bptree_map_remove(ptr *data, key int) (int, bool) {
+	if !bptree_map_lookup(ptr, key) {
+		return 0, false
+	}
+	value := 0
+	txn("undo") {
+		value, _ = bptree_map_remove_in(ptr, ptr.root, key)
+		if ptr.root.n == 0 {
+			/* the tree shrinks in height, or becomes empty */
+			if ptr.root.leaf {
+				ptr.root = nil
+				ptr.first = nil
+			} else {
+				ptr.root = ptr.root.slots[0]
+			}
+		}
+	}
+	return value, true
+}
+
+/*
+ * bptree_map_get -- searches for the value of the key
+ */
+func bptree_map_get(ptr *data, key int) (int, bool) {
+	leaf := bptree_map_find_leaf(ptr, key)
+	if leaf == nil {
+		return 0, false
+	}
+	if p := bptree_map_key_pos(leaf, key); p < leaf.n && leaf.keys[p] == key {
+		return leaf.values[p], true
+	}
+	return 0, false
+}
+
+/*
+ * bptree_map_lookup -- checks if the key exists in the tree
+ */
+func bptree_map_lookup(ptr *data, key int) bool {
+	_, ok := bptree_map_get(ptr, key)
+	return ok
+}
+
+/*
+ * bptree_map_range -- calls cb for every pair with lo <= key <= hi in key
+ * order, stopping early when cb returns true; only the path to the first
+ * leaf is searched, the rest follows the leaf links
+ */
+func bptree_map_range(ptr *data, lo int, hi int, cb func(int, int) bool) bool {
+	leaf := bptree_map_find_leaf(ptr, lo)
+	if leaf == nil {
+		return false
+	}
+	for p := bptree_map_key_pos(leaf, lo); leaf != nil; leaf, p = leaf.next, 0 {
+		for ; p < leaf.n; p++ {
+			if leaf.keys[p] > hi {
+				return false
+			}
+			if cb(leaf.keys[p], leaf.values[p]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * bptree_map_foreach -- calls cb for every pair in key order, stopping early
+ * when cb returns true
+ */
+func bptree_map_foreach(ptr *data, cb func(int, int) bool) bool {
+	for leaf := ptr.first; leaf != nil; leaf = leaf.next {
+		for p := 0; p < leaf.n; p++ {
+			if cb(leaf.keys[p], leaf.values[p]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * bptree_map_clear -- removes all pairs from the tree
+ */
+func bptree_map_clear(ptr *data) {
+	txn("undo") {
+		ptr.root = nil
+		ptr.first = nil
+	}
+}
+
+/*
+ * bptree_map_check_node -- (internal) verifies the subtree of n, whose keys
+ * lie in [lo, hi) where given, collecting its leaves in order
+ */
+func bptree_map_check_node(n *node_t, lo *int, hi *int, depth int,
+	leaf_depth *int, root bool, leaves *[]*node_t) error {
+	if n.n > BPTREE_ORDER - 1 || (!root && n.n < BPTREE_MIN) || (root && n.n < 1) {
+		return fmt.Errorf("node at depth %d holds %d keys", depth, n.n)
+	}
+	for i := 0; i < n.n; i++ {
+		if i > 0 && n.keys[i - 1] >= n.keys[i] ||
+			lo != nil && n.keys[i] < *lo || hi != nil && n.keys[i] >= *hi {
+			return fmt.Errorf("key %d at depth %d is out of order", n.keys[i], depth)
+		}
+	}
+	if n.leaf {
+		if *leaf_depth == -1 {
+			*leaf_depth = depth
+		} else if *leaf_depth != depth {
+			return fmt.Errorf("leaf at depth %d, other leaves at depth %d",
+				depth, *leaf_depth)
+		}
+		*leaves = append(*leaves, n)
+		return nil
+	}
+	for i := 0; i <= n.n; i++ {
+		if n.slots[i] == nil {
+			return fmt.Errorf("node at depth %d misses child %d", depth, i)
+		}
+		clo, chi := lo, hi
+		if i > 0 {
+			clo = &n.keys[i - 1]
+		}
+		if i < n.n {
+			chi = &n.keys[i]
+		}
+		if err := bptree_map_check_node(n.slots[i], clo, chi, depth + 1,
+			leaf_depth, false, leaves); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * bptree_map_check -- verifies the whole tree and that the leaf links visit
+ * every leaf in order, returning the height of the tree
+ */
+func bptree_map_check(ptr *data) (int, error) {
+	if ptr.root == nil {
+		if ptr.first != nil {
+			return 0, errors.New("an empty tree has a first leaf")
+		}
+		return 0, nil
+	}
+	leaf_depth := -1
+	var leaves []*node_t
+	if err := bptree_map_check_node(ptr.root, nil, nil, 0, &leaf_depth, true,
+		&leaves); err != nil {
+		return 0, err
+	}
+	leaf := ptr.first
+	for i, want := range leaves {
+		if leaf != want {
+			return 0, fmt.Errorf("leaf link %d does not lead to the next leaf", i)
+		}
+		leaf = leaf.next
+	}
+	if leaf != nil {
+		return 0, errors.New("the last leaf links to another node")
+	}
+	return leaf_depth + 1, nil
+}
+
+/*
+ * str_insert -- bptree_map_insert wrapper which works on strings
+ */
+func str_insert(ptr *data, str string) {
+	var key int
+	if scan_args("insert", str, "%d", &key) {
+		if err := bptree_map_insert(ptr, key, 0); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- bptree_map_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key int
+	if scan_args("remove", str, "%d", &key) {
+		if _, ok := bptree_map_remove(ptr, key); !ok {
+			fmt.Println("no such value")
+		}
+	}
+}
+
+/*
+ * str_check -- bptree_map_lookup wrapper which works on strings
+ */
+func str_check(ptr *data, str string) {
+	var key int
+	if scan_args("check", str, "%d", &key) {
+		fmt.Println(bptree_map_lookup(ptr, key))
+	}
+}
+
+/*
+ * str_range -- prints the keys between the two bounds given as a string
+ */
+func str_range(ptr *data, str string) {
+	var lo, hi int
+	if scan_args("range", str, "%d %d", &lo, &hi) {
+		bptree_map_range(ptr, lo, hi, func(key int, value int) bool {
+			fmt.Print(key, " ")
+			return false
+		})
+		fmt.Println()
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := bptree_map_insert(ptr, rand.Int(), 0); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"i $value - insert $value",
+		"r $value - remove $value",
+		"c $value - check $value, returns 0/1",
+		"s $lo $hi - print the values from $lo to $hi",
+		"n $value - insert $value random values",
+		"p - print all values",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	bptree_map_foreach(ptr, func(key int, value int) bool {
+		fmt.Print(key, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if height, err := bptree_map_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("height:", height)
+	}
+}
+
+/*
+ * Run -- opens the tree named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("bplustree", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'c': str_check(ptr, buf[1:])
+			case 's': str_range(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': bptree_map_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
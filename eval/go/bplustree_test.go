@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/vmware/go-pmem-transaction/pmem"
+)
+
+// The tests share one pool, as go-pmem maps a single pool per process.
+func TestMain(m *testing.M) {
+	pool := filepath.Join(os.TempDir(), fmt.Sprintf("bplustree_test.%d.pool", os.Getpid()))
+	pmem.Init(pool)
+	status := m.Run()
+	os.Remove(pool)
+	os.Exit(status)
+}
+
+// bptree_pairs returns the pairs of the tree in the order the leaf links
+// visit them, one "key value" string each.
+func bptree_pairs(ptr *data) []string {
+	pairs := []string{}
+	bptree_map_foreach(ptr, func(key int, value int) bool {
+		pairs = append(pairs, fmt.Sprint(key, value))
+		return false
+	})
+	return pairs
+}
+
+// Random inserts, replacing the values of keys among them, and removes,
+// which split, merge and rebalance nodes, keep the tree balanced and its
+// leaves linked in order, and it holds the pairs of a model of it.
+func TestBptreeInvariants(t *testing.T) {
+	ptr := pnew(data)
+	initialize(ptr)
+	rng := rand.New(rand.NewSource(1))
+	model := map[int]int{}
+	height := 0
+	for i := 0; i < 5000; i++ {
+		key := rng.Intn(400)
+		if rng.Intn(5) < 2 {
+			_, ok := bptree_map_remove(ptr, key)
+			_, want := model[key]
+			if ok != want {
+				t.Fatalf("step %d: remove of %d found %v, want %v", i, key, ok, want)
+			}
+			delete(model, key)
+		} else {
+			if err := bptree_map_insert(ptr, key, i); err != nil {
+				t.Fatalf("step %d: insert of %d: %v", i, key, err)
+			}
+			model[key] = i
+		}
+		h, err := bptree_map_check(ptr)
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if h > height {
+			height = h
+		}
+	}
+	if height < 3 {
+		t.Fatalf("the tree grew to a height of %d only", height)
+	}
+
+	keys := []int{}
+	for key := range model {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	want := []string{}
+	for _, key := range keys {
+		want = append(want, fmt.Sprint(key, model[key]))
+	}
+	if got := bptree_pairs(ptr); !reflect.DeepEqual(got, want) {
+		t.Fatalf("the tree holds %v, want %v", got, want)
+	}
+}
+
+// bptree_map_check finds a leaf out of order, an underfull node, leaves at
+// different depths and a broken leaf link.
+func TestBptreeCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(ptr *data)
+	}{
+		{"order", func(ptr *data) { ptr.first.keys[0] = ptr.first.keys[1] }},
+		{"underfull", func(ptr *data) { ptr.first.n = 1 }},
+		{"depth", func(ptr *data) {
+			ptr.root.slots[0] = ptr.root.slots[0].slots[0]
+		}},
+		{"leaf link", func(ptr *data) { ptr.first.next = nil }},
+	}
+	for _, tc := range tests {
+		ptr := pnew(data)
+		initialize(ptr)
+		/* enough keys in order for a tree of height 3 */
+		for key := 0; key < 100; key++ {
+			bptree_map_insert(ptr, key, 0)
+		}
+		if h, err := bptree_map_check(ptr); err != nil || h < 3 {
+			t.Fatalf("%s: height %d, %v", tc.name, h, err)
+		}
+		tc.corrupt(ptr)
+		if _, err := bptree_map_check(ptr); err == nil {
+			t.Errorf("%s: the broken tree passed the check", tc.name)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"os"
 	"strconv"
@@ -33,19 +34,29 @@ func initialize(ptr *data) {
 	}
 }
 
-func insert(ptr **node, key int, value string) {
+// alloc_node allocates the nodes of the tree; tests replace it with an
+// allocation the pool has no room for.
+var alloc_node = func() *node {
+	return pnew(node)
+}
+
+func insert(ptr **node, key int, value string) (err error) {
 	if *ptr == nil {
+		// a full pool panics in alloc_node, which leaves *ptr nil
+		defer pool_full(&err)
 		txn("undo") { 
-			*ptr = pnew(node)
-			(*ptr).key = key
-			copy((*ptr).value[:], value)
+			n := alloc_node()
+			n.key = key
+			copy(n.value[:], value)
+			*ptr = n
 		}
+		return nil
 	} else {
 		i := 0
 		if key > (*ptr).key {
 			i = 1
 		}
-		insert(&(*ptr).slots[i], key, value)
+		return insert(&(*ptr).slots[i], key, value)
 	}
 }
 
@@ -71,75 +82,187 @@ func print_node(ptr *node) {
 	}
 }
 
-func main() {
-	args := os.Args
-
-	if len(args) < 3 {
-		println("usage:", args[0], "filename [p|i|f|s|r] [key] [value]")
-		return
+// validate_node checks that the keys of the subtree of n keep the search
+// order, which sends keys up to a node's key left and greater keys right:
+// they must be greater than lo and at most hi, where nil is no bound. It also
+// checks that no node is reached twice and counts the keys in keys.
+func validate_node(n *node, lo *int, hi *int, seen map[*node]bool, keys map[int]int) error {
+	if n == nil {
+		return nil
+	}
+	if seen[n] {
+		return errors.New("node of key " + strconv.Itoa(n.key) + " is reachable twice")
 	}
+	seen[n] = true
+	if (lo != nil && n.key <= *lo) || (hi != nil && n.key > *hi) {
+		return errors.New("key " + strconv.Itoa(n.key) + " is out of order")
+	}
+	keys[n.key]++
+	if err := validate_node(n.slots[0], lo, &n.key, seen, keys); err != nil {
+		return err
+	}
+	return validate_node(n.slots[1], &n.key, hi, seen, keys)
+}
 
+// validate opens the existing pool at path without initializing or changing
+// it and reports the result of every check, returning an error if one
+// fails. go-pmem has no read-only mapping, and opening the pool still rolls
+// back a transaction left unfinished by a crash.
+func validate(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return pool_error(err.Error())
+	}
+	pmem.Init(path)
 	var ptr *data
-	flag.Parse()
-	firstInit := pmem.Init(args[1])
-	if firstInit {
-		// first time run of the application
-		ptr = (*data)(pmem.New("root", ptr))
-		initialize(ptr)
-	} else {
-		// not a first time initialization
-		ptr = (*data)(pmem.Get("root", ptr))
+	ptr = (*data)(pmem.Get("root", ptr))
+	if ptr == nil {
+		return pool_error("no root object in " + path)
+	}
 
-		// even though this is not a first time initialization, we should still
-		// check if the named object exists and data initialization completed
-		// succesfully. The magic element within the named object helps check
-		// for successful data initialization.
+	failed := false
+	report := func(check string, err error) {
+		if err != nil {
+			println(check+": FAILED,", err.Error())
+			failed = true
+		} else {
+			println(check + ": ok")
+		}
+	}
 
-		if ptr == nil {
-			ptr = (*data)(pmem.New("root", ptr))
+	if ptr.magic != magic {
+		report("magic", errors.New("the root object was never initialized"))
+	} else {
+		report("magic", nil)
+		keys := make(map[int]int)
+		report("order", validate_node(ptr.root, nil, nil, make(map[*node]bool), keys))
+		dups := 0
+		for _, c := range keys {
+			if c > 1 {
+				dups++
+			}
 		}
+		// insert allows a key more than once, so this is only reported
+		println("duplicates:", dups, "keys")
+	}
+
+	if failed {
+		return pool_error(path + " failed validation")
+	}
+	return nil
+}
+
+// Run opens the pool named in args (the command line without the program
+// name) and performs the requested operation on it.
+func Run(args []string) error {
+	flags := flag.NewFlagSet("btree", flag.ContinueOnError)
+	flags.Usage = func() {}
+	cpuprofile := flags.String("cpuprofile", "", "write a CPU profile of the operation to `file`")
+	memprofile := flags.String("memprofile", "", "write a heap profile to `file` on exit")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
 
-		if ptr.magic != magic {
-			initialize(ptr)
+	if len(args) < 2 || len(args[1]) == 0 {
+		return ErrUsage
+	}
+
+	if args[1] == "v" {
+		if len(args) != 2 {
+			return ErrUsage
 		}
+		return validate(args[0])
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
 	}
-	op := args[2][0]
+
+	stop, err := start_profiling(*cpuprofile, *memprofile)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	op := args[1][0]
 	switch op {
 	case 'p':
 		print_node(ptr.root)
 		println()
 	case 'i':
-		if key, err := strconv.Atoi(args[3]); err == nil {
-			value := args[4]
-			insert(&ptr.root, key, value)
+		if len(args) != 4 {
+			return ErrUsage
 		}
+		key, err := strconv.Atoi(args[2])
+		if err != nil {
+			return err
+		}
+		return insert(&ptr.root, key, args[3])
 	case 'f':
-		if key, err := strconv.Atoi(args[3]); err == nil {
-			p := find(ptr.root, key)
-			if p != nil {
-				println(string(p.value[:]))
-			} else {
-				println("not found")
-			}
+		if len(args) != 3 {
+			return ErrUsage
+		}
+		key, err := strconv.Atoi(args[2])
+		if err != nil {
+			return err
+		}
+		p := find(ptr.root, key)
+		if p != nil {
+			println(string(p.value[:]))
+		} else {
+			println("not found")
 		}
 	case 's':
-		if len, err := strconv.Atoi(args[3]); err == nil {
-			for k := 0; k < len; k++ {
-				insert(&ptr.root, k, "test")
-			}
+		if len(args) != 3 {
+			return ErrUsage
 		}
-	case 'r':
-		if len, err := strconv.Atoi(args[3]); err == nil {
-			var p *node = nil
-			for k := 0; k < len; k++ {
-				p = find(ptr.root, k)
+		len, err := strconv.Atoi(args[2])
+		if err != nil {
+			return err
+		}
+		for k := 0; k < len; k++ {
+			if is_interrupted() {
+				return ErrInterrupted
 			}
-			if p != nil {
-				println("value = ", string(p.value[:]))
+			if err := insert(&ptr.root, k, "test"); err != nil {
+				return err
 			}
 		}
+	case 'r':
+		if len(args) != 3 {
+			return ErrUsage
+		}
+		len, err := strconv.Atoi(args[2])
+		if err != nil {
+			return err
+		}
+		var p *node = nil
+		for k := 0; k < len; k++ {
+			p = find(ptr.root, k)
+		}
+		if p != nil {
+			println("value = ", string(p.value[:]))
+		}
 	default:
-		println("invalid operation")
+		return usage_error("invalid operation " + args[1])
 	}
+	return nil
 }
 
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		println("usage:", os.Args[0], "[-cpuprofile file] [-memprofile file] filename [p|i|f|s|r|v] [key] [value]")
+		println("v checks the pool without writing to it, but opening it still rolls back a transaction left unfinished by a crash")
+	} else if err != nil {
+		println(err.Error())
+	}
+	shutdown(exit_status(err))
+}
@@ -4,44 +4,173 @@ import (
 	"flag"
 	"os"
 	"bufio"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math/bits"
 	"math/rand"
+	"net"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/vmware/go-pmem-transaction/pmem"
 	"github.com/vmware/go-pmem-transaction/transaction"
 )
 
 const BTREE_ORDER int = 8
-const BTREE_MIN int = ((BTREE_ORDER / 2) - 1)
+
+/* BTREE_ORDER must be at least 3 */
+const _ = uint(BTREE_ORDER - 3)
+
+/*
+ * btree_map_order -- the order the trees are kept at, which is BTREE_ORDER
+ * but in tests checking smaller orders down to 3; the nodes always have room
+ * for BTREE_ORDER
+ */
+var btree_map_order = BTREE_ORDER
+
+/*
+ * btree_map_min_items -- (internal) minimum number of items in a node_t other
+ * than the root; a split of a full node_t with one more item leaves at least that
+ * many on both sides
+ */
+func btree_map_min_items() int {
+	return (btree_map_order - 1) / 2
+}
+
+/* number of entries inserted per transaction by btree_map_merge_trees */
+const MERGE_BATCH int = 64
 
 type item struct {
 	key int
 	value int
+	epoch int /* data.epoch of the write that made this version */
+	dead  bool /* removed from a lazy tree, see btree_map_compact */
 }
 
 type node_t struct {
 	n     int
 	items [BTREE_ORDER-1]item
 	slots [BTREE_ORDER]*node_t
+	sum   int /* sum of the values in the subtree */
 }
 
 type data struct {
 	root  *node_t
 	magic int
+	order int
+	min   int /* first key in the tree order, valid when not empty */
+	max   int /* last key in the tree order, valid when not empty */
+	epoch int /* bumped by every write, see btree_map_snapshot */
+	dirty bool /* set by btree_map_open, cleared by btree_map_close */
+	lazy  bool /* removals leave tombstones until btree_map_compact */
+	dead  int  /* number of tombstones */
+	index *btree_map_index_t /* lookups by value, nil unless created */
+}
+
+/*
+ * btree_map_key_set_t -- the keys of the live items holding value, as the
+ * keys of a tree whose values are unused
+ */
+type btree_map_key_set_t struct {
+	value int
+	keys  *data
+}
+
+/*
+ * btree_map_index_t -- secondary index of a tree by value, updated in the
+ * transactions changing the tree; values maps every value held by a live
+ * item to the position of its key set in sets
+ */
+type btree_map_index_t struct {
+	values *data
+	sets   []btree_map_key_set_t /* sets[:n] are in use */
+	n      int
 }
 
 const (
 	// A magic number used to identify if the root object initialization
-	// completed successfully.
-	magic = 0x1B2E8BFF7BFBD154
+	// completed successfully. It changes with the layout of the root object,
+	// so that a pool written by an older btree_map is not misread.
+	magic = 0x1B2E8BFF7BFBD155
+
+	// The magic number of the layouts before this one.
+	old_magic = 0x1B2E8BFF7BFBD154
+)
+
+/* key orderings a tree can be created with, persisted in data.order */
+const (
+	BTREE_ASCENDING int = iota
+	BTREE_DESCENDING
 )
 
-func initialize(ptr *data) {
+var btree_map_comparators = [...]func(int, int) bool {
+	BTREE_ASCENDING:  func(a int, b int) bool { return a < b },
+	BTREE_DESCENDING: func(a int, b int) bool { return a > b },
+}
+
+/*
+ * btree_map_layout_error -- returns the error for a root object initialized
+ * with the magic number m, which is not that of the current layout
+ */
+func btree_map_layout_error(m int) error {
+	if m == old_magic {
+		return errors.New("the tree has the layout of an older btree_map")
+	}
+	return fmt.Errorf("the root object is not a tree (magic %#x)", m)
+}
+
+func initialize(ptr *data, order int, lazy bool) {
 	{
 		ptr.root = nil
 		ptr.magic = magic
+		ptr.order = order
+		ptr.min = 0
+		ptr.max = 0
+		ptr.dirty = false
+		ptr.lazy = lazy
+		ptr.dead = 0
+		ptr.index = nil
+	}
+}
+
+/*
+ * btree_map_open -- marks the tree as open until btree_map_close; returns
+ * whether it was left open by the previous user, which did not shut down
+ * cleanly, and in that case the result of checking the invariants
+ */
+func btree_map_open(ptr *data) (bool, error) {
+	var err error = nil
+	dirty := ptr.dirty
+	if dirty {
+		err = btree_map_check_invariants(ptr)
+	}
+	txn("undo") {
+		ptr.dirty = true
+	}
+	btree_map_versions_lock.Lock()
+	btree_map_versions[ptr] = &btree_map_versions_t{
+		open: map[int]int{},
+		old:  map[int][]btree_map_version_t{},
+	}
+	btree_map_versions_lock.Unlock()
+	return dirty, err
+}
+
+/*
+ * btree_map_close -- marks the tree as cleanly closed and drops its
+ * snapshot state and append hint
+ */
+func btree_map_close(ptr *data) {
+	txn("undo") {
+		ptr.dirty = false
 	}
+	btree_map_versions_lock.Lock()
+	delete(btree_map_versions, ptr)
+	btree_map_versions_lock.Unlock()
+	delete(btree_map_append_hints, ptr)
 }
 
 /*
@@ -50,6 +179,7 @@ func initialize(ptr *data) {
 func set_empty_item(item *item) {
 	item.key = 0
 	item.value = 0
+	item.epoch = 0
 }
 
 /*
@@ -65,12 +195,34 @@ func btree_map_clear_node(node *node_t) {
 }
 
 /*
- * btree_map_clear -- removes all elements from the ptr
+ * btree_map_clear -- removes all elements from the ptr and drops its overlay;
+ * while a snapshot is open they are all left as tombstones instead
  */
 func btree_map_clear(ptr *data) int{
+	v := btree_map_writing(ptr)
+	defer btree_map_written(v)
+	btree_map_discard_overlay(ptr)
+	if btree_map_snapshots_open(v) {
+		var keys []int
+		btree_map_foreach_node(ptr.root, func(key int, value int) bool {
+			keys = append(keys, key)
+			return false
+		})
+		txn("undo") {
+			for _, key := range keys {
+				btree_map_remove_lazy(ptr, v, key)
+			}
+		}
+		return 0
+	}
 	txn("undo") {
 		btree_map_clear_node(ptr.root)
 		ptr.root = nil
+		ptr.dead = 0
+		if ptr.index != nil {
+			ptr.index.values.root = nil
+			ptr.index.n = 0
+		}
 	}
 	return 0
 }
@@ -84,109 +236,192 @@ func btree_map_insert_item_at(node *node_t, pos int, item item) {
 }
 
 /*
- * btree_map_insert_empty -- (internal) inserts an item into an empty node_t
+ * btree_map_abort -- (internal) gives up a transaction which fails with
+ * ErrPoolFull after some of its updates were made: go-pmem rolls the updates
+ * back as the panic unwinds through it, and pool_full, deferred by the
+ * function holding the transaction, returns the error
  */
-func btree_map_insert_empty(ptr *data, item item) {
-	ptr.root = pnew(node_t)
-	ptr.root.n = 0
+func btree_map_abort(err error) {
+	panic(err)
+}
 
-	btree_map_insert_item_at(ptr.root, 0, item)
+/*
+ * btree_map_alloc_node -- allocates the nodes of all the trees; tests replace
+ * it with an allocation the pool has no room for
+ */
+var btree_map_alloc_node = func() *node_t {
+	return pnew(node_t)
 }
 
 /*
- * btree_map_insert_node -- (internal) inserts and makes space for new node_t
+ * btree_map_new_node -- (internal) allocates an empty node_t; the allocation
+ * panics if the pool has no room for it (see pool_full). The mutators
+ * allocate all their nodes before their first update, so the panic leaves the
+ * tree unchanged
  */
-func btree_map_insert_node(node *node_t, p int, item item, left *node_t, right *node_t) {
-	if node.items[p].key != 0 { /* move all existing data */
-		copy(node.items[p+1:], node.items[p:])
-		copy(node.slots[p+1:], node.slots[p:])
+func btree_map_new_node() *node_t {
+	node := btree_map_alloc_node()
+	node.n = 0
+	node.sum = 0
+	return node
+}
+
+/*
+ * btree_map_node_sum -- (internal) computes the sum of values of a subtree
+ * from its items and the sums of its children
+ */
+func btree_map_node_sum(node *node_t) int {
+	sum := 0
+	for i := 0; i < node.n; i++ {
+		if !node.items[i].dead {
+			sum += node.items[i].value
+		}
 	}
-	node.slots[p] = left
-	node.slots[p + 1] = right
-	btree_map_insert_item_at(node, p, item)
+	for i := 0; i <= node.n; i++ {
+		if node.slots[i] != nil {
+			sum += node.slots[i].sum
+		}
+	}
+	return sum
+}
+
+/*
+ * btree_map_sum_fix -- (internal) recomputes the stored sum of a subtree
+ */
+func btree_map_sum_fix(node *node_t) {
+	node.sum = btree_map_node_sum(node)
+}
+
+/*
+ * btree_map_insert_empty -- (internal) inserts an item into the empty node_t
+ * root, which becomes the root of the tree
+ */
+func btree_map_insert_empty(ptr *data, root *node_t, item item) {
+	btree_map_insert_item_at(root, 0, item)
+	root.sum = item.value
+	ptr.root = root
 }
 
 /*
- * btree_map_create_split_node -- (internal) splits a node_t into two
+ * btree_map_insert_pos -- (internal) returns the position of key in node_t,
+ * after any items with an equal key
  */
-func btree_map_create_split_node(node *node_t, m *item) *node_t {
-	right := pnew(node_t)
-	right.n = 0
+func btree_map_insert_pos(less func(int, int) bool, n *node_t, key int) int {
+	p := 0
+	for p < n.n && !less(key, n.items[p].key) {
+		p++
+	}
+	return p
+}
 
-	c := (BTREE_ORDER / 2)
-	*m = node.items[c - 1]; /* select median item */
-	set_empty_item(&node.items[c - 1])
+/*
+ * btree_map_insert_node -- (internal) inserts an item and the child to its
+ * right at position p of a node_t which is not full
+ */
+func btree_map_insert_node(node *node_t, p int, item item, right *node_t) {
+	copy(node.items[p+1:], node.items[p:node.n])
+	copy(node.slots[p+2:], node.slots[p+1:node.n+1])
+	node.items[p] = item
+	node.slots[p + 1] = right
+	node.n += 1
+}
 
-	/* move everything right side of median to the new node_t */
-	for i := c; i < BTREE_ORDER; i++ {
-		if i != BTREE_ORDER - 1 {
-			right.items[right.n] = node.items[i]
-			right.n++
+/*
+ * btree_map_split_node -- (internal) inserts an item and the child to its
+ * right at position p of a full node_t by splitting it: the node_t keeps the
+ * first btree_map_min_items() items, right gets the ones after the median
+ * and the median is returned to be inserted into the parent
+ */
+func btree_map_split_node(node *node_t, p int, it item, child *node_t,
+	right *node_t) item {
+	var items [BTREE_ORDER]item
+	var slots [BTREE_ORDER + 1]*node_t
+
+	copy(items[:], node.items[:p])
+	items[p] = it
+	copy(items[p+1:], node.items[p:])
+	copy(slots[:], node.slots[:p+1])
+	slots[p + 1] = child
+	copy(slots[p+2:], node.slots[p+1:])
+
+	c := btree_map_min_items()
+	for i := 0; i < BTREE_ORDER - 1; i++ {
+		if i < c {
+			node.items[i] = items[i]
+		} else {
 			set_empty_item(&node.items[i])
 		}
-		right.slots[i - c] = node.slots[i]
-		node.slots[i] = nil
 	}
-	node.n = c - 1
+	for i := 0; i < BTREE_ORDER; i++ {
+		if i <= c {
+			node.slots[i] = slots[i]
+		} else {
+			node.slots[i] = nil
+		}
+	}
+	node.n = c
 
-	return right
+	copy(right.items[:], items[c+1:])
+	copy(right.slots[:], slots[c+1:])
+	right.n = btree_map_order - 1 - c
+
+	btree_map_sum_fix(node)
+	btree_map_sum_fix(right)
+	return items[c]
 }
 
 /*
- * btree_map_find_dest_node -- (internal) finds a place to insert the new key at
+ * btree_map_count_splits -- (internal) returns how many nodes inserting key
+ * splits in the subtree of n and whether n is one of them
  */
-func btree_map_find_dest_node(ptr *data, n *node_t, 
-	parent *node_t, key int, p *int) *node_t {
-	if n.n == BTREE_ORDER - 1 { /* node_t is full, perform a split */
-		var m item
-		right := btree_map_create_split_node(n, &m)
-
-		if parent != nil {
-			btree_map_insert_node(parent, *p, m, n, right)
-			if key > m.key { /* select node_t to continue search */
-				n = right
-			}
-		} else { /* replacing root node_t, the tree grows in height */
-			up := pnew(node_t)
-			up.n = 1
-			up.items[0] = m
-			up.slots[0] = n
-			up.slots[1] = right
+func btree_map_count_splits(less func(int, int) bool, n *node_t, key int) (int, bool) {
+	count, split := 0, true
+	if n.slots[0] != nil {
+		count, split = btree_map_count_splits(less,
+			n.slots[btree_map_insert_pos(less, n, key)], key)
+	}
+	if split && n.n == btree_map_order - 1 {
+		return count + 1, true
+	}
+	return count, false
+}
 
-			ptr.root = up
-			n = up
+/*
+ * btree_map_insert_in_node -- (internal) inserts the item into a leaf of the
+ * subtree of n and adds its value to the sums on the way. A full node_t is
+ * split into itself and a node_t taken from spare, which is returned, and
+ * the median is stored in m for the parent; nil is returned otherwise
+ */
+func btree_map_insert_in_node(less func(int, int) bool, n *node_t, it item,
+	spare *[]*node_t, m *item) *node_t {
+	p := btree_map_insert_pos(less, n, it.key)
+	n.sum += it.value
+
+	up := it
+	var right *node_t = nil
+	if n.slots[0] != nil {
+		right = btree_map_insert_in_node(less, n.slots[p], it, spare, &up)
+		if right == nil {
+			return nil
 		}
 	}
 
-	var i int
-	for i = 0; i < BTREE_ORDER - 1; i++ {
-		*p = i
-
-		/*
-		* The key either fits somewhere in the middle or at the
-		* right edge of the node.
- 		*/
-		if n.n == i || n.items[i].key > key {
-			if n.slots[i] == nil {
-				return n
-			} else {
-				return btree_map_find_dest_node(ptr, n.slots[i], n, key, p)
-			}
-		}
+	if n.n < btree_map_order - 1 {
+		btree_map_insert_node(n, p, up, right)
+		return nil
 	}
 
-	/*
-	 * The key is bigger than the last node_t element, go one level deeper
-	 * in the rightmost child.
- 	 */
-	return btree_map_find_dest_node(ptr, n.slots[i], n, key, p)
+	sibling := (*spare)[0]
+	*spare = (*spare)[1:]
+	*m = btree_map_split_node(n, p, up, right, sibling)
+	return sibling
 }
 
 /*
  * btree_map_insert_item -- (internal) inserts and makes space for new item
  */
 func btree_map_insert_item(node *node_t, p int, item item) {
-	if node.items[p].key != 0 {
+	if p < node.n {
 		copy(node.items[p+1:], node.items[p:])
 	}
 	btree_map_insert_item_at(node, p, item)
@@ -200,22 +435,203 @@ func btree_map_is_empty(ptr *data) bool {
 }
 
 /*
- * btree_map_insert -- inserts a new key-value pair into the ptr
+ * btree_map_insert -- inserts a new key-value pair into the ptr, returning
+ * false if the pool is full
  */
 func btree_map_insert(ptr *data, key int, value int) bool {
-	item := item {key, value}
+	return btree_map_try_insert(ptr, key, value) == nil
+}
+
+/*
+ * btree_map_spare_nodes -- (internal) allocates the nodes inserting key into
+ * ptr takes: one per split, and a new root if the root splits or the tree is
+ * empty; panics if the pool runs out
+ */
+func btree_map_spare_nodes(ptr *data, key int) []*node_t {
+	splits := 1
+	if !btree_map_is_empty(ptr) {
+		var grows bool
+		less := btree_map_comparators[ptr.order]
+		if splits, grows = btree_map_count_splits(less, ptr.root, key); grows {
+			splits++
+		}
+	}
+	spare := make([]*node_t, splits)
+	for i := range spare {
+		spare[i] = btree_map_new_node()
+	}
+	return spare
+}
+
+/*
+ * btree_map_try_insert -- inserts a new key-value pair into the ptr; the nodes
+ * the insert takes are allocated and the index entry is added before the tree
+ * is modified, so if the pool runs out the tree is left unchanged and
+ * ErrPoolFull is returned
+ */
+func btree_map_try_insert(ptr *data, key int, value int) (err error) {
+	defer pool_full(&err)
+
+	v := btree_map_writing(ptr)
+	defer btree_map_written(v)
+
+	less := btree_map_comparators[ptr.order]
+	it := item {key, value, ptr.epoch + 1, false}
+	var tomb *item = nil
+	if ptr.dead > 0 {
+		tomb = btree_map_find_any_item(less, ptr.root, key)
+	}
+	var spare []*node_t = nil
+	if tomb == nil || !tomb.dead {
+		spare = btree_map_spare_nodes(ptr, key)
+	}
+	/* the cached extremes are stale once only tombstones are left */
+	live := ptr.dead == 0 || btree_map_is_empty(ptr) ||
+		btree_map_leftmost_item(ptr.root) != nil
 	txn("undo") {
-		if btree_map_is_empty(ptr) {
-			btree_map_insert_empty(ptr, item)
+		/* the first update, which leaves the index as it was if it fails */
+		if ptr.index != nil {
+			if err := btree_map_index_add(ptr.index, key, value); err != nil {
+				return err
+			}
+		}
+		if tomb != nil && tomb.dead {
+			/* bring the tombstone back to life instead */
+			btree_map_keep_version(v, tomb)
+			*tomb = it
+			ptr.dead--
+			btree_map_sum_fix_path(less, ptr.root, key)
+			if btree_map_leftmost_item(ptr.root) == tomb {
+				ptr.min = key
+			}
+			if btree_map_rightmost_item(ptr.root) == tomb {
+				ptr.max = key
+			}
+		} else if btree_map_is_empty(ptr) {
+			btree_map_insert_empty(ptr, spare[0], it)
+			ptr.min = key
+			ptr.max = key
 		} else {
-			var p int /* position at the dest node_t to insert */
-			var parent *node_t = nil
-			var dest *node_t = btree_map_find_dest_node(ptr, ptr.root, parent, key, &p)
+			var m item
+			if right := btree_map_insert_in_node(less, ptr.root, it, &spare, &m); right != nil {
+				/* the root was split, the tree grows in height */
+				up := spare[0]
+				up.n = 1
+				up.items[0] = m
+				up.slots[0] = ptr.root
+				up.slots[1] = right
+				btree_map_sum_fix(up)
+				ptr.root = up
+			}
+			if !live || less(key, ptr.min) {
+				ptr.min = key
+			}
+			if !live || less(ptr.max, key) {
+				ptr.max = key
+			}
+		}
+		ptr.epoch = it.epoch
+	}
+	btree_map_assert(ptr)
+	return nil
+}
+
+/*
+ * btree_map_insert_hint_t -- the path from the root to the rightmost leaf,
+ * remembered by btree_map_insert_hint between inserts; the zero value is an
+ * empty hint
+ */
+type btree_map_insert_hint_t struct {
+	path []*node_t
+}
+
+/*
+ * btree_map_hint_valid -- (internal) checks that the hinted path is still the
+ * rightmost path of the tree and ends in a leaf with room for key after its
+ * last item, which is no tombstone
+ */
+func btree_map_hint_valid(ptr *data, hint *btree_map_insert_hint_t, key int) bool {
+	if len(hint.path) == 0 || hint.path[0] != ptr.root {
+		return false
+	}
+	for i := 1; i < len(hint.path); i++ {
+		n := hint.path[i - 1]
+		if n.slots[n.n] != hint.path[i] {
+			return false
+		}
+	}
+	leaf := hint.path[len(hint.path) - 1]
+	if leaf.slots[0] != nil || leaf.n == 0 || leaf.n == btree_map_order - 1 {
+		return false
+	}
+	last := leaf.items[leaf.n - 1]
+	return !last.dead && !btree_map_comparators[ptr.order](key, last.key)
+}
 
-			btree_map_insert_item(dest, p, item)
+/*
+ * btree_map_insert_hint -- inserts a new key-value pair into the ptr like
+ * btree_map_try_insert; a key which goes after all the others is appended to
+ * the rightmost leaf remembered in hint without searching from the root, so
+ * loading keys in order is cheaper. The hint is refreshed after an insert
+ * which splits the leaf or after the tree was changed by other means
+ */
+func btree_map_insert_hint(ptr *data, key int, value int,
+	hint *btree_map_insert_hint_t) error {
+	if btree_map_is_empty(ptr) || !btree_map_hint_valid(ptr, hint, key) {
+		if err := btree_map_try_insert(ptr, key, value); err != nil {
+			return err
 		}
+		hint.path = hint.path[:0]
+		for n := ptr.root; n != nil; n = n.slots[n.n] {
+			hint.path = append(hint.path, n)
+		}
+		return nil
 	}
-	return true
+
+	v := btree_map_writing(ptr)
+	defer btree_map_written(v)
+	txn("undo") {
+		if ptr.index != nil {
+			if err := btree_map_index_add(ptr.index, key, value); err != nil {
+				return err
+			}
+		}
+		ptr.epoch++
+		leaf := hint.path[len(hint.path) - 1]
+		btree_map_insert_item_at(leaf, leaf.n, item {key, value, ptr.epoch, false})
+		for _, n := range hint.path {
+			n.sum += value
+		}
+		ptr.max = key
+	}
+	btree_map_assert(ptr)
+	return nil
+}
+
+/*
+ * btree_map_append_hints -- the rightmost path of each tree, kept between
+ * calls to btree_map_append until btree_map_close
+ */
+var btree_map_append_hints = map[*data]*btree_map_insert_hint_t{}
+
+/*
+ * btree_map_append -- inserts a key-value pair whose key must go after every
+ * key in the tree, and fails otherwise without changing the tree; meant for
+ * loading input which is expected to be sorted, it walks the rightmost path
+ * only when the remembered one no longer fits
+ */
+func btree_map_append(ptr *data, key int, value int) error {
+	less := btree_map_comparators[ptr.order]
+	if max, ok := btree_map_tree_max(ptr); ok && !less(max, key) {
+		return fmt.Errorf("append: key %d does not follow the last key %d",
+			key, max)
+	}
+	hint := btree_map_append_hints[ptr]
+	if hint == nil {
+		hint = &btree_map_insert_hint_t{}
+		btree_map_append_hints[ptr] = hint
+	}
+	return btree_map_insert_hint(ptr, key, value, hint)
 }
 
 /*
@@ -237,6 +653,9 @@ func btree_map_rotate_right(rsb *node_t, node *node_t, parent *node_t, p int) {
 	/* move all existing elements back by one array slot */
 	copy(rsb.items[:], rsb.items[1:])
 	copy(rsb.slots[:], rsb.slots[1:])
+
+	btree_map_sum_fix(node)
+	btree_map_sum_fix(rsb)
 }
 
 /*
@@ -257,6 +676,9 @@ func btree_map_rotate_left(lsb *node_t, node *node_t, parent *node_t, p int) {
 	node.slots[0] = lsb.slots[lsb.n]
 
 	lsb.n -= 1 /* it loses one element, but still > min */
+
+	btree_map_sum_fix(node)
+	btree_map_sum_fix(lsb)
 }
 
 /*
@@ -281,6 +703,8 @@ func btree_map_merge(ptr *data, rn *node_t, node *node_t, parent *node_t, p int)
 
 	copy(parent.slots[p+1:], parent.slots[p+2:])
 
+	btree_map_sum_fix(node)
+
 	/* if the parent is empty then the tree shrinks in height */
 	if parent.n == 0 && parent == ptr.root {
 		ptr.root = node
@@ -300,9 +724,9 @@ func btree_map_rebalance(ptr *data, node *node_t, parent *node_t, p int) {
 		lsb = parent.slots[p - 1]
 	}
 
-	if rsb != nil && rsb.n > BTREE_MIN {
+	if rsb != nil && rsb.n > btree_map_min_items() {
 		btree_map_rotate_right(rsb, node, parent, p)
-	} else if lsb != nil && lsb.n > BTREE_MIN {
+	} else if lsb != nil && lsb.n > btree_map_min_items() {
 		btree_map_rotate_left(lsb, node, parent, p)
 	} else if rsb == nil { /* always merge with rightmost node_t */
 		btree_map_merge(ptr, node, lsb, parent, p - 1)
@@ -312,14 +736,23 @@ func btree_map_rebalance(ptr *data, node *node_t, parent *node_t, p int) {
 }
 
 /*
- * btree_map_get_leftmost_leaf -- (internal) searches for the successor
+ * btree_map_remove_leftmost -- (internal) removes the first item of the
+ * subtree of n, rebalancing the nodes below n on the way up
  */
-func btree_map_get_leftmost_leaf(ptr *data, n *node_t, p **node_t) *node_t {
+func btree_map_remove_leftmost(ptr *data, n *node_t) item {
+	var it item
 	if n.slots[0] == nil {
-		return n
+		it = n.items[0]
+		btree_map_remove_from_node(ptr, n, nil, 0)
+	} else {
+		child := n.slots[0]
+		it = btree_map_remove_leftmost(ptr, child)
+		if child.n < btree_map_min_items() {
+			btree_map_rebalance(ptr, child, n, 0)
+		}
 	}
-	*p = n
-	return btree_map_get_leftmost_leaf(ptr, n.slots[0], p)
+	btree_map_sum_fix(n)
+	return it
 }
 
 /*
@@ -336,21 +769,15 @@ func btree_map_remove_from_node(ptr *data, node *node_t, parent *node_t, p int)
 		return
 	}
 
-	/* can't delete from non-leaf nodes, remove successor */
+	/*
+	 * can't delete from non-leaf nodes, replace the item with its successor,
+	 * every node_t on the way to which can be left deficient
+	 */
 	var rchild *node_t = node.slots[p + 1]
-	var lp *node_t = node
-	var lm *node_t = btree_map_get_leftmost_leaf(ptr, rchild, &lp)
-
-	node.items[p] = lm.items[0]
+	node.items[p] = btree_map_remove_leftmost(ptr, rchild)
 
-	btree_map_remove_from_node(ptr, lm, lp, 0)
-
-	if lm.n < BTREE_MIN { /* right child can be deficient now */
-		if lp == node {
-			btree_map_rebalance(ptr, lm, lp, p+1)
-		} else {
-			btree_map_rebalance(ptr, lm, lp, 0)
-		}
+	if rchild.n < btree_map_min_items() {
+		btree_map_rebalance(ptr, rchild, node, p + 1)
 	}
 }
 
@@ -358,36 +785,40 @@ func btree_map_remove_from_node(ptr *data, node *node_t, parent *node_t, p int)
 // ((_i) != _n.n && _n.items[_i].key == (_k))
 
 // #define node_child_can_contain_item(_n, _i, _k)\
-// ((_i) == _n.n || _n.items[_i].key > (_k)) &&\
+// ((_i) == _n.n || less((_k), _n.items[_i].key)) &&\
 // _n.slots[_i] != nil
+//
+// less is the comparator of the tree the node belongs to
 
 func node_contains_item(n *node_t, i int, k int) bool {
 	return i != n.n && n.items[i].key == k
 }
 
-func node_child_can_contain_item(n *node_t, i int, k int) bool {
-	return (i != n.n || n.items[i].key > k) && n.slots[i] != nil
+func node_child_can_contain_item(less func(int, int) bool, n *node_t, i int, k int) bool {
+	return (i == n.n || less(k, n.items[i].key)) && n.slots[i] != nil
 }
 
 /*
  * btree_map_remove_item -- (internal) removes item from node_t
  */
 func btree_map_remove_item(ptr *data, node *node_t, parent *node_t, key int, p int) int {
+	less := btree_map_comparators[ptr.order]
 	ret := 0
 	for i := 0; i <= node.n; i++ {
 		if node_contains_item(node, i, key) {
 			ret = node.items[i].value
 			btree_map_remove_from_node(ptr, node, parent, i)
 			break
-		} else if node_child_can_contain_item(node, i, key) {
+		} else if node_child_can_contain_item(less, node, i, key) {
 			ret = btree_map_remove_item(ptr, node.slots[i],
 				node, key, i)
 			break
 		}
 	}
+	btree_map_sum_fix(node)
 
 	/* check for deficient nodes walking up */
-	if parent != nil && node.n < BTREE_MIN {
+	if parent != nil && node.n < btree_map_min_items() {
 		btree_map_rebalance(ptr, node, parent, p)
 	}
 
@@ -395,148 +826,1960 @@ func btree_map_remove_item(ptr *data, node *node_t, parent *node_t, key int, p i
 }
 
 /*
- * btree_map_remove -- removes key-value pair from the ptr
+ * btree_map_remove -- removes key-value pair from the ptr; it is left as a
+ * tombstone if the tree is lazy or a snapshot of it is open. A key in the
+ * overlay is dropped from it, and from the persistent tree as well if it is
+ * there, so that no value of it is left to read
  */
 func btree_map_remove(ptr *data, key int) int {
+	delete(btree_map_overlays[ptr], key)
+	v := btree_map_writing(ptr)
+	defer btree_map_written(v)
+	if ptr.lazy || btree_map_snapshots_open(v) {
+		return btree_map_remove_lazy(ptr, v, key)
+	}
+
 	ret := 0
+	if btree_map_is_empty(ptr) || btree_map_find_item(ptr, key) == nil {
+		return ret
+	}
 	txn("undo") {
+		if ptr.index != nil {
+			btree_map_index_remove(ptr.index, key,
+				btree_map_find_item(ptr, key).value)
+		}
 		ret = btree_map_remove_item(ptr, ptr.root, nil, key, 0)
+
+		/* find the new extreme if it was the one removed */
+		if !btree_map_is_empty(ptr) {
+			if key == ptr.min {
+				ptr.min = btree_map_leftmost_item(ptr.root).key
+			}
+			if key == ptr.max {
+				ptr.max = btree_map_rightmost_item(ptr.root).key
+			}
+		}
 	}
+	btree_map_assert(ptr)
 	return ret
 }
 
 /*
- * btree_map_get_in_node -- (internal) searches for a value in the node_t
+ * btree_map_remove_lazy -- (internal) turns the item of the key into a
+ * tombstone, leaving the nodes as they are; must be called with the lock of
+ * v held
  */
-func btree_map_get_in_node(node *node_t, key int) int {
-	for i := 0; i <= node.n; i++ {
-		if node_contains_item(node, i, key) {
-			return node.items[i].value
-		} else if node_child_can_contain_item(node, i, key) {
-			return btree_map_get_in_node(node.slots[i], key)
+func btree_map_remove_lazy(ptr *data, v *btree_map_versions_t, key int) int {
+	ret := 0
+	if btree_map_is_empty(ptr) {
+		return ret
+	}
+	it := btree_map_find_item(ptr, key)
+	if it == nil {
+		return ret
+	}
+	txn("undo") {
+		if ptr.index != nil {
+			btree_map_index_remove(ptr.index, key, it.value)
+		}
+		ret = it.value
+		btree_map_keep_version(v, it)
+		ptr.epoch++
+		it.epoch = ptr.epoch
+
+		/* a tombstone is left for btree_map_compact, which counts it */
+		it.dead = true
+		ptr.dead++
+		btree_map_sum_fix_path(btree_map_comparators[ptr.order], ptr.root, key)
+
+		/* find the new extreme if it was the one removed */
+		if key == ptr.min || key == ptr.max {
+			if first := btree_map_leftmost_item(ptr.root); first != nil {
+				ptr.min = first.key
+				ptr.max = btree_map_rightmost_item(ptr.root).key
+			}
 		}
 	}
-
-	return -1
+	btree_map_assert(ptr)
+	return ret
 }
 
 /*
- * btree_map_get -- searches for a value of the key
+ * btree_map_leftmost_item -- (internal) returns the first item of a subtree
+ * which is not a tombstone, or nil
  */
-func btree_map_get(ptr *data, key int) int {
-	if ptr.root == nil {
-		return 0
+func btree_map_leftmost_item(n *node_t) *item {
+	for i := 0; i <= n.n; i++ {
+		if n.slots[i] != nil {
+			if it := btree_map_leftmost_item(n.slots[i]); it != nil {
+				return it
+			}
+		}
+		if i < n.n && !n.items[i].dead {
+			return &n.items[i]
+		}
 	}
-	return btree_map_get_in_node(ptr.root, key)
+	return nil
 }
 
 /*
- * btree_map_lookup_in_node -- (internal) searches for key if exists
+ * btree_map_rightmost_item -- (internal) returns the last item of a subtree
+ * which is not a tombstone, or nil
  */
-func btree_map_lookup_in_node(node *node_t, key int) bool {
-	for i := 0; i <= node.n; i++ {
-		if node_contains_item(node, i, key) {
-			return true
-		} else if node_child_can_contain_item(node, i, key) {
-			return btree_map_lookup_in_node(node.slots[i], key)
+func btree_map_rightmost_item(n *node_t) *item {
+	for i := n.n; i >= 0; i-- {
+		if n.slots[i] != nil {
+			if it := btree_map_rightmost_item(n.slots[i]); it != nil {
+				return it
+			}
+		}
+		if i > 0 && !n.items[i - 1].dead {
+			return &n.items[i - 1]
 		}
 	}
-	return false
+	return nil
 }
 
 /*
- * btree_map_lookup -- searches if key exists
+ * btree_map_tree_min -- (internal) returns the first key of the persistent
+ * tree in the tree order in O(1)
  */
-func btree_map_lookup(ptr *data, key int) bool {
-	if ptr.root == nil {
-		return false
+func btree_map_tree_min(ptr *data) (int, bool) {
+	if btree_map_is_empty(ptr) || ptr.dead > 0 && btree_map_leftmost_item(ptr.root) == nil {
+		return 0, false
 	}
-	return btree_map_lookup_in_node(ptr.root, key)
+	return ptr.min, true
 }
 
 /*
- * btree_map_foreach_node -- (internal) recursively traverses tree
+ * btree_map_tree_max -- (internal) returns the last key of the persistent
+ * tree in the tree order in O(1)
  */
-func btree_map_foreach_node(p *node_t, cb func(int, int) bool) bool {
-	if p == nil {
-		return false
+func btree_map_tree_max(ptr *data) (int, bool) {
+	if btree_map_is_empty(ptr) || ptr.dead > 0 && btree_map_leftmost_item(ptr.root) == nil {
+		return 0, false
 	}
-
-	for i := 0; i <= p.n; i++ {
-		if btree_map_foreach_node(p.slots[i], cb) {
-			return true
-		}
-
-		if i != p.n && p.items[i].key != 0 {
-			if cb(p.items[i].key, p.items[i].value) {
-				return true
-			}
-		}
-	}
-	return false
+	return ptr.max, true
 }
 
 /*
- * btree_map_foreach -- initiates recursive traversal
+ * btree_map_min -- returns the first key in the tree order, in O(1) unless
+ * the overlay holds keys
  */
-func btree_map_foreach(ptr *data, cb func(int, int) bool) bool {
-	return btree_map_foreach_node(ptr.root, cb)
+func btree_map_min(ptr *data) (int, bool) {
+	key, ok := btree_map_tree_min(ptr)
+	key, _, ok = btree_map_overlay_first(ptr, func(int) bool { return true },
+		btree_map_comparators[ptr.order], key, 0, ok)
+	return key, ok
 }
 
 /*
- * ctree_map_check -- check if given persistent object is a tree ptr
+ * btree_map_max -- returns the last key in the tree order, in O(1) unless
+ * the overlay holds keys
  */
-func btree_map_check(ptr *data) bool {
-	return ptr == nil // || !TOID_VALID(ptr)
+func btree_map_max(ptr *data) (int, bool) {
+	less := btree_map_comparators[ptr.order]
+	key, ok := btree_map_tree_max(ptr)
+	key, _, ok = btree_map_overlay_first(ptr, func(int) bool { return true },
+		func(a int, b int) bool { return less(b, a) }, key, 0, ok)
+	return key, ok
 }
 
 /*
- * btree_map_remove_free -- removes and frees an object from the tree
+ * btree_map_get_in_node -- (internal) searches for a value in the node_t
  */
-func btree_map_remove_free(ptr *data, key int) bool {
-	txn("undo") {
-		btree_map_remove(ptr, key)
+func btree_map_get_in_node(less func(int, int) bool, node *node_t, key int) int {
+	for i := 0; i <= node.n; i++ {
+		if node_contains_item(node, i, key) {
+			if node.items[i].dead {
+				return -1
+			}
+			return node.items[i].value
+		} else if node_child_can_contain_item(less, node, i, key) {
+			return btree_map_get_in_node(less, node.slots[i], key)
+		}
 	}
-	return true
+
+	return -1
 }
 
 /*
- * str_insert -- hs_insert wrapper which works on strings
+ * btree_map_get -- searches for a value of the key
  */
-func str_insert(ptr *data, str string) {
-	var key int
-	if _, err := fmt.Sscanf(str, "%d", &key); err == nil {
-		btree_map_insert(ptr, key, 0)
-	} else {
-		fmt.Println("insert: invalid syntax")
+func btree_map_get(ptr *data, key int) int {
+	if value, ok := btree_map_overlays[ptr][key]; ok {
+		return value
+	}
+	if ptr.root == nil {
+		return 0
 	}
+	return btree_map_get_in_node(btree_map_comparators[ptr.order], ptr.root, key)
 }
 
 /*
- * str_remove -- hs_remove wrapper which works on strings
+ * btree_map_get_many_in_node -- (internal) searches for the keys selected by
+ * order, which is sorted by key, visiting every node at most once; returns
+ * the number of nodes visited
  */
-func str_remove(ptr *data, str string) {
-	var key int
-	if _, err := fmt.Sscanf(str, "%d", &key); err == nil {
-		if btree_map_lookup(ptr, key) {
-			btree_map_remove(ptr, key)
-		} else {
-			fmt.Println("no such value")
+func btree_map_get_many_in_node(less func(int, int) bool, node *node_t,
+	keys []int, order []int, vals []int, found []bool) int {
+	visited := 1
+	i := 0
+	for len(order) > 0 {
+		key := keys[order[0]]
+		for i < node.n && less(node.items[i].key, key) {
+			i++
 		}
-	} else {
-		fmt.Println("remove: invalid syntax")
-	}
-}
+		if i < node.n && node.items[i].key == key {
+			if !node.items[i].dead {
+				vals[order[0]] = node.items[i].value
+				found[order[0]] = true
+			}
+			order = order[1:]
+			continue
+		}
+
+		/* the following keys ordered before items[i] share the child */
+		j := 1
+		for j < len(order) && (i == node.n || less(keys[order[j]], node.items[i].key)) {
+			j++
+		}
+		if node.slots[i] != nil {
+			visited += btree_map_get_many_in_node(less, node.slots[i], keys,
+				order[:j], vals, found)
+		}
+		order = order[j:]
+	}
+	return visited
+}
+
+/*
+ * btree_map_get_many -- searches for the values of many keys at once; the keys
+ * are sorted first so that nearby keys share the nodes on their paths
+ */
+func btree_map_get_many(ptr *data, keys []int) ([]int, []bool) {
+	vals, found, _ := btree_map_get_many_stats(ptr, keys)
+	return vals, found
+}
+
+/*
+ * btree_map_get_many_stats -- searches like btree_map_get_many, also returning
+ * the number of nodes visited by the search
+ */
+func btree_map_get_many_stats(ptr *data, keys []int) ([]int, []bool, int) {
+	vals := make([]int, len(keys))
+	found := make([]bool, len(keys))
+	visited := 0
+	defer func() {
+		for i, key := range keys {
+			if value, ok := btree_map_overlays[ptr][key]; ok {
+				vals[i], found[i] = value, true
+			}
+		}
+	}()
+	if btree_map_is_empty(ptr) {
+		return vals, found, visited
+	}
+
+	less := btree_map_comparators[ptr.order]
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a int, b int) bool {
+		return less(keys[order[a]], keys[order[b]])
+	})
+
+	visited = btree_map_get_many_in_node(less, ptr.root, keys, order, vals, found)
+	return vals, found, visited
+}
+
+/*
+ * btree_map_get_stats -- searches for a value of the key, also returning the
+ * number of nodes visited by the search
+ */
+func btree_map_get_stats(ptr *data, key int) (int, bool, int) {
+	if value, ok := btree_map_overlays[ptr][key]; ok {
+		return value, true, 0
+	}
+	less := btree_map_comparators[ptr.order]
+	visited := 0
+	node := ptr.root
+	for node != nil {
+		visited++
+		next := (*node_t)(nil)
+		for i := 0; i <= node.n; i++ {
+			if node_contains_item(node, i, key) {
+				if node.items[i].dead {
+					return 0, false, visited
+				}
+				return node.items[i].value, true, visited
+			} else if node_child_can_contain_item(less, node, i, key) {
+				next = node.slots[i]
+				break
+			}
+		}
+		node = next
+	}
+	return 0, false, visited
+}
+
+/*
+ * btree_map_prefix_sum_in_node -- (internal) sums the values of the subtree
+ * whose keys are not ordered after the key
+ */
+func btree_map_prefix_sum_in_node(less func(int, int) bool, node *node_t, key int) int {
+	if node == nil {
+		return 0
+	}
+	sum := 0
+	for i := 0; i < node.n; i++ {
+		if less(key, node.items[i].key) {
+			return sum + btree_map_prefix_sum_in_node(less, node.slots[i], key)
+		}
+		if node.slots[i] != nil {
+			sum += node.slots[i].sum
+		}
+		if !node.items[i].dead {
+			sum += node.items[i].value
+		}
+	}
+	return sum + btree_map_prefix_sum_in_node(less, node.slots[node.n], key)
+}
+
+/*
+ * btree_map_prefix_sum -- returns the sum of the values of all keys up to and
+ * including the key in O(height)
+ */
+func btree_map_prefix_sum(ptr *data, key int) int {
+	if btree_map_is_empty(ptr) {
+		return 0
+	}
+	return btree_map_prefix_sum_in_node(btree_map_comparators[ptr.order], ptr.root, key)
+}
+
+/*
+ * btree_map_sum_fix_path -- (internal) recomputes the sums on the path to the
+ * item holding the key, after its value was changed in place
+ */
+func btree_map_sum_fix_path(less func(int, int) bool, node *node_t, key int) {
+	for i := 0; i <= node.n; i++ {
+		if node_contains_item(node, i, key) {
+			break
+		} else if node_child_can_contain_item(less, node, i, key) {
+			btree_map_sum_fix_path(less, node.slots[i], key)
+			break
+		}
+	}
+	btree_map_sum_fix(node)
+}
+
+/*
+ * btree_map_lookup_in_node -- (internal) searches for key if exists
+ */
+func btree_map_lookup_in_node(less func(int, int) bool, node *node_t, key int) bool {
+	for i := 0; i <= node.n; i++ {
+		if node_contains_item(node, i, key) {
+			return !node.items[i].dead
+		} else if node_child_can_contain_item(less, node, i, key) {
+			return btree_map_lookup_in_node(less, node.slots[i], key)
+		}
+	}
+	return false
+}
+
+/*
+ * btree_map_lookup -- searches if key exists
+ */
+func btree_map_lookup(ptr *data, key int) bool {
+	if _, ok := btree_map_overlays[ptr][key]; ok {
+		return true
+	}
+	if ptr.root == nil {
+		return false
+	}
+	return btree_map_lookup_in_node(btree_map_comparators[ptr.order], ptr.root, key)
+}
+
+/*
+ * btree_map_successor_in_node -- (internal) searches for the first item
+ * ordered after the key
+ */
+func btree_map_successor_in_node(less func(int, int) bool, node *node_t, key int) *item {
+	if node == nil {
+		return nil
+	}
+	for i := 0; i < node.n; i++ {
+		if less(key, node.items[i].key) {
+			if it := btree_map_successor_in_node(less, node.slots[i], key); it != nil {
+				return it
+			}
+			return &node.items[i]
+		}
+	}
+	return btree_map_successor_in_node(less, node.slots[node.n], key)
+}
+
+/*
+ * btree_map_predecessor_in_node -- (internal) searches for the last item
+ * ordered before the key
+ */
+func btree_map_predecessor_in_node(less func(int, int) bool, node *node_t, key int) *item {
+	if node == nil {
+		return nil
+	}
+	for i := node.n - 1; i >= 0; i-- {
+		if less(node.items[i].key, key) {
+			if it := btree_map_predecessor_in_node(less, node.slots[i + 1], key); it != nil {
+				return it
+			}
+			return &node.items[i]
+		}
+	}
+	return btree_map_predecessor_in_node(less, node.slots[0], key)
+}
+
+/*
+ * btree_map_successor -- returns the entry right after the key (which need
+ * not be stored) in the tree order, if any
+ */
+func btree_map_successor(ptr *data, key int) (int, int, bool) {
+	less := btree_map_comparators[ptr.order]
+	k, v, ok := 0, 0, false
+	for it := btree_map_successor_in_node(less, ptr.root, key); it != nil;
+		it = btree_map_successor_in_node(less, ptr.root, it.key) {
+		if !it.dead {
+			k, v, ok = it.key, it.value, true
+			break
+		}
+	}
+	return btree_map_overlay_first(ptr, func(o int) bool { return less(key, o) },
+		less, k, v, ok)
+}
+
+/*
+ * btree_map_predecessor -- returns the entry right before the key (which
+ * need not be stored) in the tree order, if any
+ */
+func btree_map_predecessor(ptr *data, key int) (int, int, bool) {
+	less := btree_map_comparators[ptr.order]
+	k, v, ok := 0, 0, false
+	for it := btree_map_predecessor_in_node(less, ptr.root, key); it != nil;
+		it = btree_map_predecessor_in_node(less, ptr.root, it.key) {
+		if !it.dead {
+			k, v, ok = it.key, it.value, true
+			break
+		}
+	}
+	return btree_map_overlay_first(ptr, func(o int) bool { return less(o, key) },
+		func(a int, b int) bool { return less(b, a) }, k, v, ok)
+}
+
+/*
+ * btree_map_foreach_node -- (internal) recursively traverses tree
+ */
+func btree_map_foreach_node(p *node_t, cb func(int, int) bool) bool {
+	if p == nil {
+		return false
+	}
+
+	for i := 0; i <= p.n; i++ {
+		if btree_map_foreach_node(p.slots[i], cb) {
+			return true
+		}
+
+		if i != p.n && !p.items[i].dead {
+			if cb(p.items[i].key, p.items[i].value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * btree_map_foreach -- initiates recursive traversal, which walks the keys of
+ * the overlay as well
+ */
+func btree_map_foreach(ptr *data, cb func(int, int) bool) bool {
+	keys := btree_map_overlay_keys(ptr, func(int) bool { return true })
+	return btree_map_overlay_walk(ptr, keys, cb, func(cb func(int, int) bool) {
+		btree_map_foreach_node(ptr.root, cb)
+	})
+}
+
+/*
+ * btree_map_range_node -- (internal) traverses the items of a subtree from
+ * lo to hi, skipping the subtrees which lie outside, and counts the nodes it
+ * visits in visited; returns true once an item past hi is reached or cb
+ * returns true
+ */
+func btree_map_range_node(less func(int, int) bool, p *node_t, lo int, hi int,
+	cb func(int, int) bool, visited *int) bool {
+	if p == nil {
+		return false
+	}
+	*visited++
+
+	for i := 0; i <= p.n; i++ {
+		/* slots[i] holds the keys between items[i - 1] and items[i] */
+		if (i == p.n || less(lo, p.items[i].key)) &&
+			btree_map_range_node(less, p.slots[i], lo, hi, cb, visited) {
+			return true
+		}
+
+		if i == p.n {
+			break
+		}
+		if less(hi, p.items[i].key) {
+			return true
+		}
+		if !less(p.items[i].key, lo) && !p.items[i].dead {
+			if cb(p.items[i].key, p.items[i].value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * btree_map_range -- traverses the entries from lo to hi, both included, in
+ * the tree order, those of the overlay among them; only the paths to lo and
+ * hi and the subtrees in between are visited
+ */
+func btree_map_range(ptr *data, lo int, hi int, cb func(int, int) bool) {
+	btree_map_range_stats(ptr, lo, hi, cb)
+}
+
+/*
+ * btree_map_range_stats -- traverses like btree_map_range, also returning the
+ * number of nodes visited by the traversal
+ */
+func btree_map_range_stats(ptr *data, lo int, hi int, cb func(int, int) bool) int {
+	less := btree_map_comparators[ptr.order]
+	visited := 0
+	keys := btree_map_overlay_keys(ptr, func(key int) bool {
+		return !less(key, lo) && !less(hi, key)
+	})
+	btree_map_overlay_walk(ptr, keys, cb, func(cb func(int, int) bool) {
+		btree_map_range_node(less, ptr.root, lo, hi, cb, &visited)
+	})
+	return visited
+}
+
+/*
+ * btree_map_key_histogram -- splits the range between the smallest and the
+ * largest key into buckets of equal width and counts the keys in each, the
+ * smallest keys in the first bucket
+ */
+func btree_map_key_histogram(ptr *data, buckets int) []int {
+	if buckets <= 0 {
+		return nil
+	}
+	counts := make([]int, buckets)
+	if btree_map_is_empty(ptr) {
+		return counts
+	}
+
+	lo, hi := ptr.min, ptr.max
+	if hi < lo {
+		lo, hi = hi, lo
+	}
+	/*
+	 * key falls into bucket (key - lo) * buckets / (hi - lo + 1), worked out
+	 * in 128 bits; the span of 2^64 keys between MinInt and MaxInt wraps
+	 * around to 0, and dividing by it is taking the high word
+	 */
+	span := uint64(hi - lo) + 1
+	btree_map_foreach_keys(ptr, func(key int) bool {
+		high, low := bits.Mul64(uint64(key - lo), uint64(buckets))
+		if span == 0 {
+			counts[high]++
+		} else {
+			bucket, _ := bits.Div64(high, low, span)
+			counts[bucket]++
+		}
+		return false
+	})
+	return counts
+}
+
+/*
+ * btree_map_foreach_keys_node -- (internal) recursively walks the keys of
+ * the subtree of p in order
+ */
+func btree_map_foreach_keys_node(p *node_t, cb func(int) bool) bool {
+	if p == nil {
+		return false
+	}
+
+	for i := 0; i <= p.n; i++ {
+		if btree_map_foreach_keys_node(p.slots[i], cb) {
+			return true
+		}
+
+		if i != p.n && !p.items[i].dead {
+			if cb(p.items[i].key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * btree_map_foreach_keys -- calls cb for every key in order without reading
+ * the values, stopping early when cb returns true
+ */
+func btree_map_foreach_keys(ptr *data, cb func(int) bool) bool {
+	return btree_map_foreach_keys_node(ptr.root, cb)
+}
+
+/*
+ * btree_map_parallel_foreach -- traverses the subtrees of the root with up to
+ * workers goroutines; cb is called concurrently and in no particular order
+ */
+func btree_map_parallel_foreach(ptr *data, workers int, cb func(int, int)) {
+	if btree_map_is_empty(ptr) {
+		return
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	visit := func(key int, value int) bool {
+		cb(key, value)
+		return false
+	}
+
+	root := ptr.root
+	subtrees := make(chan *node_t, root.n + 1)
+	for i := 0; i <= root.n; i++ {
+		if root.slots[i] != nil {
+			subtrees <- root.slots[i]
+		}
+	}
+	close(subtrees)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range subtrees {
+				btree_map_foreach_node(n, visit)
+			}
+		}()
+	}
+
+	for i := 0; i < root.n; i++ {
+		if !root.items[i].dead {
+			cb(root.items[i].key, root.items[i].value)
+		}
+	}
+	wg.Wait()
+}
+
+/*
+ * btree_map_scan_t -- in-order cursor that keeps the path from the root, so
+ * that stepping to the next item never descends from the root again. It reads
+ * the items of the internal nodes as well as those of the leaves: every key is
+ * stored once, in whichever node holds it, so there are no separators to skip.
+ * The B+tree whose scan follows linked leaves is bptree_map in bplustree.go
+ */
+type btree_map_scan_t struct {
+	nodes []*node_t
+	pos   []int
+}
+
+/*
+ * btree_map_scan_push -- (internal) pushes the path to the leftmost leaf
+ */
+func btree_map_scan_push(it *btree_map_scan_t, n *node_t) {
+	for n != nil {
+		it.nodes = append(it.nodes, n)
+		it.pos = append(it.pos, 0)
+		n = n.slots[0]
+	}
+}
+
+/*
+ * btree_map_scan_begin -- returns a cursor positioned before the first item
+ */
+func btree_map_scan_begin(ptr *data) *btree_map_scan_t {
+	it := &btree_map_scan_t{}
+	if !btree_map_is_empty(ptr) {
+		btree_map_scan_push(it, ptr.root)
+	}
+	return it
+}
+
+/*
+ * btree_map_scan_next -- returns the next item of the cursor, if any
+ */
+func btree_map_scan_next(it *btree_map_scan_t) (int, int, bool) {
+	for len(it.nodes) > 0 {
+		top := len(it.nodes) - 1
+		n, i := it.nodes[top], it.pos[top]
+		if i < n.n {
+			it.pos[top] = i + 1
+			btree_map_scan_push(it, n.slots[i + 1])
+			if !n.items[i].dead {
+				return n.items[i].key, n.items[i].value, true
+			}
+			continue
+		}
+		it.nodes = it.nodes[:top]
+		it.pos = it.pos[:top]
+	}
+	return 0, 0, false
+}
+
+/*
+ * btree_map_scan -- sequentially scans all items in order in O(n), and the
+ * keys of the overlay with them
+ */
+func btree_map_scan(ptr *data, cb func(int, int) bool) bool {
+	keys := btree_map_overlay_keys(ptr, func(int) bool { return true })
+	return btree_map_overlay_walk(ptr, keys, cb, func(cb func(int, int) bool) {
+		it := btree_map_scan_begin(ptr)
+		for {
+			key, value, ok := btree_map_scan_next(it)
+			if !ok || cb(key, value) {
+				return
+			}
+		}
+	})
+}
+
+/*
+ * btree_map_all -- returns an iterator over the items in order, those of the
+ * overlay among them, shaped as a Go 1.23 range-over-func one: it calls yield
+ * with each item until yield returns false. The go-pmem toolchain predates
+ * range loops over functions, so callers call the iterator with their yield
+ * function themselves
+ */
+func btree_map_all(ptr *data) func(yield func(int, int) bool) {
+	return func(yield func(int, int) bool) {
+		btree_map_scan(ptr, func(key int, value int) bool {
+			return !yield(key, value)
+		})
+	}
+}
+
+/*
+ * btree_map_version_t -- a version of an item which a later write replaced
+ */
+type btree_map_version_t struct {
+	value int
+	epoch int
+	dead  bool
+}
+
+/*
+ * btree_map_versions_t -- the volatile state of the snapshots of a tree: the
+ * number of open snapshots at each epoch, and the versions of the items
+ * which were written since a snapshot which still sees them was taken. The
+ * writers of the tree hold lock while they change it, the snapshot readers
+ * hold it for reading between their steps
+ */
+type btree_map_versions_t struct {
+	lock sync.RWMutex
+	open map[int]int
+	old  map[int][]btree_map_version_t /* by key, oldest first */
+}
+
+/*
+ * btree_map_versions -- the snapshot state of each open tree, made by
+ * btree_map_open and dropped by btree_map_close; guarded by
+ * btree_map_versions_lock
+ */
+var btree_map_versions = map[*data]*btree_map_versions_t{}
+var btree_map_versions_lock sync.Mutex
+
+/*
+ * ErrSnapshotOpen -- returned by btree_map_compact while a snapshot of the
+ * tree is open, as the tombstones it would drop are still seen by it
+ */
+var ErrSnapshotOpen = errors.New("a snapshot of the tree is open")
+
+/*
+ * btree_map_versions_of -- (internal) returns the snapshot state of ptr, or
+ * nil if the tree is not open
+ */
+func btree_map_versions_of(ptr *data) *btree_map_versions_t {
+	btree_map_versions_lock.Lock()
+	defer btree_map_versions_lock.Unlock()
+	return btree_map_versions[ptr]
+}
+
+/*
+ * btree_map_writing -- (internal) returns the snapshot state of ptr with its
+ * lock held for a write, or nil if the tree is not open; the write ends with
+ * btree_map_written
+ */
+func btree_map_writing(ptr *data) *btree_map_versions_t {
+	v := btree_map_versions_of(ptr)
+	if v != nil {
+		v.lock.Lock()
+	}
+	return v
+}
+
+/*
+ * btree_map_written -- (internal) ends a write begun by btree_map_writing
+ */
+func btree_map_written(v *btree_map_versions_t) {
+	if v != nil {
+		v.lock.Unlock()
+	}
+}
+
+/*
+ * btree_map_snapshots_open -- (internal) checks whether a snapshot is open in
+ * the state v, whose lock is held
+ */
+func btree_map_snapshots_open(v *btree_map_versions_t) bool {
+	return v != nil && len(v.open) > 0
+}
+
+/*
+ * btree_map_keep_version -- (internal) remembers the current version of it
+ * before a write replaces it, if an open snapshot sees it; must be called
+ * with the lock of v held
+ */
+func btree_map_keep_version(v *btree_map_versions_t, it *item) {
+	if v == nil {
+		return
+	}
+	for epoch := range v.open {
+		if it.epoch <= epoch {
+			v.old[it.key] = append(v.old[it.key],
+				btree_map_version_t{it.value, it.epoch, it.dead})
+			return
+		}
+	}
+}
+
+/*
+ * btree_map_version_at -- (internal) returns the value of the version of it
+ * seen at epoch, and false if there was no live one then
+ */
+func btree_map_version_at(v *btree_map_versions_t, it *item, epoch int) (int, bool) {
+	if it.epoch <= epoch {
+		return it.value, !it.dead
+	}
+	old := v.old[it.key]
+	for i := len(old) - 1; i >= 0; i-- {
+		if old[i].epoch <= epoch {
+			return old[i].value, !old[i].dead
+		}
+	}
+	return 0, false
+}
+
+/*
+ * btree_map_snapshot -- opens a snapshot of the tree as it is now and returns
+ * its epoch; until btree_map_release, btree_map_foreach_at at that epoch sees
+ * the entries of the moment, whatever is inserted, updated or removed after.
+ * While a snapshot is open removals leave tombstones, which a tree that is
+ * not lazy keeps until btree_map_compact
+ */
+func btree_map_snapshot(ptr *data) (int, error) {
+	v := btree_map_writing(ptr)
+	defer btree_map_written(v)
+	if v == nil {
+		return 0, errors.New("snapshot: the tree is not open")
+	}
+	v.open[ptr.epoch]++
+	return ptr.epoch, nil
+}
+
+/*
+ * btree_map_release -- closes a snapshot opened by btree_map_snapshot; the
+ * old versions are dropped with the last one
+ */
+func btree_map_release(ptr *data, epoch int) {
+	v := btree_map_writing(ptr)
+	defer btree_map_written(v)
+	if v == nil {
+		return
+	}
+	if v.open[epoch]--; v.open[epoch] <= 0 {
+		delete(v.open, epoch)
+	}
+	if len(v.open) == 0 {
+		v.old = make(map[int][]btree_map_version_t)
+	}
+}
+
+/*
+ * btree_map_first_item -- (internal) returns the first item of a subtree,
+ * which may be a tombstone
+ */
+func btree_map_first_item(n *node_t) *item {
+	for n.slots[0] != nil {
+		n = n.slots[0]
+	}
+	return &n.items[0]
+}
+
+/*
+ * btree_map_next_at -- (internal) returns the first entry seen at epoch which
+ * is ordered after key, or the first one if first is set
+ */
+func btree_map_next_at(ptr *data, v *btree_map_versions_t, epoch int,
+	key int, first bool) (int, int, bool) {
+	if btree_map_is_empty(ptr) {
+		return 0, 0, false
+	}
+	less := btree_map_comparators[ptr.order]
+	var it *item
+	if first {
+		it = btree_map_first_item(ptr.root)
+	} else {
+		it = btree_map_successor_in_node(less, ptr.root, key)
+	}
+	for ; it != nil; it = btree_map_successor_in_node(less, ptr.root, it.key) {
+		if value, ok := btree_map_version_at(v, it, epoch); ok {
+			return it.key, value, true
+		}
+	}
+	return 0, 0, false
+}
+
+/*
+ * btree_map_foreach_at -- traverses the entries of the snapshot at epoch in
+ * order. Each entry is looked up after the previous one with the tree held
+ * for reading, so writers go on between the steps and cb runs unlocked
+ */
+func btree_map_foreach_at(ptr *data, epoch int, cb func(int, int) bool) bool {
+	v := btree_map_versions_of(ptr)
+	if v == nil {
+		return false
+	}
+	key, first := 0, true
+	for {
+		v.lock.RLock()
+		next, value, ok := btree_map_next_at(ptr, v, epoch, key, first)
+		v.lock.RUnlock()
+		if !ok {
+			return false
+		}
+		if cb(next, value) {
+			return true
+		}
+		key, first = next, false
+	}
+}
+
+/*
+ * btree_map_reader_t -- io.Reader over the entries of a tree, see
+ * btree_map_reader
+ */
+type btree_map_reader_t struct {
+	it  *btree_map_scan_t
+	buf [16]byte
+	off int /* bytes of buf already read */
+	n   int /* bytes in buf */
+}
+
+/*
+ * btree_map_reader -- returns a reader producing the entries in order as
+ * 16-byte records (little-endian 64-bit key, then value); the records are
+ * generated as the reader is consumed
+ */
+func btree_map_reader(ptr *data) io.Reader {
+	return &btree_map_reader_t{it: btree_map_scan_begin(ptr)}
+}
+
+func (r *btree_map_reader_t) Read(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		if r.off == r.n {
+			key, value, ok := btree_map_scan_next(r.it)
+			if !ok {
+				if total == 0 {
+					return 0, io.EOF
+				}
+				return total, nil
+			}
+			binary.LittleEndian.PutUint64(r.buf[0:], uint64(key))
+			binary.LittleEndian.PutUint64(r.buf[8:], uint64(value))
+			r.off, r.n = 0, len(r.buf)
+		}
+		c := copy(p, r.buf[r.off:r.n])
+		r.off += c
+		total += c
+		p = p[c:]
+	}
+	return total, nil
+}
+
+/*
+ * btree_map_foreach_chunk -- traverses the tree in order delivering up to
+ * chunk entries at a time; the slices are reused between calls
+ */
+func btree_map_foreach_chunk(ptr *data, chunk int, cb func([]int, []int) bool) bool {
+	if chunk <= 0 {
+		chunk = 1
+	}
+	keys := make([]int, 0, chunk)
+	vals := make([]int, 0, chunk)
+	if btree_map_foreach(ptr, func(key int, value int) bool {
+		keys = append(keys, key)
+		vals = append(vals, value)
+		if len(keys) < chunk {
+			return false
+		}
+		stop := cb(keys, vals)
+		keys = keys[:0]
+		vals = vals[:0]
+		return stop
+	}) {
+		return true
+	}
+	if len(keys) > 0 {
+		return cb(keys, vals)
+	}
+	return false
+}
+
+/*
+ * btree_map_check_node -- (internal) verifies the occupancy and order of a
+ * subtree whose keys must lie strictly between lo and hi (nil if unbounded)
+ */
+func btree_map_check_node(less func(int, int) bool, n *node_t, lo *int, hi *int,
+	depth int, leaf_depth *int, is_root bool) error {
+	if n.n < 0 || n.n > btree_map_order - 1 {
+		return fmt.Errorf("node %p at depth %d holds %d items", n, depth, n.n)
+	}
+	if !is_root && n.n < btree_map_min_items() {
+		return fmt.Errorf("node %p at depth %d holds %d items, fewer than %d",
+			n, depth, n.n, btree_map_min_items())
+	}
+
+	prev := lo
+	for i := 0; i < n.n; i++ {
+		key := n.items[i].key
+		if prev != nil && !less(*prev, key) || hi != nil && !less(key, *hi) {
+			return fmt.Errorf("key %d of node %p at depth %d is out of order",
+				key, n, depth)
+		}
+		prev = &n.items[i].key
+	}
+
+	if sum := btree_map_node_sum(n); sum != n.sum {
+		return fmt.Errorf("node %p at depth %d has sum %d instead of %d",
+			n, depth, n.sum, sum)
+	}
+
+	if n.slots[0] == nil { /* leaf */
+		for i := 0; i <= n.n; i++ {
+			if n.slots[i] != nil {
+				return fmt.Errorf("leaf %p at depth %d has a child", n, depth)
+			}
+		}
+		if *leaf_depth < 0 {
+			*leaf_depth = depth
+		} else if *leaf_depth != depth {
+			return fmt.Errorf("leaf %p is at depth %d, other leaves at depth %d",
+				n, depth, *leaf_depth)
+		}
+		return nil
+	}
+
+	for i := 0; i <= n.n; i++ {
+		if n.slots[i] == nil {
+			return fmt.Errorf("node %p at depth %d misses child %d", n, depth, i)
+		}
+		var clo *int = lo
+		var chi *int = hi
+		if i > 0 {
+			clo = &n.items[i - 1].key
+		}
+		if i < n.n {
+			chi = &n.items[i].key
+		}
+		if err := btree_map_check_node(less, n.slots[i], clo, chi, depth + 1,
+			leaf_depth, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * btree_map_check_invariants -- verifies the structure of the whole tree and
+ * the cached extremes, returning a description of the first violation
+ */
+func btree_map_check_invariants(ptr *data) error {
+	if btree_map_is_empty(ptr) {
+		return btree_map_check_index(ptr)
+	}
+	leaf_depth := -1
+	less := btree_map_comparators[ptr.order]
+	if err := btree_map_check_node(less, ptr.root, nil, nil, 0, &leaf_depth, true); err != nil {
+		return err
+	}
+	if dead := btree_map_count_dead(ptr.root); dead != ptr.dead {
+		return fmt.Errorf("%d tombstones are counted, %d found", ptr.dead, dead)
+	}
+	first := btree_map_leftmost_item(ptr.root)
+	if first == nil { /* nothing but tombstones */
+		return btree_map_check_index(ptr)
+	}
+	if min := first.key; min != ptr.min {
+		return fmt.Errorf("cached min %d differs from the first key %d", ptr.min, min)
+	}
+	if max := btree_map_rightmost_item(ptr.root).key; max != ptr.max {
+		return fmt.Errorf("cached max %d differs from the last key %d", ptr.max, max)
+	}
+	return btree_map_check_index(ptr)
+}
+
+/*
+ * btree_map_check_index -- (internal) verifies that the index holds exactly
+ * the key of every live item in the key set of its value
+ */
+func btree_map_check_index(ptr *data) error {
+	idx := ptr.index
+	if idx == nil {
+		return nil
+	}
+	if err := btree_map_check_invariants(idx.values); err != nil {
+		return fmt.Errorf("index: %v", err)
+	}
+	values := map[int]int{}
+	var dups []int
+	btree_map_collect_keys(idx.values.root, values, &dups)
+	if len(dups) > 0 || len(values) != idx.n {
+		return fmt.Errorf("index: %d values for %d key sets", len(values), idx.n)
+	}
+	indexed := 0
+	for i := 0; i < idx.n; i++ {
+		set := idx.sets[i]
+		pos := btree_map_find_item(idx.values, set.value)
+		if pos == nil || pos.value != i {
+			return fmt.Errorf("index: key set %d of value %d is not found", i, set.value)
+		}
+		if btree_map_is_empty(set.keys) {
+			return fmt.Errorf("index: key set of value %d is empty", set.value)
+		}
+		btree_map_foreach_keys(set.keys, func(int) bool {
+			indexed++
+			return false
+		})
+	}
+
+	live := 0
+	var err error = nil
+	if !btree_map_is_empty(ptr) {
+		btree_map_foreach_node(ptr.root, func(key int, value int) bool {
+			live++
+			pos := btree_map_find_item(idx.values, value)
+			if pos == nil || btree_map_is_empty(idx.sets[pos.value].keys) ||
+				btree_map_find_item(idx.sets[pos.value].keys, key) == nil {
+				err = fmt.Errorf("index: key %d is missing from the key set of %d", key, value)
+			}
+			return err != nil
+		})
+	}
+	if err == nil && live != indexed {
+		err = fmt.Errorf("index: %d keys for %d items", indexed, live)
+	}
+	return err
+}
+
+/*
+ * btree_map_count_dead -- (internal) counts the tombstones of a subtree
+ */
+func btree_map_count_dead(n *node_t) int {
+	dead := 0
+	for i := 0; i <= n.n; i++ {
+		if n.slots[i] != nil {
+			dead += btree_map_count_dead(n.slots[i])
+		}
+		if i < n.n && n.items[i].dead {
+			dead++
+		}
+	}
+	return dead
+}
+
+/*
+ * btree_map_collect_keys -- (internal) counts the occurrences of every key of
+ * a subtree, including the items the foreach callbacks skip
+ */
+func btree_map_collect_keys(n *node_t, seen map[int]int, dups *[]int) {
+	if n == nil {
+		return
+	}
+	for i := 0; i <= n.n; i++ {
+		btree_map_collect_keys(n.slots[i], seen, dups)
+		if i != n.n && !n.items[i].dead {
+			key := n.items[i].key
+			seen[key]++
+			if seen[key] == 2 {
+				*dups = append(*dups, key)
+			}
+		}
+	}
+}
+
+/*
+ * btree_map_find_duplicates -- returns every key stored more than once in the
+ * tree, in order of their second occurrence
+ */
+func btree_map_find_duplicates(ptr *data) []int {
+	dups := []int{}
+	btree_map_collect_keys(ptr.root, make(map[int]int), &dups)
+	return dups
+}
+
+/*
+ * btree_map_collect_depths -- (internal) marks the depths of the leaves in the
+ * subtree of n
+ */
+func btree_map_collect_depths(n *node_t, depth int, seen map[int]bool) {
+	if n.slots[0] == nil {
+		seen[depth] = true
+		return
+	}
+	for i := 0; i <= n.n; i++ {
+		if n.slots[i] != nil {
+			btree_map_collect_depths(n.slots[i], depth + 1, seen)
+		}
+	}
+}
+
+/*
+ * btree_map_leaf_depths -- returns the distinct depths of the leaves in
+ * increasing order; a valid tree has a single one
+ */
+func btree_map_leaf_depths(ptr *data) []int {
+	if ptr.root == nil {
+		return nil
+	}
+	seen := make(map[int]bool)
+	btree_map_collect_depths(ptr.root, 0, seen)
+	depths := make([]int, 0, len(seen))
+	for d := range seen {
+		depths = append(depths, d)
+	}
+	sort.Ints(depths)
+	return depths
+}
+
+/*
+ * btree_map_collect_items -- (internal) appends the items of the subtree of n
+ * in order, leaving out the tombstones
+ */
+func btree_map_collect_items(n *node_t, items *[]item) {
+	if n == nil {
+		return
+	}
+	for i := 0; i <= n.n; i++ {
+		btree_map_collect_items(n.slots[i], items)
+		if i != n.n && !n.items[i].dead {
+			*items = append(*items, n.items[i])
+		}
+	}
+}
+
+/*
+ * btree_map_restore_epochs -- (internal) gives the items of the subtree of n,
+ * in order, the epochs of items
+ */
+func btree_map_restore_epochs(n *node_t, items []item, pos *int) {
+	if n == nil {
+		return
+	}
+	for i := 0; i <= n.n; i++ {
+		btree_map_restore_epochs(n.slots[i], items, pos)
+		if i != n.n {
+			n.items[i].epoch = items[*pos].epoch
+			*pos++
+		}
+	}
+}
+
+/*
+ * btree_map_repair_depth -- rebuilds the tree if its leaves are not all at
+ * the same depth, returning whether it was rebuilt
+ */
+func btree_map_repair_depth(ptr *data) (bool, error) {
+	if len(btree_map_leaf_depths(ptr)) <= 1 {
+		return false, nil
+	}
+	if err := btree_map_rebuild(ptr); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+/*
+ * btree_map_compact -- removes the tombstones of a lazy tree, rebalancing it
+ * as a whole
+ */
+func btree_map_compact(ptr *data) error {
+	v := btree_map_writing(ptr)
+	defer btree_map_written(v)
+	if ptr.dead == 0 {
+		return nil
+	}
+	if btree_map_snapshots_open(v) {
+		return ErrSnapshotOpen
+	}
+	return btree_map_rebuild(ptr)
+}
+
+/*
+ * btree_map_rebuild -- (internal) loads the items of the tree in order into
+ * new nodes, keeping their epochs and dropping the tombstones. The new tree
+ * is loaded aside and replaces the old one in a single transaction, so a
+ * full pool leaves ptr unchanged
+ */
+func btree_map_rebuild(ptr *data) (err error) {
+	defer pool_full(&err)
+
+	var items []item
+	btree_map_collect_items(ptr.root, &items)
+	less := btree_map_comparators[ptr.order]
+	sort.SliceStable(items, func(i, j int) bool {
+		return less(items[i].key, items[j].key)
+	})
+
+	tmp := pnew(data)
+	tmp.order = ptr.order
+	var hint btree_map_insert_hint_t
+	for _, it := range items {
+		if err := btree_map_insert_hint(tmp, it.key, it.value, &hint); err != nil {
+			return err
+		}
+	}
+	pos := 0
+	btree_map_restore_epochs(tmp.root, items, &pos)
+
+	txn("undo") {
+		ptr.root = tmp.root
+		ptr.min = tmp.min
+		ptr.max = tmp.max
+		ptr.dead = 0
+	}
+	return nil
+}
+
+/*
+ * btree_map_check_links -- (internal) checks that the item counts are within
+ * bounds and that no node_t is reachable twice, which the other checks take
+ * for granted
+ */
+func btree_map_check_links(n *node_t, seen map[*node_t]bool) error {
+	if n == nil {
+		return nil
+	}
+	if seen[n] {
+		return fmt.Errorf("node %p is reachable twice", n)
+	}
+	seen[n] = true
+	if n.n < 0 || n.n > BTREE_ORDER - 1 {
+		return fmt.Errorf("node %p has %d items", n, n.n)
+	}
+	for i := 0; i <= n.n; i++ {
+		if err := btree_map_check_links(n.slots[i], seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * btree_map_validate -- opens the existing pool at path without initializing
+ * or changing it and reports the result of every check, returning an error
+ * if one fails; go-pmem has no read-only mapping, and opening the pool still
+ * rolls back a transaction left unfinished by a crash
+ */
+func btree_map_validate(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return pool_error(err.Error())
+	}
+	pmem.Init(path)
+	var ptr *data
+	ptr = (*data)(pmem.Get("root", ptr))
+	if ptr == nil {
+		return pool_error("no root object in " + path)
+	}
+
+	failed := false
+	report := func(check string, err error) bool {
+		if err != nil {
+			fmt.Println(check + ": FAILED,", err)
+			failed = true
+		} else {
+			fmt.Println(check + ": ok")
+		}
+		return err == nil
+	}
+
+	var err error = nil
+	if ptr.magic == 0 {
+		err = errors.New("the root object was never initialized")
+	} else if ptr.magic != magic {
+		err = btree_map_layout_error(ptr.magic)
+	} else if ptr.order < 0 || ptr.order >= len(btree_map_comparators) {
+		err = fmt.Errorf("unknown key order %d", ptr.order)
+	}
+	/* the remaining checks walk the tree and rely on these */
+	if report("root", err) &&
+		report("links", btree_map_check_links(ptr.root, make(map[*node_t]bool))) {
+		report("invariants", btree_map_check_invariants(ptr))
+		if dups := btree_map_find_duplicates(ptr); len(dups) > 0 {
+			report("duplicates", fmt.Errorf("keys %v", dups))
+		} else {
+			report("duplicates", nil)
+		}
+		if depths := btree_map_leaf_depths(ptr); len(depths) > 1 {
+			report("leaf depths", fmt.Errorf("leaves at depths %v", depths))
+		} else {
+			report("leaf depths", nil)
+		}
+		if ptr.dirty {
+			fmt.Println("note: the tree was not closed cleanly")
+		}
+	}
+
+	if failed {
+		return pool_error(path + " failed validation")
+	}
+	return nil
+}
+
+/*
+ * btree_map_assert -- (internal) panics on a broken invariant in debug builds
+ */
+func btree_map_assert(ptr *data) {
+	if btree_map_debug {
+		if err := btree_map_check_invariants(ptr); err != nil {
+			panic("btree_map: invariant violated: " + err.Error())
+		}
+	}
+}
+
+/*
+ * ctree_map_check -- check if given persistent object is a tree ptr
+ */
+func btree_map_check(ptr *data) bool {
+	return ptr == nil // || !TOID_VALID(ptr)
+}
+
+/*
+ * btree_map_remove_free -- removes and frees an object from the tree
+ */
+func btree_map_remove_free(ptr *data, key int) bool {
+	txn("undo") {
+		btree_map_remove(ptr, key)
+	}
+	return true
+}
+
+/*
+ * btree_map_find_any_item -- (internal) searches for the item holding the
+ * key, which may be a tombstone
+ */
+func btree_map_find_any_item(less func(int, int) bool, node *node_t, key int) *item {
+	for i := 0; i <= node.n; i++ {
+		if node_contains_item(node, i, key) {
+			return &node.items[i]
+		} else if node_child_can_contain_item(less, node, i, key) {
+			return btree_map_find_any_item(less, node.slots[i], key)
+		}
+	}
+	return nil
+}
+
+/*
+ * btree_map_find_item -- (internal) searches the tree, which is not empty, for
+ * the item holding the key
+ */
+func btree_map_find_item(ptr *data, key int) *item {
+	less := btree_map_comparators[ptr.order]
+	if it := btree_map_find_any_item(less, ptr.root, key); it != nil && !it.dead {
+		return it
+	}
+	return nil
+}
+
+/*
+ * btree_map_merge_trees -- inserts all entries of src into dst, resolving
+ * conflicting keys with resolve(old, new); src is left unchanged. If the pool
+ * fills up, the batch it fills up in is aborted with btree_map_abort, the
+ * ones before stay merged and ErrPoolFull is returned
+ */
+func btree_map_merge_trees(dst *data, src *data, resolve func(int, int) int) (err error) {
+	defer pool_full(&err)
+	if dst == nil || src == nil {
+		return errors.New("merge: nil tree")
+	}
+	if dst == src {
+		return errors.New("merge: source and destination are the same tree")
+	}
+
+	var items []item
+	btree_map_foreach(src, func(key int, value int) bool {
+		items = append(items, item {key, value, 0, false})
+		return false
+	})
+
+	for len(items) > 0 {
+		n := len(items)
+		if n > MERGE_BATCH {
+			n = MERGE_BATCH
+		}
+		txn("undo") {
+			for _, it := range items[:n] {
+				var old *item = nil
+				if !btree_map_is_empty(dst) {
+					old = btree_map_find_item(dst, it.key)
+				}
+				if old != nil {
+					err = btree_map_set_value(dst, old, resolve(old.value, it.value))
+				} else {
+					err = btree_map_try_insert(dst, it.key, it.value)
+				}
+				if err != nil {
+					btree_map_abort(err)
+				}
+			}
+		}
+		items = items[n:]
+	}
+	return nil
+}
+
+/*
+ * btree_map_set_value -- (internal) replaces the value of the live item it of
+ * the tree, moving its key to the key set of the new value in the index; if
+ * the pool has no room for the new index entry nothing is changed
+ */
+func btree_map_set_value(ptr *data, it *item, value int) error {
+	v := btree_map_writing(ptr)
+	defer btree_map_written(v)
+	txn("undo") {
+		if ptr.index != nil && value != it.value {
+			if err := btree_map_index_add(ptr.index, it.key, value); err != nil {
+				return err
+			}
+			btree_map_index_remove(ptr.index, it.key, it.value)
+		}
+		btree_map_keep_version(v, it)
+		ptr.epoch++
+		it.epoch = ptr.epoch
+		it.value = value
+		btree_map_sum_fix_path(btree_map_comparators[ptr.order], ptr.root, it.key)
+	}
+	return nil
+}
+
+/*
+ * btree_map_cas -- replaces the value of key with new if it equals expected,
+ * in a single transaction; returns whether the key exists in the persistent
+ * tree and whether the value was replaced, which it is not if the pool has no
+ * room left for the index entry of the new value
+ */
+func btree_map_cas(ptr *data, key int, expected int, new int) (bool, bool) {
+	found, swapped := false, false
+	txn("undo") {
+		var it *item = nil
+		if !btree_map_is_empty(ptr) {
+			it = btree_map_find_item(ptr, key)
+		}
+		if it != nil {
+			found = true
+			if it.value == expected {
+				swapped = btree_map_set_value(ptr, it, new) == nil
+			}
+		}
+	}
+	return found, swapped
+}
+
+/*
+ * btree_map_overlays -- volatile entries shadowing each tree until they are
+ * promoted; they live in DRAM and are lost when the process exits. The reads
+ * and btree_map_remove go through the overlay; the checks, the snapshots,
+ * the statistics and the index see the persistent tree only
+ */
+var btree_map_overlays = map[*data]map[int]int{}
+
+/*
+ * btree_map_overlay_keys -- (internal) returns the keys of the overlay of ptr
+ * for which in is true, in the tree order
+ */
+func btree_map_overlay_keys(ptr *data, in func(int) bool) []int {
+	var keys []int
+	for key := range btree_map_overlays[ptr] {
+		if in(key) {
+			keys = append(keys, key)
+		}
+	}
+	less := btree_map_comparators[ptr.order]
+	sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+	return keys
+}
+
+/*
+ * btree_map_overlay_walk -- (internal) runs walk, a traversal of the
+ * persistent tree in the tree order, with a callback which hands cb the keys
+ * of the overlay in their places as well: keys, those the traversal covers
+ * in the tree order (see btree_map_overlay_keys), go before the first item
+ * ordered after them, and the value in the overlay takes the place of that
+ * of the same key in the tree. Returns true once cb returns true
+ */
+func btree_map_overlay_walk(ptr *data, keys []int, cb func(int, int) bool,
+	walk func(func(int, int) bool)) bool {
+	overlay := btree_map_overlays[ptr]
+	less := btree_map_comparators[ptr.order]
+	stopped := false
+	walk(func(key int, value int) bool {
+		for len(keys) > 0 && less(keys[0], key) {
+			if stopped = cb(keys[0], overlay[keys[0]]); stopped {
+				return true
+			}
+			keys = keys[1:]
+		}
+		if len(keys) > 0 && keys[0] == key {
+			value = overlay[key]
+			keys = keys[1:]
+		}
+		stopped = cb(key, value)
+		return stopped
+	})
+	/* the keys after the last item, or past the end of a range */
+	for i := 0; !stopped && i < len(keys); i++ {
+		stopped = cb(keys[i], overlay[keys[i]])
+	}
+	return stopped
+}
+
+/*
+ * btree_map_overlay_first -- (internal) returns the first entry by before of
+ * k, v, an entry of the persistent tree if ok, and of the keys of the overlay
+ * for which in is true; the value in the overlay is that of a key which is in
+ * both
+ */
+func btree_map_overlay_first(ptr *data, in func(int) bool, before func(int, int) bool,
+	k int, v int, ok bool) (int, int, bool) {
+	overlay := btree_map_overlays[ptr]
+	for key := range overlay {
+		if in(key) && (!ok || before(key, k)) {
+			k, ok = key, true
+		}
+	}
+	if value, shadowed := overlay[k]; ok && shadowed {
+		v = value
+	}
+	return k, v, ok
+}
+
+/*
+ * btree_map_overlay_insert -- inserts a key-value pair into the volatile
+ * overlay of ptr, leaving the persistent tree untouched
+ */
+func btree_map_overlay_insert(ptr *data, key int, value int) {
+	overlay := btree_map_overlays[ptr]
+	if overlay == nil {
+		overlay = make(map[int]int)
+		btree_map_overlays[ptr] = overlay
+	}
+	overlay[key] = value
+}
+
+/*
+ * btree_map_overlay_len -- returns the number of entries in the overlay
+ */
+func btree_map_overlay_len(ptr *data) int {
+	return len(btree_map_overlays[ptr])
+}
+
+/*
+ * btree_map_discard_overlay -- drops the overlay of ptr without persisting it
+ */
+func btree_map_discard_overlay(ptr *data) {
+	delete(btree_map_overlays, ptr)
+}
+
+/*
+ * btree_map_promote -- moves the overlay into the persistent tree in a single
+ * transaction, overwriting the values of keys already in the tree. If the
+ * pool fills up, the transaction is aborted with btree_map_abort, so nothing
+ * is changed and the overlay is kept for the promotion to be retried
+ */
+func btree_map_promote(ptr *data) (err error) {
+	defer pool_full(&err)
+
+	overlay := btree_map_overlays[ptr]
+	if len(overlay) == 0 {
+		return nil
+	}
+
+	keys := make([]int, 0, len(overlay))
+	for key := range overlay {
+		keys = append(keys, key)
+	}
+	less := btree_map_comparators[ptr.order]
+	sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+
+	txn("undo") {
+		for _, key := range keys {
+			var old *item = nil
+			if !btree_map_is_empty(ptr) {
+				old = btree_map_find_item(ptr, key)
+			}
+			if old != nil {
+				err = btree_map_set_value(ptr, old, overlay[key])
+			} else {
+				err = btree_map_try_insert(ptr, key, overlay[key])
+			}
+			if err != nil {
+				btree_map_abort(err)
+			}
+		}
+	}
+	btree_map_discard_overlay(ptr)
+	return nil
+}
+
+/*
+ * btree_map_new_tree -- (internal) allocates an empty tree with the given key
+ * order
+ */
+func btree_map_new_tree(order int) *data {
+	ptr := pnew(data)
+	initialize(ptr, order, false)
+	return ptr
+}
+
+/*
+ * btree_map_index_add -- (internal) adds key to the key set of value; the
+ * key set of a new value is built aside and linked in after the value is
+ * inserted, so if the pool fills up the index is left as it was and
+ * ErrPoolFull is returned
+ */
+func btree_map_index_add(idx *btree_map_index_t, key int, value int) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		if !btree_map_is_empty(idx.values) {
+			if pos := btree_map_find_item(idx.values, value); pos != nil {
+				return btree_map_try_insert(idx.sets[pos.value].keys, key, 0)
+			}
+		}
+
+		/* the first key holding value, which gets a set of its own */
+		sets := idx.sets
+		if idx.n == len(idx.sets) {
+			sets = pmake([]btree_map_key_set_t, 2 * len(idx.sets) + 8)
+			copy(sets, idx.sets)
+		}
+		/* idx.values has the order of the tree, and so has every key set */
+		keys := btree_map_new_tree(idx.values.order)
+		if err := btree_map_try_insert(keys, key, 0); err != nil {
+			return err
+		}
+		if err := btree_map_try_insert(idx.values, value, idx.n); err != nil {
+			return err
+		}
+		sets[idx.n] = btree_map_key_set_t {value, keys}
+		idx.sets = sets
+		idx.n++
+	}
+	return nil
+}
+
+/*
+ * btree_map_index_remove -- (internal) removes key from the key set of value,
+ * dropping the set when it becomes empty; it never allocates
+ */
+func btree_map_index_remove(idx *btree_map_index_t, key int, value int) {
+	if btree_map_is_empty(idx.values) {
+		return
+	}
+	pos := btree_map_find_item(idx.values, value)
+	if pos == nil {
+		return
+	}
+	p := pos.value
+	txn("undo") {
+		keys := idx.sets[p].keys
+		btree_map_remove(keys, key)
+		if btree_map_is_empty(keys) {
+			btree_map_remove(idx.values, value)
+
+			/* keep sets[:n] packed by moving the last set in */
+			last := idx.n - 1
+			if p != last {
+				idx.sets[p] = idx.sets[last]
+				moved := btree_map_find_item(idx.values, idx.sets[p].value)
+				btree_map_set_value(idx.values, moved, p)
+			}
+			idx.sets[last] = btree_map_key_set_t {}
+			idx.n--
+		}
+	}
+}
+
+/*
+ * btree_map_create_index -- builds the secondary index by value of the tree,
+ * which is kept up to date from then on; does nothing if it already exists.
+ * The index is built aside and linked to the tree last, so if the pool fills
+ * up the tree is left without one
+ */
+func btree_map_create_index(ptr *data) (err error) {
+	defer pool_full(&err)
+	if ptr.index != nil {
+		return nil
+	}
+	var items []item
+	btree_map_foreach_node(ptr.root, func(key int, value int) bool {
+		items = append(items, item {key, value, 0, false})
+		return false
+	})
+
+	txn("undo") {
+		idx := pnew(btree_map_index_t)
+		idx.values = btree_map_new_tree(ptr.order)
+		for _, it := range items {
+			if err := btree_map_index_add(idx, it.key, it.value); err != nil {
+				return err
+			}
+		}
+		ptr.index = idx
+	}
+	return nil
+}
+
+/*
+ * btree_map_find_by_value -- returns the keys of the persistent tree holding
+ * value, in order; without an index every item is visited
+ */
+func btree_map_find_by_value(ptr *data, value int) []int {
+	keys := []int{}
+	if ptr.index == nil {
+		if !btree_map_is_empty(ptr) {
+			btree_map_foreach_node(ptr.root, func(key int, v int) bool {
+				if v == value {
+					keys = append(keys, key)
+				}
+				return false
+			})
+		}
+		return keys
+	}
+
+	idx := ptr.index
+	if btree_map_is_empty(idx.values) {
+		return keys
+	}
+	pos := btree_map_find_item(idx.values, value)
+	if pos == nil {
+		return keys
+	}
+	btree_map_foreach_keys(idx.sets[pos.value].keys, func(key int) bool {
+		keys = append(keys, key)
+		return false
+	})
+	return keys
+}
+
+/*
+ * str_insert -- hs_insert wrapper which works on strings
+ */
+func str_insert(ptr *data, str string) {
+	var key int
+	if scan_args("insert", str, "%d", &key) {
+		if err := btree_map_try_insert(ptr, key, 0); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- hs_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key int
+	if scan_args("remove", str, "%d", &key) {
+		if btree_map_lookup(ptr, key) {
+			btree_map_remove(ptr, key)
+		} else {
+			fmt.Println("no such value")
+		}
+	}
+}
 
 /*
  * str_check -- hs_check wrapper which works on strings
  */
 func str_check(ptr *data, str string) {
 	var key int
-	if _, err := fmt.Sscanf(str, "%d", &key); err == nil {
+	if scan_args("check", str, "%d", &key) {
 		fmt.Println(btree_map_lookup(ptr, key))
+	}
+}
+
+/*
+ * str_overlay_insert -- btree_map_overlay_insert wrapper which works on strings
+ */
+func str_overlay_insert(ptr *data, str string) {
+	var key int
+	if scan_args("overlay insert", str, "%d", &key) {
+		btree_map_overlay_insert(ptr, key, 0)
+	}
+}
+
+/*
+ * str_promote -- persists the overlay and reports how many keys it held
+ */
+func str_promote(ptr *data) {
+	n := btree_map_overlay_len(ptr)
+	if err := btree_map_promote(ptr); err != nil {
+		fmt.Println("promote:", err)
+	} else {
+		fmt.Println(n, "keys promoted")
+	}
+}
+
+/*
+ * str_compact -- compacts the tombstones and reports how many there were
+ */
+func str_compact(ptr *data) {
+	n := ptr.dead
+	if err := btree_map_compact(ptr); err != nil {
+		fmt.Println("compact:", err)
 	} else {
-		fmt.Println("check: invalid syntax")
+		fmt.Println(n, "tombstones removed")
+	}
+}
+
+/*
+ * str_find_by_value -- prints the keys holding the value given as a string
+ */
+func str_find_by_value(ptr *data, str string) {
+	var value int
+	if scan_args("find by value", str, "%d", &value) {
+		fmt.Println(btree_map_find_by_value(ptr, value))
+	}
+}
+
+/*
+ * str_range -- prints the keys from lo to hi given as a string
+ */
+func str_range(ptr *data, str string) {
+	var lo, hi int
+	if scan_args("range", str, "%d %d", &lo, &hi) {
+		btree_map_range(ptr, lo, hi, hashmap_print)
+		fmt.Println()
 	}
 }
 
@@ -545,31 +2788,31 @@ func str_check(ptr *data, str string) {
  */
 func str_insert_random(ptr *data, str string) {
 	var val int
-	if _, err := fmt.Sscanf(str, "%d", &val); err == nil {
+	if scan_args("random insert", str, "%d", &val) {
 		for i := 0; i < val; i++ {
 			r := rand.Int()
 			if !btree_map_insert(ptr, r, 0) {
 				break
 			}
 		}
-	} else {
-		fmt.Println("random insert: invalid syntax")
 	}
 }
 
 func help() {
-	fmt.Println("h - help")
-	fmt.Println("i $value - insert $value")
-	fmt.Println("r $value - remove $value")
-	fmt.Println("c $value - check $value, returns 0/1")
-	fmt.Println("n $value - insert $value random values")
-	fmt.Println("p - print all values")
-	fmt.Println("d - print debug info")
-	fmt.Println("q - quit")
-}
-
-func unknown_command(str string) {
-	fmt.Println("unknown command '",str,"', use 'h' for help")
+	print_help(
+		"i $value - insert $value",
+		"r $value - remove $value",
+		"c $value - check $value, returns 0/1",
+		"n $value - insert $value random values",
+		"v $value - insert $value into the volatile overlay",
+		"m - promote the overlay into the tree",
+		"x - discard the overlay",
+		"p - print all values",
+		"d - print debug info",
+		"k - compact the tombstones of a lazy tree",
+		"f $value - print the keys holding $value",
+		"R $lo $hi - print the values from $lo to $hi",
+	)
 }
 
 func hashmap_print(key int, val int) bool {
@@ -582,59 +2825,319 @@ func print_all(ptr *data) {
 	fmt.Println()
 }
 
-func main() {
-	args := os.Args
+func print_debug(ptr *data) {
+	if err := btree_map_check_invariants(ptr); err != nil {
+		fmt.Println("invariants: ", err)
+	} else {
+		fmt.Println("invariants: ok")
+	}
+	fmt.Println("duplicates:", btree_map_find_duplicates(ptr))
+	fmt.Println("leaf depths:", btree_map_leaf_depths(ptr))
+	if ptr.lazy {
+		fmt.Println("tombstones:", ptr.dead)
+	}
+}
 
-	if len(args) < 2 {
-		fmt.Println("usage:", args[0], "filename")
-		return
+/*
+ * Run -- opens the tree named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("btree_map", flag.ContinueOnError)
+	flags.Usage = func() {}
+	order := flags.String("order", "asc", "key order of a new tree (asc|desc)")
+	lazy := flags.Bool("lazy", false, "make removals from a new tree leave tombstones until compacted")
+	cpuprofile := flags.String("cpuprofile", "", "write a CPU profile of the session to `file`")
+	memprofile := flags.String("memprofile", "", "write a heap profile to `file` on exit")
+	listen := flags.String("listen", "", "serve the tree over TCP on `addr` instead of the standard input")
+	index := flags.Bool("index", false, "create the secondary index by value of the tree if it has none")
+	speedup := flags.Float64("speedup", 1, "divide the gaps between the operations of a replayed workload by `factor`")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+
+	if len(args) == 2 && args[1] == "validate" {
+		return btree_map_validate(args[0])
+	}
+	workload := ""
+	if len(args) == 3 && args[1] == "replay" {
+		workload = args[2]
+		args = args[:1]
+	}
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	cmp := BTREE_ASCENDING
+	if *order == "desc" {
+		cmp = BTREE_DESCENDING
+	} else if *order != "asc" {
+		return usage_error("invalid key order '" + *order + "'")
 	}
 
 	var ptr *data
-	flag.Parse()
-	firstInit := pmem.Init(args[1])
-	if firstInit {
-		// first time run of the application
-		ptr = (*data)(pmem.New("root", ptr))
-		initialize(ptr)
-	} else {
-		// not a first time initialization
-		ptr = (*data)(pmem.Get("root", ptr))
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic == 0 {
+		initialize(ptr, cmp, *lazy)
+	} else if ptr.magic != magic {
+		return pool_error(fmt.Sprintf("%s: %v", args[0], btree_map_layout_error(ptr.magic)))
+	}
+
+	// the order recorded at creation wins over the flag on reopen
+	if ptr.order < 0 || ptr.order >= len(btree_map_comparators) {
+		return pool_error(fmt.Sprintf("unknown key order %d in %s", ptr.order, args[0]))
+	}
+
+	if dirty, err := btree_map_open(ptr); dirty {
+		fmt.Println("warning:", args[0], "was not closed cleanly")
+		if err != nil {
+			fmt.Println("warning: invariants:", err)
+		}
+	}
+	defer btree_map_close(ptr)
+
+	if *index {
+		if err := btree_map_create_index(ptr); err != nil {
+			return err
+		}
+	}
 
-		// even though this is not a first time initialization, we should still
-		// check if the named object exists and data initialization completed
-		// succesfully. The magic element within the named object helps check
-		// for successful data initialization.
+	stop, err := start_profiling(*cpuprofile, *memprofile)
+	if err != nil {
+		return err
+	}
+	defer stop()
 
-		if ptr == nil {
-			ptr = (*data)(pmem.New("root", ptr))
+	if *listen != "" {
+		return Serve(ptr, *listen)
+	}
+	if workload != "" {
+		stopped := false
+		err := replay_file(workload, *speedup, func(args []string) error {
+			if is_interrupted() {
+				stopped = true
+				return ErrInterrupted
+			}
+			return replay_command(ptr, args)
+		})
+		if stopped {
+			return ErrInterrupted
 		}
+		return err
+	}
+
+	return repl(ptr, os.Stdin)
+}
 
-		if ptr.magic != magic {
-			initialize(ptr)
+/*
+ * repl -- (internal) runs the commands read from r until 'q', EOF or a signal
+ */
+func repl(ptr *data, r io.Reader) error {
+	return run_commands(r, func(buf string) {
+		dispatch(ptr, buf)
+	})
+}
+
+/*
+ * dispatch -- runs a single REPL command; a panic in the command is reported
+ * and the REPL goes on with the next one. go-pmem aborts the transaction the
+ * panic unwinds through, so the tree is left as it was before the command
+ */
+func dispatch(ptr *data, buf string) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("command '", buf, "' failed:", r)
 		}
+	}()
+
+	switch (buf[0]) {
+		case 'i': str_insert(ptr, buf[1:])
+		case 'r': str_remove(ptr, buf[1:])
+		case 'c': str_check(ptr, buf[1:])
+		case 'n': str_insert_random(ptr, buf[1:])
+		case 'v': str_overlay_insert(ptr, buf[1:])
+		case 'm': str_promote(ptr)
+		case 'x': btree_map_discard_overlay(ptr)
+		case 'p': print_all(ptr)
+		case 'd': print_debug(ptr)
+		case 'k': str_compact(ptr)
+		case 'f': str_find_by_value(ptr, buf[1:])
+		case 'R': str_range(ptr, buf[1:])
+		case 'h': help()
+		default: unknown_command(buf)
+	}
+}
+
+/*
+ * btree_map_server_lock -- serializes the updates made by Serve with each
+ * other and with its lookups
+ */
+var btree_map_server_lock sync.RWMutex
+
+/*
+ * Serve -- accepts TCP connections on addr and serves the line commands
+ * GET k, PUT k v, DEL k and RANGE lo hi on each of them until it is closed
+ */
+func Serve(ptr *data, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
 	}
-	reader := bufio.NewReader(os.Stdin)
+	return serve_listener(ptr, l, interrupted)
+}
+
+/*
+ * serve_listener -- (internal) serves the connections accepted by l until a
+ * signal arrives on stop; the update in flight then commits and the others
+ * are held off until the process exits
+ */
+func serve_listener(ptr *data, l net.Listener, stop <-chan os.Signal) error {
+	defer l.Close()
+	done := make(chan struct{})
+	defer close(done)
+	stopped := make(chan bool, 1)
+	go func() {
+		select {
+		case <-stop:
+			btree_map_server_lock.Lock()
+			stopped <- true
+			l.Close()
+		case <-done:
+		}
+	}()
 	for {
-		fmt.Print("$ ")
-		buf, _ := reader.ReadString('\n')
-		// convert CRLF to LF
-		buf = strings.Replace(buf, "\n", "", -1)
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-stopped:
+				return ErrInterrupted
+			default:
+				return err
+			}
+		}
+		go serve_conn(ptr, conn)
+	}
+}
 
-		if buf[0] == 0 || buf[0] == '\n' {
-			continue
+/*
+ * serve_conn -- (internal) answers the commands read from conn, one line each
+ */
+func serve_conn(ptr *data, conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	w := bufio.NewWriter(conn)
+	for scanner.Scan() {
+		serve_command(ptr, strings.Fields(scanner.Text()), w)
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+/*
+ * serve_command -- (internal) runs a single server command and writes its
+ * result to w: the value, OK, NOT_FOUND, a "key value" line per entry of a
+ * range followed by END, or ERR and a message
+ */
+func serve_command(ptr *data, args []string, w io.Writer) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintln(w, "ERR", r)
 		}
+	}()
 
-		switch (buf[0]) {
-			case 'i': str_insert(ptr, buf[1:])
-			case 'r': str_remove(ptr, buf[1:])
-			case 'c': str_check(ptr, buf[1:])
-			case 'n': str_insert_random(ptr, buf[1:])
-			case 'p': print_all(ptr)
-			case 'q': return
-			case 'h': help()
-			default: unknown_command(buf)
+	var nums [2]int
+	if len(args) == 0 {
+		fmt.Fprintln(w, "ERR empty command")
+		return
+	}
+	for i, arg := range args[1:] {
+		if i >= len(nums) {
+			break
+		}
+		if _, err := fmt.Sscanf(arg, "%d", &nums[i]); err != nil {
+			fmt.Fprintln(w, "ERR invalid number", arg)
+			return
+		}
+	}
+
+	switch {
+	case strings.EqualFold(args[0], "GET") && len(args) == 2:
+		btree_map_server_lock.RLock()
+		defer btree_map_server_lock.RUnlock()
+		if btree_map_lookup(ptr, nums[0]) {
+			fmt.Fprintln(w, btree_map_get(ptr, nums[0]))
+		} else {
+			fmt.Fprintln(w, "NOT_FOUND")
 		}
+	case strings.EqualFold(args[0], "PUT") && len(args) == 3:
+		btree_map_server_lock.Lock()
+		defer btree_map_server_lock.Unlock()
+		var err error
+		txn("undo") {
+			var old *item = nil
+			if !btree_map_is_empty(ptr) {
+				old = btree_map_find_item(ptr, nums[0])
+			}
+			if old != nil {
+				err = btree_map_set_value(ptr, old, nums[1])
+			} else {
+				err = btree_map_try_insert(ptr, nums[0], nums[1])
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(w, "ERR", err)
+		} else {
+			fmt.Fprintln(w, "OK")
+		}
+	case strings.EqualFold(args[0], "DEL") && len(args) == 2:
+		btree_map_server_lock.Lock()
+		defer btree_map_server_lock.Unlock()
+		if btree_map_lookup(ptr, nums[0]) {
+			btree_map_remove(ptr, nums[0])
+			fmt.Fprintln(w, "OK")
+		} else {
+			fmt.Fprintln(w, "NOT_FOUND")
+		}
+	case strings.EqualFold(args[0], "RANGE") && len(args) == 3:
+		btree_map_server_lock.RLock()
+		defer btree_map_server_lock.RUnlock()
+		btree_map_range(ptr, nums[0], nums[1], func(key int, value int) bool {
+			fmt.Fprintln(w, key, value)
+			return false
+		})
+		fmt.Fprintln(w, "END")
+	default:
+		fmt.Fprintln(w, "ERR unknown command", args[0])
 	}
 }
 
+/*
+ * replay_command -- (internal) runs one operation of a replayed workload,
+ * which uses the commands of Serve
+ */
+func replay_command(ptr *data, args []string) error {
+	var reply strings.Builder
+	serve_command(ptr, args, &reply)
+	if strings.HasPrefix(reply.String(), "ERR") {
+		return errors.New(strings.TrimSpace(reply.String()))
+	}
+	return nil
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "[-order asc|desc] [-lazy] [-index] [-cpuprofile file] [-memprofile file] [-listen addr] [-speedup factor] filename [validate|replay workload]")
+		fmt.Println("validate checks the pool without writing to it, but opening it still rolls back a transaction left unfinished by a crash")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,9 @@
+//go:build corundum_debug
+// +build corundum_debug
+
+package main
+
+/*
+ * btree_map_debug -- checks the tree invariants after every mutation
+ */
+const btree_map_debug = true
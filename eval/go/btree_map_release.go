@@ -0,0 +1,9 @@
+//go:build !corundum_debug
+// +build !corundum_debug
+
+package main
+
+/*
+ * btree_map_debug -- invariant checks are compiled out of release builds
+ */
+const btree_map_debug = false
@@ -0,0 +1,2085 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vmware/go-pmem-transaction/pmem"
+)
+
+// The tests share one pool, as go-pmem maps a single pool per process, and
+// build their trees in it with btree_map_new_tree; a step of AssertDurable
+// opens its own pool instead, and a process started by test_program runs
+// btree_map.
+func TestMain(m *testing.M) {
+	if is_test_program() {
+		main()
+	}
+	pool := durable_pool()
+	temporary := pool == ""
+	if temporary {
+		pool = filepath.Join(os.TempDir(), fmt.Sprintf("btree_map_test.%d.pool", os.Getpid()))
+	}
+	pmem.Init(pool)
+	status := m.Run()
+	if temporary {
+		os.Remove(pool)
+	}
+	os.Exit(status)
+}
+
+// limit_nodes makes the pool run out after n more nodes; the returned
+// function lifts the limit. A go-pmem pool cannot be created with a size of
+// our choosing, so past the limit a node is allocated with a capacity larger
+// than the heap can hold, which the runtime fails as it would a pool with no
+// room left.
+func limit_nodes(n int) func() {
+	alloc := btree_map_alloc_node
+	huge := 1 << 62
+	btree_map_alloc_node = func() *node_t {
+		if n == 0 {
+			return &pmake([]node_t, 1, huge)[0]
+		}
+		n--
+		return alloc()
+	}
+	return func() { btree_map_alloc_node = alloc }
+}
+
+// new_tree returns a new ascending tree holding keys, each with ten times
+// the key as its value.
+func new_tree(t *testing.T, keys ...int) *data {
+	t.Helper()
+	ptr := btree_map_new_tree(BTREE_ASCENDING)
+	for _, key := range keys {
+		if err := btree_map_try_insert(ptr, key, key * 10); err != nil {
+			t.Fatalf("insert %d: %v", key, err)
+		}
+	}
+	return ptr
+}
+
+// tree_keys returns the keys of the persistent tree in order, leaving out
+// those of the overlay.
+func tree_keys(ptr *data) []int {
+	keys := []int{}
+	if !btree_map_is_empty(ptr) {
+		btree_map_foreach_node(ptr.root, func(key int, value int) bool {
+			keys = append(keys, key)
+			return false
+		})
+	}
+	return keys
+}
+
+// check_tree fails the test unless the tree, and its index if it has one,
+// hold their invariants and the tree holds exactly keys.
+func check_tree(t *testing.T, ptr *data, keys []int) {
+	t.Helper()
+	if err := btree_map_check_invariants(ptr); err != nil {
+		t.Fatal("invariants:", err)
+	}
+	if ptr.index != nil {
+		if err := btree_map_check_index(ptr); err != nil {
+			t.Fatal("index:", err)
+		}
+	}
+	if got := tree_keys(ptr); !reflect.DeepEqual(got, keys) {
+		t.Fatalf("keys %v, want %v", got, keys)
+	}
+}
+
+func TestInsertPoolFull(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		for nodes := 0; nodes < 8; nodes++ {
+			ptr := new_tree(t)
+			if indexed {
+				if err := btree_map_create_index(ptr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			lift := limit_nodes(nodes)
+			keys := []int{}
+			for key := 1; ; key++ {
+				epoch := ptr.epoch
+				err := btree_map_try_insert(ptr, key, key * 10)
+				if err == ErrPoolFull {
+					if ptr.epoch != epoch {
+						t.Errorf("index %v, %d nodes: the epoch moved on a failed insert",
+							indexed, nodes)
+					}
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				keys = append(keys, key)
+			}
+			lift()
+			check_tree(t, ptr, keys)
+		}
+	}
+}
+
+func TestSetValuePoolFull(t *testing.T) {
+	ptr := new_tree(t, 1, 2, 3)
+	if err := btree_map_create_index(ptr); err != nil {
+		t.Fatal(err)
+	}
+	defer limit_nodes(0)()
+	it := btree_map_find_item(ptr, 2)
+	if err := btree_map_set_value(ptr, it, 99); err != ErrPoolFull {
+		t.Fatalf("set value: %v, want ErrPoolFull", err)
+	}
+	if it.value != 20 {
+		t.Fatalf("value %d, want 20", it.value)
+	}
+	check_tree(t, ptr, []int{1, 2, 3})
+}
+
+// Merging overlapping trees with a sum resolver adds up the values of the
+// shared keys, and leaves the source as it was.
+func TestMergeTrees(t *testing.T) {
+	dst := new_tree(t)
+	src := new_tree(t)
+	for key := 0; key < 300; key += 2 {
+		btree_map_insert(dst, key, key)
+	}
+	for key := 0; key < 300; key += 3 {
+		btree_map_insert(src, key, 1000)
+	}
+	sum := func(old int, new int) int { return old + new }
+	if err := btree_map_merge_trees(dst, src, sum); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []int
+	for key := 0; key < 300; key++ {
+		if key % 2 == 0 || key % 3 == 0 {
+			keys = append(keys, key)
+		}
+	}
+	check_tree(t, dst, keys)
+	btree_map_foreach(dst, func(key int, value int) bool {
+		want := 0
+		if key % 2 == 0 {
+			want += key
+		}
+		if key % 3 == 0 {
+			want += 1000
+		}
+		if value != want {
+			t.Errorf("key %d holds %d, want %d", key, value, want)
+		}
+		return false
+	})
+
+	keys = keys[:0]
+	for key := 0; key < 300; key += 3 {
+		keys = append(keys, key)
+	}
+	check_tree(t, src, keys)
+	if err := btree_map_merge_trees(dst, dst, sum); err == nil {
+		t.Error("a tree was merged into itself")
+	}
+}
+
+// A merge the pool fills up in aborts the batch it fills up in: whichever
+// node is the one which does not fit, the destination holds the batches
+// before it and nothing of that batch.
+func TestMergeAbort(t *testing.T) {
+	src := new_tree(t)
+	for key := 0; key < 2 * MERGE_BATCH + 10; key++ {
+		btree_map_insert(src, key, key)
+	}
+	all := tree_keys(src)
+	for nodes := 0; ; nodes++ {
+		dst := new_tree(t)
+		lift := limit_nodes(nodes)
+		err := btree_map_merge_trees(dst, src, func(old int, new int) int { return new })
+		lift()
+		if err == nil {
+			check_tree(t, dst, all)
+			break
+		} else if err != ErrPoolFull {
+			t.Fatal(err)
+		}
+		merged := len(tree_keys(dst))
+		if merged % MERGE_BATCH != 0 {
+			t.Fatalf("%d nodes: %d keys merged, not a whole number of batches",
+				nodes, merged)
+		}
+		check_tree(t, dst, all[:merged])
+	}
+}
+
+// A tree created with the descending comparator is walked from its largest
+// key down, and finds its keys as the ascending one does.
+func TestDescending(t *testing.T) {
+	ptr := btree_map_new_tree(BTREE_DESCENDING)
+	if ptr.order != BTREE_DESCENDING {
+		t.Fatalf("the tree has order %d", ptr.order)
+	}
+	for _, key := range rand.Perm(200) {
+		btree_map_insert(ptr, key, key * 10)
+	}
+	for key := 0; key < 200; key += 2 {
+		btree_map_remove(ptr, key)
+	}
+
+	var keys []int
+	for key := 199; key >= 0; key -= 2 {
+		keys = append(keys, key)
+	}
+	check_tree(t, ptr, keys)
+	for key := 0; key < 200; key++ {
+		if found := btree_map_lookup(ptr, key); found != (key % 2 == 1) {
+			t.Errorf("lookup %d: %v", key, found)
+		}
+	}
+	if key, _ := btree_map_min(ptr); key != 199 {
+		t.Errorf("first key %d, want 199", key)
+	}
+	if key, _ := btree_map_max(ptr); key != 1 {
+		t.Errorf("last key %d, want 1", key)
+	}
+}
+
+// Trees of both orders live side by side: an ascending tree merged into an
+// indexed descending one leaves each in its own order, and so are the keys
+// the index finds.
+func TestMixedOrders(t *testing.T) {
+	dst := btree_map_new_tree(BTREE_DESCENDING)
+	for key := 0; key < 300; key += 2 {
+		btree_map_insert(dst, key, key)
+	}
+	if err := btree_map_create_index(dst); err != nil {
+		t.Fatal(err)
+	}
+	src := new_tree(t)
+	for key := 0; key < 300; key += 3 {
+		btree_map_insert(src, key, 1)
+	}
+	if err := btree_map_merge_trees(dst, src, func(old int, new int) int {
+		return new
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys, ones []int
+	for key := 299; key >= 0; key-- {
+		if key % 2 == 0 || key % 3 == 0 {
+			keys = append(keys, key)
+		}
+		if key % 3 == 0 {
+			ones = append(ones, key)
+		}
+	}
+	check_tree(t, dst, keys)
+	if got := btree_map_find_by_value(dst, 1); !reflect.DeepEqual(got, ones) {
+		t.Errorf("keys holding 1: %v, want %v", got, ones)
+	}
+
+	keys = keys[:0]
+	for key := 0; key < 300; key += 3 {
+		keys = append(keys, key)
+	}
+	check_tree(t, src, keys)
+}
+
+// Run rejects malformed command lines, before opening any pool, with errors
+// mapped to the usage exit status.
+func TestRunErrors(t *testing.T) {
+	missing := filepath.Join(os.TempDir(), "btree_map_test.missing.pool")
+	tests := []struct {
+		args   []string
+		status int
+	}{
+		{[]string{}, EXIT_USAGE},
+		{[]string{"pool", "extra"}, EXIT_USAGE},
+		{[]string{"-nosuchflag", "pool"}, EXIT_USAGE},
+		{[]string{"-order", "sideways", "pool"}, EXIT_USAGE},
+		{[]string{"pool", "replay"}, EXIT_USAGE},
+		{[]string{missing, "validate"}, EXIT_POOL},
+	}
+	for _, tc := range tests {
+		err := Run(tc.args)
+		if err == nil {
+			t.Errorf("%q: no error", tc.args)
+		} else if status := exit_status(err); status != tc.status {
+			t.Errorf("%q: %v, exit status %d, want %d", tc.args, err, status, tc.status)
+		}
+	}
+	if err := Run([]string{"-order", "sideways", "pool"}); err != usage_error("invalid key order 'sideways'") {
+		t.Errorf("invalid order: %v", err)
+	}
+}
+
+// The cached extremes follow inserts and removals of the extremes, in lazy
+// trees too, and match those a full scan finds.
+func TestMinMax(t *testing.T) {
+	for _, lazy := range []bool{false, true} {
+		ptr := new_tree(t)
+		ptr.lazy = lazy
+		rng := rand.New(rand.NewSource(1))
+		for i := 0; i < 2000; i++ {
+			keys := tree_keys(ptr)
+			switch op := rng.Intn(4); {
+			case len(keys) == 0 || op == 0:
+				if key := rng.Intn(1000); !btree_map_lookup(ptr, key) {
+					btree_map_insert(ptr, key, i)
+				}
+			case op == 1:
+				btree_map_insert(ptr, keys[len(keys) - 1] + 1 + rng.Intn(3), i)
+			case op == 2:
+				btree_map_remove(ptr, keys[0])
+			default:
+				btree_map_remove(ptr, keys[len(keys) - 1])
+			}
+
+			keys = tree_keys(ptr)
+			min, ok := btree_map_min(ptr)
+			max, _ := btree_map_max(ptr)
+			if len(keys) == 0 {
+				if ok {
+					t.Fatalf("lazy %v, step %d: empty tree has extreme %d", lazy, i, min)
+				}
+			} else if !ok || min != keys[0] || max != keys[len(keys) - 1] {
+				t.Fatalf("lazy %v, step %d: extremes %d %d (%v), want %d %d",
+					lazy, i, min, max, ok, keys[0], keys[len(keys) - 1])
+			}
+		}
+		if err := btree_map_check_invariants(ptr); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// The scan cursor yields every live key in order, and stops as soon as the
+// callback asks it to.
+func TestScan(t *testing.T) {
+	for _, n := range []int{0, 1, BTREE_ORDER - 1, BTREE_ORDER, 500} {
+		ptr := new_tree(t)
+		for _, i := range rand.Perm(n) {
+			btree_map_insert(ptr, i + 1, (i + 1) * 10)
+		}
+		keys := []int{}
+		for key := 1; key <= n; key++ {
+			if key % 3 == 0 {
+				btree_map_remove(ptr, key)
+			} else {
+				keys = append(keys, key)
+			}
+		}
+		got := []int{}
+		btree_map_scan(ptr, func(key int, value int) bool {
+			if value != key * 10 {
+				t.Fatalf("scan %d: value %d", key, value)
+			}
+			got = append(got, key)
+			return false
+		})
+		if !reflect.DeepEqual(got, keys) {
+			t.Fatalf("scan %v, want %v", got, keys)
+		}
+
+		/* stop at the first key */
+		seen := 0
+		stopped := btree_map_scan(ptr, func(key int, value int) bool {
+			seen++
+			return true
+		})
+		if n > 0 && (!stopped || seen != 1) {
+			t.Fatalf("scan stopped %v after %d keys", stopped, seen)
+		}
+		check_tree(t, ptr, keys)
+	}
+}
+
+// tree_entries returns the entries of the tree in order, one "key value"
+// string each.
+func tree_entries(ptr *data) []string {
+	entries := []string{}
+	btree_map_foreach(ptr, func(key int, value int) bool {
+		entries = append(entries, fmt.Sprint(key, value))
+		return false
+	})
+	return entries
+}
+
+// Removals which rebalance the tree survive a reopen.
+func TestDurableRemove(t *testing.T) {
+	AssertDurable(t, func() []string {
+		var ptr *data
+		ptr = (*data)(pmem.New("root", ptr))
+		initialize(ptr, BTREE_ASCENDING, false)
+		for key := 1; key <= 200; key++ {
+			btree_map_insert(ptr, key, key * 10)
+		}
+		for key := 2; key <= 200; key += 2 {
+			btree_map_remove(ptr, key)
+		}
+		return tree_entries(ptr)
+	}, func() []string {
+		var ptr *data
+		ptr = (*data)(pmem.Get("root", ptr))
+		if err := btree_map_check_invariants(ptr); err != nil {
+			t.Fatal(err)
+		}
+		return tree_entries(ptr)
+	})
+}
+
+// A mutation of a corrupted tree panics on the broken invariant in a build
+// with the corundum_debug tag, and goes unchecked in a release build.
+func TestAssert(t *testing.T) {
+	ptr := new_tree(t, 10, 20, 30)
+	/* swap two keys of the root, which is the only node */
+	items := &ptr.root.items
+	items[0].key, items[1].key = items[1].key, items[0].key
+
+	var r interface{}
+	func() {
+		defer func() { r = recover() }()
+		btree_map_insert(ptr, 40, 400)
+	}()
+	if !btree_map_debug {
+		if r != nil {
+			t.Fatalf("release build panicked: %v", r)
+		}
+		return
+	}
+	msg, ok := r.(string)
+	if !ok || !strings.HasPrefix(msg, "btree_map: invariant violated: ") {
+		t.Fatalf("debug build panicked with %v, want a broken invariant", r)
+	}
+}
+
+// The parallel traversal visits what the sequential one does, with any
+// number of workers, and skips the tombstones of a lazy tree; run it with
+// -race to check that the workers share nothing but cb.
+func TestParallelForeach(t *testing.T) {
+	ptr := new_tree(t)
+	ptr.lazy = true
+	for i, key := range rand.New(rand.NewSource(1)).Perm(5000) {
+		btree_map_insert(ptr, key, i)
+	}
+	for key := 0; key < 5000; key += 7 {
+		btree_map_remove(ptr, key)
+	}
+
+	var sum, count int64
+	btree_map_foreach(ptr, func(key int, value int) bool {
+		sum += int64(value)
+		count++
+		return false
+	})
+	for _, workers := range []int{0, 1, 4, 16} {
+		var psum, pcount int64
+		btree_map_parallel_foreach(ptr, workers, func(key int, value int) {
+			atomic.AddInt64(&psum, int64(value))
+			atomic.AddInt64(&pcount, 1)
+		})
+		if psum != sum || pcount != count {
+			t.Errorf("%d workers: %d values summing to %d, want %d summing to %d",
+				workers, pcount, psum, count, sum)
+		}
+	}
+}
+
+// A reader walking a snapshot while a writer inserts, updates and removes
+// entries sees the tree as it was when the snapshot was taken.
+func TestSnapshot(t *testing.T) {
+	var keys []int
+	for key := 1; key <= 100; key++ {
+		keys = append(keys, key)
+	}
+	ptr := new_tree(t, keys...)
+	if _, err := btree_map_open(ptr); err != nil {
+		t.Fatal(err)
+	}
+	defer btree_map_close(ptr)
+	epoch, err := btree_map_snapshot(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for key := 101; key <= 300; key++ {
+			btree_map_insert(ptr, key, key * 10)
+		}
+		for key := 2; key <= 100; key += 2 {
+			btree_map_remove(ptr, key)
+		}
+		for key := 1; key <= 100; key += 2 {
+			btree_map_cas(ptr, key, key * 10, -key)
+		}
+		btree_map_clear(ptr)
+	}()
+
+	check := func() {
+		got := []int{}
+		btree_map_foreach_at(ptr, epoch, func(key int, value int) bool {
+			if value != key * 10 {
+				t.Errorf("key %d has value %d in the snapshot", key, value)
+			}
+			got = append(got, key)
+			return false
+		})
+		if !reflect.DeepEqual(got, keys) {
+			t.Fatalf("snapshot keys %v, want %v", got, keys)
+		}
+	}
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		check()
+	}
+
+	if err := btree_map_compact(ptr); err != ErrSnapshotOpen {
+		t.Fatalf("compact with a snapshot open: %v", err)
+	}
+	btree_map_release(ptr, epoch)
+	if err := btree_map_compact(ptr); err != nil {
+		t.Fatal(err)
+	}
+	check_tree(t, ptr, []int{})
+}
+
+func TestKeyHistogram(t *testing.T) {
+	tests := []struct {
+		keys    []int
+		buckets int
+		want    []int
+	}{
+		{[]int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 3, []int{4, 3, 3}},
+		{[]int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 5, []int{2, 2, 2, 2, 2}},
+		{[]int{1, 10}, 4, []int{1, 0, 0, 1}},
+		{[]int{5}, 2, []int{1, 0}},
+		{[]int{math.MinInt64, -1, 1, math.MaxInt64}, 2, []int{2, 2}},
+		{[]int{math.MinInt64, math.MaxInt64}, 4, []int{1, 0, 0, 1}},
+	}
+	for _, tc := range tests {
+		ptr := new_tree(t, tc.keys...)
+		got := btree_map_key_histogram(ptr, tc.buckets)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("keys %v in %d buckets: %v, want %v",
+				tc.keys, tc.buckets, got, tc.want)
+		}
+	}
+}
+
+// A batch lookup of shuffled keys, present, absent, removed and repeated,
+// finds what looking the keys up one by one does, visiting fewer nodes.
+func TestGetMany(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	ptr := new_tree(t)
+	ptr.lazy = true
+	for _, key := range rng.Perm(10000) {
+		btree_map_insert(ptr, key * 2, key)
+	}
+	for key := 0; key < 20000; key += 10 {
+		btree_map_remove(ptr, key)
+	}
+	keys := make([]int, 20000)
+	for i := range keys {
+		keys[i] = rng.Intn(20010) - 5
+	}
+
+	vals, found, visited := btree_map_get_many_stats(ptr, keys)
+	single := 0
+	for i, key := range keys {
+		value, ok, v := btree_map_get_stats(ptr, key)
+		if vals[i] != value || found[i] != ok {
+			t.Fatalf("key %d: %d (%v), want %d (%v)", key, vals[i], found[i], value, ok)
+		}
+		single += v
+	}
+	if visited >= single {
+		t.Errorf("batch lookup visited %d nodes, one by one %d", visited, single)
+	}
+}
+
+// The nodes visited per key by batch lookups of growing size, against those
+// visited by a lookup of one key.
+func BenchmarkGetMany(b *testing.B) {
+	ptr := btree_map_new_tree(BTREE_ASCENDING)
+	rng := rand.New(rand.NewSource(1))
+	for _, key := range rng.Perm(100000) {
+		btree_map_insert(ptr, key, key)
+	}
+	for _, size := range []int{1, 100, 10000} {
+		keys := make([]int, size)
+		for i := range keys {
+			keys[i] = rng.Intn(100000)
+		}
+		b.Run(fmt.Sprint("batch", size), func(b *testing.B) {
+			visited := 0
+			for i := 0; i < b.N; i++ {
+				_, _, v := btree_map_get_many_stats(ptr, keys)
+				visited += v
+			}
+			b.ReportMetric(float64(visited) / float64(b.N * size), "nodes/key")
+		})
+		b.Run(fmt.Sprint("single", size), func(b *testing.B) {
+			visited := 0
+			for i := 0; i < b.N; i++ {
+				for _, key := range keys {
+					_, _, v := btree_map_get_stats(ptr, key)
+					visited += v
+				}
+			}
+			b.ReportMetric(float64(visited) / float64(b.N * size), "nodes/key")
+		})
+	}
+}
+
+func TestPromotePoolFull(t *testing.T) {
+	// the root leaf is full, so the first key of the overlay splits it
+	ptr := new_tree(t, 1, 2, 3, 4, 5, 6, 7)
+	btree_map_overlay_insert(ptr, 100, 1)
+	btree_map_overlay_insert(ptr, 101, 1)
+	defer btree_map_discard_overlay(ptr)
+	lift := limit_nodes(0)
+	err := btree_map_promote(ptr)
+	lift()
+	if err != ErrPoolFull {
+		t.Fatalf("promote: %v, want ErrPoolFull", err)
+	}
+	if btree_map_overlay_len(ptr) != 2 {
+		t.Fatal("the overlay was not kept")
+	}
+	check_tree(t, ptr, []int{1, 2, 3, 4, 5, 6, 7})
+}
+
+// A promotion the pool fills up in after its first key was inserted is
+// aborted, and the transaction rolled back takes that key out again.
+func TestPromoteAbort(t *testing.T) {
+	// the first key of the overlay fills the root leaf, the second splits it
+	ptr := new_tree(t, 1, 2, 3, 4, 5, 6)
+	btree_map_overlay_insert(ptr, 100, 1)
+	btree_map_overlay_insert(ptr, 101, 1)
+	defer btree_map_discard_overlay(ptr)
+	lift := limit_nodes(0)
+	err := btree_map_promote(ptr)
+	lift()
+	if err != ErrPoolFull {
+		t.Fatalf("promote: %v, want ErrPoolFull", err)
+	}
+	if btree_map_overlay_len(ptr) != 2 {
+		t.Fatal("the overlay was not kept")
+	}
+	check_tree(t, ptr, []int{1, 2, 3, 4, 5, 6})
+	if max, _ := btree_map_tree_max(ptr); max != 6 {
+		t.Fatalf("max of the persistent tree %d, want 6", max)
+	}
+}
+
+// Reads see the overlay, but a reopen finds the tree without it unless it
+// was promoted.
+func TestDurableOverlay(t *testing.T) {
+	overlay_get := func(ptr *data) []string {
+		return []string{fmt.Sprint(btree_map_lookup(ptr, 2), btree_map_get(ptr, 2))}
+	}
+	switch durable_step() {
+	case "overlay":
+		var ptr *data
+		ptr = (*data)(pmem.New("root", ptr))
+		initialize(ptr, BTREE_ASCENDING, false)
+		btree_map_insert(ptr, 1, 10)
+		btree_map_overlay_insert(ptr, 2, 20)
+		step_done(t, overlay_get(ptr))
+		return
+	case "promote":
+		var ptr *data
+		ptr = (*data)(pmem.Get("root", ptr))
+		got := overlay_get(ptr)
+		btree_map_overlay_insert(ptr, 2, 20)
+		if err := btree_map_promote(ptr); err != nil {
+			t.Fatal(err)
+		}
+		step_done(t, append(got, tree_entries(ptr)...))
+		return
+	case "verify":
+		var ptr *data
+		ptr = (*data)(pmem.Get("root", ptr))
+		if err := btree_map_check_invariants(ptr); err != nil {
+			t.Fatal(err)
+		}
+		step_done(t, append(overlay_get(ptr), tree_entries(ptr)...))
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pool := filepath.Join(dir, "overlay.pool")
+	for _, step := range []struct {
+		name string
+		want []string
+	}{
+		{"overlay", []string{"true 20"}},
+		{"promote", []string{"false -1", "1 10", "2 20"}},
+		{"verify", []string{"true 20", "1 10", "2 20"}},
+	} {
+		if got := in_pool(t, pool, step.name); !reflect.DeepEqual(got, step.want) {
+			t.Fatalf("%s: %q, want %q", step.name, got, step.want)
+		}
+	}
+}
+
+// new_overlay returns a tree of the even keys from 2 to 40, each with ten
+// times the key as its value, with an overlay holding a key before them all,
+// one between them, one after them all and one shadowing the value of 10.
+func new_overlay(t *testing.T) *data {
+	t.Helper()
+	ptr := new_tree(t)
+	for key := 2; key <= 40; key += 2 {
+		btree_map_insert(ptr, key, key * 10)
+	}
+	btree_map_overlay_insert(ptr, 1, -1)
+	btree_map_overlay_insert(ptr, 7, -7)
+	btree_map_overlay_insert(ptr, 10, -10)
+	btree_map_overlay_insert(ptr, 50, -50)
+	return ptr
+}
+
+// overlay_entries returns "key value" for the entries of the tree with the
+// overlay over it, in order, as btree_map_range visits them from lo to hi
+// and the others walk the whole tree.
+func overlay_entries(lo int, hi int) []string {
+	entries := []string{}
+	for key := lo; key <= hi; key++ {
+		switch {
+		case key == 1 || key == 7 || key == 10 || key == 50:
+			entries = append(entries, fmt.Sprint(key, " ", -key))
+		case key >= 2 && key <= 40 && key % 2 == 0:
+			entries = append(entries, fmt.Sprint(key, " ", key * 10))
+		}
+	}
+	return entries
+}
+
+// The reads of the tree see the keys of the overlay in their places, and the
+// value in the overlay of a key in both.
+func TestOverlayReads(t *testing.T) {
+	ptr := new_overlay(t)
+	defer btree_map_discard_overlay(ptr)
+	collect := func(entries *[]string) func(int, int) bool {
+		*entries = []string{}
+		return func(key int, value int) bool {
+			*entries = append(*entries, fmt.Sprint(key, " ", value))
+			return false
+		}
+	}
+	all := overlay_entries(0, 50)
+
+	var got []string
+	btree_map_foreach(ptr, collect(&got))
+	if !reflect.DeepEqual(got, all) {
+		t.Fatalf("foreach: %q, want %q", got, all)
+	}
+	btree_map_scan(ptr, collect(&got))
+	if !reflect.DeepEqual(got, all) {
+		t.Fatalf("scan: %q, want %q", got, all)
+	}
+	each := collect(&got)
+	btree_map_all(ptr)(func(key int, value int) bool { return !each(key, value) })
+	if !reflect.DeepEqual(got, all) {
+		t.Fatalf("all: %q, want %q", got, all)
+	}
+	for _, r := range [][2]int{{0, 50}, {-5, 100}, {5, 12}, {7, 7}, {41, 60}, {42, 49}, {12, 5}} {
+		btree_map_range(ptr, r[0], r[1], collect(&got))
+		if want := overlay_entries(r[0], r[1]); !reflect.DeepEqual(got, want) {
+			t.Fatalf("range %d to %d: %q, want %q", r[0], r[1], got, want)
+		}
+	}
+	n := 0
+	btree_map_range(ptr, 0, 50, func(key int, value int) bool {
+		n++
+		return key == 7
+	})
+	if n != 5 {
+		t.Fatalf("a range stopped at 7 visits %d entries, want 5", n)
+	}
+
+	if min, ok := btree_map_min(ptr); !ok || min != 1 {
+		t.Fatalf("min %d %v, want 1", min, ok)
+	}
+	if max, ok := btree_map_max(ptr); !ok || max != 50 {
+		t.Fatalf("max %d %v, want 50", max, ok)
+	}
+	for _, tc := range []struct {
+		key  int
+		next string
+		prev string
+	}{
+		{6, "7 -7", "4 40"},
+		{7, "8 80", "6 60"},
+		{8, "10 -10", "7 -7"},
+		{9, "10 -10", "8 80"},
+		{40, "50 -50", "38 380"},
+		{2, "4 40", "1 -1"},
+		{60, "", "50 -50"},
+		{-1, "1 -1", ""},
+	} {
+		next, prev := "", ""
+		if k, v, ok := btree_map_successor(ptr, tc.key); ok {
+			next = fmt.Sprint(k, " ", v)
+		}
+		if k, v, ok := btree_map_predecessor(ptr, tc.key); ok {
+			prev = fmt.Sprint(k, " ", v)
+		}
+		if next != tc.next || prev != tc.prev {
+			t.Errorf("around %d: %q and %q, want %q and %q", tc.key, next, prev,
+				tc.next, tc.prev)
+		}
+	}
+
+	keys := []int{50, 10, 8, 7, 3}
+	vals, found, _ := btree_map_get_many_stats(ptr, keys)
+	if want := []int{-50, -10, 80, -7, 0}; !reflect.DeepEqual(vals, want) {
+		t.Fatalf("get many: %v, want %v", vals, want)
+	}
+	if want := []bool{true, true, true, true, false}; !reflect.DeepEqual(found, want) {
+		t.Fatalf("get many: found %v, want %v", found, want)
+	}
+	if value, ok, _ := btree_map_get_stats(ptr, 10); !ok || value != -10 {
+		t.Fatalf("get 10: %d %v, want -10", value, ok)
+	}
+
+	/* the persistent tree is left as it was */
+	if got := tree_keys(ptr); len(got) != 20 || got[0] != 2 || got[19] != 40 {
+		t.Fatalf("the persistent tree holds %v", got)
+	}
+	if it := btree_map_find_item(ptr, 10); it.value != 100 {
+		t.Fatalf("the persistent value of 10 is %d, want 100", it.value)
+	}
+}
+
+// A key is removed from the overlay and from the persistent tree alike, and
+// is then read nowhere.
+func TestOverlayRemove(t *testing.T) {
+	ptr := new_overlay(t)
+	defer btree_map_discard_overlay(ptr)
+	for _, key := range []int{7, 10, 12} {
+		btree_map_remove(ptr, key)
+		if btree_map_lookup(ptr, key) {
+			t.Fatalf("%d is still there after its removal", key)
+		}
+	}
+	want := []int{1, 2, 4, 6, 8, 14, 16, 18, 20, 22, 24, 26, 28, 30, 32, 34, 36, 38, 40, 50}
+	got := []int{}
+	btree_map_foreach(ptr, func(key int, value int) bool {
+		got = append(got, key)
+		return false
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("the tree holds %v, want %v", got, want)
+	}
+	if btree_map_overlay_len(ptr) != 2 {
+		t.Fatalf("the overlay holds %d keys, want 2", btree_map_overlay_len(ptr))
+	}
+	check_tree(t, ptr, want[1:len(want) - 1])
+}
+
+// The REPL prints and removes the keys of the overlay like those of the
+// tree.
+func TestOverlayRepl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cmd, err := test_program(filepath.Join(dir, "overlay.pool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stdin = strings.NewReader("i 1\ni 3\nv 2\np\nr 2\nc 2\np\nq\n")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	for _, want := range []string{"1 2 3 \n", "false\n", "1 3 \n"} {
+		i := strings.Index(string(out), want)
+		if i < 0 {
+			t.Fatalf("%q is not in the output, or out of order:\n%s", want, out)
+		}
+		out = out[i + len(want):]
+	}
+}
+
+// btree_map_cas swaps the value only when it is the expected one, and
+// reports a missing or lazily removed key without inserting it.
+func TestCas(t *testing.T) {
+	var keys []int
+	for key := 1; key <= 50; key++ {
+		keys = append(keys, key)
+	}
+	ptr := new_tree(t, keys...)
+	if err := btree_map_create_index(ptr); err != nil {
+		t.Fatal(err)
+	}
+	ptr.lazy = true
+	btree_map_remove(ptr, 50)
+	keys = keys[:49]
+
+	tests := []struct {
+		key, expected, new int
+		found, swapped     bool
+		value              int
+	}{
+		{25, 250, -25, true, true, -25},
+		{25, 250, 7, true, false, -25},
+		{25, -25, 250, true, true, 250},
+		{1, 10, 11, true, true, 11},
+		{99, 0, 7, false, false, -1},
+		{50, 500, 7, false, false, -1},
+	}
+	for _, tc := range tests {
+		found, swapped := btree_map_cas(ptr, tc.key, tc.expected, tc.new)
+		if found != tc.found || swapped != tc.swapped {
+			t.Errorf("cas %d %d %d: %v %v, want %v %v", tc.key, tc.expected, tc.new,
+				found, swapped, tc.found, tc.swapped)
+		}
+		if value := btree_map_get(ptr, tc.key); value != tc.value {
+			t.Errorf("cas %d %d %d: value %d, want %d", tc.key, tc.expected, tc.new,
+				value, tc.value)
+		}
+	}
+	check_tree(t, ptr, keys)
+
+	if found, swapped := btree_map_cas(new_tree(t), 1, 0, 1); found || swapped {
+		t.Errorf("cas on an empty tree: %v %v", found, swapped)
+	}
+}
+
+// The server answers the line commands sent over a connection.
+func TestServe(t *testing.T) {
+	ptr := new_tree(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- serve_listener(ptr, l, make(chan os.Signal)) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"PUT 1 10", []string{"OK"}},
+		{"PUT 2 20", []string{"OK"}},
+		{"put 1 11", []string{"OK"}},
+		{"GET 1", []string{"11"}},
+		{"GET 3", []string{"NOT_FOUND"}},
+		{"DEL 2", []string{"OK"}},
+		{"DEL 2", []string{"NOT_FOUND"}},
+		{"PUT 5 50", []string{"OK"}},
+		{"RANGE 0 10", []string{"1 11", "5 50", "END"}},
+		{"", []string{"ERR empty command"}},
+		{"GET x", []string{"ERR invalid number x"}},
+		{"FOO 1", []string{"ERR unknown command FOO"}},
+		{"GET 1 2", []string{"ERR unknown command GET"}},
+	}
+	for _, tc := range tests {
+		if _, err := fmt.Fprintln(conn, tc.command); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range tc.want {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("%q: %v", tc.command, err)
+			}
+			if got := strings.TrimSuffix(line, "\n"); got != want {
+				t.Errorf("%q: got %q, want %q", tc.command, got, want)
+			}
+		}
+	}
+
+	/* closing the listener stops the server without taking the lock */
+	l.Close()
+	if err := <-served; err == nil {
+		t.Error("the server returned no error once its listener was closed")
+	}
+	if keys := tree_keys(ptr); !reflect.DeepEqual(keys, []int{1, 5}) {
+		t.Errorf("tree holds %v, want [1 5]", keys)
+	}
+}
+
+// Full insert and remove cycles keep the invariants at every order from 3,
+// where a node_t holds up to 2 items and at least 1, to BTREE_ORDER.
+func TestOrders(t *testing.T) {
+	defer func() { btree_map_order = BTREE_ORDER }()
+	for order := 3; order <= BTREE_ORDER; order++ {
+		btree_map_order = order
+		t.Run(fmt.Sprint("order", order), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(int64(order)))
+			ptr := new_tree(t)
+			var keys []int
+			for i, key := range rng.Perm(300) {
+				if err := btree_map_try_insert(ptr, key + 1, key); err != nil {
+					t.Fatal(err)
+				}
+				if err := btree_map_check_invariants(ptr); err != nil {
+					t.Fatalf("insert %d: %v", key + 1, err)
+				}
+				keys = append(keys, i + 1)
+			}
+			check_tree(t, ptr, keys)
+
+			/* ordered loads append to the rightmost leaf */
+			var hint btree_map_insert_hint_t
+			for key := 301; key <= 400; key++ {
+				if err := btree_map_insert_hint(ptr, key, key, &hint); err != nil {
+					t.Fatal(err)
+				}
+				if err := btree_map_check_invariants(ptr); err != nil {
+					t.Fatalf("append %d: %v", key, err)
+				}
+				keys = append(keys, key)
+			}
+
+			for _, i := range rng.Perm(400) {
+				want := i
+				if i + 1 > 300 {
+					want = i + 1
+				}
+				if got := btree_map_remove(ptr, i + 1); got != want {
+					t.Fatalf("remove %d: %d, want %d", i + 1, got, want)
+				}
+				if err := btree_map_check_invariants(ptr); err != nil {
+					t.Fatalf("remove %d: %v", i + 1, err)
+				}
+			}
+			check_tree(t, ptr, []int{})
+		})
+	}
+}
+
+// Key 0 and value 0 are entries like any other, in the tree and its index,
+// which keeps the keys of each value in a tree of its own.
+func TestZero(t *testing.T) {
+	ptr := new_tree(t)
+	if err := btree_map_create_index(ptr); err != nil {
+		t.Fatal(err)
+	}
+	var keys []int
+	for key := -50; key <= 50; key++ {
+		keys = append(keys, key)
+	}
+	for _, i := range rand.Perm(len(keys)) {
+		if err := btree_map_try_insert(ptr, keys[i], 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check_tree(t, ptr, keys)
+
+	/* removals rotate key 0 between the nodes */
+	for key := -50; key <= 50; key++ {
+		if key % 3 != 0 {
+			btree_map_remove(ptr, key)
+		}
+	}
+	keys = keys[:0]
+	for key := -48; key <= 48; key += 3 {
+		keys = append(keys, key)
+	}
+	check_tree(t, ptr, keys)
+	if !btree_map_lookup(ptr, 0) {
+		t.Fatal("key 0 is not found")
+	}
+}
+
+// tree_shape appends the nodes of the subtree of n in preorder, one string
+// of its items and sum each.
+func tree_shape(n *node_t, shape []string) []string {
+	shape = append(shape, fmt.Sprint(n.items[:n.n], n.sum))
+	for i := 0; i <= n.n && n.slots[i] != nil; i++ {
+		shape = tree_shape(n.slots[i], shape)
+	}
+	return shape
+}
+
+// Hinted inserts build the same tree as plain ones, node by node, when the
+// keys come in order and when some of them do not, which the hint cannot
+// take.
+func TestInsertHint(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, shuffled := range []int{0, 10, 100} {
+		keys := make([]int, 3000)
+		for i := range keys {
+			keys[i] = i * 3
+		}
+		for i := 0; i < shuffled; i++ {
+			keys[rng.Intn(len(keys))] = rng.Intn(len(keys) * 3)
+		}
+
+		plain, hinted := new_tree(t), new_tree(t)
+		var hint btree_map_insert_hint_t
+		for _, key := range keys {
+			if btree_map_lookup(plain, key) {
+				continue
+			}
+			if err := btree_map_try_insert(plain, key, key); err != nil {
+				t.Fatal(err)
+			}
+			if err := btree_map_insert_hint(hinted, key, key, &hint); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := btree_map_check_invariants(hinted); err != nil {
+			t.Fatal(err)
+		}
+		want := tree_shape(plain.root, []string{})
+		if got := tree_shape(hinted.root, []string{}); !reflect.DeepEqual(got, want) {
+			t.Errorf("%d shuffled keys: hinted inserts built another tree", shuffled)
+		}
+		if hinted.min != plain.min || hinted.max != plain.max {
+			t.Errorf("%d shuffled keys: extremes %d %d, want %d %d",
+				shuffled, hinted.min, hinted.max, plain.min, plain.max)
+		}
+	}
+}
+
+// Loading a million keys in order, with and without the hint.
+func BenchmarkInsertHint(b *testing.B) {
+	const keys = 1000000
+	b.Run("hinted", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ptr := btree_map_new_tree(BTREE_ASCENDING)
+			var hint btree_map_insert_hint_t
+			for key := 0; key < keys; key++ {
+				if err := btree_map_insert_hint(ptr, key, key, &hint); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("plain", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ptr := btree_map_new_tree(BTREE_ASCENDING)
+			for key := 0; key < keys; key++ {
+				if err := btree_map_try_insert(ptr, key, key); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+// tree_nodes counts the nodes of the subtree of n.
+func tree_nodes(n *node_t) int {
+	if n == nil {
+		return 0
+	}
+	count := 1
+	for i := 0; i <= n.n; i++ {
+		count += tree_nodes(n.slots[i])
+	}
+	return count
+}
+
+// Lazy removals leave tombstones which lookups skip and which take up nodes
+// until a compaction drops them and rebalances the tree into fewer nodes.
+func TestCompact(t *testing.T) {
+	ptr := new_tree(t)
+	ptr.lazy = true
+	for _, key := range rand.New(rand.NewSource(1)).Perm(3000) {
+		btree_map_insert(ptr, key, key * 10)
+	}
+	nodes := tree_nodes(ptr.root)
+	var keys []int
+	for key := 0; key < 3000; key++ {
+		if key % 10 == 0 {
+			keys = append(keys, key)
+		} else if btree_map_remove(ptr, key) != key * 10 {
+			t.Fatalf("remove %d returned another value", key)
+		}
+	}
+	if ptr.dead != 2700 || btree_map_count_dead(ptr.root) != 2700 {
+		t.Fatalf("%d tombstones, %d counted, want 2700",
+			ptr.dead, btree_map_count_dead(ptr.root))
+	}
+	if tree_nodes(ptr.root) != nodes {
+		t.Fatalf("lazy removals changed the nodes from %d to %d", nodes, tree_nodes(ptr.root))
+	}
+	for key := 1; key < 3000; key += 10 {
+		if _, found, _ := btree_map_get_stats(ptr, key); found || btree_map_lookup(ptr, key) {
+			t.Fatalf("removed key %d was found", key)
+		}
+	}
+	check_tree(t, ptr, keys)
+
+	if err := btree_map_compact(ptr); err != nil {
+		t.Fatal(err)
+	}
+	if ptr.dead != 0 || btree_map_count_dead(ptr.root) != 0 {
+		t.Fatalf("%d tombstones left by compaction", btree_map_count_dead(ptr.root))
+	}
+	if after := tree_nodes(ptr.root); after * 5 > nodes {
+		t.Fatalf("compaction left %d of the %d nodes", after, nodes)
+	}
+	check_tree(t, ptr, keys)
+	if !ptr.lazy {
+		t.Fatal("compaction ended the lazy mode")
+	}
+}
+
+// The lazy mode and the tombstones of a tree survive a reopen.
+func TestDurableLazy(t *testing.T) {
+	AssertDurable(t, func() []string {
+		var ptr *data
+		ptr = (*data)(pmem.New("root", ptr))
+		initialize(ptr, BTREE_ASCENDING, true)
+		for key := 1; key <= 200; key++ {
+			btree_map_insert(ptr, key, key * 10)
+		}
+		for key := 2; key <= 200; key += 2 {
+			btree_map_remove(ptr, key)
+		}
+		return append(tree_entries(ptr), fmt.Sprint(ptr.lazy, ptr.dead))
+	}, func() []string {
+		var ptr *data
+		ptr = (*data)(pmem.Get("root", ptr))
+		if err := btree_map_check_invariants(ptr); err != nil {
+			t.Fatal(err)
+		}
+		return append(tree_entries(ptr), fmt.Sprint(ptr.lazy, btree_map_count_dead(ptr.root)))
+	})
+}
+
+// Appends take keys after the last one, into an empty tree too, and reject
+// any other key without changing the tree; closing the tree drops the path
+// they remember.
+func TestAppend(t *testing.T) {
+	ptr := new_tree(t)
+	btree_map_open(ptr)
+	var keys []int
+	for key := 1; key <= 1000; key += 1 + key % 3 {
+		if err := btree_map_append(ptr, key, key * 10); err != nil {
+			t.Fatalf("append %d: %v", key, err)
+		}
+		keys = append(keys, key)
+	}
+	check_tree(t, ptr, keys)
+
+	last := keys[len(keys) - 1]
+	for _, key := range []int{last, last - 1, keys[0], -5} {
+		if err := btree_map_append(ptr, key, 0); err == nil {
+			t.Fatalf("append %d after %d: no error", key, last)
+		}
+		check_tree(t, ptr, keys)
+		if btree_map_get(ptr, keys[0]) != keys[0] * 10 {
+			t.Fatalf("append %d changed the value of %d", key, keys[0])
+		}
+	}
+	if err := btree_map_append(ptr, last + 1, 0); err != nil {
+		t.Fatalf("append %d after the errors: %v", last + 1, err)
+	}
+	check_tree(t, ptr, append(keys, last + 1))
+
+	btree_map_close(ptr)
+	if _, ok := btree_map_append_hints[ptr]; ok {
+		t.Fatal("close kept the append hint")
+	}
+}
+
+// Reverse lookups return the keys holding a value, shared by many keys, and
+// stay consistent through inserts, value changes and removals, eager or lazy
+// and compacted; the index may be created before or after the first keys.
+func TestFindByValue(t *testing.T) {
+	for _, lazy := range []bool{false, true} {
+		for _, late := range []bool{false, true} {
+			rng := rand.New(rand.NewSource(1))
+			ptr := new_tree(t)
+			ptr.lazy = lazy
+			values := map[int]int{}
+			step := func(i int) {
+				key := rng.Intn(300)
+				it := (*item)(nil)
+				if btree_map_lookup(ptr, key) {
+					it = btree_map_find_item(ptr, key)
+				}
+				switch {
+				case it == nil:
+					btree_map_insert(ptr, key, key % 7)
+					values[key] = key % 7
+				case rng.Intn(2) == 0:
+					if err := btree_map_set_value(ptr, it, i % 5); err != nil {
+						t.Fatal(err)
+					}
+					values[key] = i % 5
+				default:
+					btree_map_remove(ptr, key)
+					delete(values, key)
+				}
+			}
+
+			if late {
+				for i := 0; i < 500; i++ {
+					step(i)
+				}
+			}
+			if err := btree_map_create_index(ptr); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3000; i++ {
+				step(i)
+				if lazy && i % 1000 == 999 {
+					if err := btree_map_compact(ptr); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if i % 100 != 0 {
+					continue
+				}
+				for value := 0; value < 7; value++ {
+					want := []int{}
+					for key := 0; key < 300; key++ {
+						if v, ok := values[key]; ok && v == value {
+							want = append(want, key)
+						}
+					}
+					if got := btree_map_find_by_value(ptr, value); !reflect.DeepEqual(got, want) {
+						t.Fatalf("lazy %v, late %v, step %d: value %d held by %v, want %v",
+							lazy, late, i, value, got, want)
+					}
+				}
+				if err := btree_map_check_index(ptr); err != nil {
+					t.Fatalf("lazy %v, late %v, step %d: %v", lazy, late, i, err)
+				}
+			}
+		}
+	}
+}
+
+// Successors and predecessors are strict, of stored keys and of keys in
+// between alike, and there are none past the last key or before the first.
+func TestSuccessor(t *testing.T) {
+	var keys []int
+	for key := 10; key <= 1000; key += 10 {
+		keys = append(keys, key)
+	}
+	ptr := new_tree(t)
+	for _, i := range rand.Perm(len(keys)) {
+		btree_map_insert(ptr, keys[i], keys[i] * 10)
+	}
+	for key := 0; key <= 1010; key += 5 {
+		next := (key / 10 + 1) * 10
+		k, v, ok := btree_map_successor(ptr, key)
+		if next > 1000 {
+			if ok {
+				t.Errorf("successor of %d: %d past the last key", key, k)
+			}
+		} else if !ok || k != next || v != next * 10 {
+			t.Errorf("successor of %d: %d %d (%v), want %d", key, k, v, ok, next)
+		}
+
+		prev := (key + 9) / 10 * 10 - 10
+		k, v, ok = btree_map_predecessor(ptr, key)
+		if prev < 10 {
+			if ok {
+				t.Errorf("predecessor of %d: %d before the first key", key, k)
+			}
+		} else if !ok || k != prev || v != prev * 10 {
+			t.Errorf("predecessor of %d: %d %d (%v), want %d", key, k, v, ok, prev)
+		}
+	}
+	if _, _, ok := btree_map_successor(new_tree(t), 0); ok {
+		t.Error("an empty tree has a successor")
+	}
+	if _, _, ok := btree_map_predecessor(new_tree(t), 0); ok {
+		t.Error("an empty tree has a predecessor")
+	}
+}
+
+// Chunks of 100 over 1000 entries come as 10 full slices, in order, and a
+// callback returning true stops the traversal after its chunk.
+func TestForeachChunk(t *testing.T) {
+	ptr := new_tree(t)
+	for _, key := range rand.Perm(1000) {
+		btree_map_insert(ptr, key, key * 10)
+	}
+	chunks, next := 0, 0
+	btree_map_foreach_chunk(ptr, 100, func(keys []int, vals []int) bool {
+		if len(keys) != 100 || len(vals) != 100 {
+			t.Fatalf("chunk %d holds %d keys and %d values", chunks, len(keys), len(vals))
+		}
+		for i, key := range keys {
+			if key != next || vals[i] != next * 10 {
+				t.Fatalf("chunk %d: entry %d is %d %d, want %d", chunks, i, key, vals[i], next)
+			}
+			next++
+		}
+		chunks++
+		return false
+	})
+	if chunks != 10 {
+		t.Fatalf("%d chunks, want 10", chunks)
+	}
+
+	chunks = 0
+	if !btree_map_foreach_chunk(ptr, 100, func(keys []int, vals []int) bool {
+		chunks++
+		return chunks == 3
+	}) || chunks != 3 {
+		t.Fatalf("the traversal went on for %d chunks after being stopped at 3", chunks)
+	}
+}
+
+// A command which panics is reported, and the REPL goes on with the next
+// one.
+func TestReplPanic(t *testing.T) {
+	ptr := new_tree(t, 1, 2, 3)
+	ascending := btree_map_comparators[BTREE_ASCENDING]
+	defer func() { btree_map_comparators[BTREE_ASCENDING] = ascending }()
+	btree_map_comparators[BTREE_ASCENDING] = func(a int, b int) bool {
+		if a == 13 || b == 13 {
+			panic("key 13 cannot be compared")
+		}
+		return a < b
+	}
+	if err := repl(ptr, strings.NewReader("i 13\ni 5\nq\n")); err != nil {
+		t.Fatal(err)
+	}
+	btree_map_comparators[BTREE_ASCENDING] = ascending
+	check_tree(t, ptr, []int{1, 2, 3, 5})
+}
+
+// A narrow range visits the paths to its ends and the few nodes in between,
+// far fewer than a range over all the keys, which visits every node.
+func TestRangeStats(t *testing.T) {
+	ptr := new_tree(t)
+	for _, i := range rand.Perm(1000) {
+		btree_map_insert(ptr, i + 1, (i + 1) * 10)
+	}
+	all := btree_map_range_stats(ptr, 1, 1000, func(key int, value int) bool {
+		return false
+	})
+	got := []int{}
+	narrow := btree_map_range_stats(ptr, 500, 510, func(key int, value int) bool {
+		if value != key * 10 {
+			t.Fatalf("key %d has value %d", key, value)
+		}
+		got = append(got, key)
+		return false
+	})
+	if want := []int{500, 501, 502, 503, 504, 505, 506, 507, 508, 509, 510}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("range 500 to 510 is %v, want %v", got, want)
+	}
+	if narrow == 0 || narrow * 10 > all {
+		t.Fatalf("the narrow range visits %d nodes, the full one %d", narrow, all)
+	}
+	if empty := btree_map_range_stats(new_tree(t), 1, 10, func(int, int) bool { return false }); empty != 0 {
+		t.Fatalf("a range of an empty tree visits %d nodes", empty)
+	}
+}
+
+// tree_separators returns the keys of the items of the inner nodes of the
+// subtree of n, which a range crosses from one child to the next.
+func tree_separators(n *node_t) []int {
+	if n == nil || n.slots[0] == nil {
+		return nil
+	}
+	keys := []int{}
+	for i := 0; i <= n.n; i++ {
+		keys = append(keys, tree_separators(n.slots[i])...)
+		if i < n.n {
+			keys = append(keys, n.items[i].key)
+		}
+	}
+	return keys
+}
+
+// btree_map_range visits the keys from lo to hi, both included, in order:
+// none when lo is above hi or the tree is empty, and those on both sides of
+// a node split when the range crosses one; it stops once cb returns true.
+func TestRange(t *testing.T) {
+	keys := []int{}
+	for key := 2; key <= 200; key += 2 {
+		keys = append(keys, key)
+	}
+	ptr := new_tree(t, keys...)
+	collect := func(ptr *data, lo int, hi int) []int {
+		got := []int{}
+		btree_map_range(ptr, lo, hi, func(key int, value int) bool {
+			if value != key * 10 {
+				t.Fatalf("key %d has value %d", key, value)
+			}
+			got = append(got, key)
+			return false
+		})
+		return got
+	}
+	want := func(lo int, hi int) []int {
+		in := []int{}
+		for _, key := range keys {
+			if key >= lo && key <= hi {
+				in = append(in, key)
+			}
+		}
+		return in
+	}
+
+	for _, r := range [][2]int{{10, 20}, {11, 19}, {50, 50}, {51, 51},
+		{-10, 2}, {200, 300}, {201, 300}, {-10, 1000}, {20, 10}, {51, 50}} {
+		if got := collect(ptr, r[0], r[1]); !reflect.DeepEqual(got, want(r[0], r[1])) {
+			t.Fatalf("range %d to %d: %v, want %v", r[0], r[1], got, want(r[0], r[1]))
+		}
+	}
+
+	separators := tree_separators(ptr.root)
+	if len(separators) == 0 {
+		t.Fatal("the tree has a single node")
+	}
+	for _, key := range separators {
+		for _, r := range [][2]int{{key - 5, key + 5}, {key, key + 5}, {key - 5, key},
+			{key + 1, key + 7}, {key - 7, key - 1}} {
+			if got := collect(ptr, r[0], r[1]); !reflect.DeepEqual(got, want(r[0], r[1])) {
+				t.Fatalf("range %d to %d across %d: %v, want %v", r[0], r[1], key,
+					got, want(r[0], r[1]))
+			}
+		}
+	}
+
+	if got := collect(new_tree(t), 1, 10); len(got) != 0 {
+		t.Fatalf("a range of an empty tree visits %v", got)
+	}
+
+	got := []int{}
+	btree_map_range(ptr, 11, 100, func(key int, value int) bool {
+		got = append(got, key)
+		return len(got) == 3
+	})
+	if !reflect.DeepEqual(got, []int{12, 14, 16}) {
+		t.Fatalf("a range stopped at its third key visits %v", got)
+	}
+	/* stopped on the last key before a separator, the next node is skipped */
+	got = []int{}
+	key := separators[0]
+	btree_map_range(ptr, key - 4, key + 10, func(k int, value int) bool {
+		got = append(got, k)
+		return k == key - 2
+	})
+	if !reflect.DeepEqual(got, []int{key - 4, key - 2}) {
+		t.Fatalf("a range stopped at %d visits %v", key - 2, got)
+	}
+}
+
+// A pool holding a tree of an older layout is refused, by the REPL and by
+// validate, and left as it is instead of being initialized again.
+func TestOldLayout(t *testing.T) {
+	switch durable_step() {
+	case "build":
+		var ptr *data
+		ptr = (*data)(pmem.New("root", ptr))
+		initialize(ptr, BTREE_ASCENDING, false)
+		btree_map_insert(ptr, 1, 10)
+		txn("undo") {
+			ptr.magic = old_magic
+		}
+		step_done(t, tree_entries(ptr))
+		return
+	case "verify":
+		var ptr *data
+		ptr = (*data)(pmem.Get("root", ptr))
+		if ptr.magic != old_magic {
+			t.Fatalf("magic %#x, want %#x", ptr.magic, old_magic)
+		}
+		step_done(t, tree_entries(ptr))
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pool := filepath.Join(dir, "layout.pool")
+	want := in_pool(t, pool, "build")
+	for _, args := range [][]string{{pool}, {pool, "validate"}} {
+		cmd, err := test_program(args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := cmd.CombinedOutput()
+		if status := exit_code(t, err); status != EXIT_POOL {
+			t.Errorf("%q: exit status %d, want %d\n%s", args, status, EXIT_POOL, out)
+		} else if !strings.Contains(string(out), "older btree_map") {
+			t.Errorf("%q: the layout goes unreported:\n%s", args, out)
+		}
+	}
+	if got := in_pool(t, pool, "verify"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("the tree holds %q, want %q", got, want)
+	}
+}
+
+// Read in chunks of any size, which split the records, the reader produces
+// a 16-byte record for every entry in order, and then EOF.
+func TestReader(t *testing.T) {
+	ptr := new_tree(t)
+	for _, i := range rand.Perm(300) {
+		btree_map_insert(ptr, i - 150, -(i - 150) * 7)
+	}
+	want := tree_entries(ptr)
+	for _, size := range []int{1, 5, 16, 100} {
+		r := btree_map_reader(ptr)
+		var data []byte
+		buf := make([]byte, size)
+		for {
+			n, err := r.Read(buf)
+			data = append(data, buf[:n]...)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(data) != 16 * len(want) {
+			t.Fatalf("chunks of %d: %d bytes for %d entries", size, len(data), len(want))
+		}
+		got := []string{}
+		for i := 0; i < len(data); i += 16 {
+			key := int(binary.LittleEndian.Uint64(data[i:]))
+			value := int(binary.LittleEndian.Uint64(data[i + 8:]))
+			got = append(got, fmt.Sprint(key, value))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("chunks of %d: records %v, want %v", size, got, want)
+		}
+	}
+	if n, err := btree_map_reader(new_tree(t)).Read(make([]byte, 16)); n != 0 || err != io.EOF {
+		t.Fatalf("reader of an empty tree: %d bytes, %v", n, err)
+	}
+}
+
+// An insert cut short by a crash at any of its key comparisons, some of
+// which fall between the writes of its transaction, leaves the tree as it
+// was before the insert once the pool is reopened.
+func TestDurableTornInsert(t *testing.T) {
+	const key, value = 245, 2450
+	if step := durable_step(); strings.HasPrefix(step, "crash") {
+		crash, _ := strconv.Atoi(step[len("crash"):])
+		var ptr *data
+		ptr = (*data)(pmem.New("root", ptr))
+		initialize(ptr, BTREE_ASCENDING, false)
+		for k := 10; k <= 490; k += 10 {
+			btree_map_insert(ptr, k, k * 10)
+		}
+		before := tree_entries(ptr)
+		calls := 0
+		ascending := btree_map_comparators[BTREE_ASCENDING]
+		btree_map_comparators[BTREE_ASCENDING] = func(a int, b int) bool {
+			if calls++; calls == crash {
+				step_done(t, before)
+				os.Exit(0)
+			}
+			return a < b
+		}
+		btree_map_insert(ptr, key, value)
+		btree_map_comparators[BTREE_ASCENDING] = ascending
+		step_done(t, append([]string{"done"}, tree_entries(ptr)...))
+		return
+	} else if step == "verify" {
+		var ptr *data
+		ptr = (*data)(pmem.Get("root", ptr))
+		if err := btree_map_check_invariants(ptr); err != nil {
+			t.Fatal(err)
+		}
+		entries := []string{}
+		for _, entry := range tree_entries(ptr) {
+			if entry != fmt.Sprint(key, " ", value) {
+				entries = append(entries, entry)
+			}
+		}
+		step_done(t, entries)
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "torn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for crash := 1; ; crash++ {
+		pool := filepath.Join(dir, fmt.Sprintf("torn%d.pool", crash))
+		want := in_pool(t, pool, fmt.Sprint("crash", crash))
+		if want[0] == "done" {
+			if crash == 1 {
+				t.Fatal("the insert compared no keys")
+			}
+			break
+		}
+		if got := in_pool(t, pool, "verify"); !reflect.DeepEqual(got, want) {
+			t.Fatalf("crash at comparison %d: the tree holds %q, want %q", crash, got, want)
+		}
+	}
+}
+
+// A traversal visits the keys in ascending order and stops at the first one
+// for which the callback returns true, which it reports.
+func TestForeachBreak(t *testing.T) {
+	keys := []int{}
+	for key := 1; key <= 100; key++ {
+		keys = append(keys, key)
+	}
+	ptr := new_tree(t)
+	for _, i := range rand.Perm(100) {
+		btree_map_insert(ptr, keys[i], keys[i] * 10)
+	}
+	for _, stop := range []int{1, 37, 100} {
+		got := []int{}
+		broke := btree_map_foreach(ptr, func(key int, value int) bool {
+			got = append(got, key)
+			return key == stop
+		})
+		if !broke || !reflect.DeepEqual(got, keys[:stop]) {
+			t.Fatalf("stop at %d: stopped %v after %v", stop, broke, got)
+		}
+	}
+	if btree_map_foreach(ptr, func(int, int) bool { return false }) {
+		t.Fatal("a full traversal reports a stop")
+	}
+}
+
+// The iterator of btree_map_all yields the items in ascending order, and is
+// not called again once yield returns false.
+func TestAll(t *testing.T) {
+	btree_map_all(new_tree(t))(func(key int, value int) bool {
+		t.Fatalf("an empty tree yields %d", key)
+		return true
+	})
+
+	keys := []int{}
+	for key := 1; key <= 100; key++ {
+		keys = append(keys, key)
+	}
+	ptr := new_tree(t)
+	for _, i := range rand.Perm(100) {
+		btree_map_insert(ptr, keys[i], keys[i] * 10)
+	}
+	for _, stop := range []int{1, 37, 100} {
+		got := []int{}
+		btree_map_all(ptr)(func(key int, value int) bool {
+			if value != key * 10 {
+				t.Fatalf("key %d yields %d, want %d", key, value, key * 10)
+			}
+			got = append(got, key)
+			return key != stop
+		})
+		if !reflect.DeepEqual(got, keys[:stop]) {
+			t.Fatalf("stop at %d: yielded %v", stop, got)
+		}
+	}
+}
+
+// Prefix sums at every key, and between and around them, match a running
+// sum over the entries in order, after inserts and removals alike.
+func TestPrefixSum(t *testing.T) {
+	ptr := new_tree(t)
+	values := map[int]int{}
+	for _, i := range rand.Perm(300) {
+		key, value := i * 3, rand.Intn(1000) - 500
+		btree_map_insert(ptr, key, value)
+		values[key] = value
+	}
+	for key := 0; key < 900; key += 9 {
+		btree_map_remove(ptr, key)
+		delete(values, key)
+	}
+	for q := -5; q <= 905; q++ {
+		want := 0
+		btree_map_foreach(ptr, func(key int, value int) bool {
+			if key > q {
+				return true
+			}
+			if values[key] != value {
+				t.Fatalf("key %d holds %d, want %d", key, value, values[key])
+			}
+			want += value
+			return false
+		})
+		if got := btree_map_prefix_sum(ptr, q); got != want {
+			t.Fatalf("prefix sum up to %d: %d, want %d", q, got, want)
+		}
+	}
+	if got := btree_map_prefix_sum(new_tree(t), 10); got != 0 {
+		t.Fatalf("prefix sum of an empty tree: %d", got)
+	}
+}
+
+// A key stored twice is reported by btree_map_find_duplicates, and a tree
+// without one gives an empty list.
+func TestFindDuplicates(t *testing.T) {
+	ptr := new_tree(t)
+	for key := 1; key <= 100; key++ {
+		btree_map_insert(ptr, key, key * 10)
+	}
+	if dups := btree_map_find_duplicates(ptr); len(dups) != 0 {
+		t.Fatalf("a clean tree has duplicates %v", dups)
+	}
+
+	/* the leftmost key of the tree is copied over the rightmost */
+	first, last := ptr.root, ptr.root
+	for first.slots[0] != nil {
+		first = first.slots[0]
+	}
+	for last.slots[last.n] != nil {
+		last = last.slots[last.n]
+	}
+	last.items[last.n - 1].key = first.items[0].key
+	if dups := btree_map_find_duplicates(ptr); !reflect.DeepEqual(dups, []int{1}) {
+		t.Fatalf("duplicates %v, want [1]", dups)
+	}
+}
+
+// A leaf split in place, which puts the leaves of its subtree a level below
+// the others, is reported by btree_map_leaf_depths and rebuilt by
+// btree_map_repair_depth into a valid tree with the same entries.
+func TestRepairDepth(t *testing.T) {
+	var keys []int
+	for key := 1; key <= 100; key++ {
+		keys = append(keys, key)
+	}
+	ptr := new_tree(t, keys...)
+	depths := btree_map_leaf_depths(ptr)
+	if len(depths) != 1 {
+		t.Fatalf("a valid tree has leaves at depths %v", depths)
+	}
+	if repaired, err := btree_map_repair_depth(ptr); repaired || err != nil {
+		t.Fatalf("a valid tree was repaired: %v %v", repaired, err)
+	}
+
+	/* the leftmost leaf keeps its middle item, with the others in two leaves */
+	leaf := ptr.root
+	for leaf.slots[0] != nil {
+		leaf = leaf.slots[0]
+	}
+	mid := leaf.n / 2
+	txn("undo") {
+		left, right := pnew(node_t), pnew(node_t)
+		for i := 0; i < leaf.n; i++ {
+			if i < mid {
+				left.items[left.n] = leaf.items[i]
+				left.n++
+				left.sum += leaf.items[i].value
+			} else if i > mid {
+				right.items[right.n] = leaf.items[i]
+				right.n++
+				right.sum += leaf.items[i].value
+			}
+		}
+		leaf.items[0] = leaf.items[mid]
+		for i := 1; i < leaf.n; i++ {
+			leaf.items[i] = item{}
+		}
+		leaf.n = 1
+		leaf.slots[0], leaf.slots[1] = left, right
+	}
+	if got, want := btree_map_leaf_depths(ptr), []int{depths[0], depths[0] + 1}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("leaves at depths %v, want %v", got, want)
+	}
+	if btree_map_check_invariants(ptr) == nil {
+		t.Fatal("the invariants hold in an unbalanced tree")
+	}
+
+	if repaired, err := btree_map_repair_depth(ptr); !repaired || err != nil {
+		t.Fatalf("repair: %v %v", repaired, err)
+	}
+	if depths := btree_map_leaf_depths(ptr); len(depths) != 1 {
+		t.Fatalf("the repaired tree has leaves at depths %v", depths)
+	}
+	check_tree(t, ptr, keys)
+}
+
+// A tree left open by a process which exits without btree_map_close is
+// reported dirty by the next btree_map_open, which checks its invariants,
+// and a tree closed cleanly is not.
+func TestDurableDirty(t *testing.T) {
+	open := func() (*data, []string) {
+		var ptr *data
+		ptr = (*data)(pmem.Get("root", ptr))
+		dirty, err := btree_map_open(ptr)
+		return ptr, []string{fmt.Sprint(dirty, " ", err != nil)}
+	}
+	switch durable_step() {
+	case "create":
+		var ptr *data
+		ptr = (*data)(pmem.New("root", ptr))
+		initialize(ptr, BTREE_ASCENDING, false)
+		for key := 1; key <= 20; key++ {
+			btree_map_insert(ptr, key, key * 10)
+		}
+		_, got := open()
+		step_done(t, got)
+		return
+	case "close":
+		ptr, got := open()
+		btree_map_close(ptr)
+		step_done(t, got)
+		return
+	case "corrupt":
+		/* left open, with two keys of the root swapped */
+		ptr, got := open()
+		txn("undo") {
+			ptr.root.items[0].key, ptr.root.items[1].key = ptr.root.items[1].key, ptr.root.items[0].key
+		}
+		step_done(t, got)
+		return
+	case "check":
+		_, got := open()
+		step_done(t, got)
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "dirty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pool := filepath.Join(dir, "dirty.pool")
+	for _, step := range []struct {
+		name string
+		want string
+	}{
+		{"create", "false false"},
+		{"close", "true false"},
+		{"corrupt", "false false"},
+		{"check", "true true"},
+	} {
+		if got := in_pool(t, pool, step.name); !reflect.DeepEqual(got, []string{step.want}) {
+			t.Fatalf("%s: dirty and failed check %q, want %q", step.name, got, step.want)
+		}
+	}
+}
+
+// btree_map_foreach_keys visits exactly the live keys, in the order of the
+// tree, and stops when the callback asks it to.
+func TestForeachKeys(t *testing.T) {
+	for _, order := range []int{BTREE_ASCENDING, BTREE_DESCENDING} {
+		ptr := btree_map_new_tree(order)
+		if btree_map_foreach_keys(ptr, func(key int) bool {
+			t.Fatalf("order %d: key %d in an empty tree", order, key)
+			return false
+		}) {
+			t.Fatalf("order %d: the walk of an empty tree reports a stop", order)
+		}
+
+		ptr.lazy = true
+		for _, key := range rand.New(rand.NewSource(1)).Perm(300) {
+			btree_map_insert(ptr, key, key * 10)
+		}
+		var want []int
+		for key := 0; key < 300; key++ {
+			if key % 3 == 0 {
+				btree_map_remove(ptr, key)
+			} else {
+				want = append(want, key)
+			}
+		}
+		if order == BTREE_DESCENDING {
+			for i, j := 0, len(want) - 1; i < j; i, j = i + 1, j - 1 {
+				want[i], want[j] = want[j], want[i]
+			}
+		}
+
+		var got []int
+		if btree_map_foreach_keys(ptr, func(key int) bool {
+			got = append(got, key)
+			return false
+		}) {
+			t.Fatalf("order %d: a full walk reports a stop", order)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("order %d: keys %v, want %v", order, got, want)
+		}
+
+		got = nil
+		if !btree_map_foreach_keys(ptr, func(key int) bool {
+			got = append(got, key)
+			return len(got) == 10
+		}) || !reflect.DeepEqual(got, want[:10]) {
+			t.Fatalf("order %d: stopped walk visits %v, want %v", order, got, want[:10])
+		}
+	}
+}
+
+// validate passes a healthy tree, and fails a tree with two keys out of
+// order, saying which check failed.
+func TestValidate(t *testing.T) {
+	switch durable_step() {
+	case "build":
+		var ptr *data
+		ptr = (*data)(pmem.New("root", ptr))
+		initialize(ptr, BTREE_ASCENDING, false)
+		for key := 1; key <= 50; key++ {
+			btree_map_insert(ptr, key, key * 10)
+		}
+		step_done(t, tree_entries(ptr))
+		return
+	case "corrupt":
+		var ptr *data
+		ptr = (*data)(pmem.Get("root", ptr))
+		txn("undo") {
+			ptr.root.items[0].key, ptr.root.items[1].key = ptr.root.items[1].key, ptr.root.items[0].key
+		}
+		step_done(t, nil)
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pool := filepath.Join(dir, "validate.pool")
+	validate := func() (int, string) {
+		cmd, err := test_program(pool, "validate")
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := cmd.CombinedOutput()
+		return exit_code(t, err), string(out)
+	}
+
+	in_pool(t, pool, "build")
+	if status, out := validate(); status != EXIT_OK || !strings.Contains(out, "invariants: ok") {
+		t.Fatalf("healthy tree: exit status %d\n%s", status, out)
+	}
+	in_pool(t, pool, "corrupt")
+	status, out := validate()
+	if status != EXIT_POOL {
+		t.Fatalf("corrupted tree: exit status %d, want %d\n%s", status, EXIT_POOL, out)
+	}
+	for _, want := range []string{"invariants: FAILED", "failed validation"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("corrupted tree: %q missing from the report\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmware/go-pmem-transaction/pmem"
+)
+
+// first_init is what pmem.Init returned in TestMain.
+var first_init bool
+
+// The tests share one pool, as go-pmem maps a single pool per process; a
+// step run by in_pool opens its own pool instead, and a process started by
+// test_program runs btree.
+func TestMain(m *testing.M) {
+	if is_test_program() {
+		main()
+	}
+	pool := durable_pool()
+	temporary := pool == ""
+	if temporary {
+		pool = filepath.Join(os.TempDir(), fmt.Sprintf("btree_test.%d.pool", os.Getpid()))
+	}
+	first_init = pmem.Init(pool)
+	status := m.Run()
+	if temporary {
+		os.Remove(pool)
+	}
+	os.Exit(status)
+}
+
+// node_entries appends the entries of the subtree of n in key order, one
+// "key value" string each.
+func node_entries(n *node, entries []string) []string {
+	if n == nil {
+		return entries
+	}
+	entries = node_entries(n.slots[0], entries)
+	value := strings.TrimRight(string(n.value[:]), "\x00")
+	entries = append(entries, fmt.Sprint(n.key, " ", value))
+	return node_entries(n.slots[1], entries)
+}
+
+// Inserts survive a reopen.
+func TestDurableInsert(t *testing.T) {
+	AssertDurable(t, func() []string {
+		var ptr *data
+		ptr = (*data)(pmem.New("root", ptr))
+		initialize(ptr)
+		for _, key := range []int{50, 20, 80, 10, 30, 70, 90, 60} {
+			if err := insert(&ptr.root, key, fmt.Sprint("value", key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return node_entries(ptr.root, []string{})
+	}, func() []string {
+		var ptr *data
+		ptr = (*data)(pmem.Get("root", ptr))
+		if ptr.magic != magic {
+			t.Fatal("the root object was not initialized")
+		}
+		return node_entries(ptr.root, []string{})
+	})
+}
+
+// A pool is opened as a new one after ResetPool, and as an existing one
+// otherwise.
+func TestResetPool(t *testing.T) {
+	if durable_step() != "" {
+		step_done(t, []string{fmt.Sprint(first_init)})
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pool := filepath.Join(dir, "reset.pool")
+	for i, want := range []string{"true", "false", "reset", "true", "reset", "reset", "true"} {
+		if want == "reset" {
+			if err := ResetPool(pool); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if got := in_pool(t, pool, "init")[0]; got != want {
+			t.Fatalf("open %d: first init %s, want %s", i, got, want)
+		}
+	}
+}
+
+// Run rejects malformed command lines, before opening any pool, with errors
+// mapped to the usage exit status.
+func TestRunErrors(t *testing.T) {
+	missing := filepath.Join(os.TempDir(), "btree_test.missing.pool")
+	tests := []struct {
+		args   []string
+		status int
+	}{
+		{[]string{}, EXIT_USAGE},
+		{[]string{"pool"}, EXIT_USAGE},
+		{[]string{"pool", ""}, EXIT_USAGE},
+		{[]string{"-nosuchflag", "pool", "s", "1"}, EXIT_USAGE},
+		{[]string{"pool", "v", "extra"}, EXIT_USAGE},
+		{[]string{missing, "v"}, EXIT_POOL},
+	}
+	for _, tc := range tests {
+		err := Run(tc.args)
+		if err == nil {
+			t.Errorf("%q: no error", tc.args)
+		} else if status := exit_status(err); status != tc.status {
+			t.Errorf("%q: %v, exit status %d, want %d", tc.args, err, status, tc.status)
+		}
+	}
+	if err := Run([]string{"pool"}); err != ErrUsage {
+		t.Errorf("missing operation: %v, want %v", err, ErrUsage)
+	}
+}
+
+// An insert into a full pool returns ErrPoolFull and leaves the tree as it
+// was. go-pmem has no pool size to make small, so alloc_node asks for more
+// than the heap can hold instead, which the runtime fails as it would a pool
+// with no room left.
+func TestInsertPoolFull(t *testing.T) {
+	var ptr *data
+	txn("undo") {
+		ptr = pnew(data)
+	}
+	initialize(ptr)
+	keys := []int{50, 20, 80, 10, 30, 70, 90}
+	for _, key := range keys {
+		if err := insert(&ptr.root, key, fmt.Sprint("value", key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := node_entries(ptr.root, []string{})
+
+	alloc := alloc_node
+	huge := 1 << 62
+	alloc_node = func() *node { return &pmake([]node, 1, huge)[0] }
+	err := insert(&ptr.root, 60, "value60")
+	alloc_node = alloc
+	if err != ErrPoolFull {
+		t.Fatalf("insert into a full pool: %v, want ErrPoolFull", err)
+	}
+	if got := node_entries(ptr.root, []string{}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("tree holds %q, want %q", got, want)
+	}
+	if err := validate_node(ptr.root, nil, nil, map[*node]bool{}, map[int]int{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := insert(&ptr.root, 60, "value60"); err != nil {
+		t.Fatalf("insert once the pool has room: %v", err)
+	}
+}
@@ -19,6 +19,65 @@ source $HOME/.corundum/env
 export GO111MODULE=off
 go get -u github.com/vmware/go-pmem-transaction
 cd $dir_path
-go build -txn btree.go
-go build -txn btree_map.go
-go build -txn simplekv.go
\ No newline at end of file
+# shutdown.go holds the exit statuses, signal handling, pool opening and
+# shutdown shared by all the programs; repl.go is the command loop of the
+# interactive ones, with the help and argument parsing their commands share
+# profile.go writes the -cpuprofile and -memprofile profiles of the programs
+# it is built with
+go build -txn btree.go profile.go shutdown.go
+# the corundum_debug variant checks the tree invariants after every mutation
+# replay.go replays timed workloads against the structure it is built with
+go build -txn btree_map.go btree_map_release.go replay.go profile.go repl.go shutdown.go
+go build -txn -o btree_map_debug btree_map.go btree_map_debug.go replay.go profile.go repl.go shutdown.go
+go build -txn simplekv.go replay.go profile.go shutdown.go
+go build -txn skiplist.go repl.go shutdown.go
+go build -txn rbtree_map.go repl.go shutdown.go
+go build -txn avltree.go profile.go shutdown.go
+go build -txn art.go repl.go shutdown.go
+go build -txn trie.go repl.go shutdown.go
+go build -txn bplustree.go repl.go shutdown.go
+go build -txn cuckoo_map.go repl.go shutdown.go
+go build -txn hopscotch_map.go repl.go shutdown.go
+go build -txn cceh_map.go repl.go shutdown.go
+go build -txn lhash_map.go repl.go shutdown.go
+go build -txn robinhood_map.go repl.go shutdown.go
+go build -txn dlist.go repl.go shutdown.go
+go build -txn queue.go shutdown.go
+go build -txn stack.go repl.go shutdown.go
+go build -txn deque.go repl.go shutdown.go
+go build -txn pqueue.go repl.go shutdown.go
+go build -txn ringbuf.go repl.go shutdown.go
+go build -txn lsm.go repl.go shutdown.go
+go build -txn bloom.go repl.go shutdown.go
+go build -txn hll.go repl.go shutdown.go
+go build -txn roaring.go repl.go shutdown.go
+go build -txn graph.go repl.go shutdown.go
+go build -txn unionfind.go repl.go shutdown.go
+go build -txn pvector.go repl.go shutdown.go
+# strpool.go interns strings for the programs it is built with
+go build -txn intern.go strpool.go repl.go shutdown.go
+go build -txn hamt.go repl.go shutdown.go
+go build -txn treap.go repl.go shutdown.go
+go build -txn splay.go repl.go shutdown.go
+go build -txn ctree_map.go repl.go shutdown.go
+go build -txn rtree_map.go repl.go shutdown.go
+go build -txn hashmap_atomic.go repl.go shutdown.go
+go build -txn hashmap_tx.go repl.go shutdown.go
+# slab.go allocates fixed-size slots for the programs it is built with
+go build -txn slabcli.go slab.go repl.go shutdown.go
+go build -txn wal.go repl.go shutdown.go
+go build -txn multimap.go repl.go shutdown.go
+# oset.go is the ordered set of the programs it is built with
+go build -txn osetcli.go oset.go repl.go shutdown.go
+go build -txn lru.go repl.go shutdown.go
+go build -txn merkle.go repl.go shutdown.go
+go build -txn betree.go repl.go shutdown.go
+go build -txn masstree.go repl.go shutdown.go
+go build -txn segtree.go repl.go shutdown.go
+go build -txn tsdb.go repl.go shutdown.go
+go build -txn matrix.go repl.go shutdown.go
+go build -txn wordcount.go repl.go shutdown.go
+go build -txn mpmcq.go repl.go shutdown.go
+go build -txn sparse.go repl.go shutdown.go
+go build -txn routetable.go repl.go shutdown.go
+go build -txn bitcask.go repl.go shutdown.go
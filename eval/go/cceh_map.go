@@ -0,0 +1,461 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* number of slots of a segment */
+const CCEH_MAP_SEGMENT_SLOTS int = 64
+
+/* slots probed for a key, starting from the one its hash picks */
+const CCEH_MAP_PROBE int = 8
+
+type entry_t struct {
+	key   int
+	value int
+	used  bool
+}
+
+/*
+ * segment_t -- holds the keys whose hash starts with the same local_depth
+ * bits; the segment is shared by the 1 << (global_depth - local_depth)
+ * consecutive directory entries those bits select
+ */
+type segment_t struct {
+	local_depth int
+	slots       [CCEH_MAP_SEGMENT_SLOTS]entry_t
+}
+
+/*
+ * data -- dir has 1 << global_depth entries and is indexed by the top
+ * global_depth bits of the hash of a key
+ */
+type data struct {
+	dir          []*segment_t
+	global_depth int
+	count        int
+	magic        int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x1A4F03C6E98D72B5
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.dir = pmake([]*segment_t, 1)
+		ptr.dir[0] = pnew(segment_t)
+		ptr.global_depth = 0
+		ptr.count = 0
+		ptr.magic = magic
+	}
+}
+
+/*
+ * cceh_map_hash -- (internal) returns the hash of key, whose top bits pick
+ * the segment and whose bottom bits pick the slot within it
+ */
+func cceh_map_hash(key int) uint64 {
+	h := uint64(key)
+	h = (h ^ h >> 30) * 0xBF58476D1CE4E5B9
+	h = (h ^ h >> 27) * 0x94D049BB133111EB
+	return h ^ h >> 31
+}
+
+/*
+ * cceh_map_dir_index -- (internal) returns the directory entry for hash h
+ */
+func cceh_map_dir_index(ptr *data, h uint64) int {
+	return int(h >> uint(64 - ptr.global_depth))
+}
+
+/*
+ * cceh_map_slot -- (internal) returns the i-th slot probed for hash h
+ */
+func cceh_map_slot(h uint64, i int) int {
+	return (int(h % uint64(CCEH_MAP_SEGMENT_SLOTS)) + i) % CCEH_MAP_SEGMENT_SLOTS
+}
+
+/*
+ * cceh_map_find -- (internal) returns the entry holding key, or nil
+ */
+func cceh_map_find(ptr *data, key int) *entry_t {
+	h := cceh_map_hash(key)
+	seg := ptr.dir[cceh_map_dir_index(ptr, h)]
+	for i := 0; i < CCEH_MAP_PROBE; i++ {
+		if e := &seg.slots[cceh_map_slot(h, i)]; e.used && e.key == key {
+			return e
+		}
+	}
+	return nil
+}
+
+/*
+ * cceh_map_free_slot -- (internal) returns the first free slot of the probe
+ * of hash h in seg, or nil
+ */
+func cceh_map_free_slot(seg *segment_t, h uint64) *entry_t {
+	for i := 0; i < CCEH_MAP_PROBE; i++ {
+		if e := &seg.slots[cceh_map_slot(h, i)]; !e.used {
+			return e
+		}
+	}
+	return nil
+}
+
+/*
+ * cceh_map_double -- (internal) doubles the directory into dir, each entry
+ * becoming two entries for the same segment
+ */
+func cceh_map_double(ptr *data, dir []*segment_t) {
+	for i, seg := range ptr.dir {
+		dir[2 * i] = seg
+		dir[2 * i + 1] = seg
+	}
+	ptr.dir = dir
+	ptr.global_depth++
+}
+
+/*
+ * cceh_map_split -- (internal) splits the segment of directory entry idx in
+ * two by the next bit of the hash, doubling the directory first if the
+ * segment has a single entry; an entry keeps its slot in its new segment,
+ * where it is still within reach of its probe; must be called in a
+ * transaction
+ */
+func cceh_map_split(ptr *data, idx int) {
+	seg := ptr.dir[idx]
+	var dir []*segment_t
+	if seg.local_depth == ptr.global_depth {
+		dir = pmake([]*segment_t, 2 * len(ptr.dir))
+	}
+	left, right := pnew(segment_t), pnew(segment_t)
+
+	if dir != nil {
+		cceh_map_double(ptr, dir)
+		idx *= 2
+	}
+	left.local_depth = seg.local_depth + 1
+	right.local_depth = seg.local_depth + 1
+	bit := uint(63 - seg.local_depth)
+	for i, e := range seg.slots {
+		if !e.used {
+			continue
+		}
+		if cceh_map_hash(e.key) >> bit & 1 == 0 {
+			left.slots[i] = e
+		} else {
+			right.slots[i] = e
+		}
+	}
+
+	/* the entries of seg are the span of the directory it is aligned to */
+	span := 1 << uint(ptr.global_depth - seg.local_depth)
+	first := idx &^ (span - 1)
+	for i := 0; i < span; i++ {
+		if i < span / 2 {
+			ptr.dir[first + i] = left
+		} else {
+			ptr.dir[first + i] = right
+		}
+	}
+}
+
+/*
+ * cceh_map_insert -- inserts a key-value pair, replacing the value of the key
+ * if it is present; the segment splits and directory doublings the insert
+ * needs are part of its transaction, so a pool which fills up on any of
+ * them returns ErrPoolFull and leaves the map unchanged
+ */
+func cceh_map_insert(ptr *data, key int, value int) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		if e := cceh_map_find(ptr, key); e != nil {
+			e.value = value
+			return nil
+		}
+		h := cceh_map_hash(key)
+		idx := cceh_map_dir_index(ptr, h)
+		e := cceh_map_free_slot(ptr.dir[idx], h)
+		for e == nil {
+			cceh_map_split(ptr, idx)
+			idx = cceh_map_dir_index(ptr, h)
+			e = cceh_map_free_slot(ptr.dir[idx], h)
+		}
+		*e = entry_t{key, value, true}
+		ptr.count++
+	}
+	return nil
+}
+
+/*
+ * cceh_map_remove -- removes the key from the map, returning its value and
+ * whether it was found; segments are never merged back
+ */
+func cceh_map_remove(ptr *data, key int) (int, bool) {
+	e := cceh_map_find(ptr, key)
+	if e == nil {
+		return 0, false
+	}
+	value := e.value
+	txn("undo") {
+		*e = entry_t{}
+		ptr.count--
+	}
+	return value, true
+}
+
+/*
+ * cceh_map_get -- searches for the value of the key
+ */
+func cceh_map_get(ptr *data, key int) (int, bool) {
+	if e := cceh_map_find(ptr, key); e != nil {
+		return e.value, true
+	}
+	return 0, false
+}
+
+/*
+ * cceh_map_lookup -- checks if the key exists in the map
+ */
+func cceh_map_lookup(ptr *data, key int) bool {
+	return cceh_map_find(ptr, key) != nil
+}
+
+/*
+ * cceh_map_foreach -- calls cb for every pair, in no particular order,
+ * stopping early when cb returns true
+ */
+func cceh_map_foreach(ptr *data, cb func(int, int) bool) bool {
+	for i, seg := range ptr.dir {
+		if i > 0 && ptr.dir[i - 1] == seg {
+			continue
+		}
+		for _, e := range seg.slots {
+			if e.used && cb(e.key, e.value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * cceh_map_clear -- removes all pairs from the map and shrinks it back to a
+ * single segment
+ */
+func cceh_map_clear(ptr *data) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		dir := pmake([]*segment_t, 1)
+		dir[0] = pnew(segment_t)
+		ptr.dir = dir
+		ptr.global_depth = 0
+		ptr.count = 0
+	}
+	return nil
+}
+
+/*
+ * cceh_map_check -- verifies that every segment fills the aligned span of
+ * the directory its local depth gives, that every key is in the segment and
+ * within the probe its hash selects, and that count is right; returns the
+ * number of segments
+ */
+func cceh_map_check(ptr *data) (int, error) {
+	if len(ptr.dir) != 1 << uint(ptr.global_depth) {
+		return 0, fmt.Errorf("directory of %d entries at global depth %d",
+			len(ptr.dir), ptr.global_depth)
+	}
+	segments, entries := 0, 0
+	for first := 0; first < len(ptr.dir); {
+		seg := ptr.dir[first]
+		if seg.local_depth > ptr.global_depth {
+			return 0, fmt.Errorf("segment at %d has local depth %d", first,
+				seg.local_depth)
+		}
+		span := 1 << uint(ptr.global_depth - seg.local_depth)
+		if first % span != 0 {
+			return 0, fmt.Errorf("segment at %d is not aligned to its span %d",
+				first, span)
+		}
+		for i := first; i < first + span; i++ {
+			if ptr.dir[i] != seg {
+				return 0, fmt.Errorf("directory entry %d does not lead to the segment at %d",
+					i, first)
+			}
+		}
+		for i, e := range seg.slots {
+			if !e.used {
+				continue
+			}
+			h := cceh_map_hash(e.key)
+			if idx := cceh_map_dir_index(ptr, h); idx < first || idx >= first + span {
+				return 0, fmt.Errorf("key %d in the segment at %d, belongs at %d",
+					e.key, first, idx)
+			}
+			if (i - cceh_map_slot(h, 0) + CCEH_MAP_SEGMENT_SLOTS) %
+				CCEH_MAP_SEGMENT_SLOTS >= CCEH_MAP_PROBE {
+				return 0, fmt.Errorf("key %d in slot %d is out of its probe", e.key, i)
+			}
+			if cceh_map_find(ptr, e.key) != &seg.slots[i] {
+				return 0, fmt.Errorf("key %d is stored twice", e.key)
+			}
+			entries++
+		}
+		segments++
+		first += span
+	}
+	if entries != ptr.count {
+		return 0, fmt.Errorf("%d entries, count is %d", entries, ptr.count)
+	}
+	return segments, nil
+}
+
+/*
+ * str_insert -- cceh_map_insert wrapper which works on strings
+ */
+func str_insert(ptr *data, str string) {
+	var key int
+	if scan_args("insert", str, "%d", &key) {
+		if err := cceh_map_insert(ptr, key, 0); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- cceh_map_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key int
+	if scan_args("remove", str, "%d", &key) {
+		if _, ok := cceh_map_remove(ptr, key); !ok {
+			fmt.Println("no such value")
+		}
+	}
+}
+
+/*
+ * str_check -- cceh_map_lookup wrapper which works on strings
+ */
+func str_check(ptr *data, str string) {
+	var key int
+	if scan_args("check", str, "%d", &key) {
+		fmt.Println(cceh_map_lookup(ptr, key))
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := cceh_map_insert(ptr, rand.Int(), 0); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+/*
+ * str_clear -- cceh_map_clear wrapper which reports its error
+ */
+func str_clear(ptr *data) {
+	if err := cceh_map_clear(ptr); err != nil {
+		fmt.Println("clear:", err)
+	}
+}
+
+func help() {
+	print_help(
+		"i $value - insert $value",
+		"r $value - remove $value",
+		"c $value - check $value, returns 0/1",
+		"n $value - insert $value random values",
+		"p - print all values",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	cceh_map_foreach(ptr, func(key int, value int) bool {
+		fmt.Print(key, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if segments, err := cceh_map_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		slots := segments * CCEH_MAP_SEGMENT_SLOTS
+		fmt.Printf("entries: %d segments: %d global depth: %d load: %.2f\n",
+			ptr.count, segments, ptr.global_depth,
+			float64(ptr.count) / float64(slots))
+	}
+}
+
+/*
+ * Run -- opens the map named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("cceh_map", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'c': str_check(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
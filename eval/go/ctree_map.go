@@ -0,0 +1,441 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/*
+ * entry_t -- a leaf holding a pair, or a link to an internal node when child
+ * is not nil
+ */
+type entry_t struct {
+	key   int
+	value int
+	child *node_t
+}
+
+/*
+ * node_t -- the keys below entries[0] have bit diff clear and the ones below
+ * entries[1] have it set; diff is the most significant bit in which they
+ * differ, so it decreases on the way down
+ */
+type node_t struct {
+	diff    int
+	entries [2]entry_t
+}
+
+type data struct {
+	root  entry_t
+	count int
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x58E0C3B7A19F26D4
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.root = entry_t{}
+		ptr.count = 0
+		ptr.magic = magic
+	}
+}
+
+/*
+ * ctree_map_bit -- (internal) returns bit i of key, 0 or 1
+ */
+func ctree_map_bit(key int, i int) int {
+	return int(uint64(key) >> uint(i) & 1)
+}
+
+/*
+ * ctree_map_find_crit_bit -- (internal) finds the most significant bit in
+ * which the two keys differ
+ */
+func ctree_map_find_crit_bit(lhs int, rhs int) int {
+	return bits.Len64(uint64(lhs ^ rhs)) - 1
+}
+
+/*
+ * ctree_map_is_leaf -- (internal) checks whether the entry holds a pair
+ */
+func ctree_map_is_leaf(e *entry_t) bool {
+	return e.child == nil
+}
+
+/*
+ * ctree_map_insert_leaf -- (internal) inserts a new leaf at the right
+ * position, below a new node for the critical bit diff
+ */
+func ctree_map_insert_leaf(p *entry_t, e entry_t, diff int) {
+	n := pnew(node_t)
+	n.diff = diff
+	d := ctree_map_bit(e.key, diff)
+
+	/* insert the leaf at the direction based on the critical bit */
+	n.entries[d] = e
+
+	/* find the appropriate position in the tree to insert the node */
+	for !ctree_map_is_leaf(p) {
+		/* the critical bits have to be sorted */
+		if p.child.diff < diff {
+			break
+		}
+		p = &p.child.entries[ctree_map_bit(e.key, p.child.diff)]
+	}
+
+	/* insert the found destination in the other slot */
+	n.entries[1 - d] = *p
+	*p = entry_t{child: n}
+}
+
+/*
+ * ctree_map_insert -- inserts a new key-value pair into the map, replacing
+ * the value of the key if it is present; returns ErrPoolFull, leaving the
+ * map unchanged, if the pool has no room for the new node
+ */
+func ctree_map_insert(ptr *data, key int, value int) (err error) {
+	p := &ptr.root
+
+	/* descend the path until a best matching key is found */
+	for !ctree_map_is_leaf(p) {
+		p = &p.child.entries[ctree_map_bit(key, p.child.diff)]
+	}
+
+	e := entry_t{key, value, nil}
+	defer pool_full(&err)
+	txn("undo") {
+		if ptr.count == 0 || p.key == key {
+			if ptr.count == 0 {
+				ptr.count++
+			}
+			*p = e
+		} else {
+			ctree_map_insert_leaf(&ptr.root, e, ctree_map_find_crit_bit(p.key, key))
+			ptr.count++
+		}
+	}
+	return nil
+}
+
+/*
+ * ctree_map_get_leaf -- (internal) searches for the leaf of the key, also
+ * returning the entry linking to its node, nil for the root
+ */
+func ctree_map_get_leaf(ptr *data, key int) (*entry_t, *entry_t) {
+	n := &ptr.root
+	var p *entry_t
+
+	for !ctree_map_is_leaf(n) {
+		p = n
+		n = &n.child.entries[ctree_map_bit(key, n.child.diff)]
+	}
+
+	if ptr.count > 0 && n.key == key {
+		return n, p
+	}
+	return nil, nil
+}
+
+/*
+ * ctree_map_remove -- removes the key from the map, returning its value and
+ * whether it was found
+ */
+func ctree_map_remove(ptr *data, key int) (int, bool) {
+	leaf, parent := ctree_map_get_leaf(ptr, key)
+	if leaf == nil {
+		return 0, false
+	}
+	value := leaf.value
+
+	txn("undo") {
+		if parent == nil {
+			/* the root */
+			*leaf = entry_t{}
+		} else {
+			/*
+			 * In this situation:
+			 *	 parent ->[leaf][sibling]
+			 * the parent is replaced by the sibling
+			 */
+			n := parent.child
+			if n.entries[0].child == nil && n.entries[0].key == key {
+				*parent = n.entries[1]
+			} else {
+				*parent = n.entries[0]
+			}
+		}
+		ptr.count--
+	}
+	return value, true
+}
+
+/*
+ * ctree_map_get -- searches for a value of the key
+ */
+func ctree_map_get(ptr *data, key int) (int, bool) {
+	if e, _ := ctree_map_get_leaf(ptr, key); e != nil {
+		return e.value, true
+	}
+	return 0, false
+}
+
+/*
+ * ctree_map_lookup -- searches if a key exists
+ */
+func ctree_map_lookup(ptr *data, key int) bool {
+	e, _ := ctree_map_get_leaf(ptr, key)
+	return e != nil
+}
+
+/*
+ * ctree_map_is_empty -- checks whether the tree map is empty
+ */
+func ctree_map_is_empty(ptr *data) bool {
+	return ptr.count == 0
+}
+
+/*
+ * ctree_map_foreach_node -- (internal) recursively traverses tree node
+ */
+func ctree_map_foreach_node(e *entry_t, cb func(int, int) bool) bool {
+	if ctree_map_is_leaf(e) {
+		return cb(e.key, e.value)
+	}
+	for i := range e.child.entries {
+		if ctree_map_foreach_node(&e.child.entries[i], cb) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * ctree_map_foreach -- initiates recursive traversal, in the order of the
+ * keys as unsigned numbers; stops early when cb returns true
+ */
+func ctree_map_foreach(ptr *data, cb func(int, int) bool) bool {
+	if ptr.count == 0 {
+		return false
+	}
+	return ctree_map_foreach_node(&ptr.root, cb)
+}
+
+/*
+ * ctree_map_clear -- removes all pairs from the map
+ */
+func ctree_map_clear(ptr *data) {
+	txn("undo") {
+		ptr.root = entry_t{}
+		ptr.count = 0
+	}
+}
+
+/*
+ * ctree_map_first_key -- (internal) returns the key of the leftmost leaf
+ * below e
+ */
+func ctree_map_first_key(e *entry_t) int {
+	for !ctree_map_is_leaf(e) {
+		e = &e.child.entries[0]
+	}
+	return e.key
+}
+
+/*
+ * ctree_map_check_node -- (internal) verifies the subtree of e, whose
+ * critical bits must be below above; returns its number of leaves and its
+ * depth
+ */
+func ctree_map_check_node(e *entry_t, above int) (int, int, error) {
+	if ctree_map_is_leaf(e) {
+		return 1, 0, nil
+	}
+	n := e.child
+	if n.diff < 0 || n.diff >= above {
+		return 0, 0, fmt.Errorf("critical bit %d below critical bit %d", n.diff, above)
+	}
+	/*
+	 * the keys of either side agree above their own critical bits, so
+	 * comparing one key of each side is enough
+	 */
+	lhs, rhs := ctree_map_first_key(&n.entries[0]), ctree_map_first_key(&n.entries[1])
+	if ctree_map_bit(lhs, n.diff) != 0 || ctree_map_bit(rhs, n.diff) != 1 ||
+		ctree_map_find_crit_bit(lhs, rhs) != n.diff {
+		return 0, 0, fmt.Errorf("keys %d and %d do not split at bit %d",
+			lhs, rhs, n.diff)
+	}
+	leaves, depth := 0, 0
+	for i := range n.entries {
+		l, d, err := ctree_map_check_node(&n.entries[i], n.diff)
+		if err != nil {
+			return 0, 0, err
+		}
+		leaves += l
+		if d + 1 > depth {
+			depth = d + 1
+		}
+	}
+	return leaves, depth, nil
+}
+
+/*
+ * ctree_map_check -- verifies that the critical bits decrease on every path,
+ * that every node splits its keys at its critical bit and that count is right;
+ * returns the depth of the tree
+ */
+func ctree_map_check(ptr *data) (int, error) {
+	if ptr.count == 0 {
+		if ptr.root != (entry_t{}) {
+			return 0, errors.New("the empty map has a root")
+		}
+		return 0, nil
+	}
+	leaves, depth, err := ctree_map_check_node(&ptr.root, 64)
+	if err != nil {
+		return 0, err
+	}
+	if leaves != ptr.count {
+		return 0, fmt.Errorf("%d leaves, count is %d", leaves, ptr.count)
+	}
+	return depth, nil
+}
+
+/*
+ * str_insert -- ctree_map_insert wrapper which works on strings
+ */
+func str_insert(ptr *data, str string) {
+	var key int
+	if scan_args("insert", str, "%d", &key) {
+		if err := ctree_map_insert(ptr, key, 0); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- ctree_map_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key int
+	if scan_args("remove", str, "%d", &key) {
+		if _, ok := ctree_map_remove(ptr, key); !ok {
+			fmt.Println("no such value")
+		}
+	}
+}
+
+/*
+ * str_check -- ctree_map_lookup wrapper which works on strings
+ */
+func str_check(ptr *data, str string) {
+	var key int
+	if scan_args("check", str, "%d", &key) {
+		fmt.Println(ctree_map_lookup(ptr, key))
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := ctree_map_insert(ptr, rand.Int(), 0); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"i $value - insert $value",
+		"r $value - remove $value",
+		"c $value - check $value, returns 0/1",
+		"n $value - insert $value random values",
+		"p - print all values",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	ctree_map_foreach(ptr, func(key int, value int) bool {
+		fmt.Print(key, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if depth, err := ctree_map_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("entries:", ptr.count, "depth:", depth)
+	}
+}
+
+/*
+ * Run -- opens the map named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("ctree_map", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'c': str_check(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': ctree_map_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* number of slots of each table of a new map */
+const CUCKOO_MAP_MIN_SIZE int = 8
+
+/* displacements tried by an insert before the tables are grown */
+const CUCKOO_MAP_MAX_KICKS int = 32
+
+type entry_t struct {
+	key   int
+	value int
+	used  bool
+}
+
+/*
+ * data -- a key lives either in tables[0] at the slot given by seeds[0] or
+ * in tables[1] at the slot given by seeds[1]
+ */
+type data struct {
+	tables [2][]entry_t
+	seeds  [2]int
+	count  int
+	magic  int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x3C8E51F7A2D96B04
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.tables[0] = pmake([]entry_t, CUCKOO_MAP_MIN_SIZE)
+		ptr.tables[1] = pmake([]entry_t, CUCKOO_MAP_MIN_SIZE)
+		ptr.seeds = cuckoo_map_new_seeds()
+		ptr.count = 0
+		ptr.magic = magic
+	}
+}
+
+/*
+ * cuckoo_map_new_seeds -- (internal) draws a pair of distinct hash functions
+ */
+func cuckoo_map_new_seeds() [2]int {
+	seeds := [2]int{rand.Int(), rand.Int()}
+	for seeds[1] == seeds[0] {
+		seeds[1] = rand.Int()
+	}
+	return seeds
+}
+
+/*
+ * cuckoo_map_hash -- (internal) returns the slot of key in a table of n slots
+ * under the hash function picked by seed
+ */
+func cuckoo_map_hash(seed int, key int, n int) int {
+	h := uint64(key) ^ uint64(seed)
+	h = (h ^ h >> 30) * 0xBF58476D1CE4E5B9
+	h = (h ^ h >> 27) * 0x94D049BB133111EB
+	h ^= h >> 31
+	return int(h % uint64(n))
+}
+
+/*
+ * cuckoo_map_find -- (internal) returns the entry holding key, or nil
+ */
+func cuckoo_map_find(ptr *data, key int) *entry_t {
+	for t := 0; t < 2; t++ {
+		e := &ptr.tables[t][cuckoo_map_hash(ptr.seeds[t], key, len(ptr.tables[t]))]
+		if e.used && e.key == key {
+			return e
+		}
+	}
+	return nil
+}
+
+/*
+ * cuckoo_map_place -- (internal) stores e in the tables, moving the entry in
+ * its way to the other table, and that entry's victim back, and so on; gives
+ * up after CUCKOO_MAP_MAX_KICKS moves and returns the entry left without a
+ * slot, which is not always e
+ */
+func cuckoo_map_place(tables *[2][]entry_t, seeds [2]int, e entry_t) (entry_t, bool) {
+	t := 0
+	for kick := 0; kick < CUCKOO_MAP_MAX_KICKS; kick++ {
+		slot := &tables[t][cuckoo_map_hash(seeds[t], e.key, len(tables[t]))]
+		if !slot.used {
+			*slot = e
+			return entry_t{}, true
+		}
+		e, *slot = *slot, e
+		t = 1 - t
+	}
+	return e, false
+}
+
+/*
+ * cuckoo_map_grow -- (internal) moves the entries and extra, which has no
+ * slot, into tables of twice the size with new hash functions, doubling
+ * again for as long as some entry cannot be placed; must be called in a
+ * transaction
+ */
+func cuckoo_map_grow(ptr *data, extra entry_t) {
+	size := len(ptr.tables[0])
+	for {
+		size *= 2
+		var tables [2][]entry_t
+		for t := range tables {
+			tables[t] = pmake([]entry_t, size)
+		}
+		seeds := cuckoo_map_new_seeds()
+
+		_, ok := cuckoo_map_place(&tables, seeds, extra)
+		for t := 0; t < 2 && ok; t++ {
+			for i := range ptr.tables[t] {
+				if e := ptr.tables[t][i]; e.used {
+					if _, ok = cuckoo_map_place(&tables, seeds, e); !ok {
+						break
+					}
+				}
+			}
+		}
+		if ok {
+			ptr.tables = tables
+			ptr.seeds = seeds
+			return
+		}
+	}
+}
+
+/*
+ * cuckoo_map_insert -- inserts a key-value pair, replacing the value of the
+ * key if it is present; the entries displaced on the way are moved in the
+ * same transaction, so an insert which finds the pool too full to grow the
+ * tables returns ErrPoolFull and leaves every one of them in place
+ */
+func cuckoo_map_insert(ptr *data, key int, value int) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		if e := cuckoo_map_find(ptr, key); e != nil {
+			e.value = value
+			return nil
+		}
+		/* keep the load at most one half, where cuckoo tables rarely cycle */
+		if ptr.count + 1 > len(ptr.tables[0]) {
+			cuckoo_map_grow(ptr, entry_t{key, value, true})
+		} else if e, ok := cuckoo_map_place(&ptr.tables, ptr.seeds,
+			entry_t{key, value, true}); !ok {
+			cuckoo_map_grow(ptr, e)
+		}
+		ptr.count++
+	}
+	return nil
+}
+
+/*
+ * cuckoo_map_remove -- removes the key from the map, returning its value and
+ * whether it was found
+ */
+func cuckoo_map_remove(ptr *data, key int) (int, bool) {
+	e := cuckoo_map_find(ptr, key)
+	if e == nil {
+		return 0, false
+	}
+	value := e.value
+	txn("undo") {
+		*e = entry_t{}
+		ptr.count--
+	}
+	return value, true
+}
+
+/*
+ * cuckoo_map_get -- searches for the value of the key
+ */
+func cuckoo_map_get(ptr *data, key int) (int, bool) {
+	if e := cuckoo_map_find(ptr, key); e != nil {
+		return e.value, true
+	}
+	return 0, false
+}
+
+/*
+ * cuckoo_map_lookup -- checks if the key exists in the map
+ */
+func cuckoo_map_lookup(ptr *data, key int) bool {
+	return cuckoo_map_find(ptr, key) != nil
+}
+
+/*
+ * cuckoo_map_foreach -- calls cb for every pair, in no particular order,
+ * stopping early when cb returns true
+ */
+func cuckoo_map_foreach(ptr *data, cb func(int, int) bool) bool {
+	for t := 0; t < 2; t++ {
+		for _, e := range ptr.tables[t] {
+			if e.used && cb(e.key, e.value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * cuckoo_map_clear -- removes all pairs from the map and shrinks it back to
+ * its initial size
+ */
+func cuckoo_map_clear(ptr *data) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		var tables [2][]entry_t
+		for t := range tables {
+			tables[t] = pmake([]entry_t, CUCKOO_MAP_MIN_SIZE)
+		}
+		ptr.tables = tables
+		ptr.seeds = cuckoo_map_new_seeds()
+		ptr.count = 0
+	}
+	return nil
+}
+
+/*
+ * cuckoo_map_check -- verifies that every entry sits in its slot for the
+ * table it is in, that no key is stored twice and that count is right
+ */
+func cuckoo_map_check(ptr *data) error {
+	if len(ptr.tables[0]) != len(ptr.tables[1]) {
+		return fmt.Errorf("tables of %d and %d slots",
+			len(ptr.tables[0]), len(ptr.tables[1]))
+	}
+	n := 0
+	for t := 0; t < 2; t++ {
+		for i, e := range ptr.tables[t] {
+			if !e.used {
+				continue
+			}
+			if h := cuckoo_map_hash(ptr.seeds[t], e.key, len(ptr.tables[t])); h != i {
+				return fmt.Errorf("key %d in slot %d of table %d, belongs in %d",
+					e.key, i, t, h)
+			}
+			if t == 1 {
+				o := ptr.tables[0][cuckoo_map_hash(ptr.seeds[0], e.key,
+					len(ptr.tables[0]))]
+				if o.used && o.key == e.key {
+					return fmt.Errorf("key %d is in both tables", e.key)
+				}
+			}
+			n++
+		}
+	}
+	if n != ptr.count {
+		return fmt.Errorf("%d entries, count is %d", n, ptr.count)
+	}
+	return nil
+}
+
+/*
+ * str_insert -- cuckoo_map_insert wrapper which works on strings
+ */
+func str_insert(ptr *data, str string) {
+	var key int
+	if scan_args("insert", str, "%d", &key) {
+		if err := cuckoo_map_insert(ptr, key, 0); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- cuckoo_map_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key int
+	if scan_args("remove", str, "%d", &key) {
+		if _, ok := cuckoo_map_remove(ptr, key); !ok {
+			fmt.Println("no such value")
+		}
+	}
+}
+
+/*
+ * str_check -- cuckoo_map_lookup wrapper which works on strings
+ */
+func str_check(ptr *data, str string) {
+	var key int
+	if scan_args("check", str, "%d", &key) {
+		fmt.Println(cuckoo_map_lookup(ptr, key))
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := cuckoo_map_insert(ptr, rand.Int(), 0); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+/*
+ * str_clear -- cuckoo_map_clear wrapper which reports its error
+ */
+func str_clear(ptr *data) {
+	if err := cuckoo_map_clear(ptr); err != nil {
+		fmt.Println("clear:", err)
+	}
+}
+
+func help() {
+	print_help(
+		"i $value - insert $value",
+		"r $value - remove $value",
+		"c $value - check $value, returns 0/1",
+		"n $value - insert $value random values",
+		"p - print all values",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	cuckoo_map_foreach(ptr, func(key int, value int) bool {
+		fmt.Print(key, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if err := cuckoo_map_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		slots := 2 * len(ptr.tables[0])
+		fmt.Printf("entries: %d slots: %d load: %.2f\n", ptr.count, slots,
+			float64(ptr.count) / float64(slots))
+	}
+}
+
+/*
+ * Run -- opens the map named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("cuckoo_map", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'c': str_check(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
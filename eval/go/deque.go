@@ -0,0 +1,398 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* number of values held by a chunk */
+const DEQUE_CHUNK int = 16
+
+type chunk_t struct {
+	values [DEQUE_CHUNK]int
+	prev   *chunk_t
+	next   *chunk_t
+}
+
+/*
+ * data -- the values run from values[head_pos] of the head chunk up to, but
+ * not including, values[tail_pos] of the tail chunk; an empty deque has no
+ * chunks
+ */
+type data struct {
+	head     *chunk_t
+	tail     *chunk_t
+	head_pos int
+	tail_pos int
+	count    int
+	magic    int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x0E93A7C5B1F6482D
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.head = nil
+		ptr.tail = nil
+		ptr.head_pos = 0
+		ptr.tail_pos = 0
+		ptr.count = 0
+		ptr.magic = magic
+	}
+}
+
+/*
+ * deque_first_chunk -- (internal) makes c the only chunk, with room on either
+ * side of its middle
+ */
+func deque_first_chunk(ptr *data, c *chunk_t) {
+	ptr.head = c
+	ptr.tail = c
+	ptr.head_pos = DEQUE_CHUNK / 2
+	ptr.tail_pos = DEQUE_CHUNK / 2
+}
+
+/*
+ * deque_push_front -- adds value before the first one, starting a new chunk
+ * when the head chunk has no room left
+ */
+func deque_push_front(ptr *data, value int) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		if ptr.head == nil || ptr.head_pos == 0 {
+			c := pnew(chunk_t)
+			if ptr.head == nil {
+				deque_first_chunk(ptr, c)
+			} else {
+				c.next = ptr.head
+				ptr.head.prev = c
+				ptr.head = c
+				ptr.head_pos = DEQUE_CHUNK
+			}
+		}
+		ptr.head_pos--
+		ptr.head.values[ptr.head_pos] = value
+		ptr.count++
+	}
+	return nil
+}
+
+/*
+ * deque_push_back -- adds value after the last one, starting a new chunk when
+ * the tail chunk has no room left
+ */
+func deque_push_back(ptr *data, value int) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		if ptr.tail == nil || ptr.tail_pos == DEQUE_CHUNK {
+			c := pnew(chunk_t)
+			if ptr.tail == nil {
+				deque_first_chunk(ptr, c)
+			} else {
+				c.prev = ptr.tail
+				ptr.tail.next = c
+				ptr.tail = c
+				ptr.tail_pos = 0
+			}
+		}
+		ptr.tail.values[ptr.tail_pos] = value
+		ptr.tail_pos++
+		ptr.count++
+	}
+	return nil
+}
+
+/*
+ * deque_drop_last -- (internal) forgets the chunks once the last value is
+ * gone
+ */
+func deque_drop_last(ptr *data) bool {
+	if ptr.count > 0 {
+		return false
+	}
+	ptr.head = nil
+	ptr.tail = nil
+	ptr.head_pos = 0
+	ptr.tail_pos = 0
+	return true
+}
+
+/*
+ * deque_pop_front -- removes the first value, returning it and whether the
+ * deque had one; the head chunk is unlinked once it is used up
+ */
+func deque_pop_front(ptr *data) (int, bool) {
+	if ptr.count == 0 {
+		return 0, false
+	}
+	value := ptr.head.values[ptr.head_pos]
+	txn("undo") {
+		ptr.head_pos++
+		ptr.count--
+		if !deque_drop_last(ptr) && ptr.head_pos == DEQUE_CHUNK {
+			ptr.head = ptr.head.next
+			ptr.head.prev = nil
+			ptr.head_pos = 0
+		}
+	}
+	return value, true
+}
+
+/*
+ * deque_pop_back -- removes the last value, returning it and whether the
+ * deque had one; the tail chunk is unlinked once it is used up
+ */
+func deque_pop_back(ptr *data) (int, bool) {
+	if ptr.count == 0 {
+		return 0, false
+	}
+	value := ptr.tail.values[ptr.tail_pos - 1]
+	txn("undo") {
+		ptr.tail_pos--
+		ptr.count--
+		if !deque_drop_last(ptr) && ptr.tail_pos == 0 {
+			ptr.tail = ptr.tail.prev
+			ptr.tail.next = nil
+			ptr.tail_pos = DEQUE_CHUNK
+		}
+	}
+	return value, true
+}
+
+/*
+ * deque_chunk_range -- (internal) returns the positions of the values held by
+ * chunk c
+ */
+func deque_chunk_range(ptr *data, c *chunk_t) (int, int) {
+	from, to := 0, DEQUE_CHUNK
+	if c == ptr.head {
+		from = ptr.head_pos
+	}
+	if c == ptr.tail {
+		to = ptr.tail_pos
+	}
+	return from, to
+}
+
+/*
+ * deque_foreach -- calls cb for every value from the front to the back,
+ * stopping early when cb returns true
+ */
+func deque_foreach(ptr *data, cb func(int) bool) bool {
+	for c := ptr.head; c != nil; c = c.next {
+		from, to := deque_chunk_range(ptr, c)
+		for i := from; i < to; i++ {
+			if cb(c.values[i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * deque_foreach_reverse -- calls cb for every value from the back to the
+ * front, stopping early when cb returns true
+ */
+func deque_foreach_reverse(ptr *data, cb func(int) bool) bool {
+	for c := ptr.tail; c != nil; c = c.prev {
+		from, to := deque_chunk_range(ptr, c)
+		for i := to - 1; i >= from; i-- {
+			if cb(c.values[i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * deque_clear -- removes all values from the deque
+ */
+func deque_clear(ptr *data) {
+	txn("undo") {
+		ptr.count = 0
+		deque_drop_last(ptr)
+	}
+}
+
+/*
+ * deque_check -- verifies the links between the chunks, that no chunk is
+ * left empty and that count is right; returns the number of chunks
+ */
+func deque_check(ptr *data) (int, error) {
+	if ptr.head == nil || ptr.tail == nil {
+		if ptr.head != ptr.tail || ptr.count != 0 {
+			return 0, errors.New("an empty deque has chunks or values")
+		}
+		return 0, nil
+	}
+	var prev *chunk_t = nil
+	chunks, values := 0, 0
+	for c := ptr.head; c != nil; c = c.next {
+		if c.prev != prev {
+			return 0, fmt.Errorf("chunk %d does not link back to chunk %d",
+				chunks, chunks - 1)
+		}
+		from, to := deque_chunk_range(ptr, c)
+		if from >= to {
+			return 0, fmt.Errorf("chunk %d holds no values", chunks)
+		}
+		values += to - from
+		prev = c
+		chunks++
+	}
+	if ptr.tail != prev {
+		return 0, errors.New("the tail is not the last chunk")
+	}
+	if values != ptr.count {
+		return 0, fmt.Errorf("%d values, count is %d", values, ptr.count)
+	}
+	return chunks, nil
+}
+
+/*
+ * str_push -- deque_push_front or deque_push_back wrapper which works on
+ * strings
+ */
+func str_push(ptr *data, str string, front bool) {
+	var value int
+	if scan_args("push", str, "%d", &value) {
+		push := deque_push_back
+		if front {
+			push = deque_push_front
+		}
+		if err := push(ptr, value); err != nil {
+			fmt.Println("push:", err)
+		}
+	}
+}
+
+/*
+ * str_pop -- deque_pop_front or deque_pop_back wrapper which prints the value
+ */
+func str_pop(ptr *data, front bool) {
+	pop := deque_pop_back
+	if front {
+		pop = deque_pop_front
+	}
+	if value, ok := pop(ptr); ok {
+		fmt.Println(value)
+	} else {
+		fmt.Println("deque is empty")
+	}
+}
+
+/*
+ * str_insert_random -- appends specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := deque_push_back(ptr, rand.Int()); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"f $value - push $value at the front",
+		"b $value - push $value at the back",
+		"F - pop the front",
+		"B - pop the back",
+		"n $value - append $value random values",
+		"p - print all values from the front",
+		"P - print all values from the back",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_value(value int) bool {
+	fmt.Print(value, " ")
+	return false
+}
+
+func print_all(ptr *data, reverse bool) {
+	if reverse {
+		deque_foreach_reverse(ptr, print_value)
+	} else {
+		deque_foreach(ptr, print_value)
+	}
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if chunks, err := deque_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("values:", ptr.count, "chunks:", chunks)
+	}
+}
+
+/*
+ * Run -- opens the deque named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("deque", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'f': str_push(ptr, buf[1:], true)
+			case 'b': str_push(ptr, buf[1:], false)
+			case 'F': str_pop(ptr, true)
+			case 'B': str_pop(ptr, false)
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr, false)
+			case 'P': print_all(ptr, true)
+			case 'd': print_debug(ptr)
+			case 'x': deque_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
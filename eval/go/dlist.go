@@ -0,0 +1,370 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+type node_t struct {
+	value int
+	prev  *node_t
+	next  *node_t
+}
+
+type data struct {
+	head  *node_t
+	tail  *node_t
+	count int
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x2C6A9E05D3B78F41
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.head = nil
+		ptr.tail = nil
+		ptr.count = 0
+		ptr.magic = magic
+	}
+}
+
+/*
+ * dlist_new_node -- (internal) allocates a node_t holding value
+ */
+func dlist_new_node(value int) *node_t {
+	n := pnew(node_t)
+	n.value = value
+	return n
+}
+
+/*
+ * dlist_push_front -- adds value at the head of the list
+ */
+func dlist_push_front(ptr *data, value int) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		n := dlist_new_node(value)
+		n.next = ptr.head
+		if ptr.head != nil {
+			ptr.head.prev = n
+		} else {
+			ptr.tail = n
+		}
+		ptr.head = n
+		ptr.count++
+	}
+	return nil
+}
+
+/*
+ * dlist_push_back -- adds value at the tail of the list
+ */
+func dlist_push_back(ptr *data, value int) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		n := dlist_new_node(value)
+		n.prev = ptr.tail
+		if ptr.tail != nil {
+			ptr.tail.next = n
+		} else {
+			ptr.head = n
+		}
+		ptr.tail = n
+		ptr.count++
+	}
+	return nil
+}
+
+/*
+ * dlist_unlink -- (internal) takes n out of the list
+ */
+func dlist_unlink(ptr *data, n *node_t) {
+	if n.prev != nil {
+		n.prev.next = n.next
+	} else {
+		ptr.head = n.next
+	}
+	if n.next != nil {
+		n.next.prev = n.prev
+	} else {
+		ptr.tail = n.prev
+	}
+	ptr.count--
+}
+
+/*
+ * dlist_find -- (internal) returns the first node_t holding value, or nil
+ */
+func dlist_find(ptr *data, value int) *node_t {
+	n := ptr.head
+	for n != nil && n.value != value {
+		n = n.next
+	}
+	return n
+}
+
+/*
+ * dlist_remove -- removes the node_t nearest to the head which holds value,
+ * returning whether there was one
+ */
+func dlist_remove(ptr *data, value int) bool {
+	n := dlist_find(ptr, value)
+	if n == nil {
+		return false
+	}
+	txn("undo") {
+		dlist_unlink(ptr, n)
+	}
+	return true
+}
+
+/*
+ * dlist_pop_front -- removes the head of the list, returning its value and
+ * whether the list had one
+ */
+func dlist_pop_front(ptr *data) (int, bool) {
+	n := ptr.head
+	if n == nil {
+		return 0, false
+	}
+	txn("undo") {
+		dlist_unlink(ptr, n)
+	}
+	return n.value, true
+}
+
+/*
+ * dlist_pop_back -- removes the tail of the list, returning its value and
+ * whether the list had one
+ */
+func dlist_pop_back(ptr *data) (int, bool) {
+	n := ptr.tail
+	if n == nil {
+		return 0, false
+	}
+	txn("undo") {
+		dlist_unlink(ptr, n)
+	}
+	return n.value, true
+}
+
+/*
+ * dlist_foreach -- calls cb for every value from the head to the tail,
+ * stopping early when cb returns true
+ */
+func dlist_foreach(ptr *data, cb func(int) bool) bool {
+	for n := ptr.head; n != nil; n = n.next {
+		if cb(n.value) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * dlist_foreach_reverse -- calls cb for every value from the tail to the
+ * head, stopping early when cb returns true
+ */
+func dlist_foreach_reverse(ptr *data, cb func(int) bool) bool {
+	for n := ptr.tail; n != nil; n = n.prev {
+		if cb(n.value) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * dlist_clear -- removes all values from the list
+ */
+func dlist_clear(ptr *data) {
+	txn("undo") {
+		ptr.head = nil
+		ptr.tail = nil
+		ptr.count = 0
+	}
+}
+
+/*
+ * dlist_check -- verifies that every prev link mirrors a next link, that the
+ * tail ends the list and that count is right
+ */
+func dlist_check(ptr *data) error {
+	var prev *node_t = nil
+	n := 0
+	for c := ptr.head; c != nil; c = c.next {
+		if c.prev != prev {
+			return fmt.Errorf("node %d does not link back to node %d", n, n - 1)
+		}
+		prev = c
+		n++
+	}
+	if ptr.tail != prev {
+		return errors.New("the tail is not the last node")
+	}
+	if n != ptr.count {
+		return fmt.Errorf("%d nodes, count is %d", n, ptr.count)
+	}
+	return nil
+}
+
+/*
+ * str_push -- dlist_push_front or dlist_push_back wrapper which works on
+ * strings
+ */
+func str_push(ptr *data, str string, front bool) {
+	var value int
+	if scan_args("push", str, "%d", &value) {
+		push := dlist_push_back
+		if front {
+			push = dlist_push_front
+		}
+		if err := push(ptr, value); err != nil {
+			fmt.Println("push:", err)
+		}
+	}
+}
+
+/*
+ * str_pop -- dlist_pop_front or dlist_pop_back wrapper which prints the value
+ */
+func str_pop(ptr *data, front bool) {
+	pop := dlist_pop_back
+	if front {
+		pop = dlist_pop_front
+	}
+	if value, ok := pop(ptr); ok {
+		fmt.Println(value)
+	} else {
+		fmt.Println("list is empty")
+	}
+}
+
+/*
+ * str_remove -- dlist_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var value int
+	if scan_args("remove", str, "%d", &value) {
+		if !dlist_remove(ptr, value) {
+			fmt.Println("no such value")
+		}
+	}
+}
+
+/*
+ * str_insert_random -- appends specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := dlist_push_back(ptr, rand.Int()); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"f $value - push $value at the head",
+		"b $value - push $value at the tail",
+		"F - pop the head",
+		"B - pop the tail",
+		"r $value - remove the first $value",
+		"n $value - append $value random values",
+		"p - print all values from the head",
+		"P - print all values from the tail",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_value(value int) bool {
+	fmt.Print(value, " ")
+	return false
+}
+
+func print_all(ptr *data, reverse bool) {
+	if reverse {
+		dlist_foreach_reverse(ptr, print_value)
+	} else {
+		dlist_foreach(ptr, print_value)
+	}
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if err := dlist_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("nodes:", ptr.count)
+	}
+}
+
+/*
+ * Run -- opens the list named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("dlist", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'f': str_push(ptr, buf[1:], true)
+			case 'b': str_push(ptr, buf[1:], false)
+			case 'F': str_pop(ptr, true)
+			case 'B': str_pop(ptr, false)
+			case 'r': str_remove(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr, false)
+			case 'P': print_all(ptr, true)
+			case 'd': print_debug(ptr)
+			case 'x': dlist_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The variables passing the steps of in_pool to the processes running them.
+const (
+	durable_pool_env = "CORUNDUM_DURABLE_POOL"
+	durable_step_env = "CORUNDUM_DURABLE_STEP"
+	durable_out_env  = "CORUNDUM_DURABLE_OUT"
+)
+
+// program_env marks the processes started by test_program.
+const program_env = "CORUNDUM_TEST_PROGRAM"
+
+// test_program returns a command running the program under test with args:
+// the test binary started again, which TestMain turns into the program by
+// calling main once is_test_program reports it.
+func test_program(args ...string) (*exec.Cmd, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Env = append(os.Environ(), program_env + "=1")
+	return cmd, nil
+}
+
+// exit_code returns the exit status of a process started by test_program,
+// given the error its Run, Output or CombinedOutput returned.
+func exit_code(t *testing.T, err error) int {
+	t.Helper()
+	if err == nil {
+		return 0
+	}
+	exit, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatal(err)
+	}
+	return exit.ExitCode()
+}
+
+// is_test_program reports whether the process was started by test_program.
+func is_test_program() bool {
+	return os.Getenv(program_env) != ""
+}
+
+// durable_pool returns the pool a step run by in_pool opens, or "" in the
+// process running the tests; TestMain opens it instead of its own.
+func durable_pool() string {
+	return os.Getenv(durable_pool_env)
+}
+
+// durable_step returns the step a process started by in_pool runs, or "" in
+// the process running the tests.
+func durable_step() string {
+	return os.Getenv(durable_step_env)
+}
+
+// step_done hands the result of a step back to in_pool.
+func step_done(t *testing.T, lines []string) {
+	t.Helper()
+	out := strings.Join(lines, "\n")
+	if err := ioutil.WriteFile(os.Getenv(durable_out_env), []byte(out), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// in_pool runs the test again in a process of its own, started through
+// os.Executable, which opens pool in TestMain and runs step; it returns the
+// lines the step passes to step_done.
+func in_pool(t *testing.T, pool string, step string) []string {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := pool + "." + step + ".out"
+	defer os.Remove(out)
+	cmd := exec.Command(exe, "-test.run", "^" + t.Name() + "$")
+	cmd.Env = append(os.Environ(), durable_pool_env + "=" + pool,
+		durable_step_env + "=" + step, durable_out_env + "=" + out)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s: %v\n%s", step, err, output)
+	}
+	content, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(string(content), "\n")
+}
+
+// AssertDurable fails the test unless what build writes to a pool is found
+// again once the pool is closed and reopened. build makes the structure as
+// the root object of a new pool and returns its content, and verify returns
+// the content of the root object of the reopened pool.
+//
+// go-pmem maps a single pool per process and cannot unmap it, so each step
+// runs in a process of its own started by in_pool: the one running build
+// closes the pool by exiting, and the one running verify reopens it with
+// pmem.Init in TestMain and pmem.Get.
+func AssertDurable(t *testing.T, build func() []string, verify func() []string) {
+	t.Helper()
+	switch durable_step() {
+	case "build":
+		step_done(t, build())
+		return
+	case "verify":
+		step_done(t, verify())
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "durable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pool := filepath.Join(dir, "durable.pool")
+	want := in_pool(t, pool, "build")
+	if got := in_pool(t, pool, "verify"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("reopened pool holds %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* number of vertices a new graph has room for */
+const GRAPH_MIN_VERTICES int = 16
+
+/*
+ * vertex_t -- the targets of the edges leaving the vertex are adj[:degree],
+ * in the order they were added; the length of adj is its capacity
+ */
+type vertex_t struct {
+	adj    []int
+	degree int
+}
+
+/*
+ * data -- the vertices are vertices[:n], named by their position; edges
+ * counts the directed edges of all of them
+ */
+type data struct {
+	vertices []vertex_t
+	n        int
+	edges    int
+	magic    int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x0C5B9E27F4A18D63
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.vertices = pmake([]vertex_t, GRAPH_MIN_VERTICES)
+		ptr.n = 0
+		ptr.edges = 0
+		ptr.magic = magic
+	}
+}
+
+var (
+	ErrNoVertex  = errors.New("no such vertex")
+	ErrDuplicate = errors.New("edge already exists")
+)
+
+/*
+ * graph_edge_pos -- (internal) returns the position of v among the targets of
+ * u, or -1
+ */
+func graph_edge_pos(ptr *data, u int, v int) int {
+	for i, t := range ptr.vertices[u].adj[:ptr.vertices[u].degree] {
+		if t == v {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+ * graph_valid -- (internal) checks if v names a vertex
+ */
+func graph_valid(ptr *data, v int) bool {
+	return v >= 0 && v < ptr.n
+}
+
+/*
+ * graph_add_vertex -- adds a vertex without edges, returning its name; the
+ * vertex table is doubled first if it is full
+ */
+func graph_add_vertex(ptr *data) (v int, err error) {
+	v = ptr.n
+	defer pool_full(&err)
+	txn("undo") {
+		if ptr.n == len(ptr.vertices) {
+			vertices := pmake([]vertex_t, 2 * len(ptr.vertices))
+			copy(vertices, ptr.vertices)
+			ptr.vertices = vertices
+		}
+		ptr.vertices[v] = vertex_t{}
+		ptr.n++
+	}
+	return v, nil
+}
+
+/*
+ * graph_add_edge -- adds the edge from u to v, doubling the adjacency slice
+ * of u first if it is full
+ */
+func graph_add_edge(ptr *data, u int, v int) (err error) {
+	if !graph_valid(ptr, u) || !graph_valid(ptr, v) {
+		return ErrNoVertex
+	}
+	if graph_edge_pos(ptr, u, v) >= 0 {
+		return ErrDuplicate
+	}
+	defer pool_full(&err)
+	txn("undo") {
+		vx := &ptr.vertices[u]
+		if vx.degree == len(vx.adj) {
+			size := 2 * len(vx.adj)
+			if size == 0 {
+				size = 4
+			}
+			adj := pmake([]int, size)
+			copy(adj, vx.adj)
+			vx.adj = adj
+		}
+		vx.adj[vx.degree] = v
+		vx.degree++
+		ptr.edges++
+	}
+	return nil
+}
+
+/*
+ * graph_remove_edge -- removes the edge from u to v, returning whether there
+ * was one; the last target of u takes its place
+ */
+func graph_remove_edge(ptr *data, u int, v int) bool {
+	if !graph_valid(ptr, u) {
+		return false
+	}
+	i := graph_edge_pos(ptr, u, v)
+	if i < 0 {
+		return false
+	}
+	txn("undo") {
+		vx := &ptr.vertices[u]
+		vx.degree--
+		vx.adj[i] = vx.adj[vx.degree]
+		ptr.edges--
+	}
+	return true
+}
+
+/*
+ * graph_bfs -- calls cb with every vertex reachable from src and its distance
+ * in edges, in breadth-first order
+ */
+func graph_bfs(ptr *data, src int, cb func(int, int)) error {
+	if !graph_valid(ptr, src) {
+		return ErrNoVertex
+	}
+	dist := make([]int, ptr.n)
+	for i := range dist {
+		dist[i] = -1
+	}
+	dist[src] = 0
+	queue := []int{src}
+	for len(queue) > 0 {
+		u := queue[0]
+		queue = queue[1:]
+		cb(u, dist[u])
+		for _, v := range ptr.vertices[u].adj[:ptr.vertices[u].degree] {
+			if dist[v] == -1 {
+				dist[v] = dist[u] + 1
+				queue = append(queue, v)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * graph_clear -- removes all vertices and edges
+ */
+func graph_clear(ptr *data) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		vertices := pmake([]vertex_t, GRAPH_MIN_VERTICES)
+		ptr.vertices = vertices
+		ptr.n = 0
+		ptr.edges = 0
+	}
+	return nil
+}
+
+/*
+ * graph_check -- verifies that every edge leads to a vertex, that no edge is
+ * stored twice and that edges is right
+ */
+func graph_check(ptr *data) error {
+	if ptr.n < 0 || ptr.n > len(ptr.vertices) {
+		return fmt.Errorf("%d vertices in a table of %d", ptr.n, len(ptr.vertices))
+	}
+	edges := 0
+	for u, vx := range ptr.vertices[:ptr.n] {
+		if vx.degree < 0 || vx.degree > len(vx.adj) {
+			return fmt.Errorf("vertex %d has degree %d and room for %d",
+				u, vx.degree, len(vx.adj))
+		}
+		seen := make(map[int]bool)
+		for _, v := range vx.adj[:vx.degree] {
+			if !graph_valid(ptr, v) {
+				return fmt.Errorf("edge from %d to missing vertex %d", u, v)
+			}
+			if seen[v] {
+				return fmt.Errorf("edge from %d to %d is stored twice", u, v)
+			}
+			seen[v] = true
+		}
+		edges += vx.degree
+	}
+	if edges != ptr.edges {
+		return fmt.Errorf("%d edges, count is %d", edges, ptr.edges)
+	}
+	return nil
+}
+
+/*
+ * str_add_vertex -- adds a vertex and prints its name
+ */
+func str_add_vertex(ptr *data) {
+	if v, err := graph_add_vertex(ptr); err == nil {
+		fmt.Println(v)
+	} else {
+		fmt.Println("vertex:", err)
+	}
+}
+
+/*
+ * str_add_edge -- graph_add_edge wrapper which works on strings
+ */
+func str_add_edge(ptr *data, str string) {
+	var u, v int
+	if scan_args("edge", str, "%d %d", &u, &v) {
+		if err := graph_add_edge(ptr, u, v); err != nil {
+			fmt.Println("edge:", err)
+		}
+	}
+}
+
+/*
+ * str_remove_edge -- graph_remove_edge wrapper which works on strings
+ */
+func str_remove_edge(ptr *data, str string) {
+	var u, v int
+	if scan_args("remove", str, "%d %d", &u, &v) {
+		if !graph_remove_edge(ptr, u, v) {
+			fmt.Println("no such edge")
+		}
+	}
+}
+
+/*
+ * str_bfs -- prints the vertices reachable from the one given as a string,
+ * with their distance
+ */
+func str_bfs(ptr *data, str string) {
+	var src int
+	if scan_args("bfs", str, "%d", &src) {
+		err := graph_bfs(ptr, src, func(v int, dist int) {
+			fmt.Printf("%d:%d ", v, dist)
+		})
+		if err != nil {
+			fmt.Println("bfs:", err)
+		} else {
+			fmt.Println()
+		}
+	}
+}
+
+/*
+ * str_clear -- graph_clear wrapper which reports its error
+ */
+func str_clear(ptr *data) {
+	if err := graph_clear(ptr); err != nil {
+		fmt.Println("clear:", err)
+	}
+}
+
+/*
+ * str_insert_random -- adds specified (as string) number of random edges
+ * between the existing vertices
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if !scan_args("random insert", str, "%d", &val) {
+		return
+	}
+	if ptr.n == 0 {
+		fmt.Println("random insert: the graph has no vertices")
+		return
+	}
+	for i := 0; i < val; i++ {
+		err := graph_add_edge(ptr, rand.Intn(ptr.n), rand.Intn(ptr.n))
+		if err != nil && err != ErrDuplicate {
+			fmt.Println("random insert:", err)
+			break
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"v - add a vertex, print its number",
+		"e $from $to - add the edge from $from to $to",
+		"r $from $to - remove the edge from $from to $to",
+		"b $vertex - print the vertices reachable from $vertex with their distance",
+		"n $value - add $value random edges",
+		"p - print the edges of every vertex",
+		"d - print debug info",
+		"x - remove all vertices",
+	)
+}
+
+func print_all(ptr *data) {
+	for u, vx := range ptr.vertices[:ptr.n] {
+		fmt.Print(u, ":")
+		for _, v := range vx.adj[:vx.degree] {
+			fmt.Print(" ", v)
+		}
+		fmt.Println()
+	}
+}
+
+func print_debug(ptr *data) {
+	if err := graph_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("vertices:", ptr.n, "edges:", ptr.edges)
+	}
+}
+
+/*
+ * Run -- opens the graph named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("graph", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'v': str_add_vertex(ptr)
+			case 'e': str_add_edge(ptr, buf[1:])
+			case 'r': str_remove_edge(ptr, buf[1:])
+			case 'b': str_bfs(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
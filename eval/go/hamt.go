@@ -0,0 +1,468 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* bits of the hash consumed by each level, for 32-way branching */
+const HAMT_BITS uint = 5
+const HAMT_MASK uint64 = 1 << HAMT_BITS - 1
+
+/*
+ * entry_t -- a pair, or a link to the node of the next level when child is
+ * not nil
+ */
+type entry_t struct {
+	key   int
+	value int
+	child *node_t
+}
+
+/*
+ * node_t -- bit i of bitmap is set if the node has an entry for the 5-bit
+ * digit i of the hash; the entries are kept in digit order, with no room for
+ * the digits left out
+ */
+type node_t struct {
+	bitmap  uint32
+	entries []entry_t
+}
+
+type data struct {
+	root  *node_t
+	count int
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x71C3E5A9B28D4F06
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.root = pnew(node_t)
+		ptr.count = 0
+		ptr.magic = magic
+	}
+}
+
+/*
+ * hamt_hash -- (internal) returns the hash of key, whose digits pick the
+ * entries from the root down; the mix is a bijection, so two keys never
+ * share a whole hash and the trie is at most 13 levels deep
+ */
+func hamt_hash(key int) uint64 {
+	h := uint64(key)
+	h = (h ^ h >> 30) * 0xBF58476D1CE4E5B9
+	h = (h ^ h >> 27) * 0x94D049BB133111EB
+	return h ^ h >> 31
+}
+
+/*
+ * hamt_slot -- (internal) returns the bit of the digit of h at shift and the
+ * position its entry has, or would have, in the node
+ */
+func hamt_slot(n *node_t, h uint64, shift uint) (uint32, int) {
+	bit := uint32(1) << (h >> shift & HAMT_MASK)
+	return bit, bits.OnesCount32(n.bitmap & (bit - 1))
+}
+
+/*
+ * hamt_new_node -- (internal) allocates a node
+ */
+func hamt_new_node() *node_t {
+	return pnew(node_t)
+}
+
+/*
+ * hamt_resize -- (internal) replaces the entries of the node with a copy one
+ * longer, with a zero entry at i, or one shorter, without the entry at i
+ */
+func hamt_resize(n *node_t, i int, grow bool) {
+	size := len(n.entries) - 1
+	if grow {
+		size += 2
+	}
+	var entries []entry_t
+	if size > 0 {
+		entries = pmake([]entry_t, size)
+	}
+	copy(entries, n.entries[:i])
+	if grow {
+		copy(entries[i + 1:], n.entries[i:])
+	} else {
+		copy(entries[i:], n.entries[i + 1:])
+	}
+	n.entries = entries
+}
+
+/*
+ * hamt_insert_in -- (internal) inserts the pair below the node at the level
+ * of shift; returns whether the key is new
+ */
+func hamt_insert_in(n *node_t, h uint64, shift uint, key int, value int) bool {
+	bit, i := hamt_slot(n, h, shift)
+	if n.bitmap & bit == 0 {
+		hamt_resize(n, i, true)
+		n.entries[i] = entry_t{key, value, nil}
+		n.bitmap |= bit
+		return true
+	}
+	e := &n.entries[i]
+	if e.child != nil {
+		return hamt_insert_in(e.child, h, shift + HAMT_BITS, key, value)
+	}
+	if e.key == key {
+		e.value = value
+		return false
+	}
+	/* two keys share the digit, push both down a level */
+	child := hamt_new_node()
+	hamt_insert_in(child, hamt_hash(e.key), shift + HAMT_BITS, e.key, e.value)
+	hamt_insert_in(child, h, shift + HAMT_BITS, key, value)
+	*e = entry_t{child: child}
+	return true
+}
+
+/*
+ * hamt_insert -- inserts a key-value pair, replacing the value of the key if
+ * it is present; the nodes on the path are copied to their new size in the
+ * same transaction, which a full pool rolls back with ErrPoolFull
+ */
+func hamt_insert(ptr *data, key int, value int) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		if hamt_insert_in(ptr.root, hamt_hash(key), 0, key, value) {
+			ptr.count++
+		}
+	}
+	return nil
+}
+
+/*
+ * hamt_remove_in -- (internal) removes the key below the node at the level of
+ * shift, returning its value and whether it was found; a node left with a
+ * single pair is folded into the entry of its parent
+ */
+func hamt_remove_in(n *node_t, h uint64, shift uint, key int) (int, bool) {
+	bit, i := hamt_slot(n, h, shift)
+	if n.bitmap & bit == 0 {
+		return 0, false
+	}
+	e := &n.entries[i]
+	if e.child == nil {
+		if e.key != key {
+			return 0, false
+		}
+		value := e.value
+		hamt_resize(n, i, false)
+		n.bitmap &^= bit
+		return value, true
+	}
+	value, ok := hamt_remove_in(e.child, h, shift + HAMT_BITS, key)
+	if ok && len(e.child.entries) == 1 && e.child.entries[0].child == nil {
+		*e = e.child.entries[0]
+	}
+	return value, ok
+}
+
+/*
+ * hamt_remove -- removes the key from the map, returning its value and
+ * whether it was found
+ */
+func hamt_remove(ptr *data, key int) (value int, ok bool) {
+	var err error
+	defer func() {
+		if err != nil {
+			/* shrinking a node failed, nothing was removed */
+			value, ok = 0, false
+		}
+	}()
+	defer pool_full(&err)
+
+	h := hamt_hash(key)
+	if !hamt_lookup(ptr, key) {
+		return 0, false
+	}
+	txn("undo") {
+		value, ok = hamt_remove_in(ptr.root, h, 0, key)
+		ptr.count--
+	}
+	return value, ok
+}
+
+/*
+ * hamt_get -- searches for the value of the key, following one entry per
+ * level
+ */
+func hamt_get(ptr *data, key int) (int, bool) {
+	h := hamt_hash(key)
+	n := ptr.root
+	for shift := uint(0); ; shift += HAMT_BITS {
+		bit, i := hamt_slot(n, h, shift)
+		if n.bitmap & bit == 0 {
+			return 0, false
+		}
+		e := &n.entries[i]
+		if e.child == nil {
+			if e.key != key {
+				return 0, false
+			}
+			return e.value, true
+		}
+		n = e.child
+	}
+}
+
+/*
+ * hamt_lookup -- checks if the key exists in the map
+ */
+func hamt_lookup(ptr *data, key int) bool {
+	_, ok := hamt_get(ptr, key)
+	return ok
+}
+
+/*
+ * hamt_foreach_in -- (internal) calls cb for every pair below the node
+ */
+func hamt_foreach_in(n *node_t, cb func(int, int) bool) bool {
+	for _, e := range n.entries {
+		if e.child != nil {
+			if hamt_foreach_in(e.child, cb) {
+				return true
+			}
+		} else if cb(e.key, e.value) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * hamt_foreach -- calls cb for every pair in hash order, stopping early when
+ * cb returns true
+ */
+func hamt_foreach(ptr *data, cb func(int, int) bool) bool {
+	return hamt_foreach_in(ptr.root, cb)
+}
+
+/*
+ * hamt_clear -- removes all pairs from the map
+ */
+func hamt_clear(ptr *data) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		ptr.root = pnew(node_t)
+		ptr.count = 0
+	}
+	return nil
+}
+
+/*
+ * hamt_check_in -- (internal) verifies the node at the level of shift, whose
+ * pairs all have prefix as the digits of their hash above it; returns the
+ * number of pairs and the depth below the node
+ */
+func hamt_check_in(n *node_t, shift uint, prefix uint64, root bool) (int, int, error) {
+	if bits.OnesCount32(n.bitmap) != len(n.entries) {
+		return 0, 0, fmt.Errorf("node at level %d has %d entries for bitmap %#x",
+			shift / HAMT_BITS, len(n.entries), n.bitmap)
+	}
+	if !root && len(n.entries) == 1 && n.entries[0].child == nil {
+		return 0, 0, fmt.Errorf("node at level %d holds a single pair",
+			shift / HAMT_BITS)
+	}
+	if !root && len(n.entries) == 0 {
+		return 0, 0, fmt.Errorf("node at level %d is empty", shift / HAMT_BITS)
+	}
+	pairs, depth := 0, 0
+	i := 0
+	for digit := uint64(0); digit <= HAMT_MASK; digit++ {
+		if n.bitmap & (1 << digit) == 0 {
+			continue
+		}
+		e := &n.entries[i]
+		i++
+		path := prefix | digit << shift
+		if e.child != nil {
+			p, d, err := hamt_check_in(e.child, shift + HAMT_BITS, path, false)
+			if err != nil {
+				return 0, 0, err
+			}
+			pairs += p
+			if d + 1 > depth {
+				depth = d + 1
+			}
+			continue
+		}
+		/* all ones past the last level, as the shift then yields 0 */
+		mask := uint64(1) << (shift + HAMT_BITS) - 1
+		if hamt_hash(e.key) & mask != path {
+			return 0, 0, fmt.Errorf("key %d is under the wrong digits", e.key)
+		}
+		pairs++
+	}
+	return pairs, depth, nil
+}
+
+/*
+ * hamt_check -- verifies that every bitmap matches its entries, that every
+ * key is on the path of its hash, that no node below the root could be
+ * folded into its parent and that count is right; returns the depth
+ */
+func hamt_check(ptr *data) (int, error) {
+	pairs, depth, err := hamt_check_in(ptr.root, 0, 0, true)
+	if err != nil {
+		return 0, err
+	}
+	if pairs != ptr.count {
+		return 0, fmt.Errorf("%d pairs, count is %d", pairs, ptr.count)
+	}
+	return depth + 1, nil
+}
+
+/*
+ * str_insert -- hamt_insert wrapper which works on strings
+ */
+func str_insert(ptr *data, str string) {
+	var key int
+	if scan_args("insert", str, "%d", &key) {
+		if err := hamt_insert(ptr, key, 0); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- hamt_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key int
+	if scan_args("remove", str, "%d", &key) {
+		if _, ok := hamt_remove(ptr, key); !ok {
+			fmt.Println("no such value")
+		}
+	}
+}
+
+/*
+ * str_check -- hamt_lookup wrapper which works on strings
+ */
+func str_check(ptr *data, str string) {
+	var key int
+	if scan_args("check", str, "%d", &key) {
+		fmt.Println(hamt_lookup(ptr, key))
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := hamt_insert(ptr, rand.Int(), 0); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+/*
+ * str_clear -- hamt_clear wrapper which reports its error
+ */
+func str_clear(ptr *data) {
+	if err := hamt_clear(ptr); err != nil {
+		fmt.Println("clear:", err)
+	}
+}
+
+func help() {
+	print_help(
+		"i $value - insert $value",
+		"r $value - remove $value",
+		"c $value - check $value, returns 0/1",
+		"n $value - insert $value random values",
+		"p - print all values",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	hamt_foreach(ptr, func(key int, value int) bool {
+		fmt.Print(key, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if depth, err := hamt_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("entries:", ptr.count, "depth:", depth)
+	}
+}
+
+/*
+ * Run -- opens the map named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("hamt", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'c': str_check(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"runtime"
+	"time"
+	"unsafe"
+)
+
+/* large prime number used as a hashing function coefficient */
+const HASH_FUNC_COEFF_P uint64 = 32212254719
+
+/* initial number of buckets */
+const INIT_BUCKETS_NUM int = 10
+
+/* number of values in a bucket which trigger hashtable rebuild check */
+const MIN_HASHSET_THRESHOLD int = 5
+
+/* number of values in a bucket which force hashtable rebuild */
+const MAX_HASHSET_THRESHOLD int = 10
+
+type entry_t struct {
+	key   int
+	value int
+	next  *entry_t
+}
+
+type buckets_t struct {
+	bucket []*entry_t
+}
+
+/*
+ * data -- no transaction ever runs on the map; every update is a sequence of
+ * 8-byte stores, each persisted before the next one, such that a crash
+ * between two of them leaves a map hm_atomic_init can repair
+ */
+type data struct {
+	/* random number generator seed */
+	seed int64
+
+	/* hash function coefficients */
+	hash_fun_a uint64
+	hash_fun_b uint64
+	hash_fun_p uint64
+
+	/* number of values inserted, not to be trusted while count_dirty is set */
+	count       int
+	count_dirty bool
+
+	/* buckets, and the new ones while the table is being rebuilt */
+	buckets     *buckets_t
+	buckets_tmp *buckets_t
+
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x2C84F1A6E95B073D
+)
+
+/*
+ * persist -- (internal) flushes size bytes at addr to persistent memory; all
+ * the flushes go through it, and tests replace it to inject power failures
+ */
+var persist = func(addr unsafe.Pointer, size uintptr) {
+	runtime.PersistRange(addr, size)
+}
+
+/*
+ * new_buckets -- (internal) allocates a persistent table of n empty buckets
+ */
+func new_buckets(n int) *buckets_t {
+	b := pnew(buckets_t)
+	b.bucket = pmake([]*entry_t, n)
+	persist(unsafe.Pointer(b), unsafe.Sizeof(*b))
+	return b
+}
+
+/*
+ * initialize -- creates the hashmap, with hash function coefficients drawn
+ * from seed; the magic number is only stored, and persisted, once everything
+ * else is
+ */
+func initialize(ptr *data, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	ptr.seed = seed
+	ptr.hash_fun_a = uint64(rng.Int63n(1000)) + 1
+	ptr.hash_fun_b = uint64(rng.Int63n(100000))
+	ptr.hash_fun_p = HASH_FUNC_COEFF_P
+	ptr.count = 0
+	ptr.count_dirty = false
+	ptr.buckets = new_buckets(INIT_BUCKETS_NUM)
+	ptr.buckets_tmp = nil
+	persist(unsafe.Pointer(ptr), unsafe.Sizeof(*ptr))
+
+	ptr.magic = magic
+	persist(unsafe.Pointer(&ptr.magic), unsafe.Sizeof(ptr.magic))
+}
+
+/*
+ * hash -- the simplest hashing function,
+ * see https://en.wikipedia.org/wiki/Universal_hashing#Hashing_integers
+ */
+func hash(ptr *data, b *buckets_t, value int) int {
+	a, c, p := ptr.hash_fun_a, ptr.hash_fun_b, ptr.hash_fun_p
+	return int((a * uint64(value) + c) % p % uint64(len(b.bucket)))
+}
+
+/*
+ * hm_atomic_rebuild -- rebuilds the hashmap with a new number of buckets;
+ * the entries are copied into the new table, which replaces the old one
+ * with a single pointer store once complete, so a crash leaves either table
+ * whole; so does a full pool, which drops the new one with ErrPoolFull
+ */
+func hm_atomic_rebuild(ptr *data, new_len int) (err error) {
+	defer func() {
+		if err != nil {
+			ptr.buckets_tmp = nil
+			persist(unsafe.Pointer(&ptr.buckets_tmp), unsafe.Sizeof(ptr.buckets_tmp))
+		}
+	}()
+	defer pool_full(&err)
+
+	tmp := new_buckets(new_len)
+	ptr.buckets_tmp = tmp
+	persist(unsafe.Pointer(&ptr.buckets_tmp), unsafe.Sizeof(ptr.buckets_tmp))
+
+	for _, e := range ptr.buckets.bucket {
+		for ; e != nil; e = e.next {
+			h := hash(ptr, tmp, e.key)
+			c := pnew(entry_t)
+			c.key = e.key
+			c.value = e.value
+			c.next = tmp.bucket[h]
+			persist(unsafe.Pointer(c), unsafe.Sizeof(*c))
+			tmp.bucket[h] = c
+			persist(unsafe.Pointer(&tmp.bucket[h]), unsafe.Sizeof(tmp.bucket[h]))
+		}
+	}
+
+	ptr.buckets = tmp
+	persist(unsafe.Pointer(&ptr.buckets), unsafe.Sizeof(ptr.buckets))
+	ptr.buckets_tmp = nil
+	persist(unsafe.Pointer(&ptr.buckets_tmp), unsafe.Sizeof(ptr.buckets_tmp))
+	return nil
+}
+
+/*
+ * hm_atomic_set_dirty -- (internal) marks the count as trustworthy or not
+ */
+func hm_atomic_set_dirty(ptr *data, dirty bool) {
+	ptr.count_dirty = dirty
+	persist(unsafe.Pointer(&ptr.count_dirty), unsafe.Sizeof(ptr.count_dirty))
+}
+
+/*
+ * hm_atomic_insert -- inserts specified value into the hashmap, replacing
+ * the value of the key if it is present; the new entry is persisted before
+ * it is linked at the head of its bucket, so a full pool returns ErrPoolFull
+ * before the map is changed
+ */
+func hm_atomic_insert(ptr *data, key int, value int) (err error) {
+	b := ptr.buckets
+	h := hash(ptr, b, key)
+	num := 0
+
+	for e := b.bucket[h]; e != nil; e = e.next {
+		if e.key == key {
+			e.value = value
+			persist(unsafe.Pointer(&e.value), unsafe.Sizeof(e.value))
+			return nil
+		}
+		num++
+	}
+
+	defer pool_full(&err)
+	e := pnew(entry_t)
+	e.key = key
+	e.value = value
+	e.next = b.bucket[h]
+	persist(unsafe.Pointer(e), unsafe.Sizeof(*e))
+
+	hm_atomic_set_dirty(ptr, true)
+	b.bucket[h] = e
+	persist(unsafe.Pointer(&b.bucket[h]), unsafe.Sizeof(b.bucket[h]))
+	ptr.count++
+	persist(unsafe.Pointer(&ptr.count), unsafe.Sizeof(ptr.count))
+	hm_atomic_set_dirty(ptr, false)
+
+	num++
+	if num > MAX_HASHSET_THRESHOLD ||
+		(num > MIN_HASHSET_THRESHOLD && ptr.count > 2 * len(b.bucket)) {
+		/* a full pool only leaves the table as long chains */
+		hm_atomic_rebuild(ptr, len(b.bucket) * 2)
+	}
+	return nil
+}
+
+/*
+ * hm_atomic_remove -- removes specified key from the hashmap, returning its
+ * value and whether it was found; the entry is unlinked with a single
+ * pointer store
+ */
+func hm_atomic_remove(ptr *data, key int) (int, bool) {
+	b := ptr.buckets
+	link := &b.bucket[hash(ptr, b, key)]
+	for *link != nil && (*link).key != key {
+		link = &(*link).next
+	}
+	e := *link
+	if e == nil {
+		return 0, false
+	}
+
+	hm_atomic_set_dirty(ptr, true)
+	*link = e.next
+	persist(unsafe.Pointer(link), unsafe.Sizeof(*link))
+	ptr.count--
+	persist(unsafe.Pointer(&ptr.count), unsafe.Sizeof(ptr.count))
+	hm_atomic_set_dirty(ptr, false)
+	return e.value, true
+}
+
+/*
+ * hm_atomic_get -- checks whether specified key is in the hashmap, returning
+ * its value
+ */
+func hm_atomic_get(ptr *data, key int) (int, bool) {
+	b := ptr.buckets
+	for e := b.bucket[hash(ptr, b, key)]; e != nil; e = e.next {
+		if e.key == key {
+			return e.value, true
+		}
+	}
+	return 0, false
+}
+
+/*
+ * hm_atomic_lookup -- checks whether specified key is in the hashmap
+ */
+func hm_atomic_lookup(ptr *data, key int) bool {
+	_, ok := hm_atomic_get(ptr, key)
+	return ok
+}
+
+/*
+ * hm_atomic_foreach -- calls cb for every pair, bucket by bucket, stopping
+ * early when cb returns true
+ */
+func hm_atomic_foreach(ptr *data, cb func(int, int) bool) bool {
+	for _, e := range ptr.buckets.bucket {
+		for ; e != nil; e = e.next {
+			if cb(e.key, e.value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * hm_atomic_count -- returns number of elements
+ */
+func hm_atomic_count(ptr *data) int {
+	return ptr.count
+}
+
+/*
+ * hm_atomic_clear -- removes all values by swapping in an empty table
+ */
+func hm_atomic_clear(ptr *data) (err error) {
+	defer pool_full(&err)
+	b := new_buckets(INIT_BUCKETS_NUM)
+	hm_atomic_set_dirty(ptr, true)
+	ptr.buckets = b
+	persist(unsafe.Pointer(&ptr.buckets), unsafe.Sizeof(ptr.buckets))
+	ptr.count = 0
+	persist(unsafe.Pointer(&ptr.count), unsafe.Sizeof(ptr.count))
+	hm_atomic_set_dirty(ptr, false)
+	return nil
+}
+
+/*
+ * hm_atomic_init -- recovers the hashmap after the pool is opened: a count
+ * left dirty by a crash is recomputed, and the new table of an interrupted
+ * rebuild is dropped, since the old one is still whole
+ */
+func hm_atomic_init(ptr *data) {
+	if ptr.count_dirty {
+		count := 0
+		hm_atomic_foreach(ptr, func(int, int) bool {
+			count++
+			return false
+		})
+		ptr.count = count
+		persist(unsafe.Pointer(&ptr.count), unsafe.Sizeof(ptr.count))
+		hm_atomic_set_dirty(ptr, false)
+	}
+	if ptr.buckets_tmp != nil {
+		ptr.buckets_tmp = nil
+		persist(unsafe.Pointer(&ptr.buckets_tmp), unsafe.Sizeof(ptr.buckets_tmp))
+	}
+}
+
+/*
+ * hm_atomic_check -- verifies that every key is in the bucket of its hash,
+ * that no key is stored twice and that count is right; returns the longest
+ * chain
+ */
+func hm_atomic_check(ptr *data) (int, error) {
+	if ptr.count_dirty || ptr.buckets_tmp != nil {
+		return 0, errors.New("an update is still in progress")
+	}
+	seen := make(map[int]bool)
+	longest := 0
+	for i, e := range ptr.buckets.bucket {
+		chain := 0
+		for ; e != nil; e = e.next {
+			if hash(ptr, ptr.buckets, e.key) != i {
+				return 0, fmt.Errorf("key %d is in bucket %d", e.key, i)
+			}
+			if seen[e.key] {
+				return 0, fmt.Errorf("key %d is stored twice", e.key)
+			}
+			seen[e.key] = true
+			chain++
+		}
+		if chain > longest {
+			longest = chain
+		}
+	}
+	if len(seen) != ptr.count {
+		return 0, fmt.Errorf("%d entries, count is %d", len(seen), ptr.count)
+	}
+	return longest, nil
+}
+
+/*
+ * str_insert -- hm_atomic_insert wrapper which works on strings
+ */
+func str_insert(ptr *data, str string) {
+	var key int
+	if scan_args("insert", str, "%d", &key) {
+		if err := hm_atomic_insert(ptr, key, 0); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- hm_atomic_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key int
+	if scan_args("remove", str, "%d", &key) {
+		if _, ok := hm_atomic_remove(ptr, key); !ok {
+			fmt.Println("no such value")
+		}
+	}
+}
+
+/*
+ * str_check -- hm_atomic_lookup wrapper which works on strings
+ */
+func str_check(ptr *data, str string) {
+	var key int
+	if scan_args("check", str, "%d", &key) {
+		fmt.Println(hm_atomic_lookup(ptr, key))
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := hm_atomic_insert(ptr, rand.Int(), 0); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+/*
+ * str_clear -- hm_atomic_clear wrapper which reports its error
+ */
+func str_clear(ptr *data) {
+	if err := hm_atomic_clear(ptr); err != nil {
+		fmt.Println("clear:", err)
+	}
+}
+
+func help() {
+	print_help(
+		"i $value - insert $value",
+		"r $value - remove $value",
+		"c $value - check $value, returns 0/1",
+		"n $value - insert $value random values",
+		"p - print all values",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	hm_atomic_foreach(ptr, func(key int, value int) bool {
+		fmt.Print(key, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if longest, err := hm_atomic_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("a:", ptr.hash_fun_a, "b:", ptr.hash_fun_b, "p:", ptr.hash_fun_p)
+		fmt.Println("count:", hm_atomic_count(ptr), "buckets:", len(ptr.buckets.bucket),
+			"longest chain:", longest)
+	}
+}
+
+/*
+ * Run -- opens the map named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("hashmap_atomic", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr, time.Now().UnixNano())
+	}
+
+	hm_atomic_init(ptr)
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'c': str_check(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"testing"
+	"unsafe"
+
+	"github.com/vmware/go-pmem-transaction/pmem"
+)
+
+// The tests share one pool, as go-pmem maps a single pool per process.
+func TestMain(m *testing.M) {
+	pool := filepath.Join(os.TempDir(), fmt.Sprintf("hashmap_atomic_test.%d.pool", os.Getpid()))
+	pmem.Init(pool)
+	status := m.Run()
+	os.Remove(pool)
+	os.Exit(status)
+}
+
+// errPowerFail is the panic of an injected power failure.
+var errPowerFail = errors.New("power failure")
+
+// media tracks what has reached persistent memory, byte by byte, from the
+// flushes it sees; a byte never flushed holds zero, as pnew and pmake leave
+// it. The updates of the map flush every store before the next one, so at
+// any flush the bytes it covers are the only ones not on the media yet.
+type media struct {
+	bytes map[uintptr]byte
+	fail  int /* flushes to go before the failing one, or -1 */
+	keep  int /* 8-byte words of the failing flush which get through */
+}
+
+// flush is persist with power failures injected. The failing flush is torn:
+// only its first keep words reach the media, the rest of it is rolled back
+// to what the media holds, and the power fails.
+func (m *media) flush(addr unsafe.Pointer, size uintptr) {
+	if m.fail == 0 {
+		for i := uintptr(m.keep) * 8; i < size; i++ {
+			*(*byte)(unsafe.Pointer(uintptr(addr) + i)) = m.bytes[uintptr(addr) + i]
+		}
+		if kept := uintptr(m.keep) * 8; kept < size {
+			size = kept
+		}
+	}
+	for i := uintptr(0); i < size; i++ {
+		m.bytes[uintptr(addr) + i] = *(*byte)(unsafe.Pointer(uintptr(addr) + i))
+	}
+	if m.fail--; m.fail == -1 {
+		panic(errPowerFail)
+	}
+}
+
+// map_entries returns the pairs of the map in key order, one "key value"
+// string each.
+func map_entries(ptr *data) []string {
+	var keys []int
+	values := map[int]int{}
+	hm_atomic_foreach(ptr, func(key int, value int) bool {
+		keys = append(keys, key)
+		values[key] = value
+		return false
+	})
+	sort.Ints(keys)
+	entries := []string{}
+	for _, key := range keys {
+		entries = append(entries, fmt.Sprint(key, values[key]))
+	}
+	return entries
+}
+
+// crash runs op against a map holding keys 1 to n, failing the power at the
+// flush number fail with keep words of it getting through; it returns the
+// map, and whether the power failed before op finished.
+func crash(n int, op func(*data), fail int, keep int) (*data, bool) {
+	m := &media{bytes: map[uintptr]byte{}, fail: -1}
+	flush := persist
+	persist = m.flush
+	defer func() { persist = flush }()
+
+	ptr := pnew(data)
+	initialize(ptr, 1)
+	for key := 1; key <= n; key++ {
+		hm_atomic_insert(ptr, key, key * 10)
+	}
+
+	m.fail, m.keep = fail, keep
+	failed := false
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				if r != errPowerFail {
+					panic(r)
+				}
+				failed = true
+			}
+		}()
+		op(ptr)
+	}()
+	return ptr, failed
+}
+
+// A power failure at any flush of an update, tearing the write being
+// flushed, leaves a map which hm_atomic_init repairs to the state before or
+// after the update.
+func TestTornWrite(t *testing.T) {
+	/* the rolled back pointers must not be seen by the collector */
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+
+	/* the smallest map in which inserting one more key rebuilds it */
+	rebuild := 1
+	for {
+		ptr, _ := crash(rebuild, func(*data) {}, -1, 0)
+		buckets := len(ptr.buckets.bucket)
+		hm_atomic_insert(ptr, rebuild + 1, 0)
+		if len(ptr.buckets.bucket) != buckets {
+			break
+		}
+		rebuild++
+	}
+
+	tests := []struct {
+		name string
+		n    int
+		op   func(*data)
+	}{
+		{"insert", 20, func(ptr *data) { hm_atomic_insert(ptr, 21, 210) }},
+		{"update", 20, func(ptr *data) { hm_atomic_insert(ptr, 7, -7) }},
+		{"remove", 20, func(ptr *data) { hm_atomic_remove(ptr, 7) }},
+		{"clear", 20, func(ptr *data) { hm_atomic_clear(ptr) }},
+		{"rebuild", rebuild, func(ptr *data) { hm_atomic_insert(ptr, rebuild + 1, 0) }},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ptr, _ := crash(tc.n, func(*data) {}, -1, 0)
+			before := map_entries(ptr)
+			tc.op(ptr)
+			after := map_entries(ptr)
+
+			for fail := 0; ; fail++ {
+				for keep := 0; keep < 3; keep++ {
+					ptr, failed := crash(tc.n, tc.op, fail, keep)
+					if !failed {
+						return
+					}
+					hm_atomic_init(ptr)
+					if _, err := hm_atomic_check(ptr); err != nil {
+						t.Fatalf("flush %d, %d words kept: %v", fail, keep, err)
+					}
+					got := map_entries(ptr)
+					if !reflect.DeepEqual(got, before) && !reflect.DeepEqual(got, after) {
+						t.Fatalf("flush %d, %d words kept: map holds %v, want %v or %v",
+							fail, keep, got, before, after)
+					}
+				}
+			}
+		})
+	}
+}
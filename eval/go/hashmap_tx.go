@@ -0,0 +1,413 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* large prime number used as a hashing function coefficient */
+const HASH_FUNC_COEFF_P uint64 = 32212254719
+
+/* initial number of buckets */
+const INIT_BUCKETS_NUM int = 10
+
+/* number of values in a bucket which trigger hashtable rebuild check */
+const MIN_HASHSET_THRESHOLD int = 5
+
+/* number of values in a bucket which force hashtable rebuild */
+const MAX_HASHSET_THRESHOLD int = 10
+
+/* average number of values per bucket above which the table grows */
+const MAX_LOAD_FACTOR int = 2
+
+type entry_t struct {
+	key   int
+	value int
+	next  *entry_t
+}
+
+type buckets_t struct {
+	bucket []*entry_t
+}
+
+type data struct {
+	/* random number generator seed */
+	seed int64
+
+	/* hash function coefficients */
+	hash_fun_a uint64
+	hash_fun_b uint64
+	hash_fun_p uint64
+
+	/* number of values inserted */
+	count int
+
+	/* buckets */
+	buckets *buckets_t
+
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x0E5D93B1C7264AF8
+)
+
+/*
+ * new_buckets -- (internal) allocates a table of n empty buckets; must be
+ * called in a transaction
+ */
+func new_buckets(n int) *buckets_t {
+	b := pnew(buckets_t)
+	b.bucket = pmake([]*entry_t, n)
+	return b
+}
+
+/*
+ * initialize -- creates the hashmap, with hash function coefficients drawn
+ * from seed
+ */
+func initialize(ptr *data, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	txn("undo") {
+		ptr.seed = seed
+		ptr.hash_fun_a = uint64(rng.Int63n(1000)) + 1
+		ptr.hash_fun_b = uint64(rng.Int63n(100000))
+		ptr.hash_fun_p = HASH_FUNC_COEFF_P
+		ptr.count = 0
+		ptr.buckets = new_buckets(INIT_BUCKETS_NUM)
+		ptr.magic = magic
+	}
+}
+
+/*
+ * hash -- the simplest hashing function,
+ * see https://en.wikipedia.org/wiki/Universal_hashing#Hashing_integers
+ */
+func hash(ptr *data, b *buckets_t, value int) int {
+	a, c, p := ptr.hash_fun_a, ptr.hash_fun_b, ptr.hash_fun_p
+	return int((a * uint64(value) + c) % p % uint64(len(b.bucket)))
+}
+
+/*
+ * hm_tx_rebuild -- rebuilds the hashmap with a new number of buckets, moving
+ * every entry to its new bucket in one transaction
+ */
+func hm_tx_rebuild(ptr *data, new_len int) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		buckets_new := new_buckets(new_len)
+		for _, e := range ptr.buckets.bucket {
+			for e != nil {
+				next := e.next
+				h := hash(ptr, buckets_new, e.key)
+				e.next = buckets_new.bucket[h]
+				buckets_new.bucket[h] = e
+				e = next
+			}
+		}
+		ptr.buckets = buckets_new
+	}
+	return nil
+}
+
+/*
+ * hm_tx_insert -- inserts specified value into the hashmap, replacing the
+ * value of the key if it is present; the table grows once its load factor
+ * exceeds MAX_LOAD_FACTOR or the bucket of the key gets too long
+ */
+func hm_tx_insert(ptr *data, key int, value int) (err error) {
+	b := ptr.buckets
+	h := hash(ptr, b, key)
+	num := 0
+
+	for e := b.bucket[h]; e != nil; e = e.next {
+		if e.key == key {
+			txn("undo") {
+				e.value = value
+			}
+			return nil
+		}
+		num++
+	}
+
+	defer pool_full(&err)
+	txn("undo") {
+		e := pnew(entry_t)
+		e.key = key
+		e.value = value
+		e.next = b.bucket[h]
+		b.bucket[h] = e
+		ptr.count++
+		num++
+	}
+
+	if num > MAX_HASHSET_THRESHOLD ||
+		(num > MIN_HASHSET_THRESHOLD &&
+			ptr.count > MAX_LOAD_FACTOR * len(b.bucket)) {
+		/* a full pool only leaves the table as long chains */
+		hm_tx_rebuild(ptr, len(b.bucket) * 2)
+	}
+	return nil
+}
+
+/*
+ * hm_tx_remove -- removes specified key from the hashmap, returning its
+ * value and whether it was found; the table shrinks by half once it has
+ * more buckets than values
+ */
+func hm_tx_remove(ptr *data, key int) (int, bool) {
+	b := ptr.buckets
+	link := &b.bucket[hash(ptr, b, key)]
+	for *link != nil && (*link).key != key {
+		link = &(*link).next
+	}
+	e := *link
+	if e == nil {
+		return 0, false
+	}
+
+	txn("undo") {
+		*link = e.next
+		ptr.count--
+	}
+
+	if ptr.count < len(b.bucket) && len(b.bucket) / 2 >= INIT_BUCKETS_NUM {
+		hm_tx_rebuild(ptr, len(b.bucket) / 2)
+	}
+	return e.value, true
+}
+
+/*
+ * hm_tx_get -- checks whether specified key is in the hashmap, returning its
+ * value
+ */
+func hm_tx_get(ptr *data, key int) (int, bool) {
+	b := ptr.buckets
+	for e := b.bucket[hash(ptr, b, key)]; e != nil; e = e.next {
+		if e.key == key {
+			return e.value, true
+		}
+	}
+	return 0, false
+}
+
+/*
+ * hm_tx_lookup -- checks whether specified key is in the hashmap
+ */
+func hm_tx_lookup(ptr *data, key int) bool {
+	_, ok := hm_tx_get(ptr, key)
+	return ok
+}
+
+/*
+ * hm_tx_foreach -- calls cb for every pair, bucket by bucket, stopping early
+ * when cb returns true
+ */
+func hm_tx_foreach(ptr *data, cb func(int, int) bool) bool {
+	for _, e := range ptr.buckets.bucket {
+		for ; e != nil; e = e.next {
+			if cb(e.key, e.value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * hm_tx_count -- returns number of elements
+ */
+func hm_tx_count(ptr *data) int {
+	return ptr.count
+}
+
+/*
+ * hm_tx_clear -- removes all values and shrinks the table back to its
+ * initial size
+ */
+func hm_tx_clear(ptr *data) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		b := new_buckets(INIT_BUCKETS_NUM)
+		ptr.buckets = b
+		ptr.count = 0
+	}
+	return nil
+}
+
+/*
+ * hm_tx_check -- verifies that every key is in the bucket of its hash, that
+ * no key is stored twice and that count is right; returns the longest chain
+ */
+func hm_tx_check(ptr *data) (int, error) {
+	seen := make(map[int]bool)
+	longest := 0
+	for i, e := range ptr.buckets.bucket {
+		chain := 0
+		for ; e != nil; e = e.next {
+			if hash(ptr, ptr.buckets, e.key) != i {
+				return 0, fmt.Errorf("key %d is in bucket %d", e.key, i)
+			}
+			if seen[e.key] {
+				return 0, fmt.Errorf("key %d is stored twice", e.key)
+			}
+			seen[e.key] = true
+			chain++
+		}
+		if chain > longest {
+			longest = chain
+		}
+	}
+	if len(seen) != ptr.count {
+		return 0, fmt.Errorf("%d entries, count is %d", len(seen), ptr.count)
+	}
+	return longest, nil
+}
+
+/*
+ * str_insert -- hm_tx_insert wrapper which works on strings
+ */
+func str_insert(ptr *data, str string) {
+	var key int
+	if scan_args("insert", str, "%d", &key) {
+		if err := hm_tx_insert(ptr, key, 0); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- hm_tx_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key int
+	if scan_args("remove", str, "%d", &key) {
+		if _, ok := hm_tx_remove(ptr, key); !ok {
+			fmt.Println("no such value")
+		}
+	}
+}
+
+/*
+ * str_check -- hm_tx_lookup wrapper which works on strings
+ */
+func str_check(ptr *data, str string) {
+	var key int
+	if scan_args("check", str, "%d", &key) {
+		fmt.Println(hm_tx_lookup(ptr, key))
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := hm_tx_insert(ptr, rand.Int(), 0); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+/*
+ * str_clear -- hm_tx_clear wrapper which reports its error
+ */
+func str_clear(ptr *data) {
+	if err := hm_tx_clear(ptr); err != nil {
+		fmt.Println("clear:", err)
+	}
+}
+
+func help() {
+	print_help(
+		"i $value - insert $value",
+		"r $value - remove $value",
+		"c $value - check $value, returns 0/1",
+		"n $value - insert $value random values",
+		"p - print all values",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	hm_tx_foreach(ptr, func(key int, value int) bool {
+		fmt.Print(key, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if longest, err := hm_tx_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("a:", ptr.hash_fun_a, "b:", ptr.hash_fun_b, "p:", ptr.hash_fun_p)
+		fmt.Printf("count: %d buckets: %d load factor: %.2f longest chain: %d\n",
+			hm_tx_count(ptr), len(ptr.buckets.bucket),
+			float64(ptr.count) / float64(len(ptr.buckets.bucket)), longest)
+	}
+}
+
+/*
+ * Run -- opens the map named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("hashmap_tx", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr, time.Now().UnixNano())
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'c': str_check(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* a sketch has 1 << HLL_P registers, for a standard error of 1.04 / 64 */
+const HLL_P uint = 12
+const HLL_M int = 1 << HLL_P
+
+/* number of sketches in a pool */
+const HLL_SKETCHES int = 8
+
+/*
+ * sketch_t -- each register holds the longest run of leading zeros, plus
+ * one, seen in the hashes of the keys it was picked for
+ */
+type sketch_t struct {
+	registers [HLL_M]uint8
+}
+
+type data struct {
+	sketches [HLL_SKETCHES]sketch_t
+	magic    int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x3A6F1C9E84D0B257
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		for i := range ptr.sketches {
+			ptr.sketches[i] = sketch_t{}
+		}
+		ptr.magic = magic
+	}
+}
+
+/*
+ * hll_hash -- (internal) returns the 64-bit hash of key, mixed so that its
+ * top bits are as good as its bottom ones
+ */
+func hll_hash(key string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(key))
+	h := f.Sum64()
+	h = (h ^ h >> 30) * 0xBF58476D1CE4E5B9
+	h = (h ^ h >> 27) * 0x94D049BB133111EB
+	return h ^ h >> 31
+}
+
+/*
+ * hll_add -- counts key in the sketch: the top HLL_P bits of its hash pick a
+ * register, which is raised to the rank of the remaining bits if that is
+ * higher; returns whether the register changed
+ */
+func hll_add(s *sketch_t, key string) bool {
+	h := hll_hash(key)
+	idx := int(h >> (64 - HLL_P))
+	rank := uint8(1)
+	for w := h << HLL_P; w & (1 << 63) == 0 && rank <= uint8(64 - HLL_P); w <<= 1 {
+		rank++
+	}
+	if s.registers[idx] >= rank {
+		return false
+	}
+	txn("undo") {
+		s.registers[idx] = rank
+	}
+	return true
+}
+
+/*
+ * hll_estimate -- returns the estimated number of distinct keys added to the
+ * sketch, counting with the empty registers while many are left
+ */
+func hll_estimate(s *sketch_t) float64 {
+	m := float64(HLL_M)
+	sum, zeros := 0.0, 0
+	for _, r := range s.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079 / m) * m * m / sum
+	if e <= 2.5 * m && zeros > 0 {
+		e = m * math.Log(m / float64(zeros))
+	}
+	return e
+}
+
+/*
+ * hll_merge -- makes dst count the union of the keys of dst and src, by
+ * keeping the highest of every pair of registers, in one transaction
+ */
+func hll_merge(dst *sketch_t, src *sketch_t) {
+	txn("undo") {
+		for i, r := range src.registers {
+			if r > dst.registers[i] {
+				dst.registers[i] = r
+			}
+		}
+	}
+}
+
+/*
+ * hll_clear -- empties the sketch
+ */
+func hll_clear(s *sketch_t) {
+	txn("undo") {
+		*s = sketch_t{}
+	}
+}
+
+/*
+ * hll_check -- verifies that no register is above the highest rank
+ */
+func hll_check(s *sketch_t) error {
+	for i, r := range s.registers {
+		if int(r) > 65 - int(HLL_P) {
+			return fmt.Errorf("register %d holds %d", i, r)
+		}
+	}
+	return nil
+}
+
+/*
+ * str_sketch -- (internal) parses a sketch number, printing an error for cmd
+ * if it is not valid
+ */
+func str_sketch(ptr *data, cmd string, n int) *sketch_t {
+	if n < 0 || n >= HLL_SKETCHES {
+		fmt.Println(cmd + ": sketches go from 0 to", HLL_SKETCHES - 1)
+		return nil
+	}
+	return &ptr.sketches[n]
+}
+
+/*
+ * str_add -- adds the key to the sketch, both given as a string
+ */
+func str_add(ptr *data, str string) {
+	var n int
+	var key string
+	if scan_args("add", str, "%d %s", &n, &key) {
+		if s := str_sketch(ptr, "add", n); s != nil {
+			hll_add(s, key)
+		}
+	}
+}
+
+/*
+ * str_estimate -- prints the estimate of the sketch given as a string
+ */
+func str_estimate(ptr *data, str string) {
+	var n int
+	if scan_args("estimate", str, "%d", &n) {
+		if s := str_sketch(ptr, "estimate", n); s != nil {
+			fmt.Printf("%.0f\n", hll_estimate(s))
+		}
+	}
+}
+
+/*
+ * str_merge -- merges the second sketch given as a string into the first
+ */
+func str_merge(ptr *data, str string) {
+	var d, s int
+	if scan_args("merge", str, "%d %d", &d, &s) {
+		dst, src := str_sketch(ptr, "merge", d), str_sketch(ptr, "merge", s)
+		if dst != nil && src != nil {
+			hll_merge(dst, src)
+		}
+	}
+}
+
+/*
+ * str_clear -- empties the sketch given as a string
+ */
+func str_clear(ptr *data, str string) {
+	var n int
+	if scan_args("clear", str, "%d", &n) {
+		if s := str_sketch(ptr, "clear", n); s != nil {
+			hll_clear(s)
+		}
+	}
+}
+
+/*
+ * str_insert_random -- adds specified (as string) number of random keys to
+ * the sketch
+ */
+func str_insert_random(ptr *data, str string) {
+	var n, val int
+	if scan_args("random insert", str, "%d %d", &n, &val) {
+		if s := str_sketch(ptr, "random insert", n); s != nil {
+			for i := 0; i < val; i++ {
+				hll_add(s, fmt.Sprintf("%x", rand.Int63()))
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"a $sketch $key - add $key to $sketch",
+		"e $sketch - print the number of distinct keys in $sketch",
+		"m $dst $src - merge $src into $dst",
+		"n $sketch $value - add $value random keys to $sketch",
+		"d - print debug info",
+		"x $sketch - clear $sketch",
+	)
+}
+
+func print_debug(ptr *data) {
+	for i := range ptr.sketches {
+		s := &ptr.sketches[i]
+		if err := hll_check(s); err != nil {
+			fmt.Println("sketch", i, "invariants:", err)
+		} else {
+			fmt.Printf("sketch %d invariants: ok estimate: %.0f\n", i, hll_estimate(s))
+		}
+	}
+}
+
+/*
+ * Run -- opens the sketch named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("hll", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'a': str_add(ptr, buf[1:])
+			case 'e': str_estimate(ptr, buf[1:])
+			case 'm': str_merge(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr, buf[1:])
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
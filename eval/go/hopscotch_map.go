@@ -0,0 +1,427 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* number of buckets of a new map */
+const HOPSCOTCH_MAP_MIN_SIZE int = 8
+
+/* a key is stored at most HOPSCOTCH_MAP_H - 1 buckets after its home bucket */
+const HOPSCOTCH_MAP_H int = 32
+
+/* buckets searched for a free one before the table is grown */
+const HOPSCOTCH_MAP_ADD_RANGE int = 256
+
+/*
+ * bucket_t -- bit i of hop is set when the bucket i places further holds an
+ * entry whose home is this bucket
+ */
+type bucket_t struct {
+	key   int
+	value int
+	used  bool
+	hop   uint32
+}
+
+type data struct {
+	buckets []bucket_t
+	count   int
+	magic   int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x5E20B7D9C4138FA6
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.buckets = pmake([]bucket_t, HOPSCOTCH_MAP_MIN_SIZE)
+		ptr.count = 0
+		ptr.magic = magic
+	}
+}
+
+/*
+ * hopscotch_map_hash -- (internal) returns the home bucket of key in a table
+ * of n buckets
+ */
+func hopscotch_map_hash(key int, n int) int {
+	h := uint64(key)
+	h = (h ^ h >> 30) * 0xBF58476D1CE4E5B9
+	h = (h ^ h >> 27) * 0x94D049BB133111EB
+	h ^= h >> 31
+	return int(h % uint64(n))
+}
+
+/*
+ * hopscotch_map_find -- (internal) returns the bucket holding key, or nil;
+ * only the buckets flagged in the neighborhood of its home are read
+ */
+func hopscotch_map_find(buckets []bucket_t, key int) *bucket_t {
+	n := len(buckets)
+	home := hopscotch_map_hash(key, n)
+	for hop, i := buckets[home].hop, 0; hop != 0; hop, i = hop >> 1, i + 1 {
+		if hop & 1 == 0 {
+			continue
+		}
+		if b := &buckets[(home + i) % n]; b.key == key {
+			return b
+		}
+	}
+	return nil
+}
+
+/*
+ * hopscotch_map_add -- (internal) stores a key which is not in the table:
+ * finds the nearest free bucket after its home and, while that is outside
+ * the neighborhood, moves an earlier entry into it whose own neighborhood
+ * still covers it; returns false if no free bucket could be brought close
+ * enough, with the entries moved so far still in valid places
+ */
+func hopscotch_map_add(buckets []bucket_t, key int, value int) bool {
+	n := len(buckets)
+	home := hopscotch_map_hash(key, n)
+
+	dist := 0
+	for dist < n && dist < HOPSCOTCH_MAP_ADD_RANGE && buckets[(home + dist) % n].used {
+		dist++
+	}
+	if dist == n || dist == HOPSCOTCH_MAP_ADD_RANGE {
+		return false
+	}
+
+	for dist >= HOPSCOTCH_MAP_H {
+		free := (home + dist) % n
+		moved := false
+		/* the farther the owner, the closer the entry it can give up */
+		for d := HOPSCOTCH_MAP_H - 1; d > 0 && !moved; d-- {
+			owner := (free - d + n) % n
+			for i := 0; i < d; i++ {
+				if buckets[owner].hop & (1 << uint(i)) == 0 {
+					continue
+				}
+				from := (owner + i) % n
+				buckets[free].key = buckets[from].key
+				buckets[free].value = buckets[from].value
+				buckets[free].used = true
+				buckets[from].used = false
+				buckets[owner].hop = buckets[owner].hop &^ (1 << uint(i)) | 1 << uint(d)
+				dist -= d - i
+				moved = true
+				break
+			}
+		}
+		if !moved {
+			return false
+		}
+	}
+
+	b := &buckets[(home + dist) % n]
+	b.key = key
+	b.value = value
+	b.used = true
+	buckets[home].hop |= 1 << uint(dist)
+	return true
+}
+
+/*
+ * hopscotch_map_grow -- (internal) moves the entries and the new pair into a
+ * table of twice the size, doubling again for as long as some entry does not
+ * fit; must be called in a transaction
+ */
+func hopscotch_map_grow(ptr *data, key int, value int) {
+	size := len(ptr.buckets)
+	for {
+		size *= 2
+		buckets := pmake([]bucket_t, size)
+		ok := hopscotch_map_add(buckets, key, value)
+		for i := 0; i < len(ptr.buckets) && ok; i++ {
+			if b := &ptr.buckets[i]; b.used {
+				ok = hopscotch_map_add(buckets, b.key, b.value)
+			}
+		}
+		if ok {
+			ptr.buckets = buckets
+			return
+		}
+	}
+}
+
+/*
+ * hopscotch_map_insert -- inserts a key-value pair, replacing the value of the
+ * key if it is present; the entries moved to make room are moved in the same
+ * transaction as the one added, which a pool too full to grow the table
+ * rolls back with ErrPoolFull
+ */
+func hopscotch_map_insert(ptr *data, key int, value int) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		if b := hopscotch_map_find(ptr.buckets, key); b != nil {
+			b.value = value
+			return nil
+		}
+		if !hopscotch_map_add(ptr.buckets, key, value) {
+			hopscotch_map_grow(ptr, key, value)
+		}
+		ptr.count++
+	}
+	return nil
+}
+
+/*
+ * hopscotch_map_remove -- removes the key from the map, returning its value
+ * and whether it was found
+ */
+func hopscotch_map_remove(ptr *data, key int) (int, bool) {
+	b := hopscotch_map_find(ptr.buckets, key)
+	if b == nil {
+		return 0, false
+	}
+	value := b.value
+	txn("undo") {
+		n := len(ptr.buckets)
+		home := hopscotch_map_hash(key, n)
+		for i := 0; i < HOPSCOTCH_MAP_H; i++ {
+			if &ptr.buckets[(home + i) % n] == b {
+				ptr.buckets[home].hop &^= 1 << uint(i)
+				break
+			}
+		}
+		b.used = false
+		ptr.count--
+	}
+	return value, true
+}
+
+/*
+ * hopscotch_map_get -- searches for the value of the key
+ */
+func hopscotch_map_get(ptr *data, key int) (int, bool) {
+	if b := hopscotch_map_find(ptr.buckets, key); b != nil {
+		return b.value, true
+	}
+	return 0, false
+}
+
+/*
+ * hopscotch_map_lookup -- checks if the key exists in the map
+ */
+func hopscotch_map_lookup(ptr *data, key int) bool {
+	return hopscotch_map_find(ptr.buckets, key) != nil
+}
+
+/*
+ * hopscotch_map_foreach -- calls cb for every pair, in no particular order,
+ * stopping early when cb returns true
+ */
+func hopscotch_map_foreach(ptr *data, cb func(int, int) bool) bool {
+	for _, b := range ptr.buckets {
+		if b.used && cb(b.key, b.value) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * hopscotch_map_clear -- removes all pairs from the map and shrinks it back
+ * to its initial size
+ */
+func hopscotch_map_clear(ptr *data) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		buckets := pmake([]bucket_t, HOPSCOTCH_MAP_MIN_SIZE)
+		ptr.buckets = buckets
+		ptr.count = 0
+	}
+	return nil
+}
+
+/*
+ * hopscotch_map_check -- verifies that every entry is in the neighborhood of
+ * its home and flagged there, that every flag leads to such an entry and
+ * that count is right; returns the largest distance of an entry from home
+ */
+func hopscotch_map_check(ptr *data) (int, error) {
+	n := len(ptr.buckets)
+	entries, flags, farthest := 0, 0, 0
+	for i, b := range ptr.buckets {
+		for hop, d := b.hop, 0; hop != 0; hop, d = hop >> 1, d + 1 {
+			if hop & 1 == 0 {
+				continue
+			}
+			e := ptr.buckets[(i + d) % n]
+			if !e.used || hopscotch_map_hash(e.key, n) != i {
+				return 0, fmt.Errorf("bucket %d flags bucket %d, which is not its own",
+					i, (i + d) % n)
+			}
+			flags++
+		}
+		if !b.used {
+			continue
+		}
+		home := hopscotch_map_hash(b.key, n)
+		d := (i - home + n) % n
+		if d >= HOPSCOTCH_MAP_H {
+			return 0, fmt.Errorf("key %d is %d buckets from its home", b.key, d)
+		}
+		if d > farthest {
+			farthest = d
+		}
+		entries++
+	}
+	if entries != flags {
+		return 0, fmt.Errorf("%d entries, %d of them flagged", entries, flags)
+	}
+	if entries != ptr.count {
+		return 0, fmt.Errorf("%d entries, count is %d", entries, ptr.count)
+	}
+	return farthest, nil
+}
+
+/*
+ * str_insert -- hopscotch_map_insert wrapper which works on strings
+ */
+func str_insert(ptr *data, str string) {
+	var key int
+	if scan_args("insert", str, "%d", &key) {
+		if err := hopscotch_map_insert(ptr, key, 0); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- hopscotch_map_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key int
+	if scan_args("remove", str, "%d", &key) {
+		if _, ok := hopscotch_map_remove(ptr, key); !ok {
+			fmt.Println("no such value")
+		}
+	}
+}
+
+/*
+ * str_check -- hopscotch_map_lookup wrapper which works on strings
+ */
+func str_check(ptr *data, str string) {
+	var key int
+	if scan_args("check", str, "%d", &key) {
+		fmt.Println(hopscotch_map_lookup(ptr, key))
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := hopscotch_map_insert(ptr, rand.Int(), 0); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+/*
+ * str_clear -- hopscotch_map_clear wrapper which reports its error
+ */
+func str_clear(ptr *data) {
+	if err := hopscotch_map_clear(ptr); err != nil {
+		fmt.Println("clear:", err)
+	}
+}
+
+func help() {
+	print_help(
+		"i $value - insert $value",
+		"r $value - remove $value",
+		"c $value - check $value, returns 0/1",
+		"n $value - insert $value random values",
+		"p - print all values",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	hopscotch_map_foreach(ptr, func(key int, value int) bool {
+		fmt.Print(key, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if farthest, err := hopscotch_map_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Printf("entries: %d buckets: %d load: %.2f farthest: %d\n", ptr.count,
+			len(ptr.buckets), float64(ptr.count) / float64(len(ptr.buckets)), farthest)
+	}
+}
+
+/*
+ * Run -- opens the map named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("hopscotch_map", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'c': str_check(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/*
+ * data -- the strings are kept in pool, see strpool.go
+ */
+type data struct {
+	pool  *strpool
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x29F4B6E0A3C7158D
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.pool = strpool_new()
+		ptr.magic = magic
+	}
+}
+
+/*
+ * intern_clear -- replaces the pool with an empty one
+ */
+func intern_clear(ptr *data) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		ptr.pool = strpool_new()
+	}
+	return nil
+}
+
+/*
+ * str_intern -- interns the string given and prints its handle
+ */
+func str_intern(ptr *data, str string) {
+	var s string
+	if scan_args("intern", str, "%s", &s) {
+		if h, err := strpool_intern(ptr.pool, s); err == nil {
+			fmt.Println(h)
+		} else {
+			fmt.Println("intern:", err)
+		}
+	}
+}
+
+/*
+ * str_lookup -- prints the handle of the string given, if it is interned
+ */
+func str_lookup(ptr *data, str string) {
+	var s string
+	if scan_args("lookup", str, "%s", &s) {
+		if h, ok := strpool_lookup(ptr.pool, s); ok {
+			fmt.Println(h)
+		} else {
+			fmt.Println("no such string")
+		}
+	}
+}
+
+/*
+ * str_handle -- (internal) parses a handle, printing an error for cmd if it
+ * does not name a string
+ */
+func str_handle(ptr *data, cmd string, str string) (int, bool) {
+	var h int
+	if !scan_args(cmd, str, "%d", &h) {
+		return 0, false
+	}
+	if !strpool_valid(ptr.pool, h) {
+		fmt.Println("no such handle")
+		return 0, false
+	}
+	return h, true
+}
+
+/*
+ * str_get -- prints the string of the handle given as a string
+ */
+func str_get(ptr *data, str string) {
+	if h, ok := str_handle(ptr, "get", str); ok {
+		fmt.Println(strpool_get(ptr.pool, h))
+	}
+}
+
+/*
+ * str_release -- gives back a reference to the handle given as a string
+ */
+func str_release(ptr *data, str string) {
+	if h, ok := str_handle(ptr, "release", str); ok {
+		strpool_release(ptr.pool, h)
+	}
+}
+
+/*
+ * str_clear -- intern_clear wrapper which reports its error
+ */
+func str_clear(ptr *data) {
+	if err := intern_clear(ptr); err != nil {
+		fmt.Println("clear:", err)
+	}
+}
+
+/*
+ * str_insert_random -- interns specified (as string) number of random
+ * strings
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if _, err := strpool_intern(ptr.pool, fmt.Sprintf("%x", rand.Int63())); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"i $string - intern $string, print its handle",
+		"l $string - print the handle of $string without taking a reference",
+		"g $handle - print the string of $handle",
+		"r $handle - give back a reference to $handle",
+		"n $value - intern $value random strings",
+		"p - print all handles and strings",
+		"d - print debug info",
+		"x - remove all strings",
+	)
+}
+
+func print_all(ptr *data) {
+	strpool_foreach(ptr.pool, func(h int, s string) bool {
+		fmt.Println(h, s)
+		return false
+	})
+}
+
+func print_debug(ptr *data) {
+	if err := strpool_check(ptr.pool); err != nil {
+		fmt.Println("invariants:", err)
+		return
+	}
+	fmt.Println("invariants: ok")
+	fmt.Println("strings:", ptr.pool.live, "handles:", len(ptr.pool.entries),
+		"buckets:", len(ptr.pool.buckets))
+}
+
+/*
+ * Run -- opens the pool named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("intern", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_intern(ptr, buf[1:])
+			case 'l': str_lookup(ptr, buf[1:])
+			case 'g': str_get(ptr, buf[1:])
+			case 'r': str_release(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* number of buckets of a new map */
+const LHASH_MAP_MIN_BUCKETS int = 4
+
+/* number of buckets held by a segment */
+const LHASH_MAP_SEGMENT int = 64
+
+/* average number of entries per bucket above which a bucket is split */
+const LHASH_MAP_MAX_LOAD int = 2
+
+type entry_t struct {
+	key   int
+	value int
+	next  *entry_t
+}
+
+type segment_t struct {
+	buckets [LHASH_MAP_SEGMENT]*entry_t
+}
+
+/*
+ * data -- the map has (LHASH_MAP_MIN_BUCKETS << level) + split buckets:
+ * those before split have been split in the current round and address their
+ * keys with one more bit of the hash than the others
+ */
+type data struct {
+	dir   []*segment_t
+	level int
+	split int
+	count int
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x4D7E92A1F0C635B8
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.dir = pmake([]*segment_t, 1)
+		ptr.dir[0] = pnew(segment_t)
+		ptr.level = 0
+		ptr.split = 0
+		ptr.count = 0
+		ptr.magic = magic
+	}
+}
+
+/*
+ * lhash_map_hash -- (internal) returns the hash of key
+ */
+func lhash_map_hash(key int) uint64 {
+	h := uint64(key)
+	h = (h ^ h >> 30) * 0xBF58476D1CE4E5B9
+	h = (h ^ h >> 27) * 0x94D049BB133111EB
+	return h ^ h >> 31
+}
+
+/*
+ * lhash_map_buckets -- (internal) returns the number of buckets of the map
+ */
+func lhash_map_buckets(ptr *data) int {
+	return LHASH_MAP_MIN_BUCKETS << uint(ptr.level) + ptr.split
+}
+
+/*
+ * lhash_map_address -- (internal) returns the bucket of key
+ */
+func lhash_map_address(ptr *data, key int) int {
+	h := lhash_map_hash(key)
+	b := int(h % uint64(LHASH_MAP_MIN_BUCKETS << uint(ptr.level)))
+	if b < ptr.split {
+		b = int(h % uint64(LHASH_MAP_MIN_BUCKETS << uint(ptr.level + 1)))
+	}
+	return b
+}
+
+/*
+ * lhash_map_bucket -- (internal) returns the head of the chain of bucket b
+ */
+func lhash_map_bucket(ptr *data, b int) **entry_t {
+	return &ptr.dir[b / LHASH_MAP_SEGMENT].buckets[b % LHASH_MAP_SEGMENT]
+}
+
+/*
+ * lhash_map_find -- (internal) returns the link to the entry holding key,
+ * or to the nil at the end of the chain of its bucket
+ */
+func lhash_map_find(ptr *data, key int) **entry_t {
+	ref := lhash_map_bucket(ptr, lhash_map_address(ptr, key))
+	for *ref != nil && (*ref).key != key {
+		ref = &(*ref).next
+	}
+	return ref
+}
+
+/*
+ * lhash_map_split -- (internal) splits the bucket at the split pointer,
+ * moving the keys which the next bit of their hash sends to the new bucket
+ * at the end of the map, and advances the split pointer, starting a new
+ * round once every bucket of this one is split; must be called in a
+ * transaction
+ */
+func lhash_map_split(ptr *data) {
+	b := lhash_map_buckets(ptr)
+	if b % LHASH_MAP_SEGMENT == 0 {
+		/* the new bucket starts a segment */
+		seg := pnew(segment_t)
+		if b / LHASH_MAP_SEGMENT == len(ptr.dir) {
+			dir := pmake([]*segment_t, 2 * len(ptr.dir))
+			copy(dir, ptr.dir)
+			ptr.dir = dir
+		}
+		ptr.dir[b / LHASH_MAP_SEGMENT] = seg
+	}
+
+	old := lhash_map_bucket(ptr, ptr.split)
+	ptr.split++
+	ref := old
+	for *ref != nil {
+		e := *ref
+		if lhash_map_address(ptr, e.key) == b {
+			*ref = e.next
+			e.next = *lhash_map_bucket(ptr, b)
+			*lhash_map_bucket(ptr, b) = e
+		} else {
+			ref = &e.next
+		}
+	}
+
+	if ptr.split == LHASH_MAP_MIN_BUCKETS << uint(ptr.level) {
+		ptr.level++
+		ptr.split = 0
+	}
+}
+
+/*
+ * lhash_map_insert -- inserts a key-value pair, replacing the value of the
+ * key if it is present; when the insert raises the load over the limit it
+ * also splits one bucket, in the same transaction, which a full pool rolls
+ * back with ErrPoolFull
+ */
+func lhash_map_insert(ptr *data, key int, value int) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		ref := lhash_map_find(ptr, key)
+		if *ref != nil {
+			(*ref).value = value
+			return nil
+		}
+		e := pnew(entry_t)
+		if ptr.count + 1 > LHASH_MAP_MAX_LOAD * lhash_map_buckets(ptr) {
+			lhash_map_split(ptr)
+			ref = lhash_map_find(ptr, key)
+		}
+		e.key = key
+		e.value = value
+		*ref = e
+		ptr.count++
+	}
+	return nil
+}
+
+/*
+ * lhash_map_remove -- removes the key from the map, returning its value and
+ * whether it was found; buckets are never merged back
+ */
+func lhash_map_remove(ptr *data, key int) (int, bool) {
+	ref := lhash_map_find(ptr, key)
+	if *ref == nil {
+		return 0, false
+	}
+	value := (*ref).value
+	txn("undo") {
+		*ref = (*ref).next
+		ptr.count--
+	}
+	return value, true
+}
+
+/*
+ * lhash_map_get -- searches for the value of the key
+ */
+func lhash_map_get(ptr *data, key int) (int, bool) {
+	if e := *lhash_map_find(ptr, key); e != nil {
+		return e.value, true
+	}
+	return 0, false
+}
+
+/*
+ * lhash_map_lookup -- checks if the key exists in the map
+ */
+func lhash_map_lookup(ptr *data, key int) bool {
+	return *lhash_map_find(ptr, key) != nil
+}
+
+/*
+ * lhash_map_foreach -- calls cb for every pair, in no particular order,
+ * stopping early when cb returns true
+ */
+func lhash_map_foreach(ptr *data, cb func(int, int) bool) bool {
+	n := lhash_map_buckets(ptr)
+	for b := 0; b < n; b++ {
+		for e := *lhash_map_bucket(ptr, b); e != nil; e = e.next {
+			if cb(e.key, e.value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * lhash_map_clear -- removes all pairs from the map and shrinks it back to
+ * its initial size
+ */
+func lhash_map_clear(ptr *data) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		dir := pmake([]*segment_t, 1)
+		dir[0] = pnew(segment_t)
+		ptr.dir = dir
+		ptr.level = 0
+		ptr.split = 0
+		ptr.count = 0
+	}
+	return nil
+}
+
+/*
+ * lhash_map_check -- verifies that every key is in the bucket it addresses,
+ * that no key is stored twice and that count is right; returns the length of
+ * the longest chain
+ */
+func lhash_map_check(ptr *data) (int, error) {
+	n := lhash_map_buckets(ptr)
+	if (n - 1) / LHASH_MAP_SEGMENT >= len(ptr.dir) {
+		return 0, fmt.Errorf("%d buckets in a directory of %d segments",
+			n, len(ptr.dir))
+	}
+	entries, longest := 0, 0
+	for b := 0; b < n; b++ {
+		chain := 0
+		for e := *lhash_map_bucket(ptr, b); e != nil; e = e.next {
+			if a := lhash_map_address(ptr, e.key); a != b {
+				return 0, fmt.Errorf("key %d in bucket %d, belongs in %d",
+					e.key, b, a)
+			}
+			if *lhash_map_find(ptr, e.key) != e {
+				return 0, fmt.Errorf("key %d is stored twice", e.key)
+			}
+			chain++
+		}
+		if chain > longest {
+			longest = chain
+		}
+		entries += chain
+	}
+	if entries != ptr.count {
+		return 0, fmt.Errorf("%d entries, count is %d", entries, ptr.count)
+	}
+	return longest, nil
+}
+
+/*
+ * str_insert -- lhash_map_insert wrapper which works on strings
+ */
+func str_insert(ptr *data, str string) {
+	var key int
+	if scan_args("insert", str, "%d", &key) {
+		if err := lhash_map_insert(ptr, key, 0); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- lhash_map_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key int
+	if scan_args("remove", str, "%d", &key) {
+		if _, ok := lhash_map_remove(ptr, key); !ok {
+			fmt.Println("no such value")
+		}
+	}
+}
+
+/*
+ * str_check -- lhash_map_lookup wrapper which works on strings
+ */
+func str_check(ptr *data, str string) {
+	var key int
+	if scan_args("check", str, "%d", &key) {
+		fmt.Println(lhash_map_lookup(ptr, key))
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := lhash_map_insert(ptr, rand.Int(), 0); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+/*
+ * str_clear -- lhash_map_clear wrapper which reports its error
+ */
+func str_clear(ptr *data) {
+	if err := lhash_map_clear(ptr); err != nil {
+		fmt.Println("clear:", err)
+	}
+}
+
+func help() {
+	print_help(
+		"i $value - insert $value",
+		"r $value - remove $value",
+		"c $value - check $value, returns 0/1",
+		"n $value - insert $value random values",
+		"p - print all values",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	lhash_map_foreach(ptr, func(key int, value int) bool {
+		fmt.Print(key, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if longest, err := lhash_map_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Printf("entries: %d buckets: %d level: %d split: %d longest chain: %d\n",
+			ptr.count, lhash_map_buckets(ptr), ptr.level, ptr.split, longest)
+	}
+}
+
+/*
+ * Run -- opens the map named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("lhash_map", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'c': str_check(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* large prime number used as a hashing function coefficient */
+const HASH_FUNC_COEFF_P uint64 = 32212254719
+
+/* number of entries of a cache created without -capacity */
+const LRU_DEFAULT_CAPACITY int = 16
+
+/*
+ * entry_t -- a cached pair, in the chain of its bucket through hnext and in
+ * the recency list through prev and next
+ */
+type entry_t struct {
+	key   int
+	value int
+	hnext *entry_t
+	prev  *entry_t
+	next  *entry_t
+}
+
+/*
+ * data -- the cache holds at most capacity entries, hashed into as many
+ * buckets; head is the most recently used entry and tail the one evicted
+ * next
+ */
+type data struct {
+	/* hash function coefficients */
+	hash_fun_a uint64
+	hash_fun_b uint64
+	hash_fun_p uint64
+
+	capacity int
+	buckets  []*entry_t
+	head     *entry_t
+	tail     *entry_t
+	count    int
+
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x3A9F0C6B2E81D574
+)
+
+/* hits, misses and evictions since the cache was opened */
+var lru_hits, lru_misses, lru_evictions int
+
+/*
+ * initialize -- creates an empty cache of capacity entries, with hash
+ * function coefficients drawn from seed
+ */
+func initialize(ptr *data, capacity int, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	txn("undo") {
+		ptr.hash_fun_a = uint64(rng.Int63n(1000)) + 1
+		ptr.hash_fun_b = uint64(rng.Int63n(100000))
+		ptr.hash_fun_p = HASH_FUNC_COEFF_P
+		ptr.capacity = capacity
+		ptr.buckets = pmake([]*entry_t, capacity)
+		ptr.head = nil
+		ptr.tail = nil
+		ptr.count = 0
+		ptr.magic = magic
+	}
+}
+
+/*
+ * hash -- the simplest hashing function,
+ * see https://en.wikipedia.org/wiki/Universal_hashing#Hashing_integers
+ */
+func hash(ptr *data, key int) int {
+	a, c, p := ptr.hash_fun_a, ptr.hash_fun_b, ptr.hash_fun_p
+	return int((a * uint64(key) + c) % p % uint64(len(ptr.buckets)))
+}
+
+/*
+ * lru_link -- (internal) returns the link to the entry of key in its bucket,
+ * which points to nil if the key is not cached
+ */
+func lru_link(ptr *data, key int) **entry_t {
+	link := &ptr.buckets[hash(ptr, key)]
+	for *link != nil && (*link).key != key {
+		link = &(*link).hnext
+	}
+	return link
+}
+
+/*
+ * lru_unlink -- (internal) takes e out of the recency list; must be called
+ * in a transaction
+ */
+func lru_unlink(ptr *data, e *entry_t) {
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		ptr.head = e.next
+	}
+	if e.next != nil {
+		e.next.prev = e.prev
+	} else {
+		ptr.tail = e.prev
+	}
+	e.prev = nil
+	e.next = nil
+}
+
+/*
+ * lru_push_front -- (internal) makes e the most recently used entry; must be
+ * called in a transaction
+ */
+func lru_push_front(ptr *data, e *entry_t) {
+	e.next = ptr.head
+	if ptr.head != nil {
+		ptr.head.prev = e
+	} else {
+		ptr.tail = e
+	}
+	ptr.head = e
+}
+
+/*
+ * lru_drop -- (internal) removes e from its bucket and from the recency
+ * list; must be called in a transaction
+ */
+func lru_drop(ptr *data, e *entry_t) {
+	link := lru_link(ptr, e.key)
+	*link = e.hnext
+	e.hnext = nil
+	lru_unlink(ptr, e)
+	ptr.count--
+}
+
+/*
+ * lru_get -- returns the value of key if it is cached, making it the most
+ * recently used entry
+ */
+func lru_get(ptr *data, key int) (int, bool) {
+	e := *lru_link(ptr, key)
+	if e == nil {
+		lru_misses++
+		return 0, false
+	}
+	lru_hits++
+	if e != ptr.head {
+		txn("undo") {
+			lru_unlink(ptr, e)
+			lru_push_front(ptr, e)
+		}
+	}
+	return e.value, true
+}
+
+/*
+ * lru_put -- caches value under key as the most recently used entry; a full
+ * cache first evicts its least recently used entry, whose key is returned,
+ * and whose memory is reused for the new one, all in one transaction
+ */
+func lru_put(ptr *data, key int, value int) (evicted int, full bool, err error) {
+	if e := *lru_link(ptr, key); e != nil {
+		txn("undo") {
+			e.value = value
+			lru_unlink(ptr, e)
+			lru_push_front(ptr, e)
+		}
+		return 0, false, nil
+	}
+
+	full = ptr.count == ptr.capacity
+	defer pool_full(&err)
+	txn("undo") {
+		var e *entry_t
+		if full {
+			e = ptr.tail
+			evicted = e.key
+			lru_drop(ptr, e)
+		} else {
+			e = pnew(entry_t)
+		}
+		e.key = key
+		e.value = value
+		link := &ptr.buckets[hash(ptr, key)]
+		e.hnext = *link
+		*link = e
+		lru_push_front(ptr, e)
+		ptr.count++
+	}
+	if full {
+		lru_evictions++
+	}
+	return evicted, full, nil
+}
+
+/*
+ * lru_evict -- removes the least recently used entry, returning its key and
+ * value, and false if the cache is empty
+ */
+func lru_evict(ptr *data) (int, int, bool) {
+	e := ptr.tail
+	if e == nil {
+		return 0, 0, false
+	}
+	txn("undo") {
+		lru_drop(ptr, e)
+	}
+	lru_evictions++
+	return e.key, e.value, true
+}
+
+/*
+ * lru_remove -- removes key from the cache, returning whether it was cached
+ */
+func lru_remove(ptr *data, key int) bool {
+	e := *lru_link(ptr, key)
+	if e == nil {
+		return false
+	}
+	txn("undo") {
+		lru_drop(ptr, e)
+	}
+	return true
+}
+
+/*
+ * lru_foreach -- calls cb for every pair from the most recently used on,
+ * without updating the recency, stopping early when cb returns true
+ */
+func lru_foreach(ptr *data, cb func(int, int) bool) bool {
+	for e := ptr.head; e != nil; e = e.next {
+		if cb(e.key, e.value) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * lru_clear -- removes all entries
+ */
+func lru_clear(ptr *data) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		buckets := pmake([]*entry_t, ptr.capacity)
+		ptr.buckets = buckets
+		ptr.head = nil
+		ptr.tail = nil
+		ptr.count = 0
+	}
+	return nil
+}
+
+/*
+ * lru_check -- verifies that the recency list is linked both ways, that it
+ * holds exactly the entries of the buckets, each in the bucket of its hash,
+ * and that count is right and within the capacity
+ */
+func lru_check(ptr *data) error {
+	listed := make(map[*entry_t]bool)
+	var prev *entry_t = nil
+	for e := ptr.head; e != nil; e = e.next {
+		if e.prev != prev {
+			return fmt.Errorf("key %d does not link back to its predecessor", e.key)
+		}
+		if listed[e] {
+			return fmt.Errorf("key %d is listed twice", e.key)
+		}
+		listed[e] = true
+		prev = e
+	}
+	if ptr.tail != prev {
+		return errors.New("the tail is not the last entry")
+	}
+	hashed := 0
+	for i, e := range ptr.buckets {
+		for ; e != nil; e = e.hnext {
+			if hash(ptr, e.key) != i {
+				return fmt.Errorf("key %d is in bucket %d", e.key, i)
+			}
+			if !listed[e] {
+				return fmt.Errorf("key %d is not in the recency list", e.key)
+			}
+			hashed++
+		}
+	}
+	if hashed != len(listed) || hashed != ptr.count {
+		return fmt.Errorf("%d entries hashed and %d listed, count is %d",
+			hashed, len(listed), ptr.count)
+	}
+	if ptr.count > ptr.capacity {
+		return fmt.Errorf("%d entries in a cache of %d", ptr.count, ptr.capacity)
+	}
+	return nil
+}
+
+/*
+ * str_put -- lru_put wrapper which works on strings, printing the key
+ * evicted if any
+ */
+func str_put(ptr *data, str string) {
+	var key, value int
+	if scan_args("put", str, "%d %d", &key, &value) {
+		if evicted, ok, err := lru_put(ptr, key, value); err != nil {
+			fmt.Println("put:", err)
+		} else if ok {
+			fmt.Println("evicted", evicted)
+		}
+	}
+}
+
+/*
+ * str_get -- lru_get wrapper which works on strings
+ */
+func str_get(ptr *data, str string) {
+	var key int
+	if scan_args("get", str, "%d", &key) {
+		if value, ok := lru_get(ptr, key); ok {
+			fmt.Println(value)
+		} else {
+			fmt.Println("no such key")
+		}
+	}
+}
+
+/*
+ * str_remove -- lru_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key int
+	if scan_args("remove", str, "%d", &key) {
+		if !lru_remove(ptr, key) {
+			fmt.Println("no such key")
+		}
+	}
+}
+
+/*
+ * str_evict -- lru_evict wrapper which prints the pair evicted
+ */
+func str_evict(ptr *data) {
+	if key, value, ok := lru_evict(ptr); ok {
+		fmt.Println(key, value)
+	} else {
+		fmt.Println("cache is empty")
+	}
+}
+
+/*
+ * str_insert_random -- puts specified (as string) number of random keys,
+ * drawn from twice the capacity so that some are hits
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			key := rand.Intn(2 * ptr.capacity)
+			if _, ok := lru_get(ptr, key); ok {
+				continue
+			}
+			if _, _, err := lru_put(ptr, key, rand.Int()); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+/*
+ * str_clear -- lru_clear wrapper which reports its error
+ */
+func str_clear(ptr *data) {
+	if err := lru_clear(ptr); err != nil {
+		fmt.Println("clear:", err)
+	}
+}
+
+func help() {
+	print_help(
+		"i $key $value - put $value under $key, print the key evicted if any",
+		"g $key - print the value of $key and mark it used",
+		"r $key - remove $key",
+		"e - evict the least recently used key, print it with its value",
+		"n $value - look up $value random keys, putting the misses",
+		"p - print all pairs from the most recently used",
+		"d - print debug info",
+		"x - remove all keys",
+	)
+}
+
+func print_all(ptr *data) {
+	lru_foreach(ptr, func(key int, value int) bool {
+		fmt.Println(key, value)
+		return false
+	})
+}
+
+func print_debug(ptr *data) {
+	if err := lru_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+		return
+	}
+	fmt.Println("invariants: ok")
+	fmt.Println("count:", ptr.count, "capacity:", ptr.capacity)
+	fmt.Println("hits:", lru_hits, "misses:", lru_misses, "evictions:", lru_evictions)
+}
+
+/*
+ * Run -- opens the cache named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("lru", flag.ContinueOnError)
+	flags.Usage = func() {}
+	capacity := flags.Int("capacity", LRU_DEFAULT_CAPACITY, "number of entries when the cache is created")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	if *capacity <= 0 {
+		return usage_error("the cache needs a positive capacity")
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr, *capacity, time.Now().UnixNano())
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_put(ptr, buf[1:])
+			case 'g': str_get(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'e': str_evict(ptr)
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "[-capacity n] filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vmware/go-pmem-transaction/pmem"
+)
+
+// The tests share one pool, as go-pmem maps a single pool per process.
+func TestMain(m *testing.M) {
+	pool := filepath.Join(os.TempDir(), fmt.Sprintf("lru_test.%d.pool", os.Getpid()))
+	pmem.Init(pool)
+	status := m.Run()
+	os.Remove(pool)
+	os.Exit(status)
+}
+
+// lru_keys returns the keys of the cache from the most recently used.
+func lru_keys(ptr *data) []int {
+	keys := []int{}
+	lru_foreach(ptr, func(key int, value int) bool {
+		keys = append(keys, key)
+		return false
+	})
+	return keys
+}
+
+// lru_model is the recency order of a cache, from the most recently used.
+type lru_model []int
+
+// use moves key to the front, adding it if it is not there.
+func (m *lru_model) use(key int) {
+	m.drop(key)
+	*m = append(lru_model{key}, *m...)
+}
+
+// find returns the position of key, or -1.
+func (m lru_model) find(key int) int {
+	for i, k := range m {
+		if k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// drop removes key, reporting whether it was there.
+func (m *lru_model) drop(key int) bool {
+	i := m.find(key)
+	if i < 0 {
+		return false
+	}
+	*m = append((*m)[:i], (*m)[i + 1:]...)
+	return true
+}
+
+// Random puts, gets, removes and evictions keep the cache consistent, within
+// its capacity, and in the recency order of a model of it.
+func TestLruInvariants(t *testing.T) {
+	const capacity = 8
+	ptr := pnew(data)
+	initialize(ptr, capacity, 1)
+	rng := rand.New(rand.NewSource(1))
+	model := lru_model{}
+	for i := 0; i < 2000; i++ {
+		key := rng.Intn(24)
+		switch rng.Intn(4) {
+			case 0:
+				evicted, full, err := lru_put(ptr, key, i)
+				if err != nil {
+					t.Fatalf("step %d: put of %d: %v", i, key, err)
+				}
+				want_full := len(model) == capacity && model.find(key) < 0
+				if full != want_full {
+					t.Fatalf("step %d: put of %d evicted %v, want %v", i, key, full, want_full)
+				}
+				if full {
+					if last := model[len(model) - 1]; evicted != last {
+						t.Fatalf("step %d: put of %d evicted %d, want %d", i, key, evicted, last)
+					}
+					model.drop(evicted)
+				}
+				model.use(key)
+			case 1:
+				if _, ok := lru_get(ptr, key); ok {
+					model.use(key)
+				}
+			case 2:
+				if lru_remove(ptr, key) != model.drop(key) {
+					t.Fatalf("step %d: remove of %d disagrees with the model", i, key)
+				}
+			case 3:
+				if evicted, _, ok := lru_evict(ptr); ok {
+					if last := model[len(model) - 1]; evicted != last {
+						t.Fatalf("step %d: evicted %d, want %d", i, evicted, last)
+					}
+					model.drop(evicted)
+				}
+		}
+		if err := lru_check(ptr); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if got := lru_keys(ptr); !reflect.DeepEqual(got, []int(model)) {
+			t.Fatalf("step %d: the cache holds %v, want %v", i, got, model)
+		}
+	}
+}
+
+// lru_check finds a broken back link, an entry in the wrong bucket and a
+// wrong count.
+func TestLruCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(ptr *data)
+	}{
+		{"back link", func(ptr *data) { ptr.head.next.prev = nil }},
+		{"bucket", func(ptr *data) {
+			/* a key of another bucket */
+			h := hash(ptr, ptr.head.key)
+			for hash(ptr, ptr.head.key) == h {
+				ptr.head.key++
+			}
+		}},
+		{"count", func(ptr *data) { ptr.count++ }},
+	}
+	for _, tc := range tests {
+		ptr := pnew(data)
+		initialize(ptr, 4, 1)
+		for key := 1; key <= 3; key++ {
+			lru_put(ptr, key, 0)
+		}
+		if err := lru_check(ptr); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		tc.corrupt(ptr)
+		if lru_check(ptr) == nil {
+			t.Errorf("%s: the broken cache passed the check", tc.name)
+		}
+	}
+}
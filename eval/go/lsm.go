@@ -0,0 +1,440 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* number of entries the memtable holds before it is flushed into a run */
+const LSM_MEMTABLE_SIZE int = 64
+
+/* number of runs above which a flush compacts all of them into one */
+const LSM_MAX_RUNS int = 4
+
+/*
+ * entry_t -- a deleted entry is a tombstone, which hides the key in the
+ * older runs until a compaction drops them both
+ */
+type entry_t struct {
+	key     int
+	value   int
+	deleted bool
+}
+
+/*
+ * run_t -- entries sorted by key, never modified once the run is built
+ */
+type run_t struct {
+	entries []entry_t
+}
+
+/*
+ * data -- mem[:mem_n] is the memtable, sorted by key; runs go from the
+ * newest to the oldest
+ */
+type data struct {
+	mem   []entry_t
+	mem_n int
+	runs  []*run_t
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x6E1B8C4F25A07D93
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.mem = pmake([]entry_t, LSM_MEMTABLE_SIZE)
+		ptr.mem_n = 0
+		ptr.runs = nil
+		ptr.magic = magic
+	}
+}
+
+/*
+ * lsm_search -- (internal) returns the position of the first entry of the
+ * sorted entries whose key is not less than key
+ */
+func lsm_search(entries []entry_t, key int) int {
+	return sort.Search(len(entries), func(i int) bool {
+		return entries[i].key >= key
+	})
+}
+
+/*
+ * lsm_merge -- (internal) calls cb in key order for the newest entry of every
+ * key in sources, which go from the newest to the oldest, unless that entry
+ * is a tombstone
+ */
+func lsm_merge(sources [][]entry_t, cb func(entry_t) bool) bool {
+	pos := make([]int, len(sources))
+	for {
+		/* the smallest key left, taken from the newest source holding it */
+		src := -1
+		for s := range sources {
+			if pos[s] < len(sources[s]) &&
+				(src == -1 || sources[s][pos[s]].key < sources[src][pos[src]].key) {
+				src = s
+			}
+		}
+		if src == -1 {
+			return false
+		}
+		e := sources[src][pos[src]]
+		for s := range sources {
+			if pos[s] < len(sources[s]) && sources[s][pos[s]].key == e.key {
+				pos[s]++
+			}
+		}
+		if !e.deleted && cb(e) {
+			return true
+		}
+	}
+}
+
+/*
+ * lsm_sources -- (internal) returns the memtable and the runs, from the
+ * newest to the oldest
+ */
+func lsm_sources(ptr *data) [][]entry_t {
+	sources := [][]entry_t{ptr.mem[:ptr.mem_n]}
+	for _, r := range ptr.runs {
+		sources = append(sources, r.entries)
+	}
+	return sources
+}
+
+/*
+ * lsm_new_run -- (internal) allocates a run holding a copy of entries
+ */
+func lsm_new_run(entries []entry_t) *run_t {
+	r := pnew(run_t)
+	r.entries = pmake([]entry_t, len(entries))
+	copy(r.entries, entries)
+	return r
+}
+
+/*
+ * lsm_compact -- merges all the runs into a single one; the
+ * tombstones are dropped since no older run is left for them to hide
+ */
+func lsm_compact(ptr *data) (err error) {
+	var merged []entry_t
+	lsm_merge(lsm_sources(ptr)[1:], func(e entry_t) bool {
+		merged = append(merged, e)
+		return false
+	})
+	defer pool_full(&err)
+	txn("undo") {
+		if len(merged) == 0 {
+			ptr.runs = nil
+			return nil
+		}
+		runs := pmake([]*run_t, 1)
+		runs[0] = lsm_new_run(merged)
+		ptr.runs = runs
+	}
+	return nil
+}
+
+/*
+ * lsm_flush -- turns the memtable into the newest run, compacting the runs
+ * once there are more than LSM_MAX_RUNS of them
+ */
+func lsm_flush(ptr *data) (err error) {
+	if ptr.mem_n == 0 {
+		return nil
+	}
+	defer pool_full(&err)
+	txn("undo") {
+		runs := pmake([]*run_t, len(ptr.runs) + 1)
+		runs[0] = lsm_new_run(ptr.mem[:ptr.mem_n])
+		copy(runs[1:], ptr.runs)
+		ptr.runs = runs
+		ptr.mem_n = 0
+		if len(ptr.runs) > LSM_MAX_RUNS {
+			/* a full pool only delays the compaction to the next flush */
+			lsm_compact(ptr)
+		}
+	}
+	return nil
+}
+
+/*
+ * lsm_write -- (internal) stores the entry in the memtable, flushing it first
+ * if the key is new and there is no room for it
+ */
+func lsm_write(ptr *data, e entry_t) error {
+	txn("undo") {
+		p := lsm_search(ptr.mem[:ptr.mem_n], e.key)
+		if p < ptr.mem_n && ptr.mem[p].key == e.key {
+			ptr.mem[p] = e
+			return nil
+		}
+		if ptr.mem_n == len(ptr.mem) {
+			if err := lsm_flush(ptr); err != nil {
+				return err
+			}
+			p = 0
+		}
+		copy(ptr.mem[p + 1:ptr.mem_n + 1], ptr.mem[p:ptr.mem_n])
+		ptr.mem[p] = e
+		ptr.mem_n++
+	}
+	return nil
+}
+
+/*
+ * lsm_put -- inserts a key-value pair, replacing the value of the key if it
+ * is present
+ */
+func lsm_put(ptr *data, key int, value int) error {
+	return lsm_write(ptr, entry_t{key, value, false})
+}
+
+/*
+ * lsm_delete -- removes the key, returning whether it was present; the key
+ * is only hidden by a tombstone until the next compaction
+ */
+func lsm_delete(ptr *data, key int) (bool, error) {
+	if _, ok := lsm_get(ptr, key); !ok {
+		return false, nil
+	}
+	return true, lsm_write(ptr, entry_t{key, 0, true})
+}
+
+/*
+ * lsm_get -- searches for the value of the key in the memtable, then in the
+ * runs from the newest to the oldest
+ */
+func lsm_get(ptr *data, key int) (int, bool) {
+	for _, entries := range lsm_sources(ptr) {
+		p := lsm_search(entries, key)
+		if p < len(entries) && entries[p].key == key {
+			return entries[p].value, !entries[p].deleted
+		}
+	}
+	return 0, false
+}
+
+/*
+ * lsm_foreach -- calls cb for every live pair in key order, stopping early
+ * when cb returns true
+ */
+func lsm_foreach(ptr *data, cb func(int, int) bool) bool {
+	return lsm_merge(lsm_sources(ptr), func(e entry_t) bool {
+		return cb(e.key, e.value)
+	})
+}
+
+/*
+ * lsm_clear -- removes all pairs from the store
+ */
+func lsm_clear(ptr *data) {
+	txn("undo") {
+		ptr.mem_n = 0
+		ptr.runs = nil
+	}
+}
+
+/*
+ * lsm_check -- verifies that the memtable and every run are sorted without
+ * duplicate keys and that no run is empty; returns the number of entries
+ * stored, tombstones and shadowed ones included
+ */
+func lsm_check(ptr *data) (int, error) {
+	if ptr.mem_n < 0 || ptr.mem_n > len(ptr.mem) {
+		return 0, fmt.Errorf("memtable of %d entries and room for %d",
+			ptr.mem_n, len(ptr.mem))
+	}
+	stored := 0
+	for s, entries := range lsm_sources(ptr) {
+		if s > 0 && len(entries) == 0 {
+			return 0, fmt.Errorf("run %d is empty", s - 1)
+		}
+		for i := 1; i < len(entries); i++ {
+			if entries[i - 1].key >= entries[i].key {
+				where := "memtable"
+				if s > 0 {
+					where = fmt.Sprint("run ", s - 1)
+				}
+				return 0, fmt.Errorf("key %d in the %s is out of order",
+					entries[i].key, where)
+			}
+		}
+		stored += len(entries)
+	}
+	return stored, nil
+}
+
+/*
+ * str_insert -- inserts the key and the value given as a string
+ */
+func str_insert(ptr *data, str string) {
+	var key, value int
+	if scan_args("insert", str, "%d %d", &key, &value) {
+		if err := lsm_put(ptr, key, value); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- lsm_delete wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key int
+	if scan_args("remove", str, "%d", &key) {
+		if ok, err := lsm_delete(ptr, key); err != nil {
+			fmt.Println("remove:", err)
+		} else if !ok {
+			fmt.Println("no such key")
+		}
+	}
+}
+
+/*
+ * str_get -- prints the value of the key given as a string
+ */
+func str_get(ptr *data, str string) {
+	var key int
+	if scan_args("get", str, "%d", &key) {
+		if value, ok := lsm_get(ptr, key); ok {
+			fmt.Println(value)
+		} else {
+			fmt.Println("no such key")
+		}
+	}
+}
+
+/*
+ * str_flush -- lsm_flush wrapper which reports its error
+ */
+func str_flush(ptr *data) {
+	if err := lsm_flush(ptr); err != nil {
+		fmt.Println("flush:", err)
+	}
+}
+
+/*
+ * str_compact -- lsm_compact wrapper which reports its error
+ */
+func str_compact(ptr *data) {
+	if len(ptr.runs) == 0 {
+		return
+	}
+	if err := lsm_compact(ptr); err != nil {
+		fmt.Println("compact:", err)
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random keys
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := lsm_put(ptr, rand.Int(), i); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"i $key $value - insert $key with $value",
+		"r $key - remove $key",
+		"g $key - print the value of $key",
+		"f - flush the memtable into a run",
+		"m - merge all runs into one",
+		"n $value - insert $value random keys",
+		"p - print all pairs",
+		"d - print debug info",
+		"x - remove all pairs",
+	)
+}
+
+func print_all(ptr *data) {
+	lsm_foreach(ptr, func(key int, value int) bool {
+		fmt.Println(key, value)
+		return false
+	})
+}
+
+func print_debug(ptr *data) {
+	stored, err := lsm_check(ptr)
+	if err != nil {
+		fmt.Println("invariants:", err)
+		return
+	}
+	fmt.Println("invariants: ok")
+	fmt.Println("memtable:", ptr.mem_n, "of", len(ptr.mem), "entries")
+	for i, r := range ptr.runs {
+		fmt.Println("run", i, "entries:", len(r.entries))
+	}
+	fmt.Println("stored entries:", stored)
+}
+
+/*
+ * Run -- opens the store named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("lsm", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'g': str_get(ptr, buf[1:])
+			case 'f': str_flush(ptr)
+			case 'm': str_compact(ptr)
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': lsm_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
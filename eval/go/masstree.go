@@ -0,0 +1,772 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* most entries of a leaf, and separators of an interior node */
+const MT_WIDTH int = 8
+
+/* key length of an entry whose key goes on past its slice */
+const MT_CONT int = 9
+
+/*
+ * ikey_t -- the part of a key a layer orders by: the next 8 bytes of the key,
+ * big-endian and padded with zeros, and how many of them the key has, or
+ * MT_CONT if it is longer; comparing slice then klen orders the keys of a
+ * layer as their bytes compare
+ */
+type ikey_t struct {
+	slice uint64
+	klen  int
+}
+
+/*
+ * entry_t -- the value of a key ending in this layer, or for a key going
+ * on, either the rest of it in suffix when it is the only key of the layer
+ * with its slice, or the next layer, which holds every such key
+ */
+type entry_t struct {
+	value  int
+	suffix []byte
+	layer  *layer_t
+}
+
+/*
+ * node_t -- a node of the B+-tree of a layer: a leaf holds n entries, an
+ * interior node n separators and n + 1 children, child i holding the keys
+ * from keys[i-1] up to but not including keys[i]
+ */
+type node_t struct {
+	leaf     bool
+	n        int
+	keys     [MT_WIDTH]ikey_t
+	entries  [MT_WIDTH]entry_t
+	children [MT_WIDTH + 1]*node_t
+}
+
+/*
+ * layer_t -- the keys sharing a prefix of a multiple of 8 bytes, by the
+ * slice following it
+ */
+type layer_t struct {
+	root *node_t
+}
+
+type data struct {
+	layer *layer_t
+	count int
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x6E20B4D9A7F3158C
+)
+
+/*
+ * mt_new_layer -- (internal) allocates an empty layer; must be called in a
+ * transaction
+ */
+func mt_new_layer() *layer_t {
+	l := pnew(layer_t)
+	l.root = mt_new_node(true)
+	return l
+}
+
+/*
+ * mt_new_node -- (internal) allocates an empty node; must be called in a
+ * transaction
+ */
+func mt_new_node(leaf bool) *node_t {
+	n := pnew(node_t)
+	n.leaf = leaf
+	return n
+}
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.layer = pnew(layer_t)
+		ptr.layer.root = pnew(node_t)
+		ptr.layer.root.leaf = true
+		ptr.count = 0
+		ptr.magic = magic
+	}
+}
+
+/*
+ * mt_ikey -- returns the ikey of the rest of a key in a layer
+ */
+func mt_ikey(rest []byte) ikey_t {
+	var buf [8]byte
+	n := copy(buf[:], rest)
+	if len(rest) > 8 {
+		n = MT_CONT
+	}
+	return ikey_t{binary.BigEndian.Uint64(buf[:]), n}
+}
+
+/*
+ * mt_ikey_bytes -- returns the bytes of the key an ikey holds
+ */
+func mt_ikey_bytes(ik ikey_t) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, ik.slice)
+	if ik.klen < MT_CONT {
+		return buf[:ik.klen]
+	}
+	return buf
+}
+
+/*
+ * mt_compare -- returns -1, 0 or 1 as a is before, the same as or after b
+ */
+func mt_compare(a ikey_t, b ikey_t) int {
+	switch {
+	case a.slice < b.slice:
+		return -1
+	case a.slice > b.slice:
+		return 1
+	case a.klen < b.klen:
+		return -1
+	case a.klen > b.klen:
+		return 1
+	}
+	return 0
+}
+
+/*
+ * mt_route -- (internal) returns the child of interior node n holding ik
+ */
+func mt_route(n *node_t, ik ikey_t) int {
+	i := 0
+	for i < n.n && mt_compare(n.keys[i], ik) <= 0 {
+		i++
+	}
+	return i
+}
+
+/*
+ * mt_find -- (internal) returns the leaf of layer l which holds ik, or would,
+ * and the position of ik in it, and whether it is there
+ */
+func mt_find(l *layer_t, ik ikey_t) (*node_t, int, bool) {
+	n := l.root
+	for !n.leaf {
+		n = n.children[mt_route(n, ik)]
+	}
+	i := 0
+	for i < n.n && mt_compare(n.keys[i], ik) < 0 {
+		i++
+	}
+	return n, i, i < n.n && n.keys[i] == ik
+}
+
+/*
+ * mt_node_insert -- (internal) adds ik to the subtree of n with a zeroed
+ * entry, ik not being there yet; a full node is split, its upper half moved
+ * to a new node returned with the separator to put before it in the parent;
+ * must be called in a transaction
+ */
+func mt_node_insert(n *node_t, ik ikey_t) (*node_t, ikey_t) {
+	keys := make([]ikey_t, 0, MT_WIDTH + 1)
+	keys = append(keys, n.keys[:n.n]...)
+	if n.leaf {
+		p := 0
+		for p < n.n && mt_compare(n.keys[p], ik) < 0 {
+			p++
+		}
+		entries := make([]entry_t, 0, MT_WIDTH + 1)
+		entries = append(entries, n.entries[:n.n]...)
+		keys = append(keys[:p], append([]ikey_t{ik}, keys[p:]...)...)
+		entries = append(entries[:p], append([]entry_t{{}}, entries[p:]...)...)
+		if len(keys) <= MT_WIDTH {
+			copy(n.keys[:], keys)
+			copy(n.entries[:], entries)
+			n.n = len(keys)
+			return nil, ikey_t{}
+		}
+		mid := len(keys) / 2
+		right := mt_new_node(true)
+		n.n = copy(n.keys[:], keys[:mid])
+		copy(n.entries[:], entries[:mid])
+		for i := mid; i < MT_WIDTH; i++ {
+			n.keys[i] = ikey_t{}
+			n.entries[i] = entry_t{}
+		}
+		right.n = copy(right.keys[:], keys[mid:])
+		copy(right.entries[:], entries[mid:])
+		return right, right.keys[0]
+	}
+
+	i := mt_route(n, ik)
+	child, sep := mt_node_insert(n.children[i], ik)
+	if child == nil {
+		return nil, ikey_t{}
+	}
+	children := make([]*node_t, 0, MT_WIDTH + 2)
+	children = append(children, n.children[:n.n + 1]...)
+	keys = append(keys[:i], append([]ikey_t{sep}, keys[i:]...)...)
+	children = append(children[:i + 1], append([]*node_t{child}, children[i + 1:]...)...)
+	if len(keys) <= MT_WIDTH {
+		n.n = copy(n.keys[:], keys)
+		copy(n.children[:], children)
+		return nil, ikey_t{}
+	}
+	mid := len(keys) / 2
+	right := mt_new_node(false)
+	n.n = copy(n.keys[:], keys[:mid])
+	copy(n.children[:], children[:mid + 1])
+	for j := mid; j < MT_WIDTH; j++ {
+		n.keys[j] = ikey_t{}
+		n.children[j + 1] = nil
+	}
+	right.n = copy(right.keys[:], keys[mid + 1:])
+	copy(right.children[:], children[mid + 1:])
+	return right, keys[mid]
+}
+
+/*
+ * mt_layer_insert -- (internal) returns the entry of ik in layer l, adding
+ * it if it is not there, and whether it was added; must be called in a
+ * transaction
+ */
+func mt_layer_insert(l *layer_t, ik ikey_t) (*entry_t, bool) {
+	if n, i, found := mt_find(l, ik); found {
+		return &n.entries[i], false
+	}
+	if right, sep := mt_node_insert(l.root, ik); right != nil {
+		root := mt_new_node(false)
+		root.n = 1
+		root.keys[0] = sep
+		root.children[0] = l.root
+		root.children[1] = right
+		l.root = root
+	}
+	n, i, _ := mt_find(l, ik)
+	return &n.entries[i], true
+}
+
+/*
+ * mt_insert_in -- (internal) inserts the rest of a key with value in layer
+ * l, and returns whether the key is new; must be called in a transaction
+ */
+func mt_insert_in(l *layer_t, rest []byte, value int) bool {
+	ik := mt_ikey(rest)
+	e, added := mt_layer_insert(l, ik)
+	switch {
+	case ik.klen < MT_CONT:
+		e.value = value
+		return added
+	case added:
+		e.value = value
+		e.suffix = pmake([]byte, len(rest) - 8)
+		copy(e.suffix, rest[8:])
+		return true
+	case e.layer != nil:
+		return mt_insert_in(e.layer, rest[8:], value)
+	case bytes.Equal(e.suffix, rest[8:]):
+		e.value = value
+		return false
+	}
+	/* a second key with the slice: both move to a new layer */
+	layer := mt_new_layer()
+	mt_insert_in(layer, e.suffix, e.value)
+	mt_insert_in(layer, rest[8:], value)
+	e.layer = layer
+	e.suffix = nil
+	e.value = 0
+	return true
+}
+
+/*
+ * mt_insert -- inserts key with value, or replaces the value of key, in one
+ * transaction which a full pool rolls back with ErrPoolFull
+ */
+func mt_insert(ptr *data, key []byte, value int) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		if mt_insert_in(ptr.layer, key, value) {
+			ptr.count++
+		}
+	}
+	return nil
+}
+
+/*
+ * mt_get -- returns the value of key
+ */
+func mt_get(ptr *data, key []byte) (int, bool) {
+	l, rest := ptr.layer, key
+	for {
+		ik := mt_ikey(rest)
+		n, i, found := mt_find(l, ik)
+		if !found {
+			return 0, false
+		}
+		e := &n.entries[i]
+		switch {
+		case ik.klen < MT_CONT:
+			return e.value, true
+		case e.layer == nil:
+			if !bytes.Equal(e.suffix, rest[8:]) {
+				return 0, false
+			}
+			return e.value, true
+		}
+		l, rest = e.layer, rest[8:]
+	}
+}
+
+/*
+ * mt_node_remove -- (internal) removes ik, which is there, from the subtree
+ * of n, and returns whether n is left empty; an empty child is unlinked
+ * from its parent, which may be left with a single child, but nodes are
+ * not merged otherwise; must be called in a transaction
+ */
+func mt_node_remove(n *node_t, ik ikey_t) bool {
+	if n.leaf {
+		p := 0
+		for n.keys[p] != ik {
+			p++
+		}
+		copy(n.keys[p:n.n], n.keys[p + 1:n.n])
+		copy(n.entries[p:n.n], n.entries[p + 1:n.n])
+		n.n--
+		n.keys[n.n] = ikey_t{}
+		n.entries[n.n] = entry_t{}
+		return n.n == 0
+	}
+	i := mt_route(n, ik)
+	if !mt_node_remove(n.children[i], ik) {
+		return false
+	}
+	if n.n == 0 {
+		return true
+	}
+	k := i
+	if k == n.n {
+		k--
+	}
+	copy(n.keys[k:n.n], n.keys[k + 1:n.n])
+	copy(n.children[i:n.n + 1], n.children[i + 1:n.n + 1])
+	n.children[n.n] = nil
+	n.n--
+	n.keys[n.n] = ikey_t{}
+	return false
+}
+
+/*
+ * mt_layer_remove -- (internal) removes ik, which is there, from layer l,
+ * and returns whether the layer is left empty; a root left with a single
+ * child is replaced by it, so only a leaf root can empty; must be called in
+ * a transaction
+ */
+func mt_layer_remove(l *layer_t, ik ikey_t) bool {
+	empty := mt_node_remove(l.root, ik)
+	for !l.root.leaf && l.root.n == 0 {
+		l.root = l.root.children[0]
+	}
+	return empty
+}
+
+/*
+ * mt_remove_in -- (internal) removes the rest of a key from layer l, and
+ * returns whether it was found and whether the layer is left empty; must be
+ * called in a transaction
+ */
+func mt_remove_in(l *layer_t, rest []byte) (bool, bool) {
+	ik := mt_ikey(rest)
+	n, i, found := mt_find(l, ik)
+	if !found {
+		return false, false
+	}
+	e := &n.entries[i]
+	if ik.klen == MT_CONT {
+		if e.layer != nil {
+			found, empty := mt_remove_in(e.layer, rest[8:])
+			if !found || !empty {
+				return found, false
+			}
+		} else if !bytes.Equal(e.suffix, rest[8:]) {
+			return false, false
+		}
+	}
+	return true, mt_layer_remove(l, ik)
+}
+
+/*
+ * mt_remove -- removes key, returning whether it was found; a layer left
+ * empty is unlinked from the layer above
+ */
+func mt_remove(ptr *data, key []byte) (found bool) {
+	txn("undo") {
+		if found, _ = mt_remove_in(ptr.layer, key); found {
+			ptr.count--
+		}
+	}
+	return found
+}
+
+/*
+ * mt_walk -- (internal) calls cb in order for the keys of the subtree of n,
+ * in a layer below prefix, from lo on if bounded, stopping early when cb
+ * returns true
+ */
+func mt_walk(n *node_t, prefix []byte, lo []byte, bounded bool,
+	cb func([]byte, int) bool) bool {
+	var lo_ik ikey_t
+	if bounded {
+		lo_ik = mt_ikey(lo)
+	}
+	if !n.leaf {
+		for i := 0; i <= n.n; i++ {
+			if bounded && i < n.n && mt_compare(n.keys[i], lo_ik) <= 0 {
+				continue
+			}
+			if mt_walk(n.children[i], prefix, lo, bounded, cb) {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; i < n.n; i++ {
+		ik, e := n.keys[i], &n.entries[i]
+		c := 0
+		if bounded {
+			if c = mt_compare(ik, lo_ik); c < 0 {
+				continue
+			}
+		}
+		key := append(append([]byte{}, prefix...), mt_ikey_bytes(ik)...)
+		switch {
+		case ik.klen < MT_CONT:
+			if cb(key, e.value) {
+				return true
+			}
+		case e.layer != nil:
+			/* lo only bounds the layer below if it goes on with the same slice */
+			var next []byte
+			if bounded && c == 0 {
+				next = lo[8:]
+			}
+			if mt_walk(e.layer.root, key, next, next != nil, cb) {
+				return true
+			}
+		case !bounded || c > 0 || bytes.Compare(e.suffix, lo[8:]) >= 0:
+			if cb(append(key, e.suffix...), e.value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * mt_range -- calls cb in order for the keys from lo to hi, both included,
+ * stopping early when cb returns true; the walk starts from lo, skipping
+ * the subtrees before it
+ */
+func mt_range(ptr *data, lo []byte, hi []byte, cb func([]byte, int) bool) bool {
+	stopped := false
+	mt_walk(ptr.layer.root, nil, lo, true, func(key []byte, value int) bool {
+		if bytes.Compare(key, hi) > 0 {
+			return true
+		}
+		stopped = cb(key, value)
+		return stopped
+	})
+	return stopped
+}
+
+/*
+ * mt_foreach -- calls cb for every key in order, stopping early when cb
+ * returns true
+ */
+func mt_foreach(ptr *data, cb func([]byte, int) bool) bool {
+	return mt_walk(ptr.layer.root, nil, nil, false, cb)
+}
+
+/*
+ * mt_clear -- removes all keys
+ */
+func mt_clear(ptr *data) {
+	txn("undo") {
+		ptr.layer = pnew(layer_t)
+		ptr.layer.root = pnew(node_t)
+		ptr.layer.root.leaf = true
+		ptr.count = 0
+	}
+}
+
+/*
+ * mt_stats_t -- what mt_check found
+ */
+type mt_stats_t struct {
+	keys   int
+	layers int
+	nodes  int
+	depth  int /* most layers on the path to a key */
+}
+
+/*
+ * mt_check_node -- (internal) verifies the subtree of n, whose keys must be
+ * at least lo and below hi where bounded, and the layers below it, and
+ * returns the depth of its leaves
+ */
+func mt_check_node(n *node_t, lo ikey_t, hi ikey_t, bounded [2]bool, depth int,
+	stats *mt_stats_t) (int, error) {
+	stats.nodes++
+	if n.n > MT_WIDTH || n.n < 0 {
+		return 0, fmt.Errorf("node holds %d keys", n.n)
+	}
+	for i := 0; i < n.n; i++ {
+		ik := n.keys[i]
+		if (bounded[0] && mt_compare(ik, lo) < 0) ||
+			(bounded[1] && mt_compare(ik, hi) >= 0) ||
+			(i > 0 && mt_compare(ik, n.keys[i - 1]) <= 0) {
+			return 0, fmt.Errorf("key %x/%d is out of order", ik.slice, ik.klen)
+		}
+	}
+	if n.leaf {
+		for i := 0; i < n.n; i++ {
+			if err := mt_check_entry(n.keys[i], &n.entries[i], depth, stats); err != nil {
+				return 0, err
+			}
+		}
+		return 1, nil
+	}
+	height := 0
+	for i := 0; i <= n.n; i++ {
+		b, clo, chi := bounded, lo, hi
+		if i > 0 {
+			clo, b[0] = n.keys[i - 1], true
+		}
+		if i < n.n {
+			chi, b[1] = n.keys[i], true
+		}
+		h, err := mt_check_node(n.children[i], clo, chi, b, depth, stats)
+		if err != nil {
+			return 0, err
+		}
+		if i > 0 && h != height {
+			return 0, fmt.Errorf("leaves at heights %d and %d", height, h)
+		}
+		height = h
+	}
+	return height + 1, nil
+}
+
+/*
+ * mt_check_entry -- (internal) verifies the entry of ik in a layer at depth,
+ * and the layer below it
+ */
+func mt_check_entry(ik ikey_t, e *entry_t, depth int, stats *mt_stats_t) error {
+	if ik.klen < 0 || ik.klen > MT_CONT {
+		return fmt.Errorf("key length %d", ik.klen)
+	}
+	if ik.klen < 8 && ik.slice << uint(8 * ik.klen) != 0 {
+		return fmt.Errorf("slice %x has bytes past its length %d", ik.slice, ik.klen)
+	}
+	if ik.klen < MT_CONT || e.layer == nil {
+		if ik.klen == MT_CONT && len(e.suffix) == 0 {
+			return fmt.Errorf("slice %x goes on without a suffix", ik.slice)
+		}
+		if ik.klen < MT_CONT && (e.layer != nil || e.suffix != nil) {
+			return fmt.Errorf("key ending in slice %x goes on", ik.slice)
+		}
+		stats.keys++
+		if depth + 1 > stats.depth {
+			stats.depth = depth + 1
+		}
+		return nil
+	}
+	if e.suffix != nil {
+		return fmt.Errorf("slice %x has both a suffix and a layer", ik.slice)
+	}
+	stats.layers++
+	if e.layer.root.n == 0 {
+		return fmt.Errorf("layer below slice %x is empty", ik.slice)
+	}
+	_, err := mt_check_node(e.layer.root, ikey_t{}, ikey_t{}, [2]bool{}, depth + 1, stats)
+	return err
+}
+
+/*
+ * mt_check -- verifies that the keys of every node are in order and within
+ * the range of the node, that the leaves of each layer are at the same
+ * height, that every entry goes on in exactly one way and every layer below
+ * the first is not empty, and that count is right
+ */
+func mt_check(ptr *data) (mt_stats_t, error) {
+	stats := mt_stats_t{layers: 1}
+	if _, err := mt_check_node(ptr.layer.root, ikey_t{}, ikey_t{}, [2]bool{}, 0,
+		&stats); err != nil {
+		return stats, err
+	}
+	if stats.keys != ptr.count {
+		return stats, fmt.Errorf("%d keys, count is %d", stats.keys, ptr.count)
+	}
+	return stats, nil
+}
+
+/*
+ * str_insert -- mt_insert wrapper which works on strings
+ */
+func str_insert(ptr *data, str string) {
+	var key string
+	var value int
+	if scan_args("insert", str, "%s %d", &key, &value) {
+		if err := mt_insert(ptr, []byte(key), value); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- mt_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key string
+	if scan_args("remove", str, "%s", &key) {
+		if !mt_remove(ptr, []byte(key)) {
+			fmt.Println("no such key")
+		}
+	}
+}
+
+/*
+ * str_get -- mt_get wrapper which works on strings
+ */
+func str_get(ptr *data, str string) {
+	var key string
+	if scan_args("get", str, "%s", &key) {
+		if value, ok := mt_get(ptr, []byte(key)); ok {
+			fmt.Println(value)
+		} else {
+			fmt.Println("no such key")
+		}
+	}
+}
+
+/*
+ * str_range -- prints the pairs between the keys given as a string
+ */
+func str_range(ptr *data, str string) {
+	var lo, hi string
+	if scan_args("range", str, "%s %s", &lo, &hi) {
+		mt_range(ptr, []byte(lo), []byte(hi), func(key []byte, value int) bool {
+			fmt.Println(string(key), value)
+			return false
+		})
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random keys,
+ * long and sharing a few prefixes so that they spread over several layers
+ */
+func str_insert_random(ptr *data, str string) {
+	prefixes := []string{"", "user:", "session:0000000000:", "tenant/42/object/"}
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			key := fmt.Sprintf("%s%x", prefixes[rand.Intn(len(prefixes))], rand.Int63())
+			if err := mt_insert(ptr, []byte(key), rand.Intn(1000)); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"i $key $value - insert $key with $value",
+		"r $key - remove $key",
+		"g $key - print the value of $key",
+		"R $lo $hi - print the keys from $lo to $hi with their values",
+		"n $value - insert $value random keys",
+		"p - print all keys with their values",
+		"d - print debug info",
+		"x - remove all keys",
+	)
+}
+
+func print_all(ptr *data) {
+	mt_foreach(ptr, func(key []byte, value int) bool {
+		fmt.Println(string(key), value)
+		return false
+	})
+}
+
+func print_debug(ptr *data) {
+	stats, err := mt_check(ptr)
+	if err != nil {
+		fmt.Println("invariants:", err)
+		return
+	}
+	fmt.Println("invariants: ok")
+	fmt.Println("keys:", stats.keys, "layers:", stats.layers, "nodes:", stats.nodes,
+		"deepest key:", stats.depth, "layers down")
+}
+
+/*
+ * Run -- opens the index named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("masstree", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'g': str_get(ptr, buf[1:])
+			case 'R': str_range(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': mt_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
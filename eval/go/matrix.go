@@ -0,0 +1,467 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* dimensions of a matrix created without -rows and -cols */
+const MAT_DEFAULT_ROWS int = 4
+const MAT_DEFAULT_COLS int = 4
+
+/*
+ * matrix_t -- a rows by cols matrix, row after row in cells
+ */
+type matrix_t struct {
+	rows  int
+	cols  int
+	cells []float64
+}
+
+type data struct {
+	m     *matrix_t
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x58E1A3C60F2D7B49
+)
+
+var (
+	ErrRange     = errors.New("index out of range")
+	ErrDimension = errors.New("dimensions do not match")
+)
+
+/*
+ * mat_new -- allocates a rows by cols matrix of zeros
+ */
+func mat_new(rows int, cols int) *matrix_t {
+	var m *matrix_t
+	txn("undo") {
+		m = pnew(matrix_t)
+		m.rows = rows
+		m.cols = cols
+		m.cells = pmake([]float64, rows * cols)
+	}
+	return m
+}
+
+func initialize(ptr *data, rows int, cols int) {
+	txn("undo") {
+		ptr.m = mat_new(rows, cols)
+		ptr.magic = magic
+	}
+}
+
+/*
+ * mat_row -- returns row i of m, which must only be written in a
+ * transaction
+ */
+func mat_row(m *matrix_t, i int) []float64 {
+	return m.cells[i * m.cols:(i + 1) * m.cols]
+}
+
+/*
+ * mat_get -- returns the cell of row i and column j
+ */
+func mat_get(m *matrix_t, i int, j int) (float64, error) {
+	if i < 0 || i >= m.rows || j < 0 || j >= m.cols {
+		return 0, ErrRange
+	}
+	return m.cells[i * m.cols + j], nil
+}
+
+/*
+ * mat_set -- sets the cell of row i and column j to v
+ */
+func mat_set(m *matrix_t, i int, j int, v float64) error {
+	if i < 0 || i >= m.rows || j < 0 || j >= m.cols {
+		return ErrRange
+	}
+	txn("undo") {
+		m.cells[i * m.cols + j] = v
+	}
+	return nil
+}
+
+/*
+ * mat_set_row -- replaces row i with values, in one transaction
+ */
+func mat_set_row(m *matrix_t, i int, values []float64) error {
+	if i < 0 || i >= m.rows {
+		return ErrRange
+	}
+	if len(values) != m.cols {
+		return ErrDimension
+	}
+	txn("undo") {
+		copy(mat_row(m, i), values)
+	}
+	return nil
+}
+
+/*
+ * mat_add_row -- adds f times row src to row dst, in one transaction
+ */
+func mat_add_row(m *matrix_t, dst int, src int, f float64) error {
+	if dst < 0 || dst >= m.rows || src < 0 || src >= m.rows {
+		return ErrRange
+	}
+	txn("undo") {
+		d, s := mat_row(m, dst), mat_row(m, src)
+		for j := range d {
+			d[j] += f * s[j]
+		}
+	}
+	return nil
+}
+
+/*
+ * mat_multiply -- stores a times b in dst, each row of the product computed
+ * in volatile memory and then written in a transaction of its own; dst must
+ * not be a or b
+ */
+func mat_multiply(dst *matrix_t, a *matrix_t, b *matrix_t) error {
+	if a.cols != b.rows || dst.rows != a.rows || dst.cols != b.cols {
+		return ErrDimension
+	}
+	row := make([]float64, b.cols)
+	for i := 0; i < a.rows; i++ {
+		mat_multiply_row(row, mat_row(a, i), b.cells, b.cols)
+		txn("undo") {
+			copy(mat_row(dst, i), row)
+		}
+	}
+	return nil
+}
+
+/*
+ * mat_multiply_row -- (internal) stores in row the product of arow and the
+ * matrix of cols columns in cells
+ */
+func mat_multiply_row(row []float64, arow []float64, cells []float64, cols int) {
+	for j := range row {
+		row[j] = 0
+	}
+	for k, a := range arow {
+		brow := cells[k * cols:(k + 1) * cols]
+		for j, b := range brow {
+			row[j] += a * b
+		}
+	}
+}
+
+/*
+ * mat_square -- replaces the matrix, which must be square, with its square;
+ * the product is built in a new matrix which replaces the old one in a
+ * single transaction, so a crash leaves either whole
+ */
+func mat_square(ptr *data) (err error) {
+	m := ptr.m
+	if m.rows != m.cols {
+		return ErrDimension
+	}
+	defer pool_full(&err)
+	p := mat_new(m.rows, m.cols)
+	mat_multiply(p, m, m)
+	txn("undo") {
+		ptr.m = p
+	}
+	return nil
+}
+
+/*
+ * mat_fill_random -- sets every cell of m to a random number in [0, 1), a
+ * transaction per row
+ */
+func mat_fill_random(m *matrix_t, rng *rand.Rand) {
+	row := make([]float64, m.cols)
+	for i := 0; i < m.rows; i++ {
+		for j := range row {
+			row[j] = rng.Float64()
+		}
+		mat_set_row(m, i, row)
+	}
+}
+
+/*
+ * mat_clear -- sets every cell to zero
+ */
+func mat_clear(m *matrix_t) {
+	txn("undo") {
+		for i := range m.cells {
+			m.cells[i] = 0
+		}
+	}
+}
+
+/*
+ * mat_bench -- multiplies two random n by n matrices in persistent memory,
+ * storing the product there row by row, then the same matrices copied to
+ * volatile memory, and prints the time and throughput of both; the stored
+ * matrix is left as it was
+ */
+func mat_bench(n int) (err error) {
+	defer pool_full(&err)
+	a, b, p := mat_new(n, n), mat_new(n, n), mat_new(n, n)
+	rng := rand.New(rand.NewSource(1))
+	mat_fill_random(a, rng)
+	mat_fill_random(b, rng)
+
+	start := time.Now()
+	mat_multiply(p, a, b)
+	persistent := time.Since(start)
+
+	va := make([]float64, n * n)
+	vb := make([]float64, n * n)
+	vp := make([]float64, n * n)
+	copy(va, a.cells)
+	copy(vb, b.cells)
+	start = time.Now()
+	for i := 0; i < n; i++ {
+		mat_multiply_row(vp[i * n:(i + 1) * n], va[i * n:(i + 1) * n], vb, n)
+	}
+	volatile := time.Since(start)
+
+	for i := range vp {
+		if vp[i] != p.cells[i] {
+			return fmt.Errorf("products differ at cell %d", i)
+		}
+	}
+	flops := 2 * float64(n) * float64(n) * float64(n)
+	fmt.Printf("persistent: %dx%d matmul in %v, %.3f GFLOP/s\n", n, n, persistent,
+		flops / persistent.Seconds() / 1e9)
+	fmt.Printf("volatile: %dx%d matmul in %v, %.3f GFLOP/s\n", n, n, volatile,
+		flops / volatile.Seconds() / 1e9)
+	return nil
+}
+
+/*
+ * mat_check -- verifies that the cells are sized for the dimensions, and
+ * returns the sum of the cells
+ */
+func mat_check(m *matrix_t) (float64, error) {
+	if m.rows <= 0 || m.cols <= 0 || len(m.cells) != m.rows * m.cols {
+		return 0, fmt.Errorf("%d cells for %d rows of %d columns", len(m.cells),
+			m.rows, m.cols)
+	}
+	sum := 0.0
+	for _, v := range m.cells {
+		sum += v
+	}
+	return sum, nil
+}
+
+/*
+ * str_set -- mat_set wrapper which works on strings
+ */
+func str_set(ptr *data, str string) {
+	var i, j int
+	var v float64
+	if scan_args("set", str, "%d %d %g", &i, &j, &v) {
+		if err := mat_set(ptr.m, i, j, v); err != nil {
+			fmt.Println("set:", err)
+		}
+	}
+}
+
+/*
+ * str_get -- mat_get wrapper which works on strings
+ */
+func str_get(ptr *data, str string) {
+	var i, j int
+	if scan_args("get", str, "%d %d", &i, &j) {
+		if v, err := mat_get(ptr.m, i, j); err == nil {
+			fmt.Println(v)
+		} else {
+			fmt.Println("get:", err)
+		}
+	}
+}
+
+/*
+ * str_set_row -- mat_set_row wrapper which works on strings: the row, then
+ * a value for every column
+ */
+func str_set_row(ptr *data, str string) {
+	fields := strings.Fields(str)
+	if len(fields) == 0 {
+		fmt.Println("row: invalid syntax")
+		return
+	}
+	i, err := strconv.Atoi(fields[0])
+	values := make([]float64, len(fields) - 1)
+	for k := range values {
+		if err == nil {
+			values[k], err = strconv.ParseFloat(fields[k + 1], 64)
+		}
+	}
+	if err != nil {
+		fmt.Println("row: invalid syntax")
+		return
+	}
+	if err := mat_set_row(ptr.m, i, values); err != nil {
+		fmt.Println("row:", err)
+	}
+}
+
+/*
+ * str_add_row -- mat_add_row wrapper which works on strings
+ */
+func str_add_row(ptr *data, str string) {
+	var dst, src int
+	var f float64
+	if scan_args("add row", str, "%d %d %g", &dst, &src, &f) {
+		if err := mat_add_row(ptr.m, dst, src, f); err != nil {
+			fmt.Println("add row:", err)
+		}
+	}
+}
+
+/*
+ * str_square -- mat_square wrapper which reports its error
+ */
+func str_square(ptr *data) {
+	if err := mat_square(ptr); err != nil {
+		fmt.Println("square:", err)
+	}
+}
+
+/*
+ * str_bench -- mat_bench wrapper which works on strings
+ */
+func str_bench(str string) {
+	var n int
+	if _, err := fmt.Sscanf(str, "%d", &n); err == nil && n > 0 {
+		if err := mat_bench(n); err != nil {
+			fmt.Println("bench:", err)
+		}
+	} else {
+		fmt.Println("bench: invalid syntax")
+	}
+}
+
+/*
+ * str_insert_random -- sets specified (as string) number of random cells to
+ * random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		m := ptr.m
+		for i := 0; i < val; i++ {
+			mat_set(m, rand.Intn(m.rows), rand.Intn(m.cols), rand.Float64())
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"s $row $col $value - set the cell of $row and $col to $value",
+		"g $row $col - print the cell of $row and $col",
+		"w $row $values... - replace $row with $values, one per column",
+		"a $dst $src $factor - add $factor times row $src to row $dst",
+		"m - replace the matrix with its square",
+		"b $n - multiply two random $n by $n matrices, print the throughput",
+		"n $value - set $value random cells to random numbers",
+		"p - print the matrix",
+		"d - print debug info",
+		"x - set all cells to zero",
+	)
+}
+
+func print_all(ptr *data) {
+	for i := 0; i < ptr.m.rows; i++ {
+		for _, v := range mat_row(ptr.m, i) {
+			fmt.Print(v, " ")
+		}
+		fmt.Println()
+	}
+}
+
+func print_debug(ptr *data) {
+	sum, err := mat_check(ptr.m)
+	if err != nil {
+		fmt.Println("invariants:", err)
+		return
+	}
+	fmt.Println("invariants: ok")
+	fmt.Println("rows:", ptr.m.rows, "cols:", ptr.m.cols, "sum:", sum)
+}
+
+/*
+ * Run -- opens the matrix named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("matrix", flag.ContinueOnError)
+	flags.Usage = func() {}
+	rows := flags.Int("rows", MAT_DEFAULT_ROWS, "number of rows when the matrix is created")
+	cols := flags.Int("cols", MAT_DEFAULT_COLS, "number of columns when the matrix is created")
+	bench := flags.Int("bench", 0, "multiply two random `n` by n matrices, print the throughput and exit")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	if *rows <= 0 || *cols <= 0 {
+		return usage_error("the matrix needs a positive number of rows and columns")
+	}
+	if *bench < 0 {
+		return usage_error("the bench size cannot be negative")
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr, *rows, *cols)
+	}
+
+	if *bench > 0 {
+		return mat_bench(*bench)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 's': str_set(ptr, buf[1:])
+			case 'g': str_get(ptr, buf[1:])
+			case 'w': str_set_row(ptr, buf[1:])
+			case 'a': str_add_row(ptr, buf[1:])
+			case 'm': str_square(ptr)
+			case 'b': str_bench(buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': mat_clear(ptr.m)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "[-rows n] [-cols n] [-bench n] filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
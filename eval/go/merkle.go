@@ -0,0 +1,417 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* size in bytes of a data block */
+const MERKLE_BLOCK_SIZE int = 64
+
+/* number of blocks of a tree created without -blocks */
+const MERKLE_DEFAULT_BLOCKS int = 16
+
+/* prefixes of the hashed bytes, so a leaf can never pass for a node */
+const (
+	MERKLE_LEAF byte = 0
+	MERKLE_NODE byte = 1
+)
+
+type hash_t [sha256.Size]byte
+
+/*
+ * data -- the tree is complete and kept in an array: hashes[1] is the root,
+ * the children of hashes[i] are hashes[2i] and hashes[2i+1], and the hash of
+ * block i is the leaf hashes[nblocks + i]; nblocks is a power of two
+ */
+type data struct {
+	nblocks int
+	blocks  []byte
+	hashes  []hash_t
+	magic   int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x1F5B7A3D09C86E42
+)
+
+var ErrNoBlock = errors.New("no such block")
+
+/*
+ * merkle_hash_leaf -- returns the hash of the contents of a block
+ */
+func merkle_hash_leaf(block []byte) hash_t {
+	h := sha256.New()
+	h.Write([]byte{MERKLE_LEAF})
+	h.Write(block)
+	var sum hash_t
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+/*
+ * merkle_hash_node -- returns the hash of a node from the hashes of its
+ * children
+ */
+func merkle_hash_node(left *hash_t, right *hash_t) hash_t {
+	h := sha256.New()
+	h.Write([]byte{MERKLE_NODE})
+	h.Write(left[:])
+	h.Write(right[:])
+	var sum hash_t
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+/*
+ * merkle_build -- (internal) recomputes every hash from the blocks; must be
+ * called in a transaction
+ */
+func merkle_build(ptr *data) {
+	for i := 0; i < ptr.nblocks; i++ {
+		ptr.hashes[ptr.nblocks + i] = merkle_hash_leaf(merkle_block(ptr, i))
+	}
+	for i := ptr.nblocks - 1; i >= 1; i-- {
+		ptr.hashes[i] = merkle_hash_node(&ptr.hashes[2 * i], &ptr.hashes[2 * i + 1])
+	}
+}
+
+/*
+ * initialize -- creates a tree of zeroed blocks, at least nblocks of them
+ */
+func initialize(ptr *data, nblocks int) {
+	n := 1
+	for n < nblocks {
+		n *= 2
+	}
+	txn("undo") {
+		ptr.nblocks = n
+		ptr.blocks = pmake([]byte, n * MERKLE_BLOCK_SIZE)
+		ptr.hashes = pmake([]hash_t, 2 * n)
+		merkle_build(ptr)
+		ptr.magic = magic
+	}
+}
+
+/*
+ * merkle_block -- (internal) returns the bytes of block i
+ */
+func merkle_block(ptr *data, i int) []byte {
+	return ptr.blocks[i * MERKLE_BLOCK_SIZE:(i + 1) * MERKLE_BLOCK_SIZE]
+}
+
+/*
+ * merkle_write -- stores buf at the start of block i, zeroing the rest of
+ * the block, and recomputes the hashes on the path from its leaf to the
+ * root, all in one transaction
+ */
+func merkle_write(ptr *data, i int, buf []byte) error {
+	if i < 0 || i >= ptr.nblocks {
+		return ErrNoBlock
+	}
+	txn("undo") {
+		block := merkle_block(ptr, i)
+		n := copy(block, buf)
+		for j := n; j < len(block); j++ {
+			block[j] = 0
+		}
+		k := ptr.nblocks + i
+		ptr.hashes[k] = merkle_hash_leaf(block)
+		for k /= 2; k >= 1; k /= 2 {
+			ptr.hashes[k] = merkle_hash_node(&ptr.hashes[2 * k], &ptr.hashes[2 * k + 1])
+		}
+	}
+	return nil
+}
+
+/*
+ * merkle_read -- returns a copy of block i
+ */
+func merkle_read(ptr *data, i int) ([]byte, error) {
+	if i < 0 || i >= ptr.nblocks {
+		return nil, ErrNoBlock
+	}
+	buf := make([]byte, MERKLE_BLOCK_SIZE)
+	copy(buf, merkle_block(ptr, i))
+	return buf, nil
+}
+
+/*
+ * merkle_root -- returns the root hash, which covers every block
+ */
+func merkle_root(ptr *data) hash_t {
+	return ptr.hashes[1]
+}
+
+/*
+ * merkle_proof -- returns the hashes of the siblings on the path from the
+ * leaf of block i to the root, the leaf side first
+ */
+func merkle_proof(ptr *data, i int) ([]hash_t, error) {
+	if i < 0 || i >= ptr.nblocks {
+		return nil, ErrNoBlock
+	}
+	var proof []hash_t
+	for k := ptr.nblocks + i; k > 1; k /= 2 {
+		proof = append(proof, ptr.hashes[k ^ 1])
+	}
+	return proof, nil
+}
+
+/*
+ * merkle_verify_proof -- checks that block holds the contents of block i of
+ * the tree of the root, given the proof of merkle_proof; needs nothing from
+ * the tree itself
+ */
+func merkle_verify_proof(root hash_t, i int, block []byte, proof []hash_t) bool {
+	h := merkle_hash_leaf(block)
+	for _, sibling := range proof {
+		if i % 2 == 0 {
+			h = merkle_hash_node(&h, &sibling)
+		} else {
+			h = merkle_hash_node(&sibling, &h)
+		}
+		i /= 2
+	}
+	return i == 0 && h == root
+}
+
+/*
+ * merkle_verify -- recomputes every hash from the blocks and compares it with
+ * the one stored; returns the first block whose contents do not match, or
+ * -1 if they all do, and an error for a mismatch in the inner nodes
+ */
+func merkle_verify(ptr *data) (int, error) {
+	for i := 0; i < ptr.nblocks; i++ {
+		if merkle_hash_leaf(merkle_block(ptr, i)) != ptr.hashes[ptr.nblocks + i] {
+			return i, nil
+		}
+	}
+	for i := ptr.nblocks - 1; i >= 1; i-- {
+		if merkle_hash_node(&ptr.hashes[2 * i], &ptr.hashes[2 * i + 1]) != ptr.hashes[i] {
+			return -1, fmt.Errorf("node %d does not hash its children", i)
+		}
+	}
+	return -1, nil
+}
+
+/*
+ * merkle_clear -- zeroes all blocks and recomputes the tree
+ */
+func merkle_clear(ptr *data) {
+	txn("undo") {
+		for i := range ptr.blocks {
+			ptr.blocks[i] = 0
+		}
+		merkle_build(ptr)
+	}
+}
+
+/*
+ * str_block -- (internal) parses a block number at the start of str,
+ * printing an error for cmd if it is malformed
+ */
+func str_block(cmd string, str string) (int, bool) {
+	var i int
+	if !scan_args(cmd, str, "%d", &i) {
+		return 0, false
+	}
+	return i, true
+}
+
+/*
+ * str_write -- stores the word given in the block given, both as a string
+ */
+func str_write(ptr *data, str string) {
+	var i int
+	var word string
+	if scan_args("write", str, "%d %s", &i, &word) {
+		if err := merkle_write(ptr, i, []byte(word)); err != nil {
+			fmt.Println("write:", err)
+		}
+	}
+}
+
+/*
+ * block_string -- (internal) returns the contents of a block up to the first
+ * zero byte
+ */
+func block_string(block []byte) string {
+	n := 0
+	for n < len(block) && block[n] != 0 {
+		n++
+	}
+	return string(block[:n])
+}
+
+/*
+ * str_read -- prints the contents of the block given as a string
+ */
+func str_read(ptr *data, str string) {
+	if i, ok := str_block("read", str); ok {
+		if block, err := merkle_read(ptr, i); err == nil {
+			fmt.Println(block_string(block))
+		} else {
+			fmt.Println("read:", err)
+		}
+	}
+}
+
+/*
+ * str_proof -- prints the proof of the block given as a string, one hash
+ * per line
+ */
+func str_proof(ptr *data, str string) {
+	if i, ok := str_block("proof", str); ok {
+		if proof, err := merkle_proof(ptr, i); err == nil {
+			for _, h := range proof {
+				fmt.Println(hex.EncodeToString(h[:]))
+			}
+		} else {
+			fmt.Println("proof:", err)
+		}
+	}
+}
+
+/*
+ * str_check -- checks the block given as a string against the root with its
+ * proof, as a client holding only the root would, printing true or false
+ */
+func str_check(ptr *data, str string) {
+	if i, ok := str_block("check", str); ok {
+		block, err := merkle_read(ptr, i)
+		if err != nil {
+			fmt.Println("check:", err)
+			return
+		}
+		proof, _ := merkle_proof(ptr, i)
+		fmt.Println(merkle_verify_proof(merkle_root(ptr), i, block, proof))
+	}
+}
+
+/*
+ * print_root -- prints the root hash in hex
+ */
+func print_root(ptr *data) {
+	root := merkle_root(ptr)
+	fmt.Println(hex.EncodeToString(root[:]))
+}
+
+/*
+ * str_insert_random -- writes specified (as string) number of random words
+ * to random blocks
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			word := fmt.Sprintf("%x", rand.Int63())
+			merkle_write(ptr, rand.Intn(ptr.nblocks), []byte(word))
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"w $block $word - store $word in $block",
+		"r $block - print the contents of $block",
+		"P $block - print the proof of $block, from its leaf up",
+		"c $block - check $block against the root with its proof, returns 0/1",
+		"R - print the root hash",
+		"n $value - write $value random words to random blocks",
+		"p - print all blocks which are not empty",
+		"d - print debug info",
+		"x - zero all blocks",
+	)
+}
+
+func print_all(ptr *data) {
+	for i := 0; i < ptr.nblocks; i++ {
+		if s := block_string(merkle_block(ptr, i)); len(s) > 0 {
+			fmt.Println(i, s)
+		}
+	}
+}
+
+func print_debug(ptr *data) {
+	if i, err := merkle_verify(ptr); err != nil {
+		fmt.Println("invariants:", err)
+		return
+	} else if i >= 0 {
+		fmt.Println("invariants: block", i, "does not match its hash")
+		return
+	}
+	fmt.Println("invariants: ok")
+	depth := 0
+	for n := ptr.nblocks; n > 1; n /= 2 {
+		depth++
+	}
+	fmt.Println("blocks:", ptr.nblocks, "of", MERKLE_BLOCK_SIZE, "bytes, depth:", depth)
+	print_root(ptr)
+}
+
+/*
+ * Run -- opens the tree named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("merkle", flag.ContinueOnError)
+	flags.Usage = func() {}
+	blocks := flags.Int("blocks", MERKLE_DEFAULT_BLOCKS, "number of blocks when the tree is created")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	if *blocks <= 0 {
+		return usage_error("the tree needs a positive number of blocks")
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr, *blocks)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'w': str_write(ptr, buf[1:])
+			case 'r': str_read(ptr, buf[1:])
+			case 'P': str_proof(ptr, buf[1:])
+			case 'c': str_check(ptr, buf[1:])
+			case 'R': print_root(ptr)
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': merkle_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "[-blocks n] filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
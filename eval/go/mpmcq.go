@@ -0,0 +1,500 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* number of slots of a new queue, unless -capacity says otherwise */
+const MPMC_DEFAULT_CAPACITY int = 1024
+
+/* the benchmark doubles its producers and consumers up to this many each */
+const MPMC_BENCH_MAX_THREADS int = 8
+
+/*
+ * slot_t -- a slot awaiting the value of position p holds seq p, and once
+ * that value is stored, seq p + 1; taking the value off sets seq to
+ * p + capacity, the next position the slot serves
+ */
+type slot_t struct {
+	seq   int64
+	value int64
+}
+
+type queue_t struct {
+	slots []slot_t
+}
+
+type data struct {
+	q     *queue_t
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x1D6B8F04A3E279C5
+)
+
+/*
+ * mpmc_t -- a queue opened for use; the positions of the next enqueue and
+ * dequeue are volatile, claimed by compare-and-swap, and rebuilt from the
+ * sequence numbers by mpmc_open
+ */
+type mpmc_t struct {
+	q           *queue_t
+	enqueue_pos int64
+	dequeue_pos int64
+}
+
+var (
+	ErrFull  = errors.New("queue is full")
+	ErrEmpty = errors.New("queue is empty")
+)
+
+/*
+ * persist -- (internal) flushes size bytes at addr to persistent memory
+ */
+func persist(addr unsafe.Pointer, size uintptr) {
+	runtime.PersistRange(addr, size)
+}
+
+/*
+ * mpmc_new -- allocates an empty queue of capacity slots
+ */
+func mpmc_new(capacity int) *queue_t {
+	var q *queue_t
+	txn("undo") {
+		q = pnew(queue_t)
+		q.slots = pmake([]slot_t, capacity)
+		for i := range q.slots {
+			q.slots[i].seq = int64(i)
+		}
+	}
+	return q
+}
+
+func initialize(ptr *data, capacity int) {
+	txn("undo") {
+		ptr.q = mpmc_new(capacity)
+		ptr.magic = magic
+	}
+}
+
+/*
+ * mpmc_enqueue -- stores value at the next position; the value is persisted
+ * before the sequence number which publishes it, so a crash in between
+ * leaves the slot empty; safe for concurrent use
+ */
+func mpmc_enqueue(h *mpmc_t, value int64) error {
+	slots := h.q.slots
+	capacity := int64(len(slots))
+	pos := atomic.LoadInt64(&h.enqueue_pos)
+	var s *slot_t
+	for {
+		s = &slots[pos % capacity]
+		dif := atomic.LoadInt64(&s.seq) - pos
+		if dif == 0 {
+			if atomic.CompareAndSwapInt64(&h.enqueue_pos, pos, pos + 1) {
+				break
+			}
+		} else if dif < 0 {
+			/* the slot still holds the value of pos - capacity */
+			return ErrFull
+		}
+		pos = atomic.LoadInt64(&h.enqueue_pos)
+	}
+	s.value = value
+	persist(unsafe.Pointer(&s.value), unsafe.Sizeof(s.value))
+	atomic.StoreInt64(&s.seq, pos + 1)
+	persist(unsafe.Pointer(&s.seq), unsafe.Sizeof(s.seq))
+	return nil
+}
+
+/*
+ * mpmc_dequeue -- takes the value at the oldest position off; a crash before
+ * its sequence number is persisted leaves the value in the queue, so values
+ * are delivered at least once; safe for concurrent use
+ */
+func mpmc_dequeue(h *mpmc_t) (int64, error) {
+	slots := h.q.slots
+	capacity := int64(len(slots))
+	pos := atomic.LoadInt64(&h.dequeue_pos)
+	var s *slot_t
+	for {
+		s = &slots[pos % capacity]
+		dif := atomic.LoadInt64(&s.seq) - (pos + 1)
+		if dif == 0 {
+			if atomic.CompareAndSwapInt64(&h.dequeue_pos, pos, pos + 1) {
+				break
+			}
+		} else if dif < 0 {
+			/* the value of pos is not stored yet */
+			return 0, ErrEmpty
+		}
+		pos = atomic.LoadInt64(&h.dequeue_pos)
+	}
+	value := s.value
+	atomic.StoreInt64(&s.seq, pos + capacity)
+	persist(unsafe.Pointer(&s.seq), unsafe.Sizeof(s.seq))
+	return value, nil
+}
+
+/*
+ * mpmc_len -- returns the number of values in the queue; only exact while no
+ * other goroutine uses it
+ */
+func mpmc_len(h *mpmc_t) int {
+	return int(atomic.LoadInt64(&h.enqueue_pos) - atomic.LoadInt64(&h.dequeue_pos))
+}
+
+/*
+ * mpmc_check -- verifies that every slot is either empty or full for a
+ * position it serves, that the full slots hold consecutive positions and the
+ * empty ones the positions that follow; returns the positions of the oldest
+ * value and of the next one
+ */
+func mpmc_check(q *queue_t) (int64, int64, error) {
+	capacity := int64(len(q.slots))
+	if capacity < 2 {
+		return 0, 0, fmt.Errorf("a queue of %d slots", capacity)
+	}
+	var full []int64
+	var empty []int64
+	for i := range q.slots {
+		seq := q.slots[i].seq
+		switch (seq - int64(i)) % capacity {
+			case 0: empty = append(empty, seq)
+			case 1: full = append(full, seq - 1)
+			default:
+				return 0, 0, fmt.Errorf("slot %d holds sequence number %d", i, seq)
+		}
+	}
+	var head, tail int64
+	if len(full) > 0 {
+		head, tail = full[0], full[0] + 1
+		for _, pos := range full {
+			if pos < head {
+				head = pos
+			}
+			if pos + 1 > tail {
+				tail = pos + 1
+			}
+		}
+	} else {
+		head = empty[0]
+		for _, pos := range empty {
+			if pos < head {
+				head = pos
+			}
+		}
+		tail = head
+	}
+	if tail - head != int64(len(full)) {
+		return 0, 0, fmt.Errorf("%d values between positions %d and %d", len(full),
+			head, tail)
+	}
+	for _, pos := range empty {
+		if pos < tail || pos >= head + capacity {
+			return 0, 0, fmt.Errorf("slot of position %d is empty, values are from %d to %d",
+				pos, head, tail)
+		}
+	}
+	return head, tail, nil
+}
+
+/*
+ * mpmc_compact -- (internal) moves the values to the first slots in the
+ * order of their positions, which start over from zero, in one transaction;
+ * this closes the gaps left by enqueues cut short by a crash
+ */
+func mpmc_compact(q *queue_t) {
+	capacity := int64(len(q.slots))
+	var full []slot_t
+	for i := range q.slots {
+		if (q.slots[i].seq - int64(i)) % capacity == 1 {
+			full = append(full, q.slots[i])
+		}
+	}
+	sort.Slice(full, func(i, j int) bool {
+		return full[i].seq < full[j].seq
+	})
+	txn("undo") {
+		for i := range q.slots {
+			if i < len(full) {
+				q.slots[i].seq = int64(i) + 1
+				q.slots[i].value = full[i].value
+			} else {
+				q.slots[i].seq = int64(i)
+			}
+		}
+	}
+}
+
+/*
+ * mpmc_open -- returns q opened for use, compacting it first if a crash
+ * left it with gaps; must not run concurrently with anything on q
+ */
+func mpmc_open(q *queue_t) *mpmc_t {
+	head, tail, err := mpmc_check(q)
+	if err != nil {
+		mpmc_compact(q)
+		head, tail, _ = mpmc_check(q)
+	}
+	return &mpmc_t{q: q, enqueue_pos: tail, dequeue_pos: head}
+}
+
+/*
+ * mpmc_foreach -- calls cb for every value from the oldest on, stopping
+ * early when cb returns true; must not run concurrently with updates
+ */
+func mpmc_foreach(h *mpmc_t, cb func(int64) bool) bool {
+	capacity := int64(len(h.q.slots))
+	for pos := h.dequeue_pos; pos < h.enqueue_pos; pos++ {
+		if cb(h.q.slots[pos % capacity].value) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * mpmc_clear -- removes all values, in one transaction; must not run
+ * concurrently with anything on the queue
+ */
+func mpmc_clear(h *mpmc_t) {
+	txn("undo") {
+		for i := range h.q.slots {
+			h.q.slots[i].seq = int64(i)
+		}
+	}
+	h.enqueue_pos = 0
+	h.dequeue_pos = 0
+}
+
+/*
+ * mpmc_bench_run -- (internal) passes n values through a new queue of
+ * capacity slots from threads producers to threads consumers, waiting on a
+ * full or empty queue by yielding; checks that every value came out once
+ */
+func mpmc_bench_run(capacity int, n int, threads int) (elapsed time.Duration, err error) {
+	defer pool_full(&err)
+	q := mpmc_new(capacity)
+	h := mpmc_open(q)
+	var wg sync.WaitGroup
+	var consumed, sum int64
+
+	start := time.Now()
+	for p := 0; p < threads; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			/* producer p enqueues p + 1, p + 1 + threads, ... up to n */
+			for v := int64(p + 1); v <= int64(n); v += int64(threads) {
+				for mpmc_enqueue(h, v) != nil {
+					runtime.Gosched()
+				}
+			}
+		}(p)
+	}
+	for c := 0; c < threads; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt64(&consumed) < int64(n) {
+				if v, err := mpmc_dequeue(h); err == nil {
+					atomic.AddInt64(&sum, v)
+					atomic.AddInt64(&consumed, 1)
+				} else {
+					runtime.Gosched()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed = time.Since(start)
+
+	if want := int64(n) * int64(n + 1) / 2; sum != want || mpmc_len(h) != 0 {
+		return 0, fmt.Errorf("values sum to %d, %d left, expected %d and none", sum,
+			mpmc_len(h), want)
+	}
+	return elapsed, nil
+}
+
+/*
+ * mpmc_bench -- runs mpmc_bench_run with 1, 2, 4, ... producers and as many
+ * consumers, up to MPMC_BENCH_MAX_THREADS, and prints the throughput of
+ * each; the stored queue is left as it was
+ */
+func mpmc_bench(capacity int, n int) error {
+	for threads := 1; threads <= MPMC_BENCH_MAX_THREADS; threads *= 2 {
+		elapsed, err := mpmc_bench_run(capacity, n, threads)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d producers, %d consumers: %d values in %v, %.0f values/s\n",
+			threads, threads, n, elapsed, float64(n) / elapsed.Seconds())
+	}
+	return nil
+}
+
+/*
+ * str_enqueue -- mpmc_enqueue wrapper which works on strings
+ */
+func str_enqueue(h *mpmc_t, str string) {
+	var value int64
+	if scan_args("enqueue", str, "%d", &value) {
+		if err := mpmc_enqueue(h, value); err != nil {
+			fmt.Println("enqueue:", err)
+		}
+	}
+}
+
+/*
+ * str_dequeue -- mpmc_dequeue wrapper which prints the value
+ */
+func str_dequeue(h *mpmc_t) {
+	if value, err := mpmc_dequeue(h); err == nil {
+		fmt.Println(value)
+	} else {
+		fmt.Println(err)
+	}
+}
+
+/*
+ * str_insert_random -- enqueues specified (as string) number of random
+ * values, or fewer if the queue fills up
+ */
+func str_insert_random(h *mpmc_t, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := mpmc_enqueue(h, rand.Int63n(1000)); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+/*
+ * str_bench -- mpmc_bench wrapper which works on strings
+ */
+func str_bench(h *mpmc_t, str string) {
+	var n int
+	if _, err := fmt.Sscanf(str, "%d", &n); err == nil && n > 0 {
+		if err := mpmc_bench(len(h.q.slots), n); err != nil {
+			fmt.Println("bench:", err)
+		}
+	} else {
+		fmt.Println("bench: invalid syntax")
+	}
+}
+
+func help() {
+	print_help(
+		"e $value - enqueue $value",
+		"c - dequeue and print the oldest value",
+		"n $value - enqueue $value random values",
+		fmt.Sprintf("b $count - pass $count values through a queue with 1 to %d producers and consumers",
+			MPMC_BENCH_MAX_THREADS),
+		"p - print all values from the oldest",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(h *mpmc_t) {
+	mpmc_foreach(h, func(value int64) bool {
+		fmt.Print(value, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(h *mpmc_t) {
+	head, tail, err := mpmc_check(h.q)
+	if err != nil {
+		fmt.Println("invariants:", err)
+		return
+	}
+	fmt.Println("invariants: ok")
+	fmt.Println("values:", tail - head, "capacity:", len(h.q.slots),
+		"head:", head, "tail:", tail)
+}
+
+/*
+ * Run -- opens the queue named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("mpmcq", flag.ContinueOnError)
+	flags.Usage = func() {}
+	capacity := flags.Int("capacity", MPMC_DEFAULT_CAPACITY,
+		"room for `n` values when the queue is created")
+	bench := flags.Int("bench", 0, "pass `n` values through queues with growing thread counts and exit")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	if *capacity < 2 {
+		return usage_error("the queue needs at least 2 slots")
+	}
+	if *bench < 0 {
+		return usage_error("the bench count cannot be negative")
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr, *capacity)
+	}
+
+	if *bench > 0 {
+		return mpmc_bench(len(ptr.q.slots), *bench)
+	}
+
+	h := mpmc_open(ptr.q)
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'e': str_enqueue(h, buf[1:])
+			case 'c': str_dequeue(h)
+			case 'n': str_insert_random(h, buf[1:])
+			case 'b': str_bench(h, buf[1:])
+			case 'p': print_all(h)
+			case 'd': print_debug(h)
+			case 'x': mpmc_clear(h)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "[-capacity n] [-bench n] filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
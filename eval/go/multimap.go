@@ -0,0 +1,499 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* large prime number used as a hashing function coefficient */
+const HASH_FUNC_COEFF_P uint64 = 32212254719
+
+/* initial number of buckets */
+const INIT_BUCKETS_NUM int = 10
+
+/* average number of keys per bucket above which the table grows */
+const MAX_LOAD_FACTOR int = 2
+
+/*
+ * value_t -- one value of a key; the chain of a key holds the most recently
+ * added value first, and may hold a value more than once
+ */
+type value_t struct {
+	value int
+	next  *value_t
+}
+
+/*
+ * key_t -- a key in the chain of its bucket, with the chain of its values,
+ * which is never empty
+ */
+type key_t struct {
+	key     int
+	values  *value_t
+	nvalues int
+	next    *key_t
+}
+
+type buckets_t struct {
+	bucket []*key_t
+}
+
+type data struct {
+	/* hash function coefficients */
+	hash_fun_a uint64
+	hash_fun_b uint64
+	hash_fun_p uint64
+
+	/* number of keys, and of values of all keys */
+	nkeys   int
+	nvalues int
+
+	/* buckets */
+	buckets *buckets_t
+
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x4B1E7D2A96C3F058
+)
+
+/*
+ * new_buckets -- (internal) allocates a table of n empty buckets; must be
+ * called in a transaction
+ */
+func new_buckets(n int) *buckets_t {
+	b := pnew(buckets_t)
+	b.bucket = pmake([]*key_t, n)
+	return b
+}
+
+/*
+ * initialize -- creates the multimap, with hash function coefficients drawn
+ * from seed
+ */
+func initialize(ptr *data, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	txn("undo") {
+		ptr.hash_fun_a = uint64(rng.Int63n(1000)) + 1
+		ptr.hash_fun_b = uint64(rng.Int63n(100000))
+		ptr.hash_fun_p = HASH_FUNC_COEFF_P
+		ptr.nkeys = 0
+		ptr.nvalues = 0
+		ptr.buckets = new_buckets(INIT_BUCKETS_NUM)
+		ptr.magic = magic
+	}
+}
+
+/*
+ * hash -- the simplest hashing function,
+ * see https://en.wikipedia.org/wiki/Universal_hashing#Hashing_integers
+ */
+func hash(ptr *data, b *buckets_t, key int) int {
+	a, c, p := ptr.hash_fun_a, ptr.hash_fun_b, ptr.hash_fun_p
+	return int((a * uint64(key) + c) % p % uint64(len(b.bucket)))
+}
+
+/*
+ * mm_rebuild -- (internal) rebuilds the table with a new number of buckets,
+ * moving every key, with its values, to its new bucket in one transaction
+ */
+func mm_rebuild(ptr *data, new_len int) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		buckets_new := new_buckets(new_len)
+		for _, k := range ptr.buckets.bucket {
+			for k != nil {
+				next := k.next
+				h := hash(ptr, buckets_new, k.key)
+				k.next = buckets_new.bucket[h]
+				buckets_new.bucket[h] = k
+				k = next
+			}
+		}
+		ptr.buckets = buckets_new
+	}
+	return nil
+}
+
+/*
+ * mm_link -- (internal) returns the link to the entry of key in its bucket,
+ * which points to nil if the key is not in the multimap
+ */
+func mm_link(ptr *data, key int) **key_t {
+	link := &ptr.buckets.bucket[hash(ptr, ptr.buckets, key)]
+	for *link != nil && (*link).key != key {
+		link = &(*link).next
+	}
+	return link
+}
+
+/*
+ * mm_add -- adds a value to the values of key, creating the key if it is not
+ * in the multimap yet
+ */
+func mm_add(ptr *data, key int, value int) (err error) {
+	link := mm_link(ptr, key)
+	defer pool_full(&err)
+	txn("undo") {
+		v := pnew(value_t)
+		v.value = value
+		k := *link
+		if k == nil {
+			k = pnew(key_t)
+			k.key = key
+			*link = k
+			ptr.nkeys++
+		}
+		v.next = k.values
+		k.values = v
+		k.nvalues++
+		ptr.nvalues++
+	}
+
+	if ptr.nkeys > MAX_LOAD_FACTOR * len(ptr.buckets.bucket) {
+		/* a full pool only leaves the table as long chains */
+		mm_rebuild(ptr, len(ptr.buckets.bucket) * 2)
+	}
+	return nil
+}
+
+/*
+ * mm_unlink -- (internal) removes the entry at link with all its values and
+ * shrinks the table by half once it has more buckets than keys
+ */
+func mm_unlink(ptr *data, link **key_t) {
+	k := *link
+	txn("undo") {
+		*link = k.next
+		ptr.nkeys--
+		ptr.nvalues -= k.nvalues
+	}
+
+	b := ptr.buckets
+	if ptr.nkeys < len(b.bucket) && len(b.bucket) / 2 >= INIT_BUCKETS_NUM {
+		mm_rebuild(ptr, len(b.bucket) / 2)
+	}
+}
+
+/*
+ * mm_remove -- removes one occurrence of value from the values of key, and
+ * the key along with its last value; returns whether it was found
+ */
+func mm_remove(ptr *data, key int, value int) bool {
+	link := mm_link(ptr, key)
+	k := *link
+	if k == nil {
+		return false
+	}
+	vlink := &k.values
+	for *vlink != nil && (*vlink).value != value {
+		vlink = &(*vlink).next
+	}
+	if *vlink == nil {
+		return false
+	}
+
+	if k.nvalues == 1 {
+		mm_unlink(ptr, link)
+		return true
+	}
+	txn("undo") {
+		*vlink = (*vlink).next
+		k.nvalues--
+		ptr.nvalues--
+	}
+	return true
+}
+
+/*
+ * mm_remove_all -- removes key with all its values, returning how many there
+ * were
+ */
+func mm_remove_all(ptr *data, key int) int {
+	link := mm_link(ptr, key)
+	if *link == nil {
+		return 0
+	}
+	n := (*link).nvalues
+	mm_unlink(ptr, link)
+	return n
+}
+
+/*
+ * mm_count -- returns the number of values of key
+ */
+func mm_count(ptr *data, key int) int {
+	if k := *mm_link(ptr, key); k != nil {
+		return k.nvalues
+	}
+	return 0
+}
+
+/*
+ * mm_foreach_value -- calls cb for every value of key, the most recently
+ * added first, stopping early when cb returns true
+ */
+func mm_foreach_value(ptr *data, key int, cb func(int) bool) bool {
+	k := *mm_link(ptr, key)
+	if k == nil {
+		return false
+	}
+	for v := k.values; v != nil; v = v.next {
+		if cb(v.value) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * mm_foreach_key -- calls cb for every key with its number of values, bucket
+ * by bucket, stopping early when cb returns true
+ */
+func mm_foreach_key(ptr *data, cb func(int, int) bool) bool {
+	for _, k := range ptr.buckets.bucket {
+		for ; k != nil; k = k.next {
+			if cb(k.key, k.nvalues) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * mm_clear -- removes all keys and shrinks the table back to its initial
+ * size
+ */
+func mm_clear(ptr *data) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		b := new_buckets(INIT_BUCKETS_NUM)
+		ptr.buckets = b
+		ptr.nkeys = 0
+		ptr.nvalues = 0
+	}
+	return nil
+}
+
+/*
+ * mm_check -- verifies that every key is in the bucket of its hash, that no
+ * key is stored twice, that the value counts match the chains and that the
+ * totals are right; returns the most values held by a key
+ */
+func mm_check(ptr *data) (int, error) {
+	seen := make(map[int]bool)
+	values := 0
+	most := 0
+	for i, k := range ptr.buckets.bucket {
+		for ; k != nil; k = k.next {
+			if hash(ptr, ptr.buckets, k.key) != i {
+				return 0, fmt.Errorf("key %d is in bucket %d", k.key, i)
+			}
+			if seen[k.key] {
+				return 0, fmt.Errorf("key %d is stored twice", k.key)
+			}
+			seen[k.key] = true
+			n := 0
+			for v := k.values; v != nil; v = v.next {
+				n++
+			}
+			if n == 0 || n != k.nvalues {
+				return 0, fmt.Errorf("key %d has %d values, count is %d",
+					k.key, n, k.nvalues)
+			}
+			values += n
+			if n > most {
+				most = n
+			}
+		}
+	}
+	if len(seen) != ptr.nkeys || values != ptr.nvalues {
+		return 0, fmt.Errorf("%d keys and %d values, counts are %d and %d",
+			len(seen), values, ptr.nkeys, ptr.nvalues)
+	}
+	return most, nil
+}
+
+/*
+ * str_add -- mm_add wrapper which works on strings
+ */
+func str_add(ptr *data, str string) {
+	var key, value int
+	if scan_args("add", str, "%d %d", &key, &value) {
+		if err := mm_add(ptr, key, value); err != nil {
+			fmt.Println("add:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- mm_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key, value int
+	if scan_args("remove", str, "%d %d", &key, &value) {
+		if !mm_remove(ptr, key, value) {
+			fmt.Println("no such value")
+		}
+	}
+}
+
+/*
+ * str_remove_all -- mm_remove_all wrapper which works on strings, printing
+ * the number of values removed
+ */
+func str_remove_all(ptr *data, str string) {
+	var key int
+	if scan_args("remove all", str, "%d", &key) {
+		fmt.Println(mm_remove_all(ptr, key))
+	}
+}
+
+/*
+ * str_get -- prints the values of the key given as a string
+ */
+func str_get(ptr *data, str string) {
+	var key int
+	if scan_args("get", str, "%d", &key) {
+		mm_foreach_value(ptr, key, func(value int) bool {
+			fmt.Print(value, " ")
+			return false
+		})
+		fmt.Println()
+	}
+}
+
+/*
+ * str_count -- mm_count wrapper which works on strings
+ */
+func str_count(ptr *data, str string) {
+	var key int
+	if scan_args("count", str, "%d", &key) {
+		fmt.Println(mm_count(ptr, key))
+	}
+}
+
+/*
+ * str_insert_random -- adds specified (as string) number of random values,
+ * to keys drawn from a range a tenth that size so that keys get several
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			key := rand.Intn(val / 10 + 1)
+			if err := mm_add(ptr, key, rand.Int()); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+/*
+ * str_clear -- mm_clear wrapper which reports its error
+ */
+func str_clear(ptr *data) {
+	if err := mm_clear(ptr); err != nil {
+		fmt.Println("clear:", err)
+	}
+}
+
+func help() {
+	print_help(
+		"a $key $value - add $value to the values of $key",
+		"r $key $value - remove one $value from the values of $key",
+		"R $key - remove $key with all its values, print how many",
+		"g $key - print the values of $key",
+		"c $key - print the number of values of $key",
+		"n $value - add $value random values",
+		"p - print all keys with their values",
+		"d - print debug info",
+		"x - remove all keys",
+	)
+}
+
+func print_all(ptr *data) {
+	mm_foreach_key(ptr, func(key int, n int) bool {
+		fmt.Print(key, ":")
+		mm_foreach_value(ptr, key, func(value int) bool {
+			fmt.Print(" ", value)
+			return false
+		})
+		fmt.Println()
+		return false
+	})
+}
+
+func print_debug(ptr *data) {
+	if most, err := mm_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("a:", ptr.hash_fun_a, "b:", ptr.hash_fun_b, "p:", ptr.hash_fun_p)
+		fmt.Printf("keys: %d values: %d buckets: %d most values of a key: %d\n",
+			ptr.nkeys, ptr.nvalues, len(ptr.buckets.bucket), most)
+	}
+}
+
+/*
+ * Run -- opens the multimap named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("multimap", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr, time.Now().UnixNano())
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'a': str_add(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'R': str_remove_all(ptr, buf[1:])
+			case 'g': str_get(ptr, buf[1:])
+			case 'c': str_count(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,290 @@
+package main
+
+// A persistent ordered set of ints, for the programs it is built with; see
+// build.sh.
+//
+// The keys are held in an AVL tree, as in avltree.go, so the set stays
+// balanced whatever the order of the updates, and is walked in key order by
+// oset_foreach and oset_range. Every mutator is a transaction of its own,
+// and may be nested in the transaction of the caller.
+
+import (
+	"fmt"
+)
+
+// oset_node is a node of the tree: the heights of its subtrees differ by at
+// most one.
+type oset_node struct {
+	key    int
+	height int // of the subtree, 1 for a leaf
+	slots  [2]*oset_node
+}
+
+// oset is a set of keys; count is the number of nodes of the tree.
+type oset struct {
+	root  *oset_node
+	count int
+}
+
+// oset_new allocates an empty set.
+func oset_new() *oset {
+	var s *oset
+	txn("undo") {
+		s = pnew(oset)
+	}
+	return s
+}
+
+func oset_height(n *oset_node) int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+func oset_fix_height(n *oset_node) {
+	h := oset_height(n.slots[0])
+	if r := oset_height(n.slots[1]); r > h {
+		h = r
+	}
+	n.height = h + 1
+}
+
+// oset_rotate moves n down to its slot d, lifting its other child into its
+// place, and returns that child.
+func oset_rotate(n *oset_node, d int) *oset_node {
+	child := n.slots[1-d]
+	n.slots[1-d] = child.slots[d]
+	child.slots[d] = n
+	oset_fix_height(n)
+	oset_fix_height(child)
+	return child
+}
+
+// oset_balance restores the height difference of at most one at n, whose
+// subtrees are balanced and differ by at most two, and returns the root of
+// the subtree.
+func oset_balance(n *oset_node) *oset_node {
+	for d := 0; d < 2; d++ {
+		if oset_height(n.slots[d])-oset_height(n.slots[1-d]) > 1 {
+			child := n.slots[d]
+			if oset_height(child.slots[1-d]) > oset_height(child.slots[d]) {
+				n.slots[d] = oset_rotate(child, d)
+			}
+			return oset_rotate(n, 1-d)
+		}
+	}
+	oset_fix_height(n)
+	return n
+}
+
+func oset_add_node(n *oset_node, key int) (*oset_node, bool) {
+	if n == nil {
+		n = pnew(oset_node)
+		n.key = key
+		n.height = 1
+		return n, true
+	}
+	if key == n.key {
+		return n, false
+	}
+	i := 0
+	if key > n.key {
+		i = 1
+	}
+	child, added := oset_add_node(n.slots[i], key)
+	if !added {
+		return n, false
+	}
+	n.slots[i] = child
+	return oset_balance(n), true
+}
+
+// oset_add adds key to the set, rebalancing the path to it in the same
+// transaction, and returns whether it was not in the set yet. A full pool
+// rolls the transaction back with ErrPoolFull.
+func oset_add(s *oset, key int) (added bool, err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		var n *oset_node
+		if n, added = oset_add_node(s.root, key); added {
+			s.root = n
+			s.count++
+		}
+	}
+	return added, nil
+}
+
+// oset_remove_min unlinks the node with the smallest key from the subtree of
+// n and returns the new root of the subtree.
+func oset_remove_min(n *oset_node) *oset_node {
+	if n.slots[0] == nil {
+		return n.slots[1]
+	}
+	n.slots[0] = oset_remove_min(n.slots[0])
+	return oset_balance(n)
+}
+
+func oset_remove_node(n *oset_node, key int) (*oset_node, bool) {
+	if n == nil {
+		return nil, false
+	}
+	if key != n.key {
+		i := 0
+		if key > n.key {
+			i = 1
+		}
+		child, found := oset_remove_node(n.slots[i], key)
+		if !found {
+			return n, false
+		}
+		n.slots[i] = child
+		return oset_balance(n), true
+	}
+	if n.slots[0] == nil {
+		return n.slots[1], true
+	}
+	if n.slots[1] == nil {
+		return n.slots[0], true
+	}
+	// the successor of n takes its place
+	m := n.slots[1]
+	for m.slots[0] != nil {
+		m = m.slots[0]
+	}
+	m.slots[1] = oset_remove_min(n.slots[1])
+	m.slots[0] = n.slots[0]
+	return oset_balance(m), true
+}
+
+// oset_remove deletes key from the set, rebalancing the path to it in the
+// same transaction, and returns whether it was found.
+func oset_remove(s *oset, key int) bool {
+	found := false
+	txn("undo") {
+		var n *oset_node
+		if n, found = oset_remove_node(s.root, key); found {
+			s.root = n
+			s.count--
+		}
+	}
+	return found
+}
+
+// oset_contains checks if key is in the set.
+func oset_contains(s *oset, key int) bool {
+	n := s.root
+	for n != nil && n.key != key {
+		i := 0
+		if key > n.key {
+			i = 1
+		}
+		n = n.slots[i]
+	}
+	return n != nil
+}
+
+// oset_end returns the smallest key of the set for d 0, the largest for d
+// 1, and false if the set is empty.
+func oset_end(s *oset, d int) (int, bool) {
+	n := s.root
+	if n == nil {
+		return 0, false
+	}
+	for n.slots[d] != nil {
+		n = n.slots[d]
+	}
+	return n.key, true
+}
+
+// oset_min returns the smallest key of the set, and false if it is empty.
+func oset_min(s *oset) (int, bool) {
+	return oset_end(s, 0)
+}
+
+// oset_max returns the largest key of the set, and false if it is empty.
+func oset_max(s *oset) (int, bool) {
+	return oset_end(s, 1)
+}
+
+func oset_range_node(n *oset_node, lo int, hi int, cb func(int) bool) bool {
+	if n == nil {
+		return false
+	}
+	if n.key > lo && oset_range_node(n.slots[0], lo, hi, cb) {
+		return true
+	}
+	if n.key >= lo && n.key <= hi && cb(n.key) {
+		return true
+	}
+	return n.key < hi && oset_range_node(n.slots[1], lo, hi, cb)
+}
+
+// oset_range calls cb in order for the keys from lo to hi, both included,
+// stopping early when cb returns true; only the subtrees which may hold
+// such keys are visited.
+func oset_range(s *oset, lo int, hi int, cb func(int) bool) bool {
+	return oset_range_node(s.root, lo, hi, cb)
+}
+
+// oset_foreach calls cb for every key in order, stopping early when cb
+// returns true.
+func oset_foreach(s *oset, cb func(int) bool) bool {
+	if min, ok := oset_min(s); ok {
+		max, _ := oset_max(s)
+		return oset_range(s, min, max, cb)
+	}
+	return false
+}
+
+// oset_clear removes all keys, leaving the nodes to the garbage collector.
+func oset_clear(s *oset) {
+	txn("undo") {
+		s.root = nil
+		s.count = 0
+	}
+}
+
+func oset_check_node(n *oset_node, lo int, hi int, bounded [2]bool) (int, int, error) {
+	if n == nil {
+		return 0, 0, nil
+	}
+	if (bounded[0] && n.key <= lo) || (bounded[1] && n.key >= hi) {
+		return 0, 0, fmt.Errorf("key %d is out of order", n.key)
+	}
+	lh, lc, err := oset_check_node(n.slots[0], lo, n.key, [2]bool{bounded[0], true})
+	if err != nil {
+		return 0, 0, err
+	}
+	rh, rc, err := oset_check_node(n.slots[1], n.key, hi, [2]bool{true, bounded[1]})
+	if err != nil {
+		return 0, 0, err
+	}
+	if lh-rh > 1 || rh-lh > 1 {
+		return 0, 0, fmt.Errorf("subtrees of key %d have heights %d and %d",
+			n.key, lh, rh)
+	}
+	h := lh + 1
+	if rh >= lh {
+		h = rh + 1
+	}
+	if h != n.height {
+		return 0, 0, fmt.Errorf("key %d has height %d, recorded as %d",
+			n.key, h, n.height)
+	}
+	return h, lc + rc + 1, nil
+}
+
+// oset_check verifies that the keys are in order, that the tree is balanced
+// with the heights recorded right, and that count is right; returns the
+// height of the tree.
+func oset_check(s *oset) (int, error) {
+	h, count, err := oset_check_node(s.root, 0, 0, [2]bool{})
+	if err != nil {
+		return 0, err
+	}
+	if count != s.count {
+		return 0, fmt.Errorf("%d keys, count is %d", count, s.count)
+	}
+	return h, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/*
+ * data -- the keys are kept in set, see oset.go
+ */
+type data struct {
+	set   *oset
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x5C2A8E17F0B9D643
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.set = oset_new()
+		ptr.magic = magic
+	}
+}
+
+/*
+ * str_add -- oset_add wrapper which works on strings
+ */
+func str_add(ptr *data, str string) {
+	var key int
+	if scan_args("add", str, "%d", &key) {
+		if _, err := oset_add(ptr.set, key); err != nil {
+			fmt.Println("add:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- oset_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key int
+	if scan_args("remove", str, "%d", &key) {
+		if !oset_remove(ptr.set, key) {
+			fmt.Println("no such value")
+		}
+	}
+}
+
+/*
+ * str_check -- oset_contains wrapper which works on strings
+ */
+func str_check(ptr *data, str string) {
+	var key int
+	if scan_args("check", str, "%d", &key) {
+		fmt.Println(oset_contains(ptr.set, key))
+	}
+}
+
+/*
+ * str_end -- prints the smallest key of the set for d 0, the largest for d 1
+ */
+func str_end(ptr *data, d int) {
+	if key, ok := oset_end(ptr.set, d); ok {
+		fmt.Println(key)
+	} else {
+		fmt.Println("set is empty")
+	}
+}
+
+/*
+ * str_range -- prints the keys between the bounds given as a string
+ */
+func str_range(ptr *data, str string) {
+	var lo, hi int
+	if scan_args("range", str, "%d %d", &lo, &hi) {
+		oset_range(ptr.set, lo, hi, func(key int) bool {
+			fmt.Print(key, " ")
+			return false
+		})
+		fmt.Println()
+	}
+}
+
+/*
+ * str_insert_random -- adds specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if _, err := oset_add(ptr.set, rand.Int()); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"a $value - add $value",
+		"r $value - remove $value",
+		"c $value - check $value, returns 0/1",
+		"m - print the smallest value",
+		"M - print the largest value",
+		"R $lo $hi - print the values from $lo to $hi",
+		"n $value - add $value random values",
+		"p - print all values",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	oset_foreach(ptr.set, func(key int) bool {
+		fmt.Print(key, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if h, err := oset_check(ptr.set); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("count:", ptr.set.count, "height:", h)
+	}
+}
+
+/*
+ * Run -- opens the set named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("osetcli", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'a': str_add(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'c': str_check(ptr, buf[1:])
+			case 'm': str_end(ptr, 0)
+			case 'M': str_end(ptr, 1)
+			case 'R': str_range(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': oset_clear(ptr.set)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
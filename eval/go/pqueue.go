@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* number of items a new heap has room for */
+const PQUEUE_MIN_CAPACITY int = 16
+
+type item struct {
+	key   int
+	value int
+}
+
+/*
+ * data -- items[:n] is a binary min-heap: the key of items[i] is not less
+ * than the key of its parent items[(i - 1) / 2]
+ */
+type data struct {
+	items []item
+	n     int
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x31C7F9A05E4B8D26
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.items = pmake([]item, PQUEUE_MIN_CAPACITY)
+		ptr.n = 0
+		ptr.magic = magic
+	}
+}
+
+var ErrEmpty = errors.New("queue is empty")
+
+/*
+ * pqueue_sift_up -- (internal) moves the item at i up until its parent has a
+ * smaller or equal key
+ */
+func pqueue_sift_up(items []item, i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if items[parent].key <= items[i].key {
+			break
+		}
+		items[parent], items[i] = items[i], items[parent]
+		i = parent
+	}
+}
+
+/*
+ * pqueue_sift_down -- (internal) moves the item at i down the first n items
+ * until none of its children has a smaller key
+ */
+func pqueue_sift_down(items []item, n int, i int) {
+	for {
+		min := i
+		for c := 2 * i + 1; c <= 2 * i + 2 && c < n; c++ {
+			if items[c].key < items[min].key {
+				min = c
+			}
+		}
+		if min == i {
+			return
+		}
+		items[min], items[i] = items[i], items[min]
+		i = min
+	}
+}
+
+/*
+ * pqueue_insert -- adds the item with the key, doubling the array first if it
+ * is full
+ */
+func pqueue_insert(ptr *data, key int, value int) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		if ptr.n == len(ptr.items) {
+			items := pmake([]item, 2 * len(ptr.items))
+			copy(items, ptr.items)
+			ptr.items = items
+		}
+		ptr.items[ptr.n] = item{key, value}
+		pqueue_sift_up(ptr.items, ptr.n)
+		ptr.n++
+	}
+	return nil
+}
+
+/*
+ * pqueue_min -- returns the item with the smallest key without removing it
+ */
+func pqueue_min(ptr *data) (item, error) {
+	if ptr.n == 0 {
+		return item{}, ErrEmpty
+	}
+	return ptr.items[0], nil
+}
+
+/*
+ * pqueue_extract_min -- removes and returns the item with the smallest key;
+ * the last item takes its place and is sifted down
+ */
+func pqueue_extract_min(ptr *data) (item, error) {
+	if ptr.n == 0 {
+		return item{}, ErrEmpty
+	}
+	min := ptr.items[0]
+	txn("undo") {
+		ptr.n--
+		ptr.items[0] = ptr.items[ptr.n]
+		ptr.items[ptr.n] = item{}
+		pqueue_sift_down(ptr.items, ptr.n, 0)
+	}
+	return min, nil
+}
+
+/*
+ * pqueue_foreach -- calls cb for every item in the order of the array,
+ * stopping early when cb returns true
+ */
+func pqueue_foreach(ptr *data, cb func(item) bool) bool {
+	for _, it := range ptr.items[:ptr.n] {
+		if cb(it) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * pqueue_clear -- removes all items from the heap and shrinks the array back
+ * to its initial size
+ */
+func pqueue_clear(ptr *data) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		items := pmake([]item, PQUEUE_MIN_CAPACITY)
+		ptr.items = items
+		ptr.n = 0
+	}
+	return nil
+}
+
+/*
+ * pqueue_check -- verifies the heap property and that the array holds the n
+ * items
+ */
+func pqueue_check(ptr *data) error {
+	if ptr.n < 0 || ptr.n > len(ptr.items) {
+		return fmt.Errorf("%d items in an array of %d", ptr.n, len(ptr.items))
+	}
+	for i := 1; i < ptr.n; i++ {
+		if parent := (i - 1) / 2; ptr.items[i].key < ptr.items[parent].key {
+			return fmt.Errorf("item %d has key %d, less than %d of its parent",
+				i, ptr.items[i].key, ptr.items[parent].key)
+		}
+	}
+	return nil
+}
+
+/*
+ * str_insert -- pqueue_insert wrapper which works on strings
+ */
+func str_insert(ptr *data, str string) {
+	var key int
+	if scan_args("insert", str, "%d", &key) {
+		if err := pqueue_insert(ptr, key, 0); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_extract_min -- pqueue_extract_min wrapper which prints the key
+ */
+func str_extract_min(ptr *data) {
+	if it, err := pqueue_extract_min(ptr); err == nil {
+		fmt.Println(it.key)
+	} else {
+		fmt.Println(err)
+	}
+}
+
+/*
+ * str_min -- pqueue_min wrapper which prints the key
+ */
+func str_min(ptr *data) {
+	if it, err := pqueue_min(ptr); err == nil {
+		fmt.Println(it.key)
+	} else {
+		fmt.Println(err)
+	}
+}
+
+/*
+ * str_clear -- pqueue_clear wrapper which reports its error
+ */
+func str_clear(ptr *data) {
+	if err := pqueue_clear(ptr); err != nil {
+		fmt.Println("clear:", err)
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := pqueue_insert(ptr, rand.Int(), 0); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"i $value - insert $value",
+		"m - remove and print the smallest value",
+		"t - print the smallest value",
+		"n $value - insert $value random values",
+		"p - print all values in heap order",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	pqueue_foreach(ptr, func(it item) bool {
+		fmt.Print(it.key, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if err := pqueue_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("items:", ptr.n, "capacity:", len(ptr.items))
+	}
+}
+
+/*
+ * Run -- opens the queue named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("pqueue", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'm': str_extract_min(ptr)
+			case 't': str_min(ptr)
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// read_profile fails the test unless the file holds a non-empty profile,
+// which pprof writes as gzipped protocol buffers.
+func read_profile(t *testing.T, path string) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	if len(content) == 0 {
+		t.Fatalf("%s: empty profile", path)
+	}
+}
+
+// A tiny workload run between start_profiling and the function it returns
+// leaves a CPU and a heap profile behind.
+func TestProfiling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cpu := filepath.Join(dir, "cpu.prof")
+	mem := filepath.Join(dir, "mem.prof")
+
+	stop, err := start_profiling(cpu, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	work := make([]int, 100000)
+	for i := range work {
+		work[i] = (i * 7919) % len(work)
+	}
+	sort.Ints(work)
+	stop()
+
+	read_profile(t, cpu)
+	read_profile(t, mem)
+	if _, err := start_profiling(filepath.Join(dir, "missing", "cpu.prof"), ""); err == nil {
+		t.Error("a CPU profile was started in a missing directory")
+	}
+}
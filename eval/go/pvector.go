@@ -0,0 +1,264 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* capacity of the first backing array of a vector */
+const PVECTOR_MIN_CAP int = 8
+
+/*
+ * data -- the values are elems[:len(elems)]; the capacity of elems is the
+ * room left before the next reallocation
+ */
+type data struct {
+	elems []int
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x5A3C81E6D94F072B
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.elems = nil
+		ptr.magic = magic
+	}
+}
+
+/* number of reallocations since the program started */
+var pvector_grows int
+
+/*
+ * pvector_append -- appends value in one transaction; when the backing array
+ * is full the values are first copied to a new one of twice the capacity,
+ * which is swapped in only once the copy is complete
+ */
+func pvector_append(ptr *data, value int) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		if len(ptr.elems) == cap(ptr.elems) {
+			size := 2 * cap(ptr.elems)
+			if size == 0 {
+				size = PVECTOR_MIN_CAP
+			}
+			elems := pmake([]int, len(ptr.elems), size)
+			copy(elems, ptr.elems)
+			ptr.elems = elems
+			pvector_grows++
+		}
+		ptr.elems = ptr.elems[:len(ptr.elems) + 1]
+		ptr.elems[len(ptr.elems) - 1] = value
+	}
+	return nil
+}
+
+/*
+ * pvector_get -- returns the value at position i, if there is one
+ */
+func pvector_get(ptr *data, i int) (int, bool) {
+	if i < 0 || i >= len(ptr.elems) {
+		return 0, false
+	}
+	return ptr.elems[i], true
+}
+
+/*
+ * pvector_foreach -- calls cb for every position and value in order, stopping
+ * early when cb returns true
+ */
+func pvector_foreach(ptr *data, cb func(int, int) bool) bool {
+	for i, v := range ptr.elems {
+		if cb(i, v) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * pvector_truncate -- (internal) drops the values from position n on, keeping
+ * the backing array
+ */
+func pvector_truncate(ptr *data, n int) {
+	txn("undo") {
+		ptr.elems = ptr.elems[:n]
+	}
+}
+
+/*
+ * pvector_clear -- removes all values and releases the backing array
+ */
+func pvector_clear(ptr *data) {
+	txn("undo") {
+		ptr.elems = nil
+	}
+}
+
+/*
+ * pvector_bench -- appends n values, one transaction each, and prints the
+ * throughput and the number of reallocations; the vector is left as it was
+ */
+func pvector_bench(ptr *data, n int) error {
+	old, grows := len(ptr.elems), pvector_grows
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		if err := pvector_append(ptr, i); err != nil {
+			pvector_truncate(ptr, old)
+			return err
+		}
+	}
+	elapsed := time.Since(start)
+	pvector_truncate(ptr, old)
+
+	fmt.Printf("append: %d ops in %v, %.0f ops/s, %d reallocations\n", n, elapsed,
+		float64(n) / elapsed.Seconds(), pvector_grows - grows)
+	return nil
+}
+
+/*
+ * str_append -- appends the value given as a string
+ */
+func str_append(ptr *data, str string) {
+	var value int
+	if scan_args("append", str, "%d", &value) {
+		if err := pvector_append(ptr, value); err != nil {
+			fmt.Println("append:", err)
+		}
+	}
+}
+
+/*
+ * str_get -- prints the value at the position given as a string
+ */
+func str_get(ptr *data, str string) {
+	var i int
+	if scan_args("get", str, "%d", &i) {
+		if value, ok := pvector_get(ptr, i); ok {
+			fmt.Println(value)
+		} else {
+			fmt.Println("no such position")
+		}
+	}
+}
+
+/*
+ * str_bench -- pvector_bench wrapper which works on strings
+ */
+func str_bench(ptr *data, str string) {
+	var n int
+	if _, err := fmt.Sscanf(str, "%d", &n); err == nil && n > 0 {
+		if err := pvector_bench(ptr, n); err != nil {
+			fmt.Println("bench:", err)
+		}
+	} else {
+		fmt.Println("bench: invalid syntax")
+	}
+}
+
+/*
+ * str_insert_random -- appends specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := pvector_append(ptr, rand.Int()); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"a $value - append $value",
+		"g $index - print the value at $index",
+		"b $count - append $count values, print the throughput and drop them",
+		"n $value - append $value random numbers",
+		"p - print all values",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	pvector_foreach(ptr, func(i int, value int) bool {
+		fmt.Println(i, value)
+		return false
+	})
+}
+
+func print_debug(ptr *data) {
+	fmt.Println("length:", len(ptr.elems), "capacity:", cap(ptr.elems))
+	fmt.Println("reallocations this session:", pvector_grows)
+}
+
+/*
+ * Run -- opens the vector named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("pvector", flag.ContinueOnError)
+	flags.Usage = func() {}
+	bench := flags.Int("bench", 0, "append `n` values, print the throughput and exit")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	if *bench < 0 {
+		return usage_error("the bench count cannot be negative")
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	if *bench > 0 {
+		return pvector_bench(ptr, *bench)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'a': str_append(ptr, buf[1:])
+			case 'g': str_get(ptr, buf[1:])
+			case 'b': str_bench(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': pvector_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "[-bench n] filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+type entry_t struct {
+	data []byte
+}
+
+/*
+ * queue_t -- the entries from front up to back, both counting every entry
+ * ever enqueued, live in entries at their position modulo its length
+ */
+type queue_t struct {
+	front   int
+	back    int
+	entries []*entry_t
+}
+
+type data struct {
+	queue *queue_t
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x7E05C3A91B64D28F
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.queue = nil
+		ptr.magic = magic
+	}
+}
+
+var (
+	ErrNoQueue    = errors.New("no queue, create one with new")
+	ErrQueueFull  = errors.New("queue is full")
+	ErrQueueEmpty = errors.New("queue is empty")
+)
+
+/*
+ * queue_new -- allocates a new queue of capacity entries in place of the
+ * current one
+ */
+func queue_new(ptr *data, capacity int) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		q := pnew(queue_t)
+		q.entries = pmake([]*entry_t, capacity)
+		ptr.queue = q
+	}
+	return nil
+}
+
+/*
+ * queue_nentries -- returns the number of entries in the queue
+ */
+func queue_nentries(q *queue_t) int {
+	return q.back - q.front
+}
+
+/*
+ * queue_enqueue -- allocates and appends a new entry with the data
+ */
+func queue_enqueue(q *queue_t, data []byte) (err error) {
+	if len(q.entries) - queue_nentries(q) == 0 {
+		return ErrQueueFull
+	}
+	pos := q.back % len(q.entries)
+
+	defer pool_full(&err)
+	txn("undo") {
+		e := pnew(entry_t)
+		e.data = pmake([]byte, len(data))
+		copy(e.data, data)
+		q.entries[pos] = e
+		q.back++
+	}
+	return nil
+}
+
+/*
+ * queue_dequeue -- removes the entry at the front of the queue, returning
+ * its data
+ */
+func queue_dequeue(q *queue_t) ([]byte, error) {
+	if queue_nentries(q) == 0 {
+		return nil, ErrQueueEmpty
+	}
+	pos := q.front % len(q.entries)
+	e := q.entries[pos]
+
+	txn("undo") {
+		q.entries[pos] = nil
+		q.front++
+	}
+	return e.data, nil
+}
+
+/*
+ * queue_show -- prints all queue entries
+ */
+func queue_show(q *queue_t) {
+	for i := q.front; i < q.back; i++ {
+		fmt.Printf("Entry %d: %s\n", i, q.entries[i % len(q.entries)].data)
+	}
+}
+
+/*
+ * Run -- opens the queue named in args (the command line without the program
+ * name) and performs the operation that follows it
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("queue", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) < 2 {
+		return ErrUsage
+	}
+	switch args[1] {
+	case "new", "enqueue":
+		if len(args) != 3 {
+			return ErrUsage
+		}
+	case "show", "dequeue":
+		if len(args) != 2 {
+			return ErrUsage
+		}
+	default:
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	if args[1] == "new" {
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n <= 0 {
+			return usage_error("new: invalid capacity " + args[2])
+		}
+		return queue_new(ptr, n)
+	}
+
+	q := ptr.queue
+	if q == nil {
+		return ErrNoQueue
+	}
+	switch args[1] {
+	case "enqueue":
+		return queue_enqueue(q, []byte(args[2]))
+	case "dequeue":
+		data, err := queue_dequeue(q)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	case "show":
+		queue_show(q)
+	}
+	return nil
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename new n|show|enqueue data|dequeue")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+const (
+	RB_BLACK int = iota
+	RB_RED
+)
+
+/* child slots of a node_t, also the result of a comparison with its key */
+const (
+	RB_LEFT int = iota
+	RB_RIGHT
+)
+
+type node_t struct {
+	key    int
+	value  int
+	color  int
+	parent *node_t
+	slots  [2]*node_t
+}
+
+type data struct {
+	sentinel *node_t /* black leaf shared by all the nodes, holds no entry */
+	root     *node_t /* dummy node_t with the tree as its left child */
+	magic    int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x7B3A1E5C9F08D264
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		s := pnew(node_t)
+		s.color = RB_BLACK
+		s.parent = s
+		s.slots[RB_LEFT] = s
+		s.slots[RB_RIGHT] = s
+
+		r := pnew(node_t)
+		r.color = RB_BLACK
+		r.parent = s
+		r.slots[RB_LEFT] = s
+		r.slots[RB_RIGHT] = s
+
+		ptr.sentinel = s
+		ptr.root = r
+		ptr.magic = magic
+	}
+}
+
+/*
+ * rbtree_map_first -- (internal) returns the topmost node_t of the tree
+ */
+func rbtree_map_first(ptr *data) *node_t {
+	return ptr.root.slots[RB_LEFT]
+}
+
+/*
+ * rbtree_map_location -- (internal) returns the slot of its parent that holds
+ * the node_t
+ */
+func rbtree_map_location(n *node_t) int {
+	if n == n.parent.slots[RB_RIGHT] {
+		return RB_RIGHT
+	}
+	return RB_LEFT
+}
+
+/*
+ * rbtree_map_dir -- (internal) returns the slot of n in which key belongs
+ */
+func rbtree_map_dir(n *node_t, key int) int {
+	if key > n.key {
+		return RB_RIGHT
+	}
+	return RB_LEFT
+}
+
+/*
+ * rbtree_map_rotate -- (internal) moves the c-opposite child of the node_t up
+ * into its place, the node_t becoming its c child
+ */
+func rbtree_map_rotate(ptr *data, node *node_t, c int) {
+	child := node.slots[1 - c]
+	node.slots[1 - c] = child.slots[c]
+
+	if child.slots[c] != ptr.sentinel {
+		child.slots[c].parent = node
+	}
+
+	child.parent = node.parent
+	node.parent.slots[rbtree_map_location(node)] = child
+
+	child.slots[c] = node
+	node.parent = child
+}
+
+/*
+ * rbtree_map_insert_bst -- (internal) inserts a node_t in a regular BST way
+ */
+func rbtree_map_insert_bst(ptr *data, n *node_t) {
+	parent := ptr.root
+	dst := &ptr.root.slots[RB_LEFT]
+
+	n.slots[RB_LEFT] = ptr.sentinel
+	n.slots[RB_RIGHT] = ptr.sentinel
+
+	for *dst != ptr.sentinel {
+		parent = *dst
+		dst = &parent.slots[rbtree_map_dir(parent, n.key)]
+	}
+
+	n.parent = parent
+	*dst = n
+}
+
+/*
+ * rbtree_map_recolor -- (internal) restores the red-black properties around
+ * the red node_t n whose parent, the c child of its own parent, is red too;
+ * returns the node_t to go on from
+ */
+func rbtree_map_recolor(ptr *data, n *node_t, c int) *node_t {
+	uncle := n.parent.parent.slots[1 - c]
+
+	if uncle.color == RB_RED {
+		uncle.color = RB_BLACK
+		n.parent.color = RB_BLACK
+		n.parent.parent.color = RB_RED
+		return n.parent.parent
+	}
+
+	if n == n.parent.slots[1 - c] {
+		n = n.parent
+		rbtree_map_rotate(ptr, n, c)
+	}
+
+	n.parent.color = RB_BLACK
+	n.parent.parent.color = RB_RED
+	rbtree_map_rotate(ptr, n.parent.parent, 1 - c)
+
+	return n
+}
+
+/*
+ * rbtree_map_insert -- inserts a new key-value pair into the tree, or
+ * returns ErrPoolFull
+ */
+func rbtree_map_insert(ptr *data, key int, value int) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		n := pnew(node_t)
+		n.key = key
+		n.value = value
+
+		rbtree_map_insert_bst(ptr, n)
+
+		n.color = RB_RED
+		for n.parent.color == RB_RED {
+			n = rbtree_map_recolor(ptr, n, rbtree_map_location(n.parent))
+		}
+
+		rbtree_map_first(ptr).color = RB_BLACK
+	}
+	return nil
+}
+
+/*
+ * rbtree_map_successor -- (internal) returns the node_t following n in key
+ * order, or the sentinel
+ */
+func rbtree_map_successor(ptr *data, n *node_t) *node_t {
+	dst := n.slots[RB_RIGHT]
+
+	if dst != ptr.sentinel {
+		for dst.slots[RB_LEFT] != ptr.sentinel {
+			dst = dst.slots[RB_LEFT]
+		}
+	} else {
+		dst = n.parent
+		for n == dst.slots[RB_RIGHT] {
+			n = dst
+			dst = dst.parent
+		}
+		if dst == ptr.root {
+			return ptr.sentinel
+		}
+	}
+
+	return dst
+}
+
+/*
+ * rbtree_map_find_node -- (internal) returns the node_t holding key, or the
+ * sentinel
+ */
+func rbtree_map_find_node(ptr *data, key int) *node_t {
+	dst := rbtree_map_first(ptr)
+	for dst != ptr.sentinel {
+		if dst.key == key {
+			return dst
+		}
+		dst = dst.slots[rbtree_map_dir(dst, key)]
+	}
+	return ptr.sentinel
+}
+
+/*
+ * rbtree_map_repair_branch -- (internal) restores the red-black properties
+ * around n, the c child of its parent, which is one black node_t short;
+ * returns the node_t to go on from
+ */
+func rbtree_map_repair_branch(ptr *data, n *node_t, c int) *node_t {
+	sb := n.parent.slots[1 - c] /* sibling */
+	if sb.color == RB_RED {
+		sb.color = RB_BLACK
+		n.parent.color = RB_RED
+		rbtree_map_rotate(ptr, n.parent, c)
+		sb = n.parent.slots[1 - c]
+	}
+
+	if sb.slots[RB_RIGHT].color == RB_BLACK && sb.slots[RB_LEFT].color == RB_BLACK {
+		sb.color = RB_RED
+		return n.parent
+	}
+
+	if sb.slots[1 - c].color == RB_BLACK {
+		sb.slots[c].color = RB_BLACK
+		sb.color = RB_RED
+		rbtree_map_rotate(ptr, sb, 1 - c)
+		sb = n.parent.slots[1 - c]
+	}
+	sb.color = n.parent.color
+	n.parent.color = RB_BLACK
+	sb.slots[1 - c].color = RB_BLACK
+	rbtree_map_rotate(ptr, n.parent, c)
+
+	return rbtree_map_first(ptr)
+}
+
+/*
+ * rbtree_map_repair -- (internal) restores the red-black properties after a
+ * black node_t was taken out above n
+ */
+func rbtree_map_repair(ptr *data, n *node_t) {
+	/* if left, repair right sibling, otherwise repair left sibling. */
+	for n != rbtree_map_first(ptr) && n.color == RB_BLACK {
+		n = rbtree_map_repair_branch(ptr, n, rbtree_map_location(n))
+	}
+	n.color = RB_BLACK
+}
+
+/*
+ * rbtree_map_remove -- removes the key from the tree, returning its value and
+ * whether it was found
+ */
+func rbtree_map_remove(ptr *data, key int) (int, bool) {
+	n := rbtree_map_find_node(ptr, key)
+	if n == ptr.sentinel {
+		return 0, false
+	}
+
+	txn("undo") {
+		/* y is the node_t unlinked from the tree: n or its successor */
+		y := n
+		if n.slots[RB_LEFT] != ptr.sentinel && n.slots[RB_RIGHT] != ptr.sentinel {
+			y = rbtree_map_successor(ptr, n)
+		}
+
+		x := y.slots[RB_LEFT]
+		if x == ptr.sentinel {
+			x = y.slots[RB_RIGHT]
+		}
+
+		x.parent = y.parent
+		y.parent.slots[rbtree_map_location(y)] = x
+
+		if y.color == RB_BLACK {
+			rbtree_map_repair(ptr, x)
+		}
+
+		if y != n {
+			/* the successor takes the place of n */
+			y.slots = n.slots
+			y.parent = n.parent
+			y.color = n.color
+			n.slots[RB_LEFT].parent = y
+			n.slots[RB_RIGHT].parent = y
+			n.parent.slots[rbtree_map_location(n)] = y
+		}
+	}
+
+	return n.value, true
+}
+
+/*
+ * rbtree_map_get -- searches for the value of the key
+ */
+func rbtree_map_get(ptr *data, key int) (int, bool) {
+	if n := rbtree_map_find_node(ptr, key); n != ptr.sentinel {
+		return n.value, true
+	}
+	return 0, false
+}
+
+/*
+ * rbtree_map_lookup -- checks if the key exists in the tree
+ */
+func rbtree_map_lookup(ptr *data, key int) bool {
+	return rbtree_map_find_node(ptr, key) != ptr.sentinel
+}
+
+/*
+ * rbtree_map_is_empty -- checks whether the tree is empty
+ */
+func rbtree_map_is_empty(ptr *data) bool {
+	return rbtree_map_first(ptr) == ptr.sentinel
+}
+
+/*
+ * rbtree_map_foreach_node -- (internal) recursively traverses the tree
+ */
+func rbtree_map_foreach_node(ptr *data, n *node_t, cb func(int, int) bool) bool {
+	if n == ptr.sentinel {
+		return false
+	}
+	if rbtree_map_foreach_node(ptr, n.slots[RB_LEFT], cb) {
+		return true
+	}
+	if cb(n.key, n.value) {
+		return true
+	}
+	return rbtree_map_foreach_node(ptr, n.slots[RB_RIGHT], cb)
+}
+
+/*
+ * rbtree_map_foreach -- calls cb for every pair in key order, stopping early
+ * when cb returns true
+ */
+func rbtree_map_foreach(ptr *data, cb func(int, int) bool) bool {
+	return rbtree_map_foreach_node(ptr, rbtree_map_first(ptr), cb)
+}
+
+/*
+ * rbtree_map_clear -- removes all pairs from the tree
+ */
+func rbtree_map_clear(ptr *data) {
+	txn("undo") {
+		ptr.root.slots[RB_LEFT] = ptr.sentinel
+	}
+}
+
+/*
+ * rbtree_map_check_node -- (internal) verifies the subtree of n, whose keys
+ * lie within [lo, hi] where given, and returns its black height
+ */
+func rbtree_map_check_node(ptr *data, n *node_t, lo *int, hi *int) (int, error) {
+	if n == ptr.sentinel {
+		return 1, nil
+	}
+	if lo != nil && n.key < *lo || hi != nil && n.key > *hi {
+		return 0, fmt.Errorf("key %d is out of order", n.key)
+	}
+	for c := RB_LEFT; c <= RB_RIGHT; c++ {
+		child := n.slots[c]
+		if child == ptr.sentinel {
+			continue
+		}
+		if child.parent != n {
+			return 0, fmt.Errorf("key %d does not point back to its parent %d",
+				child.key, n.key)
+		}
+		if n.color == RB_RED && child.color == RB_RED {
+			return 0, fmt.Errorf("red key %d has a red child %d", n.key, child.key)
+		}
+	}
+	left, err := rbtree_map_check_node(ptr, n.slots[RB_LEFT], lo, &n.key)
+	if err != nil {
+		return 0, err
+	}
+	right, err := rbtree_map_check_node(ptr, n.slots[RB_RIGHT], &n.key, hi)
+	if err != nil {
+		return 0, err
+	}
+	if left != right {
+		return 0, fmt.Errorf("key %d has black heights %d and %d", n.key, left, right)
+	}
+	if n.color == RB_BLACK {
+		left++
+	}
+	return left, nil
+}
+
+/*
+ * rbtree_map_check -- verifies the red-black properties of the whole tree,
+ * returning its black height
+ */
+func rbtree_map_check(ptr *data) (int, error) {
+	if ptr.sentinel.color != RB_BLACK {
+		return 0, errors.New("the sentinel is red")
+	}
+	first := rbtree_map_first(ptr)
+	if first != ptr.sentinel {
+		if first.color != RB_BLACK {
+			return 0, errors.New("the root is red")
+		}
+		if first.parent != ptr.root {
+			return 0, errors.New("the root does not point back to the dummy root")
+		}
+	}
+	return rbtree_map_check_node(ptr, first, nil, nil)
+}
+
+/*
+ * str_insert -- rbtree_map_insert wrapper which works on strings
+ */
+func str_insert(ptr *data, str string) {
+	var key int
+	if scan_args("insert", str, "%d", &key) {
+		if err := rbtree_map_insert(ptr, key, 0); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- rbtree_map_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key int
+	if scan_args("remove", str, "%d", &key) {
+		if _, ok := rbtree_map_remove(ptr, key); !ok {
+			fmt.Println("no such value")
+		}
+	}
+}
+
+/*
+ * str_check -- rbtree_map_lookup wrapper which works on strings
+ */
+func str_check(ptr *data, str string) {
+	var key int
+	if scan_args("check", str, "%d", &key) {
+		fmt.Println(rbtree_map_lookup(ptr, key))
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := rbtree_map_insert(ptr, rand.Int(), 0); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"i $value - insert $value",
+		"r $value - remove $value",
+		"c $value - check $value, returns 0/1",
+		"n $value - insert $value random values",
+		"p - print all values",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	rbtree_map_foreach(ptr, func(key int, value int) bool {
+		fmt.Print(key, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if height, err := rbtree_map_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("black height:", height)
+	}
+}
+
+/*
+ * Run -- opens the tree named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("rbtree_map", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'c': str_check(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': rbtree_map_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
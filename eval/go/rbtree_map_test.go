@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/vmware/go-pmem-transaction/pmem"
+)
+
+// The tests share one pool, as go-pmem maps a single pool per process.
+func TestMain(m *testing.M) {
+	pool := filepath.Join(os.TempDir(), fmt.Sprintf("rbtree_map_test.%d.pool", os.Getpid()))
+	pmem.Init(pool)
+	status := m.Run()
+	os.Remove(pool)
+	os.Exit(status)
+}
+
+// rbtree_keys returns the keys of the tree in the order it visits them.
+func rbtree_keys(ptr *data) []int {
+	keys := []int{}
+	rbtree_map_foreach(ptr, func(key int, value int) bool {
+		keys = append(keys, key)
+		return false
+	})
+	return keys
+}
+
+// Random inserts and removes keep the red-black properties, within a black
+// height of a tree of that many keys, and the tree holds the keys inserted
+// and not removed.
+func TestRbtreeInvariants(t *testing.T) {
+	ptr := pnew(data)
+	initialize(ptr)
+	rng := rand.New(rand.NewSource(1))
+	present := map[int]bool{}
+	for i := 0; i < 3000; i++ {
+		key := rng.Intn(500)
+		if present[key] {
+			if _, ok := rbtree_map_remove(ptr, key); !ok {
+				t.Fatalf("step %d: %d not found", i, key)
+			}
+			delete(present, key)
+		} else {
+			if err := rbtree_map_insert(ptr, key, i); err != nil {
+				t.Fatalf("step %d: insert of %d: %v", i, key, err)
+			}
+			present[key] = true
+		}
+		height, err := rbtree_map_check(ptr)
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		/* n keys need at least 2^(height - 1) - 1 */
+		if len(present) < 1 << uint(height - 1) - 1 {
+			t.Fatalf("step %d: black height %d with %d keys", i, height, len(present))
+		}
+	}
+
+	want := []int{}
+	for key := range present {
+		want = append(want, key)
+	}
+	sort.Ints(want)
+	if got := rbtree_keys(ptr); !reflect.DeepEqual(got, want) {
+		t.Fatalf("the tree holds %v, want %v", got, want)
+	}
+}
+
+// rbtree_map_check finds a red root, a red node with a red child, unequal
+// black heights and a key out of order.
+func TestRbtreeCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(root *node_t)
+	}{
+		{"red root", func(root *node_t) { root.color = RB_RED }},
+		{"red child", func(root *node_t) { root.slots[RB_RIGHT].color = RB_RED }},
+		{"black height", func(root *node_t) { root.slots[RB_LEFT].color = RB_RED }},
+		{"order", func(root *node_t) { root.slots[RB_LEFT].key = root.key + 1 }},
+	}
+	for _, tc := range tests {
+		ptr := pnew(data)
+		initialize(ptr)
+		for key := 1; key <= 4; key++ {
+			rbtree_map_insert(ptr, key, 0)
+		}
+		/* 2 at the root, 1 and 3 black below it, and 4 red below 3 */
+		if _, err := rbtree_map_check(ptr); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		tc.corrupt(rbtree_map_first(ptr))
+		if _, err := rbtree_map_check(ptr); err == nil {
+			t.Errorf("%s: the broken tree passed the check", tc.name)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+// The command loop of the interactive programs it is built with, and the
+// helpers their commands share; see build.sh.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// input_line is a line read by read_lines, with the error which ended the
+// input.
+type input_line struct {
+	buf string
+	err error
+}
+
+// read_lines reads r in a goroutine of its own and sends its lines on the
+// returned channel, so that run_commands can wait for a line and a signal at
+// once; the line carrying an error is the last one.
+func read_lines(r io.Reader) <-chan input_line {
+	lines := make(chan input_line)
+	go func() {
+		reader := bufio.NewReader(r)
+		for {
+			buf, err := reader.ReadString('\n')
+			lines <- input_line{buf, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return lines
+}
+
+// run_commands prompts for the commands read from r and passes every one
+// which is not blank to run, without its newline, until 'q', EOF or a signal.
+// A signal is only noticed between commands, so the one running completes; a
+// read error other than EOF ends the loop without running its partial line.
+func run_commands(r io.Reader, run func(buf string)) error {
+	lines := read_lines(r)
+	for {
+		fmt.Print("$ ")
+		var line input_line
+		select {
+		case <-interrupted:
+			return ErrInterrupted
+		case line = <-lines:
+		}
+		buf, err := line.buf, line.err
+		if err != nil && err != io.EOF {
+			return err
+		}
+		// convert CRLF to LF
+		buf = strings.Replace(buf, "\n", "", -1)
+
+		if len(buf) > 0 && buf[0] != 0 && buf[0] != '\n' {
+			if buf[0] == 'q' {
+				return nil
+			}
+			run(buf)
+		}
+		// nothing follows the line which met the end of r
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// scan_args scans the arguments of command cmd from str by format, as
+// fmt.Sscanf, and reports whether they were all found, printing that the
+// syntax is invalid if not.
+func scan_args(cmd string, str string, format string, args ...interface{}) bool {
+	if _, err := fmt.Sscanf(str, format, args...); err != nil {
+		fmt.Println(cmd + ": invalid syntax")
+		return false
+	}
+	return true
+}
+
+// print_help prints the help of a program: the line of every command it
+// runs, between the ones of 'h' and 'q', which run_commands handles for all.
+func print_help(commands ...string) {
+	fmt.Println("h - help")
+	for _, c := range commands {
+		fmt.Println(c)
+	}
+	fmt.Println("q - quit")
+}
+
+// unknown_command reports a command which the program does not run.
+func unknown_command(str string) {
+	fmt.Println("unknown command '",str,"', use 'h' for help")
+}
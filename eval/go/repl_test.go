@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// run_commands passes the commands without their newlines, skips the blank
+// lines and stops at 'q', or at EOF on a last line without a newline.
+func TestRunCommands(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"i 1\n\ni 2\r\nq\ni 3\n", []string{"i 1", "i 2\r"}},
+		{"p\nr 7", []string{"p", "r 7"}},
+		{"", nil},
+	}
+	for _, tc := range tests {
+		var got []string
+		err := run_commands(strings.NewReader(tc.input), func(buf string) {
+			got = append(got, buf)
+		})
+		if err != nil {
+			t.Fatalf("%q: %v", tc.input, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: ran %q, want %q", tc.input, got, tc.want)
+		}
+	}
+}
+
+// A read error other than EOF ends the loop with that error.
+func TestRunCommandsError(t *testing.T) {
+	broken := errors.New("broken input")
+	r := io.MultiReader(strings.NewReader("i 1\n"), &failing_reader{broken})
+	n := 0
+	if err := run_commands(r, func(buf string) { n++ }); err != broken {
+		t.Fatalf("run_commands returned %v, want %v", err, broken)
+	}
+	if n != 1 {
+		t.Fatalf("ran %d commands, want 1", n)
+	}
+}
+
+// A signal waiting before the first command ends the loop as interrupted,
+// without running anything.
+func TestRunCommandsInterrupted(t *testing.T) {
+	interrupted <- os.Interrupt
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	err := run_commands(pr, func(buf string) {
+		t.Errorf("ran %q after the signal", buf)
+	})
+	if err != ErrInterrupted {
+		t.Fatalf("run_commands returned %v, want ErrInterrupted", err)
+	}
+}
+
+// scan_args reports whether the arguments were all scanned.
+func TestScanArgs(t *testing.T) {
+	var a, b int
+	if !scan_args("insert", " 3 4", "%d %d", &a, &b) || a != 3 || b != 4 {
+		t.Errorf("scanned %d %d, want 3 4", a, b)
+	}
+	if scan_args("insert", " 3 x", "%d %d", &a, &b) {
+		t.Error("a malformed argument was scanned")
+	}
+	if scan_args("insert", "", "%d", &a) {
+		t.Error("a missing argument was scanned")
+	}
+}
+
+// failing_reader fails every read with err.
+type failing_reader struct {
+	err error
+}
+
+func (r *failing_reader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,119 @@
+package main
+
+// Replays timed workloads against the structure of the program it is built
+// with; see build.sh.
+//
+// A timed workload has one operation per line: the time it was issued at, in
+// microseconds from an arbitrary origin, followed by a command of the program
+// and its arguments, for instance
+//
+//	1500 put 7 10
+//	1730 get 7
+//	2950 del 7
+//
+// Times never decrease. Blank lines and lines starting with '#' are skipped.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// replay_op is one operation of a timed workload.
+type replay_op struct {
+	at   time.Duration // since the first operation
+	args []string
+}
+
+// read_workload parses a timed workload.
+func read_workload(r io.Reader) ([]replay_op, error) {
+	var ops []replay_op
+	var first, last int64
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		us, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("workload line %d: invalid time '%s'", line, fields[0])
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("workload line %d: no command", line)
+		}
+		if len(ops) == 0 {
+			first = us
+		} else if us < last {
+			return nil, fmt.Errorf("workload line %d: time %d is before %d", line, us, last)
+		}
+		last = us
+		ops = append(ops, replay_op{time.Duration(us-first) * time.Microsecond, fields[1:]})
+	}
+	return ops, scanner.Err()
+}
+
+// replay runs each operation with exec at its recorded time divided by
+// speedup, in order, and returns their latencies. The replay is open loop:
+// an operation falling due while an earlier one is still running starts as
+// soon as it completes, and its latency, counted from the time it was due,
+// includes the wait. The replay stops at the first operation that fails.
+func replay(ops []replay_op, speedup float64, exec func(args []string) error) ([]time.Duration, error) {
+	lat := make([]time.Duration, 0, len(ops))
+	start := time.Now()
+	for _, op := range ops {
+		due := start.Add(time.Duration(float64(op.at) / speedup))
+		if d := due.Sub(time.Now()); d > 0 {
+			time.Sleep(d)
+		}
+		if err := exec(op.args); err != nil {
+			return lat, fmt.Errorf("%s: %v", strings.Join(op.args, " "), err)
+		}
+		lat = append(lat, time.Since(due))
+	}
+	return lat, nil
+}
+
+// print_latencies writes the number of operations and their latency
+// percentiles to w.
+func print_latencies(w io.Writer, lat []time.Duration) {
+	if len(lat) == 0 {
+		fmt.Fprintln(w, "ops 0")
+		return
+	}
+	sorted := append([]time.Duration(nil), lat...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(p float64) time.Duration {
+		return sorted[int(p*float64(len(sorted)-1))]
+	}
+	fmt.Fprintln(w, "ops", len(sorted))
+	fmt.Fprintln(w, "p50", at(0.50))
+	fmt.Fprintln(w, "p90", at(0.90))
+	fmt.Fprintln(w, "p99", at(0.99))
+	fmt.Fprintln(w, "max", sorted[len(sorted)-1])
+}
+
+// replay_file replays the workload in path and prints the latencies, also
+// when an operation fails part way.
+func replay_file(path string, speedup float64, exec func(args []string) error) error {
+	if speedup <= 0 {
+		return usage_error("the speedup must be positive")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ops, err := read_workload(f)
+	if err != nil {
+		return err
+	}
+	lat, err := replay(ops, speedup, exec)
+	print_latencies(os.Stdout, lat)
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A timed workload replayed with a speedup of 1000 runs its operations in
+// order, each no earlier than its recorded time divided by 1000, and all of
+// them in far less time than the workload spans.
+func TestReplay(t *testing.T) {
+	ops, err := read_workload(strings.NewReader(`
+# a second between operations, a millisecond once sped up
+5000000 put a 1
+6000000 get a
+
+7000000 put b 2
+9000000 del a
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	var at []time.Duration
+	start := time.Now()
+	lat, err := replay(ops, 1000, func(args []string) error {
+		at = append(at, time.Since(start))
+		got = append(got, strings.Join(args, " "))
+		return nil
+	})
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"put a 1", "get a", "put b 2", "del a"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("operations %q, want %q", got, want)
+	}
+	if len(lat) != len(want) {
+		t.Fatalf("%d latencies for %d operations", len(lat), len(want))
+	}
+	for i, due := range []time.Duration{0, time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond} {
+		if at[i] < due {
+			t.Errorf("%q ran at %v, before %v", got[i], at[i], due)
+		}
+	}
+	if elapsed > time.Second {
+		t.Errorf("the replay took %v, the delays are not scaled", elapsed)
+	}
+}
+
+// The replay stops at the first operation that fails, with the latencies of
+// the ones before it.
+func TestReplayError(t *testing.T) {
+	ops, err := read_workload(strings.NewReader("0 put a 1\n10 get b\n20 get a\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	lat, err := replay(ops, 1000, func(args []string) error {
+		n++
+		if args[1] == "b" {
+			return errors.New("no such key")
+		}
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "get b: no such key") {
+		t.Fatalf("error %v, want the failure of get b", err)
+	}
+	if n != 2 || len(lat) != 1 {
+		t.Fatalf("%d operations run, %d latencies, want 2 and 1", n, len(lat))
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* largest record the log holds */
+const RINGBUF_RECORD_SIZE int = 64
+
+/* number of records of a new log, unless -capacity says otherwise */
+const RINGBUF_DEFAULT_CAPACITY int = 1024
+
+type record_t struct {
+	len  int
+	data [RINGBUF_RECORD_SIZE]byte
+}
+
+/*
+ * data -- head and tail count the records ever consumed and appended; the
+ * records in between are at their count modulo the capacity in records
+ */
+type data struct {
+	records []record_t
+	head    int
+	tail    int
+	magic   int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x47A2E6B09D1C35F8
+)
+
+/*
+ * initialize -- creates an empty log with room for capacity records
+ */
+func initialize(ptr *data, capacity int) {
+	txn("undo") {
+		ptr.records = pmake([]record_t, capacity)
+		ptr.head = 0
+		ptr.tail = 0
+		ptr.magic = magic
+	}
+}
+
+var (
+	ErrFull     = errors.New("log is full")
+	ErrEmpty    = errors.New("log is empty")
+	ErrTooLarge = fmt.Errorf("record is longer than %d bytes", RINGBUF_RECORD_SIZE)
+)
+
+/*
+ * ringbuf_len -- returns the number of records in the log
+ */
+func ringbuf_len(ptr *data) int {
+	return ptr.tail - ptr.head
+}
+
+/*
+ * ringbuf_append -- writes the record after the last one, wrapping around to
+ * the start of the array past its end
+ */
+func ringbuf_append(ptr *data, rec []byte) error {
+	if len(rec) > RINGBUF_RECORD_SIZE {
+		return ErrTooLarge
+	}
+	if ringbuf_len(ptr) == len(ptr.records) {
+		return ErrFull
+	}
+	txn("undo") {
+		r := &ptr.records[ptr.tail % len(ptr.records)]
+		r.len = copy(r.data[:], rec)
+		ptr.tail++
+	}
+	return nil
+}
+
+/*
+ * ringbuf_consume -- removes the oldest record, returning a copy of it
+ */
+func ringbuf_consume(ptr *data) ([]byte, error) {
+	if ringbuf_len(ptr) == 0 {
+		return nil, ErrEmpty
+	}
+	r := &ptr.records[ptr.head % len(ptr.records)]
+	rec := make([]byte, r.len)
+	copy(rec, r.data[:r.len])
+	txn("undo") {
+		ptr.head++
+	}
+	return rec, nil
+}
+
+/*
+ * ringbuf_foreach -- calls cb for every record from the oldest on, stopping
+ * early when cb returns true
+ */
+func ringbuf_foreach(ptr *data, cb func([]byte) bool) bool {
+	for i := ptr.head; i < ptr.tail; i++ {
+		r := &ptr.records[i % len(ptr.records)]
+		if cb(r.data[:r.len]) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * ringbuf_clear -- removes all records from the log
+ */
+func ringbuf_clear(ptr *data) {
+	txn("undo") {
+		ptr.head = ptr.tail
+	}
+}
+
+/*
+ * ringbuf_check -- verifies that the indices fit the capacity
+ */
+func ringbuf_check(ptr *data) error {
+	if ptr.head < 0 || ptr.head > ptr.tail || ringbuf_len(ptr) > len(ptr.records) {
+		return fmt.Errorf("head %d and tail %d in a log of %d records",
+			ptr.head, ptr.tail, len(ptr.records))
+	}
+	for i := ptr.head; i < ptr.tail; i++ {
+		if l := ptr.records[i % len(ptr.records)].len; l < 0 || l > RINGBUF_RECORD_SIZE {
+			return fmt.Errorf("record %d is %d bytes long", i, l)
+		}
+	}
+	return nil
+}
+
+/*
+ * ringbuf_bench -- runs a producer appending n records and a consumer taking
+ * them off concurrently, each operation its own transaction under a lock;
+ * prints the throughput and how often either side had to wait
+ */
+func ringbuf_bench(ptr *data, n int) {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	full, empty := 0, 0
+	rec := make([]byte, RINGBUF_RECORD_SIZE)
+
+	start := time.Now()
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; {
+			lock.Lock()
+			err := ringbuf_append(ptr, rec)
+			lock.Unlock()
+			if err == nil {
+				i++
+			} else {
+				full++
+				runtime.Gosched()
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; {
+			lock.Lock()
+			_, err := ringbuf_consume(ptr)
+			lock.Unlock()
+			if err == nil {
+				i++
+			} else {
+				empty++
+				runtime.Gosched()
+			}
+		}
+	}()
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	fmt.Printf("%d records through a log of %d in %v, %.0f records/s\n", n,
+		len(ptr.records), elapsed, float64(n) / elapsed.Seconds())
+	fmt.Printf("producer found the log full %d times, consumer found it empty %d times\n",
+		full, empty)
+}
+
+/*
+ * str_append -- appends the rest of the line as a record
+ */
+func str_append(ptr *data, str string) {
+	if err := ringbuf_append(ptr, []byte(strings.TrimSpace(str))); err != nil {
+		fmt.Println("append:", err)
+	}
+}
+
+/*
+ * str_consume -- ringbuf_consume wrapper which prints the record
+ */
+func str_consume(ptr *data) {
+	if rec, err := ringbuf_consume(ptr); err == nil {
+		fmt.Println(string(rec))
+	} else {
+		fmt.Println(err)
+	}
+}
+
+/*
+ * str_bench -- ringbuf_bench wrapper which works on strings
+ */
+func str_bench(ptr *data, str string) {
+	var n int
+	if _, err := fmt.Sscanf(str, "%d", &n); err == nil && n > 0 {
+		ringbuf_bench(ptr, n)
+	} else {
+		fmt.Println("bench: invalid syntax")
+	}
+}
+
+func help() {
+	print_help(
+		"a $text - append $text as a record",
+		"c - consume and print the oldest record",
+		"b $count - pass $count records from a producer to a consumer",
+		"p - print all records from the oldest",
+		"d - print debug info",
+		"x - remove all records",
+	)
+}
+
+func print_all(ptr *data) {
+	ringbuf_foreach(ptr, func(rec []byte) bool {
+		fmt.Println(string(rec))
+		return false
+	})
+}
+
+func print_debug(ptr *data) {
+	if err := ringbuf_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("records:", ringbuf_len(ptr), "capacity:", len(ptr.records),
+			"head:", ptr.head, "tail:", ptr.tail)
+	}
+}
+
+/*
+ * Run -- opens the log named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("ringbuf", flag.ContinueOnError)
+	flags.Usage = func() {}
+	capacity := flags.Int("capacity", RINGBUF_DEFAULT_CAPACITY,
+		"room for `n` records when the log is created")
+	bench := flags.Int("bench", 0, "pass `n` records from a producer to a consumer and exit")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	if *capacity <= 0 {
+		return usage_error("the capacity must be positive")
+	}
+	if *bench < 0 {
+		return usage_error("the bench count cannot be negative")
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr, *capacity)
+	}
+
+	if *bench > 0 {
+		ringbuf_bench(ptr, *bench)
+		return nil
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'a': str_append(ptr, buf[1:])
+			case 'c': str_consume(ptr)
+			case 'b': str_bench(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': ringbuf_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "[-capacity n] [-bench n] filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
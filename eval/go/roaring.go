@@ -0,0 +1,528 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* a container holds the values sharing their top 16 bits */
+const ROARING_CONTAINER_BITS uint = 16
+
+/* number of 64-bit words of a bitmap container */
+const ROARING_WORDS int = (1 << ROARING_CONTAINER_BITS) / 64
+
+/* the most values an array container holds, as many bytes as a bitmap */
+const ROARING_ARRAY_MAX int = 4096
+
+/*
+ * container_t -- an array container keeps its n values sorted in array,
+ * whose length is its capacity; a bitmap container has them as bits
+ */
+type container_t struct {
+	key   int
+	n     int
+	array []uint16
+	bits  []uint64
+}
+
+/*
+ * data -- the containers are sorted by key and none of them is empty
+ */
+type data struct {
+	containers []*container_t
+	magic      int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x1F7C3D95A6E0B84E
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.containers = nil
+		ptr.magic = magic
+	}
+}
+
+var ErrRange = errors.New("values go from 0 to 4294967295")
+
+/*
+ * roaring_split -- (internal) returns the container key and the low bits of
+ * value
+ */
+func roaring_split(value int) (int, uint16) {
+	return value >> ROARING_CONTAINER_BITS, uint16(value)
+}
+
+/*
+ * roaring_find -- (internal) returns the position of the first container
+ * whose key is not less than key
+ */
+func roaring_find(ptr *data, key int) int {
+	return sort.Search(len(ptr.containers), func(i int) bool {
+		return ptr.containers[i].key >= key
+	})
+}
+
+/*
+ * roaring_array_pos -- (internal) returns the position of the first value of
+ * the array container c not less than low
+ */
+func roaring_array_pos(c *container_t, low uint16) int {
+	return sort.Search(c.n, func(i int) bool {
+		return c.array[i] >= low
+	})
+}
+
+/*
+ * roaring_contains -- (internal) checks if the container holds low
+ */
+func roaring_contains(c *container_t, low uint16) bool {
+	if c.bits != nil {
+		return c.bits[low / 64] & (1 << (low % 64)) != 0
+	}
+	p := roaring_array_pos(c, low)
+	return p < c.n && c.array[p] == low
+}
+
+/*
+ * roaring_to_bitmap -- (internal) turns the full array container c into the
+ * bitmap bits; must be called in a transaction
+ */
+func roaring_to_bitmap(c *container_t, bits []uint64) {
+	for _, v := range c.array[:c.n] {
+		bits[v / 64] |= 1 << (v % 64)
+	}
+	c.bits = bits
+	c.array = nil
+}
+
+/*
+ * roaring_to_array -- (internal) turns the bitmap container c, which has
+ * come down to ROARING_ARRAY_MAX values, into the array array; must be
+ * called in a transaction
+ */
+func roaring_to_array(c *container_t, array []uint16) {
+	n := 0
+	for w, word := range c.bits {
+		for ; word != 0; word &= word - 1 {
+			b := 0
+			for word & (1 << uint(b)) == 0 {
+				b++
+			}
+			array[n] = uint16(w * 64 + b)
+			n++
+		}
+	}
+	c.array = array
+	c.bits = nil
+}
+
+/*
+ * roaring_set -- adds value to the set, returning whether it was absent; the
+ * array container it goes into is grown, or converted into a bitmap once it
+ * is full, in the same transaction
+ *
+ * Whatever the set needs is allocated before the transaction, so a full pool
+ * fails it with ErrPoolFull and leaves the set as it was.
+ */
+func roaring_set(ptr *data, value int) (added bool, err error) {
+	if value < 0 || value >> 32 != 0 {
+		return false, ErrRange
+	}
+	defer pool_full(&err)
+	key, low := roaring_split(value)
+	i := roaring_find(ptr, key)
+	var c *container_t
+	var containers []*container_t
+	if i < len(ptr.containers) && ptr.containers[i].key == key {
+		c = ptr.containers[i]
+		if roaring_contains(c, low) {
+			return false, nil
+		}
+	} else {
+		c = pnew(container_t)
+		containers = pmake([]*container_t, len(ptr.containers) + 1)
+	}
+	var bits []uint64
+	var array []uint16
+	if c.bits == nil && c.n == ROARING_ARRAY_MAX {
+		bits = pmake([]uint64, ROARING_WORDS)
+	} else if c.bits == nil && c.n == len(c.array) {
+		size := 2 * len(c.array)
+		if size == 0 {
+			size = 4
+		} else if size > ROARING_ARRAY_MAX {
+			size = ROARING_ARRAY_MAX
+		}
+		array = pmake([]uint16, size)
+	}
+
+	txn("undo") {
+		if containers != nil {
+			c.key = key
+			copy(containers, ptr.containers[:i])
+			containers[i] = c
+			copy(containers[i + 1:], ptr.containers[i:])
+			ptr.containers = containers
+		}
+		if bits != nil {
+			roaring_to_bitmap(c, bits)
+		} else if array != nil {
+			copy(array, c.array[:c.n])
+			c.array = array
+		}
+		if c.bits != nil {
+			c.bits[low / 64] |= 1 << (low % 64)
+		} else {
+			p := roaring_array_pos(c, low)
+			copy(c.array[p + 1:c.n + 1], c.array[p:c.n])
+			c.array[p] = low
+		}
+		c.n++
+	}
+	return true, nil
+}
+
+/*
+ * roaring_clear -- removes value from the set, returning whether it was
+ * present; a bitmap container is converted back into an array once it is
+ * sparse enough and an emptied container is dropped, with what they need
+ * allocated before the transaction, like in roaring_set
+ */
+func roaring_clear(ptr *data, value int) (removed bool, err error) {
+	if value < 0 || value >> 32 != 0 {
+		return false, ErrRange
+	}
+	defer pool_full(&err)
+	key, low := roaring_split(value)
+	i := roaring_find(ptr, key)
+	if i == len(ptr.containers) || ptr.containers[i].key != key ||
+		!roaring_contains(ptr.containers[i], low) {
+		return false, nil
+	}
+	c := ptr.containers[i]
+	var containers []*container_t = nil
+	var array []uint16
+	if c.n == 1 && len(ptr.containers) > 1 {
+		containers = pmake([]*container_t, len(ptr.containers) - 1)
+	} else if c.bits != nil && c.n - 1 == ROARING_ARRAY_MAX {
+		array = pmake([]uint16, ROARING_ARRAY_MAX)
+	}
+
+	txn("undo") {
+		if c.n == 1 {
+			if containers != nil {
+				copy(containers, ptr.containers[:i])
+				copy(containers[i:], ptr.containers[i + 1:])
+			}
+			ptr.containers = containers
+			return true, nil
+		}
+		if c.bits != nil {
+			c.bits[low / 64] &^= 1 << (low % 64)
+		} else {
+			p := roaring_array_pos(c, low)
+			copy(c.array[p:], c.array[p + 1:c.n])
+		}
+		c.n--
+		if c.bits != nil && c.n == ROARING_ARRAY_MAX {
+			roaring_to_array(c, array)
+		}
+	}
+	return true, nil
+}
+
+/*
+ * roaring_test -- checks if value is in the set
+ */
+func roaring_test(ptr *data, value int) bool {
+	key, low := roaring_split(value)
+	i := roaring_find(ptr, key)
+	return i < len(ptr.containers) && ptr.containers[i].key == key &&
+		roaring_contains(ptr.containers[i], low)
+}
+
+/*
+ * roaring_rank -- returns the number of values in the set not greater than
+ * value
+ */
+func roaring_rank(ptr *data, value int) int {
+	key, low := roaring_split(value)
+	rank := 0
+	i := 0
+	for ; i < len(ptr.containers) && ptr.containers[i].key < key; i++ {
+		rank += ptr.containers[i].n
+	}
+	if i == len(ptr.containers) || ptr.containers[i].key != key {
+		return rank
+	}
+	c := ptr.containers[i]
+	if c.bits == nil {
+		p := roaring_array_pos(c, low)
+		if p < c.n && c.array[p] == low {
+			p++
+		}
+		return rank + p
+	}
+	for w := 0; w <= int(low / 64); w++ {
+		word := c.bits[w]
+		if w == int(low / 64) && low % 64 != 63 {
+			word &= 1 << (low % 64 + 1) - 1
+		}
+		for ; word != 0; word &= word - 1 {
+			rank++
+		}
+	}
+	return rank
+}
+
+/*
+ * roaring_foreach -- calls cb for every value in increasing order, stopping
+ * early when cb returns true
+ */
+func roaring_foreach(ptr *data, cb func(int) bool) bool {
+	for _, c := range ptr.containers {
+		base := c.key << ROARING_CONTAINER_BITS
+		if c.bits == nil {
+			for _, v := range c.array[:c.n] {
+				if cb(base + int(v)) {
+					return true
+				}
+			}
+			continue
+		}
+		for b := 0; b < ROARING_WORDS * 64; b++ {
+			if c.bits[b / 64] & (1 << uint(b % 64)) != 0 && cb(base + b) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * roaring_cardinality -- returns the number of values in the set
+ */
+func roaring_cardinality(ptr *data) int {
+	n := 0
+	for _, c := range ptr.containers {
+		n += c.n
+	}
+	return n
+}
+
+/*
+ * roaring_clear_all -- removes all values from the set
+ */
+func roaring_clear_all(ptr *data) {
+	txn("undo") {
+		ptr.containers = nil
+	}
+}
+
+/*
+ * roaring_check -- verifies the order of the containers and of the values
+ * of the arrays, that every container has the form its cardinality calls for
+ * and that the cardinalities are right; returns the numbers of array and
+ * bitmap containers
+ */
+func roaring_check(ptr *data) (int, int, error) {
+	arrays, bitmaps := 0, 0
+	for i, c := range ptr.containers {
+		if i > 0 && ptr.containers[i - 1].key >= c.key {
+			return 0, 0, fmt.Errorf("container %d is out of order", c.key)
+		}
+		if c.n <= 0 {
+			return 0, 0, fmt.Errorf("container %d is empty", c.key)
+		}
+		if c.bits != nil {
+			n := 0
+			for _, word := range c.bits {
+				for ; word != 0; word &= word - 1 {
+					n++
+				}
+			}
+			if n != c.n || c.n <= ROARING_ARRAY_MAX || c.array != nil {
+				return 0, 0, fmt.Errorf("bitmap container %d has %d bits set, n is %d",
+					c.key, n, c.n)
+			}
+			bitmaps++
+			continue
+		}
+		if c.n > len(c.array) || c.n > ROARING_ARRAY_MAX {
+			return 0, 0, fmt.Errorf("array container %d of %d values and room for %d",
+				c.key, c.n, len(c.array))
+		}
+		for j := 1; j < c.n; j++ {
+			if c.array[j - 1] >= c.array[j] {
+				return 0, 0, fmt.Errorf("array container %d is out of order at %d",
+					c.key, j)
+			}
+		}
+		arrays++
+	}
+	return arrays, bitmaps, nil
+}
+
+/*
+ * str_set -- roaring_set wrapper which works on strings
+ */
+func str_set(ptr *data, str string) {
+	var value int
+	if scan_args("insert", str, "%d", &value) {
+		if _, err := roaring_set(ptr, value); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_clear -- roaring_clear wrapper which works on strings
+ */
+func str_clear(ptr *data, str string) {
+	var value int
+	if scan_args("remove", str, "%d", &value) {
+		if ok, err := roaring_clear(ptr, value); err != nil {
+			fmt.Println("remove:", err)
+		} else if !ok {
+			fmt.Println("no such value")
+		}
+	}
+}
+
+/*
+ * str_test -- roaring_test wrapper which works on strings
+ */
+func str_test(ptr *data, str string) {
+	var value int
+	if scan_args("check", str, "%d", &value) {
+		fmt.Println(roaring_test(ptr, value))
+	}
+}
+
+/*
+ * str_rank -- roaring_rank wrapper which works on strings
+ */
+func str_rank(ptr *data, str string) {
+	var value int
+	if scan_args("rank", str, "%d", &value) {
+		fmt.Println(roaring_rank(ptr, value))
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random numbers
+ * below the given bound
+ */
+func str_insert_random(ptr *data, str string) {
+	var val, bound int
+	if _, err := fmt.Sscanf(str, "%d %d", &val, &bound); err != nil {
+		bound = 1 << 32
+		if _, err = fmt.Sscanf(str, "%d", &val); err != nil {
+			fmt.Println("random insert: invalid syntax")
+			return
+		}
+	}
+	if bound <= 0 || bound > 1 << 32 {
+		fmt.Println("random insert:", ErrRange)
+		return
+	}
+	for i := 0; i < val; i++ {
+		if _, err := roaring_set(ptr, rand.Intn(bound)); err != nil {
+			fmt.Println("random insert:", err)
+			break
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"i $value - insert $value",
+		"r $value - remove $value",
+		"c $value - check $value, returns 0/1",
+		"k $value - print the number of values up to $value",
+		"n $value [$bound] - insert $value random values below $bound",
+		"p - print all values",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	roaring_foreach(ptr, func(value int) bool {
+		fmt.Print(value, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if arrays, bitmaps, err := roaring_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("values:", roaring_cardinality(ptr), "array containers:", arrays,
+			"bitmap containers:", bitmaps)
+	}
+}
+
+/*
+ * Run -- opens the bitmap named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("roaring", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_set(ptr, buf[1:])
+			case 'r': str_clear(ptr, buf[1:])
+			case 'c': str_test(ptr, buf[1:])
+			case 'k': str_rank(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': roaring_clear_all(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* number of slots of a new map */
+const ROBINHOOD_MAP_MIN_SIZE int = 8
+
+/* the table is grown before more than 7/8 of its slots are used */
+const ROBINHOOD_MAP_LOAD_NUM int = 7
+const ROBINHOOD_MAP_LOAD_DEN int = 8
+
+/*
+ * slot_t -- dist is one more than the distance of the slot from the home
+ * slot of its key, 0 for a free slot
+ */
+type slot_t struct {
+	key   int
+	value int
+	dist  int
+}
+
+type data struct {
+	slots []slot_t
+	count int
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x6B1D4F83A2E97C05
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.slots = pmake([]slot_t, ROBINHOOD_MAP_MIN_SIZE)
+		ptr.count = 0
+		ptr.magic = magic
+	}
+}
+
+/*
+ * the slots written by the mutators since the program started, including the
+ * ones moved by a displacement, a shift or a resize, and the number of
+ * mutations; each written slot is a range the undo log has to save
+ */
+var robinhood_map_writes int = 0
+var robinhood_map_mutations int = 0
+
+/*
+ * robinhood_map_hash -- (internal) returns the home slot of key in a table of
+ * n slots
+ */
+func robinhood_map_hash(key int, n int) int {
+	h := uint64(key)
+	h = (h ^ h >> 30) * 0xBF58476D1CE4E5B9
+	h = (h ^ h >> 27) * 0x94D049BB133111EB
+	h ^= h >> 31
+	return int(h % uint64(n))
+}
+
+/*
+ * robinhood_map_find -- (internal) returns the index of the slot holding key,
+ * or -1; the search stops at the first slot closer to its home than key
+ * would be, since key would have displaced its entry
+ */
+func robinhood_map_find(slots []slot_t, key int) int {
+	n := len(slots)
+	i := robinhood_map_hash(key, n)
+	for dist := 1; slots[i].dist >= dist; dist++ {
+		if slots[i].key == key {
+			return i
+		}
+		i = (i + 1) % n
+	}
+	return -1
+}
+
+/*
+ * robinhood_map_add -- (internal) stores a key which is not in slots, which
+ * must have a free slot: whenever the entry being placed is farther from its
+ * home than the one in the slot it reaches, the two swap and the probe goes
+ * on with the one evicted
+ */
+func robinhood_map_add(slots []slot_t, key int, value int) {
+	n := len(slots)
+	e := slot_t{key, value, 1}
+	for i := robinhood_map_hash(key, n); ; i = (i + 1) % n {
+		if slots[i].dist == 0 {
+			slots[i] = e
+			robinhood_map_writes++
+			return
+		}
+		if slots[i].dist < e.dist {
+			e, slots[i] = slots[i], e
+			robinhood_map_writes++
+		}
+		e.dist++
+	}
+}
+
+/*
+ * robinhood_map_grow -- (internal) moves the entries into a table of twice
+ * the size
+ */
+func robinhood_map_grow(ptr *data) {
+	slots := pmake([]slot_t, 2 * len(ptr.slots))
+	for _, s := range ptr.slots {
+		if s.dist != 0 {
+			robinhood_map_add(slots, s.key, s.value)
+		}
+	}
+	ptr.slots = slots
+}
+
+/*
+ * robinhood_map_insert -- inserts a key-value pair, replacing the value of
+ * the key if it is present; every entry the insert displaces is rewritten in
+ * its transaction, which a full pool rolls back with ErrPoolFull
+ */
+func robinhood_map_insert(ptr *data, key int, value int) (err error) {
+	robinhood_map_mutations++
+	defer pool_full(&err)
+	txn("undo") {
+		if i := robinhood_map_find(ptr.slots, key); i >= 0 {
+			ptr.slots[i].value = value
+			robinhood_map_writes++
+			return nil
+		}
+		if (ptr.count + 1) * ROBINHOOD_MAP_LOAD_DEN >
+			len(ptr.slots) * ROBINHOOD_MAP_LOAD_NUM {
+			robinhood_map_grow(ptr)
+		}
+		robinhood_map_add(ptr.slots, key, value)
+		ptr.count++
+	}
+	return nil
+}
+
+/*
+ * robinhood_map_remove -- removes the key from the map, returning its value
+ * and whether it was found; the entries after it are shifted back by one
+ * slot up to the first one which is free or in its home, so no tombstone is
+ * left behind
+ */
+func robinhood_map_remove(ptr *data, key int) (int, bool) {
+	i := robinhood_map_find(ptr.slots, key)
+	if i < 0 {
+		return 0, false
+	}
+	value := ptr.slots[i].value
+	robinhood_map_mutations++
+	txn("undo") {
+		n := len(ptr.slots)
+		for next := (i + 1) % n; ptr.slots[next].dist > 1; next = (next + 1) % n {
+			ptr.slots[i] = ptr.slots[next]
+			ptr.slots[i].dist--
+			robinhood_map_writes++
+			i = next
+		}
+		ptr.slots[i] = slot_t{}
+		robinhood_map_writes++
+		ptr.count--
+	}
+	return value, true
+}
+
+/*
+ * robinhood_map_get -- searches for the value of the key
+ */
+func robinhood_map_get(ptr *data, key int) (int, bool) {
+	if i := robinhood_map_find(ptr.slots, key); i >= 0 {
+		return ptr.slots[i].value, true
+	}
+	return 0, false
+}
+
+/*
+ * robinhood_map_lookup -- checks if the key exists in the map
+ */
+func robinhood_map_lookup(ptr *data, key int) bool {
+	return robinhood_map_find(ptr.slots, key) >= 0
+}
+
+/*
+ * robinhood_map_foreach -- calls cb for every pair, in no particular order,
+ * stopping early when cb returns true
+ */
+func robinhood_map_foreach(ptr *data, cb func(int, int) bool) bool {
+	for _, s := range ptr.slots {
+		if s.dist != 0 && cb(s.key, s.value) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * robinhood_map_clear -- removes all pairs from the map and shrinks it back
+ * to its initial size
+ */
+func robinhood_map_clear(ptr *data) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		slots := pmake([]slot_t, ROBINHOOD_MAP_MIN_SIZE)
+		ptr.slots = slots
+		ptr.count = 0
+	}
+	return nil
+}
+
+/*
+ * robinhood_map_check -- verifies that every entry records its distance from
+ * home, that no entry is more than one slot farther from home than the one
+ * before it, that every key can be found and that count is right; returns
+ * the longest probe
+ */
+func robinhood_map_check(ptr *data) (int, error) {
+	n := len(ptr.slots)
+	entries, longest := 0, 0
+	for i, s := range ptr.slots {
+		if s.dist == 0 {
+			continue
+		}
+		if d := (i - robinhood_map_hash(s.key, n) + n) % n + 1; d != s.dist {
+			return 0, fmt.Errorf("key %d in slot %d records distance %d, is at %d",
+				s.key, i, s.dist - 1, d - 1)
+		}
+		if prev := ptr.slots[(i - 1 + n) % n]; s.dist > prev.dist + 1 {
+			return 0, fmt.Errorf("key %d in slot %d should have displaced key %d",
+				s.key, i, prev.key)
+		}
+		if robinhood_map_find(ptr.slots, s.key) != i {
+			return 0, fmt.Errorf("key %d in slot %d cannot be found", s.key, i)
+		}
+		if s.dist > longest {
+			longest = s.dist
+		}
+		entries++
+	}
+	if entries != ptr.count {
+		return 0, fmt.Errorf("%d entries, count is %d", entries, ptr.count)
+	}
+	return longest, nil
+}
+
+/*
+ * str_insert -- robinhood_map_insert wrapper which works on strings
+ */
+func str_insert(ptr *data, str string) {
+	var key int
+	if scan_args("insert", str, "%d", &key) {
+		if err := robinhood_map_insert(ptr, key, 0); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- robinhood_map_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key int
+	if scan_args("remove", str, "%d", &key) {
+		if _, ok := robinhood_map_remove(ptr, key); !ok {
+			fmt.Println("no such value")
+		}
+	}
+}
+
+/*
+ * str_check -- robinhood_map_lookup wrapper which works on strings
+ */
+func str_check(ptr *data, str string) {
+	var key int
+	if scan_args("check", str, "%d", &key) {
+		fmt.Println(robinhood_map_lookup(ptr, key))
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := robinhood_map_insert(ptr, rand.Int(), 0); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+/*
+ * str_clear -- robinhood_map_clear wrapper which reports its error
+ */
+func str_clear(ptr *data) {
+	if err := robinhood_map_clear(ptr); err != nil {
+		fmt.Println("clear:", err)
+	}
+}
+
+func help() {
+	print_help(
+		"i $value - insert $value",
+		"r $value - remove $value",
+		"c $value - check $value, returns 0/1",
+		"n $value - insert $value random values",
+		"p - print all values",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	robinhood_map_foreach(ptr, func(key int, value int) bool {
+		fmt.Print(key, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if longest, err := robinhood_map_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Printf("entries: %d slots: %d load: %.2f longest probe: %d\n",
+			ptr.count, len(ptr.slots),
+			float64(ptr.count) / float64(len(ptr.slots)), longest)
+	}
+	if robinhood_map_mutations > 0 {
+		fmt.Printf("slots written per mutation: %.2f\n",
+			float64(robinhood_map_writes) / float64(robinhood_map_mutations))
+	}
+}
+
+/*
+ * Run -- opens the map named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("robinhood_map", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'c': str_check(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/*
+ * node_t -- a node at depth n stands for the prefix of n bits spelled by the
+ * path to it, 0 to the left and 1 to the right; a node with a route forwards
+ * to next_hop
+ */
+type node_t struct {
+	child     [2]*node_t
+	has_route bool
+	next_hop  uint32
+}
+
+type data struct {
+	root   *node_t
+	routes int
+	nodes  int
+	magic  int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x6C2E9A17F3B40D85
+)
+
+var ErrNoRoute = errors.New("no such route")
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.root = pnew(node_t)
+		ptr.routes = 0
+		ptr.nodes = 1
+		ptr.magic = magic
+	}
+}
+
+/*
+ * bit -- (internal) returns bit i of addr, counting from the most
+ * significant
+ */
+func bit(addr uint32, i int) int {
+	return int(addr >> uint(31 - i) & 1)
+}
+
+/*
+ * mask -- (internal) returns prefix with all but its first plen bits cleared
+ */
+func mask(prefix uint32, plen int) uint32 {
+	if plen == 0 {
+		return 0
+	}
+	return prefix &^ (1 << uint(32 - plen) - 1)
+}
+
+/*
+ * rt_insert -- routes prefix/plen to next_hop, replacing the route of the
+ * prefix if there is one; the nodes missing down to it are allocated and
+ * chained before the transaction links them in, so a full pool fails with
+ * ErrPoolFull and changes nothing
+ */
+func rt_insert(ptr *data, prefix uint32, plen int, next_hop uint32) (err error) {
+	defer pool_full(&err)
+	n := ptr.root
+	depth := 0
+	for ; depth < plen && n.child[bit(prefix, depth)] != nil; depth++ {
+		n = n.child[bit(prefix, depth)]
+	}
+	missing := make([]*node_t, plen - depth)
+	for i := range missing {
+		missing[i] = pnew(node_t)
+	}
+
+	txn("undo") {
+		for i, c := range missing {
+			n.child[bit(prefix, depth + i)] = c
+			n = c
+		}
+		ptr.nodes += len(missing)
+		if !n.has_route {
+			n.has_route = true
+			ptr.routes++
+		}
+		n.next_hop = next_hop
+	}
+	return nil
+}
+
+/*
+ * rt_delete -- removes the route of prefix/plen, and the nodes left with
+ * neither a route nor children, in one transaction
+ */
+func rt_delete(ptr *data, prefix uint32, plen int) error {
+	var path [33]*node_t
+	n := ptr.root
+	path[0] = n
+	for i := 0; i < plen && n != nil; i++ {
+		n = n.child[bit(prefix, i)]
+		path[i + 1] = n
+	}
+	if n == nil || !n.has_route {
+		return ErrNoRoute
+	}
+	txn("undo") {
+		n.has_route = false
+		n.next_hop = 0
+		ptr.routes--
+		for i := plen; i > 0; i-- {
+			c := path[i]
+			if c.has_route || c.child[0] != nil || c.child[1] != nil {
+				break
+			}
+			path[i - 1].child[bit(prefix, i - 1)] = nil
+			ptr.nodes--
+		}
+	}
+	return nil
+}
+
+/*
+ * rt_lookup -- returns the next hop of the longest prefix matching addr,
+ * with the length of that prefix, or false if no route matches
+ */
+func rt_lookup(ptr *data, addr uint32) (uint32, int, bool) {
+	var hop uint32
+	plen, found := 0, false
+	n := ptr.root
+	for i := 0; n != nil; i++ {
+		if n.has_route {
+			hop, plen, found = n.next_hop, i, true
+		}
+		if i == 32 {
+			break
+		}
+		n = n.child[bit(addr, i)]
+	}
+	return hop, plen, found
+}
+
+/*
+ * rt_walk -- (internal) calls cb for the routes under n, which stands for
+ * prefix/depth, shorter prefixes first and then in address order
+ */
+func rt_walk(n *node_t, prefix uint32, depth int, cb func(uint32, int, uint32) bool) bool {
+	if n.has_route && cb(prefix, depth, n.next_hop) {
+		return true
+	}
+	for b, c := range n.child {
+		if c != nil && rt_walk(c, prefix | uint32(b) << uint(31 - depth), depth + 1, cb) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * rt_foreach -- calls cb for every route with its prefix, length and next
+ * hop, stopping early when cb returns true
+ */
+func rt_foreach(ptr *data, cb func(uint32, int, uint32) bool) bool {
+	return rt_walk(ptr.root, 0, 0, cb)
+}
+
+/*
+ * rt_clear -- removes all routes
+ */
+func rt_clear(ptr *data) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		n := pnew(node_t)
+		ptr.root = n
+		ptr.routes = 0
+		ptr.nodes = 1
+	}
+	return nil
+}
+
+/*
+ * rt_check_node -- (internal) verifies that no node below the root is
+ * without both a route and children, that none is deeper than 32 bits, and
+ * counts the routes and nodes
+ */
+func rt_check_node(n *node_t, depth int, routes *int, nodes *int) error {
+	*nodes++
+	if n.has_route {
+		*routes++
+	} else if depth > 0 && n.child[0] == nil && n.child[1] == nil {
+		return fmt.Errorf("node at depth %d has neither route nor children", depth)
+	}
+	for _, c := range n.child {
+		if c == nil {
+			continue
+		}
+		if depth == 32 {
+			return errors.New("node deeper than 32 bits")
+		}
+		if err := rt_check_node(c, depth + 1, routes, nodes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * rt_check -- verifies the trie and its totals
+ */
+func rt_check(ptr *data) error {
+	routes, nodes := 0, 0
+	if err := rt_check_node(ptr.root, 0, &routes, &nodes); err != nil {
+		return err
+	}
+	if routes != ptr.routes || nodes != ptr.nodes {
+		return fmt.Errorf("%d routes in %d nodes, totals are %d and %d", routes, nodes,
+			ptr.routes, ptr.nodes)
+	}
+	return nil
+}
+
+/*
+ * parse_addr -- returns the IPv4 address of str as an integer
+ */
+func parse_addr(str string) (uint32, error) {
+	ip := net.ParseIP(str).To4()
+	if ip == nil {
+		return 0, fmt.Errorf("invalid IPv4 address %q", str)
+	}
+	return binary.BigEndian.Uint32(ip), nil
+}
+
+/*
+ * parse_prefix -- returns the prefix and its length of str in CIDR notation;
+ * the bits past the length must be zero
+ */
+func parse_prefix(str string) (uint32, int, error) {
+	ip, ipnet, err := net.ParseCIDR(str)
+	if err != nil || ip.To4() == nil {
+		return 0, 0, fmt.Errorf("invalid IPv4 prefix %q", str)
+	}
+	plen, _ := ipnet.Mask.Size()
+	prefix := binary.BigEndian.Uint32(ip.To4())
+	if mask(prefix, plen) != prefix {
+		return 0, 0, fmt.Errorf("%q has host bits set", str)
+	}
+	return prefix, plen, nil
+}
+
+/*
+ * format_addr -- returns addr in dotted notation
+ */
+func format_addr(addr uint32) string {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, addr)
+	return ip.String()
+}
+
+/*
+ * str_insert -- rt_insert wrapper which works on strings: a prefix in CIDR
+ * notation and the address of the next hop
+ */
+func str_insert(ptr *data, str string) {
+	fields := strings.Fields(str)
+	if len(fields) != 2 {
+		fmt.Println("insert: invalid syntax")
+		return
+	}
+	prefix, plen, err := parse_prefix(fields[0])
+	if err != nil {
+		fmt.Println("insert:", err)
+		return
+	}
+	hop, err := parse_addr(fields[1])
+	if err != nil {
+		fmt.Println("insert:", err)
+		return
+	}
+	if err := rt_insert(ptr, prefix, plen, hop); err != nil {
+		fmt.Println("insert:", err)
+	}
+}
+
+/*
+ * str_delete -- rt_delete wrapper which works on strings
+ */
+func str_delete(ptr *data, str string) {
+	prefix, plen, err := parse_prefix(strings.TrimSpace(str))
+	if err == nil {
+		err = rt_delete(ptr, prefix, plen)
+	}
+	if err != nil {
+		fmt.Println("delete:", err)
+	}
+}
+
+/*
+ * str_lookup -- rt_lookup wrapper which works on strings
+ */
+func str_lookup(ptr *data, str string) {
+	addr, err := parse_addr(strings.TrimSpace(str))
+	if err != nil {
+		fmt.Println("lookup:", err)
+		return
+	}
+	if hop, plen, ok := rt_lookup(ptr, addr); ok {
+		fmt.Printf("%s via %s/%d\n", format_addr(hop), format_addr(mask(addr, plen)), plen)
+	} else {
+		fmt.Println("no route")
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random
+ * routes of 8 to 24 bits
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			plen := 8 + rand.Intn(17)
+			rt_insert(ptr, mask(rand.Uint32(), plen), plen, rand.Uint32())
+		}
+	}
+}
+
+/*
+ * str_clear -- rt_clear wrapper which reports its error
+ */
+func str_clear(ptr *data) {
+	if err := rt_clear(ptr); err != nil {
+		fmt.Println("clear:", err)
+	}
+}
+
+func help() {
+	print_help(
+		"i $prefix/$len $hop - route $prefix/$len to $hop",
+		"r $prefix/$len - delete the route of $prefix/$len",
+		"l $addr - print the next hop of $addr and the route it matched",
+		"n $value - insert $value random routes",
+		"p - print all routes",
+		"d - print debug info",
+		"x - delete all routes",
+	)
+}
+
+func print_all(ptr *data) {
+	rt_foreach(ptr, func(prefix uint32, plen int, hop uint32) bool {
+		fmt.Printf("%s/%d %s\n", format_addr(prefix), plen, format_addr(hop))
+		return false
+	})
+}
+
+func print_debug(ptr *data) {
+	if err := rt_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("routes:", ptr.routes, "nodes:", ptr.nodes)
+	}
+}
+
+/*
+ * Run -- opens the table named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("routetable", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_delete(ptr, buf[1:])
+			case 'l': str_lookup(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+const ALPHABET_SIZE int = 256
+
+/*
+ * node_t -- holds the part of the keys below it which follows the key of
+ * its parent; slots[c] is the child whose key starts with the byte c
+ */
+type node_t struct {
+	slots     [ALPHABET_SIZE]*node_t
+	has_value bool
+	value     int
+	key       []byte
+}
+
+/*
+ * data -- the root node has an empty key, so it only holds the value of the
+ * empty key
+ */
+type data struct {
+	root  *node_t
+	count int
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x46B9D2E870C3A15F
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.root = pnew(node_t)
+		ptr.count = 0
+		ptr.magic = magic
+	}
+}
+
+/*
+ * rtree_new_node -- (internal) allocates a node holding a copy of key
+ */
+func rtree_new_node(key []byte, value int, has_value bool) *node_t {
+	n := pnew(node_t)
+	if len(key) > 0 {
+		n.key = pmake([]byte, len(key))
+		copy(n.key, key)
+	}
+	n.value = value
+	n.has_value = has_value
+	return n
+}
+
+/*
+ * find_common_prefix -- (internal) returns the length of the common prefix
+ * of the two keys
+ */
+func find_common_prefix(lhs []byte, rhs []byte) int {
+	i := 0
+	for i < len(lhs) && i < len(rhs) && lhs[i] == rhs[i] {
+		i++
+	}
+	return i
+}
+
+/*
+ * rtree_map_insert_value -- (internal) inserts the pair below the node at
+ * link, splitting the node if its key only partly matches; returns whether
+ * the key is new
+ */
+func rtree_map_insert_value(link **node_t, key []byte, value int) bool {
+	if *link == nil {
+		*link = rtree_new_node(key, value, true)
+		return true
+	}
+
+	n := *link
+	common_len := find_common_prefix(key, n.key)
+
+	/* key exists */
+	if common_len == len(key) && common_len == len(n.key) {
+		fresh := !n.has_value
+		n.value = value
+		n.has_value = true
+		return fresh
+	}
+
+	/* need split; both new nodes are made before n is touched */
+	if common_len < len(n.key) {
+		split := rtree_new_node(key[:common_len], 0, false)
+		if common_len == len(key) {
+			/* key is prefix */
+			split.value = value
+			split.has_value = true
+		} else {
+			split.slots[key[common_len]] = rtree_new_node(key[common_len:], value, true)
+		}
+		split.slots[n.key[common_len]] = n
+		n.key = n.key[common_len:]
+		*link = split
+		return true
+	}
+
+	return rtree_map_insert_value(&(*link).slots[key[common_len]],
+		key[common_len:], value)
+}
+
+/*
+ * rtree_map_insert -- inserts a new key-value pair into the map, replacing
+ * the value of the key if it is present
+ *
+ * A full pool rolls the transaction back with ErrPoolFull.
+ */
+func rtree_map_insert(ptr *data, key []byte, value int) (err error) {
+	defer pool_full(&err)
+
+	txn("undo") {
+		if rtree_map_insert_value(&ptr.root, key, value) {
+			ptr.count++
+		}
+	}
+	return nil
+}
+
+/*
+ * rtree_map_only_child -- (internal) returns the child of the node if it has
+ * exactly one, or nil
+ */
+func rtree_map_only_child(n *node_t) *node_t {
+	var only *node_t
+	for _, child := range n.slots {
+		if child != nil {
+			if only != nil {
+				return nil
+			}
+			only = child
+		}
+	}
+	return only
+}
+
+/*
+ * rtree_map_is_leaf -- (internal) checks whether the node has no children
+ */
+func rtree_map_is_leaf(n *node_t) bool {
+	for _, child := range n.slots {
+		if child != nil {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * rtree_map_compact -- (internal) drops the node at link if it holds nothing,
+ * or merges it with its child if it holds no value and has only one child;
+ * the root is left as it is
+ */
+func rtree_map_compact(link **node_t, root bool) {
+	n := *link
+	if root || n.has_value {
+		return
+	}
+	if rtree_map_is_leaf(n) {
+		*link = nil
+		return
+	}
+	child := rtree_map_only_child(n)
+	if child == nil {
+		return
+	}
+	key := pmake([]byte, len(n.key) + len(child.key))
+	copy(key, n.key)
+	copy(key[len(n.key):], child.key)
+	child.key = key
+	*link = child
+}
+
+/*
+ * rtree_map_remove_node -- (internal) removes the key below the node at
+ * link, returning its value and whether it was found; the nodes left without
+ * a purpose on the way back up are compacted
+ */
+func rtree_map_remove_node(link **node_t, key []byte, root bool) (int, bool) {
+	n := *link
+	if n == nil {
+		return 0, false
+	}
+
+	common_len := find_common_prefix(key, n.key)
+	if common_len != len(n.key) {
+		/* node has no such key */
+		return 0, false
+	}
+
+	var value int
+	var found bool
+	if common_len == len(key) {
+		/* we found the key */
+		if !n.has_value {
+			return 0, false
+		}
+		value, found = n.value, true
+		n.value = 0
+		n.has_value = false
+	} else {
+		value, found = rtree_map_remove_node(&n.slots[key[common_len]],
+			key[common_len:], false)
+		if !found {
+			return 0, false
+		}
+	}
+	rtree_map_compact(link, root)
+	return value, found
+}
+
+/*
+ * rtree_map_remove -- removes the key from the map, returning its value and
+ * whether it was found
+ */
+func rtree_map_remove(ptr *data, key []byte) (value int, ok bool) {
+	var err error
+	defer func() {
+		if err != nil {
+			/* merging a node failed, nothing was removed */
+			value, ok = 0, false
+		}
+	}()
+	defer pool_full(&err)
+
+	if !rtree_map_lookup(ptr, key) {
+		return 0, false
+	}
+	txn("undo") {
+		value, ok = rtree_map_remove_node(&ptr.root, key, true)
+		ptr.count--
+	}
+	return value, ok
+}
+
+/*
+ * rtree_map_get_node -- (internal) returns the node holding the value of the
+ * key, or nil
+ */
+func rtree_map_get_node(n *node_t, key []byte) *node_t {
+	for n != nil {
+		if !bytes.HasPrefix(key, n.key) {
+			return nil
+		}
+		key = key[len(n.key):]
+		if len(key) == 0 {
+			if !n.has_value {
+				return nil
+			}
+			return n
+		}
+		n = n.slots[key[0]]
+	}
+	return nil
+}
+
+/*
+ * rtree_map_get -- searches for a value of the key
+ */
+func rtree_map_get(ptr *data, key []byte) (int, bool) {
+	if n := rtree_map_get_node(ptr.root, key); n != nil {
+		return n.value, true
+	}
+	return 0, false
+}
+
+/*
+ * rtree_map_lookup -- searches if a key exists
+ */
+func rtree_map_lookup(ptr *data, key []byte) bool {
+	return rtree_map_get_node(ptr.root, key) != nil
+}
+
+/*
+ * rtree_map_is_empty -- checks whether the tree map is empty
+ */
+func rtree_map_is_empty(ptr *data) bool {
+	return ptr.count == 0
+}
+
+/*
+ * rtree_map_foreach_node -- (internal) recursively traverses tree node, with
+ * prefix the key of its parent
+ */
+func rtree_map_foreach_node(n *node_t, prefix []byte, cb func([]byte, int) bool) bool {
+	if n == nil {
+		return false
+	}
+	key := append(prefix[:len(prefix):len(prefix)], n.key...)
+	if n.has_value && cb(key, n.value) {
+		return true
+	}
+	for _, child := range n.slots {
+		if rtree_map_foreach_node(child, key, cb) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * rtree_map_foreach -- initiates recursive traversal, in the order of the
+ * keys; stops early when cb returns true
+ */
+func rtree_map_foreach(ptr *data, cb func([]byte, int) bool) bool {
+	return rtree_map_foreach_node(ptr.root, nil, cb)
+}
+
+/*
+ * rtree_map_clear -- removes all pairs from the map
+ */
+func rtree_map_clear(ptr *data) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		root := pnew(node_t)
+		ptr.root = root
+		ptr.count = 0
+	}
+	return nil
+}
+
+/*
+ * rtree_map_check_node -- (internal) verifies the subtree of the node, which
+ * is in slot c of its parent; returns its number of values, of nodes and its
+ * depth
+ */
+func rtree_map_check_node(n *node_t, c int) (int, int, int, error) {
+	if c >= 0 {
+		if len(n.key) == 0 || int(n.key[0]) != c {
+			return 0, 0, 0, fmt.Errorf("node '%s' is in slot %d", n.key, c)
+		}
+		if !n.has_value && (rtree_map_is_leaf(n) || rtree_map_only_child(n) != nil) {
+			return 0, 0, 0, fmt.Errorf("node '%s' should have been compacted", n.key)
+		}
+	}
+	values, nodes, depth := 0, 1, 0
+	if n.has_value {
+		values++
+	}
+	for i, child := range n.slots {
+		if child == nil {
+			continue
+		}
+		v, m, d, err := rtree_map_check_node(child, i)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		values += v
+		nodes += m
+		if d + 1 > depth {
+			depth = d + 1
+		}
+	}
+	return values, nodes, depth, nil
+}
+
+/*
+ * rtree_map_check -- verifies that every node is in the slot of its first
+ * byte, that no node below the root could be compacted and that count is
+ * right; returns the number of nodes and the depth of the tree
+ */
+func rtree_map_check(ptr *data) (int, int, error) {
+	if len(ptr.root.key) != 0 {
+		return 0, 0, fmt.Errorf("the root has key '%s'", ptr.root.key)
+	}
+	values, nodes, depth, err := rtree_map_check_node(ptr.root, -1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if values != ptr.count {
+		return 0, 0, fmt.Errorf("%d values, count is %d", values, ptr.count)
+	}
+	return nodes, depth, nil
+}
+
+/*
+ * str_insert -- inserts the key and the value given as a string
+ */
+func str_insert(ptr *data, str string) {
+	var key string
+	var value int
+	if scan_args("insert", str, "%s %d", &key, &value) {
+		if err := rtree_map_insert(ptr, []byte(key), value); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- rtree_map_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key string
+	if scan_args("remove", str, "%s", &key) {
+		if _, ok := rtree_map_remove(ptr, []byte(key)); !ok {
+			fmt.Println("no such key")
+		}
+	}
+}
+
+/*
+ * str_get -- prints the value of the key given as a string
+ */
+func str_get(ptr *data, str string) {
+	var key string
+	if scan_args("get", str, "%s", &key) {
+		if value, ok := rtree_map_get(ptr, []byte(key)); ok {
+			fmt.Println(value)
+		} else {
+			fmt.Println("no such key")
+		}
+	}
+}
+
+/*
+ * str_clear -- rtree_map_clear wrapper which reports its error
+ */
+func str_clear(ptr *data) {
+	if err := rtree_map_clear(ptr); err != nil {
+		fmt.Println("clear:", err)
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random keys
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			key := []byte(fmt.Sprintf("%x", rand.Int63()))
+			if err := rtree_map_insert(ptr, key, i); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"i $key $value - insert $key with $value",
+		"r $key - remove $key",
+		"g $key - print the value of $key",
+		"n $value - insert $value random keys",
+		"p - print all pairs",
+		"d - print debug info",
+		"x - remove all pairs",
+	)
+}
+
+func print_all(ptr *data) {
+	rtree_map_foreach(ptr, func(key []byte, value int) bool {
+		fmt.Println(string(key), value)
+		return false
+	})
+}
+
+func print_debug(ptr *data) {
+	if nodes, depth, err := rtree_map_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("entries:", ptr.count, "nodes:", nodes, "depth:", depth)
+	}
+}
+
+/*
+ * Run -- opens the map named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("rtree_map", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'g': str_get(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* number of elements of an array created without -size */
+const SEG_DEFAULT_SIZE int = 16
+
+/*
+ * data -- element i of the array is the leaf tree[n + i], and every other
+ * tree[i] is the sum of tree[2i] and tree[2i + 1], so that a range is the
+ * sum of O(log n) nodes; tree[0] is unused
+ */
+type data struct {
+	n     int
+	tree  []int
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x47D0C2E9B8A51F36
+)
+
+var ErrRange = errors.New("index out of range")
+
+/*
+ * initialize -- creates an array of n elements, all zero
+ */
+func initialize(ptr *data, n int) {
+	txn("undo") {
+		ptr.n = n
+		ptr.tree = pmake([]int, 2 * n)
+		ptr.magic = magic
+	}
+}
+
+/*
+ * seg_update -- (internal) sets element i to value and the sums above it;
+ * must be called in a transaction
+ */
+func seg_update(ptr *data, i int, value int) {
+	k := ptr.n + i
+	ptr.tree[k] = value
+	for k /= 2; k >= 1; k /= 2 {
+		ptr.tree[k] = ptr.tree[2 * k] + ptr.tree[2 * k + 1]
+	}
+}
+
+/*
+ * seg_set -- sets element i to value, updating the sums on its path to the
+ * root in the same transaction
+ */
+func seg_set(ptr *data, i int, value int) error {
+	if i < 0 || i >= ptr.n {
+		return ErrRange
+	}
+	txn("undo") {
+		seg_update(ptr, i, value)
+	}
+	return nil
+}
+
+/*
+ * seg_add -- adds delta to element i, updating the sums on its path to the
+ * root in the same transaction
+ */
+func seg_add(ptr *data, i int, delta int) error {
+	if i < 0 || i >= ptr.n {
+		return ErrRange
+	}
+	txn("undo") {
+		seg_update(ptr, i, ptr.tree[ptr.n + i] + delta)
+	}
+	return nil
+}
+
+/*
+ * seg_get -- returns element i
+ */
+func seg_get(ptr *data, i int) (int, error) {
+	if i < 0 || i >= ptr.n {
+		return 0, ErrRange
+	}
+	return ptr.tree[ptr.n + i], nil
+}
+
+/*
+ * seg_sum -- returns the sum of the elements from lo to hi, both included
+ */
+func seg_sum(ptr *data, lo int, hi int) (int, error) {
+	if lo < 0 || hi >= ptr.n || lo > hi {
+		return 0, ErrRange
+	}
+	sum := 0
+	for l, r := lo + ptr.n, hi + ptr.n + 1; l < r; l, r = l / 2, r / 2 {
+		if l % 2 == 1 {
+			sum += ptr.tree[l]
+			l++
+		}
+		if r % 2 == 1 {
+			r--
+			sum += ptr.tree[r]
+		}
+	}
+	return sum, nil
+}
+
+/*
+ * seg_clear -- sets all elements to zero
+ */
+func seg_clear(ptr *data) {
+	txn("undo") {
+		for i := range ptr.tree {
+			ptr.tree[i] = 0
+		}
+	}
+}
+
+/*
+ * seg_check -- verifies that every inner node holds the sum of its children
+ */
+func seg_check(ptr *data) error {
+	if len(ptr.tree) != 2 * ptr.n {
+		return fmt.Errorf("%d nodes for %d elements", len(ptr.tree), ptr.n)
+	}
+	for i := ptr.n - 1; i >= 1; i-- {
+		if ptr.tree[i] != ptr.tree[2 * i] + ptr.tree[2 * i + 1] {
+			return fmt.Errorf("node %d holds %d, its children sum to %d", i,
+				ptr.tree[i], ptr.tree[2 * i] + ptr.tree[2 * i + 1])
+		}
+	}
+	return nil
+}
+
+/*
+ * str_set -- seg_set or seg_add wrapper which works on strings
+ */
+func str_set(ptr *data, str string, add bool) {
+	var i, value int
+	if scan_args("update", str, "%d %d", &i, &value) {
+		update := seg_set
+		if add {
+			update = seg_add
+		}
+		if err := update(ptr, i, value); err != nil {
+			fmt.Println("update:", err)
+		}
+	}
+}
+
+/*
+ * str_get -- seg_get wrapper which works on strings
+ */
+func str_get(ptr *data, str string) {
+	var i int
+	if scan_args("get", str, "%d", &i) {
+		if value, err := seg_get(ptr, i); err == nil {
+			fmt.Println(value)
+		} else {
+			fmt.Println("get:", err)
+		}
+	}
+}
+
+/*
+ * str_sum -- seg_sum wrapper which works on strings
+ */
+func str_sum(ptr *data, str string) {
+	var lo, hi int
+	if scan_args("sum", str, "%d %d", &lo, &hi) {
+		if sum, err := seg_sum(ptr, lo, hi); err == nil {
+			fmt.Println(sum)
+		} else {
+			fmt.Println("sum:", err)
+		}
+	}
+}
+
+/*
+ * str_insert_random -- adds random amounts to specified (as string) number
+ * of random elements
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			seg_add(ptr, rand.Intn(ptr.n), rand.Intn(100))
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"s $index $value - set element $index to $value",
+		"a $index $delta - add $delta to element $index",
+		"g $index - print element $index",
+		"S $lo $hi - print the sum of the elements from $lo to $hi",
+		"n $value - add random amounts to $value random elements",
+		"p - print all elements",
+		"d - print debug info",
+		"x - set all elements to zero",
+	)
+}
+
+func print_all(ptr *data) {
+	for _, v := range ptr.tree[ptr.n:] {
+		fmt.Print(v, " ")
+	}
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if err := seg_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+		return
+	}
+	fmt.Println("invariants: ok")
+	total, _ := seg_sum(ptr, 0, ptr.n - 1)
+	fmt.Println("elements:", ptr.n, "sum:", total)
+}
+
+/*
+ * Run -- opens the array named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("segtree", flag.ContinueOnError)
+	flags.Usage = func() {}
+	size := flags.Int("size", SEG_DEFAULT_SIZE, "number of elements when the array is created")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	if *size <= 0 {
+		return usage_error("the array needs a positive number of elements")
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr, *size)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 's': str_set(ptr, buf[1:], false)
+			case 'a': str_set(ptr, buf[1:], true)
+			case 'g': str_get(ptr, buf[1:])
+			case 'S': str_sum(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': seg_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "[-size n] filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
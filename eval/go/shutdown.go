@@ -0,0 +1,174 @@
+package main
+
+// Exit statuses, signal handling, pool opening, shutdown and pool reset of the
+// programs it is built with; see build.sh.
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/vmware/go-pmem-transaction/pmem"
+)
+
+// Exit statuses shared by the eval programs.
+const (
+	EXIT_OK          = 0 // the session or operation completed
+	EXIT_USAGE       = 1 // malformed command line
+	EXIT_POOL        = 2 // the pool could not be opened, or failed validation
+	EXIT_INTERRUPTED = 3 // terminated by SIGINT or SIGTERM
+	EXIT_FAILED      = 4 // an operation failed, for instance on a full pool
+)
+
+// ErrUsage is returned by Run when the command line is malformed.
+var ErrUsage = errors.New("invalid arguments")
+
+// usage_error is a malformed argument with a message of its own.
+type usage_error string
+
+func (e usage_error) Error() string {
+	return string(e)
+}
+
+// pool_error is a pool which could not be opened, or which failed validation.
+type pool_error string
+
+func (e pool_error) Error() string {
+	return string(e)
+}
+
+// exit_status maps the result of Run to an exit status.
+func exit_status(err error) int {
+	switch err.(type) {
+	case nil:
+		return EXIT_OK
+	case usage_error, *strconv.NumError:
+		return EXIT_USAGE
+	case pool_error:
+		return EXIT_POOL
+	}
+	switch err {
+	case ErrUsage:
+		return EXIT_USAGE
+	case ErrInterrupted:
+		return EXIT_INTERRUPTED
+	}
+	return EXIT_FAILED
+}
+
+// ErrInterrupted is returned by Run when SIGINT or SIGTERM ends the session.
+var ErrInterrupted = errors.New("interrupted")
+
+// interrupted receives SIGINT and SIGTERM once handle_signals is called.
+var interrupted = make(chan os.Signal, 1)
+
+// handle_signals delivers SIGINT and SIGTERM to interrupted instead of
+// terminating the process; Run checks for them between commands, so a
+// command and its transactions always run to the end.
+func handle_signals() {
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+}
+
+// is_interrupted returns whether a signal arrived, without waiting for one.
+func is_interrupted() bool {
+	select {
+	case <-interrupted:
+		return true
+	default:
+		return false
+	}
+}
+
+// ErrPoolFull is returned by the mutators when the pool has no room for what
+// they allocate.
+var ErrPoolFull = errors.New("pool is full")
+
+// pool_full is deferred by the functions which allocate in the pool: pnew and
+// pmake never return nil, but panic when the runtime cannot satisfy them, and
+// pool_full recovers that panic and returns ErrPoolFull in *err instead. The
+// panic unwinds through the transactions it was raised in first, so go-pmem
+// rolls them back; a mutator which finds the pool full halfway through a
+// transaction panics with ErrPoolFull to give it up the same way. Any other
+// panic goes on.
+func pool_full(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if r != ErrPoolFull && !alloc_failed(r) {
+		panic(r)
+	}
+	*err = ErrPoolFull
+}
+
+// alloc_failed reports whether r, recovered from a panic, is the runtime
+// failing an allocation: one larger than the heap can hold, or a heap which
+// cannot grow any more.
+func alloc_failed(r interface{}) bool {
+	e, ok := r.(runtime.Error)
+	if !ok {
+		return false
+	}
+	msg := e.Error()
+	return strings.Contains(msg, "makeslice") || strings.Contains(msg, "out of memory")
+}
+
+// ResetPool removes the pool file at path so that the next pmem.Init on it
+// takes the first-time initialization path. The transaction logs live inside
+// the pool file, so removing it discards them as well.
+func ResetPool(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// The root object of the pool Run opened, flushed by shutdown.
+var (
+	root_addr unsafe.Pointer
+	root_size uintptr
+)
+
+// pool_opened records the root object of the pool, size bytes at root, for
+// shutdown to flush.
+func pool_opened(root unsafe.Pointer, size uintptr) {
+	root_addr = root
+	root_size = size
+}
+
+// open_root opens the pool at path and returns its root object, of the type
+// the nil pointer root points to, and records it for shutdown to flush. The
+// object is created zeroed when the pool is new, or when a crash came between
+// the creation of the pool and that of the object, so the caller initializes
+// it unless it finds its magic in it.
+func open_root(path string, root interface{}) (unsafe.Pointer, error) {
+	var p unsafe.Pointer
+	if !pmem.Init(path) {
+		p = pmem.Get("root", root)
+	}
+	if p == nil {
+		p = pmem.New("root", root)
+		if p == nil {
+			return nil, pool_error("cannot create the root object in " + path)
+		}
+	}
+	pool_opened(p, reflect.TypeOf(root).Elem().Size())
+	return p, nil
+}
+
+// shutdown flushes the root object of the pool and standard output, then
+// exits with the status. Run has closed its structure by then, and go-pmem
+// cannot unmap a pool, so the mapping goes away with the process.
+func shutdown(status int) {
+	if root_addr != nil {
+		runtime.PersistRange(root_addr, root_size)
+	}
+	os.Stdout.Sync()
+	os.Exit(status)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Every kind of error Run returns maps to its own exit status.
+func TestExitStatus(t *testing.T) {
+	_, numerr := strconv.Atoi("x")
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{nil, EXIT_OK},
+		{ErrUsage, EXIT_USAGE},
+		{usage_error("invalid operation x"), EXIT_USAGE},
+		{numerr, EXIT_USAGE},
+		{pool_error("no root object in pool"), EXIT_POOL},
+		{ErrInterrupted, EXIT_INTERRUPTED},
+		{ErrPoolFull, EXIT_FAILED},
+	}
+	for _, tc := range tests {
+		if status := exit_status(tc.err); status != tc.status {
+			t.Errorf("%v: exit status %d, want %d", tc.err, status, tc.status)
+		}
+	}
+}
+
+// pool_full returns ErrPoolFull for an allocation the runtime cannot satisfy
+// and for a panic with ErrPoolFull, and passes any other panic on.
+func TestPoolFull(t *testing.T) {
+	alloc := func(n int, fail interface{}) (err error) {
+		defer pool_full(&err)
+		b := pmake([]byte, n)
+		if fail != nil {
+			panic(fail)
+		}
+		if len(b) != n {
+			return errors.New("short allocation")
+		}
+		return nil
+	}
+	if err := alloc(16, nil); err != nil {
+		t.Fatalf("allocation with room: %v", err)
+	}
+	if err := alloc(1 << 62, nil); err != ErrPoolFull {
+		t.Fatalf("allocation larger than the heap: %v, want ErrPoolFull", err)
+	}
+	if err := alloc(16, ErrPoolFull); err != ErrPoolFull {
+		t.Fatalf("panic with ErrPoolFull: %v, want ErrPoolFull", err)
+	}
+	defer func() {
+		if r := recover(); r != "other" {
+			t.Fatalf("recovered %v, want the other panic", r)
+		}
+	}()
+	alloc(16, "other")
+	t.Fatal("another panic was recovered")
+}
+
+// The program exits with the status of the way its run ended, and what it
+// inserted before shutdown is there when the pool is opened again. It is
+// btree, which test_units.sh runs these tests with.
+func TestShutdownStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shutdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pool := filepath.Join(dir, "shutdown.pool")
+	missing := filepath.Join(dir, "missing.pool")
+	unwritable := filepath.Join(dir, "nosuchdir", "cpu.prof")
+
+	tests := []struct {
+		args   []string
+		status int
+		out    string
+	}{
+		{[]string{}, EXIT_USAGE, "usage:"},
+		{[]string{pool, "x"}, EXIT_USAGE, "invalid operation"},
+		{[]string{pool, "i", "one", "1"}, EXIT_USAGE, "invalid syntax"},
+		{[]string{missing, "v"}, EXIT_POOL, "missing.pool"},
+		{[]string{"-cpuprofile", unwritable, pool, "p"}, EXIT_FAILED, "nosuchdir"},
+		{[]string{pool, "i", "1", "one"}, EXIT_OK, ""},
+		{[]string{pool, "f", "1"}, EXIT_OK, "one"},
+	}
+	for _, tc := range tests {
+		cmd, err := test_program(tc.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := cmd.CombinedOutput()
+		if status := exit_code(t, err); status != tc.status {
+			t.Errorf("%q: exit status %d, want %d\n%s", tc.args, status, tc.status, out)
+		} else if !strings.Contains(string(out), tc.out) {
+			t.Errorf("%q: output %q, want %q in it", tc.args, out, tc.out)
+		}
+	}
+}
+
+// SIGINT stops a run of inserts between two of them, with the interrupted
+// status.
+func TestShutdownInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shutdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	profile := filepath.Join(dir, "cpu.prof")
+
+	/* the profile is created after handle_signals, before the inserts */
+	cmd, err := test_program("-cpuprofile", profile, filepath.Join(dir, "shutdown.pool"), "s", "1000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if _, err := os.Stat(profile); err == nil {
+			break
+		}
+		if time.Since(start) > 10 * time.Second {
+			cmd.Process.Kill()
+			t.Fatal("no profile after 10s")
+		}
+	}
+	if err := cmd.Process.Signal(syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	if status := exit_code(t, cmd.Wait()); status != EXIT_INTERRUPTED {
+		t.Errorf("exit status %d, want %d", status, EXIT_INTERRUPTED)
+	}
+}
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
+	"io"
 	"os"
+	"os/exec"
 	"fmt"
 	"strconv"
 	"hash/fnv"
+	"sync"
 
 	"github.com/vmware/go-pmem-transaction/pmem"
 	"github.com/vmware/go-pmem-transaction/transaction"
@@ -13,151 +22,1396 @@ import (
 
 const N int = 10
 
+// Initial number of slots of an open addressing table; the table doubles
+// when more than 3/4 of the slots are taken.
+const P int = 16
+
+// Number of slots rehash moves to the new table per transaction.
+const REHASH_BATCH int = 256
+
+// Collision resolution schemes, chosen when the store is created.
+const (
+	MODE_CHAINING = iota // one slice of pairs per bucket
+	MODE_PROBING         // linear probing over a single slice of slots
+)
+
+// States of an open addressing slot.
+const (
+	SLOT_EMPTY = iota
+	SLOT_USED
+	SLOT_DELETED
+)
+
 type pair struct {
 	key   [32]byte
 	idx   int
 }
 
+type slot struct {
+	state int
+	pair
+}
+
+// link places the value at the same position in the insertion order list.
+type link struct {
+	key  [32]byte
+	prev int // position of the previous key inserted, or -1
+	next int // position of the next key inserted, or -1
+}
+
+// PVec is a persistent dynamic array of ints. Its backing array lives in the
+// pool and doubles when it fills up, so pushes take amortized constant time.
+type PVec struct {
+	elems []int // the backing array, cap(elems) is the capacity
+}
+
 type data struct {
 	buckets [][]pair
-	values  []int
+	values  PVec
 	magic   int
+	width   int    // size of the fixed-width blob values, 0 if disabled
+	blobs   []byte // blob value of pair.idx at [idx*width, (idx+1)*width)
+	mode    int    // MODE_CHAINING or MODE_PROBING
+	slots   []slot // open addressing table, used in MODE_PROBING
+	filled  int    // slots that are not SLOT_EMPTY
+	links   []link // insertion order list of the live keys, by value position
+	head    int    // position of the oldest live key, or -1
+	tail    int    // position of the newest live key, or -1
 }
 
 const (
 	// A magic number used to identify if the root object initialization
-	// completed successfully.
-	magic = 0x1B2E8BFF7BFBD154
+	// completed successfully. It changes with the layout of the root object,
+	// so that a pool written by an older simplekv is not misread.
+	magic = 0x1B2E8BFF7BFBD156
+
+	// The magic number of the layouts before this one.
+	old_magic = 0x1B2E8BFF7BFBD154
 )
 
+// hash is the 32-bit FNV-1a hash of s, computed in place so that neither it
+// nor hash_bytes allocates.
 func hash(s string) int {
-	h := fnv.New32a()
-	h.Write([]byte(s))
-	return int(h.Sum32())
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h = (h ^ uint32(s[i])) * 16777619
+	}
+	return int(h)
+}
+
+// hash_bytes is hash for a key held in a byte slice.
+func hash_bytes(b []byte) int {
+	h := uint32(2166136261)
+	for _, c := range b {
+		h = (h ^ uint32(c)) * 16777619
+	}
+	return int(h)
+}
+
+// layout_error returns the error for a root object initialized with the
+// magic number m, which is not that of the current layout.
+func layout_error(m int) error {
+	if m == old_magic {
+		return errors.New("the store has the layout of an older simplekv")
+	}
+	return fmt.Errorf("the root object is not a store (magic %#x)", m)
 }
 
-func initialize(ptr *data) {
+func initialize(ptr *data, width int, mode int) {
 	txn("undo") {
-		ptr.buckets = pmake([][]pair, N)
+		if mode == MODE_PROBING {
+			ptr.slots = pmake([]slot, P)
+			ptr.filled = 0
+		} else {
+			ptr.buckets = pmake([][]pair, N)
+		}
+		ptr.mode = mode
+		ptr.head = -1
+		ptr.tail = -1
+		ptr.width = width
 		ptr.magic = magic
 	}
 }
 
-func get(ptr *data, key string) *int {
-	index := hash(key) % N
+// probe returns the slot holding key in an open addressing table, or -1.
+func probe(slots []slot, key [32]byte, h int) int {
+	for i := 0; i < len(slots); i++ {
+		j := (h + i) % len(slots)
+		if slots[j].state == SLOT_EMPTY {
+			return -1
+		} else if slots[j].state == SLOT_USED && slots[j].key == key {
+			return j
+		}
+	}
+	return -1
+}
+
+// probe_free returns the first slot along the probe sequence of h that does
+// not hold a live pair.
+func probe_free(slots []slot, h int) int {
+	for i := 0; ; i++ {
+		j := (h + i) % len(slots)
+		if slots[j].state != SLOT_USED {
+			return j
+		}
+	}
+}
+
+// find_idx returns the position of the value of key in the value arrays, or
+// -1 if the key does not exist.
+func find_idx(ptr *data, key string) int {
+	if len(key) > 32 {
+		return -1
+	}
 	var bytes [32]byte
 	copy(bytes[:], key)
+	return find_key(ptr, bytes, hash(key))
+}
+
+// find_key is find_idx for a key already padded to 32 bytes, with hash h.
+func find_key(ptr *data, bytes [32]byte, h int) int {
+	if ptr.mode == MODE_PROBING {
+		if j := probe(ptr.slots, bytes, h); j >= 0 {
+			return ptr.slots[j].idx
+		}
+		return -1
+	}
 
+	index := h % N
 	for i:=0; i<len(ptr.buckets[index]); i++ {
 		e := ptr.buckets[index][i]
 		if e.key == bytes {
-			return &ptr.values[e.idx]
+			return e.idx
+		}
+	}
+	return -1
+}
+
+// foreach_pair calls cb for every key in the store and the position of its
+// value, until cb returns true.
+func foreach_pair(ptr *data, cb func(pair) bool) bool {
+	if ptr.mode == MODE_PROBING {
+		for j := 0; j < len(ptr.slots); j++ {
+			if ptr.slots[j].state == SLOT_USED && cb(ptr.slots[j].pair) {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; i < len(ptr.buckets); i++ {
+		for j := 0; j < len(ptr.buckets[i]); j++ {
+			if cb(ptr.buckets[i][j]) {
+				return true
+			}
 		}
 	}
+	return false
+}
 
+// simplekv_all returns an iterator over the keys and int values of the
+// store, bucket by bucket, shaped as a Go 1.23 range-over-func one: it calls
+// yield with each key until yield returns false. The go-pmem toolchain
+// predates range loops over functions, so callers call the iterator with
+// their yield function themselves.
+func simplekv_all(ptr *data) func(yield func(string, int) bool) {
+	return func(yield func(string, int) bool) {
+		foreach_pair(ptr, func(e pair) bool {
+			return !yield(key_string(e.key), ptr.values.Get(e.idx))
+		})
+	}
+}
+
+func get(ptr *data, key string) *int {
+	if i := find_idx(ptr, key); i >= 0 {
+		return ptr.values.At(i)
+	}
 	return nil
 }
 
-func put(ptr *data, key string, val int) {
-	index := hash(key) % N
+// get_bytes is get for a key held in a byte slice, which saves converting it
+// to a string.
+func get_bytes(ptr *data, key []byte) (int, bool) {
+	if len(key) > 32 {
+		return 0, false
+	}
 	var bytes [32]byte
 	copy(bytes[:], key)
+	if i := find_key(ptr, bytes, hash_bytes(key)); i >= 0 {
+		return ptr.values.Get(i), true
+	}
+	return 0, false
+}
+
+// ErrKeyTooLong is returned by the mutators for a key that does not fit in
+// the 32 bytes of a pair. Stored truncated it would be taken for any other
+// key with the same prefix, and be rehashed to the wrong place on a resize.
+var ErrKeyTooLong = errors.New("key is longer than 32 bytes")
+
+// Len returns the number of elements in v.
+func (v *PVec) Len() int {
+	return len(v.elems)
+}
+
+// Get returns the element at position i.
+func (v *PVec) Get(i int) int {
+	return v.elems[i]
+}
 
+// At returns a pointer to the element at position i, which must only be
+// written in a transaction.
+func (v *PVec) At(i int) *int {
+	return &v.elems[i]
+}
+
+// Set transactionally replaces the element at position i with val.
+func (v *PVec) Set(i int, val int) {
+	txn("undo") {
+		v.elems[i] = val
+	}
+}
+
+// Push transactionally appends val to v. When v is full its elements are
+// moved to a new backing array of twice the capacity, allocated before v is
+// changed so that a full pool leaves v as it was and returns ErrPoolFull.
+func (v *PVec) Push(val int) (err error) {
+	defer pool_full(&err)
+	elems := v.grow(1)
+	txn("undo") {
+		v.elems = append(elems, val)
+	}
+	return nil
+}
+
+// grow returns a backing array holding the elements of v with room for n
+// more, which is that of v if it has the room; it panics if the pool is full
+// (see pool_full). v itself is not changed.
+func (v *PVec) grow(n int) []int {
+	if len(v.elems) + n <= cap(v.elems) {
+		return v.elems
+	}
+	elems := pmake([]int, len(v.elems), grow_cap(cap(v.elems), len(v.elems) + n))
 	txn("undo") {
-		/* search for element with specified key - if found
-		 * transactionally update its value */
-		for i:=0; i<len(ptr.buckets[index]); i++ {
-			e := ptr.buckets[index][i];
-			if e.key == bytes {
-				ptr.values[e.idx] = val
-				return
+		copy(elems, v.elems)
+	}
+	return elems
+}
+
+// grow_cap returns the capacity c doubles to until it holds n elements.
+func grow_cap(c int, n int) int {
+	if c == 0 {
+		c = 1
+	}
+	for c < n {
+		c *= 2
+	}
+	return c
+}
+
+// reserve makes room in the store for the new keys with hashes hs, so that
+// inserting them with new_value and add_pair allocates nothing. Every array
+// is allocated and filled before any is replaced, so a full pool leaves the
+// store as it was and returns ErrPoolFull. If progress is not nil it is
+// called as the buckets are moved: for each slot rehash moves to a new open
+// addressing table, and for each bucket of a chaining table moved to a larger
+// slice, with the number done and the total. reserve runs transactions of its
+// own and calls progress between them, so it must not be called in a
+// transaction, and progress must not touch the store.
+func reserve(ptr *data, hs []int, progress func(done, total int)) (err error) {
+	defer pool_full(&err)
+	n := ptr.values.Len() + len(hs)
+	elems := ptr.values.grow(len(hs))
+	links := ptr.links
+	if n > cap(links) {
+		links = pmake([]link, len(ptr.links), grow_cap(cap(ptr.links), n))
+		txn("undo") {
+			copy(links, ptr.links)
+		}
+	}
+	blobs := ptr.blobs
+	if ptr.width > 0 && n * ptr.width > cap(blobs) {
+		blobs = pmake([]byte, len(ptr.blobs), grow_cap(cap(ptr.blobs), n * ptr.width))
+		txn("undo") {
+			copy(blobs, ptr.blobs)
+		}
+	}
+
+	var buckets map[int][]pair = nil
+	var slots []slot = nil
+	live := 0
+	if ptr.mode == MODE_PROBING {
+		capacity := len(ptr.slots)
+		for 4 * (ptr.filled + len(hs)) > 3 * capacity {
+			capacity *= 2
+		}
+		if capacity > len(ptr.slots) {
+			slots, live = rehash(ptr, capacity, progress)
+		}
+	} else {
+		added := make(map[int]int)
+		for _, h := range hs {
+			added[h % N]++
+		}
+		var full []int
+		for index, k := range added {
+			if len(ptr.buckets[index]) + k > cap(ptr.buckets[index]) {
+				full = append(full, index)
 			}
 		}
+		buckets = make(map[int][]pair)
+		for i, index := range full {
+			bucket := ptr.buckets[index]
+			b := pmake([]pair, len(bucket), grow_cap(cap(bucket), len(bucket) + added[index]))
+			txn("undo") {
+				copy(b, bucket)
+			}
+			buckets[index] = b
+			if progress != nil {
+				progress(i + 1, len(full))
+			}
+		}
+	}
 
-		/* if there is no element with specified key, insert new value
-		 * to the end of values vector and put reference in proper
-		 * bucket transactionally */
-		l1 := len(ptr.values)
-		if len(ptr.values) == 0 {
-			ptr.values = pmake([]int, 0, 1)
+	txn("undo") {
+		ptr.values.elems = elems
+		ptr.links = links
+		ptr.blobs = blobs
+		for index, b := range buckets {
+			ptr.buckets[index] = b
+		}
+		if slots != nil {
+			ptr.slots = slots
+			ptr.filled = live
 		}
-		ptr.values = append(ptr.values, val)
+	}
+	return nil
+}
+
+// new_value appends val, and a zeroed blob if the store has blob values, to
+// the end of the value arrays, links key at the tail of the insertion order
+// list and returns the position of the value. The arrays must have room for
+// it (see reserve).
+func new_value(ptr *data, key [32]byte, val int) int {
+	idx := ptr.values.Len()
+	ptr.values.elems = append(ptr.values.elems, val)
+	if ptr.width > 0 {
+		ptr.blobs = append(ptr.blobs, make([]byte, ptr.width)...)
+	}
+
+	ptr.links = append(ptr.links, link {key, ptr.tail, -1})
+	if ptr.tail >= 0 {
+		ptr.links[ptr.tail].next = idx
+	} else {
+		ptr.head = idx
+	}
+	ptr.tail = idx
+	return idx
+}
+
+// unlink removes the value at position idx from the insertion order list.
+func unlink(ptr *data, idx int) {
+	l := ptr.links[idx]
+	if l.prev >= 0 {
+		ptr.links[l.prev].next = l.next
+	} else {
+		ptr.head = l.next
+	}
+	if l.next >= 0 {
+		ptr.links[l.next].prev = l.prev
+	} else {
+		ptr.tail = l.prev
+	}
+}
 
-		if len(ptr.buckets[index]) == 0 {
-			ptr.buckets[index] = pmake([]pair, 0, 1)
+// foreach_insertion_order calls cb for the live keys and their int values,
+// oldest first, until cb returns true.
+func foreach_insertion_order(ptr *data, cb func(string, int) bool) bool {
+	for i := ptr.head; i >= 0; i = ptr.links[i].next {
+		if cb(key_string(ptr.links[i].key), ptr.values.Get(i)) {
+			return true
 		}
-		ptr.buckets[index] = append(ptr.buckets[index], pair {bytes, l1})
 	}
+	return false
 }
 
-func show_usage(prog string) {
-	println("usage:", prog, "filename [get key|put key value]")
+// rehash returns a new open addressing table of the given capacity holding
+// the live pairs of the table of the store, and their number; it panics if
+// the pool is full (see pool_full), and the store itself is not changed. The slots are moved
+// REHASH_BATCH at a time, each batch in a transaction of its own, and if
+// progress is not nil it is called for each slot of the old table once the
+// batch moving it is committed. Nothing refers to the new table until it is
+// returned, so a crash in between only leaves it to the garbage collector.
+func rehash(ptr *data, capacity int, progress func(done, total int)) ([]slot, int) {
+	slots := pmake([]slot, capacity)
+	live := 0
+	for start := 0; start < len(ptr.slots); start += REHASH_BATCH {
+		end := start + REHASH_BATCH
+		if end > len(ptr.slots) {
+			end = len(ptr.slots)
+		}
+		txn("undo") {
+			for j := start; j < end; j++ {
+				if ptr.slots[j].state == SLOT_USED {
+					/* put takes no key longer than its 32 bytes, so the
+					 * key read back is the one which was hashed */
+					e := ptr.slots[j]
+					slots[probe_free(slots, hash(key_string(e.key)))] = e
+					live++
+				}
+			}
+		}
+		if progress != nil {
+			for j := start; j < end; j++ {
+				progress(j + 1, len(ptr.slots))
+			}
+		}
+	}
+	return slots, live
+}
 
+// store_locks holds the lock of each store, made on first use. The mutators
+// hold it for writing, and snapshot and clone hold it for reading while they
+// copy the store, so that the copy is the store between two writes.
+var (
+	store_locks_mu sync.Mutex
+	store_locks    = map[*data]*sync.RWMutex{}
+)
+
+// store_lock returns the lock of the store.
+func store_lock(ptr *data) *sync.RWMutex {
+	store_locks_mu.Lock()
+	defer store_locks_mu.Unlock()
+	l := store_locks[ptr]
+	if l == nil {
+		l = new(sync.RWMutex)
+		store_locks[ptr] = l
+	}
+	return l
 }
 
-func main() {
-	args := os.Args
+func put(ptr *data, key string, val int) error {
+	return put_progress(ptr, key, val, nil)
+}
+
+// put_progress is put, calling progress as the resize the new key may take
+// moves the buckets (see reserve).
+func put_progress(ptr *data, key string, val int, progress func(done, total int)) error {
+	if len(key) > 32 {
+		return ErrKeyTooLong
+	}
+	var bytes [32]byte
+	copy(bytes[:], key)
+	return put_key(ptr, bytes, hash(key), val, progress)
+}
+
+// put_bytes is put for a key held in a byte slice, which saves converting it
+// to a string.
+func put_bytes(ptr *data, key []byte, val int) error {
+	if len(key) > 32 {
+		return ErrKeyTooLong
+	}
+	var bytes [32]byte
+	copy(bytes[:], key)
+	return put_key(ptr, bytes, hash_bytes(key), val, nil)
+}
+
+// put_key is put_progress for a key already padded to 32 bytes, with hash h.
+func put_key(ptr *data, bytes [32]byte, h int, val int, progress func(done, total int)) error {
+	l := store_lock(ptr)
+	l.Lock()
+	defer l.Unlock()
+
+	/* search for element with specified key - if found
+	 * transactionally update its value */
+	if i := find_key(ptr, bytes, h); i >= 0 {
+		ptr.values.Set(i, val)
+		return nil
+	}
+
+	/* make room for the key before anything else, so that a full pool
+	 * leaves the store untouched */
+	if err := reserve(ptr, []int{h}, progress); err != nil {
+		return err
+	}
+
+	txn("undo") {
+		/* if there is no element with specified key, insert new value
+		 * to the end of values vector and put reference in the table
+		 * transactionally */
+		add_pair(ptr, bytes, h, new_value(ptr, bytes, val))
+	}
+	return nil
+}
 
-	if len(args) < 4 {
-		show_usage(args[0])
+// add_pair puts the key with hash h and value position idx in the table,
+// which must have room for it (see reserve).
+func add_pair(ptr *data, bytes [32]byte, h int, idx int) {
+	if ptr.mode == MODE_PROBING {
+		j := probe_free(ptr.slots, h)
+		if ptr.slots[j].state == SLOT_EMPTY {
+			ptr.filled++
+		}
+		ptr.slots[j] = slot {SLOT_USED, pair {bytes, idx}}
 		return
 	}
+	index := h % N
+	ptr.buckets[index] = append(ptr.buckets[index], pair {bytes, idx})
+}
 
-	var ptr *data
-	flag.Parse()
-	firstInit := pmem.Init(args[1])
-	if firstInit {
-		// first time run of the application
-		ptr = (*data)(pmem.New("root", ptr))
-		initialize(ptr)
+// del removes key from the store and reports whether it existed. The value
+// arrays only grow, so the value of the key stays allocated.
+func del(ptr *data, key string) bool {
+	if len(key) > 32 {
+		return false
+	}
+	var bytes [32]byte
+	copy(bytes[:], key)
+	found := false
+	l := store_lock(ptr)
+	l.Lock()
+	defer l.Unlock()
+
+	txn("undo") {
+		if ptr.mode == MODE_PROBING {
+			if j := probe(ptr.slots, bytes, hash(key)); j >= 0 {
+				ptr.slots[j].state = SLOT_DELETED
+				unlink(ptr, ptr.slots[j].idx)
+				found = true
+			}
+		} else {
+			index := hash(key) % N
+			last := len(ptr.buckets[index]) - 1
+			for i := 0; i <= last; i++ {
+				if ptr.buckets[index][i].key == bytes {
+					unlink(ptr, ptr.buckets[index][i].idx)
+					ptr.buckets[index][i] = ptr.buckets[index][last]
+					ptr.buckets[index] = ptr.buckets[index][:last]
+					found = true
+					break
+				}
+			}
+		}
+	}
+	return found
+}
+
+// incr atomically adds delta to the value of key, creating it with delta if
+// it does not exist, and returns the new value.
+func incr(ptr *data, key string, delta int) (int, error) {
+	if len(key) > 32 {
+		return 0, ErrKeyTooLong
+	}
+	var bytes [32]byte
+	copy(bytes[:], key)
+	h := hash(key)
+	l := store_lock(ptr)
+	l.Lock()
+	defer l.Unlock()
+	i := find_key(ptr, bytes, h)
+	if i < 0 {
+		if err := reserve(ptr, []int{h}, nil); err != nil {
+			return 0, err
+		}
+	}
+
+	ret := delta
+	txn("undo") {
+		if i < 0 {
+			add_pair(ptr, bytes, h, new_value(ptr, bytes, delta))
+		} else {
+			*ptr.values.At(i) += delta
+			ret = ptr.values.Get(i)
+		}
+	}
+	return ret, nil
+}
+
+// transfer moves amount from the int value of from to that of to in a single
+// transaction. Nothing is changed if amount is negative, either key does not
+// exist or from holds less than amount.
+func transfer(ptr *data, from string, to string, amount int) error {
+	if amount < 0 {
+		return fmt.Errorf("cannot transfer a negative amount %d", amount)
+	}
+	l := store_lock(ptr)
+	l.Lock()
+	defer l.Unlock()
+	txn("undo") {
+		src, dst := find_idx(ptr, from), find_idx(ptr, to)
+		if src < 0 {
+			return fmt.Errorf("no value found for %s", from)
+		}
+		if dst < 0 {
+			return fmt.Errorf("no value found for %s", to)
+		}
+		if ptr.values.Get(src) < amount {
+			return fmt.Errorf("%s holds %d, less than %d", from, ptr.values.Get(src), amount)
+		}
+		*ptr.values.At(src) -= amount
+		*ptr.values.At(dst) += amount
+	}
+	return nil
+}
+
+// put_blob sets the fixed-width blob value of key, creating the key with a
+// zero int value if it does not exist.
+func put_blob(ptr *data, key string, val []byte) error {
+	if ptr.width == 0 {
+		return errors.New("the store has no blob values")
+	}
+	if len(val) != ptr.width {
+		return fmt.Errorf("value is %d bytes, the store holds %d-byte values",
+			len(val), ptr.width)
+	}
+	if len(key) > 32 {
+		return ErrKeyTooLong
+	}
+	var bytes [32]byte
+	copy(bytes[:], key)
+	h := hash(key)
+	l := store_lock(ptr)
+	l.Lock()
+	defer l.Unlock()
+	i := find_key(ptr, bytes, h)
+	if i < 0 {
+		if err := reserve(ptr, []int{h}, nil); err != nil {
+			return err
+		}
+	}
+
+	txn("undo") {
+		if i < 0 {
+			i = new_value(ptr, bytes, 0)
+			add_pair(ptr, bytes, h, i)
+		}
+		copy(ptr.blobs[i*ptr.width:], val)
+	}
+	return nil
+}
+
+// view_blob returns the blob value of key without copying it out of the
+// pool, or nil if the key does not exist. The result must not be modified.
+func view_blob(ptr *data, key string) []byte {
+	i := find_idx(ptr, key)
+	if i < 0 || ptr.width == 0 {
+		return nil
+	}
+	return ptr.blobs[i*ptr.width : (i+1)*ptr.width : (i+1)*ptr.width]
+}
+
+// get_blob returns a copy of the blob value of key, or nil if the key does
+// not exist.
+func get_blob(ptr *data, key string) []byte {
+	v := view_blob(ptr, key)
+	if v == nil {
+		return nil
+	}
+	out := make([]byte, len(v))
+	copy(out, v)
+	return out
+}
+
+// key_string converts a stored key back to the string it was created from.
+func key_string(key [32]byte) string {
+	return string(bytes.TrimRight(key[:], "\x00"))
+}
+
+// fingerprint returns a hash of the content of the store that does not depend
+// on the order of insertion or on the layout of the table: the hashes of the
+// entries (key, int value and blob value) are combined with XOR.
+func fingerprint(ptr *data) uint64 {
+	var sum uint64
+	var v [8]byte
+	foreach_pair(ptr, func(e pair) bool {
+		h := fnv.New64a()
+		h.Write([]byte(key_string(e.key)))
+		binary.LittleEndian.PutUint64(v[:], uint64(ptr.values.Get(e.idx)))
+		h.Write(v[:])
+		if ptr.width > 0 {
+			h.Write(ptr.blobs[e.idx*ptr.width : (e.idx+1)*ptr.width])
+		}
+		sum ^= h.Sum64()
+		return false
+	})
+	return sum
+}
+
+// export_json writes the whole store to w as a single JSON object with the
+// keys in sorted order.
+func export_json(ptr *data, w io.Writer) error {
+	m := make(map[string]int)
+	foreach_pair(ptr, func(e pair) bool {
+		m[key_string(e.key)] = ptr.values.Get(e.idx)
+		return false
+	})
+	// encoding/json emits map keys sorted
+	return json.NewEncoder(w).Encode(m)
+}
+
+// import_json reads a JSON object produced by export_json from r and puts
+// all of its entries into the store in a single transaction. Room is made for
+// all the new keys first, so a full pool leaves the store as it was; progress,
+// if not nil, is called as the resize this takes moves the buckets (see
+// reserve).
+func import_json(ptr *data, r io.Reader, progress func(done, total int)) error {
+	var m map[string]int
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return err
+	}
+	for k := range m {
+		if len(k) > 32 {
+			return fmt.Errorf("key '%s': %v", k, ErrKeyTooLong)
+		}
+	}
+	l := store_lock(ptr)
+	l.Lock()
+	defer l.Unlock()
+	var hs []int
+	for k := range m {
+		if find_idx(ptr, k) < 0 {
+			hs = append(hs, hash(k))
+		}
+	}
+	if err := reserve(ptr, hs, progress); err != nil {
+		return err
+	}
+	txn("undo") {
+		/* the keys find the room they need */
+		for k, v := range m {
+			var bytes [32]byte
+			copy(bytes[:], k)
+			if i := find_key(ptr, bytes, hash(k)); i >= 0 {
+				*ptr.values.At(i) = v
+			} else {
+				add_pair(ptr, bytes, hash(k), new_value(ptr, bytes, v))
+			}
+		}
+	}
+	return nil
+}
+
+// program_command returns the command running this program again with args;
+// the tests replace it, as their executable is not simplekv.
+var program_command = func(args ...string) (*exec.Cmd, error) {
+	prog, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return exec.Command(prog, args...), nil
+}
+
+// snapshot copies all keys and int values into a new store at destPath,
+// created with the same collision resolution. A process maps a single pool,
+// so the copy is made by a child simplekv importing the JSON export of this
+// store, taken under the store lock so that no write lands in the middle of
+// it. The export has no room for blob values, so a store holding them is
+// copied with clone instead.
+func snapshot(ptr *data, destPath string) error {
+	if ptr.width > 0 {
+		return errors.New("snapshot drops blob values, use clone")
+	}
+	if _, err := os.Stat(destPath); err == nil {
+		return fmt.Errorf("%s already exists", destPath)
+	}
+
+	var buf bytes.Buffer
+	l := store_lock(ptr)
+	l.RLock()
+	err := export_json(ptr, &buf)
+	l.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	mode := "chain"
+	if ptr.mode == MODE_PROBING {
+		mode = "probe"
+	}
+	cmd, err := program_command("-mode", mode, destPath, "import")
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = &buf
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// image_writer and image_reader carry the layout of a store from clone to
+// the process writing the copy, as little-endian 64-bit words and raw bytes.
+// The first error sticks and ends the transfer.
+type image_writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+type image_reader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (w *image_writer) int(v int) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(v))
+	w.bytes(buf[:])
+}
+
+func (w *image_writer) bytes(b []byte) {
+	if w.err == nil {
+		_, w.err = w.w.Write(b)
+	}
+}
+
+func (r *image_reader) int() int {
+	var buf [8]byte
+	r.bytes(buf[:])
+	return int(binary.LittleEndian.Uint64(buf[:]))
+}
+
+func (r *image_reader) bytes(b []byte) {
+	if r.err == nil {
+		_, r.err = io.ReadFull(r.r, b)
+	}
+}
+
+// len reads a slice length, which must not exceed max.
+func (r *image_reader) len(max int) int {
+	n := r.int()
+	if r.err == nil && (n < 0 || n > max) {
+		r.err = fmt.Errorf("corrupt image: length %d", n)
+	}
+	if r.err != nil {
+		return 0
+	}
+	return n
+}
+
+// write_image writes every array of the store to w as it is laid out.
+func write_image(ptr *data, w io.Writer) error {
+	iw := &image_writer{w: bufio.NewWriter(w)}
+	iw.int(ptr.head)
+	iw.int(ptr.tail)
+	iw.int(ptr.filled)
+
+	iw.int(ptr.values.Len())
+	for i := 0; i < ptr.values.Len(); i++ {
+		iw.int(ptr.values.Get(i))
+	}
+	for i := 0; i < len(ptr.links); i++ {
+		iw.bytes(ptr.links[i].key[:])
+		iw.int(ptr.links[i].prev)
+		iw.int(ptr.links[i].next)
+	}
+	iw.bytes(ptr.blobs)
+
+	iw.int(len(ptr.buckets))
+	for _, bucket := range ptr.buckets {
+		iw.int(len(bucket))
+		for _, e := range bucket {
+			iw.bytes(e.key[:])
+			iw.int(e.idx)
+		}
+	}
+	iw.int(len(ptr.slots))
+	for _, sl := range ptr.slots {
+		iw.int(sl.state)
+		iw.bytes(sl.key[:])
+		iw.int(sl.idx)
+	}
+
+	if iw.err != nil {
+		return iw.err
+	}
+	return iw.w.Flush()
+}
+
+// read_image fills the empty store ptr, created with the same width and
+// collision resolution, with the arrays written by write_image, in a single
+// transaction.
+func read_image(ptr *data, r io.Reader) (err error) {
+	defer pool_full(&err)
+	if ptr.values.Len() != 0 || ptr.filled != 0 {
+		return errors.New("the store to restore into is not empty")
+	}
+	const max = 1 << 40
+	ir := &image_reader{r: bufio.NewReader(r)}
+	head, tail, filled := ir.int(), ir.int(), ir.int()
+
+	n := ir.len(max)
+	values := make([]int, n)
+	for i := range values {
+		values[i] = ir.int()
+	}
+	links := make([]link, n)
+	for i := range links {
+		ir.bytes(links[i].key[:])
+		links[i].prev = ir.int()
+		links[i].next = ir.int()
+	}
+	blobs := make([]byte, n*ptr.width)
+	ir.bytes(blobs)
+
+	buckets := make([][]pair, ir.len(max))
+	for i := range buckets {
+		buckets[i] = make([]pair, ir.len(max))
+		for j := range buckets[i] {
+			ir.bytes(buckets[i][j].key[:])
+			buckets[i][j].idx = ir.int()
+		}
+	}
+	slots := make([]slot, ir.len(max))
+	for i := range slots {
+		slots[i].state = ir.int()
+		ir.bytes(slots[i].key[:])
+		slots[i].idx = ir.int()
+	}
+	if ir.err != nil {
+		return ir.err
+	}
+	if ptr.mode == MODE_CHAINING && len(buckets) != N ||
+		ptr.mode == MODE_PROBING && len(slots) == 0 {
+		return errors.New("the image does not match the collision resolution of the store")
+	}
+
+	/* allocate every array before the store is changed, so that a full
+	 * pool leaves it empty */
+	var v []int = nil
+	var l []link = nil
+	var b []byte = nil
+	if n > 0 {
+		v, l = pmake([]int, n), pmake([]link, n)
+	}
+	if len(blobs) > 0 {
+		b = pmake([]byte, len(blobs))
+	}
+	var bs [][]pair = nil
+	var sl []slot = nil
+	if ptr.mode == MODE_CHAINING {
+		bs = make([][]pair, len(buckets))
+		for i := range buckets {
+			if len(buckets[i]) == 0 {
+				continue
+			}
+			bs[i] = pmake([]pair, len(buckets[i]))
+		}
 	} else {
-		// not a first time initialization
-		ptr = (*data)(pmem.Get("root", ptr))
+		sl = pmake([]slot, len(slots))
+	}
+
+	txn("undo") {
+		if n > 0 {
+			copy(v, values)
+			copy(l, links)
+			ptr.values.elems = v
+			ptr.links = l
+		}
+		if len(blobs) > 0 {
+			copy(b, blobs)
+			ptr.blobs = b
+		}
+		if ptr.mode == MODE_CHAINING {
+			for i := range bs {
+				if bs[i] != nil {
+					copy(bs[i], buckets[i])
+					ptr.buckets[i] = bs[i]
+				}
+			}
+		} else {
+			copy(sl, slots)
+			ptr.slots = sl
+		}
+		ptr.head = head
+		ptr.tail = tail
+		ptr.filled = filled
+	}
+	return nil
+}
+
+// clone copies the store into a new store at destPath with the same layout,
+// array by array: unlike snapshot nothing is rehashed, and the blobs are
+// copied as well. As for snapshot, the image is taken under the store lock
+// and a child simplekv writes the copy.
+func clone(ptr *data, destPath string) error {
+	if _, err := os.Stat(destPath); err == nil {
+		return fmt.Errorf("%s already exists", destPath)
+	}
+
+	var buf bytes.Buffer
+	l := store_lock(ptr)
+	l.RLock()
+	err := write_image(ptr, &buf)
+	l.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	mode := "chain"
+	if ptr.mode == MODE_PROBING {
+		mode = "probe"
+	}
+	cmd, err := program_command("-width", strconv.Itoa(ptr.width), "-mode", mode,
+		destPath, "restore")
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = &buf
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// validate_pairs checks that every key can be found by a lookup and that no
+// key or value position is used twice or out of range, and returns the
+// number of live keys.
+func validate_pairs(ptr *data) (int, error) {
+	keys := make(map[[32]byte]bool)
+	positions := make(map[int]bool)
+	var err error = nil
+	foreach_pair(ptr, func(e pair) bool {
+		key := key_string(e.key)
+		if e.idx < 0 || e.idx >= ptr.values.Len() {
+			err = fmt.Errorf("key %s has value position %d of %d", key, e.idx, ptr.values.Len())
+		} else if keys[e.key] {
+			err = fmt.Errorf("key %s is stored twice", key)
+		} else if positions[e.idx] {
+			err = fmt.Errorf("value position %d is shared by several keys", e.idx)
+		} else if find_key(ptr, e.key, hash(key)) != e.idx {
+			err = fmt.Errorf("key %s is not where a lookup looks for it", key)
+		}
+		keys[e.key] = true
+		positions[e.idx] = true
+		return err != nil
+	})
+	return len(keys), err
+}
+
+// validate_slots checks the count of the open addressing slots in use.
+func validate_slots(ptr *data) error {
+	filled := 0
+	for j := 0; j < len(ptr.slots); j++ {
+		if ptr.slots[j].state != SLOT_EMPTY {
+			filled++
+		}
+	}
+	if filled != ptr.filled {
+		return fmt.Errorf("%d slots are taken, %d are counted", filled, ptr.filled)
+	}
+	if len(ptr.slots) > 0 && filled == len(ptr.slots) {
+		return errors.New("no slot is empty, lookups of missing keys never end")
+	}
+	return nil
+}
+
+// validate_links checks that the insertion order list is a well-linked list
+// of live keys of the given length.
+func validate_links(ptr *data, live int) error {
+	prev, n := -1, 0
+	for i := ptr.head; i >= 0; i = ptr.links[i].next {
+		if i >= len(ptr.links) || n == live {
+			return fmt.Errorf("the list goes past %d keys or out of range", live)
+		}
+		if ptr.links[i].prev != prev {
+			return fmt.Errorf("position %d links back to %d, not %d", i, ptr.links[i].prev, prev)
+		}
+		if find_idx(ptr, key_string(ptr.links[i].key)) != i {
+			return fmt.Errorf("key %s in the list is not live", key_string(ptr.links[i].key))
+		}
+		prev = i
+		n++
+	}
+	if n != live {
+		return fmt.Errorf("the list holds %d keys, the store %d", n, live)
+	}
+	if prev != ptr.tail {
+		return fmt.Errorf("the list ends at %d, the tail is %d", prev, ptr.tail)
+	}
+	return nil
+}
+
+// validate opens the existing store at path without initializing or changing
+// it and reports the result of every check, returning an error if one fails.
+// go-pmem has no read-only mapping, and opening the store still rolls back a
+// transaction left unfinished by a crash.
+func validate(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return pool_error(err.Error())
+	}
+	pmem.Init(path)
+	var ptr *data
+	ptr = (*data)(pmem.Get("root", ptr))
+	if ptr == nil {
+		return pool_error("no root object in " + path)
+	}
+
+	failed := false
+	report := func(check string, err error) bool {
+		if err != nil {
+			fmt.Println(check + ": FAILED,", err)
+			failed = true
+		} else {
+			fmt.Println(check + ": ok")
+		}
+		return err == nil
+	}
+
+	var err error = nil
+	if ptr.magic == 0 {
+		err = errors.New("the root object was never initialized")
+	} else if ptr.magic != magic {
+		err = layout_error(ptr.magic)
+	} else if ptr.mode != MODE_CHAINING && ptr.mode != MODE_PROBING {
+		err = fmt.Errorf("unknown collision resolution %d", ptr.mode)
+	} else if ptr.mode == MODE_CHAINING && len(ptr.buckets) != N {
+		err = fmt.Errorf("%d buckets instead of %d", len(ptr.buckets), N)
+	} else if len(ptr.links) != ptr.values.Len() {
+		err = fmt.Errorf("%d links for %d values", len(ptr.links), ptr.values.Len())
+	} else if ptr.width < 0 || len(ptr.blobs) != ptr.width * ptr.values.Len() {
+		err = fmt.Errorf("%d blob bytes for %d values of width %d",
+			len(ptr.blobs), ptr.values.Len(), ptr.width)
+	}
+	// the remaining checks index the arrays checked above
+	if report("root", err) {
+		if ptr.mode == MODE_PROBING {
+			report("slots", validate_slots(ptr))
+		}
+		live, err := validate_pairs(ptr)
+		if report("keys", err) {
+			report("insertion order", validate_links(ptr, live))
+		}
+	}
+
+	if failed {
+		return pool_error(path + " failed validation")
+	}
+	return nil
+}
+
+// replay_command runs one operation of a replayed workload: get, put, del
+// or incr with the arguments of the command of the same name.
+func replay_command(ptr *data, args []string) error {
+	n := 0
+	if len(args) == 3 {
+		var err error
+		if n, err = strconv.Atoi(args[2]); err != nil {
+			return err
+		}
+	}
+	switch {
+	case args[0] == "get" && len(args) == 2:
+		get(ptr, args[1])
+	case args[0] == "put" && len(args) == 3:
+		return put(ptr, args[1], n)
+	case args[0] == "del" && len(args) == 2:
+		del(ptr, args[1])
+	case args[0] == "incr" && len(args) == 3:
+		_, err := incr(ptr, args[1], n)
+		return err
+	default:
+		return errors.New("unknown command")
+	}
+	return nil
+}
+
+func show_usage(prog string) {
+	println("usage:", prog, "[-cpuprofile file] [-memprofile file] [-width bytes] [-mode chain|probe] [-progress] [-speedup factor] filename "+
+		"[get key|put key value|del key|incr key delta|transfer from to amount|getb key|putb key hex|list|export|import|snapshot dest|clone dest|fingerprint|validate|replay workload]")
+	println("validate checks the store without writing to it, but opening it still rolls back a transaction left unfinished by a crash")
+}
+
+// check_width fails unless width, the -width of the command line, is 0 or
+// the width of the blob values of the store in the pool path; the width is
+// fixed when the store is created.
+func check_width(ptr *data, path string, width int) error {
+	if width != 0 && width != ptr.width {
+		return fmt.Errorf("value width mismatch: %s holds %d-byte values, not %d",
+			path, ptr.width, width)
+	}
+	return nil
+}
+
+// Run opens the store named in args (the command line without the program
+// name) and executes the command that follows it.
+func Run(args []string) error {
+	flags := flag.NewFlagSet("simplekv", flag.ContinueOnError)
+	flags.Usage = func() {}
+	cpuprofile := flags.String("cpuprofile", "", "write a CPU profile of the command to `file`")
+	memprofile := flags.String("memprofile", "", "write a heap profile to `file` on exit")
+	width := flags.Int("width", 0, "size in bytes of the blob values of a new store")
+	mode := flags.String("mode", "chain", "collision resolution of a new store (chain|probe)")
+	progress := flags.Bool("progress", false, "report the progress of the table resizes of put and import on the standard error")
+	speedup := flags.Float64("speedup", 1, "divide the gaps between the operations of a replayed workload by `factor`")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
 
-		// even though this is not a first time initialization, we should still
-		// check if the named object exists and data initialization completed
-		// succesfully. The magic element within the named object helps check
-		// for successful data initialization.
+	if len(args) < 2 || *width < 0 {
+		return ErrUsage
+	}
 
-		if ptr == nil {
-			ptr = (*data)(pmem.New("root", ptr))
+	if args[1] == "validate" {
+		if len(args) != 2 {
+			return ErrUsage
 		}
+		return validate(args[0])
+	}
+
+	resolution := MODE_CHAINING
+	if *mode == "probe" {
+		resolution = MODE_PROBING
+	} else if *mode != "chain" {
+		return usage_error("invalid collision resolution '" + *mode + "'")
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic == 0 {
+		initialize(ptr, *width, resolution)
+	} else if ptr.magic != magic {
+		return pool_error(fmt.Sprintf("%s: %v", args[0], layout_error(ptr.magic)))
+	}
 
-		if ptr.magic != magic {
-			initialize(ptr)
+	if err := check_width(ptr, args[0], *width); err != nil {
+		return err
+	}
+
+	stop, err := start_profiling(*cpuprofile, *memprofile)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	var resized func(done, total int) = nil
+	if *progress {
+		resized = func(done, total int) {
+			fmt.Fprintf(os.Stderr, "\rresizing: %d/%d", done, total)
+			if done == total {
+				fmt.Fprintln(os.Stderr)
+			}
 		}
 	}
 
-	if args[2] == "get" && len(args) == 4 {
-		if n := get(ptr, args[3]); n != nil {
+	if args[1] == "get" && len(args) == 3 {
+		if n := get(ptr, args[2]); n != nil {
 			fmt.Println(*n)
 		} else {
-			fmt.Println("No value found for", args[3])
+			fmt.Println("No value found for", args[2])
+		}
+	} else if args[1] == "put" && len(args) == 4 {
+		n, err := strconv.Atoi(args[3])
+		if err != nil {
+			return err
+		}
+		return put_progress(ptr, args[2], n, resized)
+	} else if args[1] == "del" && len(args) == 3 {
+		if !del(ptr, args[2]) {
+			fmt.Println("No value found for", args[2])
+		}
+	} else if args[1] == "incr" && len(args) == 4 {
+		n, err := strconv.Atoi(args[3])
+		if err != nil {
+			return err
+		}
+		v, err := incr(ptr, args[2], n)
+		if err != nil {
+			return err
+		}
+		fmt.Println(v)
+	} else if args[1] == "transfer" && len(args) == 5 {
+		n, err := strconv.Atoi(args[4])
+		if err != nil {
+			return err
+		}
+		return transfer(ptr, args[2], args[3], n)
+	} else if args[1] == "getb" && len(args) == 3 {
+		if v := get_blob(ptr, args[2]); v != nil {
+			fmt.Println(hex.EncodeToString(v))
+		} else {
+			fmt.Println("No value found for", args[2])
 		}
-	} else if args[2] == "put" && len(args) == 5 {
-		if n, err := strconv.Atoi(args[4]); err == nil {
-			put(ptr, args[3], n)
+	} else if args[1] == "putb" && len(args) == 4 {
+		v, err := hex.DecodeString(args[3])
+		if err != nil {
+			return usage_error(err.Error())
 		}
-	} else if args[2] == "burst" && args[3] =="get" && len(args) == 5 {
-		if m, err := strconv.Atoi(args[4]); err == nil {
-			var v *int
-			for i := 0; i < m; i++ {
-				key := fmt.Sprintf("key%d", i);
-				v = get(ptr, key)
+		return put_blob(ptr, args[2], v)
+	} else if args[1] == "snapshot" && len(args) == 3 {
+		return snapshot(ptr, args[2])
+	} else if args[1] == "list" && len(args) == 2 {
+		foreach_insertion_order(ptr, func(key string, val int) bool {
+			fmt.Println(key, val)
+			return false
+		})
+	} else if args[1] == "fingerprint" && len(args) == 2 {
+		fmt.Printf("%016x\n", fingerprint(ptr))
+	} else if args[1] == "export" && len(args) == 2 {
+		return export_json(ptr, os.Stdout)
+	} else if args[1] == "import" && len(args) == 2 {
+		return import_json(ptr, os.Stdin, resized)
+	} else if args[1] == "clone" && len(args) == 3 {
+		return clone(ptr, args[2])
+	} else if args[1] == "restore" && len(args) == 2 {
+		// the receiving end of clone
+		return read_image(ptr, os.Stdin)
+	} else if args[1] == "replay" && len(args) == 3 {
+		stopped := false
+		err := replay_file(args[2], *speedup, func(args []string) error {
+			if is_interrupted() {
+				stopped = true
+				return ErrInterrupted
 			}
-			if v != nil {
-				fmt.Println("v =", *v)
+			return replay_command(ptr, args)
+		})
+		if stopped {
+			return ErrInterrupted
+		}
+		return err
+	} else if args[1] == "burst" && len(args) == 4 && args[2] == "get" {
+		m, err := strconv.Atoi(args[3])
+		if err != nil {
+			return err
+		}
+		var v *int
+		for i := 0; i < m; i++ {
+			if is_interrupted() {
+				return ErrInterrupted
 			}
+			key := fmt.Sprintf("key%d", i);
+			v = get(ptr, key)
+		}
+		if v != nil {
+			fmt.Println("v =", *v)
 		}
-    } else if args[2] == "burst" && args[3] == "put" && len(args) == 5 {
-		if m, err := strconv.Atoi(args[4]); err == nil {
-			for i := 0; i < m; i++ {
-				key := fmt.Sprintf("key%d", i);
-				put(ptr, key, i);
+	} else if args[1] == "burst" && len(args) == 4 && args[2] == "put" {
+		m, err := strconv.Atoi(args[3])
+		if err != nil {
+			return err
+		}
+		for i := 0; i < m; i++ {
+			if is_interrupted() {
+				return ErrInterrupted
+			}
+			key := fmt.Sprintf("key%d", i);
+			if err := put(ptr, key, i); err != nil {
+				return err
 			}
 		}
-    } else {
-        show_usage(args[0]);
-    }
+	} else {
+		return ErrUsage
+	}
+	return nil
 }
 
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		show_usage(os.Args[0])
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
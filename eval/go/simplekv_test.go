@@ -0,0 +1,1086 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/vmware/go-pmem-transaction/pmem"
+)
+
+// The tests share one pool, as go-pmem maps a single pool per process, and
+// make their stores in it with new_store; a step of AssertDurable opens its
+// own pool instead, and a process started by test_program runs simplekv.
+func TestMain(m *testing.M) {
+	if is_test_program() {
+		main()
+	}
+	pool := durable_pool()
+	temporary := pool == ""
+	if temporary {
+		pool = filepath.Join(os.TempDir(), fmt.Sprintf("simplekv_test.%d.pool", os.Getpid()))
+	}
+	pmem.Init(pool)
+	status := m.Run()
+	if temporary {
+		os.Remove(pool)
+	}
+	os.Exit(status)
+}
+
+var modes = []struct {
+	name string
+	mode int
+}{
+	{"chaining", MODE_CHAINING},
+	{"probing", MODE_PROBING},
+}
+
+// new_store returns a new empty store with no blob values.
+func new_store(mode int) *data {
+	var ptr *data
+	txn("undo") {
+		ptr = pnew(data)
+	}
+	initialize(ptr, 0, mode)
+	return ptr
+}
+
+// check_store fails the test unless the store holds its invariants and
+// exactly the pairs of want.
+func check_store(t *testing.T, ptr *data, want map[string]int) {
+	t.Helper()
+	if ptr.mode == MODE_PROBING {
+		if err := validate_slots(ptr); err != nil {
+			t.Fatal("slots:", err)
+		}
+	}
+	live, err := validate_pairs(ptr)
+	if err != nil {
+		t.Fatal("keys:", err)
+	}
+	if err := validate_links(ptr, live); err != nil {
+		t.Fatal("insertion order:", err)
+	}
+	n := 0
+	foreach_pair(ptr, func(e pair) bool {
+		key, value := key_string(e.key), ptr.values.Get(e.idx)
+		if v, ok := want[key]; !ok || v != value {
+			t.Fatalf("key %q holds %d, want %d (%v)", key, value, v, ok)
+		}
+		n++
+		return false
+	})
+	if n != len(want) {
+		t.Fatalf("%d keys, want %d", n, len(want))
+	}
+}
+
+// Run rejects malformed command lines, before opening any pool, with errors
+// mapped to the usage exit status.
+func TestRunErrors(t *testing.T) {
+	missing := filepath.Join(os.TempDir(), "simplekv_test.missing.pool")
+	tests := []struct {
+		args   []string
+		status int
+	}{
+		{[]string{}, EXIT_USAGE},
+		{[]string{"pool"}, EXIT_USAGE},
+		{[]string{"-nosuchflag", "pool", "get", "k"}, EXIT_USAGE},
+		{[]string{"-width", "-1", "pool", "get", "k"}, EXIT_USAGE},
+		{[]string{"-mode", "tree", "pool", "get", "k"}, EXIT_USAGE},
+		{[]string{"pool", "validate", "extra"}, EXIT_USAGE},
+		{[]string{missing, "validate"}, EXIT_POOL},
+	}
+	for _, tc := range tests {
+		err := Run(tc.args)
+		if err == nil {
+			t.Errorf("%q: no error", tc.args)
+		} else if status := exit_status(err); status != tc.status {
+			t.Errorf("%q: %v, exit status %d, want %d", tc.args, err, status, tc.status)
+		}
+	}
+	if err := Run([]string{"-mode", "tree", "pool", "get", "k"}); err != usage_error("invalid collision resolution 'tree'") {
+		t.Errorf("invalid mode: %v", err)
+	}
+}
+
+func TestLongKey(t *testing.T) {
+	long := "0123456789abcdef0123456789abcdef"
+	for _, m := range modes {
+		ptr := new_store(m.mode)
+		if err := put(ptr, long + "!", 1); err != ErrKeyTooLong {
+			t.Fatalf("%s: put of a 33-byte key: %v, want ErrKeyTooLong", m.name, err)
+		}
+		if err := put_bytes(ptr, []byte(long + "!"), 1); err != ErrKeyTooLong {
+			t.Fatalf("%s: put_bytes of a 33-byte key: %v, want ErrKeyTooLong", m.name, err)
+		}
+		want := map[string]int{long: 32}
+		if err := put(ptr, long, 32); err != nil {
+			t.Fatal(err)
+		}
+		if get(ptr, long + "!") != nil {
+			t.Fatalf("%s: a longer key finds the value of its prefix", m.name)
+		}
+		/* enough keys for the probing table to be resized a few times */
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key%d", i)
+			if err := put(ptr, key, i); err != nil {
+				t.Fatal(err)
+			}
+			want[key] = i
+		}
+		check_store(t, ptr, want)
+
+		buf := []byte("key7")
+		if n := testing.AllocsPerRun(100, func() { get_bytes(ptr, buf) }); n != 0 {
+			t.Errorf("%s: get_bytes makes %v allocations", m.name, n)
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	ptr := new_store(MODE_CHAINING)
+	put(ptr, "a", 10)
+	put(ptr, "b", 0)
+	if err := transfer(ptr, "a", "b", 4); err != nil {
+		t.Fatal(err)
+	}
+	for _, amount := range []int{7, -5} {
+		if err := transfer(ptr, "a", "b", amount); err == nil {
+			t.Errorf("a transfer of %d from 6 went through", amount)
+		}
+	}
+	if err := transfer(ptr, "b", "a", -1); err == nil {
+		t.Error("a negative transfer went through")
+	}
+	check_store(t, ptr, map[string]int{"a": 6, "b": 4})
+}
+
+// store_entries returns the pairs of the store in insertion order, one
+// "key value" string each.
+func store_entries(ptr *data) []string {
+	entries := []string{}
+	foreach_insertion_order(ptr, func(key string, value int) bool {
+		entries = append(entries, fmt.Sprint(key, value))
+		return false
+	})
+	return entries
+}
+
+// A store resized by puts and then shrunk by deletions survives a reopen,
+// insertion order included.
+func TestDurableRehash(t *testing.T) {
+	for _, m := range modes {
+		t.Run(m.name, func(t *testing.T) {
+			AssertDurable(t, func() []string {
+				var ptr *data
+				ptr = (*data)(pmem.New("root", ptr))
+				initialize(ptr, 0, m.mode)
+				for i := 0; i < 200; i++ {
+					put(ptr, fmt.Sprintf("key%d", i), i)
+				}
+				for i := 0; i < 200; i += 3 {
+					del(ptr, fmt.Sprintf("key%d", i))
+				}
+				return store_entries(ptr)
+			}, func() []string {
+				var ptr *data
+				ptr = (*data)(pmem.Get("root", ptr))
+				live, err := validate_pairs(ptr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := validate_links(ptr, live); err != nil {
+					t.Fatal(err)
+				}
+				return store_entries(ptr)
+			})
+		})
+	}
+}
+
+// A resize reports its progress for every bucket it moves to a larger one:
+// every slot of an open addressing table, and every bucket of a chaining
+// table which grows. An import and a put report to the callback they are
+// given, and the other mutators to none.
+func TestResizeProgress(t *testing.T) {
+	for _, m := range modes {
+		t.Run(m.name, func(t *testing.T) {
+			ptr := new_store(m.mode)
+			for i := 0; i < 400; i++ {
+				put(ptr, fmt.Sprintf("key%d", i), i)
+			}
+			slots := len(ptr.slots)
+			var caps [N]int
+			for i := range ptr.buckets {
+				caps[i] = cap(ptr.buckets[i])
+			}
+
+			var done []int
+			total := 0
+			progress := func(d int, t int) {
+				done = append(done, d)
+				total = t
+			}
+			var json strings.Builder
+			json.WriteString("{")
+			for i := 400; i < 2000; i++ {
+				if i > 400 {
+					json.WriteString(",")
+				}
+				fmt.Fprintf(&json, "\"key%d\":%d", i, i)
+			}
+			json.WriteString("}")
+			if err := import_json(ptr, strings.NewReader(json.String()), progress); err != nil {
+				t.Fatal(err)
+			}
+
+			want := slots
+			if m.mode == MODE_CHAINING {
+				want = 0
+				for i := range ptr.buckets {
+					if cap(ptr.buckets[i]) != caps[i] {
+						want++
+					}
+				}
+			}
+			if want == 0 || total != want || len(done) != want {
+				t.Fatalf("%d reports of %d buckets, want %d", len(done), total, want)
+			}
+			for i, d := range done {
+				if d != i + 1 {
+					t.Fatalf("report %d says %d buckets are done", i, d)
+				}
+			}
+
+			/* put the keys until one of them takes a resize */
+			done = done[:0]
+			for i := 2000; len(done) == 0; i++ {
+				if err := put_progress(ptr, fmt.Sprintf("key%d", i), i, progress); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if done[len(done) - 1] != total {
+				t.Fatalf("the resize of a put reports %d of %d buckets done",
+					done[len(done) - 1], total)
+			}
+		})
+	}
+}
+
+// vec_elems returns the elements of v, one string each.
+func vec_elems(v *PVec) []string {
+	elems := []string{}
+	for i := 0; i < v.Len(); i++ {
+		elems = append(elems, fmt.Sprint(v.Get(i)))
+	}
+	return elems
+}
+
+// Pushed elements are read back and replaced in place, and the capacity
+// doubles each time a push finds the vector full.
+func TestPVec(t *testing.T) {
+	v := &new_store(MODE_CHAINING).values
+	for i := 0; i < 100; i++ {
+		c := cap(v.elems)
+		if err := v.Push(i * 10); err != nil {
+			t.Fatal(err)
+		}
+		want := c
+		if i == c {
+			want = grow_cap(c, c + 1)
+		}
+		if v.Len() != i + 1 || cap(v.elems) != want {
+			t.Fatalf("push %d: length %d, capacity %d, want %d, %d",
+				i, v.Len(), cap(v.elems), i + 1, want)
+		}
+	}
+	if cap(v.elems) != 128 {
+		t.Fatalf("capacity %d after 100 pushes, want 128", cap(v.elems))
+	}
+	for i := 0; i < 100; i += 3 {
+		v.Set(i, -i)
+	}
+	for i := 0; i < 100; i++ {
+		want := i * 10
+		if i % 3 == 0 {
+			want = -i
+		}
+		if v.Get(i) != want {
+			t.Fatalf("element %d is %d, want %d", i, v.Get(i), want)
+		}
+	}
+}
+
+// A crash in the middle of a push which moves the vector to a larger backing
+// array leaves it as it was before the push once the pool is reopened.
+func TestDurablePush(t *testing.T) {
+	switch durable_step() {
+	case "build":
+		var ptr *data
+		ptr = (*data)(pmem.New("root", ptr))
+		initialize(ptr, 0, MODE_CHAINING)
+		for i := 0; i < 8; i++ {
+			if err := ptr.values.Push(i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		step_done(t, vec_elems(&ptr.values))
+		return
+	case "crash":
+		var ptr *data
+		ptr = (*data)(pmem.Get("root", ptr))
+		step_done(t, vec_elems(&ptr.values))
+		/* the push and its copy join this transaction, which never ends */
+		txn("undo") {
+			if err := ptr.values.Push(8); err != nil {
+				t.Fatal(err)
+			}
+			os.Exit(0)
+		}
+		return
+	case "verify":
+		var ptr *data
+		ptr = (*data)(pmem.Get("root", ptr))
+		step_done(t, vec_elems(&ptr.values))
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "durable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pool := filepath.Join(dir, "durable.pool")
+	want := in_pool(t, pool, "build")
+	if got := in_pool(t, pool, "crash"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("before the crash the vector holds %q, want %q", got, want)
+	}
+	if got := in_pool(t, pool, "verify"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("after the crash the vector holds %q, want %q", got, want)
+	}
+}
+
+// Increments of a counter from many goroutines, which the store lock
+// serializes, add up to the total of the deltas; the first one creates the
+// counter.
+func TestIncr(t *testing.T) {
+	for _, m := range modes {
+		ptr := new_store(m.mode)
+		var wg sync.WaitGroup
+		for g := 1; g <= 8; g++ {
+			wg.Add(1)
+			go func(delta int) {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					if _, err := incr(ptr, "counter", delta); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+		/* 100 increments by each of 1 to 8 */
+		check_store(t, ptr, map[string]int{"counter": 3600})
+		if v, err := incr(ptr, "counter", -600); err != nil || v != 3000 {
+			t.Fatalf("%s: incr returned %d (%v), want 3000", m.name, v, err)
+		}
+	}
+}
+
+// A store exported to JSON, emptied by deleting every key and imported back
+// holds what it held before the export.
+func TestJSONRoundTrip(t *testing.T) {
+	for _, m := range modes {
+		ptr := new_store(m.mode)
+		want := map[string]int{}
+		for i := 0; i < 300; i++ {
+			key := fmt.Sprintf("key%d", i)
+			put(ptr, key, i - 150)
+			want[key] = i - 150
+		}
+		var buf bytes.Buffer
+		if err := export_json(ptr, &buf); err != nil {
+			t.Fatal(err)
+		}
+		exported := buf.String()
+		for key := range want {
+			if !del(ptr, key) {
+				t.Fatalf("%s: del %s found nothing", m.name, key)
+			}
+		}
+		check_store(t, ptr, map[string]int{})
+
+		if err := import_json(ptr, strings.NewReader(exported), nil); err != nil {
+			t.Fatal(err)
+		}
+		check_store(t, ptr, want)
+		buf.Reset()
+		if err := export_json(ptr, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != exported {
+			t.Fatalf("%s: export after the import differs:\n%s\nwant\n%s", m.name, buf.String(), exported)
+		}
+	}
+}
+
+// blob_entries returns the pairs of the store in insertion order, one
+// "key value blob" string each with the blob value in hex.
+func blob_entries(ptr *data) []string {
+	entries := []string{}
+	foreach_insertion_order(ptr, func(key string, value int) bool {
+		entries = append(entries, fmt.Sprintf("%s %d %x", key, value, get_blob(ptr, key)))
+		return false
+	})
+	return entries
+}
+
+// 16-byte blob values are read back as written, next to the int values, and
+// survive a reopen, which only accepts the width the store was created with.
+func TestDurableBlobs(t *testing.T) {
+	for _, m := range modes {
+		t.Run(m.name, func(t *testing.T) {
+			AssertDurable(t, func() []string {
+				var ptr *data
+				ptr = (*data)(pmem.New("root", ptr))
+				initialize(ptr, 16, m.mode)
+				for i := 0; i < 100; i++ {
+					key := fmt.Sprintf("key%d", i)
+					blob := bytes.Repeat([]byte{byte(i)}, 16)
+					blob[0] = 0xff
+					if err := put_blob(ptr, key, blob); err != nil {
+						t.Fatal(err)
+					}
+					if got := get_blob(ptr, key); !bytes.Equal(got, blob) {
+						t.Fatalf("blob of %s is %x, want %x", key, got, blob)
+					}
+					if i % 2 == 0 {
+						put(ptr, key, i)
+					}
+				}
+				if err := put_blob(ptr, "short", make([]byte, 8)); err == nil {
+					t.Fatal("an 8-byte blob went into a 16-byte store")
+				}
+				if get_blob(ptr, "missing") != nil {
+					t.Fatal("a missing key has a blob")
+				}
+				return blob_entries(ptr)
+			}, func() []string {
+				var ptr *data
+				ptr = (*data)(pmem.Get("root", ptr))
+				for _, width := range []int{0, 16} {
+					if err := check_width(ptr, "pool", width); err != nil {
+						t.Fatalf("-width %d: %v", width, err)
+					}
+				}
+				err := check_width(ptr, "pool", 8)
+				if err == nil || !strings.Contains(err.Error(), "value width mismatch") {
+					t.Fatalf("-width 8: %v, want a value width mismatch", err)
+				}
+				return blob_entries(ptr)
+			})
+		})
+	}
+}
+
+// A snapshot made by a child simplekv holds the keys and values of the store,
+// and a store with blob values, which the snapshot would drop, is refused.
+func TestSnapshot(t *testing.T) {
+	defer func(saved func(...string) (*exec.Cmd, error)) { program_command = saved }(program_command)
+	program_command = test_program
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, m := range modes {
+		ptr := new_store(m.mode)
+		for i := 0; i < 300; i++ {
+			put(ptr, fmt.Sprintf("key%d", i), i)
+		}
+		for i := 0; i < 300; i += 7 {
+			del(ptr, fmt.Sprintf("key%d", i))
+		}
+		dest := filepath.Join(dir, m.name + ".pool")
+		if err := snapshot(ptr, dest); err != nil {
+			t.Fatalf("%s: %v", m.name, err)
+		}
+		if err := snapshot(ptr, dest); err == nil {
+			t.Fatalf("%s: a snapshot overwrote %s", m.name, dest)
+		}
+
+		var want bytes.Buffer
+		if err := export_json(ptr, &want); err != nil {
+			t.Fatal(err)
+		}
+		cmd, err := test_program(dest, "export")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: export of the snapshot: %v", m.name, err)
+		}
+		if string(got) != want.String() {
+			t.Fatalf("%s: the snapshot holds\n%s\nwant\n%s", m.name, got, want.String())
+		}
+		if cmd, err = test_program(dest, "validate"); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s: validate of the snapshot: %v\n%s", m.name, err, out)
+		}
+	}
+
+	var ptr *data
+	txn("undo") {
+		ptr = pnew(data)
+	}
+	initialize(ptr, 16, MODE_CHAINING)
+	if err := put_blob(ptr, "key", make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "blobs.pool")
+	if err := snapshot(ptr, dest); err == nil {
+		t.Fatal("a store with blob values was snapshot")
+	}
+	if _, err := os.Stat(dest); err == nil {
+		t.Fatalf("%s was created", dest)
+	}
+}
+
+// A snapshot taken while a writer keeps moving an amount from one key to
+// another and adding keys is the store between two of its writes: the two
+// keys hold the whole amount, and the keys added are the first ones of the
+// writer.
+func TestSnapshotWriter(t *testing.T) {
+	defer func(saved func(...string) (*exec.Cmd, error)) { program_command = saved }(program_command)
+	program_command = test_program
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const total = 1 << 40
+	for _, m := range modes {
+		ptr := new_store(m.mode)
+		put(ptr, "from", total)
+		put(ptr, "to", 0)
+
+		started, stop := make(chan bool), make(chan bool)
+		errs := make(chan error, 1)
+		go func() {
+			for i := 0; ; i++ {
+				if i == 100 {
+					close(started)
+				}
+				select {
+				case <-stop:
+					errs <- nil
+					return
+				default:
+				}
+				err := transfer(ptr, "from", "to", 1)
+				if err == nil {
+					err = put(ptr, fmt.Sprintf("key%d", i), i)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+		select {
+		case <-started:
+		case err := <-errs:
+			t.Fatal(err)
+		}
+		dest := filepath.Join(dir, m.name + ".pool")
+		err := snapshot(ptr, dest)
+		close(stop)
+		if err != nil {
+			t.Fatalf("%s: %v", m.name, err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+
+		cmd, err := test_program(dest, "export")
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: export of the snapshot: %v", m.name, err)
+		}
+		var got map[string]int
+		if err := json.Unmarshal(out, &got); err != nil {
+			t.Fatalf("%s: %v\n%s", m.name, err, out)
+		}
+		if got["from"] + got["to"] != total {
+			t.Fatalf("%s: the snapshot holds %d and %d, %d in all, want %d", m.name,
+				got["from"], got["to"], got["from"] + got["to"], total)
+		}
+		added := len(got) - 2
+		for i := 0; i < added; i++ {
+			if v, ok := got[fmt.Sprintf("key%d", i)]; !ok || v != i {
+				t.Fatalf("%s: %d keys added, but key%d holds %d (%v)", m.name, added, i, v, ok)
+			}
+		}
+		if got["to"] < added || got["to"] > added + 1 {
+			t.Fatalf("%s: %d moved for %d keys added", m.name, got["to"], added)
+		}
+	}
+}
+
+// A clone made by a child simplekv has the layout of the store, arrays and
+// blob values included, and so the same entries; an existing pool is not
+// overwritten.
+func TestClone(t *testing.T) {
+	if durable_step() == "image" {
+		var ptr *data
+		ptr = (*data)(pmem.Get("root", ptr))
+		var image bytes.Buffer
+		if err := write_image(ptr, &image); err != nil {
+			t.Fatal(err)
+		}
+		step_done(t, append([]string{hex.EncodeToString(image.Bytes())}, store_entries(ptr)...))
+		return
+	}
+
+	defer func(saved func(...string) (*exec.Cmd, error)) { program_command = saved }(program_command)
+	program_command = test_program
+	dir, err := ioutil.TempDir("", "clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, m := range modes {
+		for _, width := range []int{0, 16} {
+			var ptr *data
+			txn("undo") {
+				ptr = pnew(data)
+			}
+			initialize(ptr, width, m.mode)
+			for i := 0; i < 300; i++ {
+				key := fmt.Sprintf("key%d", i)
+				if width > 0 {
+					put_blob(ptr, key, bytes.Repeat([]byte{byte(i)}, width))
+				}
+				put(ptr, key, i)
+			}
+			for i := 0; i < 300; i += 7 {
+				del(ptr, fmt.Sprintf("key%d", i))
+			}
+			var image bytes.Buffer
+			if err := write_image(ptr, &image); err != nil {
+				t.Fatal(err)
+			}
+			want := append([]string{hex.EncodeToString(image.Bytes())}, store_entries(ptr)...)
+
+			dest := filepath.Join(dir, fmt.Sprint(m.name, width, ".pool"))
+			if err := clone(ptr, dest); err != nil {
+				t.Fatalf("%s, width %d: %v", m.name, width, err)
+			}
+			if err := clone(ptr, dest); err == nil {
+				t.Fatalf("%s, width %d: a clone overwrote %s", m.name, width, dest)
+			}
+			got := in_pool(t, dest, "image")
+			if got[0] != want[0] {
+				t.Errorf("%s, width %d: the clone has another layout", m.name, width)
+			}
+			if !reflect.DeepEqual(got[1:], want[1:]) {
+				t.Errorf("%s, width %d: the clone holds %q, want %q", m.name, width, got[1:], want[1:])
+			}
+		}
+	}
+}
+
+// A put or incr which needs more room than the pool has returns ErrPoolFull
+// and leaves the store as it was. go-pmem has no pool size to make small, so
+// the store has blob values larger than the heap can hold instead, which the
+// runtime fails to allocate as it would a pool with no room left.
+func TestPutPoolFull(t *testing.T) {
+	for _, m := range modes {
+		var ptr *data
+		txn("undo") {
+			ptr = pnew(data)
+		}
+		initialize(ptr, 1 << 50, m.mode)
+		if err := put(ptr, "key", 1); err != ErrPoolFull {
+			t.Fatalf("%s: put: %v, want ErrPoolFull", m.name, err)
+		}
+		if _, err := incr(ptr, "key", 1); err != ErrPoolFull {
+			t.Fatalf("%s: incr of a new key: %v, want ErrPoolFull", m.name, err)
+		}
+		if ptr.values.Len() != 0 || len(ptr.links) != 0 || len(ptr.blobs) != 0 {
+			t.Fatalf("%s: %d values, %d links and %d blob bytes, want none",
+				m.name, ptr.values.Len(), len(ptr.links), len(ptr.blobs))
+		}
+		check_store(t, ptr, map[string]int{})
+	}
+}
+
+// A pool holding a store of an older layout is refused, by the commands and
+// by validate, and left as it is instead of being initialized again.
+func TestOldLayout(t *testing.T) {
+	switch durable_step() {
+	case "build":
+		var ptr *data
+		ptr = (*data)(pmem.New("root", ptr))
+		initialize(ptr, 0, MODE_CHAINING)
+		put(ptr, "key", 1)
+		txn("undo") {
+			ptr.magic = old_magic
+		}
+		step_done(t, store_entries(ptr))
+		return
+	case "verify":
+		var ptr *data
+		ptr = (*data)(pmem.Get("root", ptr))
+		if ptr.magic != old_magic {
+			t.Fatalf("magic %#x, want %#x", ptr.magic, old_magic)
+		}
+		step_done(t, store_entries(ptr))
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pool := filepath.Join(dir, "layout.pool")
+	want := in_pool(t, pool, "build")
+	for _, args := range [][]string{{pool, "put", "key", "2"}, {pool, "validate"}} {
+		cmd, err := test_program(args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := cmd.CombinedOutput()
+		if status := exit_code(t, err); status != EXIT_POOL {
+			t.Errorf("%q: exit status %d, want %d\n%s", args, status, EXIT_POOL, out)
+		} else if !strings.Contains(string(out), "older simplekv") {
+			t.Errorf("%q: the layout goes unreported:\n%s", args, out)
+		}
+	}
+	if got := in_pool(t, pool, "verify"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("the store holds %q, want %q", got, want)
+	}
+}
+
+// A walk over the keys visits every one once, and stops at the first one
+// for which the callback returns true, which it reports.
+func TestForeachBreak(t *testing.T) {
+	for _, m := range modes {
+		ptr := new_store(m.mode)
+		want := map[string]int{}
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%d", i)
+			put(ptr, key, i)
+			want[key] = i
+		}
+		seen := map[string]int{}
+		if foreach_pair(ptr, func(e pair) bool {
+			seen[key_string(e.key)] = ptr.values.Get(e.idx)
+			return false
+		}) {
+			t.Fatalf("%s: a full walk reports a stop", m.name)
+		}
+		if !reflect.DeepEqual(seen, want) {
+			t.Fatalf("%s: the walk visits %v, want %v", m.name, seen, want)
+		}
+
+		for _, stop := range []int{1, 50, 100} {
+			n := 0
+			if !foreach_pair(ptr, func(e pair) bool {
+				n++
+				return n == stop
+			}) || n != stop {
+				t.Fatalf("%s: stop at key %d: %d keys visited", m.name, stop, n)
+			}
+			n = 0
+			if !foreach_insertion_order(ptr, func(key string, value int) bool {
+				n++
+				return n == stop
+			}) || n != stop {
+				t.Fatalf("%s: stop at key %d in insertion order: %d keys visited", m.name, stop, n)
+			}
+		}
+	}
+}
+
+// The iterator of simplekv_all yields every key once with its value, and is
+// not called again once yield returns false.
+func TestAll(t *testing.T) {
+	for _, m := range modes {
+		ptr := new_store(m.mode)
+		simplekv_all(ptr)(func(key string, value int) bool {
+			t.Fatalf("%s: an empty store yields %s", m.name, key)
+			return true
+		})
+		want := map[string]int{}
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%d", i)
+			put(ptr, key, i)
+			want[key] = i
+		}
+		seen := map[string]int{}
+		simplekv_all(ptr)(func(key string, value int) bool {
+			if _, ok := seen[key]; ok {
+				t.Fatalf("%s: %s yielded twice", m.name, key)
+			}
+			seen[key] = value
+			return true
+		})
+		if !reflect.DeepEqual(seen, want) {
+			t.Fatalf("%s: the iterator yields %v, want %v", m.name, seen, want)
+		}
+
+		for _, stop := range []int{1, 50, 100} {
+			n := 0
+			simplekv_all(ptr)(func(key string, value int) bool {
+				n++
+				return n != stop
+			})
+			if n != stop {
+				t.Fatalf("%s: stop at key %d: %d keys yielded", m.name, stop, n)
+			}
+		}
+	}
+}
+
+// The insertion order skips a key deleted from its middle, is unchanged by
+// an update, and gets a key put back after a deletion at its end.
+func TestInsertionOrder(t *testing.T) {
+	for _, m := range modes {
+		ptr := new_store(m.mode)
+		for i, key := range []string{"e", "a", "d", "b", "c"} {
+			put(ptr, key, i)
+		}
+		del(ptr, "d")
+		put(ptr, "a", 10)
+		want := []string{"e0", "a10", "b3", "c4"}
+		if got := store_entries(ptr); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: order %q, want %q", m.name, got, want)
+		}
+		put(ptr, "d", 5)
+		del(ptr, "e")
+		want = []string{"a10", "b3", "c4", "d5"}
+		if got := store_entries(ptr); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: order %q, want %q", m.name, got, want)
+		}
+		check_store(t, ptr, map[string]int{"a": 10, "b": 3, "c": 4, "d": 5})
+	}
+}
+
+// Stores with the same content have the same fingerprint, whatever the order
+// of their inserts, the deletions in between and the collision scheme, and
+// stores with another content a different one.
+func TestFingerprint(t *testing.T) {
+	build := func(mode int, keys []int, deleted int) *data {
+		ptr := new_store(mode)
+		for _, i := range keys {
+			put(ptr, fmt.Sprintf("key%d", i), i)
+		}
+		for i := 0; i < deleted; i++ {
+			put(ptr, fmt.Sprintf("gone%d", i), i)
+		}
+		for i := 0; i < deleted; i++ {
+			del(ptr, fmt.Sprintf("gone%d", i))
+		}
+		return ptr
+	}
+	var up, down []int
+	for i := 0; i < 200; i++ {
+		up = append(up, i)
+		down = append(down, 199 - i)
+	}
+	want := fingerprint(build(MODE_CHAINING, up, 0))
+	for _, m := range modes {
+		if got := fingerprint(build(m.mode, up, 0)); got != want {
+			t.Errorf("%s: fingerprint %016x, want %016x", m.name, got, want)
+		}
+		if got := fingerprint(build(m.mode, down, 50)); got != want {
+			t.Errorf("%s, reverse order: fingerprint %016x, want %016x", m.name, got, want)
+		}
+
+		ptr := build(m.mode, down, 0)
+		put(ptr, "key7", 8)
+		if fingerprint(ptr) == want {
+			t.Errorf("%s: another value, same fingerprint", m.name)
+		}
+		if fingerprint(build(m.mode, down[1:], 0)) == want {
+			t.Errorf("%s: a key less, same fingerprint", m.name)
+		}
+	}
+}
+
+// get_bytes and get agree on every key, missing and too long ones included,
+// whether it was put as a string or as bytes.
+func TestGetBytes(t *testing.T) {
+	long := strings.Repeat("k", 32)
+	for _, m := range modes {
+		ptr := new_store(m.mode)
+		want := map[string]int{long: 32, "": -1}
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%d", i)
+			want[key] = i
+			var err error
+			if i % 2 == 0 {
+				err = put(ptr, key, i)
+			} else {
+				err = put_bytes(ptr, []byte(key), i)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		put_bytes(ptr, []byte(long), 32)
+		put(ptr, "", -1)
+		if err := put_bytes(ptr, []byte(long + "k"), 33); err != ErrKeyTooLong {
+			t.Fatalf("%s: put_bytes of 33 bytes: %v, want ErrKeyTooLong", m.name, err)
+		}
+
+		keys := []string{"", long, long + "k", "key", "key100"}
+		for i := 0; i < 100; i++ {
+			keys = append(keys, fmt.Sprintf("key%d", i))
+		}
+		for _, key := range keys {
+			value, found := 0, false
+			if v := get(ptr, key); v != nil {
+				value, found = *v, true
+			}
+			if got, ok := get_bytes(ptr, []byte(key)); got != value || ok != found {
+				t.Errorf("%s: get_bytes %q: %d %v, get: %d %v", m.name, key, got, ok, value, found)
+			}
+		}
+		check_store(t, ptr, want)
+
+		buf := []byte("key7")
+		if n := testing.AllocsPerRun(100, func() { get_bytes(ptr, buf) }); n != 0 {
+			t.Errorf("%s: get_bytes makes %v allocations", m.name, n)
+		}
+	}
+}
+
+// request_key returns the key of a request "get key" read into buf, as the
+// parser of a server hands it over. It is kept out of line, as such a parser
+// is, so the string it returns is on the heap.
+//go:noinline
+func request_key(buf []byte) string {
+	return string(buf[4:])
+}
+
+// request_key_bytes is request_key returning the key in buf.
+//go:noinline
+func request_key_bytes(buf []byte) []byte {
+	return buf[4:]
+}
+
+// Lookups of the keys of requests read into byte buffers, handed over as
+// strings to get and as bytes to get_bytes.
+func BenchmarkGetBytes(b *testing.B) {
+	ptr := new_store(MODE_CHAINING)
+	var bufs [][]byte
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		put(ptr, key, i)
+		bufs = append(bufs, []byte("get " + key))
+	}
+	b.Run("get", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if get(ptr, request_key(bufs[i % len(bufs)])) == nil {
+				b.Fatal("missing key")
+			}
+		}
+	})
+	b.Run("get_bytes", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, ok := get_bytes(ptr, request_key_bytes(bufs[i % len(bufs)])); !ok {
+				b.Fatal("missing key")
+			}
+		}
+	})
+}
+
+// validate passes a healthy store, and fails a store with a key renamed in
+// place, saying which check failed.
+func TestValidate(t *testing.T) {
+	if durable_step() == "corrupt" {
+		var ptr *data
+		ptr = (*data)(pmem.Get("root", ptr))
+		txn("undo") {
+			if ptr.mode == MODE_CHAINING {
+				for b := range ptr.buckets {
+					if len(ptr.buckets[b]) > 0 {
+						ptr.buckets[b][0].key[0] = 'K'
+						break
+					}
+				}
+			} else {
+				for j := range ptr.slots {
+					if ptr.slots[j].state == SLOT_USED {
+						ptr.slots[j].key[0] = 'K'
+						break
+					}
+				}
+			}
+		}
+		step_done(t, nil)
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	run := func(args ...string) (int, string) {
+		cmd, err := test_program(args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := cmd.CombinedOutput()
+		return exit_code(t, err), string(out)
+	}
+	for _, mode := range []string{"chain", "probe"} {
+		pool := filepath.Join(dir, mode + ".pool")
+		for i := 0; i < 20; i++ {
+			if status, out := run("-mode", mode, pool, "put", fmt.Sprint("k", i), fmt.Sprint(i)); status != EXIT_OK {
+				t.Fatalf("%s: put: exit status %d\n%s", mode, status, out)
+			}
+		}
+		if status, out := run(pool, "validate"); status != EXIT_OK || !strings.Contains(out, "keys: ok") {
+			t.Fatalf("%s: healthy store: exit status %d\n%s", mode, status, out)
+		}
+
+		in_pool(t, pool, "corrupt")
+		status, out := run(pool, "validate")
+		if status != EXIT_POOL {
+			t.Fatalf("%s: corrupted store: exit status %d, want %d\n%s", mode, status, EXIT_POOL, out)
+		}
+		for _, want := range []string{": FAILED, ", "failed validation"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("%s: corrupted store: %q missing from the report\n%s", mode, want, out)
+			}
+		}
+	}
+}
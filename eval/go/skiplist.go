@@ -0,0 +1,340 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* number of levels of the list, as in the pmemobj skiplist_map example */
+const SKIPLIST_LEVELS_NUM int = 4
+
+type entry struct {
+	key   int
+	value int
+}
+
+type node_t struct {
+	next  [SKIPLIST_LEVELS_NUM]*node_t
+	entry entry
+}
+
+type data struct {
+	head  node_t /* sentinel before the first node_t, holds no entry */
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x5C1B7A3E9D24F061
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.head = node_t{}
+		ptr.magic = magic
+	}
+}
+
+/*
+ * skiplist_map_find -- (internal) fills path with the last node_t before key
+ * at every level and returns the first node_t holding key, or nil
+ */
+func skiplist_map_find(ptr *data, key int,
+	path *[SKIPLIST_LEVELS_NUM]*node_t) *node_t {
+	active := &ptr.head
+	for level := SKIPLIST_LEVELS_NUM - 1; level >= 0; level-- {
+		for active.next[level] != nil && active.next[level].entry.key < key {
+			active = active.next[level]
+		}
+		path[level] = active
+	}
+	if next := active.next[0]; next != nil && next.entry.key == key {
+		return next
+	}
+	return nil
+}
+
+/*
+ * skiplist_map_insert_node -- (internal) links the new node_t after the path
+ * on the lowest level and, flipping a coin for each, on the levels above
+ */
+func skiplist_map_insert_node(node *node_t, path *[SKIPLIST_LEVELS_NUM]*node_t) {
+	level := 0
+	for {
+		node.next[level] = path[level].next[level]
+		path[level].next[level] = node
+		level++
+		if level == SKIPLIST_LEVELS_NUM || rand.Intn(2) != 0 {
+			break
+		}
+	}
+}
+
+/*
+ * skiplist_map_remove_node -- (internal) unlinks the node_t following the
+ * path from every level it is linked on
+ */
+func skiplist_map_remove_node(path *[SKIPLIST_LEVELS_NUM]*node_t) {
+	node := path[0].next[0]
+	for level := 0; level < SKIPLIST_LEVELS_NUM; level++ {
+		if path[level].next[level] == node {
+			path[level].next[level] = node.next[level]
+		}
+	}
+}
+
+/*
+ * skiplist_map_is_empty -- checks whether the list is empty
+ */
+func skiplist_map_is_empty(ptr *data) bool {
+	return ptr.head.next[0] == nil
+}
+
+/*
+ * skiplist_map_insert -- inserts a new key-value pair into the list, before
+ * any pairs with the same key, or returns ErrPoolFull
+ */
+func skiplist_map_insert(ptr *data, key int, value int) (err error) {
+	var path [SKIPLIST_LEVELS_NUM]*node_t
+	defer pool_full(&err)
+	txn("undo") {
+		node := pnew(node_t)
+		node.entry = entry{key, value}
+		skiplist_map_find(ptr, key, &path)
+		skiplist_map_insert_node(node, &path)
+	}
+	return nil
+}
+
+/*
+ * skiplist_map_remove -- removes the first pair holding key, returning its
+ * value and whether it was found
+ */
+func skiplist_map_remove(ptr *data, key int) (int, bool) {
+	var path [SKIPLIST_LEVELS_NUM]*node_t
+	node := skiplist_map_find(ptr, key, &path)
+	if node == nil {
+		return 0, false
+	}
+	txn("undo") {
+		skiplist_map_remove_node(&path)
+	}
+	return node.entry.value, true
+}
+
+/*
+ * skiplist_map_get -- searches for the value of the key
+ */
+func skiplist_map_get(ptr *data, key int) (int, bool) {
+	var path [SKIPLIST_LEVELS_NUM]*node_t
+	if node := skiplist_map_find(ptr, key, &path); node != nil {
+		return node.entry.value, true
+	}
+	return 0, false
+}
+
+/*
+ * skiplist_map_lookup -- checks if the key exists in the list
+ */
+func skiplist_map_lookup(ptr *data, key int) bool {
+	_, ok := skiplist_map_get(ptr, key)
+	return ok
+}
+
+/*
+ * skiplist_map_foreach -- calls cb for every pair in key order, stopping
+ * early when cb returns true
+ */
+func skiplist_map_foreach(ptr *data, cb func(int, int) bool) bool {
+	for node := ptr.head.next[0]; node != nil; node = node.next[0] {
+		if cb(node.entry.key, node.entry.value) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * skiplist_map_clear -- removes all pairs from the list
+ */
+func skiplist_map_clear(ptr *data) {
+	txn("undo") {
+		ptr.head.next = [SKIPLIST_LEVELS_NUM]*node_t{}
+	}
+}
+
+/*
+ * skiplist_map_level_len -- (internal) counts the nodes linked on a level
+ */
+func skiplist_map_level_len(ptr *data, level int) int {
+	n := 0
+	for node := ptr.head.next[level]; node != nil; node = node.next[level] {
+		n++
+	}
+	return n
+}
+
+/*
+ * skiplist_map_check -- verifies that every level is sorted and that each
+ * node_t linked on a level is also linked on all the levels below
+ */
+func skiplist_map_check(ptr *data) error {
+	below := map[*node_t]bool{}
+	for level := 0; level < SKIPLIST_LEVELS_NUM; level++ {
+		linked := map[*node_t]bool{}
+		prev := (*node_t)(nil)
+		for node := ptr.head.next[level]; node != nil; node = node.next[level] {
+			if linked[node] {
+				return fmt.Errorf("level %d loops back to key %d", level, node.entry.key)
+			}
+			if level > 0 && !below[node] {
+				return fmt.Errorf("key %d is on level %d but not on level %d",
+					node.entry.key, level, level - 1)
+			}
+			if prev != nil && node.entry.key < prev.entry.key {
+				return fmt.Errorf("key %d follows key %d on level %d",
+					node.entry.key, prev.entry.key, level)
+			}
+			linked[node] = true
+			prev = node
+		}
+		below = linked
+	}
+	return nil
+}
+
+/*
+ * str_insert -- skiplist_map_insert wrapper which works on strings
+ */
+func str_insert(ptr *data, str string) {
+	var key int
+	if scan_args("insert", str, "%d", &key) {
+		if err := skiplist_map_insert(ptr, key, 0); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- skiplist_map_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key int
+	if scan_args("remove", str, "%d", &key) {
+		if _, ok := skiplist_map_remove(ptr, key); !ok {
+			fmt.Println("no such value")
+		}
+	}
+}
+
+/*
+ * str_check -- skiplist_map_lookup wrapper which works on strings
+ */
+func str_check(ptr *data, str string) {
+	var key int
+	if scan_args("check", str, "%d", &key) {
+		fmt.Println(skiplist_map_lookup(ptr, key))
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := skiplist_map_insert(ptr, rand.Int(), 0); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"i $value - insert $value",
+		"r $value - remove $value",
+		"c $value - check $value, returns 0/1",
+		"n $value - insert $value random values",
+		"p - print all values",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	skiplist_map_foreach(ptr, func(key int, value int) bool {
+		fmt.Print(key, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if err := skiplist_map_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+	}
+	for level := SKIPLIST_LEVELS_NUM - 1; level >= 0; level-- {
+		fmt.Println("level", level, "nodes:", skiplist_map_level_len(ptr, level))
+	}
+}
+
+/*
+ * Run -- opens the list named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("skiplist", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'c': str_check(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': skiplist_map_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/vmware/go-pmem-transaction/pmem"
+)
+
+// The tests share one pool, as go-pmem maps a single pool per process.
+func TestMain(m *testing.M) {
+	pool := filepath.Join(os.TempDir(), fmt.Sprintf("skiplist_test.%d.pool", os.Getpid()))
+	pmem.Init(pool)
+	status := m.Run()
+	os.Remove(pool)
+	os.Exit(status)
+}
+
+// skiplist_keys returns the keys of the list in the order it holds them.
+func skiplist_keys(ptr *data) []int {
+	keys := []int{}
+	skiplist_map_foreach(ptr, func(key int, value int) bool {
+		keys = append(keys, key)
+		return false
+	})
+	return keys
+}
+
+// Random inserts, duplicates among them, and removes keep every level sorted
+// and linked on the levels below, and the list holds the keys inserted and
+// not removed.
+func TestSkiplistInvariants(t *testing.T) {
+	ptr := pnew(data)
+	initialize(ptr)
+	rng := rand.New(rand.NewSource(1))
+	count := map[int]int{}
+	for i := 0; i < 2000; i++ {
+		key := rng.Intn(200)
+		if rng.Intn(3) == 0 {
+			_, ok := skiplist_map_remove(ptr, key)
+			if ok != (count[key] > 0) {
+				t.Fatalf("step %d: remove of %d found %v, want %v", i, key, ok, !ok)
+			}
+			if ok {
+				count[key]--
+			}
+		} else {
+			if err := skiplist_map_insert(ptr, key, i); err != nil {
+				t.Fatalf("step %d: insert of %d: %v", i, key, err)
+			}
+			count[key]++
+		}
+		if err := skiplist_map_check(ptr); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+	}
+
+	want := []int{}
+	for key, n := range count {
+		for ; n > 0; n-- {
+			want = append(want, key)
+		}
+	}
+	sort.Ints(want)
+	if got := skiplist_keys(ptr); !reflect.DeepEqual(got, want) {
+		t.Fatalf("the list holds %v, want %v", got, want)
+	}
+}
+
+// skiplist_map_check finds a level out of order and a node linked above a
+// level it is missing from.
+func TestSkiplistCheck(t *testing.T) {
+	ptr := pnew(data)
+	initialize(ptr)
+	for key := 1; key <= 3; key++ {
+		skiplist_map_insert(ptr, key, 0)
+	}
+	if err := skiplist_map_check(ptr); err != nil {
+		t.Fatal(err)
+	}
+
+	first := ptr.head.next[0]
+	first.entry.key = 5
+	if skiplist_map_check(ptr) == nil {
+		t.Error("a level out of order passed the check")
+	}
+	first.entry.key = 1
+
+	ptr.head.next[1] = first
+	ptr.head.next[0] = first.next[0]
+	if skiplist_map_check(ptr) == nil {
+		t.Error("a node missing from the level below passed the check")
+	}
+}
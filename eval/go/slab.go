@@ -0,0 +1,200 @@
+package main
+
+// A persistent slab allocator, for the programs it is built with; see
+// build.sh.
+//
+// Memory is taken from pnew in slabs, each holding a fixed number of slots of
+// a fixed size, and a bitmap of the slots in use. A slot is named by a
+// handle, an int which stays valid until the slot is freed, so a structure
+// opting into the allocator keeps handles where it would keep pointers, and
+// reads and writes the bytes of a slot through slab_bytes. A slab whose
+// slots are all free is given back to the persistent heap. Every mutator is
+// a transaction of its own, and may be nested in the transaction of the
+// caller.
+
+import (
+	"fmt"
+)
+
+// slab_t is one slab: bit i of used is set when slot i is allocated.
+type slab_t struct {
+	used  []uint64
+	nfree int
+	mem   []byte
+}
+
+// slab_allocator hands out slots of slot_size bytes, slots_per_slab at a
+// time. A nil slab is a hole left by a released one, reused before the
+// array of slabs grows.
+type slab_allocator struct {
+	slot_size      int
+	slots_per_slab int
+	slabs          []*slab_t
+	live           int
+}
+
+// slab_new returns an allocator of slots of slot_size bytes, taken from the
+// heap slots_per_slab at a time.
+func slab_new(slot_size int, slots_per_slab int) *slab_allocator {
+	var a *slab_allocator
+	txn("undo") {
+		a = pnew(slab_allocator)
+		a.slot_size = slot_size
+		a.slots_per_slab = slots_per_slab
+	}
+	return a
+}
+
+// slab_grow adds a slab with every slot free, in the first hole if there is
+// one, and returns its index.
+func slab_grow(a *slab_allocator) int {
+	i := -1
+	txn("undo") {
+		s := pnew(slab_t)
+		s.used = pmake([]uint64, (a.slots_per_slab+63)/64)
+		s.mem = pmake([]byte, a.slots_per_slab*a.slot_size)
+		s.nfree = a.slots_per_slab
+		for j, t := range a.slabs {
+			if t == nil {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			slabs := pmake([]*slab_t, len(a.slabs)+1)
+			copy(slabs, a.slabs)
+			a.slabs = slabs
+			i = len(a.slabs) - 1
+		}
+		a.slabs[i] = s
+	}
+	return i
+}
+
+// slab_alloc allocates a slot, zeroed, and returns its handle. The slot is
+// taken from the first slab with one free, so that the slabs at the end
+// empty out and can be released. A full pool rolls the transaction back with
+// ErrPoolFull.
+func slab_alloc(a *slab_allocator) (h int, err error) {
+	defer pool_full(&err)
+	i := -1
+	for j, s := range a.slabs {
+		if s != nil && s.nfree > 0 {
+			i = j
+			break
+		}
+	}
+	h = -1
+	txn("undo") {
+		if i < 0 {
+			i = slab_grow(a)
+		}
+		s := a.slabs[i]
+		slot := 0
+		for s.used[slot/64]&(1<<uint(slot%64)) != 0 {
+			slot++
+		}
+		s.used[slot/64] |= 1 << uint(slot%64)
+		s.nfree--
+		mem := s.mem[slot*a.slot_size : (slot+1)*a.slot_size]
+		for k := range mem {
+			mem[k] = 0
+		}
+		a.live++
+		h = i*a.slots_per_slab + slot
+	}
+	return h, nil
+}
+
+// slab_valid checks if h is the handle of an allocated slot.
+func slab_valid(a *slab_allocator, h int) bool {
+	if h < 0 || h >= len(a.slabs)*a.slots_per_slab {
+		return false
+	}
+	s, slot := a.slabs[h/a.slots_per_slab], h%a.slots_per_slab
+	return s != nil && s.used[slot/64]&(1<<uint(slot%64)) != 0
+}
+
+// slab_bytes returns the bytes of the slot of handle h, which must be valid.
+// They must only be written in a transaction.
+func slab_bytes(a *slab_allocator, h int) []byte {
+	s, slot := a.slabs[h/a.slots_per_slab], h%a.slots_per_slab
+	return s.mem[slot*a.slot_size : (slot+1)*a.slot_size]
+}
+
+// slab_free frees the slot of handle h, which must be valid, releasing its
+// slab once all of its slots are free.
+func slab_free(a *slab_allocator, h int) {
+	i, slot := h/a.slots_per_slab, h%a.slots_per_slab
+	txn("undo") {
+		s := a.slabs[i]
+		s.used[slot/64] &^= 1 << uint(slot%64)
+		s.nfree++
+		if s.nfree == a.slots_per_slab {
+			a.slabs[i] = nil
+		}
+		a.live--
+	}
+}
+
+// slab_footprint returns the number of bytes held by the slabs, the slots
+// free or not and the bitmaps.
+func slab_footprint(a *slab_allocator) int {
+	n := 0
+	for _, s := range a.slabs {
+		if s != nil {
+			n += len(s.mem) + 8*len(s.used)
+		}
+	}
+	return n
+}
+
+// slab_count returns the number of slabs held.
+func slab_count(a *slab_allocator) int {
+	n := 0
+	for _, s := range a.slabs {
+		if s != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// slab_check verifies that every slab is sized for the allocator, that the
+// bitmaps agree with the free counts and that no held slab is empty, and
+// that live is right.
+func slab_check(a *slab_allocator) error {
+	live := 0
+	for i, s := range a.slabs {
+		if s == nil {
+			continue
+		}
+		if len(s.mem) != a.slots_per_slab*a.slot_size ||
+			len(s.used) != (a.slots_per_slab+63)/64 {
+			return fmt.Errorf("slab %d is not sized for %d slots of %d bytes",
+				i, a.slots_per_slab, a.slot_size)
+		}
+		used := 0
+		for slot := 0; slot < len(s.used)*64; slot++ {
+			if s.used[slot/64]&(1<<uint(slot%64)) != 0 {
+				if slot >= a.slots_per_slab {
+					return fmt.Errorf("slab %d uses slot %d of %d", i, slot,
+						a.slots_per_slab)
+				}
+				used++
+			}
+		}
+		if used+s.nfree != a.slots_per_slab {
+			return fmt.Errorf("slab %d has %d slots used and %d free of %d",
+				i, used, s.nfree, a.slots_per_slab)
+		}
+		if used == 0 {
+			return fmt.Errorf("slab %d is empty", i)
+		}
+		live += used
+	}
+	if live != a.live {
+		return fmt.Errorf("%d slots used, count is %d", live, a.live)
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* size of the slots and number of slots per slab of a new allocator */
+const SLAB_DEFAULT_SLOT_SIZE int = 64
+const SLAB_DEFAULT_SLOTS int = 64
+
+/*
+ * data -- the slots are handed out by alloc, see slab.go
+ */
+type data struct {
+	alloc *slab_allocator
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x6D0A4E8C2F71B359
+)
+
+func initialize(ptr *data, slot_size int, slots int) {
+	txn("undo") {
+		ptr.alloc = slab_new(slot_size, slots)
+		ptr.magic = magic
+	}
+}
+
+/*
+ * slabcli_clear -- replaces the allocator with an empty one of the same
+ * geometry, freeing all slots
+ */
+func slabcli_clear(ptr *data) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		ptr.alloc = slab_new(ptr.alloc.slot_size, ptr.alloc.slots_per_slab)
+	}
+	return nil
+}
+
+/*
+ * slabcli_write -- stores str at the start of the slot of handle h, which
+ * must be valid, truncated to the slot size, and zeroes the rest of the slot
+ */
+func slabcli_write(ptr *data, h int, str string) {
+	txn("undo") {
+		mem := slab_bytes(ptr.alloc, h)
+		n := copy(mem, str)
+		for i := n; i < len(mem); i++ {
+			mem[i] = 0
+		}
+	}
+}
+
+/*
+ * slabcli_amplification -- returns the bytes held by the slabs per byte of
+ * the slots in use
+ */
+func slabcli_amplification(ptr *data) float64 {
+	if ptr.alloc.live == 0 {
+		return 0
+	}
+	return float64(slab_footprint(ptr.alloc)) /
+		float64(ptr.alloc.live * ptr.alloc.slot_size)
+}
+
+/*
+ * slabcli_bench -- allocates n slots from the allocator and frees them again,
+ * then allocates n byte slices of the slot size with pmake, printing the
+ * throughput of both and the amplification of the allocator at its peak;
+ * the allocator is left as it was
+ */
+func slabcli_bench(ptr *data, n int) (err error) {
+	handles := make([]int, 0, n)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		h, err := slab_alloc(ptr.alloc)
+		if err != nil {
+			for _, h := range handles {
+				slab_free(ptr.alloc, h)
+			}
+			return err
+		}
+		handles = append(handles, h)
+	}
+	allocated := time.Since(start)
+	amplification := slabcli_amplification(ptr)
+	for _, h := range handles {
+		slab_free(ptr.alloc, h)
+	}
+
+	defer pool_full(&err)
+	slices := make([][]byte, 0, n)
+	start = time.Now()
+	for i := 0; i < n; i++ {
+		var s []byte
+		txn("undo") {
+			s = pmake([]byte, ptr.alloc.slot_size)
+		}
+		slices = append(slices, s)
+	}
+	made := time.Since(start)
+
+	fmt.Printf("slab: %d allocs in %v, %.0f ops/s, amplification %.2f\n", n, allocated,
+		float64(n) / allocated.Seconds(), amplification)
+	fmt.Printf("pmake: %d allocs in %v, %.0f ops/s\n", n, made,
+		float64(n) / made.Seconds())
+	return nil
+}
+
+/*
+ * str_alloc -- allocates a slot and prints its handle
+ */
+func str_alloc(ptr *data) {
+	if h, err := slab_alloc(ptr.alloc); err == nil {
+		fmt.Println(h)
+	} else {
+		fmt.Println("alloc:", err)
+	}
+}
+
+/*
+ * str_handle -- (internal) parses a handle at the start of str, printing an
+ * error for cmd if it does not name an allocated slot
+ */
+func str_handle(ptr *data, cmd string, str string) (int, bool) {
+	var h int
+	if !scan_args(cmd, str, "%d", &h) {
+		return 0, false
+	}
+	if !slab_valid(ptr.alloc, h) {
+		fmt.Println("no such slot")
+		return 0, false
+	}
+	return h, true
+}
+
+/*
+ * str_free -- frees the slot of the handle given as a string
+ */
+func str_free(ptr *data, str string) {
+	if h, ok := str_handle(ptr, "free", str); ok {
+		slab_free(ptr.alloc, h)
+	}
+}
+
+/*
+ * str_write -- stores a word in the slot of a handle, both given as a string
+ */
+func str_write(ptr *data, str string) {
+	var word string
+	if h, ok := str_handle(ptr, "write", str); ok {
+		if scan_args("write", str, "%d %s", &h, &word) {
+			slabcli_write(ptr, h, word)
+		}
+	}
+}
+
+/*
+ * str_read -- prints the contents of the slot of the handle given as a
+ * string, up to the first zero byte
+ */
+func str_read(ptr *data, str string) {
+	if h, ok := str_handle(ptr, "read", str); ok {
+		mem := slab_bytes(ptr.alloc, h)
+		n := 0
+		for n < len(mem) && mem[n] != 0 {
+			n++
+		}
+		fmt.Println(string(mem[:n]))
+	}
+}
+
+/*
+ * str_bench -- slabcli_bench wrapper which works on strings
+ */
+func str_bench(ptr *data, str string) {
+	var n int
+	if _, err := fmt.Sscanf(str, "%d", &n); err == nil && n > 0 {
+		if err := slabcli_bench(ptr, n); err != nil {
+			fmt.Println("bench:", err)
+		}
+	} else {
+		fmt.Println("bench: invalid syntax")
+	}
+}
+
+/*
+ * str_clear -- slabcli_clear wrapper which reports its error
+ */
+func str_clear(ptr *data) {
+	if err := slabcli_clear(ptr); err != nil {
+		fmt.Println("clear:", err)
+	}
+}
+
+func help() {
+	print_help(
+		"a - allocate a slot, print its handle",
+		"f $handle - free the slot of $handle",
+		"w $handle $word - store $word in the slot of $handle",
+		"r $handle - print the contents of the slot of $handle",
+		"b $count - allocate $count slots, then as many with pmake, print the throughput",
+		"p - print the handles of all allocated slots",
+		"d - print debug info",
+		"x - free all slots",
+	)
+}
+
+func print_all(ptr *data) {
+	for h := 0; h < len(ptr.alloc.slabs) * ptr.alloc.slots_per_slab; h++ {
+		if slab_valid(ptr.alloc, h) {
+			fmt.Print(h, " ")
+		}
+	}
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if err := slab_check(ptr.alloc); err != nil {
+		fmt.Println("invariants:", err)
+		return
+	}
+	fmt.Println("invariants: ok")
+	fmt.Println("slot size:", ptr.alloc.slot_size, "slots per slab:", ptr.alloc.slots_per_slab)
+	fmt.Printf("slots used: %d slabs: %d footprint: %d amplification: %.2f\n",
+		ptr.alloc.live, slab_count(ptr.alloc), slab_footprint(ptr.alloc),
+		slabcli_amplification(ptr))
+}
+
+/*
+ * Run -- opens the pool named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("slabcli", flag.ContinueOnError)
+	flags.Usage = func() {}
+	slot_size := flags.Int("slot", SLAB_DEFAULT_SLOT_SIZE, "size of the slots in bytes when the allocator is created")
+	slots := flags.Int("slots", SLAB_DEFAULT_SLOTS, "number of slots per slab when the allocator is created")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	if *slot_size <= 0 || *slots <= 0 {
+		return usage_error("the slabs need a positive slot size and number of slots")
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr, *slot_size, *slots)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'a': str_alloc(ptr)
+			case 'f': str_free(ptr, buf[1:])
+			case 'w': str_write(ptr, buf[1:])
+			case 'r': str_read(ptr, buf[1:])
+			case 'b': str_bench(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "[-slot bytes] [-slots n] filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
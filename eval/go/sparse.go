@@ -0,0 +1,381 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* an index is split into SA_DIR_BITS selecting a page and SA_PAGE_BITS in it */
+const SA_DIR_BITS uint = 12
+const SA_PAGE_BITS uint = 8
+
+const SA_DIR_SIZE int = 1 << SA_DIR_BITS
+const SA_PAGE_SIZE int = 1 << SA_PAGE_BITS
+
+/* number of indices the array can hold */
+const SA_MAX_INDEX int = SA_DIR_SIZE * SA_PAGE_SIZE
+
+/*
+ * page_t -- the values of SA_PAGE_SIZE consecutive indices, with a bit set in
+ * present for each index which holds one
+ */
+type page_t struct {
+	values  [SA_PAGE_SIZE]int
+	present [SA_PAGE_SIZE / 64]uint64
+	count   int
+}
+
+/*
+ * data -- dir points to the page of every SA_PAGE_SIZE indices in which at
+ * least one holds a value, and is nil for the others
+ */
+type data struct {
+	dir   []*page_t
+	count int
+	pages int
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x3F9A27C1E0D8B456
+)
+
+var ErrRange = fmt.Errorf("index out of range [0, %d)", SA_MAX_INDEX)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.dir = pmake([]*page_t, SA_DIR_SIZE)
+		ptr.count = 0
+		ptr.pages = 0
+		ptr.magic = magic
+	}
+}
+
+/*
+ * sa_split -- (internal) returns the directory entry and the offset in its
+ * page of index i
+ */
+func sa_split(i int) (int, int) {
+	return i >> SA_PAGE_BITS, i & (SA_PAGE_SIZE - 1)
+}
+
+/*
+ * sa_is_present -- (internal) returns whether offset off of page p holds a
+ * value
+ */
+func sa_is_present(p *page_t, off int) bool {
+	return p.present[off / 64] & (1 << uint(off % 64)) != 0
+}
+
+/*
+ * sa_set -- stores value at index i; the page of i is allocated on first
+ * touch in the same transaction, which a full pool rolls back with
+ * ErrPoolFull
+ */
+func sa_set(ptr *data, i int, value int) (err error) {
+	if i < 0 || i >= SA_MAX_INDEX {
+		return ErrRange
+	}
+	defer pool_full(&err)
+	d, off := sa_split(i)
+	txn("undo") {
+		p := ptr.dir[d]
+		if p == nil {
+			p = pnew(page_t)
+			ptr.dir[d] = p
+			ptr.pages++
+		}
+		if !sa_is_present(p, off) {
+			p.present[off / 64] |= 1 << uint(off % 64)
+			p.count++
+			ptr.count++
+		}
+		p.values[off] = value
+	}
+	return nil
+}
+
+/*
+ * sa_get -- returns the value at index i, and whether it holds one
+ */
+func sa_get(ptr *data, i int) (int, bool) {
+	if i < 0 || i >= SA_MAX_INDEX {
+		return 0, false
+	}
+	d, off := sa_split(i)
+	p := ptr.dir[d]
+	if p == nil || !sa_is_present(p, off) {
+		return 0, false
+	}
+	return p.values[off], true
+}
+
+/*
+ * sa_remove -- removes the value at index i, returning whether there was
+ * one; a page left empty is unlinked in the same transaction
+ */
+func sa_remove(ptr *data, i int) bool {
+	if i < 0 || i >= SA_MAX_INDEX {
+		return false
+	}
+	d, off := sa_split(i)
+	p := ptr.dir[d]
+	if p == nil || !sa_is_present(p, off) {
+		return false
+	}
+	txn("undo") {
+		p.present[off / 64] &^= 1 << uint(off % 64)
+		p.values[off] = 0
+		p.count--
+		ptr.count--
+		if p.count == 0 {
+			ptr.dir[d] = nil
+			ptr.pages--
+		}
+	}
+	return true
+}
+
+/*
+ * sa_range -- calls cb for every index from lo to hi, both included, which
+ * holds a value, in order, stopping early when cb returns true; pages not
+ * allocated are skipped whole
+ */
+func sa_range(ptr *data, lo int, hi int, cb func(int, int) bool) bool {
+	if lo < 0 {
+		lo = 0
+	}
+	if hi >= SA_MAX_INDEX {
+		hi = SA_MAX_INDEX - 1
+	}
+	for d := lo >> SA_PAGE_BITS; d <= hi >> SA_PAGE_BITS; d++ {
+		p := ptr.dir[d]
+		if p == nil {
+			continue
+		}
+		base := d << SA_PAGE_BITS
+		for w, word := range p.present {
+			for ; word != 0; word &= word - 1 {
+				i := base + w * 64 + bits.TrailingZeros64(word)
+				if i < lo || i > hi {
+					continue
+				}
+				if cb(i, p.values[i - base]) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * sa_foreach -- sa_range over all indices
+ */
+func sa_foreach(ptr *data, cb func(int, int) bool) bool {
+	return sa_range(ptr, 0, SA_MAX_INDEX - 1, cb)
+}
+
+/*
+ * sa_clear -- removes all values, unlinking every page
+ */
+func sa_clear(ptr *data) {
+	txn("undo") {
+		for d := range ptr.dir {
+			if ptr.dir[d] != nil {
+				ptr.dir[d] = nil
+			}
+		}
+		ptr.count = 0
+		ptr.pages = 0
+	}
+}
+
+/*
+ * sa_check -- verifies that every page counts its present bits, holds at
+ * least one value and zero where it holds none, and that the totals are
+ * right
+ */
+func sa_check(ptr *data) error {
+	if len(ptr.dir) != SA_DIR_SIZE {
+		return fmt.Errorf("directory of %d entries", len(ptr.dir))
+	}
+	count, pages := 0, 0
+	for d, p := range ptr.dir {
+		if p == nil {
+			continue
+		}
+		n := 0
+		for _, word := range p.present {
+			n += bits.OnesCount64(word)
+		}
+		if n != p.count || n == 0 {
+			return fmt.Errorf("page %d holds %d values, counts %d", d, n, p.count)
+		}
+		for off, v := range p.values {
+			if v != 0 && !sa_is_present(p, off) {
+				return fmt.Errorf("index %d holds %d but no value", d << SA_PAGE_BITS + off, v)
+			}
+		}
+		count += n
+		pages++
+	}
+	if count != ptr.count || pages != ptr.pages {
+		return fmt.Errorf("%d values in %d pages, totals are %d and %d", count, pages,
+			ptr.count, ptr.pages)
+	}
+	return nil
+}
+
+/*
+ * str_set -- sa_set wrapper which works on strings
+ */
+func str_set(ptr *data, str string) {
+	var i, value int
+	if scan_args("set", str, "%d %d", &i, &value) {
+		if err := sa_set(ptr, i, value); err != nil {
+			fmt.Println("set:", err)
+		}
+	}
+}
+
+/*
+ * str_get -- sa_get wrapper which works on strings
+ */
+func str_get(ptr *data, str string) {
+	var i int
+	if scan_args("get", str, "%d", &i) {
+		if value, ok := sa_get(ptr, i); ok {
+			fmt.Println(value)
+		} else {
+			fmt.Println("no value")
+		}
+	}
+}
+
+/*
+ * str_remove -- sa_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var i int
+	if scan_args("remove", str, "%d", &i) {
+		if !sa_remove(ptr, i) {
+			fmt.Println("no value")
+		}
+	}
+}
+
+/*
+ * str_range -- sa_range wrapper which works on strings
+ */
+func str_range(ptr *data, str string) {
+	var lo, hi int
+	if scan_args("range", str, "%d %d", &lo, &hi) {
+		sa_range(ptr, lo, hi, func(i int, value int) bool {
+			fmt.Println(i, value)
+			return false
+		})
+	}
+}
+
+/*
+ * str_insert_random -- sets specified (as string) number of random indices
+ * to random values
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			sa_set(ptr, rand.Intn(SA_MAX_INDEX), rand.Intn(1000))
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"s $index $value - store $value at $index",
+		"g $index - print the value at $index",
+		"r $index - remove the value at $index",
+		"R $lo $hi - print the values from $lo to $hi",
+		"n $value - store random values at $value random indices",
+		"p - print all indices with their value",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	sa_foreach(ptr, func(i int, value int) bool {
+		fmt.Println(i, value)
+		return false
+	})
+}
+
+func print_debug(ptr *data) {
+	if err := sa_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("values:", ptr.count, "pages:", ptr.pages, "of", SA_DIR_SIZE,
+			"page size:", SA_PAGE_SIZE)
+	}
+}
+
+/*
+ * Run -- opens the array named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("sparse", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 's': str_set(ptr, buf[1:])
+			case 'g': str_get(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'R': str_range(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': sa_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
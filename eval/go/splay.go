@@ -0,0 +1,412 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+type node_t struct {
+	key   int
+	value int
+	left  *node_t
+	right *node_t
+}
+
+type data struct {
+	root  *node_t
+	count int
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x3F07B2D95C1E8A64
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.root = nil
+		ptr.count = 0
+		ptr.magic = magic
+	}
+}
+
+/*
+ * the rotations done since the program started, the accesses which splayed
+ * the tree, lookups included, and the time these spent in their transactions
+ */
+var splay_rotations int = 0
+var splay_accesses int = 0
+var splay_time time.Duration = 0
+
+/*
+ * splay_rotate_right -- (internal) lifts the left child of the node at link
+ * in its place
+ */
+func splay_rotate_right(link **node_t) {
+	n := *link
+	l := n.left
+	n.left = l.right
+	l.right = n
+	*link = l
+	splay_rotations++
+}
+
+/*
+ * splay_rotate_left -- (internal) lifts the right child of the node at link
+ * in its place
+ */
+func splay_rotate_left(link **node_t) {
+	n := *link
+	r := n.right
+	n.right = r.left
+	r.left = n
+	*link = r
+	splay_rotations++
+}
+
+/*
+ * splay_splay -- (internal) brings the node of the key to link, or the last
+ * node on its search path if the key is not in the subtree, by zig-zig and
+ * zig-zag steps; must be called in a transaction
+ */
+func splay_splay(link **node_t, key int) {
+	n := *link
+	if n == nil || n.key == key {
+		return
+	}
+	if key < n.key {
+		if n.left == nil {
+			return
+		}
+		if key < n.left.key {
+			splay_splay(&n.left.left, key)
+			splay_rotate_right(link)
+		} else if key > n.left.key {
+			splay_splay(&n.left.right, key)
+			if n.left.right != nil {
+				splay_rotate_left(&n.left)
+			}
+		}
+		if (*link).left != nil {
+			splay_rotate_right(link)
+		}
+	} else {
+		if n.right == nil {
+			return
+		}
+		if key > n.right.key {
+			splay_splay(&n.right.right, key)
+			splay_rotate_left(link)
+		} else if key < n.right.key {
+			splay_splay(&n.right.left, key)
+			if n.right.left != nil {
+				splay_rotate_right(&n.right)
+			}
+		}
+		if (*link).right != nil {
+			splay_rotate_left(link)
+		}
+	}
+}
+
+/*
+ * splay_access -- (internal) runs fn in a transaction, after splaying the
+ * tree around the key, and accounts for its time
+ */
+func splay_access(ptr *data, key int, fn func()) {
+	start := time.Now()
+	txn("undo") {
+		splay_splay(&ptr.root, key)
+		fn()
+	}
+	splay_time += time.Since(start)
+	splay_accesses++
+}
+
+/*
+ * splay_insert -- inserts a key-value pair, replacing the value of the key if
+ * it is present; the new node becomes the root, between the halves of the
+ * tree splayed around its key; a full pool rolls the splay back with
+ * ErrPoolFull
+ */
+func splay_insert(ptr *data, key int, value int) (err error) {
+	defer pool_full(&err)
+	splay_access(ptr, key, func() {
+		root := ptr.root
+		if root != nil && root.key == key {
+			root.value = value
+			return
+		}
+		n := pnew(node_t)
+		n.key = key
+		n.value = value
+		if root != nil && key < root.key {
+			n.left = root.left
+			n.right = root
+			root.left = nil
+		} else if root != nil {
+			n.right = root.right
+			n.left = root
+			root.right = nil
+		}
+		ptr.root = n
+		ptr.count++
+	})
+	return nil
+}
+
+/*
+ * splay_remove -- removes the key from the tree, returning its value and
+ * whether it was found; once the node is at the root, the largest key of its
+ * left subtree is splayed up to take its place
+ */
+func splay_remove(ptr *data, key int) (value int, ok bool) {
+	splay_access(ptr, key, func() {
+		root := ptr.root
+		if root == nil || root.key != key {
+			return
+		}
+		value, ok = root.value, true
+		if root.left == nil {
+			ptr.root = root.right
+		} else {
+			ptr.root = root.left
+			splay_splay(&ptr.root, key)
+			ptr.root.right = root.right
+		}
+		ptr.count--
+	})
+	return value, ok
+}
+
+/*
+ * splay_get -- searches for the value of the key, splaying the tree around it
+ */
+func splay_get(ptr *data, key int) (value int, ok bool) {
+	splay_access(ptr, key, func() {
+		if ptr.root != nil && ptr.root.key == key {
+			value, ok = ptr.root.value, true
+		}
+	})
+	return value, ok
+}
+
+/*
+ * splay_lookup -- checks if the key exists in the tree
+ */
+func splay_lookup(ptr *data, key int) bool {
+	_, ok := splay_get(ptr, key)
+	return ok
+}
+
+/*
+ * splay_foreach_node -- (internal) calls cb for every pair below the node in
+ * key order
+ */
+func splay_foreach_node(n *node_t, cb func(int, int) bool) bool {
+	if n == nil {
+		return false
+	}
+	return splay_foreach_node(n.left, cb) || cb(n.key, n.value) ||
+		splay_foreach_node(n.right, cb)
+}
+
+/*
+ * splay_foreach -- calls cb for every pair in key order, stopping early when
+ * cb returns true; the tree is left as it is
+ */
+func splay_foreach(ptr *data, cb func(int, int) bool) bool {
+	return splay_foreach_node(ptr.root, cb)
+}
+
+/*
+ * splay_clear -- removes all pairs from the tree
+ */
+func splay_clear(ptr *data) {
+	txn("undo") {
+		ptr.root = nil
+		ptr.count = 0
+	}
+}
+
+/*
+ * splay_check_node -- (internal) verifies the key order below the node, whose
+ * keys must be within lo and hi when these are not nil; returns its number of
+ * nodes and its height
+ */
+func splay_check_node(n *node_t, lo *int, hi *int) (int, int, error) {
+	if n == nil {
+		return 0, 0, nil
+	}
+	if lo != nil && n.key <= *lo || hi != nil && n.key >= *hi {
+		return 0, 0, fmt.Errorf("key %d is out of order", n.key)
+	}
+	lcount, lheight, err := splay_check_node(n.left, lo, &n.key)
+	if err != nil {
+		return 0, 0, err
+	}
+	rcount, rheight, err := splay_check_node(n.right, &n.key, hi)
+	if err != nil {
+		return 0, 0, err
+	}
+	if rheight > lheight {
+		lheight = rheight
+	}
+	return lcount + rcount + 1, lheight + 1, nil
+}
+
+/*
+ * splay_check -- verifies the key order and count; returns the height of the
+ * tree
+ */
+func splay_check(ptr *data) (int, error) {
+	count, height, err := splay_check_node(ptr.root, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	if count != ptr.count {
+		return 0, fmt.Errorf("%d nodes, count is %d", count, ptr.count)
+	}
+	return height, nil
+}
+
+/*
+ * str_insert -- splay_insert wrapper which works on strings
+ */
+func str_insert(ptr *data, str string) {
+	var key int
+	if scan_args("insert", str, "%d", &key) {
+		if err := splay_insert(ptr, key, 0); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- splay_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key int
+	if scan_args("remove", str, "%d", &key) {
+		if _, ok := splay_remove(ptr, key); !ok {
+			fmt.Println("no such value")
+		}
+	}
+}
+
+/*
+ * str_check -- splay_lookup wrapper which works on strings
+ */
+func str_check(ptr *data, str string) {
+	var key int
+	if scan_args("check", str, "%d", &key) {
+		fmt.Println(splay_lookup(ptr, key))
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := splay_insert(ptr, rand.Int(), 0); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"i $value - insert $value",
+		"r $value - remove $value",
+		"c $value - check $value, returns 0/1",
+		"n $value - insert $value random values",
+		"p - print all values",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	splay_foreach(ptr, func(key int, value int) bool {
+		fmt.Print(key, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if height, err := splay_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("entries:", ptr.count, "height:", height)
+	}
+	if splay_accesses > 0 {
+		fmt.Printf("rotations per access: %.2f time per access: %v\n",
+			float64(splay_rotations) / float64(splay_accesses),
+			splay_time / time.Duration(splay_accesses))
+	}
+}
+
+/*
+ * Run -- opens the tree named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("splay", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'c': str_check(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': splay_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
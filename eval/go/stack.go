@@ -0,0 +1,298 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+type node_t struct {
+	value int
+	next  *node_t
+}
+
+type data struct {
+	top   *node_t
+	count int
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x58F3B1E06D2A94C7
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.top = nil
+		ptr.count = 0
+		ptr.magic = magic
+	}
+}
+
+/*
+ * stack_push -- puts value on top of the stack
+ */
+func stack_push(ptr *data, value int) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		n := pnew(node_t)
+		n.value = value
+		n.next = ptr.top
+		ptr.top = n
+		ptr.count++
+	}
+	return nil
+}
+
+/*
+ * stack_pop -- takes the value off the top of the stack, returning it and
+ * whether the stack had one
+ */
+func stack_pop(ptr *data) (int, bool) {
+	n := ptr.top
+	if n == nil {
+		return 0, false
+	}
+	txn("undo") {
+		ptr.top = n.next
+		ptr.count--
+	}
+	return n.value, true
+}
+
+/*
+ * stack_peek -- returns the value on top of the stack and whether there is
+ * one
+ */
+func stack_peek(ptr *data) (int, bool) {
+	if ptr.top == nil {
+		return 0, false
+	}
+	return ptr.top.value, true
+}
+
+/*
+ * stack_foreach -- calls cb for every value from the top down, stopping early
+ * when cb returns true
+ */
+func stack_foreach(ptr *data, cb func(int) bool) bool {
+	for n := ptr.top; n != nil; n = n.next {
+		if cb(n.value) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * stack_clear -- removes all values from the stack
+ */
+func stack_clear(ptr *data) {
+	txn("undo") {
+		ptr.top = nil
+		ptr.count = 0
+	}
+}
+
+/*
+ * stack_check -- verifies that count is the number of nodes
+ */
+func stack_check(ptr *data) error {
+	n := 0
+	for c := ptr.top; c != nil; c = c.next {
+		n++
+	}
+	if n != ptr.count {
+		return fmt.Errorf("%d nodes, count is %d", n, ptr.count)
+	}
+	return nil
+}
+
+/*
+ * stack_burst -- pushes n values and pops them again, one transaction each,
+ * printing the throughput of either phase; the stack is left as it was
+ */
+func stack_burst(ptr *data, n int) error {
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		if err := stack_push(ptr, i); err != nil {
+			/* leave the stack as it was before the burst */
+			for ; i > 0; i-- {
+				stack_pop(ptr)
+			}
+			return err
+		}
+	}
+	pushed := time.Since(start)
+
+	start = time.Now()
+	for i := 0; i < n; i++ {
+		stack_pop(ptr)
+	}
+	popped := time.Since(start)
+
+	fmt.Printf("push: %d ops in %v, %.0f ops/s\n", n, pushed,
+		float64(n) / pushed.Seconds())
+	fmt.Printf("pop: %d ops in %v, %.0f ops/s\n", n, popped,
+		float64(n) / popped.Seconds())
+	return nil
+}
+
+/*
+ * str_push -- stack_push wrapper which works on strings
+ */
+func str_push(ptr *data, str string) {
+	var value int
+	if scan_args("push", str, "%d", &value) {
+		if err := stack_push(ptr, value); err != nil {
+			fmt.Println("push:", err)
+		}
+	}
+}
+
+/*
+ * str_pop -- stack_pop wrapper which prints the value
+ */
+func str_pop(ptr *data) {
+	if value, ok := stack_pop(ptr); ok {
+		fmt.Println(value)
+	} else {
+		fmt.Println("stack is empty")
+	}
+}
+
+/*
+ * str_peek -- stack_peek wrapper which prints the value
+ */
+func str_peek(ptr *data) {
+	if value, ok := stack_peek(ptr); ok {
+		fmt.Println(value)
+	} else {
+		fmt.Println("stack is empty")
+	}
+}
+
+/*
+ * str_burst -- stack_burst wrapper which works on strings
+ */
+func str_burst(ptr *data, str string) {
+	var n int
+	if _, err := fmt.Sscanf(str, "%d", &n); err == nil && n > 0 {
+		if err := stack_burst(ptr, n); err != nil {
+			fmt.Println("burst:", err)
+		}
+	} else {
+		fmt.Println("burst: invalid syntax")
+	}
+}
+
+/*
+ * str_insert_random -- pushes specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := stack_push(ptr, rand.Int()); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"i $value - push $value",
+		"o - pop and print the top value",
+		"t - print the top value",
+		"b $count - push and pop $count values, printing the throughput",
+		"n $value - push $value random values",
+		"p - print all values from the top",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	stack_foreach(ptr, func(value int) bool {
+		fmt.Print(value, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if err := stack_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("nodes:", ptr.count)
+	}
+}
+
+/*
+ * Run -- opens the stack named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("stack", flag.ContinueOnError)
+	flags.Usage = func() {}
+	burst := flags.Int("burst", 0, "push and pop `n` values, print the throughput and exit")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	if *burst < 0 {
+		return usage_error("the burst count cannot be negative")
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	if *burst > 0 {
+		return stack_burst(ptr, *burst)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_push(ptr, buf[1:])
+			case 'o': str_pop(ptr)
+			case 't': str_peek(ptr)
+			case 'b': str_burst(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': stack_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "[-burst n] filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
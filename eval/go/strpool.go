@@ -0,0 +1,217 @@
+package main
+
+// A persistent pool of interned strings, for the programs it is built with;
+// see build.sh.
+//
+// Every distinct string is stored once and named by a handle, a small int
+// which stays the same for as long as the string is in the pool, so it can
+// be kept in persistent structures in place of a fixed [32]byte key or value.
+// Each string counts the references taken by strpool_intern and is dropped
+// when strpool_release gives the last one back; its handle may then be
+// reused for another string. Every mutator is a transaction of its own, and
+// may be nested in the transaction of the caller.
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// strpool_entry is a string of the pool, or a free handle when refs is 0.
+// next links the entries of a bucket chain, or the free handles, as a
+// handle plus one, 0 ending the chain.
+type strpool_entry struct {
+	bytes []byte
+	hash  uint32
+	refs  int
+	next  int
+}
+
+// strpool maps the hash of each string to a chain of entries. The bucket
+// array is rebuilt as large as the entry array whenever that grows, so that
+// chains stay short.
+type strpool struct {
+	entries []strpool_entry
+	buckets []int
+	live    int
+	free    int
+}
+
+// strpool_min_entries is the number of handles of a new pool.
+const strpool_min_entries = 16
+
+// strpool_new allocates an empty pool.
+func strpool_new() *strpool {
+	var p *strpool
+	txn("undo") {
+		p = pnew(strpool)
+		p.entries = pmake([]strpool_entry, 0, strpool_min_entries)
+		p.buckets = pmake([]int, strpool_min_entries)
+	}
+	return p
+}
+
+// strpool_hash returns the 32-bit FNV-1a hash of s.
+func strpool_hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// strpool_find returns the handle of s, or -1.
+func strpool_find(p *strpool, s string, hash uint32) int {
+	for e := p.buckets[hash%uint32(len(p.buckets))]; e != 0; e = p.entries[e-1].next {
+		if p.entries[e-1].hash == hash && string(p.entries[e-1].bytes) == s {
+			return e - 1
+		}
+	}
+	return -1
+}
+
+// strpool_grow doubles the entry array and rehashes the live entries into a
+// bucket array of the same size.
+func strpool_grow(p *strpool) {
+	txn("undo") {
+		entries := pmake([]strpool_entry, len(p.entries), 2*cap(p.entries))
+		buckets := pmake([]int, 2*cap(p.entries))
+		copy(entries, p.entries)
+		for h := range entries {
+			if entries[h].refs > 0 {
+				b := entries[h].hash % uint32(len(buckets))
+				entries[h].next = buckets[b]
+				buckets[b] = h + 1
+			}
+		}
+		p.entries = entries
+		p.buckets = buckets
+	}
+}
+
+// strpool_intern returns the handle of s, adding s to the pool if it is not
+// there, and takes a reference to it. A full pool rolls the transaction back
+// with ErrPoolFull.
+func strpool_intern(p *strpool, s string) (h int, err error) {
+	defer pool_full(&err)
+	hash := strpool_hash(s)
+	h = strpool_find(p, s, hash)
+	txn("undo") {
+		if h >= 0 {
+			p.entries[h].refs++
+			return h, nil
+		}
+		bytes := pmake([]byte, len(s))
+		copy(bytes, s)
+		if p.free != 0 {
+			h = p.free - 1
+			p.free = p.entries[h].next
+		} else {
+			if len(p.entries) == cap(p.entries) {
+				strpool_grow(p)
+			}
+			h = len(p.entries)
+			p.entries = p.entries[:h+1]
+		}
+		b := hash % uint32(len(p.buckets))
+		p.entries[h] = strpool_entry{bytes, hash, 1, p.buckets[b]}
+		p.buckets[b] = h + 1
+		p.live++
+	}
+	return h, nil
+}
+
+// strpool_lookup returns the handle of s without taking a reference, and
+// whether s is in the pool.
+func strpool_lookup(p *strpool, s string) (int, bool) {
+	h := strpool_find(p, s, strpool_hash(s))
+	return h, h >= 0
+}
+
+// strpool_valid checks if h is the handle of a string of the pool.
+func strpool_valid(p *strpool, h int) bool {
+	return h >= 0 && h < len(p.entries) && p.entries[h].refs > 0
+}
+
+// strpool_get returns the string of handle h, which must be valid.
+func strpool_get(p *strpool, h int) string {
+	return string(p.entries[h].bytes)
+}
+
+// strpool_release gives back a reference to the string of handle h, which
+// must be valid, and drops the string once no reference is left. It returns
+// whether the string was dropped.
+func strpool_release(p *strpool, h int) bool {
+	dropped := false
+	txn("undo") {
+		e := &p.entries[h]
+		e.refs--
+		if e.refs == 0 {
+			link := &p.buckets[e.hash%uint32(len(p.buckets))]
+			for *link != h+1 {
+				link = &p.entries[*link-1].next
+			}
+			*link = e.next
+			*e = strpool_entry{next: p.free}
+			p.free = h + 1
+			p.live--
+			dropped = true
+		}
+	}
+	return dropped
+}
+
+// strpool_foreach calls cb with the handle and the string of every entry in
+// handle order, stopping early when cb returns true.
+func strpool_foreach(p *strpool, cb func(int, string) bool) bool {
+	for h := range p.entries {
+		if p.entries[h].refs > 0 && cb(h, string(p.entries[h].bytes)) {
+			return true
+		}
+	}
+	return false
+}
+
+// strpool_check verifies that every live entry is in the chain of its hash,
+// that no string is stored twice, and that live and the free list account
+// for every other handle.
+func strpool_check(p *strpool) error {
+	chained := 0
+	for b, e := range p.buckets {
+		for ; e != 0; e = p.entries[e-1].next {
+			if e < 0 || e > len(p.entries) {
+				return fmt.Errorf("bucket %d links to handle %d", b, e-1)
+			}
+			entry := &p.entries[e-1]
+			if entry.refs <= 0 {
+				return fmt.Errorf("bucket %d links to free handle %d", b, e-1)
+			}
+			if int(entry.hash%uint32(len(p.buckets))) != b ||
+				entry.hash != strpool_hash(string(entry.bytes)) {
+				return fmt.Errorf("handle %d is in the wrong bucket", e-1)
+			}
+			chained++
+		}
+	}
+	seen := make(map[string]bool)
+	live := 0
+	for h := range p.entries {
+		if p.entries[h].refs > 0 {
+			s := string(p.entries[h].bytes)
+			if seen[s] {
+				return fmt.Errorf("'%s' is stored twice", s)
+			}
+			seen[s] = true
+			live++
+		}
+	}
+	free := 0
+	for e := p.free; e != 0; e = p.entries[e-1].next {
+		if e < 0 || e > len(p.entries) || p.entries[e-1].refs != 0 || free == len(p.entries) {
+			return fmt.Errorf("free list links to handle %d", e-1)
+		}
+		free++
+	}
+	if live != p.live || chained != live || live+free != len(p.entries) {
+		return fmt.Errorf("%d live handles, %d chained and %d free of %d, count is %d",
+			live, chained, free, len(p.entries), p.live)
+	}
+	return nil
+}
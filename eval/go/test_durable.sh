@@ -0,0 +1,250 @@
+#!/bin/bash
+
+# Checks that what the Go examples write is found again when the pool is
+# reopened. go-pmem maps a single pool per process and cannot unmap it, so
+# the pool is "closed" by letting the writing process exit and reopened by
+# starting a new one, which goes through pmem.Get.
+#
+# usage: test_durable.sh [pool]   (built binaries are expected next to it)
+
+full_path=$(realpath $0)
+dir_path=$(dirname $full_path)
+pool=${1:-/mnt/pmem0/go-durable.pool}
+failed=0
+
+# assert_durable name expected build verify
+#   runs build against a fresh pool, then verify in a new process, and fails
+#   unless verify prints expected
+assert_durable() {
+  local name=$1 expected=$2 build=$3 verify=$4
+
+  rm -f $pool
+  if ! eval "$build" > /dev/null; then
+    echo "$name: FAILED to build the structure"
+    failed=1
+    return
+  fi
+
+  local actual
+  actual=$(eval "$verify")
+  if [ "$actual" == "$expected" ]; then
+    echo "$name: ok"
+  else
+    echo "$name: FAILED, expected '$expected' after reopen, got '$actual'"
+    failed=1
+  fi
+}
+
+cd $dir_path
+
+assert_durable btree "test" \
+  "./btree $pool s 100" \
+  "./btree $pool f 99 2>&1"
+
+assert_durable btree_map "3 5 9" \
+  "printf 'i 5\ni 3\ni 9\ni 7\nr 7\n' | ./btree_map $pool" \
+  "echo p | ./btree_map $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable btree_map "3 5" \
+  "printf 'i 5\ni 3\ni 9\ni 1\n' | ./btree_map $pool" \
+  "echo R 2 8 | ./btree_map $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable simplekv '{"a":1,"b":2}' \
+  "echo '{\"a\":1,\"b\":2}' | ./simplekv $pool import" \
+  "./simplekv $pool export"
+
+assert_durable skiplist "3 5 9" \
+  "printf 'i 5\ni 3\ni 9\ni 7\nr 7\n' | ./skiplist $pool" \
+  "echo p | ./skiplist $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable rbtree_map "3 5 9" \
+  "printf 'i 5\ni 3\ni 9\ni 7\nr 7\n' | ./rbtree_map $pool" \
+  "echo p | ./rbtree_map $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable avltree "test" \
+  "./avltree $pool s 100" \
+  "./avltree $pool f 99 2>&1"
+
+assert_durable art "3 5 9" \
+  "printf 'i 5\ni 3\ni 9\ni 7\nr 7\n' | ./art $pool" \
+  "echo p | ./art $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable trie "tea 2 ten 3" \
+  "printf 'i tea 2\ni ten 3\ni to 4\nr to\n' | ./trie $pool" \
+  "echo 'f te' | ./trie $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable bplustree "5 9" \
+  "printf 'i 5\ni 3\ni 9\ni 7\nr 7\n' | ./bplustree $pool" \
+  "echo 's 4 9' | ./bplustree $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable cuckoo_map "3 5 9" \
+  "printf 'i 5\ni 3\ni 9\ni 7\nr 7\n' | ./cuckoo_map $pool" \
+  "echo p | ./cuckoo_map $pool | sed 's/\\$//g' | xargs -n 1 | sort -n | xargs echo"
+
+assert_durable hopscotch_map "3 5 9" \
+  "printf 'i 5\ni 3\ni 9\ni 7\nr 7\n' | ./hopscotch_map $pool" \
+  "echo p | ./hopscotch_map $pool | sed 's/\\$//g' | xargs -n 1 | sort -n | xargs echo"
+
+assert_durable cceh_map "3 5 9" \
+  "printf 'i 5\ni 3\ni 9\ni 7\nr 7\n' | ./cceh_map $pool" \
+  "echo p | ./cceh_map $pool | sed 's/\\$//g' | xargs -n 1 | sort -n | xargs echo"
+
+assert_durable lhash_map "3 5 9" \
+  "printf 'i 5\ni 3\ni 9\ni 7\nr 7\n' | ./lhash_map $pool" \
+  "echo p | ./lhash_map $pool | sed 's/\\$//g' | xargs -n 1 | sort -n | xargs echo"
+
+assert_durable robinhood_map "3 5 9" \
+  "printf 'i 5\ni 3\ni 9\ni 7\nr 7\n' | ./robinhood_map $pool" \
+  "echo p | ./robinhood_map $pool | sed 's/\\$//g' | xargs -n 1 | sort -n | xargs echo"
+
+assert_durable dlist "3 5 9" \
+  "printf 'b 5\nf 3\nf 1\nb 9\nr 1\n' | ./dlist $pool" \
+  "echo p | ./dlist $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable queue "Entry 1: bar" \
+  "./queue $pool new 4 && ./queue $pool enqueue foo &&
+   ./queue $pool enqueue bar && ./queue $pool dequeue" \
+  "./queue $pool show"
+
+assert_durable stack "9 5 3" \
+  "printf 'i 3\ni 5\ni 7\no\ni 9\n' | ./stack $pool" \
+  "echo p | ./stack $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable deque "3 5 9" \
+  "printf 'b 5\nf 3\nf 1\nb 9\nb 7\nF\nB\n' | ./deque $pool" \
+  "echo p | ./deque $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable pqueue "3 5 7" \
+  "printf 'i 9\ni 3\ni 5\ni 7\ni 1\nm\n' | ./pqueue $pool" \
+  "printf 'm\nm\nm\n' | ./pqueue $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable ringbuf "two three" \
+  "printf 'a one\na two\nc\na three\n' | ./ringbuf -capacity 2 $pool" \
+  "echo p | ./ringbuf $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable lsm "3 30 9 90" \
+  "printf 'i 5 50\ni 3 30\nf\ni 9 90\nr 5\n' | ./lsm $pool" \
+  "echo p | ./lsm $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable bloom "true true false" \
+  "printf 'a apple\na pear\n' | ./bloom $pool" \
+  "printf 'c apple\nc pear\nc plum\n' | ./bloom $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable hll "4 2" \
+  "printf 'a 0 ant\na 0 bee\na 0 cat\na 1 cat\na 1 dog\nm 0 1\n' | ./hll $pool" \
+  "printf 'e 0\ne 1\n' | ./hll $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable roaring "3 65541 2" \
+  "printf 'i 3\ni 65541\ni 9\nr 9\n' | ./roaring $pool" \
+  "printf 'p\nk 70000\n' | ./roaring $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable graph "0:0 1:1 2:2" \
+  "printf 'v\nv\nv\ne 0 1\ne 1 2\ne 0 2\nr 0 2\n' | ./graph $pool" \
+  "printf 'b 0\n' | ./graph $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable unionfind "true false" \
+  "printf 'u 1 2\nu 2 3\nu 5 6\n' | ./unionfind $pool" \
+  "printf 'c 1 3\nc 1 5\n' | ./unionfind $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable pvector "5 7" \
+  "printf 'a 3\na 5\na 7\n' | ./pvector $pool" \
+  "printf 'g 1\ng 2\n' | ./pvector $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable intern "0 bar" \
+  "printf 'i foo\ni bar\ni foo\nr 0\n' | ./intern $pool" \
+  "printf 'l foo\ng 1\n' | ./intern $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable hamt "3 5 9" \
+  "printf 'i 5\ni 3\ni 9\ni 7\nr 7\n' | ./hamt $pool" \
+  "echo p | ./hamt $pool | sed 's/\\$//g' | xargs -n 1 | sort -n | xargs echo"
+
+assert_durable treap "3 5 9" \
+  "printf 'i 5\ni 3\ni 9\ni 7\nr 7\n' | ./treap $pool" \
+  "echo p | ./treap $pool | sed 's/\\$//g' | xargs -n 1 | sort -n | xargs echo"
+
+assert_durable splay "3 5 9" \
+  "printf 'i 5\ni 3\ni 9\ni 7\nr 7\n' | ./splay $pool" \
+  "echo p | ./splay $pool | sed 's/\\$//g' | xargs -n 1 | sort -n | xargs echo"
+
+assert_durable ctree_map "3 5 9" \
+  "printf 'i 5\ni 3\ni 9\ni 7\nr 7\n' | ./ctree_map $pool" \
+  "echo p | ./ctree_map $pool | sed 's/\\$//g' | xargs -n 1 | sort -n | xargs echo"
+
+assert_durable rtree_map "romane 1 romulus 3" \
+  "printf 'i romane 1\ni romanus 2\ni romulus 3\nr romanus\n' | ./rtree_map $pool" \
+  "echo p | ./rtree_map $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable hashmap_atomic "3 5 9" \
+  "printf 'i 5\ni 3\ni 9\ni 7\nr 7\n' | ./hashmap_atomic $pool" \
+  "echo p | ./hashmap_atomic $pool | sed 's/\\$//g' | xargs -n 1 | sort -n | xargs echo"
+
+assert_durable hashmap_tx "3 5 9" \
+  "printf 'i 5\ni 3\ni 9\ni 7\nr 7\n' | ./hashmap_tx $pool" \
+  "echo p | ./hashmap_tx $pool | sed 's/\\$//g' | xargs -n 1 | sort -n | xargs echo"
+
+assert_durable slabcli "hello 0" \
+  "printf 'a\na\nw 0 hello\nw 1 world\nf 1\n' | ./slabcli $pool" \
+  "printf 'r 0\np\n' | ./slabcli $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable wal "1 b 2 c" \
+  "printf 'a a\na b\na c\nt 1\n' | ./wal $pool" \
+  "echo p | ./wal $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable multimap "20 1 0" \
+  "printf 'a 1 10\na 1 20\na 2 5\na 3 7\nr 1 10\nR 3\n' | ./multimap $pool" \
+  "printf 'g 1\nc 2\nc 3\n' | ./multimap $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable osetcli "3 9 3 5" \
+  "printf 'a 5\na 9\na 3\na 7\nr 7\n' | ./osetcli $pool" \
+  "printf 'm\nM\nR 0 6\n' | ./osetcli $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable lru "3 30 1 10" \
+  "printf 'i 1 10\ni 2 20\ng 1\ni 3 30\n' | ./lru -capacity 2 $pool" \
+  "echo p | ./lru $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable merkle "world true" \
+  "printf 'w 0 hello\nw 3 world\n' | ./merkle -blocks 4 $pool" \
+  "printf 'r 3\nc 3\n' | ./merkle $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable betree "40 false" \
+  "(seq 1 40 | sed 's/.*/i & &/'; echo r 7) | ./betree $pool" \
+  "printf 'g 40\nc 7\n' | ./betree $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable masstree "tenant/42/object/a 1 tenant/42/object/b 2 tenant/7 3" \
+  "printf 'i tenant/42/object/b 2\ni tenant/42/object/a 1\ni tenant/7 3\ni tenant/42/z 4\nr tenant/42/z\n' | ./masstree $pool" \
+  "echo 'R tenant/42/ tenant/7' | ./masstree $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable segtree "12 7" \
+  "printf 's 1 5\ns 3 7\na 2 4\na 2 -4\ns 0 9\ns 0 0\n' | ./segtree -size 6 $pool" \
+  "printf 'S 0 5\nS 2 4\n' | ./segtree $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable tsdb "20 2.5 30 3.5" \
+  "printf 'a cpu 10 1.5\na cpu 20 2.5\na mem 5 1\na cpu 30 3.5\na cpu 25 9\n' | ./tsdb $pool" \
+  "echo 'r cpu 15 30' | ./tsdb $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable matrix "7 10 1 2" \
+  "printf 'w 0 1 2\nw 1 3 4\nm\na 1 0 -2\n' | ./matrix -rows 2 -cols 2 $pool" \
+  "echo p | ./matrix $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable wordcount "the 3 cat 1 hat 1" \
+  "printf 'l The cat, the hat\nl the dog\nr dog\n' | ./wordcount $pool" \
+  "echo p | ./wordcount $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable mpmcq "2 3" \
+  "printf 'e 1\ne 2\ne 3\nc\n' | ./mpmcq $pool" \
+  "echo p | ./mpmcq $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable sparse "7 70 1000000 3" \
+  "printf 's 7 70\ns 300 1\ns 1000000 3\nr 300\n' | ./sparse $pool" \
+  "echo p | ./sparse $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable routetable "2.2.2.2 via 10.1.0.0/16 9.9.9.9 via 0.0.0.0/0" \
+  "printf 'i 10.0.0.0/8 1.1.1.1\ni 10.1.0.0/16 2.2.2.2\ni 0.0.0.0/0 9.9.9.9\nr 10.0.0.0/8\n' | ./routetable $pool" \
+  "printf 'l 10.1.2.3\nl 10.2.0.1\n' | ./routetable $pool | sed 's/\\$//g' | xargs echo"
+
+assert_durable bitcask "a 3 c 4" \
+  "printf 's a 1\ns b two words\ns a 3\nr b\nc\ns c 4\n' | ./bitcask $pool" \
+  "echo p | ./bitcask $pool | sed 's/\\$//g' | xargs echo"
+
+rm -f $pool
+exit $failed
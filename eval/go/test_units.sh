@@ -0,0 +1,32 @@
+#!/bin/bash
+
+# Runs the Go tests of the examples. Every example is a main package of its
+# own in this directory, so each is tested together with the files build.sh
+# builds it from, in a process of its own; btree_map is tested in its debug
+# build too. durable_test.go, shared by all of them, provides AssertDurable;
+# profile_test.go and shutdown_test.go test profile.go and shutdown.go, and
+# are run once, with btree; replay_test.go tests replay.go, with simplekv, and
+# repl_test.go tests repl.go, with hashmap_atomic. The tests of skiplist,
+# rbtree_map, bplustree and lru check the invariants of their structures.
+#
+# usage: test_units.sh [go test flags]
+
+full_path=$(realpath $0)
+dir_path=$(dirname $full_path)
+failed=0
+
+cd $dir_path
+source $HOME/.corundum/env
+export GO111MODULE=off
+
+go test -txn "$@" btree.go profile.go shutdown.go btree_test.go durable_test.go profile_test.go shutdown_test.go || failed=1
+go test -txn "$@" btree_map.go btree_map_release.go replay.go profile.go repl.go shutdown.go btree_map_test.go durable_test.go || failed=1
+go test -txn -tags corundum_debug "$@" btree_map.go btree_map_debug.go replay.go profile.go repl.go shutdown.go btree_map_test.go durable_test.go || failed=1
+go test -txn "$@" simplekv.go replay.go profile.go shutdown.go simplekv_test.go durable_test.go replay_test.go || failed=1
+go test -txn "$@" hashmap_atomic.go repl.go shutdown.go hashmap_atomic_test.go repl_test.go || failed=1
+go test -txn "$@" skiplist.go repl.go shutdown.go skiplist_test.go || failed=1
+go test -txn "$@" rbtree_map.go repl.go shutdown.go rbtree_map_test.go || failed=1
+go test -txn "$@" bplustree.go repl.go shutdown.go bplustree_test.go || failed=1
+go test -txn "$@" lru.go repl.go shutdown.go lru_test.go || failed=1
+
+exit $failed
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* seed of treap_rand when none is given, so that runs repeat by default */
+const TREAP_DEFAULT_SEED int64 = 1
+
+/*
+ * node_t -- the keys are in search tree order and the priorities in heap
+ * order, no child having a higher priority than its parent
+ */
+type node_t struct {
+	key   int
+	value int
+	prio  int
+	left  *node_t
+	right *node_t
+}
+
+type data struct {
+	root  *node_t
+	count int
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x1E9A5C73D04B62F8
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.root = nil
+		ptr.count = 0
+		ptr.magic = magic
+	}
+}
+
+/*
+ * the source of the priorities and of the random keys, seeded from the
+ * command line
+ */
+var treap_rand = rand.New(rand.NewSource(TREAP_DEFAULT_SEED))
+
+/*
+ * the rotations done by the mutators since the program started, and the
+ * number of mutations
+ */
+var treap_rotations int = 0
+var treap_mutations int = 0
+
+/*
+ * treap_rotate_right -- (internal) lifts the left child of the node at link
+ * in its place
+ */
+func treap_rotate_right(link **node_t) {
+	n := *link
+	l := n.left
+	n.left = l.right
+	l.right = n
+	*link = l
+	treap_rotations++
+}
+
+/*
+ * treap_rotate_left -- (internal) lifts the right child of the node at link
+ * in its place
+ */
+func treap_rotate_left(link **node_t) {
+	n := *link
+	r := n.right
+	n.right = r.left
+	r.left = n
+	*link = r
+	treap_rotations++
+}
+
+/*
+ * treap_insert_in -- (internal) inserts the pair as a leaf below link, then
+ * rotates it up while its priority is above the one of its parent; returns
+ * whether the key is new
+ */
+func treap_insert_in(link **node_t, key int, value int, prio int) bool {
+	n := *link
+	if n == nil {
+		n = pnew(node_t)
+		n.key = key
+		n.value = value
+		n.prio = prio
+		*link = n
+		return true
+	}
+	if key == n.key {
+		n.value = value
+		return false
+	}
+	if key < n.key {
+		if !treap_insert_in(&n.left, key, value, prio) {
+			return false
+		}
+		if n.left.prio > n.prio {
+			treap_rotate_right(link)
+		}
+	} else {
+		if !treap_insert_in(&n.right, key, value, prio) {
+			return false
+		}
+		if n.right.prio > n.prio {
+			treap_rotate_left(link)
+		}
+	}
+	return true
+}
+
+/*
+ * treap_insert -- inserts a key-value pair, replacing the value of the key if
+ * it is present; the rotations happen in the transaction of the insert,
+ * which a full pool rolls back with ErrPoolFull
+ */
+func treap_insert(ptr *data, key int, value int) (err error) {
+	defer pool_full(&err)
+
+	prio := treap_rand.Int()
+	treap_mutations++
+	txn("undo") {
+		if treap_insert_in(&ptr.root, key, value, prio) {
+			ptr.count++
+		}
+	}
+	return nil
+}
+
+/*
+ * treap_find -- (internal) returns the link to the node of the key, which
+ * points to nil if the key is not in the tree
+ */
+func treap_find(ptr *data, key int) **node_t {
+	link := &ptr.root
+	for *link != nil && (*link).key != key {
+		if key < (*link).key {
+			link = &(*link).left
+		} else {
+			link = &(*link).right
+		}
+	}
+	return link
+}
+
+/*
+ * treap_remove -- removes the key from the tree, returning its value and
+ * whether it was found; the node is rotated down, below the child of higher
+ * priority each time, until it is a leaf which can be cut off
+ */
+func treap_remove(ptr *data, key int) (int, bool) {
+	link := treap_find(ptr, key)
+	n := *link
+	if n == nil {
+		return 0, false
+	}
+	treap_mutations++
+	txn("undo") {
+		for n.left != nil || n.right != nil {
+			if n.right == nil || n.left != nil && n.left.prio > n.right.prio {
+				treap_rotate_right(link)
+				link = &(*link).right
+			} else {
+				treap_rotate_left(link)
+				link = &(*link).left
+			}
+		}
+		*link = nil
+		ptr.count--
+	}
+	return n.value, true
+}
+
+/*
+ * treap_get -- searches for the value of the key
+ */
+func treap_get(ptr *data, key int) (int, bool) {
+	if n := *treap_find(ptr, key); n != nil {
+		return n.value, true
+	}
+	return 0, false
+}
+
+/*
+ * treap_lookup -- checks if the key exists in the tree
+ */
+func treap_lookup(ptr *data, key int) bool {
+	return *treap_find(ptr, key) != nil
+}
+
+/*
+ * treap_foreach_node -- (internal) calls cb for every pair below the node in
+ * key order
+ */
+func treap_foreach_node(n *node_t, cb func(int, int) bool) bool {
+	if n == nil {
+		return false
+	}
+	return treap_foreach_node(n.left, cb) || cb(n.key, n.value) ||
+		treap_foreach_node(n.right, cb)
+}
+
+/*
+ * treap_foreach -- calls cb for every pair in key order, stopping early when
+ * cb returns true
+ */
+func treap_foreach(ptr *data, cb func(int, int) bool) bool {
+	return treap_foreach_node(ptr.root, cb)
+}
+
+/*
+ * treap_clear -- removes all pairs from the tree
+ */
+func treap_clear(ptr *data) {
+	txn("undo") {
+		ptr.root = nil
+		ptr.count = 0
+	}
+}
+
+/*
+ * treap_check_node -- (internal) verifies the subtree of the node, whose keys
+ * must be within lo and hi when these are not nil; returns its number of
+ * nodes and its height
+ */
+func treap_check_node(n *node_t, lo *int, hi *int) (int, int, error) {
+	if n == nil {
+		return 0, 0, nil
+	}
+	if lo != nil && n.key <= *lo || hi != nil && n.key >= *hi {
+		return 0, 0, fmt.Errorf("key %d is out of order", n.key)
+	}
+	for _, child := range []*node_t{n.left, n.right} {
+		if child != nil && child.prio > n.prio {
+			return 0, 0, fmt.Errorf("key %d has a higher priority than its parent %d",
+				child.key, n.key)
+		}
+	}
+	lcount, lheight, err := treap_check_node(n.left, lo, &n.key)
+	if err != nil {
+		return 0, 0, err
+	}
+	rcount, rheight, err := treap_check_node(n.right, &n.key, hi)
+	if err != nil {
+		return 0, 0, err
+	}
+	if rheight > lheight {
+		lheight = rheight
+	}
+	return lcount + rcount + 1, lheight + 1, nil
+}
+
+/*
+ * treap_check -- verifies the key order, the priority order and count;
+ * returns the height of the tree
+ */
+func treap_check(ptr *data) (int, error) {
+	count, height, err := treap_check_node(ptr.root, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	if count != ptr.count {
+		return 0, fmt.Errorf("%d nodes, count is %d", count, ptr.count)
+	}
+	return height, nil
+}
+
+/*
+ * str_insert -- treap_insert wrapper which works on strings
+ */
+func str_insert(ptr *data, str string) {
+	var key int
+	if scan_args("insert", str, "%d", &key) {
+		if err := treap_insert(ptr, key, 0); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- treap_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key int
+	if scan_args("remove", str, "%d", &key) {
+		if _, ok := treap_remove(ptr, key); !ok {
+			fmt.Println("no such value")
+		}
+	}
+}
+
+/*
+ * str_check -- treap_lookup wrapper which works on strings
+ */
+func str_check(ptr *data, str string) {
+	var key int
+	if scan_args("check", str, "%d", &key) {
+		fmt.Println(treap_lookup(ptr, key))
+	}
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random numbers
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			if err := treap_insert(ptr, treap_rand.Int(), 0); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"i $value - insert $value",
+		"r $value - remove $value",
+		"c $value - check $value, returns 0/1",
+		"n $value - insert $value random values",
+		"p - print all values",
+		"d - print debug info",
+		"x - remove all values",
+	)
+}
+
+func print_all(ptr *data) {
+	treap_foreach(ptr, func(key int, value int) bool {
+		fmt.Print(key, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	if height, err := treap_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("entries:", ptr.count, "height:", height)
+	}
+	if treap_mutations > 0 {
+		fmt.Printf("rotations per mutation: %.2f\n",
+			float64(treap_rotations) / float64(treap_mutations))
+	}
+}
+
+/*
+ * Run -- opens the tree named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("treap", flag.ContinueOnError)
+	flags.Usage = func() {}
+	seed := flags.Int64("seed", TREAP_DEFAULT_SEED, "seed of the priorities and of the random keys")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	treap_rand.Seed(*seed)
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'c': str_check(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': treap_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "[-seed n] filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
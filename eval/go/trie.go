@@ -0,0 +1,401 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/*
+ * node_t -- one byte of the keys below it; the children of a node_t are
+ * chained through sibling in increasing order of their label
+ */
+type node_t struct {
+	label     byte
+	has_value bool /* a key ends here */
+	value     int
+	child     *node_t
+	sibling   *node_t
+}
+
+type data struct {
+	root  node_t /* the empty key, its label is unused */
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x2F91D4B6A07C35E8
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.root = node_t{}
+		ptr.magic = magic
+	}
+}
+
+/*
+ * trie_find_child -- (internal) returns the slot in the chain of children of
+ * n where the child labeled b is, or would be inserted
+ */
+func trie_find_child(n *node_t, b byte) **node_t {
+	ref := &n.child
+	for *ref != nil && (*ref).label < b {
+		ref = &(*ref).sibling
+	}
+	return ref
+}
+
+/*
+ * trie_find -- (internal) returns the node_t reached by the bytes of key, or
+ * nil
+ */
+func trie_find(ptr *data, key string) *node_t {
+	n := &ptr.root
+	for i := 0; i < len(key) && n != nil; i++ {
+		c := *trie_find_child(n, key[i])
+		if c == nil || c.label != key[i] {
+			return nil
+		}
+		n = c
+	}
+	return n
+}
+
+/*
+ * trie_insert -- inserts the key with the value, replacing the value if the
+ * key is present; the missing nodes are allocated and chained before they
+ * are linked in, so a full pool leaves the trie unchanged
+ */
+func trie_insert(ptr *data, key string, value int) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		/* follow the nodes which exist */
+		n := &ptr.root
+		i := 0
+		for ; i < len(key); i++ {
+			c := *trie_find_child(n, key[i])
+			if c == nil || c.label != key[i] {
+				break
+			}
+			n = c
+		}
+		if i == len(key) {
+			n.has_value = true
+			n.value = value
+			return nil
+		}
+
+		/* build the rest of the key bottom up */
+		var chain *node_t = nil
+		for j := len(key) - 1; j >= i; j-- {
+			c := pnew(node_t)
+			c.label = key[j]
+			c.child = chain
+			if chain == nil {
+				c.has_value = true
+				c.value = value
+			}
+			chain = c
+		}
+
+		ref := trie_find_child(n, key[i])
+		chain.sibling = *ref
+		*ref = chain
+	}
+	return nil
+}
+
+/*
+ * trie_get -- searches for the value of the key
+ */
+func trie_get(ptr *data, key string) (int, bool) {
+	if n := trie_find(ptr, key); n != nil && n.has_value {
+		return n.value, true
+	}
+	return 0, false
+}
+
+/*
+ * trie_lookup -- checks if the key exists in the trie
+ */
+func trie_lookup(ptr *data, key string) bool {
+	_, ok := trie_get(ptr, key)
+	return ok
+}
+
+/*
+ * trie_remove_at -- (internal) removes key[depth:] from the subtrie of n and
+ * unlinks the nodes left without keys; returns the value and whether the
+ * key was found
+ */
+func trie_remove_at(n *node_t, key string, depth int) (int, bool) {
+	if depth == len(key) {
+		if !n.has_value {
+			return 0, false
+		}
+		n.has_value = false
+		return n.value, true
+	}
+
+	ref := trie_find_child(n, key[depth])
+	c := *ref
+	if c == nil || c.label != key[depth] {
+		return 0, false
+	}
+	value, found := trie_remove_at(c, key, depth + 1)
+	if found && !c.has_value && c.child == nil {
+		*ref = c.sibling
+	}
+	return value, found
+}
+
+/*
+ * trie_remove -- removes the key from the trie, returning its value and
+ * whether it was found
+ */
+func trie_remove(ptr *data, key string) (int, bool) {
+	if !trie_lookup(ptr, key) {
+		return 0, false
+	}
+	value, found := 0, false
+	txn("undo") {
+		value, found = trie_remove_at(&ptr.root, key, 0)
+	}
+	return value, found
+}
+
+/*
+ * trie_foreach_node -- (internal) calls cb for the keys of the subtrie of n,
+ * whose path spells key, in lexicographic order
+ */
+func trie_foreach_node(n *node_t, key []byte, cb func(string, int) bool) bool {
+	if n.has_value && cb(string(key), n.value) {
+		return true
+	}
+	for c := n.child; c != nil; c = c.sibling {
+		if trie_foreach_node(c, append(key, c.label), cb) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * trie_foreach_prefix -- calls cb for every key starting with prefix in
+ * lexicographic order, stopping early when cb returns true
+ */
+func trie_foreach_prefix(ptr *data, prefix string, cb func(string, int) bool) bool {
+	n := trie_find(ptr, prefix)
+	if n == nil {
+		return false
+	}
+	return trie_foreach_node(n, []byte(prefix), cb)
+}
+
+/*
+ * trie_foreach -- calls cb for every key in lexicographic order, stopping
+ * early when cb returns true
+ */
+func trie_foreach(ptr *data, cb func(string, int) bool) bool {
+	return trie_foreach_prefix(ptr, "", cb)
+}
+
+/*
+ * trie_clear -- removes all keys from the trie
+ */
+func trie_clear(ptr *data) {
+	txn("undo") {
+		ptr.root = node_t{}
+	}
+}
+
+/*
+ * trie_check_node -- (internal) verifies that the children of n are sorted
+ * and that every leaf ends a key, returning the number of nodes and the
+ * depth of the subtrie
+ */
+func trie_check_node(n *node_t, depth int) (int, int, error) {
+	nodes, deepest := 1, depth
+	if n.child == nil && !n.has_value && depth > 0 {
+		return 0, 0, fmt.Errorf("leaf at depth %d ends no key", depth)
+	}
+	for c := n.child; c != nil; c = c.sibling {
+		if c.sibling != nil && c.sibling.label <= c.label {
+			return 0, 0, fmt.Errorf("children %q and %q at depth %d are out of order",
+				c.label, c.sibling.label, depth + 1)
+		}
+		cn, cd, err := trie_check_node(c, depth + 1)
+		if err != nil {
+			return 0, 0, err
+		}
+		nodes += cn
+		if cd > deepest {
+			deepest = cd
+		}
+	}
+	return nodes, deepest, nil
+}
+
+/*
+ * trie_check -- verifies the whole trie, returning its number of nodes,
+ * the root included, and its depth
+ */
+func trie_check(ptr *data) (int, int, error) {
+	return trie_check_node(&ptr.root, 0)
+}
+
+/*
+ * str_insert -- inserts the key and the value given as a string
+ */
+func str_insert(ptr *data, str string) {
+	var key string
+	var value int
+	if scan_args("insert", str, "%s %d", &key, &value) {
+		if err := trie_insert(ptr, key, value); err != nil {
+			fmt.Println("insert:", err)
+		}
+	}
+}
+
+/*
+ * str_remove -- trie_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var key string
+	if scan_args("remove", str, "%s", &key) {
+		if _, ok := trie_remove(ptr, key); !ok {
+			fmt.Println("no such key")
+		}
+	}
+}
+
+/*
+ * str_get -- prints the value of the key given as a string
+ */
+func str_get(ptr *data, str string) {
+	var key string
+	if scan_args("get", str, "%s", &key) {
+		if value, ok := trie_get(ptr, key); ok {
+			fmt.Println(value)
+		} else {
+			fmt.Println("no such key")
+		}
+	}
+}
+
+/*
+ * str_prefix -- prints the keys starting with the prefix given as a string,
+ * all of them if it is empty
+ */
+func str_prefix(ptr *data, str string) {
+	trie_foreach_prefix(ptr, strings.TrimSpace(str), func(key string, value int) bool {
+		fmt.Println(key, value)
+		return false
+	})
+}
+
+/*
+ * str_insert_random -- inserts specified (as string) number of random keys
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			key := fmt.Sprintf("%x", rand.Int63())
+			if err := trie_insert(ptr, key, i); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"i $key $value - insert $key with $value",
+		"r $key - remove $key",
+		"g $key - print the value of $key",
+		"f $prefix - print the keys starting with $prefix",
+		"n $value - insert $value random keys",
+		"p - print all keys",
+		"d - print debug info",
+		"x - remove all keys",
+	)
+}
+
+func print_all(ptr *data) {
+	trie_foreach(ptr, func(key string, value int) bool {
+		fmt.Print(key, " ")
+		return false
+	})
+	fmt.Println()
+}
+
+func print_debug(ptr *data) {
+	nodes, depth, err := trie_check(ptr)
+	if err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("nodes:", nodes, "depth:", depth)
+	}
+}
+
+/*
+ * Run -- opens the trie named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("trie", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'i': str_insert(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 'g': str_get(ptr, buf[1:])
+			case 'f': str_prefix(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': trie_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
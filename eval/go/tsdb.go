@@ -0,0 +1,529 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* points per chunk */
+const TS_CHUNK_POINTS int = 128
+
+/* initial room of the series directory, and of the chunk list of a series */
+const TS_MIN_SERIES int = 4
+const TS_MIN_CHUNKS int = 4
+
+/* number of series the benchmark spreads its points over */
+const TS_BENCH_SERIES int = 8
+
+/*
+ * chunk_t -- up to TS_CHUNK_POINTS points of a series, in timestamp order
+ */
+type chunk_t struct {
+	ts     [TS_CHUNK_POINTS]int64
+	values [TS_CHUNK_POINTS]float64
+	n      int
+}
+
+/*
+ * series_t -- the points of a series, in chunks of increasing timestamps,
+ * all full but the last; the capacity of chunks is the room left before the
+ * list is reallocated
+ */
+type series_t struct {
+	name   []byte
+	chunks []*chunk_t
+	count  int
+}
+
+/*
+ * data -- the series directory, sorted by name; its capacity is the room
+ * left before it is reallocated
+ */
+type data struct {
+	series []*series_t
+	magic  int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x3D8B5E1F07A26C94
+)
+
+var ErrOutOfOrder = errors.New("timestamp is not after the last one of the series")
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.series = pmake([]*series_t, 0, TS_MIN_SERIES)
+		ptr.magic = magic
+	}
+}
+
+/*
+ * ts_find -- (internal) returns the position of the series name in the
+ * directory, or where it would go, and whether it is there
+ */
+func ts_find(ptr *data, name string) (int, bool) {
+	i := sort.Search(len(ptr.series), func(j int) bool {
+		return string(ptr.series[j].name) >= name
+	})
+	return i, i < len(ptr.series) && string(ptr.series[i].name) == name
+}
+
+/*
+ * ts_series -- returns the series name, or nil if it has no points
+ */
+func ts_series(ptr *data, name string) *series_t {
+	if i, found := ts_find(ptr, name); found {
+		return ptr.series[i]
+	}
+	return nil
+}
+
+/*
+ * ts_create -- (internal) adds an empty series name at position i of the
+ * directory, which is copied to an array of twice the capacity if it is
+ * full; the series starts with one chunk; must be called in a transaction
+ */
+func ts_create(ptr *data, i int, name string) *series_t {
+	s := pnew(series_t)
+	s.name = pmake([]byte, len(name))
+	s.chunks = pmake([]*chunk_t, 0, TS_MIN_CHUNKS)
+	copy(s.name, name)
+	ts_new_chunk(s)
+
+	dir := ptr.series
+	if len(dir) == cap(dir) {
+		dir = pmake([]*series_t, len(dir), 2 * cap(dir))
+		copy(dir, ptr.series)
+	}
+	dir = dir[:len(dir) + 1]
+	copy(dir[i + 1:], dir[i:])
+	dir[i] = s
+	ptr.series = dir
+	return s
+}
+
+/*
+ * ts_new_chunk -- (internal) adds an empty chunk at the end of series s,
+ * copying its chunk list to an array of twice the capacity if it is full;
+ * must be called in a transaction
+ */
+func ts_new_chunk(s *series_t) *chunk_t {
+	c := pnew(chunk_t)
+	chunks := s.chunks
+	if len(chunks) == cap(chunks) {
+		chunks = pmake([]*chunk_t, len(chunks), 2 * cap(chunks))
+		copy(chunks, s.chunks)
+	}
+	chunks = chunks[:len(chunks) + 1]
+	chunks[len(chunks) - 1] = c
+	s.chunks = chunks
+	return c
+}
+
+/*
+ * ts_last -- returns the timestamp of the last point of series s, and
+ * false if it has none
+ */
+func ts_last(s *series_t) (int64, bool) {
+	if s.count == 0 {
+		return 0, false
+	}
+	c := s.chunks[len(s.chunks) - 1]
+	return c.ts[c.n - 1], true
+}
+
+/*
+ * ts_append -- appends the point (ts, value) to the series name, creating
+ * the series on its first point; ts must be after the last timestamp of the
+ * series; a full pool rolls the append back with ErrPoolFull
+ */
+func ts_append(ptr *data, name string, ts int64, value float64) (err error) {
+	defer pool_full(&err)
+	i, found := ts_find(ptr, name)
+	if found {
+		if last, ok := ts_last(ptr.series[i]); ok && ts <= last {
+			return ErrOutOfOrder
+		}
+	}
+	txn("undo") {
+		var s *series_t
+		if found {
+			s = ptr.series[i]
+		} else {
+			s = ts_create(ptr, i, name)
+		}
+		var c *chunk_t
+		if len(s.chunks) > 0 {
+			c = s.chunks[len(s.chunks) - 1]
+		}
+		if c == nil || c.n == TS_CHUNK_POINTS {
+			c = ts_new_chunk(s)
+		}
+		c.ts[c.n] = ts
+		c.values[c.n] = value
+		c.n++
+		s.count++
+	}
+	return nil
+}
+
+/*
+ * ts_range -- calls cb for the points of series s from timestamp from to
+ * to, both included, in order, stopping early when cb returns true; the
+ * first chunk is found by binary search
+ */
+func ts_range(s *series_t, from int64, to int64, cb func(int64, float64) bool) bool {
+	k := sort.Search(len(s.chunks), func(j int) bool {
+		c := s.chunks[j]
+		return c.ts[c.n - 1] >= from
+	})
+	for ; k < len(s.chunks); k++ {
+		c := s.chunks[k]
+		for j := 0; j < c.n; j++ {
+			if c.ts[j] < from {
+				continue
+			}
+			if c.ts[j] > to {
+				return false
+			}
+			if cb(c.ts[j], c.values[j]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * ts_drop -- removes the series name with all its points, returning whether
+ * it was there
+ */
+func ts_drop(ptr *data, name string) bool {
+	i, found := ts_find(ptr, name)
+	if !found {
+		return false
+	}
+	txn("undo") {
+		dir := ptr.series
+		copy(dir[i:], dir[i + 1:])
+		dir[len(dir) - 1] = nil
+		ptr.series = dir[:len(dir) - 1]
+	}
+	return true
+}
+
+/*
+ * ts_foreach_series -- calls cb for every series in name order, stopping
+ * early when cb returns true
+ */
+func ts_foreach_series(ptr *data, cb func(*series_t) bool) bool {
+	for _, s := range ptr.series {
+		if cb(s) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * ts_clear -- removes all series
+ */
+func ts_clear(ptr *data) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		dir := pmake([]*series_t, 0, TS_MIN_SERIES)
+		ptr.series = dir
+	}
+	return nil
+}
+
+/*
+ * ts_bench -- appends n points with increasing timestamps, spread round
+ * robin over TS_BENCH_SERIES series named bench.0 and on, one transaction
+ * each, then reads every series back with range reads of a hundredth of
+ * its span, and prints the throughput of both; the bench series are
+ * dropped afterwards, and any already there beforehand too
+ */
+func ts_bench(ptr *data, n int) error {
+	names := make([]string, TS_BENCH_SERIES)
+	for i := range names {
+		names[i] = fmt.Sprintf("bench.%d", i)
+		ts_drop(ptr, names[i])
+	}
+	defer func() {
+		for _, name := range names {
+			ts_drop(ptr, name)
+		}
+	}()
+
+	base := time.Now().UnixNano()
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		ts := base + int64(i / TS_BENCH_SERIES) * int64(time.Millisecond)
+		if err := ts_append(ptr, names[i % TS_BENCH_SERIES], ts, rand.Float64()); err != nil {
+			return err
+		}
+	}
+	appended := time.Since(start)
+
+	span := int64(n / TS_BENCH_SERIES + 1) * int64(time.Millisecond)
+	window := span / 100 + 1
+	points, reads := 0, 0
+	start = time.Now()
+	for _, name := range names {
+		s := ts_series(ptr, name)
+		if s == nil {
+			continue
+		}
+		for from := base; from < base + span; from += window {
+			ts_range(s, from, from + window - 1, func(int64, float64) bool {
+				points++
+				return false
+			})
+			reads++
+		}
+	}
+	read := time.Since(start)
+
+	fmt.Printf("append: %d points in %v, %.0f points/s\n", n, appended,
+		float64(n) / appended.Seconds())
+	fmt.Printf("range: %d reads of %d points in %v, %.0f points/s\n", reads, points,
+		read, float64(points) / read.Seconds())
+	return nil
+}
+
+/*
+ * ts_check -- verifies that the directory is sorted by name without
+ * duplicates, and that in every series the chunks are full but the last,
+ * the timestamps increase and count is right
+ */
+func ts_check(ptr *data) (int, int, error) {
+	points, chunks := 0, 0
+	for i, s := range ptr.series {
+		if i > 0 && string(ptr.series[i - 1].name) >= string(s.name) {
+			return 0, 0, fmt.Errorf("series %s is out of order", s.name)
+		}
+		n := 0
+		var last int64
+		for k, c := range s.chunks {
+			if c.n <= 0 || c.n > TS_CHUNK_POINTS ||
+				(c.n < TS_CHUNK_POINTS && k < len(s.chunks) - 1) {
+				return 0, 0, fmt.Errorf("chunk %d of series %s holds %d points",
+					k, s.name, c.n)
+			}
+			for j := 0; j < c.n; j++ {
+				if n > 0 && c.ts[j] <= last {
+					return 0, 0, fmt.Errorf("timestamp %d of series %s follows %d",
+						c.ts[j], s.name, last)
+				}
+				last = c.ts[j]
+				n++
+			}
+		}
+		if n != s.count || n == 0 {
+			return 0, 0, fmt.Errorf("series %s has %d points, count is %d",
+				s.name, n, s.count)
+		}
+		points += n
+		chunks += len(s.chunks)
+	}
+	return points, chunks, nil
+}
+
+/*
+ * str_append -- appends a point to a series, name, timestamp and value
+ * given as a string
+ */
+func str_append(ptr *data, str string) {
+	var name string
+	var ts int64
+	var value float64
+	if scan_args("append", str, "%s %d %g", &name, &ts, &value) {
+		if err := ts_append(ptr, name, ts, value); err != nil {
+			fmt.Println("append:", err)
+		}
+	}
+}
+
+/*
+ * str_range -- prints the points of a series between two timestamps, all
+ * given as a string
+ */
+func str_range(ptr *data, str string) {
+	var name string
+	var from, to int64
+	if scan_args("range", str, "%s %d %d", &name, &from, &to) {
+		s := ts_series(ptr, name)
+		if s == nil {
+			fmt.Println("no such series")
+			return
+		}
+		ts_range(s, from, to, func(ts int64, value float64) bool {
+			fmt.Println(ts, value)
+			return false
+		})
+	}
+}
+
+/*
+ * str_drop -- ts_drop wrapper which works on strings
+ */
+func str_drop(ptr *data, str string) {
+	var name string
+	if scan_args("drop", str, "%s", &name) {
+		if !ts_drop(ptr, name) {
+			fmt.Println("no such series")
+		}
+	}
+}
+
+/*
+ * str_bench -- ts_bench wrapper which works on strings
+ */
+func str_bench(ptr *data, str string) {
+	var n int
+	if _, err := fmt.Sscanf(str, "%d", &n); err == nil && n > 0 {
+		if err := ts_bench(ptr, n); err != nil {
+			fmt.Println("bench:", err)
+		}
+	} else {
+		fmt.Println("bench: invalid syntax")
+	}
+}
+
+/*
+ * str_insert_random -- appends specified (as string) number of random
+ * values to series random.0 to random.3, a random interval after the last
+ * point of each
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			name := fmt.Sprintf("random.%d", rand.Intn(4))
+			var ts int64
+			if s := ts_series(ptr, name); s != nil {
+				ts, _ = ts_last(s)
+			}
+			if err := ts_append(ptr, name, ts + 1 + rand.Int63n(1000), rand.Float64()); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+/*
+ * str_clear -- ts_clear wrapper which reports its error
+ */
+func str_clear(ptr *data) {
+	if err := ts_clear(ptr); err != nil {
+		fmt.Println("clear:", err)
+	}
+}
+
+func help() {
+	print_help(
+		"a $series $ts $value - append the point ($ts, $value) to $series",
+		"r $series $from $to - print the points of $series from $from to $to",
+		"R $series - remove $series with all its points",
+		"b $count - append $count points, read them back, print the throughput",
+		"n $value - append $value random points",
+		"p - print all series with their number of points and time span",
+		"d - print debug info",
+		"x - remove all series",
+	)
+}
+
+func print_all(ptr *data) {
+	ts_foreach_series(ptr, func(s *series_t) bool {
+		first := s.chunks[0].ts[0]
+		last, _ := ts_last(s)
+		fmt.Println(string(s.name), s.count, first, last)
+		return false
+	})
+}
+
+func print_debug(ptr *data) {
+	points, chunks, err := ts_check(ptr)
+	if err != nil {
+		fmt.Println("invariants:", err)
+		return
+	}
+	fmt.Println("invariants: ok")
+	fill := 0.0
+	if chunks > 0 {
+		fill = float64(points) / float64(chunks * TS_CHUNK_POINTS)
+	}
+	fmt.Printf("series: %d points: %d chunks: %d fill: %.2f\n", len(ptr.series), points,
+		chunks, fill)
+}
+
+/*
+ * Run -- opens the store named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("tsdb", flag.ContinueOnError)
+	flags.Usage = func() {}
+	bench := flags.Int("bench", 0, "append `n` points, read them back, print the throughput and exit")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	if *bench < 0 {
+		return usage_error("the bench count cannot be negative")
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	if *bench > 0 {
+		return ts_bench(ptr, *bench)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'a': str_append(ptr, buf[1:])
+			case 'r': str_range(ptr, buf[1:])
+			case 'R': str_drop(ptr, buf[1:])
+			case 'b': str_bench(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "[-bench n] filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* number of elements of a new structure */
+const UF_DEFAULT_SIZE int = 1024
+
+/*
+ * data -- the elements are 0 to len(parent) - 1; an element is the root of
+ * its set when it is its own parent, and only the rank of a root matters
+ */
+type data struct {
+	parent []int
+	rank   []int
+	sets   int
+	magic  int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x4D2E7A91C05F386B
+)
+
+/*
+ * initialize -- creates n elements, each in a set of its own
+ */
+func initialize(ptr *data, n int) {
+	txn("undo") {
+		ptr.parent = pmake([]int, n)
+		ptr.rank = pmake([]int, n)
+		for i := range ptr.parent {
+			ptr.parent[i] = i
+		}
+		ptr.sets = n
+		ptr.magic = magic
+	}
+}
+
+/* returned for an element out of range */
+var ErrNoElement = errors.New("no such element")
+
+/*
+ * uf_valid -- (internal) checks if x names an element
+ */
+func uf_valid(ptr *data, x int) bool {
+	return x >= 0 && x < len(ptr.parent)
+}
+
+/*
+ * uf_root -- (internal) returns the root of the set of x, pointing every
+ * element on the way straight at it; must be called in a transaction
+ */
+func uf_root(ptr *data, x int) int {
+	root := x
+	for ptr.parent[root] != root {
+		root = ptr.parent[root]
+	}
+	for ptr.parent[x] != root {
+		next := ptr.parent[x]
+		ptr.parent[x] = root
+		x = next
+	}
+	return root
+}
+
+/*
+ * uf_find -- returns the representative of the set of x, compressing the path
+ * to it in one transaction
+ */
+func uf_find(ptr *data, x int) (int, error) {
+	if !uf_valid(ptr, x) {
+		return 0, ErrNoElement
+	}
+	root := x
+	txn("undo") {
+		root = uf_root(ptr, x)
+	}
+	return root, nil
+}
+
+/*
+ * uf_union -- merges the sets of x and y, hanging the root of lower rank
+ * under the other; returns whether they were apart
+ */
+func uf_union(ptr *data, x int, y int) (bool, error) {
+	if !uf_valid(ptr, x) || !uf_valid(ptr, y) {
+		return false, ErrNoElement
+	}
+	merged := false
+	txn("undo") {
+		a, b := uf_root(ptr, x), uf_root(ptr, y)
+		if a != b {
+			if ptr.rank[a] < ptr.rank[b] {
+				a, b = b, a
+			}
+			ptr.parent[b] = a
+			if ptr.rank[a] == ptr.rank[b] {
+				ptr.rank[a]++
+			}
+			ptr.sets--
+			merged = true
+		}
+	}
+	return merged, nil
+}
+
+/*
+ * uf_connected -- checks if x and y are in the same set
+ */
+func uf_connected(ptr *data, x int, y int) (bool, error) {
+	a, err := uf_find(ptr, x)
+	if err != nil {
+		return false, err
+	}
+	b, err := uf_find(ptr, y)
+	if err != nil {
+		return false, err
+	}
+	return a == b, nil
+}
+
+/*
+ * uf_clear -- puts every element back in a set of its own
+ */
+func uf_clear(ptr *data) {
+	txn("undo") {
+		for i := range ptr.parent {
+			ptr.parent[i] = i
+			ptr.rank[i] = 0
+		}
+		ptr.sets = len(ptr.parent)
+	}
+}
+
+/*
+ * uf_check -- verifies that every parent is an element of higher rank, which
+ * rules out cycles, and that sets counts the roots; returns the highest rank
+ */
+func uf_check(ptr *data) (int, error) {
+	if len(ptr.rank) != len(ptr.parent) {
+		return 0, fmt.Errorf("%d ranks for %d elements", len(ptr.rank), len(ptr.parent))
+	}
+	roots, height := 0, 0
+	for x, p := range ptr.parent {
+		if p == x {
+			roots++
+		} else if !uf_valid(ptr, p) {
+			return 0, fmt.Errorf("element %d has parent %d", x, p)
+		} else if ptr.rank[p] <= ptr.rank[x] {
+			return 0, fmt.Errorf("element %d of rank %d has parent %d of rank %d",
+				x, ptr.rank[x], p, ptr.rank[p])
+		}
+		if ptr.rank[x] > height {
+			height = ptr.rank[x]
+		}
+	}
+	if roots != ptr.sets {
+		return 0, fmt.Errorf("%d sets, count is %d", roots, ptr.sets)
+	}
+	return height, nil
+}
+
+/*
+ * str_union -- uf_union wrapper which works on strings
+ */
+func str_union(ptr *data, str string) {
+	var x, y int
+	if scan_args("union", str, "%d %d", &x, &y) {
+		if _, err := uf_union(ptr, x, y); err != nil {
+			fmt.Println("union:", err)
+		}
+	}
+}
+
+/*
+ * str_find -- prints the representative of the element given as a string
+ */
+func str_find(ptr *data, str string) {
+	var x int
+	if scan_args("find", str, "%d", &x) {
+		if root, err := uf_find(ptr, x); err == nil {
+			fmt.Println(root)
+		} else {
+			fmt.Println("find:", err)
+		}
+	}
+}
+
+/*
+ * str_connected -- uf_connected wrapper which works on strings
+ */
+func str_connected(ptr *data, str string) {
+	var x, y int
+	if scan_args("connected", str, "%d %d", &x, &y) {
+		if ok, err := uf_connected(ptr, x, y); err == nil {
+			fmt.Println(ok)
+		} else {
+			fmt.Println("connected:", err)
+		}
+	}
+}
+
+/*
+ * str_union_random -- merges the sets of specified (as string) number of
+ * random pairs of elements
+ */
+func str_union_random(ptr *data, str string) {
+	var val int
+	if scan_args("random union", str, "%d", &val) {
+		n := len(ptr.parent)
+		for i := 0; i < val; i++ {
+			uf_union(ptr, rand.Intn(n), rand.Intn(n))
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"u $x $y - merge the sets of $x and $y",
+		"f $x - print the representative of the set of $x",
+		"c $x $y - check if $x and $y are in the same set",
+		"n $value - merge the sets of $value random pairs",
+		"p - print every set with more than one element",
+		"d - print debug info",
+		"x - put every element back in a set of its own",
+	)
+}
+
+func print_all(ptr *data) {
+	members := make(map[int][]int)
+	var roots []int
+	for x := range ptr.parent {
+		root, _ := uf_find(ptr, x)
+		if members[root] == nil {
+			roots = append(roots, root)
+		}
+		members[root] = append(members[root], x)
+	}
+	for _, root := range roots {
+		if len(members[root]) > 1 {
+			fmt.Println(members[root])
+		}
+	}
+}
+
+func print_debug(ptr *data) {
+	height, err := uf_check(ptr)
+	if err != nil {
+		fmt.Println("invariants:", err)
+		return
+	}
+	fmt.Println("invariants: ok")
+	fmt.Println("elements:", len(ptr.parent), "sets:", ptr.sets, "highest rank:", height)
+}
+
+/*
+ * Run -- opens the pool named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("unionfind", flag.ContinueOnError)
+	flags.Usage = func() {}
+	size := flags.Int("size", UF_DEFAULT_SIZE, "number of elements when the structure is created")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	if *size <= 0 {
+		return usage_error("the structure needs a positive number of elements")
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr, *size)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'u': str_union(ptr, buf[1:])
+			case 'f': str_find(ptr, buf[1:])
+			case 'c': str_connected(ptr, buf[1:])
+			case 'n': str_union_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': uf_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "[-size n] filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
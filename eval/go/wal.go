@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* capacity in bytes of the first region of a log, and in records of its index */
+const WAL_MIN_BYTES int = 256
+const WAL_MIN_RECORDS int = 16
+
+/*
+ * data -- the records are stored back to back in log[:len(log)]; record
+ * first + i starts at index[i] and ends where the next one starts, or at the
+ * end of the log; the capacities of log and index are the room left before
+ * they are reallocated
+ */
+type data struct {
+	log   []byte
+	index []int
+	first int
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x17A3F5C9E0D84B62
+)
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.log = pmake([]byte, 0, WAL_MIN_BYTES)
+		ptr.index = pmake([]int, 0, WAL_MIN_RECORDS)
+		ptr.first = 0
+		ptr.magic = magic
+	}
+}
+
+var ErrNoRecord = errors.New("no such record")
+
+/*
+ * wal_next -- returns the id the next record appended will get
+ */
+func wal_next(ptr *data) int {
+	return ptr.first + len(ptr.index)
+}
+
+/*
+ * wal_grow_log -- (internal) returns the log with room for n more bytes,
+ * copied to a region of at least twice the capacity if needed; the log in
+ * ptr is left to the caller to replace; must be called in a transaction
+ */
+func wal_grow_log(ptr *data, n int) []byte {
+	if len(ptr.log) + n <= cap(ptr.log) {
+		return ptr.log
+	}
+	size := 2 * cap(ptr.log)
+	for size < len(ptr.log) + n {
+		size *= 2
+	}
+	log := pmake([]byte, len(ptr.log), size)
+	copy(log, ptr.log)
+	return log
+}
+
+/*
+ * wal_grow_index -- (internal) returns the index with room for one more
+ * offset, copied to an array of twice the capacity if needed; must be
+ * called in a transaction
+ */
+func wal_grow_index(ptr *data) []int {
+	if len(ptr.index) < cap(ptr.index) {
+		return ptr.index
+	}
+	index := pmake([]int, len(ptr.index), 2 * cap(ptr.index))
+	copy(index, ptr.index)
+	return index
+}
+
+/*
+ * wal_append -- appends a record and returns its id; the bytes and the
+ * offset are written in one transaction, which a full pool rolls back with
+ * ErrPoolFull
+ */
+func wal_append(ptr *data, rec []byte) (id int, err error) {
+	defer pool_full(&err)
+	id = wal_next(ptr)
+	txn("undo") {
+		/* both arrays are grown before either is replaced */
+		log := wal_grow_log(ptr, len(rec))
+		index := wal_grow_index(ptr)
+		off := len(log)
+		ptr.log = log[:off + len(rec)]
+		copy(ptr.log[off:], rec)
+		ptr.index = index[:len(index) + 1]
+		ptr.index[len(index)] = off
+	}
+	return id, nil
+}
+
+/*
+ * wal_record -- (internal) returns the bytes of the record at position i of
+ * the index
+ */
+func wal_record(ptr *data, i int) []byte {
+	end := len(ptr.log)
+	if i + 1 < len(ptr.index) {
+		end = ptr.index[i + 1]
+	}
+	return ptr.log[ptr.index[i]:end]
+}
+
+/*
+ * wal_read -- returns a copy of the record of the id, if it has not been
+ * truncated
+ */
+func wal_read(ptr *data, id int) ([]byte, error) {
+	if id < ptr.first || id >= wal_next(ptr) {
+		return nil, ErrNoRecord
+	}
+	rec := wal_record(ptr, id - ptr.first)
+	out := make([]byte, len(rec))
+	copy(out, rec)
+	return out, nil
+}
+
+/*
+ * wal_foreach -- calls cb for every record from the oldest on, stopping early
+ * when cb returns true
+ */
+func wal_foreach(ptr *data, cb func(int, []byte) bool) bool {
+	for i := range ptr.index {
+		if cb(ptr.first + i, wal_record(ptr, i)) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * wal_truncate -- discards the records older than id, as once a checkpoint
+ * covers them; the records kept are copied to the start of a new region of
+ * the same capacity, keeping their ids, and the old region is left to the
+ * garbage collector
+ */
+func wal_truncate(ptr *data, id int) (err error) {
+	if id > wal_next(ptr) {
+		id = wal_next(ptr)
+	}
+	if id <= ptr.first {
+		return nil
+	}
+	defer pool_full(&err)
+	drop := id - ptr.first
+	start := len(ptr.log)
+	if drop < len(ptr.index) {
+		start = ptr.index[drop]
+	}
+	txn("undo") {
+		log := pmake([]byte, len(ptr.log) - start, cap(ptr.log))
+		index := pmake([]int, len(ptr.index) - drop, cap(ptr.index))
+		copy(log, ptr.log[start:])
+		for i := range index {
+			index[i] = ptr.index[drop + i] - start
+		}
+		ptr.log = log
+		ptr.index = index
+		ptr.first = id
+	}
+	return nil
+}
+
+/*
+ * wal_clear -- discards all records; the ids go on from where they were
+ */
+func wal_clear(ptr *data) error {
+	return wal_truncate(ptr, wal_next(ptr))
+}
+
+/*
+ * wal_check -- verifies that the offsets go forward from the start of the
+ * log and stay within it
+ */
+func wal_check(ptr *data) error {
+	if ptr.first < 0 {
+		return fmt.Errorf("first record is %d", ptr.first)
+	}
+	if len(ptr.index) == 0 {
+		if len(ptr.log) != 0 {
+			return fmt.Errorf("%d bytes in a log without records", len(ptr.log))
+		}
+		return nil
+	}
+	if ptr.index[0] != 0 {
+		return fmt.Errorf("record %d starts at %d", ptr.first, ptr.index[0])
+	}
+	for i := 1; i < len(ptr.index); i++ {
+		if ptr.index[i] < ptr.index[i - 1] || ptr.index[i] > len(ptr.log) {
+			return fmt.Errorf("record %d starts at %d, after %d in a log of %d bytes",
+				ptr.first + i, ptr.index[i], ptr.index[i - 1], len(ptr.log))
+		}
+	}
+	return nil
+}
+
+/*
+ * str_append -- appends the record given as a string and prints its id
+ */
+func str_append(ptr *data, str string) {
+	rec := strings.TrimSpace(str)
+	if len(rec) == 0 {
+		fmt.Println("append: invalid syntax")
+		return
+	}
+	if id, err := wal_append(ptr, []byte(rec)); err == nil {
+		fmt.Println(id)
+	} else {
+		fmt.Println("append:", err)
+	}
+}
+
+/*
+ * str_read -- prints the record of the id given as a string
+ */
+func str_read(ptr *data, str string) {
+	var id int
+	if scan_args("read", str, "%d", &id) {
+		if rec, err := wal_read(ptr, id); err == nil {
+			fmt.Println(string(rec))
+		} else {
+			fmt.Println("read:", err)
+		}
+	}
+}
+
+/*
+ * str_truncate -- discards the records older than the id given as a string
+ */
+func str_truncate(ptr *data, str string) {
+	var id int
+	if scan_args("truncate", str, "%d", &id) {
+		if err := wal_truncate(ptr, id); err != nil {
+			fmt.Println("truncate:", err)
+		}
+	}
+}
+
+/*
+ * str_clear -- wal_clear wrapper which reports its error
+ */
+func str_clear(ptr *data) {
+	if err := wal_clear(ptr); err != nil {
+		fmt.Println("clear:", err)
+	}
+}
+
+/*
+ * str_insert_random -- appends specified (as string) number of random
+ * records
+ */
+func str_insert_random(ptr *data, str string) {
+	var val int
+	if scan_args("random insert", str, "%d", &val) {
+		for i := 0; i < val; i++ {
+			rec := []byte(fmt.Sprintf("%x", rand.Int63()))
+			if _, err := wal_append(ptr, rec); err != nil {
+				fmt.Println("random insert:", err)
+				break
+			}
+		}
+	}
+}
+
+func help() {
+	print_help(
+		"a $data - append a record holding $data, print its id",
+		"r $id - print the record of $id",
+		"t $id - discard the records older than $id",
+		"n $value - append $value random records",
+		"p - print all records with their id",
+		"d - print debug info",
+		"x - discard all records",
+	)
+}
+
+func print_all(ptr *data) {
+	wal_foreach(ptr, func(id int, rec []byte) bool {
+		fmt.Println(id, string(rec))
+		return false
+	})
+}
+
+func print_debug(ptr *data) {
+	if err := wal_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+		return
+	}
+	fmt.Println("invariants: ok")
+	fmt.Println("records:", len(ptr.index), "from id:", ptr.first, "next id:", wal_next(ptr))
+	fmt.Println("bytes:", len(ptr.log), "of", cap(ptr.log), "index:", len(ptr.index),
+		"of", cap(ptr.index))
+}
+
+/*
+ * Run -- opens the log named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("wal", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'a': str_append(ptr, buf[1:])
+			case 'r': str_read(ptr, buf[1:])
+			case 't': str_truncate(ptr, buf[1:])
+			case 'n': str_insert_random(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "filename")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+/* initial number of buckets */
+const INIT_BUCKETS_NUM int = 16
+
+/* average number of words per bucket above which the table grows */
+const MAX_LOAD_FACTOR int = 2
+
+/* number of words printed by -top when it is not given */
+const WC_DEFAULT_TOP int = 10
+
+type entry_t struct {
+	word  []byte
+	count int
+	next  *entry_t
+}
+
+type buckets_t struct {
+	bucket []*entry_t
+}
+
+/*
+ * data -- the count of every word seen, in a hashmap of its bytes, and the
+ * totals of the files counted
+ */
+type data struct {
+	buckets *buckets_t
+	nwords  int /* distinct words */
+	total   int /* words counted, repeats included */
+	files   int
+
+	magic int
+}
+
+const (
+	// A magic number used to identify if the root object initialization
+	// completed successfully.
+	magic = 0x7A4C19E3D5B06F28
+)
+
+/*
+ * new_buckets -- (internal) allocates a table of n empty buckets; must be
+ * called in a transaction
+ */
+func new_buckets(n int) *buckets_t {
+	b := pnew(buckets_t)
+	b.bucket = pmake([]*entry_t, n)
+	return b
+}
+
+func initialize(ptr *data) {
+	txn("undo") {
+		ptr.buckets = new_buckets(INIT_BUCKETS_NUM)
+		ptr.nwords = 0
+		ptr.total = 0
+		ptr.files = 0
+		ptr.magic = magic
+	}
+}
+
+/*
+ * hash -- 64-bit FNV-1a of word, reduced to the buckets of b
+ */
+func hash(b *buckets_t, word string) int {
+	h := fnv.New64a()
+	h.Write([]byte(word))
+	return int(h.Sum64() % uint64(len(b.bucket)))
+}
+
+/*
+ * wc_find -- (internal) returns the entry of word, or nil
+ */
+func wc_find(ptr *data, word string) *entry_t {
+	b := ptr.buckets
+	for e := b.bucket[hash(b, word)]; e != nil; e = e.next {
+		if string(e.word) == word {
+			return e
+		}
+	}
+	return nil
+}
+
+/*
+ * wc_rebuild -- (internal) moves every entry to a table of new_len buckets;
+ * must be called in a transaction
+ */
+func wc_rebuild(ptr *data, new_len int) {
+	buckets_new := new_buckets(new_len)
+	for _, e := range ptr.buckets.bucket {
+		for e != nil {
+			next := e.next
+			h := hash(buckets_new, string(e.word))
+			e.next = buckets_new.bucket[h]
+			buckets_new.bucket[h] = e
+			e = next
+		}
+	}
+	ptr.buckets = buckets_new
+}
+
+/*
+ * wc_add -- (internal) adds n to the count of word, creating its entry;
+ * must be called in a transaction
+ */
+func wc_add(ptr *data, word string, n int) {
+	if e := wc_find(ptr, word); e != nil {
+		e.count += n
+		ptr.total += n
+		return
+	}
+	e := pnew(entry_t)
+	e.word = pmake([]byte, len(word))
+	copy(e.word, word)
+	e.count = n
+	b := ptr.buckets
+	h := hash(b, word)
+	e.next = b.bucket[h]
+	b.bucket[h] = e
+	ptr.nwords++
+	ptr.total += n
+
+	if ptr.nwords > MAX_LOAD_FACTOR * len(b.bucket) {
+		wc_rebuild(ptr, len(b.bucket) * 2)
+	}
+}
+
+/*
+ * wc_tokenize -- calls cb for every word read from r: a run of letters and
+ * digits, lowercased
+ */
+func wc_tokenize(r io.Reader, cb func(string)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		words := strings.FieldsFunc(scanner.Text(), func(c rune) bool {
+			return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+		})
+		for _, w := range words {
+			cb(strings.ToLower(w))
+		}
+	}
+	return scanner.Err()
+}
+
+/*
+ * wc_count -- counts the words read from r; they are tallied in volatile
+ * memory first and merged into the map in a single transaction, so a file
+ * is counted whole or not at all, and a full pool rolls it back with
+ * ErrPoolFull; returns the number of words read
+ */
+func wc_count(ptr *data, r io.Reader) (n int, err error) {
+	counts := make(map[string]int)
+	if err := wc_tokenize(r, func(word string) {
+		counts[word]++
+		n++
+	}); err != nil {
+		return 0, err
+	}
+
+	/* sorted so that a count is merged the same way every time */
+	words := make([]string, 0, len(counts))
+	for w := range counts {
+		words = append(words, w)
+	}
+	sort.Strings(words)
+	defer pool_full(&err)
+	txn("undo") {
+		for _, w := range words {
+			wc_add(ptr, w, counts[w])
+		}
+		ptr.files++
+	}
+	return n, nil
+}
+
+/*
+ * wc_count_file -- wc_count on the file of path
+ */
+func wc_count_file(ptr *data, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return wc_count(ptr, f)
+}
+
+/*
+ * wc_get -- returns the count of word
+ */
+func wc_get(ptr *data, word string) int {
+	if e := wc_find(ptr, strings.ToLower(word)); e != nil {
+		return e.count
+	}
+	return 0
+}
+
+/*
+ * wc_remove -- forgets word, returning its count
+ */
+func wc_remove(ptr *data, word string) int {
+	word = strings.ToLower(word)
+	b := ptr.buckets
+	link := &b.bucket[hash(b, word)]
+	for *link != nil && string((*link).word) != word {
+		link = &(*link).next
+	}
+	e := *link
+	if e == nil {
+		return 0
+	}
+	txn("undo") {
+		*link = e.next
+		ptr.nwords--
+		ptr.total -= e.count
+	}
+	return e.count
+}
+
+/*
+ * wc_foreach -- calls cb for every word with its count, bucket by bucket,
+ * stopping early when cb returns true
+ */
+func wc_foreach(ptr *data, cb func(string, int) bool) bool {
+	for _, e := range ptr.buckets.bucket {
+		for ; e != nil; e = e.next {
+			if cb(string(e.word), e.count) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * wc_top -- returns the n most frequent words, ties broken by word
+ */
+func wc_top(ptr *data, n int) ([]string, []int) {
+	var words []string
+	counts := make(map[string]int)
+	wc_foreach(ptr, func(word string, count int) bool {
+		words = append(words, word)
+		counts[word] = count
+		return false
+	})
+	sort.Slice(words, func(i, j int) bool {
+		a, b := counts[words[i]], counts[words[j]]
+		return a > b || (a == b && words[i] < words[j])
+	})
+	if n < len(words) {
+		words = words[:n]
+	}
+	top := make([]int, len(words))
+	for i, w := range words {
+		top[i] = counts[w]
+	}
+	return words, top
+}
+
+/*
+ * wc_clear -- forgets all words and files
+ */
+func wc_clear(ptr *data) (err error) {
+	defer pool_full(&err)
+	txn("undo") {
+		b := new_buckets(INIT_BUCKETS_NUM)
+		ptr.buckets = b
+		ptr.nwords = 0
+		ptr.total = 0
+		ptr.files = 0
+	}
+	return nil
+}
+
+/*
+ * wc_check -- verifies that every word is in the bucket of its hash, that no
+ * word is stored twice, and that the totals are right; returns the longest
+ * chain
+ */
+func wc_check(ptr *data) (int, error) {
+	seen := make(map[string]bool)
+	total, longest := 0, 0
+	for i, e := range ptr.buckets.bucket {
+		chain := 0
+		for ; e != nil; e = e.next {
+			w := string(e.word)
+			if hash(ptr.buckets, w) != i {
+				return 0, fmt.Errorf("word %q is in bucket %d", w, i)
+			}
+			if seen[w] {
+				return 0, fmt.Errorf("word %q is stored twice", w)
+			}
+			if e.count <= 0 {
+				return 0, fmt.Errorf("word %q has count %d", w, e.count)
+			}
+			seen[w] = true
+			total += e.count
+			chain++
+		}
+		if chain > longest {
+			longest = chain
+		}
+	}
+	if len(seen) != ptr.nwords || total != ptr.total {
+		return 0, fmt.Errorf("%d words counted %d times, totals are %d and %d",
+			len(seen), total, ptr.nwords, ptr.total)
+	}
+	return longest, nil
+}
+
+/*
+ * str_count_file -- counts the words of the file given as a string
+ */
+func str_count_file(ptr *data, str string) {
+	path := strings.TrimSpace(str)
+	if len(path) == 0 {
+		fmt.Println("count: invalid syntax")
+		return
+	}
+	if n, err := wc_count_file(ptr, path); err == nil {
+		fmt.Println(n)
+	} else {
+		fmt.Println("count:", err)
+	}
+}
+
+/*
+ * str_count_line -- counts the words of the rest of the line
+ */
+func str_count_line(ptr *data, str string) {
+	if _, err := wc_count(ptr, strings.NewReader(str)); err != nil {
+		fmt.Println("count:", err)
+	}
+}
+
+/*
+ * str_get -- prints the count of the word given as a string
+ */
+func str_get(ptr *data, str string) {
+	var word string
+	if scan_args("get", str, "%s", &word) {
+		fmt.Println(wc_get(ptr, word))
+	}
+}
+
+/*
+ * str_remove -- wc_remove wrapper which works on strings
+ */
+func str_remove(ptr *data, str string) {
+	var word string
+	if scan_args("remove", str, "%s", &word) {
+		if wc_remove(ptr, word) == 0 {
+			fmt.Println("no such word")
+		}
+	}
+}
+
+/*
+ * print_top -- prints the n most frequent words with their count
+ */
+func print_top(ptr *data, n int) {
+	words, counts := wc_top(ptr, n)
+	for i, w := range words {
+		fmt.Println(w, counts[i])
+	}
+}
+
+/*
+ * str_top -- print_top wrapper which works on strings
+ */
+func str_top(ptr *data, str string) {
+	var n int
+	if _, err := fmt.Sscanf(str, "%d", &n); err == nil && n > 0 {
+		print_top(ptr, n)
+	} else {
+		fmt.Println("top: invalid syntax")
+	}
+}
+
+/*
+ * str_clear -- wc_clear wrapper which reports its error
+ */
+func str_clear(ptr *data) {
+	if err := wc_clear(ptr); err != nil {
+		fmt.Println("clear:", err)
+	}
+}
+
+func help() {
+	print_help(
+		"f $path - count the words of the file $path, print how many",
+		"l $text - count the words of $text",
+		"g $word - print the count of $word",
+		"r $word - forget $word",
+		"t $n - print the $n most frequent words",
+		"p - print all words with their count",
+		"d - print debug info",
+		"x - forget all words",
+	)
+}
+
+func print_all(ptr *data) {
+	print_top(ptr, ptr.nwords)
+}
+
+func print_debug(ptr *data) {
+	if longest, err := wc_check(ptr); err != nil {
+		fmt.Println("invariants:", err)
+	} else {
+		fmt.Println("invariants: ok")
+		fmt.Println("files:", ptr.files, "words:", ptr.total, "distinct:", ptr.nwords)
+		fmt.Println("buckets:", len(ptr.buckets.bucket), "longest chain:", longest)
+	}
+}
+
+/*
+ * Run -- opens the map named in args (the command line without the program
+ * name) and serves commands read from the standard input until 'q' or EOF
+ */
+func Run(args []string) error {
+	flags := flag.NewFlagSet("wordcount", flag.ContinueOnError)
+	flags.Usage = func() {}
+	top := flags.Int("top", WC_DEFAULT_TOP, "number of words printed after counting the inputs")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	args = flags.Args()
+	if len(args) < 1 {
+		return ErrUsage
+	}
+	if *top <= 0 {
+		return usage_error("the number of top words must be positive")
+	}
+
+	var ptr *data
+	root, err := open_root(args[0], ptr)
+	if err != nil {
+		return err
+	}
+	ptr = (*data)(root)
+	if ptr.magic != magic {
+		initialize(ptr)
+	}
+
+	/* with inputs, count them, print the most frequent words and exit */
+	if inputs := args[1:]; len(inputs) > 0 {
+		for _, path := range inputs {
+			if _, err := wc_count_file(ptr, path); err != nil {
+				return err
+			}
+		}
+		print_top(ptr, *top)
+		return nil
+	}
+
+	return run_commands(os.Stdin, func(buf string) {
+		switch (buf[0]) {
+			case 'f': str_count_file(ptr, buf[1:])
+			case 'l': str_count_line(ptr, buf[1:])
+			case 'g': str_get(ptr, buf[1:])
+			case 'r': str_remove(ptr, buf[1:])
+			case 't': str_top(ptr, buf[1:])
+			case 'p': print_all(ptr)
+			case 'd': print_debug(ptr)
+			case 'x': str_clear(ptr)
+			case 'h': help()
+			default: unknown_command(buf)
+		}
+	})
+}
+
+func main() {
+	handle_signals()
+	err := Run(os.Args[1:])
+	if err == ErrUsage {
+		fmt.Println("usage:", os.Args[0], "[-top n] filename [input...]")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+	shutdown(exit_status(err))
+}